@@ -0,0 +1,362 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// openIPAM opens one IPAM instance per configured address family, IPv4 first
+func openIPAM(conf *PluginConf) ([]*ipam.IPAM, error) {
+	configs := []*ipam.Config{{
+		Subnet:  conf.Subnet,
+		Gateway: conf.Gateway,
+		DataDir: conf.DataDir,
+		Network: conf.Name,
+	}}
+	if conf.IPv6Subnet != "" {
+		configs = append(configs, &ipam.Config{
+			Subnet:  conf.IPv6Subnet,
+			Gateway: conf.IPv6Gateway,
+			DataDir: conf.DataDir,
+			Network: conf.Name,
+		})
+	}
+
+	ipams := make([]*ipam.IPAM, 0, len(configs))
+	for _, config := range configs {
+		ipamInstance, err := ipam.New(config)
+		if err != nil {
+			return nil, ipamError("failed to initialize IPAM", err)
+		}
+		ipams = append(ipams, ipamInstance)
+	}
+	return ipams, nil
+}
+
+// namedSubnet is a subnet along with the setting holding it
+type namedSubnet struct {
+	field string
+	net   *net.IPNet
+}
+
+// subnetSet collects the subnets of a network and its segments or
+// attachments, which are routed to each other through the host, so none may
+// overlap another
+type subnetSet []namedSubnet
+
+// newSubnetSet returns the set of the network's own subnets
+func newSubnetSet(c *PluginConf) *subnetSet {
+	s := &subnetSet{}
+	s.add("subnet", c.Subnet)
+	s.add("ipv6Subnet", c.IPv6Subnet)
+	return s
+}
+
+// add adds the subnet, skipping invalid ones, and returns the problems with
+// it overlapping those added before
+func (s *subnetSet) add(field, cidr string) []string {
+	_, sn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	var problems []string
+	for _, other := range *s {
+		if other.net.Contains(sn.IP) || sn.Contains(other.net.IP) {
+			problems = append(problems, fmt.Sprintf("%s %s overlaps %s %s", field, sn, other.field, other.net))
+		}
+	}
+	*s = append(*s, namedSubnet{field, sn})
+	return problems
+}
+
+// gatewayAddrs returns the gateway addresses of every configured subnet
+func gatewayAddrs(conf *PluginConf) []*net.IPNet {
+	var addrs []*net.IPNet
+	ranges := [][2]string{{conf.Subnet, conf.Gateway}, {conf.IPv6Subnet, conf.IPv6Gateway}}
+	for _, r := range ranges {
+		if r[0] == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(r[0])
+		if err != nil {
+			continue // Rejected by validation
+		}
+		addrs = append(addrs, &net.IPNet{IP: net.ParseIP(r[1]), Mask: subnet.Mask})
+	}
+	return addrs
+}
+
+// allocateIPs allocates one address per IPAM instance for the attachment,
+// using the requested addresses where given, and records the pod owning it
+func allocateIPs(ipams []*ipam.IPAM, id string, requested []string, owner ipam.Owner) ([]*current.IPConfig, error) {
+	wanted, err := matchRequestedIPs(ipams, requested)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate an address from every subnet
+	ips := make([]*current.IPConfig, 0, len(ipams))
+	for _, ipamInstance := range ipams {
+		ip, ok := wanted[ipamInstance]
+		if ok {
+			if err := ipamInstance.AllocateIP(id, ip); err != nil {
+				return nil, ipamError("failed to allocate requested IP", err)
+			}
+		} else {
+			var err error
+			ip, err = ipamInstance.Allocate(id)
+			if err != nil {
+				return nil, ipamError("failed to allocate IP", err)
+			}
+		}
+		if !owner.IsEmpty() {
+			if err := ipamInstance.SetOwner(id, owner); err != nil {
+				return nil, ipamError("failed to record allocation owner", err)
+			}
+		}
+		ips = append(ips, &current.IPConfig{
+			Address: net.IPNet{IP: ip, Mask: ipamInstance.Subnet.Mask},
+			Gateway: ipamInstance.Gateway,
+		})
+	}
+	return ips, nil
+}
+
+// previewIPs returns the addresses allocateIPs would allocate, without
+// saving them
+func previewIPs(ipams []*ipam.IPAM, id string, requested []string) ([]*current.IPConfig, error) {
+	wanted, err := matchRequestedIPs(ipams, requested)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]*current.IPConfig, 0, len(ipams))
+	for _, ipamInstance := range ipams {
+		ip, err := ipamInstance.Preview(id, wanted[ipamInstance])
+		if err != nil {
+			return nil, ipamError("failed to allocate IP", err)
+		}
+		ips = append(ips, &current.IPConfig{
+			Address: net.IPNet{IP: ip, Mask: ipamInstance.Subnet.Mask},
+			Gateway: ipamInstance.Gateway,
+		})
+	}
+	return ips, nil
+}
+
+// matchRequestedIPs matches the requested addresses to the IPAM instance of
+// their address family
+func matchRequestedIPs(ipams []*ipam.IPAM, requested []string) (map[*ipam.IPAM]net.IP, error) {
+	wanted := make(map[*ipam.IPAM]net.IP)
+	for _, req := range requested {
+		ip := parseRequestedIP(req)
+		if ip == nil {
+			return nil, configError(fmt.Sprintf("invalid requested IP %q", req), nil)
+		}
+		var match *ipam.IPAM
+		for _, ipamInstance := range ipams {
+			if (ip.To4() != nil) == (ipamInstance.Subnet.IP.To4() != nil) {
+				match = ipamInstance
+				break
+			}
+		}
+		if match == nil {
+			return nil, configError(fmt.Sprintf("no subnet configured for the address family of requested IP %s", ip), nil)
+		}
+		if _, ok := wanted[match]; ok {
+			return nil, configError(fmt.Sprintf("more than one IP requested from subnet %s", match.Subnet), nil)
+		}
+		wanted[match] = ip
+	}
+	return wanted, nil
+}
+
+// releaseIPs releases the addresses of the attachment and returns them. An
+// allocation made before allocations were keyed by attachment is released as
+// well if it belongs to the subnet.
+func releaseIPs(ipams []*ipam.IPAM, containerID, ifName string) ([]net.IP, error) {
+	var released []net.IP
+	for _, ipamInstance := range ipams {
+		key := attachmentKey(containerID, ifName)
+		if ip, ok := ipamInstance.Allocations[key]; ok {
+			if err := ipamInstance.Release(key); err != nil {
+				return nil, ipamError("failed to release IP", err)
+			}
+			released = append(released, ip)
+		}
+		if ip, ok := ipamInstance.Allocations[containerID]; ok && ipamInstance.Subnet.Contains(ip) {
+			if err := ipamInstance.Release(containerID); err != nil {
+				return nil, ipamError("failed to release IP", err)
+			}
+			released = append(released, ip)
+		}
+	}
+	return released, nil
+}
+
+// attachmentIPs returns the addresses the attachment holds, reading the
+// allocations under the network lock
+func attachmentIPs(ctx context.Context, conf *PluginConf, containerID, ifName string) ([]net.IP, error) {
+	unlock, err := lockNetwork(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, ipamInstance := range ipams {
+		if ip, ok := ipamInstance.Allocations[attachmentKey(containerID, ifName)]; ok {
+			ips = append(ips, ip)
+		}
+		if ip, ok := ipamInstance.Allocations[containerID]; ok && ipamInstance.Subnet.Contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// heldIPs reports for every IPAM instance whether the attachment already
+// holds an address in it, as after a repeated ADD
+func heldIPs(ipams []*ipam.IPAM, key string) []bool {
+	held := make([]bool, len(ipams))
+	for i, ipamInstance := range ipams {
+		_, held[i] = ipamInstance.Allocations[key]
+	}
+	return held
+}
+
+// rollbackIPs releases the addresses a failed ADD allocated, and removes the
+// masquerade rules once no container holds an address anymore. ADD has given
+// up the network lock by then, so the allocations are reloaded under it.
+// Undoing isn't bound by the command's deadline, only by the lock's.
+func rollbackIPs(conf *PluginConf, key string, held []bool) error {
+	unlock, err := lockNetwork(context.Background(), conf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return err
+	}
+
+	var released []net.IP
+	for i, ipamInstance := range ipams {
+		ip, ok := ipamInstance.Allocations[key]
+		if !ok || held[i] {
+			continue
+		}
+		if err := ipamInstance.Release(key); err != nil {
+			return ipamError("failed to release IP", err)
+		}
+		released = append(released, ip)
+	}
+	if err := flushConntrack(released); err != nil {
+		return err
+	}
+	if conf.IPMasq {
+		return teardownIPMasq(conf, ipams)
+	}
+	return nil
+}
+
+// flushConntrack deletes the connection tracking entries of released
+// addresses, so a container reusing one doesn't inherit their NAT and flow
+// state. Entries are matched on the original direction and, for flows
+// translated to or from the address, on the reply direction.
+func flushConntrack(ips []net.IP) error {
+	for _, ip := range ips {
+		family := netlink.InetFamily(unix.AF_INET)
+		if ip.To4() == nil {
+			family = unix.AF_INET6
+		}
+		var filters []netlink.CustomConntrackFilter
+		for _, tp := range []netlink.ConntrackFilterType{netlink.ConntrackOrigSrcIP, netlink.ConntrackOrigDstIP, netlink.ConntrackReplyAnyIP} {
+			filter := &netlink.ConntrackFilter{}
+			if err := filter.AddIP(tp, ip); err != nil {
+				return newError(types.ErrInternal, "failed to build conntrack filter", err)
+			}
+			filters = append(filters, filter)
+		}
+		if _, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family, filters...); err != nil {
+			// Without conntrack loaded there are no entries to delete
+			if errors.Is(err, unix.EPROTONOSUPPORT) {
+				return nil
+			}
+			return netlinkError(fmt.Sprintf("failed to delete conntrack entries of %s", ip), err)
+		}
+	}
+	return nil
+}
+
+// parseRequestedIP parses an address given either plain or in CIDR notation
+func parseRequestedIP(s string) net.IP {
+	if strings.Contains(s, "/") {
+		ip, _, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return ip
+	}
+	return net.ParseIP(s)
+}
+
+// firewall returns the backend managing the network's NAT rules
+func firewall(conf *PluginConf) (fw.Backend, error) {
+	backend, err := fw.New(conf.FirewallBackend)
+	if err != nil {
+		return nil, newError(types.ErrInternal, "failed to select firewall backend", err)
+	}
+	return backend, nil
+}
+
+// setupIPMasq installs the network's masquerade rules for every subnet
+func setupIPMasq(conf *PluginConf, ipams []*ipam.IPAM) error {
+	backend, err := firewall(conf)
+	if err != nil {
+		return err
+	}
+	for _, ipamInstance := range ipams {
+		if err := backend.SetupMasquerade(conf.Name, ipamInstance.Subnet); err != nil {
+			return newError(types.ErrInternal, "failed to setup IP masquerading", err)
+		}
+	}
+	return nil
+}
+
+// teardownIPMasq removes the network's masquerade rules once no container
+// holds an address in any of its subnets anymore. Rules are removed with
+// every backend on the host, so none are left behind if the backend changed
+// since they were installed.
+func teardownIPMasq(conf *PluginConf, ipams []*ipam.IPAM) error {
+	for _, ipamInstance := range ipams {
+		if ipamInstance.Count() > 0 {
+			return nil // Still in use
+		}
+	}
+	for _, backend := range fw.Available() {
+		for _, ipamInstance := range ipams {
+			if err := backend.TeardownMasquerade(conf.Name, ipamInstance.Subnet); err != nil {
+				return newError(types.ErrInternal, "failed to teardown IP masquerading", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/antispoof"
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+// setupAntiSpoofing installs the filters on the attachment's host-side port
+// that drop traffic not sent from the container's MAC and addresses
+func setupAntiSpoofing(conf *PluginConf, args *skel.CmdArgs, hostPort, containerIface net.Interface, containerIPs []*current.IPConfig, undo *rollback) error {
+	port := &antispoof.Port{
+		Attachment: attachmentKey(args.ContainerID, args.IfName),
+		Device:     hostPort.Name,
+		MAC:        containerIface.HardwareAddr,
+	}
+	// A tap is the VM's port itself, and the guest picks its own MAC
+	if conf.Mode == modeTap {
+		port.Device = containerIface.Name
+		port.MAC = nil
+	}
+	for _, ipc := range containerIPs {
+		port.IPs = append(port.IPs, ipc.Address.IP)
+	}
+
+	if conf.bpfAntiSpoofing() {
+		if err := setupBPFAntiSpoofing(conf, port); err != nil {
+			return err
+		}
+	} else if err := antispoof.Setup(antispoof.TableName(conf.VxlanID), port); err != nil {
+		return newError(types.ErrInternal, "failed to install anti-spoofing filters", err)
+	}
+	undo.add(func() error { return teardownAntiSpoofing(conf, args.ContainerID, args.IfName) })
+	return nil
+}
+
+// setupBPFAntiSpoofing attaches the program checking the port's traffic
+// and sets the port's MAC and addresses in its maps
+func setupBPFAntiSpoofing(conf *PluginConf, port *antispoof.Port) error {
+	if err := mountBPF(conf); err != nil {
+		return err
+	}
+	maps, err := antispoof.OpenMaps(bpfDir(conf))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open anti-spoofing maps", err)
+	}
+	defer maps.Close()
+	link, err := netlink.LinkByName(port.Device)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to find %s", port.Device), err)
+	}
+	// The port is known before the program drops the traffic of unknown ones
+	if err := maps.SetPort(link.Attrs().Index, port); err != nil {
+		return newError(types.ErrInternal, "failed to set anti-spoofing port", err)
+	}
+	prog, err := antispoof.Program(maps)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load anti-spoofing program", err)
+	}
+	defer prog.Close()
+	if err := bpf.AttachIngress(link, prog, antispoof.Filter, antispoof.FilterPriority); err != nil {
+		return netlinkError("failed to attach anti-spoofing program", err)
+	}
+	return nil
+}
+
+// teardownAntiSpoofing removes the filters of the attachment's port
+func teardownAntiSpoofing(conf *PluginConf, containerID, ifName string) error {
+	if conf.bpfAntiSpoofing() {
+		return pruneBPFAntiSpoofing(conf, func(alias string) bool {
+			return ownedBy(alias, containerID, ifName)
+		})
+	}
+	if err := antispoof.Teardown(antispoof.TableName(conf.VxlanID), attachmentKey(containerID, ifName)); err != nil {
+		return newError(types.ErrInternal, "failed to remove anti-spoofing filters", err)
+	}
+	return nil
+}
+
+// checkAntiSpoofing verifies that the filters of the attachment's port are
+// installed
+func checkAntiSpoofing(conf *PluginConf, args *skel.CmdArgs) error {
+	if conf.bpfAntiSpoofing() {
+		return checkBPFAntiSpoofing(conf, args)
+	}
+	key := attachmentKey(args.ContainerID, args.IfName)
+	attachments, err := antispoof.Attachments(antispoof.TableName(conf.VxlanID))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list anti-spoofing filters", err)
+	}
+	if attachments[antispoof.ChainName(key)] != key {
+		return newError(types.ErrInternal, fmt.Sprintf("no anti-spoofing filters for %s", args.IfName), nil)
+	}
+	return nil
+}
+
+// gcAntiSpoofing removes the filters of attachments the runtime no longer
+// knows about
+func gcAntiSpoofing(conf *PluginConf, validAttachments map[string]bool) error {
+	if conf.bpfAntiSpoofing() {
+		return pruneBPFAntiSpoofing(conf, func(alias string) bool {
+			key, owned := parseAttachmentAlias(alias)
+			return owned && !validAttachments[key]
+		})
+	}
+	table := antispoof.TableName(conf.VxlanID)
+	attachments, err := antispoof.Attachments(table)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list anti-spoofing filters", err)
+	}
+	for _, key := range attachments {
+		if validAttachments[key] {
+			continue
+		}
+		if err := antispoof.Teardown(table, key); err != nil {
+			return newError(types.ErrInternal, "failed to remove orphaned anti-spoofing filters", err)
+		}
+	}
+	return nil
+}
+
+// checkBPFAntiSpoofing verifies that the program is attached to the
+// attachment's port and knows the port
+func checkBPFAntiSpoofing(conf *PluginConf, args *skel.CmdArgs) error {
+	name, err := hostPortName(conf, args)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", name), err)
+	}
+	attached, err := bpf.IngressAttached(link, antispoof.Filter, antispoof.FilterPriority)
+	if err != nil {
+		return netlinkError("failed to list filters", err)
+	}
+	if !attached {
+		return newError(types.ErrInternal, fmt.Sprintf("no anti-spoofing program on %s", name), nil)
+	}
+	maps, err := antispoof.OpenExistingMaps(bpfDir(conf))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open anti-spoofing maps", err)
+	}
+	defer maps.Close()
+	known, err := maps.HasPort(link.Attrs().Index)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to look up anti-spoofing port", err)
+	}
+	if !known {
+		return newError(types.ErrInternal, fmt.Sprintf("no anti-spoofing port for %s", name), nil)
+	}
+	return nil
+}
+
+// pruneBPFAntiSpoofing removes the ports whose interfaces are gone, or
+// whose alias is stale, from the program's maps
+func pruneBPFAntiSpoofing(conf *PluginConf, stale func(alias string) bool) error {
+	maps, err := antispoof.OpenExistingMaps(bpfDir(conf))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open anti-spoofing maps", err)
+	}
+	defer maps.Close()
+	ifindexes, err := maps.Ports()
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list anti-spoofing ports", err)
+	}
+	for _, ifindex := range ifindexes {
+		if link, err := netlink.LinkByIndex(ifindex); err == nil && !stale(link.Attrs().Alias) {
+			continue
+		}
+		if err := maps.DeletePort(ifindex); err != nil {
+			return newError(types.ErrInternal, "failed to remove anti-spoofing port", err)
+		}
+	}
+	return nil
+}
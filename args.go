@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// EnvArgs represents the CNI_ARGS keys understood by the plugin
+type EnvArgs struct {
+	types.CommonArgs
+	IP                types.UnmarshallableString `json:"ip,omitempty"`
+	MAC               types.UnmarshallableString `json:"mac,omitempty"`
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+	K8S_POD_UID       types.UnmarshallableString
+}
+
+// parseEnvArgs parses CNI_ARGS, ignoring keys the plugin doesn't know
+func parseEnvArgs(args string) (*EnvArgs, error) {
+	envArgs := &EnvArgs{}
+	envArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args, envArgs); err != nil {
+		return nil, newError(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS", err)
+	}
+	return envArgs, nil
+}
+
+// owner returns the pod identity passed by the runtime, if any
+func (e *EnvArgs) owner() ipam.Owner {
+	return ipam.Owner{
+		PodNamespace: string(e.K8S_POD_NAMESPACE),
+		PodName:      string(e.K8S_POD_NAME),
+		PodUID:       string(e.K8S_POD_UID),
+	}
+}
+
+// containerMAC returns the MAC requested for the container interface, or
+// an empty string to let the kernel pick one. The mac capability takes
+// precedence over CNI_ARGS.
+func containerMAC(conf *PluginConf, envArgs *EnvArgs) (string, error) {
+	mac := string(envArgs.MAC)
+	if conf.RuntimeConfig.Mac != "" {
+		mac = conf.RuntimeConfig.Mac
+	}
+	if mac == "" {
+		return "", nil
+	}
+
+	if _, err := net.ParseMAC(mac); err != nil {
+		return "", configError(fmt.Sprintf("invalid MAC address %q", mac), err)
+	}
+	return mac, nil
+}
+
+// requestedIPs returns the addresses requested for the container. The ips
+// capability takes precedence over args.cni.ips, which takes precedence over
+// the addresses pinned by the pod's annotation, then the comma-separated IP
+// key in CNI_ARGS.
+func requestedIPs(conf *PluginConf, envArgs *EnvArgs, pinned []string) []string {
+	if len(conf.RuntimeConfig.IPs) > 0 {
+		return conf.RuntimeConfig.IPs
+	}
+	if conf.Args != nil && len(conf.Args.CNI.IPs) > 0 {
+		return conf.Args.CNI.IPs
+	}
+	if len(pinned) > 0 {
+		return pinned
+	}
+	if envArgs.IP == "" {
+		return nil
+	}
+	return strings.Split(string(envArgs.IP), ",")
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEnvArgs(t *testing.T) {
+	envArgs, err := parseEnvArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;K8S_POD_UID=1234;" +
+		"K8S_POD_INFRA_CONTAINER_ID=abc;IP=10.244.0.5,fd00::5;MAC=0a:58:0a:f4:00:05")
+	if err != nil {
+		t.Fatalf("Failed to parse CNI_ARGS: %v", err)
+	}
+
+	// Pod identity
+	owner := envArgs.owner()
+	if owner.PodNamespace != "default" || owner.PodName != "web" || owner.PodUID != "1234" {
+		t.Fatalf("Unexpected pod identity: %+v", owner)
+	}
+
+	// Requested IPs from CNI_ARGS, overridden by the pod's annotation, args.cni
+	// and the ips capability
+	conf := &PluginConf{}
+	if ips := requestedIPs(conf, envArgs, nil); len(ips) != 2 || ips[0] != "10.244.0.5" || ips[1] != "fd00::5" {
+		t.Fatalf("Expected IPs from CNI_ARGS, got %v", ips)
+	}
+	if ips := requestedIPs(conf, envArgs, []string{"10.244.0.8"}); len(ips) != 1 || ips[0] != "10.244.0.8" {
+		t.Fatalf("Expected IPs pinned by the pod, got %v", ips)
+	}
+	conf.Args = &ArgsConf{CNI: CNIArgs{IPs: []string{"10.244.0.7"}}}
+	if ips := requestedIPs(conf, envArgs, []string{"10.244.0.8"}); len(ips) != 1 || ips[0] != "10.244.0.7" {
+		t.Fatalf("Expected IPs from args.cni, got %v", ips)
+	}
+	conf.RuntimeConfig.IPs = []string{"10.244.0.6/16"}
+	if ips := requestedIPs(conf, envArgs, nil); len(ips) != 1 || ips[0] != "10.244.0.6/16" {
+		t.Fatalf("Expected IPs from runtimeConfig, got %v", ips)
+	}
+
+	// MAC from CNI_ARGS, overridden by the mac capability
+	mac, err := containerMAC(conf, envArgs)
+	if err != nil {
+		t.Fatalf("Failed to resolve MAC: %v", err)
+	}
+	if mac != "0a:58:0a:f4:00:05" {
+		t.Fatalf("Expected MAC from CNI_ARGS, got %q", mac)
+	}
+	conf.RuntimeConfig.Mac = "0a:58:0a:f4:00:06"
+	mac, err = containerMAC(conf, envArgs)
+	if err != nil {
+		t.Fatalf("Failed to resolve MAC: %v", err)
+	}
+	if mac != "0a:58:0a:f4:00:06" {
+		t.Fatalf("Expected MAC from runtimeConfig, got %q", mac)
+	}
+
+	// Invalid MACs are rejected
+	conf.RuntimeConfig.Mac = "not-a-mac"
+	if _, err := containerMAC(conf, envArgs); err == nil {
+		t.Fatalf("Expected invalid MAC to be rejected")
+	}
+}
@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// AttachmentConf adds a further interface to the container, on a VXLAN
+// segment and subnets of its own, e.g. a back-end network next to the
+// network's front-end one
+type AttachmentConf struct {
+	Name        string      `json:"name"`
+	IfName      string      `json:"ifName"`
+	VxlanID     int         `json:"vxlanID"`
+	Subnet      string      `json:"subnet"`
+	Gateway     string      `json:"gateway"`
+	IPv6Subnet  string      `json:"ipv6Subnet,omitempty"`
+	IPv6Gateway string      `json:"ipv6Gateway,omitempty"`
+	Routes      []RouteConf `json:"routes,omitempty"`
+}
+
+// validateAttachments returns the problems with the further attachments
+func (c *PluginConf) validateAttachments() []string {
+	if len(c.Attachments) == 0 {
+		return nil
+	}
+	var problems []string
+	// The attachments keep their state under names derived from the
+	// network's
+	if c.Name == "" {
+		problems = append(problems, "attachments requires name")
+	}
+	if len(c.NamespaceVNIs) > 0 {
+		problems = append(problems, "attachments can't be combined with namespaceVNIs")
+	}
+	names := make(map[string]int)
+	ifNames := make(map[string]int)
+	vnis := map[int]string{c.VxlanID: "vxlanID"}
+	subnets := newSubnetSet(c)
+	for i, a := range c.Attachments {
+		field := fmt.Sprintf("attachments[%d]", i)
+		if !networkNameRE.MatchString(a.Name) {
+			problems = append(problems, fmt.Sprintf("%s.name %q must start with a letter or digit and hold only letters, digits, '_', '.' and '-'", field, a.Name))
+		} else if j, ok := names[a.Name]; ok {
+			problems = append(problems, fmt.Sprintf("%s.name %s is that of attachments[%d]", field, a.Name, j))
+		}
+		names[a.Name] = i
+		if a.IfName == "" {
+			problems = append(problems, field+".ifName must be specified")
+		} else if j, ok := ifNames[a.IfName]; ok {
+			problems = append(problems, fmt.Sprintf("%s.ifName %s is that of attachments[%d]", field, a.IfName, j))
+		}
+		ifNames[a.IfName] = i
+		if a.VxlanID < 1 || a.VxlanID > vxlan.MaxVxlanVNI {
+			problems = append(problems, fmt.Sprintf("%s.vxlanID %d out of range (1-%d)", field, a.VxlanID, vxlan.MaxVxlanVNI))
+		} else if other, ok := vnis[a.VxlanID]; ok {
+			problems = append(problems, fmt.Sprintf("%s.vxlanID %d is that of %s", field, a.VxlanID, other))
+		}
+		vnis[a.VxlanID] = field
+		if a.Subnet == "" {
+			problems = append(problems, field+".subnet must be specified")
+		}
+		if a.Gateway == "" {
+			problems = append(problems, field+".gateway must be specified")
+		}
+		problems = append(problems, validateRange(field+".subnet", a.Subnet, a.Gateway, false)...)
+		if a.IPv6Subnet != "" || a.IPv6Gateway != "" {
+			if a.IPv6Subnet == "" {
+				problems = append(problems, field+".ipv6Subnet must be specified with ipv6Gateway")
+			}
+			if a.IPv6Gateway == "" {
+				problems = append(problems, field+".ipv6Gateway must be specified with ipv6Subnet")
+			}
+			problems = append(problems, validateRange(field+".ipv6Subnet", a.IPv6Subnet, a.IPv6Gateway, true)...)
+		}
+		problems = append(problems, subnets.add(field+".subnet", a.Subnet)...)
+		problems = append(problems, subnets.add(field+".ipv6Subnet", a.IPv6Subnet)...)
+		for _, route := range a.Routes {
+			problems = append(problems, route.validate()...)
+		}
+	}
+	return problems
+}
+
+// attached returns the configuration of a further attachment: the
+// network's, on the attachment's VNI, subnets and routes, and named after
+// both so its addresses, records and lock are its own. The default route,
+// the runtime's capabilities and the per-attachment overrides stay with the
+// network's interface.
+func (c *PluginConf) attached(a AttachmentConf) *PluginConf {
+	s := *c
+	s.Name = c.Name + "-" + a.Name
+	s.VxlanID = a.VxlanID
+	s.Subnet, s.Gateway = a.Subnet, a.Gateway
+	s.IPv6Subnet, s.IPv6Gateway = a.IPv6Subnet, a.IPv6Gateway
+	s.Routes = a.Routes
+	s.DefaultRoute = &DefaultRouteConf{Disabled: true}
+	s.RuntimeConfig = RuntimeConf{DNS: c.RuntimeConfig.DNS}
+	s.Args = nil
+	s.NamespaceRanges = nil
+	s.Attachments = nil
+	return &s
+}
+
+// attachedNetworks returns the configurations of the further attachments
+func (c *PluginConf) attachedNetworks() []*PluginConf {
+	var networks []*PluginConf
+	for _, a := range c.Attachments {
+		networks = append(networks, c.attached(a))
+	}
+	return networks
+}
+
+// attachedArgs returns the arguments of a further attachment: those of the
+// invocation on the attachment's interface. The addresses and MAC requested
+// in CNI_ARGS are the network's interface's.
+func attachedArgs(args *skel.CmdArgs, a AttachmentConf) *skel.CmdArgs {
+	attachedArgs := *args
+	attachedArgs.IfName = a.IfName
+	var pairs []string
+	for _, pair := range strings.Split(args.Args, ";") {
+		key, _, _ := strings.Cut(pair, "=")
+		if key != "IP" && key != "MAC" {
+			pairs = append(pairs, pair)
+		}
+	}
+	attachedArgs.Args = strings.Join(pairs, ";")
+	return &attachedArgs
+}
+
+// addFurtherAttachments adds the network's further attachments, each
+// starting from the result of the previous one as in a chain, and returns
+// the result of the last or, in dry-run mode, the plans of all. The
+// attachments added so far are removed again if one fails.
+func addFurtherAttachments(ctx context.Context, conf *PluginConf, args *skel.CmdArgs, result types.Result, p *plan) (types.Result, *plan, error) {
+	for i, a := range conf.Attachments {
+		if a.IfName == args.IfName {
+			return nil, nil, configError(fmt.Sprintf("attachments[%d].ifName %s is the network's interface", i, a.IfName), nil)
+		}
+	}
+	for i, a := range conf.Attachments {
+		c := conf.attached(a)
+		if result != nil {
+			c.PrevResult = result
+		}
+		r, attachedPlan, err := addAttachment(ctx, c, attachedArgs(args, a))
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				_ = delAttachment(ctx, conf.attached(conf.Attachments[j]), attachedArgs(args, conf.Attachments[j]))
+			}
+			_ = delAttachment(ctx, conf, args)
+			return nil, nil, err
+		}
+		result = r
+		if attachedPlan != nil {
+			p.Operations = append(p.Operations, attachedPlan.Operations...)
+		}
+	}
+	return result, p, nil
+}
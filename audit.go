@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/audit"
+)
+
+// AuditConf has each invocation logged to journald or syslog, with the
+// attachment, outcome and latency in fields of their own
+type AuditConf struct {
+	// Target is journald or syslog; empty picks journald if it runs and
+	// syslog otherwise
+	Target string `json:"target,omitempty"`
+}
+
+// validate returns the problems with the audit settings
+func (a *AuditConf) validate() []string {
+	switch a.Target {
+	case "", audit.TargetJournald, audit.TargetSyslog:
+		return nil
+	}
+	return []string{fmt.Sprintf("invalid audit target %q, must be %q or %q", a.Target, audit.TargetJournald, audit.TargetSyslog)}
+}
+
+// audited wraps a command to log its invocations on networks with audit
+// set. Logging is best effort: an invocation doesn't fail for want of a
+// journal, and one whose configuration doesn't parse isn't logged.
+func audited(command string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		start := time.Now()
+		err := cmd(args)
+		conf, parseErr := parseConfig(args.StdinData)
+		if parseErr != nil || conf.Audit == nil {
+			return err
+		}
+		_ = audit.Log(conf.Audit.Target, auditEvent(command, conf, args, time.Since(start), err))
+		return err
+	}
+}
+
+// auditEvent returns the invocation as an audit event
+func auditEvent(command string, conf *PluginConf, args *skel.CmdArgs, duration time.Duration, err error) *audit.Event {
+	e := &audit.Event{
+		Command:     command,
+		Network:     conf.Name,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Netns:       args.Netns,
+		Args:        args.Args,
+		Duration:    duration,
+	}
+	if envArgs, err := parseEnvArgs(args.Args); err == nil {
+		owner := envArgs.owner()
+		e.PodNamespace, e.PodName, e.PodUID = owner.PodNamespace, owner.PodName, owner.PodUID
+	}
+	if err != nil {
+		e.Err = err.Error()
+		e.ErrCode = types.ErrInternal
+		if cniErr, ok := err.(*types.Error); ok {
+			e.ErrCode = cniErr.Code
+		}
+	}
+	return e
+}
@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+	"github.com/nohns/xvm-cni/pkg/bumguard"
+)
+
+// BUMGuardConf limits the broadcast and multicast frames each remote VTEP
+// sends into the network's VNI
+type BUMGuardConf struct {
+	// Rate is the frames per second a peer may send
+	Rate int `json:"rate"`
+	// Burst is the frames a peer may send at once (default: rate)
+	Burst int `json:"burst,omitempty"`
+	// Native attaches the guard in the host interface's driver rather than
+	// generically
+	Native bool `json:"native,omitempty"`
+}
+
+// validate returns the problems with the guard's settings
+func (g *BUMGuardConf) validate(c *PluginConf) []string {
+	var problems []string
+	if g.Rate < 1 || g.Rate > 1e9 {
+		problems = append(problems, fmt.Sprintf("ebpf.bumGuard.rate %d out of range (1-1000000000)", g.Rate))
+	}
+	if g.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("ebpf.bumGuard.burst %d must not be negative", g.Burst))
+	}
+	if !c.usesVxlan() {
+		problems = append(problems, "ebpf.bumGuard requires a VXLAN interface")
+	}
+	return problems
+}
+
+// limit returns the limit of each peer
+func (g *BUMGuardConf) limit() bumguard.Limit {
+	limit := bumguard.Limit{Rate: g.Rate, Burst: g.Burst}
+	if limit.Burst == 0 {
+		limit.Burst = limit.Rate
+	}
+	return limit
+}
+
+// bumGuard returns the limit of the peers' broadcast and multicast, or nil
+func (c *PluginConf) bumGuard() *BUMGuardConf {
+	if c.EBPF == nil {
+		return nil
+	}
+	return c.EBPF.BUMGuard
+}
+
+// bumGuardDir returns the directory of the guard on the host interface
+func bumGuardDir(conf *PluginConf) string {
+	return filepath.Join(conf.bpfFSDir(), bumguard.Dir(conf.HostInterface))
+}
+
+// setupBUMGuard limits the broadcast and multicast the peers send into the
+// network's VNI, attaching the guard to the host interface unless another
+// network did already
+func setupBUMGuard(conf *PluginConf) error {
+	if err := bpf.MountFS(conf.bpfFSDir(), bumguard.Dir(conf.HostInterface)); err != nil {
+		return newError(types.ErrInternal, "failed to set up BPF file system", err)
+	}
+	dir := bumGuardDir(conf)
+	unlock, err := bumguard.Lock(dir)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to lock BUM guard", err)
+	}
+	defer unlock()
+	maps, err := bumguard.Open(dir)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open BUM guard maps", err)
+	}
+	defer maps.Close()
+	if err := maps.SetVNI(conf.VxlanPort, conf.VxlanID, conf.bumGuard().limit()); err != nil {
+		return newError(types.ErrInternal, "failed to set BUM limit", err)
+	}
+
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to find host interface %s", conf.HostInterface), err)
+	}
+	if err := bumguard.Attach(link, dir, maps, conf.bumGuard().Native); err != nil {
+		return netlinkError("failed to attach BUM guard", err)
+	}
+	return nil
+}
+
+// teardownBUMGuard stops limiting the traffic into the network's VNI, and
+// detaches the guard from the host interface if no network is left on it
+func teardownBUMGuard(conf *PluginConf) error {
+	dir := bumGuardDir(conf)
+	unlock, err := bumguard.Lock(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to lock BUM guard", err)
+	}
+	defer unlock()
+	maps, err := bumguard.OpenExisting(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open BUM guard maps", err)
+	}
+	defer maps.Close()
+	if err := maps.DeleteVNI(conf.VxlanPort, conf.VxlanID); err != nil {
+		return newError(types.ErrInternal, "failed to remove BUM limit", err)
+	}
+	empty, err := maps.Empty()
+	if err != nil || !empty {
+		return err
+	}
+
+	// The host interface may be gone, and the guard with it
+	if link, err := netlink.LinkByName(conf.HostInterface); err == nil {
+		if err := bumguard.Detach(link, dir); err != nil {
+			return netlinkError("failed to detach BUM guard", err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return newError(types.ErrInternal, "failed to remove BUM guard maps", err)
+	}
+	return nil
+}
+
+// checkBUMGuard verifies that the guard is attached to the host interface
+// and limits the network's VNI as configured
+func checkBUMGuard(conf *PluginConf) error {
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("host interface %s not found", conf.HostInterface), err)
+	}
+	dir := bumGuardDir(conf)
+	attached, err := bumguard.Attached(link, dir)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check BUM guard", err)
+	}
+	if !attached {
+		return newError(types.ErrInternal, fmt.Sprintf("no BUM guard on %s", conf.HostInterface), nil)
+	}
+	maps, err := bumguard.OpenExisting(dir)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open BUM guard maps", err)
+	}
+	defer maps.Close()
+	limited, err := maps.Limits(conf.VxlanPort, conf.VxlanID, conf.bumGuard().limit())
+	if err != nil {
+		return newError(types.ErrInternal, "failed to look up BUM limit", err)
+	}
+	if !limited {
+		return newError(types.ErrInternal, fmt.Sprintf("BUM guard doesn't limit VNI %d as configured", conf.VxlanID), nil)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// prevResult returns the result of the previous plugin in the chain, or an
+// empty result if xvm-cni runs first. It refuses to continue if an earlier
+// plugin already created the container interface we are asked to create.
+func prevResult(conf *PluginConf, args *skel.CmdArgs) (*current.Result, error) {
+	if conf.PrevResult == nil {
+		return &current.Result{CNIVersion: current.ImplementedSpecVersion}, nil
+	}
+
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, newError(types.ErrDecodingFailure, "failed to convert prevResult", err)
+	}
+
+	// Don't clobber interfaces created by earlier plugins
+	for _, iface := range result.Interfaces {
+		if iface.Name == args.IfName && iface.Sandbox == args.Netns {
+			return nil, configError(fmt.Sprintf("interface %s was already created by a previous plugin", args.IfName), nil)
+		}
+	}
+
+	return result, nil
+}
+
+// hasDefaultRoute reports whether the result already carries a default
+// route, an IPv6 one if ipv6 is set
+func hasDefaultRoute(result *current.Result, ipv6 bool) bool {
+	for _, route := range result.Routes {
+		if (route.Dst.IP.To4() == nil) == ipv6 {
+			if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,524 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bgp"
+	"github.com/nohns/xvm-cni/pkg/capture"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+const (
+	// defaultSocketPath is where the control API is served for local tools
+	defaultSocketPath = "/run/xvm-cni/agent.sock"
+	// defaultCaptureDuration and maxCaptureDuration bound captures, which
+	// hold their request open until done
+	defaultCaptureDuration = 10 * time.Second
+	maxCaptureDuration     = 5 * time.Minute
+)
+
+// handler returns the control API. Every response is JSON, except captures,
+// which are pcap files, and metrics, which are in the Prometheus text
+// format.
+func (a *agent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/health", a.handleHealth)
+	mux.HandleFunc("GET /v1/networks", a.handleNetworks)
+	mux.HandleFunc("GET /v1/networks/{network}/allocations", a.handleAllocations)
+	mux.HandleFunc("GET /v1/networks/{network}/attachments", a.handleAttachments)
+	mux.HandleFunc("GET /v1/networks/{network}/peers", a.handlePeers)
+	mux.HandleFunc("POST /v1/networks/{network}/release", a.handleRelease)
+	mux.HandleFunc("POST /v1/resync", a.handleResync)
+	mux.HandleFunc("GET /v1/capture", a.handleCapture)
+	mux.HandleFunc("GET /metrics", a.handleMetrics)
+	return mux
+}
+
+// serveUnix serves the API on a unix socket only root can connect to, which
+// stands in for authentication
+func serveUnix(path string, h http.Handler) (*http.Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	// A previous agent may have left its socket behind
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict socket: %v", err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	return srv, nil
+}
+
+// serveTCP serves the API on a TCP address to clients presenting the token.
+// The token grants everything the API does, force-releasing attachments and
+// capturing traffic included, so it's served over TLS unless the address is
+// a loopback one.
+func serveTCP(addr string, h http.Handler, tokenFile, certFile, keyFile string) (*http.Server, error) {
+	if tokenFile == "" {
+		return nil, fmt.Errorf("serving the API on TCP requires --token-file")
+	}
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if certFile == "" && !loopback(addr) {
+		return nil, fmt.Errorf("serving the API on %s requires --tls-cert and --tls-key, as the token would be sent in the clear", addr)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	srv := &http.Server{Handler: requireToken(token, h)}
+	if certFile != "" {
+		go srv.ServeTLS(l, certFile, keyFile)
+	} else {
+		go srv.Serve(l)
+	}
+	return srv, nil
+}
+
+// loopback reports whether the TCP address only listens on the loopback
+// interface
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// lookupNetwork returns the network named in the request path, or writes
+// the error and returns nil
+func (a *agent) lookupNetwork(w http.ResponseWriter, req *http.Request) *netconf.Network {
+	n, err := a.network(req.PathValue("network"))
+	if errors.Is(err, errNetworkNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return n
+}
+
+// health is the agent's state as of its latest pass
+type health struct {
+	// Status is "ok", or "degraded" if the latest pass failed for some
+	// network, a peer's underlay path is a PMTU blackhole or a BGP session
+	// is down
+	Status   string    `json:"status"`
+	LastPass time.Time `json:"lastPass"`
+	Errors   []string  `json:"errors,omitempty"`
+	// Blackholes are the peers whose paths drop large packets silently
+	Blackholes []pathState `json:"pmtuBlackholes,omitempty"`
+	// BGPSessions are the sessions to the BGP peers, if announcing
+	BGPSessions []bgp.Status `json:"bgpSessions,omitempty"`
+}
+
+func (a *agent) handleHealth(w http.ResponseWriter, req *http.Request) {
+	last := a.lastPass()
+	h := health{Status: "ok", LastPass: last.Time, Errors: last.Errors}
+	if a.pmtu != nil {
+		for _, s := range a.pmtu.states() {
+			if s.Blackhole {
+				h.Blackholes = append(h.Blackholes, s)
+			}
+		}
+	}
+	down := false
+	if a.bgp != nil {
+		h.BGPSessions = a.bgp.speaker.Status()
+		for _, s := range h.BGPSessions {
+			down = down || s.State != bgp.StateEstablished
+		}
+	}
+	if len(last.Errors) > 0 || len(h.Blackholes) > 0 || down {
+		h.Status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// handleMetrics serves the agent's state in the Prometheus text format
+func (a *agent) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	last := a.lastPass()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP xvm_agent_last_pass_timestamp_seconds Time of the latest reconciliation pass.\n")
+	fmt.Fprintf(&b, "# TYPE xvm_agent_last_pass_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "xvm_agent_last_pass_timestamp_seconds %d\n", last.Time.Unix())
+	fmt.Fprintf(&b, "# HELP xvm_agent_last_pass_errors Networks the latest reconciliation pass failed for.\n")
+	fmt.Fprintf(&b, "# TYPE xvm_agent_last_pass_errors gauge\n")
+	fmt.Fprintf(&b, "xvm_agent_last_pass_errors %d\n", len(last.Errors))
+	if a.pmtu != nil {
+		states := a.pmtu.states()
+		fmt.Fprintf(&b, "# HELP xvm_agent_pmtu_blackhole Whether the underlay path to the peer drops large packets without reporting its MTU.\n")
+		fmt.Fprintf(&b, "# TYPE xvm_agent_pmtu_blackhole gauge\n")
+		for _, s := range states {
+			blackhole := 0
+			if s.Blackhole {
+				blackhole = 1
+			}
+			fmt.Fprintf(&b, "xvm_agent_pmtu_blackhole{network=%q,peer=%q} %d\n", s.Network, s.Peer, blackhole)
+		}
+		fmt.Fprintf(&b, "# HELP xvm_agent_pmtu_path_mtu_bytes Largest packet the blackholed underlay path to the peer carries.\n")
+		fmt.Fprintf(&b, "# TYPE xvm_agent_pmtu_path_mtu_bytes gauge\n")
+		for _, s := range states {
+			if s.Blackhole {
+				fmt.Fprintf(&b, "xvm_agent_pmtu_path_mtu_bytes{network=%q,peer=%q} %d\n", s.Network, s.Peer, s.MTU)
+			}
+		}
+	}
+	if a.bgp != nil {
+		sessions := a.bgp.speaker.Status()
+		fmt.Fprintf(&b, "# HELP xvm_agent_bgp_session_established Whether the BGP session to the peer is established.\n")
+		fmt.Fprintf(&b, "# TYPE xvm_agent_bgp_session_established gauge\n")
+		for _, s := range sessions {
+			established := 0
+			if s.State == bgp.StateEstablished {
+				established = 1
+			}
+			fmt.Fprintf(&b, "xvm_agent_bgp_session_established{peer=%q} %d\n", s.Peer, established)
+		}
+		fmt.Fprintf(&b, "# HELP xvm_agent_bgp_advertised_prefixes Prefixes announced to the BGP peer.\n")
+		fmt.Fprintf(&b, "# TYPE xvm_agent_bgp_advertised_prefixes gauge\n")
+		for _, s := range sessions {
+			fmt.Fprintf(&b, "xvm_agent_bgp_advertised_prefixes{peer=%q} %d\n", s.Peer, s.Advertised)
+		}
+	}
+
+	// A network that fails to load is reported by the passes already
+	networks, _ := a.networks()
+	writeTableMetrics(&b, networks)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
+
+// networkInfo is a network's configuration and the devices it uses
+type networkInfo struct {
+	*netconf.Network
+	VxlanDevice string `json:"vxlanDevice,omitempty"`
+	L2Device    string `json:"l2Device"`
+}
+
+func (a *agent) handleNetworks(w http.ResponseWriter, req *http.Request) {
+	networks, err := a.networks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	infos := make([]networkInfo, 0, len(networks))
+	for _, n := range networks {
+		infos = append(infos, networkInfo{Network: n, VxlanDevice: n.VxlanName(), L2Device: n.L2Name()})
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *agent) handleAllocations(w http.ResponseWriter, req *http.Request) {
+	n := a.lookupNetwork(w, req)
+	if n == nil {
+		return
+	}
+	entries, err := n.Allocations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []netconf.Allocation{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// attachment is an attachment's addresses and host-side interfaces
+type attachment struct {
+	Attachment   string          `json:"attachment"`
+	IPs          []string        `json:"ips"`
+	PodNamespace string          `json:"podNamespace,omitempty"`
+	PodName      string          `json:"podName,omitempty"`
+	Interfaces   []hostInterface `json:"interfaces"`
+}
+
+// hostInterface is a host-side interface of an attachment
+type hostInterface struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	State  string `json:"state"`
+	MAC    string `json:"mac,omitempty"`
+	Master string `json:"master,omitempty"`
+}
+
+func (a *agent) handleAttachments(w http.ResponseWriter, req *http.Request) {
+	n := a.lookupNetwork(w, req)
+	if n == nil {
+		return
+	}
+	entries, err := n.Allocations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	links, err := netconf.HostLinks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Allocations are sorted by attachment
+	attachments := []attachment{}
+	for _, e := range entries {
+		if len(attachments) > 0 && attachments[len(attachments)-1].Attachment == e.Attachment {
+			last := &attachments[len(attachments)-1]
+			last.IPs = append(last.IPs, e.IP)
+			continue
+		}
+		att := attachment{
+			Attachment:   e.Attachment,
+			IPs:          []string{e.IP},
+			PodNamespace: e.PodNamespace,
+			PodName:      e.PodName,
+			Interfaces:   []hostInterface{},
+		}
+		for _, l := range links[e.Attachment] {
+			attrs := l.Link.Attrs()
+			iface := hostInterface{Name: attrs.Name, Type: l.Link.Type(), State: attrs.OperState.String()}
+			if attrs.HardwareAddr != nil {
+				iface.MAC = attrs.HardwareAddr.String()
+			}
+			if attrs.MasterIndex != 0 {
+				if master, err := netlink.LinkByIndex(attrs.MasterIndex); err == nil {
+					iface.Master = master.Attrs().Name
+				}
+			}
+			att.Interfaces = append(att.Interfaces, iface)
+		}
+		attachments = append(attachments, att)
+	}
+	writeJSON(w, http.StatusOK, attachments)
+}
+
+// peer is a remote VTEP known to the VXLAN device
+type peer struct {
+	IP string `json:"ip"`
+	// MACs is the number of remote MACs forwarded to the peer
+	MACs int `json:"macs"`
+	// Flood tells whether traffic without a known destination is
+	// replicated to the peer
+	Flood bool `json:"flood"`
+}
+
+func (a *agent) handlePeers(w http.ResponseWriter, req *http.Request) {
+	n := a.lookupNetwork(w, req)
+	if n == nil {
+		return
+	}
+	if n.VxlanName() == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("network %s forwards with Open vSwitch, which keeps its peers itself", n.Name))
+		return
+	}
+	link, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("VXLAN device %s not found: %v", n.VxlanName(), err))
+		return
+	}
+	entries, err := netlink.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to list forwarding entries: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, peersOf(entries))
+}
+
+// peersOf returns the remote VTEPs of a VXLAN device's forwarding entries,
+// sorted by address. The entry flooding to the multicast group isn't a peer.
+func peersOf(entries []netlink.Neigh) []peer {
+	group := net.ParseIP(vxlan.MulticastGroup)
+	zero := make(net.HardwareAddr, 6)
+	byIP := make(map[string]*peer)
+	for _, e := range entries {
+		if e.IP == nil || e.IP.Equal(group) {
+			continue
+		}
+		p, ok := byIP[e.IP.String()]
+		if !ok {
+			p = &peer{IP: e.IP.String()}
+			byIP[p.IP] = p
+		}
+		if bytes.Equal(e.HardwareAddr, zero) {
+			p.Flood = true
+		} else {
+			p.MACs++
+		}
+	}
+	peers := make([]peer, 0, len(byIP))
+	for _, p := range byIP {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+	return peers
+}
+
+// releaseRequest names the address to release
+type releaseRequest struct {
+	IP string `json:"ip"`
+	// Force releases the address even if its attachment still has host
+	// interfaces
+	Force bool `json:"force,omitempty"`
+}
+
+func (a *agent) handleRelease(w http.ResponseWriter, req *http.Request) {
+	n := a.lookupNetwork(w, req)
+	if n == nil {
+		return
+	}
+	var body releaseRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	ip := net.ParseIP(body.IP)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid IP address %q", body.IP))
+		return
+	}
+	key, err := n.Release(ip, body.Force)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"ip": ip.String(), "attachment": key})
+}
+
+func (a *agent) handleResync(w http.ResponseWriter, req *http.Request) {
+	result := a.pass()
+	if result.Events == nil {
+		result.Events = []event{}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleCapture streams a pcap of a container's attachment (container and
+// optionally ifname) or of a VNI's VXLAN device (vni) for duration
+func (a *agent) handleCapture(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var iface string
+	switch container, vni := q.Get("container"), q.Get("vni"); {
+	case container != "" && vni != "":
+		writeError(w, http.StatusBadRequest, errors.New("container and vni are mutually exclusive"))
+		return
+	case container != "":
+		var err error
+		if iface, err = netconf.ContainerInterface(container, q.Get("ifname")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+	case vni != "":
+		id, err := strconv.Atoi(vni)
+		if err != nil || id <= 0 || id > vxlan.MaxVxlanVNI {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid VNI %q", vni))
+			return
+		}
+		if iface, err = netconf.VxlanDevice(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("either container or vni is required"))
+		return
+	}
+
+	duration := defaultCaptureDuration
+	if d := q.Get("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > maxCaptureDuration {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q, must be positive and at most %s", d, maxCaptureDuration))
+			return
+		}
+	}
+	snapLen := capture.DefaultSnapLen
+	if s := q.Get("snaplen"); s != "" {
+		var err error
+		if snapLen, err = strconv.Atoi(s); err != nil || snapLen <= 0 || snapLen > capture.DefaultSnapLen {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid snaplen %q, must be positive and at most %d", s, capture.DefaultSnapLen))
+			return
+		}
+	}
+	if _, err := netlink.LinkByName(iface); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("interface %s not found: %v", iface, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.pcap", iface, time.Now().Format("20060102T150405"))))
+	pw, err := capture.NewPcapWriter(w, snapLen)
+	if err != nil {
+		return // The client is gone
+	}
+	// The status is sent with the pcap header, so a failure from here on
+	// can only cut the file short
+	if _, err := capture.Capture(iface, duration, pw); err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: capture on %s: %v\n", iface, err)
+	}
+}
@@ -0,0 +1,211 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// newTestAgent returns an agent serving a network whose allocations live in
+// a scratch directory
+func newTestAgent(t *testing.T) *agent {
+	dir := t.TempDir()
+	conf := `{"cniVersion": "1.0.0", "name": "xvm-net", "type": "xvm-cni", "vxlanID": 42, "subnet": "10.42.0.0/16", "gateway": "10.42.0.1", "dataDir": "` + filepath.Join(dir, "data") + `"}`
+	if err := os.WriteFile(filepath.Join(dir, "10-xvm.conf"), []byte(conf), 0644); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	return &agent{configDir: dir, r: newReconciler(true, 0, newEventWriter(io.Discard))}
+}
+
+func request(t *testing.T, h http.Handler, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAPINetworks(t *testing.T) {
+	h := newTestAgent(t).handler()
+
+	code, body := request(t, h, "GET", "/v1/networks", "")
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", code, body)
+	}
+	var networks []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &networks); err != nil {
+		t.Fatalf("Failed to decode networks: %v", err)
+	}
+	if len(networks) != 1 || networks[0]["name"] != "xvm-net" || networks[0]["l2Device"] != "xbr-xvm-net" || networks[0]["vxlanDevice"] != "xvx-xvm-net" {
+		t.Fatalf("Unexpected networks: %s", body)
+	}
+
+	// A network without allocations has an empty list, not null
+	if code, body := request(t, h, "GET", "/v1/networks/xvm-net/allocations", ""); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Fatalf("Unexpected allocations %d: %s", code, body)
+	}
+	if code, _ := request(t, h, "GET", "/v1/networks/other/allocations", ""); code != http.StatusNotFound {
+		t.Fatalf("Expected unknown network to be not found, got %d", code)
+	}
+	if code, _ := request(t, h, "DELETE", "/v1/networks", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected other methods to be rejected, got %d", code)
+	}
+}
+
+func TestAPIRelease(t *testing.T) {
+	h := newTestAgent(t).handler()
+
+	if code, body := request(t, h, "POST", "/v1/networks/xvm-net/release", `{"ip": "bogus"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected invalid address to be rejected, got %d: %s", code, body)
+	}
+	code, body := request(t, h, "POST", "/v1/networks/xvm-net/release", `{"ip": "10.42.0.5"}`)
+	if code != http.StatusConflict || !strings.Contains(body, "not allocated") {
+		t.Fatalf("Expected unallocated address to be refused, got %d: %s", code, body)
+	}
+}
+
+func TestAPIHealth(t *testing.T) {
+	a := newTestAgent(t)
+	h := a.handler()
+
+	// A pass over a network that isn't in use finds nothing to repair
+	if code, body := request(t, h, "POST", "/v1/resync", ""); code != http.StatusOK || !strings.Contains(body, `"events":[]`) {
+		t.Fatalf("Unexpected resync %d: %s", code, body)
+	}
+	code, body := request(t, h, "GET", "/v1/health", "")
+	var got health
+	if err := json.Unmarshal([]byte(body), &got); err != nil || code != http.StatusOK {
+		t.Fatalf("Unexpected health %d: %s", code, body)
+	}
+	if got.Status != "ok" || got.LastPass.IsZero() {
+		t.Fatalf("Unexpected health: %+v", got)
+	}
+}
+
+func TestAPIPMTUBlackhole(t *testing.T) {
+	a := newTestAgent(t)
+	a.pmtu = newPMTUChecker(true, newEventWriter(io.Discard))
+	a.pmtu.paths["xvm-net"] = map[string]*pathState{
+		"192.168.1.11": {Network: "xvm-net", Peer: "192.168.1.11"},
+		"192.168.1.12": {Network: "xvm-net", Peer: "192.168.1.12", Blackhole: true, MTU: 1400},
+	}
+	h := a.handler()
+
+	// A blackholed peer degrades the agent and lowers its routes' MTU
+	code, body := request(t, h, "GET", "/v1/health", "")
+	var got health
+	if err := json.Unmarshal([]byte(body), &got); err != nil || code != http.StatusOK {
+		t.Fatalf("Unexpected health %d: %s", code, body)
+	}
+	if got.Status != "degraded" || len(got.Blackholes) != 1 || got.Blackholes[0].Peer != "192.168.1.12" {
+		t.Fatalf("Expected degraded health with the blackhole, got %+v", got)
+	}
+	if mtu := a.pmtu.routeMTU("xvm-net", net.ParseIP("192.168.1.12")); mtu != 1350 {
+		t.Fatalf("Expected route MTU 1350, got %d", mtu)
+	}
+	if mtu := a.pmtu.routeMTU("xvm-net", net.ParseIP("192.168.1.11")); mtu != 0 {
+		t.Fatalf("Expected healthy path to leave the route MTU, got %d", mtu)
+	}
+
+	code, body = request(t, h, "GET", "/metrics", "")
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected metrics %d: %s", code, body)
+	}
+	for _, want := range []string{
+		`xvm_agent_pmtu_blackhole{network="xvm-net",peer="192.168.1.11"} 0`,
+		`xvm_agent_pmtu_blackhole{network="xvm-net",peer="192.168.1.12"} 1`,
+		`xvm_agent_pmtu_path_mtu_bytes{network="xvm-net",peer="192.168.1.12"} 1400`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestAPITableMetrics(t *testing.T) {
+	h := newTestAgent(t).handler()
+
+	code, body := request(t, h, "GET", "/metrics", "")
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected metrics %d: %s", code, body)
+	}
+	if !strings.Contains(body, `xvm_agent_neighbor_entries{family="ipv4"} `) {
+		t.Errorf("Metrics lack the neighbor table's entries:\n%s", body)
+	}
+
+	// The network's devices don't exist, so it has no forwarding entries
+	if strings.Contains(body, `xvm_agent_fdb_entries{network="xvm-net"`) {
+		t.Errorf("Expected no forwarding entries without the bridge:\n%s", body)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("s3cret", newTestAgent(t).handler())
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %q to be rejected, got %d", auth, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/v1/health", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected token to be accepted, got %d", rec.Code)
+	}
+}
+
+func TestServeTCPRequiresTLS(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0"} {
+		if _, err := serveTCP(addr, http.NotFoundHandler(), tokenFile, "", ""); err == nil || !strings.Contains(err.Error(), "--tls-cert") {
+			t.Errorf("Expected %s without TLS to be rejected, got %v", addr, err)
+		}
+	}
+
+	// Loopback addresses don't leave the host
+	srv, err := serveTCP("127.0.0.1:0", http.NotFoundHandler(), tokenFile, "", "")
+	if err != nil {
+		t.Fatalf("Expected loopback address to be served without TLS: %v", err)
+	}
+	srv.Close()
+}
+
+func TestPeersOf(t *testing.T) {
+	zero := make(net.HardwareAddr, 6)
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	entries := []netlink.Neigh{
+		{HardwareAddr: zero, IP: net.ParseIP("239.1.1.1")},
+		{HardwareAddr: zero, IP: net.ParseIP("192.168.1.12")},
+		{HardwareAddr: mac, IP: net.ParseIP("192.168.1.11")},
+		{HardwareAddr: mac},
+	}
+	peers := peersOf(entries)
+	if len(peers) != 2 {
+		t.Fatalf("Expected two peers, got %+v", peers)
+	}
+	if peers[0] != (peer{IP: "192.168.1.11", MACs: 1}) || peers[1] != (peer{IP: "192.168.1.12", Flood: true}) {
+		t.Fatalf("Unexpected peers: %+v", peers)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/bgp"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// What the BGP speaker announces
+const (
+	// bgpAdvertisePods announces a /32 for each allocated IPv4 address
+	bgpAdvertisePods = "pods"
+	// bgpAdvertiseSubnet announces the node's pod CIDRs with --watch-nodes,
+	// the network's subnet otherwise
+	bgpAdvertiseSubnet = "subnet"
+)
+
+// defaultBGPRestartTime is how long the peers keep the routes while the agent
+// restarts
+const defaultBGPRestartTime = 120 * time.Second
+
+// bgpOptions are the flags configuring the BGP speaker
+type bgpOptions struct {
+	localAS      uint64
+	peers        string
+	passwordFile string
+	routerID     string
+	nextHop      string
+	advertise    string
+	restartTime  time.Duration
+	network      string
+}
+
+// bgpAnnouncer announces the node network's workloads to the upstream
+// routers, so the rest of the datacenter reaches them without NAT
+type bgpAnnouncer struct {
+	speaker   *bgp.Speaker
+	network   string
+	advertise string
+}
+
+// startBGP starts a speaker announcing the network's workloads to the peers,
+// with the network's underlay address as next hop unless set
+func startBGP(ctx context.Context, a *agent, o bgpOptions) (*bgpAnnouncer, error) {
+	if o.advertise != bgpAdvertisePods && o.advertise != bgpAdvertiseSubnet {
+		return nil, fmt.Errorf("invalid --bgp-advertise %q: must be %s or %s", o.advertise, bgpAdvertisePods, bgpAdvertiseSubnet)
+	}
+	parsed, err := parseBGPPeers(o.peers)
+	if err != nil {
+		return nil, err
+	}
+	if o.passwordFile != "" {
+		data, err := os.ReadFile(o.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read BGP password: %v", err)
+		}
+		password := strings.TrimSpace(string(data))
+		if password == "" {
+			return nil, fmt.Errorf("BGP password file %s is empty", o.passwordFile)
+		}
+		for i := range parsed {
+			parsed[i].Password = password
+		}
+	}
+	n, err := a.nodeNetwork(o.network)
+	if err != nil {
+		return nil, err
+	}
+	hop := net.ParseIP(o.nextHop)
+	if o.nextHop == "" {
+		if hop, err = vxlan.LocalIP(n.HostInterface); err != nil {
+			return nil, err
+		}
+	} else if hop == nil {
+		return nil, fmt.Errorf("invalid --bgp-next-hop %q", o.nextHop)
+	}
+	id := hop
+	if o.routerID != "" {
+		if id = net.ParseIP(o.routerID); id == nil {
+			return nil, fmt.Errorf("invalid --bgp-router-id %q", o.routerID)
+		}
+	}
+	if o.localAS > 1<<32-1 {
+		return nil, fmt.Errorf("invalid --bgp-as %d", o.localAS)
+	}
+	conf := bgp.Config{LocalAS: uint32(o.localAS), RouterID: id, NextHop: hop, RestartTime: o.restartTime}
+	speaker, err := bgp.NewSpeaker(conf, parsed)
+	if err != nil {
+		return nil, err
+	}
+	b := &bgpAnnouncer{speaker: speaker, network: o.network, advertise: o.advertise}
+	go speaker.Run(ctx)
+	return b, nil
+}
+
+// parseBGPPeers parses a comma-separated list of peers, each as
+// <AS>@<address>[:<port>]
+func parseBGPPeers(s string) ([]bgp.Peer, error) {
+	var peers []bgp.Peer
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		asText, addr, ok := strings.Cut(field, "@")
+		as, err := strconv.ParseUint(asText, 10, 32)
+		if !ok || err != nil || as == 0 {
+			return nil, fmt.Errorf("invalid BGP peer %q: must be <AS>@<address>[:<port>]", field)
+		}
+		p := bgp.Peer{Address: net.ParseIP(addr), AS: uint32(as)}
+		if p.Address == nil {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BGP peer %q: %v", field, err)
+			}
+			if p.Address = net.ParseIP(host); p.Address == nil {
+				return nil, fmt.Errorf("invalid BGP peer %q: %q isn't an IP address", field, host)
+			}
+			if p.Port, err = strconv.Atoi(port); err != nil || p.Port <= 0 || p.Port > 65535 {
+				return nil, fmt.Errorf("invalid BGP peer %q: invalid port %q", field, port)
+			}
+		}
+		peers = append(peers, p)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("--bgp-peers is required with --bgp-as")
+	}
+	return peers, nil
+}
+
+// announce brings the announced prefixes in line with the network. The
+// previous ones stay announced if the network fails to load.
+func (b *bgpAnnouncer) announce(a *agent) error {
+	n, err := a.nodeNetwork(b.network)
+	if err != nil {
+		return err
+	}
+	var podCIDRs []*net.IPNet
+	if a.nodes != nil {
+		podCIDRs = a.nodes.podCIDRs()
+	}
+	prefixes, err := bgpPrefixes(n, b.advertise, podCIDRs)
+	if err != nil {
+		return fmt.Errorf("network %s: %v", n.Name, err)
+	}
+	b.speaker.Announce(prefixes)
+	return nil
+}
+
+// bgpPrefixes returns the network's IPv4 prefixes to announce. In subnet
+// mode, those are the node's pod CIDRs if known, as the network's subnet may
+// be shared by all nodes.
+func bgpPrefixes(n *netconf.Network, advertise string, podCIDRs []*net.IPNet) ([]*net.IPNet, error) {
+	if advertise == bgpAdvertiseSubnet {
+		var prefixes []*net.IPNet
+		for _, cidr := range podCIDRs {
+			if cidr.IP.To4() != nil {
+				prefixes = append(prefixes, cidr)
+			}
+		}
+		if len(prefixes) > 0 {
+			return prefixes, nil
+		}
+		_, subnet, err := net.ParseCIDR(n.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", n.Subnet, err)
+		}
+		return []*net.IPNet{subnet}, nil
+	}
+
+	unlock, err := n.Lock()
+	if err != nil {
+		return nil, err
+	}
+	allocations, err := n.Allocations()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []*net.IPNet
+	for _, alloc := range allocations {
+		if ip := net.ParseIP(alloc.IP).To4(); ip != nil {
+			prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func TestParseBGPPeers(t *testing.T) {
+	peers, err := parseBGPPeers("65000@192.0.2.1, 4200000001@192.0.2.2:1179")
+	if err != nil {
+		t.Fatalf("Failed to parse peers: %v", err)
+	}
+	if len(peers) != 2 || peers[0].String() != "192.0.2.1:179" || peers[0].AS != 65000 || peers[1].String() != "192.0.2.2:1179" || peers[1].AS != 4200000001 {
+		t.Fatalf("Unexpected peers %+v", peers)
+	}
+
+	for _, bad := range []string{"", "192.0.2.1", "0@192.0.2.1", "65000@router", "65000@192.0.2.1:0", "4294967296@192.0.2.1"} {
+		if _, err := parseBGPPeers(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBGPPrefixes(t *testing.T) {
+	n, err := netconf.Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "hostInterface": "eth0", "vxlanID": 42, "subnet": "10.42.0.0/24", "gateway": "10.42.0.1", "ipv6Subnet": "fd42::/64", "ipv6Gateway": "fd42::1"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	n.DataDir = t.TempDir()
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		t.Fatalf("Failed to open IPAM: %v", err)
+	}
+	for _, i := range ipams {
+		if _, err := i.Allocate("ctr-a/eth0"); err != nil {
+			t.Fatalf("Failed to allocate: %v", err)
+		}
+	}
+
+	// Each allocated IPv4 address is announced on its own
+	prefixes, err := bgpPrefixes(n, bgpAdvertisePods, nil)
+	if err != nil {
+		t.Fatalf("Failed to get prefixes: %v", err)
+	}
+	if fmt.Sprint(prefixes) != "[10.42.0.2/32]" {
+		t.Fatalf("Unexpected prefixes %v", prefixes)
+	}
+
+	prefixes, err = bgpPrefixes(n, bgpAdvertiseSubnet, nil)
+	if err != nil {
+		t.Fatalf("Failed to get prefixes: %v", err)
+	}
+	if fmt.Sprint(prefixes) != "[10.42.0.0/24]" {
+		t.Fatalf("Unexpected prefixes %v", prefixes)
+	}
+
+	// The node's IPv4 pod CIDRs take the place of the shared subnet
+	_, v4, _ := net.ParseCIDR("10.42.3.0/24")
+	_, v6, _ := net.ParseCIDR("fd42:3::/64")
+	prefixes, err = bgpPrefixes(n, bgpAdvertiseSubnet, []*net.IPNet{v4, v6})
+	if err != nil {
+		t.Fatalf("Failed to get prefixes: %v", err)
+	}
+	if fmt.Sprint(prefixes) != "[10.42.3.0/24]" {
+		t.Fatalf("Unexpected prefixes %v", prefixes)
+	}
+}
@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+)
+
+// discardPort is the port of the datagrams having the kernel resolve the
+// gateways, which nothing has to listen on
+const discardPort = 9
+
+// reconcileDefaultRoutes withdraws the gateways the node fails to resolve
+// from the ECMP default routes of the network's containers, and restores
+// them once they resolve again. The containers' fib_multipath_use_neigh
+// only skips a gateway once each container failed to resolve it on its
+// own. A gateway is only withdrawn while another one is up, so containers
+// keep their default route. The caller holds the network lock.
+func (r *reconciler) reconcileDefaultRoutes(n *netconf.Network) error {
+	if n.DefaultRoute == nil || len(n.DefaultRoute.Gateways) < 2 {
+		return nil
+	}
+	var gateways []net.IP
+	for _, s := range n.DefaultRoute.Gateways {
+		if gw := net.ParseIP(s); gw != nil {
+			gateways = append(gateways, gw)
+		}
+	}
+	// Without the device the gateways can't be resolved, which the rest
+	// of the pass reports
+	l2, err := netlink.LinkByName(n.L2Name())
+	if err != nil {
+		return nil
+	}
+	neighs, err := netlink.NeighList(l2.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors of %s: %v", l2.Attrs().Name, err)
+	}
+	up := gatewaysUp(gateways, neighs, net.ParseIP(n.Gateway))
+	// Have the kernel resolve the gateways again for the next pass,
+	// probing those it failed to and those it hasn't confirmed lately
+	for _, gw := range gateways {
+		if !gw.Equal(net.ParseIP(n.Gateway)) {
+			resolveGateway(l2.Attrs().Name, gw)
+		}
+	}
+
+	records, err := resultcache.LoadAll(ipam.NetworkDir(n.DataDir, n.Name), n.Name)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if rec.Netns == "" || !sameNetns(rec) {
+			continue
+		}
+		r.reconcileDefaultRoute(n, rec, gateways, up)
+	}
+	return nil
+}
+
+// reconcileDefaultRoute has the attachment's ECMP default route go through
+// the gateways that are up
+func (r *reconciler) reconcileDefaultRoute(n *netconf.Network, rec *resultcache.Record, gateways, up []net.IP) {
+	var route *netlink.Route
+	var linkIndex int
+	err := ns.WithNetNSPath(rec.Netns, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(rec.IfName)
+		if err != nil {
+			return err
+		}
+		linkIndex = link.Attrs().Index
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		route = ecmpRoute(routes, linkIndex, gateways, n.DefaultRoute.Metric)
+		return nil
+	})
+	// Attachments on their way out and routes of other gateways, e.g. of
+	// args.cni, are left alone
+	if err != nil || route == nil {
+		return
+	}
+	via := routeGateways(*route)
+	if sameIPs(via, up) {
+		return
+	}
+
+	reason, message := reasonGatewayRestored, fmt.Sprintf("gateways %v are up again; adding them to the default route", missingIPs(up, via))
+	if withdrawn := missingIPs(via, up); len(withdrawn) > 0 {
+		reason, message = reasonGatewayWithdrawn, fmt.Sprintf("gateways %v are down; withdrawing them from the default route", withdrawn)
+	}
+	r.report(n, rec.ContainerID+"/"+rec.IfName, reason, message, func() error {
+		return ns.WithNetNSPath(rec.Netns, func(ns.NetNS) error {
+			replacement := &netlink.Route{
+				Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Priority: route.Priority,
+			}
+			for _, gw := range up {
+				replacement.MultiPath = append(replacement.MultiPath, &netlink.NexthopInfo{LinkIndex: linkIndex, Gw: gw})
+			}
+			return netlink.RouteReplace(replacement)
+		})
+	})
+}
+
+// gatewaysUp returns the gateways the node's neighbor entries don't report
+// failed, all of them if every one failed. The node's own gateway address
+// is always up.
+func gatewaysUp(gateways []net.IP, neighs []netlink.Neigh, local net.IP) []net.IP {
+	var up []net.IP
+	for _, gw := range gateways {
+		failed := false
+		for _, neigh := range neighs {
+			if neigh.IP.Equal(gw) && neigh.State&netlink.NUD_FAILED != 0 {
+				failed = true
+				break
+			}
+		}
+		if !failed || gw.Equal(local) {
+			up = append(up, gw)
+		}
+	}
+	if len(up) == 0 {
+		return gateways
+	}
+	return up
+}
+
+// resolveGateway sends a datagram to the gateway out of the device, having
+// the kernel resolve its neighbor entry. Errors only mean the gateway
+// isn't resolved, which the entry tells.
+func resolveGateway(dev string, gw net.IP) {
+	dialer := net.Dialer{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, dev)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	conn, err := dialer.Dial("udp4", net.JoinHostPort(gw.String(), strconv.Itoa(discardPort)))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte{0})
+}
+
+// ecmpRoute returns the default route of the metric through some of the
+// gateways on the link, nil if there's none
+func ecmpRoute(routes []netlink.Route, linkIndex int, gateways []net.IP, metric int) *netlink.Route {
+	for i, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if metric != 0 && route.Priority != metric {
+			continue
+		}
+		via := routeGateways(route)
+		if len(via) == 0 || len(missingIPs(via, gateways)) > 0 {
+			continue
+		}
+		if route.LinkIndex != 0 && route.LinkIndex != linkIndex {
+			continue
+		}
+		onLink := true
+		for _, nh := range route.MultiPath {
+			onLink = onLink && nh.LinkIndex == linkIndex
+		}
+		if onLink {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// routeGateways returns the next hops of a route
+func routeGateways(route netlink.Route) []net.IP {
+	if len(route.MultiPath) == 0 {
+		if route.Gw == nil {
+			return nil
+		}
+		return []net.IP{route.Gw}
+	}
+	gateways := make([]net.IP, 0, len(route.MultiPath))
+	for _, nh := range route.MultiPath {
+		gateways = append(gateways, nh.Gw)
+	}
+	return gateways
+}
+
+// missingIPs returns the addresses of a that b lacks
+func missingIPs(a, b []net.IP) []net.IP {
+	var missing []net.IP
+	for _, ip := range a {
+		found := false
+		for _, other := range b {
+			if ip.Equal(other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
+}
+
+// sameIPs reports whether a and b hold the same addresses, in any order
+func sameIPs(a, b []net.IP) bool {
+	return len(missingIPs(a, b)) == 0 && len(missingIPs(b, a)) == 0
+}
+
+// sameNetns reports whether the attachment's recorded namespace path still
+// names its namespace, rather than another one that reused the path
+func sameNetns(rec *resultcache.Record) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(rec.Netns, &st); err != nil {
+		return false
+	}
+	return rec.NetnsInode == 0 || st.Ino == rec.NetnsInode
+}
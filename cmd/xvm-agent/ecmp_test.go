@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestGatewaysUp(t *testing.T) {
+	gateways := []net.IP{net.ParseIP("10.244.0.1"), net.ParseIP("10.244.0.2"), net.ParseIP("10.244.0.3")}
+	neighs := []netlink.Neigh{
+		{IP: gateways[1], State: netlink.NUD_REACHABLE},
+		{IP: gateways[2], State: netlink.NUD_FAILED},
+	}
+
+	// Failed gateways are down, unresolved ones and the node's own aren't
+	up := gatewaysUp(gateways, neighs, gateways[0])
+	if !sameIPs(up, gateways[:2]) {
+		t.Fatalf("Expected %v up, got %v", gateways[:2], up)
+	}
+
+	// Containers keep every gateway if all are down
+	neighs = []netlink.Neigh{{IP: gateways[1], State: netlink.NUD_FAILED}, {IP: gateways[2], State: netlink.NUD_FAILED}}
+	if up := gatewaysUp(gateways[1:], neighs, gateways[0]); !sameIPs(up, gateways[1:]) {
+		t.Fatalf("Expected every gateway kept, got %v", up)
+	}
+}
+
+func TestECMPRoute(t *testing.T) {
+	gateways := []net.IP{net.ParseIP("10.244.0.1"), net.ParseIP("10.244.0.2")}
+	ecmp := netlink.Route{MultiPath: []*netlink.NexthopInfo{{LinkIndex: 3, Gw: gateways[0]}, {LinkIndex: 3, Gw: gateways[1]}}}
+	withdrawn := netlink.Route{LinkIndex: 3, Gw: gateways[1]}
+	other := netlink.Route{LinkIndex: 3, Gw: net.ParseIP("10.244.0.9")}
+	otherLink := netlink.Route{LinkIndex: 4, Gw: gateways[0]}
+
+	for _, route := range []netlink.Route{ecmp, withdrawn} {
+		if got := ecmpRoute([]netlink.Route{other, otherLink, route}, 3, gateways, 0); got == nil || !sameIPs(routeGateways(*got), routeGateways(route)) {
+			t.Fatalf("Expected route via %v, got %+v", routeGateways(route), got)
+		}
+	}
+	// Default routes of other gateways or metrics aren't the network's
+	if got := ecmpRoute([]netlink.Route{other, otherLink}, 3, gateways, 0); got != nil {
+		t.Fatalf("Expected no route, got %+v", got)
+	}
+	if got := ecmpRoute([]netlink.Route{ecmp}, 3, gateways, 100); got != nil {
+		t.Fatalf("Expected no route of metric 100, got %+v", got)
+	}
+}
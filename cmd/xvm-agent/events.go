@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Reasons of the events, naming the drift found
+const (
+	reasonVxlanMissing     = "VxlanMissing"
+	reasonVxlanMismatch    = "VxlanMismatch"
+	reasonL2Missing        = "L2DeviceMissing"
+	reasonLinkDown         = "LinkDown"
+	reasonMTUMismatch      = "MTUMismatch"
+	reasonOffloadMismatch  = "OffloadMismatch"
+	reasonPromiscOff       = "PromiscuousModeOff"
+	reasonVLANFilteringOff = "VLANFilteringOff"
+	reasonVRFDetached      = "VRFDetached"
+	reasonGatewayMissing   = "GatewayAddressMissing"
+	reasonPortDetached     = "PortDetached"
+	reasonFloodMissing     = "FloodEntryMissing"
+	reasonInterfaceMissing = "HostInterfaceMissing"
+	reasonOrphaned         = "OrphanedInterface"
+	reasonPMTUBlackhole    = "PMTUBlackhole"
+	reasonPMTURecovered    = "PMTURecovered"
+	reasonPortMapMissing   = "PortMappingMissing"
+	reasonGoneWithReboot   = "AttachmentGoneWithReboot"
+	reasonGatewayWithdrawn = "GatewayWithdrawn"
+	reasonGatewayRestored  = "GatewayRestored"
+)
+
+// event reports drift between a network's configuration and the kernel,
+// and whether it was repaired
+type event struct {
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	// Object is the device or attachment that drifted
+	Object   string `json:"object"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+	// Error is why the repair failed
+	Error string `json:"error,omitempty"`
+}
+
+// eventWriter writes events as JSON lines, for log collectors to pick up
+type eventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{enc: json.NewEncoder(w)}
+}
+
+// emit writes the event, stamped with the current time unless it has one,
+// and returns it
+func (w *eventWriter) emit(e event) event {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Nothing sensible is left to do if stdout is gone
+	_ = w.enc.Encode(e)
+	return e
+}
@@ -0,0 +1,199 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+// Types of the lifecycle events
+const (
+	lifecycleAttachmentCreated = "AttachmentCreated"
+	lifecycleAttachmentDeleted = "AttachmentDeleted"
+	lifecycleIPAllocated       = "IPAllocated"
+	lifecycleIPReleased        = "IPReleased"
+	lifecyclePeerAdded         = "PeerAdded"
+	lifecyclePeerRemoved       = "PeerRemoved"
+)
+
+// lifecycleEvent reports an attachment, address or peer of a network that
+// appeared or went away between passes
+type lifecycleEvent struct {
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Network string    `json:"network"`
+	Type    string    `json:"type"`
+	// Attachment is the attachment's key, for attachment and address events
+	Attachment   string `json:"attachment,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	// IP is the address, for address events, or the VTEP, for peer events
+	IP string `json:"ip,omitempty"`
+}
+
+// networkState is what lifecycle events are derived from
+type networkState struct {
+	// attachments holds the attachments' addresses, by attachment key
+	attachments map[string][]netconf.Allocation
+	// peers holds the remote VTEPs of the VXLAN device
+	peers map[string]bool
+}
+
+// lifecycleTracker compares the networks' states between passes
+type lifecycleTracker struct {
+	node string
+	// last holds the state seen in the latest pass, by network
+	last map[string]*networkState
+}
+
+func newLifecycleTracker(node string) *lifecycleTracker {
+	return &lifecycleTracker{node: node, last: make(map[string]*networkState)}
+}
+
+// observe reads the network's state and returns the events since the
+// previous pass. The first pass only records the state, as what changed
+// before the agent started is unknown.
+func (t *lifecycleTracker) observe(n *netconf.Network) ([]lifecycleEvent, error) {
+	cur, err := readNetworkState(n)
+	if err != nil {
+		return nil, err
+	}
+	prev, ok := t.last[n.Name]
+	t.last[n.Name] = cur
+	if !ok {
+		return nil, nil
+	}
+	events := diffNetworkState(prev, cur)
+	now := time.Now().UTC()
+	for i := range events {
+		events[i].Time = now
+		events[i].Node = t.node
+		events[i].Network = n.Name
+	}
+	return events, nil
+}
+
+// forget drops the state of networks no longer configured, so they start
+// over if they come back
+func (t *lifecycleTracker) forget(networks []*netconf.Network) {
+	names := make(map[string]bool, len(networks))
+	for _, n := range networks {
+		names[n.Name] = true
+	}
+	for name := range t.last {
+		if !names[name] {
+			delete(t.last, name)
+		}
+	}
+}
+
+// readNetworkState reads the allocations under the network's lock, and the
+// VTEPs in the VXLAN device's forwarding entries, none if it is missing
+func readNetworkState(n *netconf.Network) (*networkState, error) {
+	unlock, err := n.Lock()
+	if err != nil {
+		return nil, err
+	}
+	allocations, err := n.Allocations()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	s := &networkState{attachments: make(map[string][]netconf.Allocation), peers: make(map[string]bool)}
+	for _, a := range allocations {
+		s.attachments[a.Attachment] = append(s.attachments[a.Attachment], a)
+	}
+
+	if n.VxlanName() == "" {
+		return s, nil
+	}
+	link, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		return s, nil
+	}
+	entries, err := netlink.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range peersOf(entries) {
+		s.peers[p.IP] = true
+	}
+	return s, nil
+}
+
+// diffNetworkState returns the events turning one state into another:
+// attachments deleted with the addresses they released first, then those
+// created with the addresses they were allocated, then peers, each sorted
+func diffNetworkState(prev, cur *networkState) []lifecycleEvent {
+	var events []lifecycleEvent
+	allocation := func(typ string, a netconf.Allocation) lifecycleEvent {
+		return lifecycleEvent{Type: typ, Attachment: a.Attachment, PodNamespace: a.PodNamespace, PodName: a.PodName, IP: a.IP}
+	}
+	attachment := func(typ string, allocations []netconf.Allocation) lifecycleEvent {
+		e := allocation(typ, allocations[0])
+		e.IP = ""
+		return e
+	}
+	// added returns the allocations of a not in b
+	added := func(a, b []netconf.Allocation) []netconf.Allocation {
+		var diff []netconf.Allocation
+		for _, x := range a {
+			found := false
+			for _, y := range b {
+				found = found || x.IP == y.IP
+			}
+			if !found {
+				diff = append(diff, x)
+			}
+		}
+		return diff
+	}
+
+	for _, key := range sortedKeys(prev.attachments) {
+		old, now := prev.attachments[key], cur.attachments[key]
+		for _, a := range added(old, now) {
+			events = append(events, allocation(lifecycleIPReleased, a))
+		}
+		if len(now) == 0 {
+			events = append(events, attachment(lifecycleAttachmentDeleted, old))
+		}
+	}
+	for _, key := range sortedKeys(cur.attachments) {
+		old, now := prev.attachments[key], cur.attachments[key]
+		if len(old) == 0 {
+			events = append(events, attachment(lifecycleAttachmentCreated, now))
+		}
+		for _, a := range added(now, old) {
+			events = append(events, allocation(lifecycleIPAllocated, a))
+		}
+	}
+
+	for _, ip := range sortedKeys(prev.peers) {
+		if !cur.peers[ip] {
+			events = append(events, lifecycleEvent{Type: lifecyclePeerRemoved, IP: ip})
+		}
+	}
+	for _, ip := range sortedKeys(cur.peers) {
+		if !prev.peers[ip] {
+			events = append(events, lifecycleEvent{Type: lifecyclePeerAdded, IP: ip})
+		}
+	}
+	return events
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
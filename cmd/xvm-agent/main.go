@@ -0,0 +1,401 @@
+//go:build linux
+// +build linux
+
+// xvm-agent runs on nodes using xvm-cni and keeps the kernel state of their
+// networks in line with the configurations and allocations, repairing what
+// was changed or removed behind the plugin's back. It serves a control API
+// for tools querying and administering the node's networks.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+const (
+	// defaultConfigDir is where runtimes read network configurations from
+	defaultConfigDir = "/etc/cni/net.d"
+	// defaultInterval is how often the networks are reconciled
+	defaultInterval = 30 * time.Second
+	// attachmentGrace is how long an attachment may lack host interfaces
+	// before it is reported, so ADDs in progress, which allocate before they
+	// create the interfaces, aren't
+	attachmentGrace = 5 * time.Second
+	// shutdownTimeout bounds how long requests in flight, such as captures,
+	// may delay exiting
+	shutdownTimeout = 5 * time.Second
+)
+
+// errNetworkNotFound is returned for networks without a configuration
+var errNetworkNotFound = errors.New("network not found")
+
+// agent reconciles the node's networks and answers the control API
+type agent struct {
+	configDir string
+	config    string
+	r         *reconciler
+	// nodes programs the routes to other nodes, if watching them
+	nodes *nodeWatcher
+	// pmtu checks the paths to the peers for PMTU blackholes, if enabled
+	pmtu *pmtuChecker
+	// bgp announces the workloads to the upstream routers, if enabled
+	bgp *bgpAnnouncer
+	// lifecycle and notifier report attachments, addresses and peers
+	// coming and going, if notifications are enabled
+	lifecycle *lifecycleTracker
+	notifier  *notifier
+
+	// mu serializes passes, whether periodic or requested over the API
+	mu   sync.Mutex
+	last passResult
+}
+
+// passResult is the outcome of a reconciliation pass
+type passResult struct {
+	Time   time.Time `json:"time"`
+	Events []event   `json:"events"`
+	Errors []string  `json:"errors,omitempty"`
+}
+
+func main() {
+	configDir := flag.String("config-dir", defaultConfigDir, "Directory of the network configurations to reconcile")
+	config := flag.String("config", "", "Reconcile only the network of this configuration file")
+	interval := flag.Duration("interval", defaultInterval, "Time between reconciliations")
+	once := flag.Bool("once", false, "Reconcile once and exit")
+	dryRun := flag.Bool("dry-run", false, "Report drift without repairing it")
+	deleteOrphans := flag.Bool("delete-orphans", false, "Delete the host interfaces removed containers left behind rather than only reporting them")
+	socket := flag.String("socket", defaultSocketPath, "Unix socket to serve the control API on (empty to disable)")
+	listen := flag.String("listen", "", "TCP address to also serve the control API on, requires --token-file")
+	tokenFile := flag.String("token-file", "", "File holding the bearer token TCP clients must present")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve the TCP API with TLS, required unless --listen is a loopback address")
+	tlsKey := flag.String("tls-key", "", "Key of --tls-cert")
+	watchNodes := flag.Bool("watch-nodes", false, "Watch the Kubernetes nodes and route to their pod CIDRs")
+	nodeName := flag.String("node-name", os.Getenv("NODE_NAME"), "Name of this Kubernetes node (default: $NODE_NAME or the hostname)")
+	watchNetworks := flag.Bool("watch-networks", false, "Watch the XVMNetwork resources and render them into --config-dir")
+	kubeconfig := flag.String("kubeconfig", "", "Kubeconfig to watch the XVMNetworks with (default: the pod's service account)")
+	networkHostInterface := flag.String("network-host-interface", "", "Host interface of the XVMNetworks that don't set spec.hostInterface")
+	nodeRouting := flag.String("node-routing", nodeRoutingOverlay, "How --watch-nodes routes to the other nodes' pod CIDRs: overlay, or host-gw to route to nodes on the underlay subnet directly")
+	nodeNetwork := flag.String("node-network", "", "Network to reach the other nodes through and to announce over BGP, if several are configured")
+	webhookURL := flag.String("webhook-url", "", "URL to POST attachment, address and peer lifecycle events to")
+	webhookTokenFile := flag.String("webhook-token-file", "", "File holding the bearer token to send to --webhook-url")
+	natsURL := flag.String("nats-url", "", "NATS server to publish lifecycle events to, e.g. nats://nats.example.com:4222")
+	natsSubject := flag.String("nats-subject", defaultNATSSubject, "NATS subject to publish lifecycle events on")
+	pmtuInterval := flag.Duration("pmtu-interval", defaultPMTUInterval, "Time between checks of the underlay paths to the peers for PMTU blackholes (0 to disable)")
+	bgpAS := flag.Uint64("bgp-as", 0, "AS number to announce the workloads to --bgp-peers from (0 to disable BGP)")
+	bgpPeers := flag.String("bgp-peers", "", "Comma-separated BGP peers to announce to, each as <AS>@<address>[:<port>]")
+	bgpRouterID := flag.String("bgp-router-id", "", "BGP identifier (default: the next hop)")
+	bgpNextHop := flag.String("bgp-next-hop", "", "IPv4 address the peers route to the workloads through (default: the network's hostInterface address)")
+	bgpAdvertise := flag.String("bgp-advertise", bgpAdvertisePods, "What to announce over BGP: pods, a /32 for each allocated address, or subnet, the node's pod CIDRs with --watch-nodes or the network's subnet")
+	bgpPasswordFile := flag.String("bgp-password-file", "", "File holding the TCP MD5 password of the BGP sessions")
+	bgpRestartTime := flag.Duration("bgp-restart-time", defaultBGPRestartTime, "Time the BGP peers keep the routes after the agent stops, for it to restart (0 to withdraw them on stop)")
+	flag.Parse()
+
+	// A single pass has nothing to wait for ADDs in progress with
+	grace := attachmentGrace
+	if *once {
+		grace = 0
+	}
+	a := &agent{
+		configDir: *configDir,
+		config:    *config,
+		r:         newReconciler(*dryRun, grace, newEventWriter(os.Stdout)),
+	}
+	a.r.deleteOrphans = *deleteOrphans
+
+	// Fail fast rather than run networks whose jumbo frames the underlay
+	// drops
+	if err := a.probeMTU(); err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *once {
+		if len(a.pass().Errors) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var sinks []sink
+	if *webhookURL != "" {
+		s, err := newWebhookSink(*webhookURL, *webhookTokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if *natsURL != "" {
+		s, err := newNATSSink(*natsURL, *natsSubject)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) > 0 {
+		self, err := resolveNodeName(*nodeName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		a.lifecycle = newLifecycleTracker(self)
+		a.notifier = newNotifier(sinks)
+		go a.notifier.run(ctx)
+	}
+	if *pmtuInterval > 0 {
+		a.pmtu = newPMTUChecker(*dryRun, a.r.events)
+		go a.pmtu.run(ctx, a, *pmtuInterval)
+	}
+	if *watchNetworks {
+		if _, err := startNetworkController(ctx, a, *kubeconfig, *networkHostInterface); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *bgpAS != 0 {
+		b, err := startBGP(ctx, a, bgpOptions{
+			localAS:      *bgpAS,
+			peers:        *bgpPeers,
+			passwordFile: *bgpPasswordFile,
+			routerID:     *bgpRouterID,
+			nextHop:      *bgpNextHop,
+			advertise:    *bgpAdvertise,
+			restartTime:  *bgpRestartTime,
+			network:      *nodeNetwork,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		a.bgp = b
+	}
+	if *watchNodes {
+		w, err := startNodeWatcher(ctx, a, *nodeName, *nodeNetwork, *nodeRouting)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		a.nodes = w
+	}
+
+	var servers []*http.Server
+	if *socket != "" {
+		srv, err := serveUnix(*socket, a.handler())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		servers = append(servers, srv)
+	}
+	if *listen != "" {
+		srv, err := serveTCP(*listen, a.handler(), *tokenFile, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		servers = append(servers, srv)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		a.pass()
+		select {
+		case <-ticker.C:
+		case <-signals:
+			stop()
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			for _, srv := range servers {
+				srv.Shutdown(ctx)
+			}
+			return
+		}
+	}
+}
+
+// pass reconciles every network once and returns the drift found
+func (a *agent) pass() passResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := passResult{Time: time.Now().UTC()}
+	a.r.recorded = nil
+	networks, err := a.networks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: %v\n", err)
+		result.Errors = append(result.Errors, err.Error())
+	}
+	for _, n := range networks {
+		if err := a.r.reconcile(n); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: network %s: %v\n", n.Name, err)
+			result.Errors = append(result.Errors, fmt.Sprintf("network %s: %v", n.Name, err))
+		}
+		if a.pmtu != nil {
+			if err := a.pmtu.mitigate(n); err != nil {
+				fmt.Fprintf(os.Stderr, "xvm-agent: network %s: %v\n", n.Name, err)
+				result.Errors = append(result.Errors, fmt.Sprintf("network %s: %v", n.Name, err))
+			}
+		}
+		if a.lifecycle != nil {
+			a.observe(n)
+		}
+	}
+	if a.lifecycle != nil && err == nil {
+		a.lifecycle.forget(networks)
+	}
+	result.Events = a.r.recorded
+	if a.nodes != nil {
+		a.nodes.sync()
+	}
+	if a.bgp != nil {
+		if err := a.bgp.announce(a); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: bgp: %v\n", err)
+			result.Errors = append(result.Errors, fmt.Sprintf("bgp: %v", err))
+		}
+	}
+	a.last = result
+	return result
+}
+
+// probeMTU checks that the underlay carries the encapsulated frames of each
+// network's MTU to its peers. Networks that fail to load are left to the
+// passes to report.
+func (a *agent) probeMTU() error {
+	networks, _ := a.networks()
+	for _, n := range networks {
+		if err := n.ProbeMTU(); err != nil {
+			return fmt.Errorf("network %s: mtu %d: %v", n.Name, n.MTU, err)
+		}
+	}
+	return nil
+}
+
+// startNodeWatcher connects to the API server as the network's kubernetes
+// block configures, and starts watching the nodes
+func startNodeWatcher(ctx context.Context, a *agent, self, network, routing string) (*nodeWatcher, error) {
+	if routing != nodeRoutingOverlay && routing != nodeRoutingHostGW {
+		return nil, fmt.Errorf("invalid --node-routing %q: must be %s or %s", routing, nodeRoutingOverlay, nodeRoutingHostGW)
+	}
+	self, err := resolveNodeName(self)
+	if err != nil {
+		return nil, err
+	}
+	n, err := a.nodeNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	config, err := n.Kubernetes.Config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := k8s.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	w := newNodeWatcher(a, client, self, network, routing == nodeRoutingHostGW)
+	go w.run(ctx)
+	return w, nil
+}
+
+// observe notifies the lifecycle events of a network since the previous
+// pass
+func (a *agent) observe(n *netconf.Network) {
+	events, err := a.lifecycle.observe(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: network %s: failed to read lifecycle state: %v\n", n.Name, err)
+		return
+	}
+	for _, e := range events {
+		a.notifier.notify(e)
+	}
+}
+
+// resolveNodeName returns the node's name, the hostname unless set
+func resolveNodeName(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get node name: %v", err)
+	}
+	return name, nil
+}
+
+// lastPass returns the outcome of the latest pass
+func (a *agent) lastPass() passResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// networks reads the networks to reconcile, followed by their namespace
+// segments. The directory is read on every pass, so networks added or
+// removed later are picked up.
+func (a *agent) networks() ([]*netconf.Network, error) {
+	var networks []*netconf.Network
+	if a.config != "" {
+		n, err := netconf.Load(a.config)
+		if err != nil {
+			return nil, err
+		}
+		networks = []*netconf.Network{n}
+	} else {
+		var err error
+		if networks, err = netconf.LoadDir(a.configDir); err != nil {
+			return nil, err
+		}
+	}
+	var segments []*netconf.Network
+	for _, n := range networks {
+		segments = append(segments, n.Segments()...)
+	}
+	return append(networks, segments...), nil
+}
+
+// network returns the network with the given name
+func (a *agent) network(name string) (*netconf.Network, error) {
+	networks, err := a.networks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errNetworkNotFound, name)
+}
+
+// nodeNetwork returns the network whose overlay reaches the other nodes: the
+// one with the given name, or the only one configured
+func (a *agent) nodeNetwork(name string) (*netconf.Network, error) {
+	if name != "" {
+		return a.network(name)
+	}
+	networks, err := a.networks()
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) != 1 {
+		return nil, fmt.Errorf("%d networks configured, select the one to reach other nodes through with --node-network", len(networks))
+	}
+	return networks[0], nil
+}
@@ -0,0 +1,455 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+const (
+	// annotationVtepIP is the underlay address other nodes tunnel to; the
+	// node's InternalIP is used without it
+	annotationVtepIP = "xvm-cni.dev/vtep-ip"
+	// annotationGatewayMAC is the MAC address of the node's bridge or shim,
+	// which routed traffic for the node's pods is sent to
+	annotationGatewayMAC = "xvm-cni.dev/gateway-mac"
+)
+
+// How the other nodes' pod CIDRs are routed to
+const (
+	// nodeRoutingOverlay routes them through the overlay
+	nodeRoutingOverlay = "overlay"
+	// nodeRoutingHostGW routes them through the underlay address of nodes
+	// on the same underlay subnet, without encapsulation, and through the
+	// overlay otherwise
+	nodeRoutingHostGW = "host-gw"
+)
+
+// nodePeer is another node of the cluster, reached through the overlay or,
+// in host-gw mode, the underlay
+type nodePeer struct {
+	name string
+	vtep net.IP
+	// mac is the node's gateway MAC, nil until its agent published it
+	mac      net.HardwareAddr
+	podCIDRs []*net.IPNet
+	// mtu lowers the MTU of the routes to the node's pods to what a
+	// blackholed underlay path carries, 0 to leave it
+	mtu int
+	// via is the underlay device the node's pods are routed through
+	// directly in host-gw mode, 0 to route them through the overlay
+	via int
+}
+
+// equal reports whether the peer is programmed the same as another. The
+// route MTU is left out, as programming a peer again replaces its routes.
+func (p *nodePeer) equal(o *nodePeer) bool {
+	if !p.vtep.Equal(o.vtep) || !bytes.Equal(p.mac, o.mac) || p.via != o.via || len(p.podCIDRs) != len(o.podCIDRs) {
+		return false
+	}
+	for i := range p.podCIDRs {
+		if p.podCIDRs[i].String() != o.podCIDRs[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// peerFromNode returns the peer a node is, or nil if it has no address to
+// tunnel to
+func peerFromNode(node *k8s.Node) *nodePeer {
+	p := &nodePeer{name: node.Metadata.Name, podCIDRs: node.PodCIDRs()}
+	if ip := net.ParseIP(node.Metadata.Annotations[annotationVtepIP]); ip != nil {
+		p.vtep = ip
+	} else if p.vtep = node.InternalIP(false); p.vtep == nil {
+		return nil
+	}
+	if mac, err := net.ParseMAC(node.Metadata.Annotations[annotationGatewayMAC]); err == nil {
+		p.mac = mac
+	}
+	return p
+}
+
+// nodeWatcher watches the cluster's nodes and programs what reaches their
+// pods without multicast: a flood entry replicating broadcasts to each
+// node, and, once the node published its gateway MAC, a route to each of
+// its pod CIDRs through a static neighbor and forwarding entry. In host-gw
+// mode, nodes on the underlay subnet are routed to directly instead. It
+// also publishes this node's VTEP address and gateway MAC for the others.
+type nodeWatcher struct {
+	a        *agent
+	client   *k8s.Client
+	informer *k8s.NodeInformer
+	self     string
+	network  string
+	hostGW   bool
+
+	mu sync.Mutex
+	// programmed are the peers as programmed into the kernel, by name
+	programmed map[string]*nodePeer
+	// published are the annotations last set on this node
+	published map[string]string
+	// sharedSubnet is whether the network's subnet was last seen outside
+	// the node's pod CIDRs, to warn about it once
+	sharedSubnet bool
+}
+
+func newNodeWatcher(a *agent, client *k8s.Client, self, network string, hostGW bool) *nodeWatcher {
+	w := &nodeWatcher{
+		a:          a,
+		client:     client,
+		self:       self,
+		network:    network,
+		hostGW:     hostGW,
+		programmed: make(map[string]*nodePeer),
+	}
+	w.informer = k8s.NewNodeInformer(client, w.sync, func(err error) {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: %v\n", err)
+	})
+	return w
+}
+
+// run watches the nodes until ctx is done, syncing after every change
+func (w *nodeWatcher) run(ctx context.Context) {
+	w.informer.Run(ctx)
+}
+
+// peers returns the other nodes as last seen, by name
+func (w *nodeWatcher) peers() map[string]*nodePeer {
+	peers := make(map[string]*nodePeer)
+	for _, node := range w.informer.List() {
+		if p := peerFromNode(node); p != nil && p.name != w.self {
+			peers[p.name] = p
+		}
+	}
+	return peers
+}
+
+// podCIDRs returns this node's pod CIDRs as last seen
+func (w *nodeWatcher) podCIDRs() []*net.IPNet {
+	if node := w.informer.Get(w.self); node != nil {
+		return node.PodCIDRs()
+	}
+	return nil
+}
+
+// sync publishes this node's annotations and brings the programmed peers in
+// line with the nodes seen. It is also called on every reconciliation, so
+// entries are restored after the devices were recreated.
+func (w *nodeWatcher) sync() {
+	// Until the nodes were listed, every peer would look gone
+	if !w.informer.HasSynced() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.a.nodeNetwork(w.network)
+	if err == nil && n.Mode == netconf.ModeOVS {
+		err = fmt.Errorf("network %s forwards with Open vSwitch, which the node watcher can't program", n.Name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: %v\n", err)
+		return
+	}
+	// Pods reach the addresses of a subnet shared with other nodes on the
+	// segment, so only routing through the overlay reaches them both ways
+	own := w.podCIDRs()
+	shared := !withinPodCIDRs(n.Subnet, own)
+	if shared && len(own) > 0 && !w.sharedSubnet {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: network %s's subnet %s isn't within the node's pod CIDRs %v\n", n.Name, n.Subnet, own)
+	}
+	if shared && w.hostGW && !w.sharedSubnet {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: routing the other nodes through the overlay, as host-gw needs the network's subnet within the node's pod CIDRs\n")
+	}
+	w.sharedSubnet = shared
+
+	// Hold the plugin's lock, so the devices aren't removed or recreated
+	// while their entries are programmed
+	unlock, err := n.Lock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: %v\n", err)
+		return
+	}
+	l2 := w.program(n, w.hostGW && !shared)
+	unlock()
+	if l2 == nil {
+		return
+	}
+	if err := w.publish(n, l2); err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: node watch: %v\n", err)
+	}
+}
+
+// program brings the entries reaching the peers in line with the nodes seen,
+// routing to those on the underlay subnet directly if set. It returns the
+// network's bridge or shim, or nil if the plugin hasn't created the devices.
+func (w *nodeWatcher) program(n *netconf.Network, direct bool) netlink.Link {
+	// The plugin creates the devices with the network's first container;
+	// removing them removed the entries as well
+	vx, err1 := netlink.LinkByName(n.VxlanName())
+	l2, err2 := netlink.LinkByName(n.L2Name())
+	if err1 != nil || err2 != nil {
+		w.programmed = make(map[string]*nodePeer)
+		return nil
+	}
+
+	// Networks flooding nowhere rely on the programmed entries alone
+	flood := n.FloodMode() != vxlan.FloodNone
+	peers := w.peers()
+	if direct {
+		if err := routeDirectly(n, peers); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: node watch: %v\n", err)
+		}
+	}
+	if w.a.pmtu != nil {
+		for _, p := range peers {
+			p.mtu = w.a.pmtu.routeMTU(n.Name, p.vtep)
+		}
+	}
+	for name, old := range w.programmed {
+		if p, ok := peers[name]; !ok || !p.equal(old) {
+			if err := withdrawPeer(vx, l2, n.UsesBridge(), flood, n.RouteTableID(), old); err != nil {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: %v\n", name, err)
+			}
+			delete(w.programmed, name)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: withdrew routes to %v\n", name, old.podCIDRs)
+			}
+		}
+	}
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := peers[name]
+		if err := programPeer(vx, l2, n.UsesBridge(), flood, n.RouteTableID(), p); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: node %s: %v\n", name, err)
+			continue
+		}
+		if _, ok := w.programmed[name]; !ok {
+			if p.via != 0 {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: routing %v directly to %s\n", name, p.podCIDRs, p.vtep)
+			} else if p.mac != nil {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: routing %v through %s\n", name, p.podCIDRs, p.vtep)
+			} else if flood {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: flooding to %s, routes wait for its gateway MAC\n", name, p.vtep)
+			} else {
+				fmt.Fprintf(os.Stderr, "xvm-agent: node %s: routes wait for its gateway MAC\n", name)
+			}
+		}
+		w.programmed[name] = p
+	}
+	return l2
+}
+
+// publish sets this node's VTEP address and gateway MAC annotations if they
+// changed, as they do when the bridge is recreated
+func (w *nodeWatcher) publish(n *netconf.Network, l2 netlink.Link) error {
+	vtep, err := vxlan.LocalIP(n.HostInterface)
+	if err != nil {
+		return err
+	}
+	annotations := map[string]string{
+		annotationVtepIP:     vtep.String(),
+		annotationGatewayMAC: l2.Attrs().HardwareAddr.String(),
+	}
+	if w.published == nil {
+		// The node keeps the annotations of an earlier run of the agent
+		if node := w.informer.Get(w.self); node != nil {
+			w.published = node.Metadata.Annotations
+		}
+	}
+	if w.published[annotationVtepIP] == annotations[annotationVtepIP] && w.published[annotationGatewayMAC] == annotations[annotationGatewayMAC] {
+		return nil
+	}
+	if err := w.client.AnnotateNode(context.Background(), w.self, annotations); err != nil {
+		return err
+	}
+	w.published = annotations
+	return nil
+}
+
+// withinPodCIDRs reports whether the subnet lies within one of the node's
+// pod CIDRs, rather than being shared with the other nodes
+func withinPodCIDRs(subnet string, podCIDRs []*net.IPNet) bool {
+	_, sub, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	ones, _ := sub.Mask.Size()
+	for _, cidr := range podCIDRs {
+		if cidrOnes, _ := cidr.Mask.Size(); cidr.Contains(sub.IP) && cidrOnes <= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDirectly has the peers whose underlay address is on a subnet of the
+// network's host interface routed to through it, rather than the overlay
+func routeDirectly(n *netconf.Network, peers map[string]*nodePeer) error {
+	host, err := netlink.LinkByName(n.HostInterface)
+	if err != nil {
+		return fmt.Errorf("failed to get host interface %s: %v", n.HostInterface, err)
+	}
+	addrs, err := netlink.AddrList(host, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to get addresses of %s: %v", n.HostInterface, err)
+	}
+	for _, p := range peers {
+		for _, addr := range addrs {
+			if addr.IPNet.Contains(p.vtep) && !addr.IP.Equal(p.vtep) {
+				p.via = host.Attrs().Index
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// nexthop returns the address standing for a peer's gateway in routes to
+// the pod CIDR: its network address, which no pod is allocated
+func nexthop(cidr *net.IPNet) net.IP {
+	return cidr.IP.Mask(cidr.Mask)
+}
+
+// peerEntries returns the forwarding entries on the VXLAN device, the
+// neighbors on the bridge or shim, and the routes reaching a peer's pods, in
+// the routing table, 0 for the main one. Peers routed to directly only need
+// the routes through their underlay address.
+func peerEntries(vx, l2 netlink.Link, usesBridge, flood bool, table int, p *nodePeer) (fdb, neighs []*netlink.Neigh, routes []*netlink.Route) {
+	// Broadcasts, such as ARP requests for pods on the same segment, are
+	// replicated to every node, unless the network floods nowhere
+	if flood {
+		fdb = append(fdb, &netlink.Neigh{
+			LinkIndex:    vx.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			IP:           p.vtep,
+			HardwareAddr: make(net.HardwareAddr, 6),
+		})
+	}
+	if p.via != 0 {
+		for _, cidr := range p.podCIDRs {
+			routes = append(routes, &netlink.Route{
+				LinkIndex: p.via,
+				Dst:       cidr,
+				Gw:        p.vtep,
+				Table:     table,
+			})
+		}
+		return fdb, nil, routes
+	}
+	if p.mac == nil {
+		return fdb, nil, nil
+	}
+
+	// Frames to the peer's gateway are tunneled to its VTEP, and the bridge
+	// sends them to the VXLAN port rather than flooding them
+	fdb = append(fdb, &netlink.Neigh{
+		LinkIndex:    vx.Attrs().Index,
+		Family:       unix.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           p.vtep,
+		HardwareAddr: p.mac,
+	})
+	if usesBridge {
+		fdb = append(fdb, &netlink.Neigh{
+			LinkIndex:    vx.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_NOARP,
+			Flags:        netlink.NTF_MASTER,
+			HardwareAddr: p.mac,
+		})
+	}
+	for _, cidr := range p.podCIDRs {
+		gw := nexthop(cidr)
+		neighs = append(neighs, &netlink.Neigh{
+			LinkIndex:    l2.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           gw,
+			HardwareAddr: p.mac,
+		})
+		routes = append(routes, &netlink.Route{
+			LinkIndex: l2.Attrs().Index,
+			Dst:       cidr,
+			Gw:        gw,
+			Flags:     int(netlink.FLAG_ONLINK),
+			MTU:       p.mtu,
+			Table:     table,
+		})
+	}
+	return fdb, neighs, routes
+}
+
+// programPeer installs the entries reaching a peer, replacing any left from
+// before
+func programPeer(vx, l2 netlink.Link, usesBridge, flood bool, table int, p *nodePeer) error {
+	fdb, neighs, routes := peerEntries(vx, l2, usesBridge, flood, table, p)
+	for _, e := range fdb {
+		add := netlink.NeighSet
+		// Every flood destination is another entry for the all-zeros MAC
+		if bytes.Equal(e.HardwareAddr, make(net.HardwareAddr, 6)) {
+			add = netlink.NeighAppend
+		}
+		if err := add(e); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add forwarding entry %s to %s: %v", e.HardwareAddr, e.IP, err)
+		}
+	}
+	for _, neigh := range neighs {
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor %s: %v", neigh.IP, err)
+		}
+	}
+	for _, route := range routes {
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", route.Dst, err)
+		}
+	}
+	return nil
+}
+
+// withdrawPeer removes the entries reaching a peer. Those already gone are
+// skipped.
+func withdrawPeer(vx, l2 netlink.Link, usesBridge, flood bool, table int, p *nodePeer) error {
+	fdb, neighs, routes := peerEntries(vx, l2, usesBridge, flood, table, p)
+	gone := func(err error) bool {
+		return err == nil || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH)
+	}
+	for _, route := range routes {
+		if err := netlink.RouteDel(route); !gone(err) {
+			return fmt.Errorf("failed to remove route to %s: %v", route.Dst, err)
+		}
+	}
+	for _, neigh := range neighs {
+		if err := netlink.NeighDel(neigh); !gone(err) {
+			return fmt.Errorf("failed to remove neighbor %s: %v", neigh.IP, err)
+		}
+	}
+	for _, e := range fdb {
+		if err := netlink.NeighDel(e); !gone(err) {
+			return fmt.Errorf("failed to remove forwarding entry %s to %s: %v", e.HardwareAddr, e.IP, err)
+		}
+	}
+	return nil
+}
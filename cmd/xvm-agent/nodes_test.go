@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+)
+
+func testNode(name, internalIP string, annotations map[string]string, podCIDRs ...string) *k8s.Node {
+	node := &k8s.Node{}
+	node.Metadata.Name = name
+	node.Metadata.Annotations = annotations
+	node.Spec.PodCIDRs = podCIDRs
+	if internalIP != "" {
+		node.Status.Addresses = append(node.Status.Addresses, struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		}{"InternalIP", internalIP})
+	}
+	return node
+}
+
+func TestPeerFromNode(t *testing.T) {
+	p := peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.1.0/24"))
+	if p == nil || p.vtep.String() != "192.168.1.11" || p.mac != nil {
+		t.Fatalf("Expected peer tunneled to the InternalIP without gateway MAC, got %+v", p)
+	}
+
+	// The published VTEP address takes precedence
+	p = peerFromNode(testNode("node-a", "192.168.1.11", map[string]string{
+		annotationVtepIP:     "10.0.0.11",
+		annotationGatewayMAC: "02:42:ac:11:00:02",
+	}, "10.244.1.0/24"))
+	if p.vtep.String() != "10.0.0.11" || p.mac.String() != "02:42:ac:11:00:02" {
+		t.Fatalf("Expected peer from the annotations, got %+v", p)
+	}
+
+	if p := peerFromNode(testNode("node-a", "", map[string]string{annotationVtepIP: "invalid"})); p != nil {
+		t.Fatalf("Expected no peer without an address, got %+v", p)
+	}
+}
+
+func TestNodePeerEqual(t *testing.T) {
+	a := peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.1.0/24"))
+	b := peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.1.0/24"))
+	if !a.equal(b) {
+		t.Fatalf("Expected equal peers")
+	}
+	b.mac, _ = net.ParseMAC("02:42:ac:11:00:02")
+	if a.equal(b) {
+		t.Fatalf("Expected peers with different MACs to differ")
+	}
+	c := peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.2.0/24"))
+	if a.equal(c) {
+		t.Fatalf("Expected peers with different pod CIDRs to differ")
+	}
+	c = peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.1.0/24"))
+	c.via = 2
+	if a.equal(c) {
+		t.Fatalf("Expected peers routed differently to differ")
+	}
+}
+
+func TestWithinPodCIDRs(t *testing.T) {
+	own := testNode("node-a", "", nil, "10.244.1.0/24", "fd00:1::/64").PodCIDRs()
+	for subnet, want := range map[string]bool{
+		"10.244.1.0/24":   true,
+		"10.244.1.128/25": true,
+		"fd00:1::/64":     true,
+		"10.244.0.0/16":   false,
+		"10.244.2.0/24":   false,
+		"invalid":         false,
+	} {
+		if got := withinPodCIDRs(subnet, own); got != want {
+			t.Errorf("Expected %s within the pod CIDRs to be %v, got %v", subnet, want, got)
+		}
+	}
+}
+
+func TestPeerEntries(t *testing.T) {
+	vx := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Index: 5}}
+	l2 := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Index: 6}}
+	p := peerFromNode(testNode("node-a", "192.168.1.11", nil, "10.244.1.0/24", "10.244.129.0/24"))
+
+	// Without the peer's gateway MAC, it can only be flooded to
+	fdb, neighs, routes := peerEntries(vx, l2, true, true, 0, p)
+	if len(fdb) != 1 || len(neighs) != 0 || len(routes) != 0 {
+		t.Fatalf("Expected only the flood entry, got %d, %d, %d", len(fdb), len(neighs), len(routes))
+	}
+
+	p.mac, _ = net.ParseMAC("02:42:ac:11:00:02")
+	fdb, neighs, routes = peerEntries(vx, l2, true, true, 100, p)
+	if len(fdb) != 3 || len(neighs) != 2 || len(routes) != 2 {
+		t.Fatalf("Expected 3 forwarding entries, 2 neighbors and 2 routes, got %d, %d, %d", len(fdb), len(neighs), len(routes))
+	}
+	if !routes[1].Gw.Equal(net.ParseIP("10.244.129.0")) || routes[1].LinkIndex != 6 || routes[1].Table != 100 {
+		t.Fatalf("Expected route through the pod CIDR's network address on the bridge in table 100, got %+v", routes[1])
+	}
+	if !neighs[1].IP.Equal(routes[1].Gw) || neighs[1].HardwareAddr.String() != "02:42:ac:11:00:02" {
+		t.Fatalf("Expected neighbor resolving the route's gateway to the peer's MAC, got %+v", neighs[1])
+	}
+
+	// Without a bridge, there is no bridge forwarding entry
+	fdb, _, _ = peerEntries(vx, l2, false, true, 0, p)
+	if len(fdb) != 2 {
+		t.Fatalf("Expected 2 forwarding entries without a bridge, got %d", len(fdb))
+	}
+
+	// Networks flooding nowhere get no flood entry
+	fdb, _, _ = peerEntries(vx, l2, true, false, 0, p)
+	if len(fdb) != 2 {
+		t.Fatalf("Expected 2 forwarding entries without flooding, got %d", len(fdb))
+	}
+
+	// Peers routed to directly are reached through their underlay address
+	p.via = 2
+	fdb, neighs, routes = peerEntries(vx, l2, true, true, 0, p)
+	if len(fdb) != 1 || len(neighs) != 0 || len(routes) != 2 {
+		t.Fatalf("Expected the flood entry and 2 routes, got %d, %d, %d", len(fdb), len(neighs), len(routes))
+	}
+	if !routes[0].Gw.Equal(net.ParseIP("192.168.1.11")) || routes[0].LinkIndex != 2 || routes[0].Flags != 0 {
+		t.Fatalf("Expected route through the peer's underlay address, got %+v", routes[0])
+	}
+}
@@ -0,0 +1,297 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// notifyQueueLen is how many lifecycle events wait for delivery before
+	// new ones are dropped
+	notifyQueueLen = 1024
+	// notifyAttempts is how often delivering an event to a sink is tried
+	notifyAttempts = 3
+	// notifyTimeout bounds a single delivery
+	notifyTimeout = 10 * time.Second
+	// defaultNATSPort is the port of nats:// URLs without one
+	defaultNATSPort = "4222"
+	// defaultNATSSubject is the subject lifecycle events are published on
+	defaultNATSSubject = "xvm-cni.events"
+)
+
+// sink delivers lifecycle events to an external system
+type sink interface {
+	send(ctx context.Context, e *lifecycleEvent) error
+	String() string
+}
+
+// notifier delivers lifecycle events to the sinks in the background, so a
+// slow or unreachable endpoint doesn't hold up reconciliation
+type notifier struct {
+	sinks []sink
+	queue chan lifecycleEvent
+}
+
+func newNotifier(sinks []sink) *notifier {
+	return &notifier{
+		sinks: sinks,
+		queue: make(chan lifecycleEvent, notifyQueueLen),
+	}
+}
+
+// notify queues an event, dropping it if the queue is full
+func (n *notifier) notify(e lifecycleEvent) {
+	select {
+	case n.queue <- e:
+	default:
+		fmt.Fprintf(os.Stderr, "xvm-agent: notify: queue full, dropped %s event of %s\n", e.Type, e.Network)
+	}
+}
+
+// run delivers the queued events in order until ctx is done
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case e := <-n.queue:
+			for _, s := range n.sinks {
+				n.deliver(ctx, s, &e)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver sends an event to a sink, retrying with a backoff
+func (n *notifier) deliver(ctx context.Context, s sink, e *lifecycleEvent) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := s.send(sendCtx, e)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt == notifyAttempts || ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: notify: dropped %s event of %s for %s: %v\n", e.Type, e.Network, s, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// webhookSink POSTs every event as JSON to a URL
+type webhookSink struct {
+	url       string
+	tokenFile string
+	client    *http.Client
+}
+
+func newWebhookSink(rawURL, tokenFile string) (*webhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q: must be an http or https URL", rawURL)
+	}
+	return &webhookSink{url: rawURL, tokenFile: tokenFile, client: &http.Client{}}, nil
+}
+
+func (s *webhookSink) String() string { return s.url }
+
+func (s *webhookSink) send(ctx context.Context, e *lifecycleEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.tokenFile != "" {
+		// Re-read, so the token can be rotated without restarting
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// natsSink publishes every event as JSON to a NATS subject, speaking the
+// client protocol over a connection kept open between events
+type natsSink struct {
+	addr    string
+	user    string
+	pass    string
+	token   string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSSink(rawURL, subject string) (*natsSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q: must be a nats:// URL", rawURL)
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultNATSPort
+	}
+	s := &natsSink{addr: net.JoinHostPort(u.Hostname(), port), subject: subject}
+	if u.User != nil {
+		// A user without a password is a token, as for the NATS clients
+		if pass, ok := u.User.Password(); ok {
+			s.user, s.pass = u.User.Username(), pass
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSink) String() string { return "nats://" + s.addr + "/" + s.subject }
+
+func (s *natsSink) send(ctx context.Context, e *lifecycleEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	// The PING makes the server answer once it processed the PUB, reporting
+	// errors such as a subject the user may not publish to
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", s.subject, len(payload), payload)
+	if _, err := io.WriteString(s.conn, msg); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.awaitPong(); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// connect opens the connection and authenticates
+func (s *natsSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	// The server greets with its INFO
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.close()
+		return fmt.Errorf("failed to read server info: %v", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		s.close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired {
+		s.close()
+		return fmt.Errorf("server requires TLS, which isn't supported")
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":    false,
+		"pedantic":   false,
+		"name":       "xvm-agent",
+		"lang":       "go",
+		"user":       s.user,
+		"pass":       s.pass,
+		"auth_token": s.token,
+	})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.awaitPong(); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads until the server answers a PING, failing on errors
+func (s *natsSink) awaitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			// The server checks the connection is alive
+			if _, err := io.WriteString(s.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// close drops the connection, so the next event reconnects
+func (s *natsSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.r = nil, nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func TestDiffNetworkState(t *testing.T) {
+	alloc := func(key, ip string) netconf.Allocation {
+		return netconf.Allocation{Attachment: key, IP: ip, PodNamespace: "default", PodName: "web"}
+	}
+	prev := &networkState{
+		attachments: map[string][]netconf.Allocation{
+			"a/eth0": {alloc("a/eth0", "10.0.0.2")},
+			"b/eth0": {alloc("b/eth0", "10.0.0.3"), alloc("b/eth0", "fd00::3")},
+		},
+		peers: map[string]bool{"192.168.1.2": true},
+	}
+	cur := &networkState{
+		attachments: map[string][]netconf.Allocation{
+			"b/eth0": {alloc("b/eth0", "10.0.0.3")},
+			"c/eth0": {alloc("c/eth0", "10.0.0.4")},
+		},
+		peers: map[string]bool{"192.168.1.3": true},
+	}
+
+	var got []string
+	for _, e := range diffNetworkState(prev, cur) {
+		got = append(got, e.Type+" "+e.Attachment+" "+e.IP)
+	}
+	want := []string{
+		"IPReleased a/eth0 10.0.0.2",
+		"AttachmentDeleted a/eth0 ",
+		"IPReleased b/eth0 fd00::3",
+		"AttachmentCreated c/eth0 ",
+		"IPAllocated c/eth0 10.0.0.4",
+		"PeerRemoved  192.168.1.2",
+		"PeerAdded  192.168.1.3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	// Nothing changed, nothing to report
+	if events := diffNetworkState(cur, cur); len(events) != 0 {
+		t.Fatalf("Expected no events, got %v", events)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan lifecycleEvent, 1)
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The first attempt fails, so the event is retried
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e lifecycleEvent
+		json.NewDecoder(req.Body).Decode(&e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	s, err := newWebhookSink(srv.URL, tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newNotifier([]sink{s})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.run(ctx)
+	n.notify(lifecycleEvent{Network: "xvm-net", Type: lifecycleIPAllocated, IP: "10.0.0.2"})
+
+	select {
+	case e := <-received:
+		if e.Type != lifecycleIPAllocated || e.IP != "10.0.0.2" {
+			t.Fatalf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event wasn't delivered")
+	}
+
+	if _, err := newWebhookSink("ftp://example.com", ""); err == nil {
+		t.Fatalf("Expected non-HTTP URL to be rejected")
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A server speaking just enough of the protocol, recording the CONNECT
+	// and the published messages
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "PING":
+				io.WriteString(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				lines <- line + " " + strings.TrimSpace(payload)
+			default:
+				lines <- line
+			}
+		}
+	}()
+
+	s, err := newNATSSink("nats://t0ken@"+l.Addr().String(), "xvm.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := s.send(ctx, &lifecycleEvent{Network: "xvm-net", Type: lifecyclePeerAdded, IP: "192.168.1.3"}); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+
+	connect := <-lines
+	if !strings.HasPrefix(connect, "CONNECT ") || !strings.Contains(connect, `"auth_token":"t0ken"`) {
+		t.Fatalf("Unexpected CONNECT %q", connect)
+	}
+	// Both events go over the same connection
+	for i := 0; i < 2; i++ {
+		pub := <-lines
+		if !strings.HasPrefix(pub, "PUB xvm.events ") || !strings.Contains(pub, `"type":"PeerAdded"`) {
+			t.Fatalf("Unexpected PUB %q", pub)
+		}
+	}
+
+	if _, err := newNATSSink("http://example.com", "xvm.events"); err == nil {
+		t.Fatalf("Expected non-NATS URL to be rejected")
+	}
+}
@@ -0,0 +1,332 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/pmtu"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// defaultPMTUInterval is how often the underlay paths to the peers are
+// checked for PMTU blackholes
+const defaultPMTUInterval = 5 * time.Minute
+
+// pathState is the outcome of the latest check of the underlay path to a
+// peer
+type pathState struct {
+	Network string `json:"network"`
+	Peer    string `json:"peer"`
+	// Blackhole is set for paths dropping the network's encapsulated
+	// frames without reporting their MTU, typically as an underlay firewall
+	// filters ICMP fragmentation needed
+	Blackhole bool `json:"blackhole"`
+	// MTU is the largest packet a blackholed path carries
+	MTU     int       `json:"mtu,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// innerMTU returns the largest inner packet a blackholed path carries
+// encapsulated, 0 for paths that need no mitigation
+func (s *pathState) innerMTU() int {
+	if !s.Blackhole {
+		return 0
+	}
+	return s.MTU - vxlan.Overhead
+}
+
+// pmtuChecker probes the underlay paths to the peers of the networks for
+// PMTU blackholes. The connections tunneled to a blackholed peer have
+// their TCP MSS clamped, and the node watcher's routes to its pods get the
+// MTU the path carries, so senders fit their packets without the ICMP that
+// never arrives.
+type pmtuChecker struct {
+	dryRun bool
+	events *eventWriter
+
+	mu sync.Mutex
+	// paths holds the paths checked, by network and peer
+	paths map[string]map[string]*pathState
+	// clamped holds the networks whose clamping table is installed
+	clamped map[string]bool
+}
+
+func newPMTUChecker(dryRun bool, events *eventWriter) *pmtuChecker {
+	return &pmtuChecker{
+		dryRun:  dryRun,
+		events:  events,
+		paths:   make(map[string]map[string]*pathState),
+		clamped: make(map[string]bool),
+	}
+}
+
+// run checks the networks every interval until ctx is done. Probing takes
+// up to a few seconds per blackholed peer, so it runs apart from the passes.
+func (c *pmtuChecker) run(ctx context.Context, a *agent, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		networks, _ := a.networks()
+		for _, n := range networks {
+			if n.Mode == netconf.ModeOVS {
+				continue
+			}
+			if err := c.check(n); err != nil {
+				fmt.Fprintf(os.Stderr, "xvm-agent: network %s: PMTU check: %v\n", n.Name, err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check probes the peers of the network, those the VXLAN device tunnels to
+// and those of mtuProbe, reports the blackholes appearing and clearing, and
+// mitigates them
+func (c *pmtuChecker) check(n *netconf.Network) error {
+	vx, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		// The plugin creates the devices with the network's first container
+		return nil
+	}
+	entries, err := netlink.NeighList(vx.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list forwarding entries: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, p := range peersOf(entries) {
+		seen[p.IP] = true
+	}
+	if n.MTUProbe != nil {
+		for _, peer := range n.MTUProbe.Peers {
+			seen[peer] = true
+		}
+	}
+	peers := make([]string, 0, len(seen))
+	for peer := range seen {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	states := make([]*pathState, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			states[i] = probePath(n, peer)
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	prev := c.paths[n.Name]
+	cur := make(map[string]*pathState, len(peers))
+	var changes []event
+	for i, peer := range peers {
+		s := states[i]
+		if s == nil {
+			// A peer not answering tells nothing about its path
+			if s = prev[peer]; s == nil {
+				continue
+			}
+		}
+		cur[peer] = s
+		if e, ok := pathChange(n, prev[peer], s); ok {
+			changes = append(changes, e)
+		}
+	}
+	c.paths[n.Name] = cur
+	c.mu.Unlock()
+
+	err = c.mitigate(n)
+	if rerr := c.record(n); err == nil {
+		err = rerr
+	}
+	for _, e := range changes {
+		if err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Repaired = !c.dryRun
+		}
+		c.events.emit(e)
+	}
+	return err
+}
+
+// probePath returns the state of the path to the peer, nil if it can't be
+// told
+func probePath(n *netconf.Network, peer string) *pathState {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return nil
+	}
+	s := &pathState{Network: n.Name, Peer: peer, Checked: time.Now().UTC()}
+	size := n.MTU + vxlan.Overhead
+	err := pmtu.Probe(n.HostInterface, ip, size, 0)
+	var perr *pmtu.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &perr) && perr.MTU != 0:
+		// The path reports its MTU, so senders learn it
+	case errors.As(err, &perr):
+		// The large probe may have been lost rather than dropped for its
+		// size, which the bisection carrying the full size tells
+		mtu, err := pmtu.Discover(n.HostInterface, ip, size, 0)
+		if err != nil {
+			return nil
+		}
+		if mtu < size {
+			s.Blackhole, s.MTU = true, mtu
+		}
+	default:
+		return nil
+	}
+	return s
+}
+
+// pathChange returns the event of a path turning into a blackhole,
+// shrinking further or recovering, if it did
+func pathChange(n *netconf.Network, prev, cur *pathState) (event, bool) {
+	e := event{Network: n.Name, Object: cur.Peer}
+	switch {
+	case cur.Blackhole && (prev == nil || !prev.Blackhole || prev.MTU != cur.MTU):
+		e.Reason = reasonPMTUBlackhole
+		e.Message = fmt.Sprintf("path drops packets over %d bytes without reporting its MTU, clamping to %d", cur.MTU, cur.innerMTU())
+	case !cur.Blackhole && prev != nil && prev.Blackhole:
+		e.Reason = reasonPMTURecovered
+		e.Message = fmt.Sprintf("path carries %d byte packets again", n.MTU+vxlan.Overhead)
+	default:
+		return event{}, false
+	}
+	return e, true
+}
+
+// mitigate clamps the MSS of the connections tunneled to the network's
+// blackholed peers, matching the MACs the VXLAN device tunnels to them. It
+// is repeated on every pass, as MACs are learned and the plugin recreates
+// the VXLAN device, which takes the clamping chain along.
+func (c *pmtuChecker) mitigate(n *netconf.Network) error {
+	if c.dryRun {
+		return nil
+	}
+	c.mu.Lock()
+	var blackholes []*pathState
+	for _, s := range c.paths[n.Name] {
+		if s.Blackhole {
+			blackholes = append(blackholes, s)
+		}
+	}
+	clamped := c.clamped[n.Name]
+	c.mu.Unlock()
+	sort.Slice(blackholes, func(i, j int) bool { return blackholes[i].Peer < blackholes[j].Peer })
+
+	table := pmtu.TableName(n.VxlanID)
+	if len(blackholes) == 0 {
+		if !clamped {
+			return nil
+		}
+		if err := pmtu.RemoveClamping(table); err != nil {
+			return err
+		}
+		c.setClamped(n.Name, false)
+		return nil
+	}
+
+	vx, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		return nil
+	}
+	entries, err := netlink.NeighList(vx.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list forwarding entries: %v", err)
+	}
+	zero := make(net.HardwareAddr, 6)
+	var clamps []pmtu.Clamp
+	for _, s := range blackholes {
+		clamp := pmtu.Clamp{MTU: s.innerMTU()}
+		for _, e := range entries {
+			if e.IP.String() == s.Peer && len(e.HardwareAddr) == 6 && !bytes.Equal(e.HardwareAddr, zero) {
+				clamp.MACs = append(clamp.MACs, e.HardwareAddr)
+			}
+		}
+		clamps = append(clamps, clamp)
+	}
+	if err := pmtu.SetupClamping(table, vx.Attrs().Name, clamps); err != nil {
+		return err
+	}
+	c.setClamped(n.Name, true)
+	return nil
+}
+
+// record saves the network's blackholes in its data directory, for the
+// plugin to report on STATUS
+func (c *pmtuChecker) record(n *netconf.Network) error {
+	if c.dryRun {
+		return nil
+	}
+	c.mu.Lock()
+	var blackholes []pmtu.Blackhole
+	for _, s := range c.paths[n.Name] {
+		if s.Blackhole {
+			blackholes = append(blackholes, pmtu.Blackhole{Peer: s.Peer, MTU: s.MTU})
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(blackholes, func(i, j int) bool { return blackholes[i].Peer < blackholes[j].Peer })
+	return pmtu.SaveBlackholes(ipam.NetworkDir(n.DataDir, n.Name), blackholes)
+}
+
+func (c *pmtuChecker) setClamped(network string, clamped bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clamped[network] = clamped
+}
+
+// routeMTU returns the MTU of routes tunneled to the peer's VTEP, 0 unless
+// its path is a blackhole
+func (c *pmtuChecker) routeMTU(network string, vtep net.IP) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.paths[network][vtep.String()]; s != nil {
+		return s.innerMTU()
+	}
+	return 0
+}
+
+// states returns the paths checked, sorted by network and peer
+func (c *pmtuChecker) states() []pathState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var states []pathState
+	for _, paths := range c.paths {
+		for _, s := range paths {
+			states = append(states, *s)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Network != states[j].Network {
+			return states[i].Network < states[j].Network
+		}
+		return states[i].Peer < states[j].Peer
+	})
+	return states
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func TestPathChange(t *testing.T) {
+	n := &netconf.Network{Name: "xvm-net", MTU: 1450}
+	healthy := &pathState{Network: n.Name, Peer: "192.168.1.11"}
+	blackhole := &pathState{Network: n.Name, Peer: "192.168.1.11", Blackhole: true, MTU: 1400}
+	smaller := &pathState{Network: n.Name, Peer: "192.168.1.11", Blackhole: true, MTU: 1300}
+
+	for _, c := range []struct {
+		name      string
+		prev, cur *pathState
+		reason    string
+	}{
+		{"first seen healthy", nil, healthy, ""},
+		{"still healthy", healthy, healthy, ""},
+		{"first seen blackholed", nil, blackhole, reasonPMTUBlackhole},
+		{"turned blackhole", healthy, blackhole, reasonPMTUBlackhole},
+		{"still blackholed", blackhole, blackhole, ""},
+		{"shrunk", blackhole, smaller, reasonPMTUBlackhole},
+		{"recovered", blackhole, healthy, reasonPMTURecovered},
+	} {
+		e, ok := pathChange(n, c.prev, c.cur)
+		if ok != (c.reason != "") || e.Reason != c.reason {
+			t.Errorf("%s: expected reason %q, got %q (%v)", c.name, c.reason, e.Reason, ok)
+		}
+		if ok && (e.Network != n.Name || e.Object != c.cur.Peer) {
+			t.Errorf("%s: unexpected event %+v", c.name, e)
+		}
+	}
+}
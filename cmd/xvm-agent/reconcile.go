@@ -0,0 +1,666 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/sublink"
+	"github.com/nohns/xvm-cni/pkg/vrf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// tosInherit is the VXLAN TOS value copying the inner TOS, as the plugin
+// sets it for inheritDSCP
+const tosInherit = 1
+
+// reconciler compares the networks' configurations and allocations with
+// the kernel and repairs the differences
+type reconciler struct {
+	dryRun bool
+	events *eventWriter
+	// grace is how long an attachment may lack its host interfaces before
+	// it is reported, as ADDs allocate before creating them
+	grace time.Duration
+	// missing holds the attachments without host interfaces, by network
+	// and attachment key
+	missing map[string]*missingAttachment
+	// orphans holds when the orphaned host interfaces were first seen, by
+	// network, name and index
+	orphans map[string]time.Time
+	// deleteOrphans deletes the orphaned host interfaces rather than only
+	// reporting them
+	deleteOrphans bool
+	// recorded are the events of the current pass
+	recorded []event
+}
+
+// missingAttachment is an attachment seen without its host interfaces
+type missingAttachment struct {
+	since    time.Time
+	reported bool
+}
+
+func newReconciler(dryRun bool, grace time.Duration, events *eventWriter) *reconciler {
+	return &reconciler{
+		dryRun:  dryRun,
+		events:  events,
+		grace:   grace,
+		missing: make(map[string]*missingAttachment),
+		orphans: make(map[string]time.Time),
+	}
+}
+
+// report emits an event for drift and, unless only reporting, repairs it
+// with fix. A nil fix means the drift can't be repaired safely.
+func (r *reconciler) report(n *netconf.Network, object, reason, message string, fix func() error) {
+	e := event{Network: n.Name, Object: object, Reason: reason, Message: message}
+	if fix != nil && !r.dryRun {
+		if err := fix(); err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Repaired = true
+		}
+	}
+	e = r.events.emit(e)
+	r.recorded = append(r.recorded, e)
+}
+
+// reconcile repairs the devices and port forwarding rules of a network. The
+// devices of OVS networks are left alone, as ovs-vswitchd restores its
+// bridges and ports itself.
+func (r *reconciler) reconcile(n *netconf.Network) error {
+	// Hold the plugin's lock, so devices aren't repaired while an
+	// invocation is creating or removing them
+	unlock, err := n.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// A reboot takes the containers away but leaves their allocations, which
+	// are released before restoring the devices and rules for them
+	if err := r.releaseRebootedAttachments(n); err != nil {
+		return err
+	}
+
+	// Firewall reloads and flushes drop the rules of published ports
+	if err := r.reconcilePortMappings(n); err != nil {
+		return err
+	}
+
+	// Containers route around the gateways that are down
+	if err := r.reconcileDefaultRoutes(n); err != nil {
+		return err
+	}
+	if n.Mode == netconf.ModeOVS {
+		return nil
+	}
+
+	// Interfaces left behind are removed even when no attachment is left
+	if err := r.sweep(n); err != nil {
+		return err
+	}
+
+	// The plugin creates the shared devices with the first attachment and
+	// removes them with the last, so only networks in use should have them
+	allocated, err := allocatedAttachments(n)
+	if err != nil {
+		return err
+	}
+	if len(allocated) == 0 {
+		return nil
+	}
+
+	// Standalone networks only have the bridge
+	var vx *netlink.Vxlan
+	if !n.Standalone {
+		vx, err = r.reconcileVxlan(n)
+		if err != nil || vx == nil {
+			return err
+		}
+		r.reconcileFloodEntry(n, vx)
+	}
+	if !n.UsesBridge() {
+		return r.reconcileShim(n, vx)
+	}
+	br, err := r.reconcileBridge(n, vx)
+	if err != nil || br == nil {
+		return err
+	}
+	return r.reconcilePorts(n, br, allocated)
+}
+
+// releaseRebootedAttachments releases the addresses and port mappings of
+// the attachments whose network namespace is gone since the node rebooted,
+// and records the current boot once all are released
+func (r *reconciler) releaseRebootedAttachments(n *netconf.Network) error {
+	dir := ipam.NetworkDir(n.DataDir, n.Name)
+	state, err := hoststate.Load(dir, n.Name)
+	if err != nil {
+		return err
+	}
+	bootID, err := hoststate.BootID()
+	if err != nil {
+		return err
+	}
+	if !state.Rebooted(bootID) {
+		return nil
+	}
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, key := range state.Stale() {
+		key := key
+		msg := "VM port is gone since the node rebooted; releasing its addresses"
+		if netns := state.Attachments[key]; netns != "" {
+			msg = fmt.Sprintf("network namespace %s is gone since the node rebooted; releasing its addresses", netns)
+		}
+		r.report(n, key, reasonGoneWithReboot, msg, func() error {
+			err := state.Release(dir, key, ipams)
+			failed = failed || err != nil
+			return err
+		})
+	}
+	if r.dryRun || failed {
+		return nil // Released on a later pass
+	}
+	state.BootID = bootID
+	return state.Save(dir)
+}
+
+// allocatedAttachments returns the keys of the attachments holding
+// addresses in the network's subnets
+func allocatedAttachments(n *netconf.Network) ([]string, error) {
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, i := range ipams {
+		for key, ip := range i.Allocations {
+			// Networks may share the data directory
+			if i.Subnet.Contains(ip) && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// sweep reports the host interfaces attachments left behind once they stayed
+// orphaned for the grace period, sparing DELs in progress, which release the
+// addresses before deleting the interfaces, and removes them if asked to
+func (r *reconciler) sweep(n *netconf.Network) error {
+	orphans, err := n.Orphans()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	seen := make(map[string]time.Time)
+	for _, o := range orphans {
+		o := o
+		name := o.Link.Attrs().Name
+		id := fmt.Sprintf("%s/%s/%d", n.Name, name, o.Link.Attrs().Index)
+		since, ok := r.orphans[id]
+		if !ok {
+			since = now
+		}
+		seen[id] = since
+		if now.Sub(since) < r.grace {
+			continue
+		}
+		if !r.deleteOrphans {
+			r.report(n, name, reasonOrphaned, fmt.Sprintf("host interface of %s is left behind, %s", o.Attachment, o.Why), nil)
+			continue
+		}
+		r.report(n, name, reasonOrphaned, fmt.Sprintf("host interface of %s is left behind, %s; deleting it", o.Attachment, o.Why), func() error {
+			return n.RemoveOrphan(o)
+		})
+	}
+
+	for id := range r.orphans {
+		if strings.HasPrefix(id, n.Name+"/") {
+			delete(r.orphans, id)
+		}
+	}
+	for id, since := range seen {
+		r.orphans[id] = since
+	}
+	return nil
+}
+
+// reconcileVxlan recreates the VXLAN device if it is missing or was changed
+// in ways that can't be undone in place, and restores its MTU and state. It
+// returns the device, or nil if it is still missing.
+func (r *reconciler) reconcileVxlan(n *netconf.Network) (*netlink.Vxlan, error) {
+	config := &vxlan.VxlanConfig{
+		HostInterface: n.HostInterface,
+		VxlanID:       n.VxlanID,
+		MTU:           n.MTU,
+		Port:          n.VxlanPort,
+		TxQLen:        n.TxQueueLen,
+		InheritTOS:    n.InheritDSCP,
+		Flooding:      n.FloodMode(),
+	}
+	setup := func() error {
+		vx, err := vxlan.SetupVxlan(config)
+		if err != nil {
+			return err
+		}
+		return offload.Apply(vx.Name, n.VxlanOffloads())
+	}
+	name := n.VxlanName()
+
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		r.report(n, name, reasonVxlanMissing, "VXLAN device is missing; recreating it", setup)
+		return lookupVxlan(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", name, err)
+	}
+	vx, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s device, not VXLAN", name, link.Type())
+	}
+
+	host, err := netlink.LinkByName(n.HostInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host interface %s: %v", n.HostInterface, err)
+	}
+	local, err := vxlan.LocalIP(n.HostInterface)
+	if err != nil {
+		return nil, err
+	}
+	if drift := vxlanDrift(vx, n, host.Attrs().Index, local); len(drift) > 0 {
+		msg := "VXLAN device differs from the configuration: " + strings.Join(drift, ", ")
+		// Recreating the device removes its macvlan or ipvlan children,
+		// which are the containers' interfaces, while bridge ports merely
+		// have to be attached again
+		if n.UsesBridge() {
+			r.report(n, name, reasonVxlanMismatch, msg+"; recreating it", setup)
+		} else {
+			r.report(n, name, reasonVxlanMismatch, msg+"; recreate the network to apply the configuration", nil)
+		}
+		if vx, err = lookupVxlan(name); err != nil || vx == nil {
+			return nil, err
+		}
+	}
+
+	// The kernel caps the MTU the plugin sets at what the underlay carries
+	mtu := n.MTU
+	if max := host.Attrs().MTU - vxlan.Overhead; mtu > max {
+		mtu = max
+	}
+	if vx.Attrs().MTU != mtu {
+		r.report(n, name, reasonMTUMismatch, fmt.Sprintf("MTU is %d instead of %d", vx.Attrs().MTU, mtu), func() error {
+			return netlink.LinkSetMTU(vx, mtu)
+		})
+	}
+	if vx.Attrs().Flags&net.FlagUp == 0 {
+		r.report(n, name, reasonLinkDown, "VXLAN device is down; setting it up", func() error {
+			return netlink.LinkSetUp(vx)
+		})
+	}
+	differing, err := offload.Check(name, n.VxlanOffloads())
+	if err != nil {
+		return nil, err
+	}
+	if len(differing) > 0 {
+		r.report(n, name, reasonOffloadMismatch, "offloads differ from the configuration: "+strings.Join(differing, ", "), func() error {
+			return offload.Apply(name, n.VxlanOffloads())
+		})
+	}
+	return vx, nil
+}
+
+// lookupVxlan returns the VXLAN device, or nil if it doesn't exist
+func lookupVxlan(name string) (*netlink.Vxlan, error) {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", name, err)
+	}
+	vx, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s device, not VXLAN", name, link.Type())
+	}
+	return vx, nil
+}
+
+// vxlanDrift returns the attributes of the VXLAN device that differ from
+// those the plugin creates it with
+func vxlanDrift(vx *netlink.Vxlan, n *netconf.Network, hostIndex int, local net.IP) []string {
+	var drift []string
+	if vx.VxlanId != n.VxlanID {
+		drift = append(drift, fmt.Sprintf("VNI %d instead of %d", vx.VxlanId, n.VxlanID))
+	}
+	if vx.Port != n.VxlanPort {
+		drift = append(drift, fmt.Sprintf("port %d instead of %d", vx.Port, n.VxlanPort))
+	}
+	if mode := vxlan.FloodMode(vx); mode != n.FloodMode() {
+		drift = append(drift, fmt.Sprintf("flooding mode %s instead of %s", mode, n.FloodMode()))
+	} else if group := net.ParseIP(vxlan.MulticastGroup); mode == vxlan.FloodMulticast && !vx.Group.Equal(group) {
+		drift = append(drift, fmt.Sprintf("group %v instead of %s", vx.Group, group))
+	}
+	if vx.VtepDevIndex != hostIndex {
+		drift = append(drift, fmt.Sprintf("underlay device %d instead of %s", vx.VtepDevIndex, n.HostInterface))
+	}
+	if !vx.SrcAddr.Equal(local) {
+		drift = append(drift, fmt.Sprintf("local address %v instead of %s", vx.SrcAddr, local))
+	}
+	if inherit := vx.TOS == tosInherit; inherit != n.InheritDSCP {
+		drift = append(drift, fmt.Sprintf("inheriting the inner TOS is %t instead of %t", inherit, n.InheritDSCP))
+	}
+	return drift
+}
+
+// reconcileFloodEntry restores the forwarding entries flooding traffic to
+// the multicast group or the head-end replication peers, without which the
+// VTEPs can't find each other
+func (r *reconciler) reconcileFloodEntry(n *netconf.Network, vx *netlink.Vxlan) {
+	switch n.FloodMode() {
+	case vxlan.FloodNone:
+		return
+	case vxlan.FloodHeadEnd:
+		r.reconcileFloodPeers(n, vx)
+		return
+	}
+	ok, err := vxlan.HasFloodEntry(vx)
+	if err != nil {
+		r.report(n, vx.Attrs().Name, reasonFloodMissing, err.Error(), nil)
+		return
+	}
+	if !ok {
+		r.report(n, vx.Attrs().Name, reasonFloodMissing, fmt.Sprintf("flood entry to %s is missing; re-adding it", vxlan.MulticastGroup), func() error {
+			return vxlan.AddFloodEntry(vx)
+		})
+	}
+}
+
+// reconcileFloodPeers restores the forwarding entries replicating traffic
+// to the head-end replication peers
+func (r *reconciler) reconcileFloodPeers(n *netconf.Network, vx *netlink.Vxlan) {
+	have, err := vxlan.FloodPeers(vx)
+	if err != nil {
+		r.report(n, vx.Attrs().Name, reasonFloodMissing, err.Error(), nil)
+		return
+	}
+	var missing []net.IP
+next:
+	for _, peer := range n.FloodPeers() {
+		for _, ip := range have {
+			if ip.Equal(peer) {
+				continue next
+			}
+		}
+		missing = append(missing, peer)
+	}
+	if len(missing) > 0 {
+		r.report(n, vx.Attrs().Name, reasonFloodMissing, fmt.Sprintf("flood entries to %v are missing; re-adding them", missing), func() error {
+			return vxlan.AddFloodPeers(vx, missing)
+		})
+	}
+}
+
+// reconcileBridge recreates the bridge if it is missing and restores its
+// state, VRF, gateway addresses and VXLAN port. It returns the bridge, or
+// nil if it is still missing.
+func (r *reconciler) reconcileBridge(n *netconf.Network, vx *netlink.Vxlan) (*netlink.Bridge, error) {
+	name := n.L2Name()
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		r.report(n, name, reasonL2Missing, "bridge is missing; recreating it", func() error {
+			_, err := bridge.SetupBridge(&bridge.BridgeConfig{Name: name, MTU: n.MTU})
+			return err
+		})
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, nil
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", name, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s device, not a bridge", name, link.Type())
+	}
+
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		r.report(n, name, reasonLinkDown, "bridge is down; setting it up", func() error {
+			return netlink.LinkSetUp(br)
+		})
+	}
+	if n.PromiscMode && br.Attrs().Promisc == 0 {
+		r.report(n, name, reasonPromiscOff, "bridge isn't promiscuous; setting it promiscuous", func() error {
+			return netlink.SetPromiscOn(br)
+		})
+	}
+	r.reconcileVRF(n, br)
+	if err := r.reconcileGateways(n, br, func(gw *net.IPNet) error { return bridge.ConfigureGateway(br, gw) }); err != nil {
+		return nil, err
+	}
+	// The VXLAN port carries the VLANs only once it is a port of the
+	// bridge, and loses them with it
+	vlans := n.VLANFiltering && (br.VlanFiltering == nil || !*br.VlanFiltering)
+	if vx != nil && vx.Attrs().MasterIndex != br.Attrs().Index {
+		r.report(n, vx.Attrs().Name, reasonPortDetached, fmt.Sprintf("VXLAN device isn't a port of %s; attaching it", name), func() error {
+			return bridge.AddPort(br, vx)
+		})
+		vlans = n.VLANFiltering
+	}
+	if vlans {
+		var uplink netlink.Link
+		if vx != nil {
+			uplink = vx
+		}
+		r.report(n, name, reasonVLANFilteringOff, "bridge doesn't filter VLANs; enabling VLAN filtering", func() error {
+			return bridge.EnableVLANFiltering(br, uplink)
+		})
+	}
+	return br, nil
+}
+
+// reconcileVRF places the bridge or shim in the network's VRF again,
+// recreating the VRF if missing. Joining drops the IPv6 gateway address,
+// which reconcileGateways restores.
+func (r *reconciler) reconcileVRF(n *netconf.Network, l2 netlink.Link) {
+	if n.VRF == nil {
+		return
+	}
+	if member, err := vrf.Member(n.VRF.Name, l2); err == nil && member {
+		return
+	}
+	r.report(n, l2.Attrs().Name, reasonVRFDetached, fmt.Sprintf("device isn't in VRF %s; adding it", n.VRF.Name), func() error {
+		v, err := vrf.Setup(n.VRF.Name, n.VRF.Table)
+		if err != nil {
+			return err
+		}
+		_, err = vrf.Join(v, l2)
+		return err
+	})
+}
+
+// reconcileShim recreates the shim of a macvlan or ipvlan network if it is
+// missing and restores its state, VRF and gateway addresses
+func (r *reconciler) reconcileShim(n *netconf.Network, vx *netlink.Vxlan) error {
+	name := n.L2Name()
+	config := &sublink.LinkConfig{Mode: n.Mode, Parent: vx, Name: name, MTU: n.MTU}
+	shim, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		r.report(n, name, reasonL2Missing, "shim is missing; recreating it", func() error {
+			_, err := sublink.SetupShim(config)
+			return err
+		})
+		if shim, err = netlink.LinkByName(name); err != nil {
+			return nil
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get %s: %v", name, err)
+	}
+
+	if shim.Attrs().Flags&net.FlagUp == 0 {
+		r.report(n, name, reasonLinkDown, "shim is down; setting it up", func() error {
+			return netlink.LinkSetUp(shim)
+		})
+	}
+	r.reconcileVRF(n, shim)
+	return r.reconcileGateways(n, shim, func(gw *net.IPNet) error { return sublink.ConfigureGateway(shim, gw) })
+}
+
+// reconcileGateways re-adds the gateway addresses missing from the bridge
+// or shim
+func (r *reconciler) reconcileGateways(n *netconf.Network, l2 netlink.Link, configure func(*net.IPNet) error) error {
+	want, err := n.GatewayAddrs()
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(l2, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %s: %v", l2.Attrs().Name, err)
+	}
+	for _, gw := range want {
+		if !hasAddr(addrs, gw) {
+			gw := gw
+			r.report(n, l2.Attrs().Name, reasonGatewayMissing, fmt.Sprintf("gateway address %s is missing; re-adding it", gw), func() error {
+				return configure(gw)
+			})
+		}
+	}
+	return nil
+}
+
+// hasAddr reports whether the address, with its prefix length, is among
+// the addresses
+func hasAddr(addrs []netlink.Addr, want *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet != nil && addr.IP.Equal(want.IP) && bytes.Equal(addr.Mask, want.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcilePorts attaches the allocated attachments' host interfaces to the
+// bridge again and sets them up. Attachments whose interfaces are gone are
+// reported once, after staying gone for the grace period; recreating them
+// takes the container's namespace, so it's left to the runtime.
+func (r *reconciler) reconcilePorts(n *netconf.Network, br *netlink.Bridge, allocated []string) error {
+	links, err := netconf.HostLinks()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	missing := make(map[string]*missingAttachment)
+	for _, key := range allocated {
+		var ports []netlink.Link
+		for _, l := range links[key] {
+			// IFBs redirect ingress traffic and aren't bridge ports
+			if l.Link.Type() != "ifb" {
+				ports = append(ports, l.Link)
+			}
+		}
+
+		if len(ports) == 0 {
+			id := n.Name + "/" + key
+			m, seen := r.missing[id]
+			if !seen {
+				m = &missingAttachment{since: now}
+			}
+			missing[id] = m
+			if !m.reported && now.Sub(m.since) >= r.grace {
+				m.reported = true
+				r.report(n, key, reasonInterfaceMissing, "attachment holds addresses but has no host interface; run 'xvmctl gc' if its container is gone", nil)
+			}
+			continue
+		}
+
+		for _, port := range ports {
+			port := port
+			name := port.Attrs().Name
+			if port.Attrs().MasterIndex != br.Attrs().Index {
+				r.report(n, name, reasonPortDetached, fmt.Sprintf("host interface of %s isn't a port of %s; attaching it", key, br.Attrs().Name), func() error {
+					return bridge.AddPort(br, port)
+				})
+			}
+			if port.Attrs().Flags&net.FlagUp == 0 {
+				r.report(n, name, reasonLinkDown, fmt.Sprintf("host interface of %s is down; setting it up", key), func() error {
+					return netlink.LinkSetUp(port)
+				})
+			}
+		}
+	}
+
+	// Forget the attachments of this network that got their interfaces or
+	// were released
+	for id := range r.missing {
+		if strings.HasPrefix(id, n.Name+"/") {
+			delete(r.missing, id)
+		}
+	}
+	for id, m := range missing {
+		r.missing[id] = m
+	}
+	return nil
+}
+
+// reconcilePortMappings reinstalls the port forwarding rules the plugin
+// stored for the network's attachments once they're gone from the firewall,
+// as after an iptables flush or a firewalld reload
+func (r *reconciler) reconcilePortMappings(n *netconf.Network) error {
+	stored, err := fw.LoadPortMappings(ipam.NetworkDir(n.DataDir, n.Name), n.Name)
+	if err != nil {
+		return err
+	}
+	for _, s := range stored {
+		s := s
+		backend, err := fw.New(s.Backend)
+		if err != nil {
+			return err
+		}
+		ok, err := backend.HasPortMappings(n.Name, s.Attachment, s.Mappings)
+		if err != nil {
+			// The devices are repaired regardless
+			fmt.Fprintf(os.Stderr, "xvm-agent: network %s: %s: %v\n", n.Name, s.Attachment, err)
+			continue
+		}
+		if !ok {
+			r.report(n, s.Attachment, reasonPortMapMissing, fmt.Sprintf("%d port forwarding rules are missing from %s; reinstalling them", len(s.Mappings), s.Backend), func() error {
+				return backend.SetupPortMappings(n.Name, s.Attachment, s.Mappings)
+			})
+		}
+		// The bridge or shim keeps routing loopback addresses after the
+		// reset, so the guard is restored along
+		if !fw.NeedsLoopbackRouting(s.Mappings) {
+			continue
+		}
+		if ok, err := backend.HasLoopbackGuard(n.Name, n.L2Name()); err == nil && !ok {
+			r.report(n, n.L2Name(), reasonPortMapMissing, fmt.Sprintf("loopback guard is missing from %s; reinstalling it", s.Backend), func() error {
+				return backend.SetupLoopbackGuard(n.Name, n.L2Name())
+			})
+		}
+	}
+	return nil
+}
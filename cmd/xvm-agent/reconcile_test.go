@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func TestVxlanDrift(t *testing.T) {
+	n, err := netconf.Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "hostInterface": "eth0", "vxlanID": 42}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	local := net.ParseIP("192.168.1.10")
+	vx := &netlink.Vxlan{
+		VxlanId:      42,
+		Port:         8472,
+		Group:        net.ParseIP("239.1.1.1"),
+		VtepDevIndex: 2,
+		SrcAddr:      local,
+	}
+	if drift := vxlanDrift(vx, n, 2, local); len(drift) != 0 {
+		t.Fatalf("Expected no drift, got %v", drift)
+	}
+
+	// Every attribute the plugin sets is compared
+	vx.Port = 4789
+	vx.Group = nil
+	vx.TOS = tosInherit
+	drift := vxlanDrift(vx, n, 3, net.ParseIP("192.168.1.11"))
+	if len(drift) != 5 {
+		t.Fatalf("Expected port, group, device, address and TOS drift, got %v", drift)
+	}
+	if !strings.Contains(drift[0], "port 4789 instead of 8472") {
+		t.Fatalf("Unexpected drift description: %q", drift[0])
+	}
+
+	// A network replicating to its peers has no group, and still learns
+	n, err = netconf.Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "hostInterface": "eth0", "vxlanID": 42, "flooding": {"mode": "headEnd", "peers": ["192.168.1.11"]}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	vx = &netlink.Vxlan{VxlanId: 42, Port: 8472, VtepDevIndex: 2, SrcAddr: local, Learning: true}
+	if drift := vxlanDrift(vx, n, 2, local); len(drift) != 0 {
+		t.Fatalf("Expected no drift, got %v", drift)
+	}
+	vx.Group = net.ParseIP("239.1.1.1")
+	if drift := vxlanDrift(vx, n, 2, local); len(drift) != 1 || drift[0] != "flooding mode multicast instead of headEnd" {
+		t.Fatalf("Expected flooding mode drift, got %v", drift)
+	}
+}
+
+func TestHasAddr(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.42.0.0/16")
+	gw := &net.IPNet{IP: net.ParseIP("10.42.0.1"), Mask: subnet.Mask}
+	addrs := []netlink.Addr{
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.42.0.1"), Mask: net.CIDRMask(24, 32)}},
+	}
+	// The prefix length decides which subnet the host routes to the bridge
+	if hasAddr(addrs, gw) {
+		t.Fatalf("Expected gateway with another prefix length not to match")
+	}
+	addrs = append(addrs, netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.42.0.1").To4(), Mask: subnet.Mask}})
+	if !hasAddr(addrs, gw) {
+		t.Fatalf("Expected gateway to match")
+	}
+}
+
+func TestReport(t *testing.T) {
+	n := &netconf.Network{Name: "xvm-net"}
+	var out bytes.Buffer
+	fixed := 0
+	fix := func() error { fixed++; return nil }
+
+	// Drift is only repaired outside of dry runs, but reported in both
+	newReconciler(true, 0, newEventWriter(&out)).report(n, "xvmbr42", reasonLinkDown, "bridge is down", fix)
+	newReconciler(false, 0, newEventWriter(&out)).report(n, "xvmbr42", reasonLinkDown, "bridge is down", fix)
+	if fixed != 1 {
+		t.Fatalf("Expected a single repair, got %d", fixed)
+	}
+
+	dec := json.NewDecoder(&out)
+	for _, repaired := range []bool{false, true} {
+		var e event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		if e.Network != "xvm-net" || e.Object != "xvmbr42" || e.Reason != reasonLinkDown || e.Repaired != repaired || e.Time.IsZero() {
+			t.Fatalf("Unexpected event: %+v", e)
+		}
+	}
+}
+
+func TestReleaseRebootedAttachments(t *testing.T) {
+	n, err := netconf.Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "hostInterface": "eth0", "vxlanID": 42, "subnet": "10.42.0.0/24", "gateway": "10.42.0.1"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	n.DataDir = t.TempDir()
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		t.Fatalf("Failed to open IPAM: %v", err)
+	}
+	for _, key := range []string{"ctr-a/eth0", "ctr-b/eth0"} {
+		if _, err := ipams[0].Allocate(key); err != nil {
+			t.Fatalf("Failed to allocate: %v", err)
+		}
+	}
+
+	// ctr-a's namespace survived the reboot, ctr-b's didn't
+	dir := ipam.NetworkDir(n.DataDir, n.Name)
+	kept := filepath.Join(n.DataDir, "cni-a")
+	if err := os.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := &hoststate.State{Network: n.Name, BootID: "previous-boot", Attachments: map[string]string{
+		"ctr-a/eth0": kept,
+		"ctr-b/eth0": filepath.Join(n.DataDir, "cni-b"),
+	}}
+	if err := state.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := newReconciler(false, 0, newEventWriter(&out)).releaseRebootedAttachments(n); err != nil {
+		t.Fatalf("Failed to release attachments: %v", err)
+	}
+	if !strings.Contains(out.String(), reasonGoneWithReboot) || !strings.Contains(out.String(), "ctr-b/eth0") {
+		t.Fatalf("Expected ctr-b to be reported, got %s", out.String())
+	}
+	if ipams, _ = n.OpenIPAM(); ipams[0].Count() != 1 {
+		t.Fatalf("Expected only ctr-a's address left, got %v", ipams[0].Allocations)
+	}
+	state, err = hoststate.Load(dir, n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootID, _ := hoststate.BootID()
+	if state.BootID != bootID || len(state.Attachments) != 1 {
+		t.Fatalf("Expected current boot recorded with ctr-a, got %+v", state)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/neigh"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+// fdbOccupancy is the forwarding entries of a network's devices
+type fdbOccupancy struct {
+	Network string
+	// Bridge is the entries of the bridge's ports, and Vxlan those the
+	// VXLAN device holds itself, its remote VTEPs
+	Bridge int
+	Vxlan  int
+	// Limit is the bridge's learned entries and its limit of them, nil on
+	// kernels without one
+	Limit *bridge.FDBLimit
+}
+
+// fdbOccupancies returns the forwarding entries of the networks whose
+// devices exist
+func fdbOccupancies(networks []*netconf.Network) ([]fdbOccupancy, error) {
+	entries, err := netlink.NeighList(0, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list forwarding entries: %v", err)
+	}
+	var occupancies []fdbOccupancy
+	for _, n := range networks {
+		if !n.UsesBridge() {
+			continue
+		}
+		l2, err := netlink.LinkByName(n.L2Name())
+		if err != nil {
+			continue
+		}
+		o := fdbOccupancy{Network: n.Name}
+		vxlanIndex := -1
+		if name := n.VxlanName(); name != "" {
+			if vx, err := netlink.LinkByName(name); err == nil {
+				vxlanIndex = vx.Attrs().Index
+			}
+		}
+		for _, e := range entries {
+			switch {
+			case e.MasterIndex == l2.Attrs().Index:
+				o.Bridge++
+			case e.LinkIndex == vxlanIndex:
+				o.Vxlan++
+			}
+		}
+		if limit, err := bridge.FDBLimitOf(l2); err == nil {
+			o.Limit = &limit
+		}
+		occupancies = append(occupancies, o)
+	}
+	return occupancies, nil
+}
+
+// writeTableMetrics writes the occupancy of the node's neighbor tables, next
+// to the thresholds past which the kernel evicts entries, and of the
+// networks' forwarding databases
+func writeTableMetrics(b *strings.Builder, networks []*netconf.Network) {
+	fmt.Fprintf(b, "# HELP xvm_agent_neighbor_entries Entries of the neighbor table in the agent's network namespace.\n")
+	fmt.Fprintf(b, "# TYPE xvm_agent_neighbor_entries gauge\n")
+	for _, family := range neigh.Families {
+		if n, err := neigh.Count(family); err == nil {
+			fmt.Fprintf(b, "xvm_agent_neighbor_entries{family=%q} %d\n", family, n)
+		}
+	}
+	fmt.Fprintf(b, "# HELP xvm_agent_neighbor_gc_thresh Garbage collection thresholds of the node's neighbor table.\n")
+	fmt.Fprintf(b, "# TYPE xvm_agent_neighbor_gc_thresh gauge\n")
+	for _, family := range neigh.Families {
+		if !neigh.Sizable(family) {
+			continue
+		}
+		t, err := neigh.Thresholds(family)
+		if err != nil {
+			continue
+		}
+		for i, v := range []int{t.Thresh1, t.Thresh2, t.Thresh3} {
+			fmt.Fprintf(b, "xvm_agent_neighbor_gc_thresh{family=%q,threshold=\"%d\"} %d\n", family, i+1, v)
+		}
+	}
+
+	occupancies, err := fdbOccupancies(networks)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(b, "# HELP xvm_agent_fdb_entries Forwarding entries of the network's bridge ports and VXLAN device.\n")
+	fmt.Fprintf(b, "# TYPE xvm_agent_fdb_entries gauge\n")
+	for _, o := range occupancies {
+		fmt.Fprintf(b, "xvm_agent_fdb_entries{network=%q,device=\"bridge\"} %d\n", o.Network, o.Bridge)
+		fmt.Fprintf(b, "xvm_agent_fdb_entries{network=%q,device=\"vxlan\"} %d\n", o.Network, o.Vxlan)
+	}
+	fmt.Fprintf(b, "# HELP xvm_agent_fdb_learned Forwarding entries the network's bridge learned.\n")
+	fmt.Fprintf(b, "# TYPE xvm_agent_fdb_learned gauge\n")
+	for _, o := range occupancies {
+		if o.Limit != nil {
+			fmt.Fprintf(b, "xvm_agent_fdb_learned{network=%q} %d\n", o.Network, o.Limit.Learned)
+		}
+	}
+	fmt.Fprintf(b, "# HELP xvm_agent_fdb_max_learned Forwarding entries the network's bridge learns at most, 0 for no limit.\n")
+	fmt.Fprintf(b, "# TYPE xvm_agent_fdb_max_learned gauge\n")
+	for _, o := range occupancies {
+		if o.Limit != nil {
+			fmt.Fprintf(b, "xvm_agent_fdb_max_learned{network=%q} %d\n", o.Network, o.Limit.MaxLearned)
+		}
+	}
+}
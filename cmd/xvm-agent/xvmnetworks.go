@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+const (
+	// xvmNetworkFilePrefix names the configuration lists rendered from
+	// XVMNetworks, telling them from those the operator wrote
+	xvmNetworkFilePrefix = "50-xvmnetwork-"
+	// xvmNetworkCNIVersion is the CNI version of the rendered lists
+	xvmNetworkCNIVersion = "1.0.0"
+)
+
+// xvmNetworkSettings are the plugin settings an XVMNetwork's spec.config may
+// hold. Anyone creating XVMNetworks configures every node, so settings that
+// run commands, like hooks, or name files and directories on the node, like
+// dataDir, stay with the node's operator.
+var xvmNetworkSettings = map[string]bool{
+	"capabilities": true, "vxlanPort": true, "ipMasq": true, "hostRoutes": true,
+	"ndpProxy": true, "hairpinMode": true, "promiscMode": true, "txQueueLen": true,
+	"qdisc": true, "vethQueues": true, "disableIPv6": true, "antiSpoofing": true,
+	"namespaceRanges": true, "namespaceVNIs": true, "attachments": true,
+	"unmanaged": true, "dscp": true, "inheritDSCP": true, "vlanFiltering": true,
+	"vlan": true, "offloads": true, "proxyARP": true, "vethNameTemplate": true,
+	"vxlanNameTemplate": true, "bridgeNameTemplate": true, "defaultRoute": true, "secondary": true,
+	"routes": true, "routerAdvertisements": true, "vrf": true, "routeTable": true,
+	"sourceRouting": true, "openFirewall": true, "underlayVLAN": true,
+	"flooding": true, "mtuProbe": true, "egressRules": true,
+	"allowedIngressPorts": true, "ebpf": true, "ovs": true, "podAnnotations": true,
+	"tables": true, "timeouts": true, "disableCheck": true, "disableGC": true,
+	"checkRepairs": true,
+}
+
+// xvmNetworkPaths are the settings within the allowed ones that name files
+// or directories on the node
+var xvmNetworkPaths = map[string]string{
+	"ebpf":   "fsDir",
+	"ovs":    "socketDir",
+	"policy": "networkPolicyDir",
+}
+
+// checkXVMNetworkSettings returns an error naming the settings of the
+// XVMNetwork that it may not set
+func checkXVMNetworkSettings(spec k8s.XVMNetworkSpec) error {
+	var denied []string
+	for k, v := range spec.Config {
+		if !xvmNetworkSettings[k] {
+			denied = append(denied, "spec.config."+k)
+			continue
+		}
+		if path, ok := xvmNetworkPaths[k]; ok {
+			if m, ok := v.(map[string]interface{}); ok && m[path] != nil {
+				denied = append(denied, "spec.config."+k+"."+path)
+			}
+		}
+	}
+	if len(spec.Policy) > 0 {
+		var policy map[string]interface{}
+		if err := json.Unmarshal(spec.Policy, &policy); err != nil {
+			return fmt.Errorf("invalid spec.policy: %v", err)
+		}
+		if policy[xvmNetworkPaths["policy"]] != nil {
+			denied = append(denied, "spec.policy."+xvmNetworkPaths["policy"])
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return fmt.Errorf("%s can't be set by an XVMNetwork", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// networkController renders the cluster's XVMNetworks into configuration
+// lists in the configuration directory, which the runtime and the agent's
+// passes pick up, and removes those of deleted XVMNetworks
+type networkController struct {
+	dir string
+	// hostInterface is the underlay of XVMNetworks that don't name one
+	hostInterface string
+	informer      *k8s.XVMNetworkInformer
+
+	// mu serializes renderings
+	mu sync.Mutex
+}
+
+// startNetworkController connects to the API server with the kubeconfig,
+// the pod's service account if empty, and starts rendering the XVMNetworks
+func startNetworkController(ctx context.Context, a *agent, kubeconfig, hostInterface string) (*networkController, error) {
+	if a.config != "" {
+		return nil, fmt.Errorf("--watch-networks renders into --config-dir and can't be combined with --config")
+	}
+	config, err := (&k8s.Settings{Kubeconfig: kubeconfig}).Config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := k8s.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &networkController{dir: a.configDir, hostInterface: hostInterface}
+	c.informer = k8s.NewXVMNetworkInformer(client, c.render, func(err error) {
+		fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork watch: %v\n", err)
+	})
+	go c.informer.Run(ctx)
+	return c, nil
+}
+
+// render brings the rendered configuration lists in line with the
+// XVMNetworks. Those that fail to render keep their previous list.
+func (c *networkController) render() {
+	// Until the XVMNetworks were listed, every list would look stale
+	if !c.informer.HasSynced() {
+		return
+	}
+	c.sync(c.informer.List())
+}
+
+// sync renders the XVMNetworks and removes the lists of others
+func (c *networkController) sync(xvmNetworks []*k8s.XVMNetwork) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keep := make(map[string]bool)
+	for _, xn := range xvmNetworks {
+		path := filepath.Join(c.dir, xvmNetworkFilePrefix+xn.Metadata.Name+".conflist")
+		keep[path] = true
+		data, err := renderXVMNetwork(xn, c.hostInterface)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork %s: %v\n", xn.Metadata.Name, err)
+			continue
+		}
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+			continue
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork %s: %v\n", xn.Metadata.Name, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork %s: rendered %s\n", xn.Metadata.Name, path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(c.dir, xvmNetworkFilePrefix+"*.conflist"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork: %v\n", err)
+		return
+	}
+	for _, path := range paths {
+		if keep[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork: failed to remove %s: %v\n", path, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "xvm-agent: XVMNetwork %s: removed %s\n", strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), xvmNetworkFilePrefix), ".conflist"), path)
+	}
+}
+
+// renderXVMNetwork returns the configuration list of the XVMNetwork, with
+// hostInterface as underlay unless it names its own
+func renderXVMNetwork(xn *k8s.XVMNetwork, hostInterface string) ([]byte, error) {
+	spec := xn.Spec
+	if spec.VNI <= 0 {
+		return nil, fmt.Errorf("spec.vni is required")
+	}
+	if spec.Subnet == "" && spec.IPv6Subnet == "" {
+		return nil, fmt.Errorf("spec.subnet or spec.ipv6Subnet is required")
+	}
+	if spec.HostInterface != "" {
+		hostInterface = spec.HostInterface
+	}
+	if hostInterface == "" {
+		return nil, fmt.Errorf("no host interface: set spec.hostInterface or --network-host-interface")
+	}
+	if err := checkXVMNetworkSettings(spec); err != nil {
+		return nil, err
+	}
+
+	plugin := map[string]interface{}{
+		"capabilities": map[string]interface{}{"portMappings": true},
+	}
+	for k, v := range spec.Config {
+		plugin[k] = v
+	}
+	plugin["type"] = netconf.PluginType
+	plugin["hostInterface"] = hostInterface
+	plugin["vxlanID"] = spec.VNI
+	for key, value := range map[string]string{
+		"subnet":      spec.Subnet,
+		"gateway":     spec.Gateway,
+		"ipv6Subnet":  spec.IPv6Subnet,
+		"ipv6Gateway": spec.IPv6Gateway,
+		"mode":        spec.Mode,
+	} {
+		if value != "" {
+			plugin[key] = value
+		}
+	}
+	if spec.MTU != 0 {
+		plugin["mtu"] = spec.MTU
+	}
+	if len(spec.Policy) > 0 {
+		plugin["policy"] = spec.Policy
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"cniVersion": xvmNetworkCNIVersion,
+		"name":       xn.Metadata.Name,
+		"plugins":    []interface{}{plugin},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netconf.Parse(data); err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeFileAtomic replaces the file with the data, so readers never see it
+// partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func testXVMNetwork(name string, spec k8s.XVMNetworkSpec) *k8s.XVMNetwork {
+	xn := &k8s.XVMNetwork{Spec: spec}
+	xn.Metadata.Name = name
+	return xn
+}
+
+func TestRenderXVMNetwork(t *testing.T) {
+	xn := testXVMNetwork("tenant-a", k8s.XVMNetworkSpec{
+		VNI:     100,
+		Subnet:  "10.100.0.0/24",
+		Gateway: "10.100.0.1",
+		MTU:     1400,
+		Policy:  json.RawMessage(`{"defaultIngress": "deny"}`),
+		Config:  map[string]interface{}{"txQueueLen": 2000},
+	})
+	data, err := renderXVMNetwork(xn, "eth0")
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	n, err := netconf.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse rendered list: %v", err)
+	}
+	if n.Name != "tenant-a" || n.HostInterface != "eth0" || n.VxlanID != 100 || n.Subnet != "10.100.0.0/24" || n.MTU != 1400 || n.TxQueueLen != 2000 {
+		t.Fatalf("Unexpected network %+v", n)
+	}
+	if _, ok := n.Plugin["policy"]; !ok {
+		t.Fatalf("Expected the policy to be passed to the plugin")
+	}
+
+	xn.Spec.HostInterface = "bond0"
+	if data, err = renderXVMNetwork(xn, "eth0"); err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	if n, _ = netconf.Parse(data); n.HostInterface != "bond0" {
+		t.Fatalf("Expected the spec's host interface, got %s", n.HostInterface)
+	}
+
+	for _, spec := range []k8s.XVMNetworkSpec{
+		{Subnet: "10.100.0.0/24"},
+		{VNI: 100},
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"txQueueLen": "long"}},
+		// Settings running commands or naming paths on the node are the
+		// node operator's
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"hooks": map[string]interface{}{"preAdd": []string{"/bin/sh"}}}},
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"dataDir": "/etc"}},
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"firewallBackend": "firewalld"}},
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"vxlanID": 7}},
+		{VNI: 100, Subnet: "10.100.0.0/24", Config: map[string]interface{}{"ebpf": map[string]interface{}{"fsDir": "/etc"}}},
+		{VNI: 100, Subnet: "10.100.0.0/24", Policy: json.RawMessage(`{"networkPolicyDir": "/etc"}`)},
+	} {
+		if _, err := renderXVMNetwork(testXVMNetwork("bad", spec), "eth0"); err == nil {
+			t.Errorf("Expected %+v to be rejected", spec)
+		}
+	}
+	if _, err := renderXVMNetwork(testXVMNetwork("bad", k8s.XVMNetworkSpec{VNI: 100, Subnet: "10.100.0.0/24"}), ""); err == nil {
+		t.Errorf("Expected a network without host interface to be rejected")
+	}
+}
+
+func TestNetworkControllerSync(t *testing.T) {
+	dir := t.TempDir()
+	c := &networkController{dir: dir, hostInterface: "eth0"}
+	other := filepath.Join(dir, "10-other.conflist")
+	if err := os.WriteFile(other, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := testXVMNetwork("tenant-a", k8s.XVMNetworkSpec{VNI: 100, Subnet: "10.100.0.0/24"})
+	b := testXVMNetwork("tenant-b", k8s.XVMNetworkSpec{VNI: 200, Subnet: "10.200.0.0/24"})
+	c.sync([]*k8s.XVMNetwork{a, b})
+	pathA := filepath.Join(dir, "50-xvmnetwork-tenant-a.conflist")
+	pathB := filepath.Join(dir, "50-xvmnetwork-tenant-b.conflist")
+	for _, path := range []string{pathA, pathB} {
+		if _, err := netconf.Load(path); err != nil {
+			t.Fatalf("Expected %s to be rendered: %v", path, err)
+		}
+	}
+
+	// A broken XVMNetwork keeps its previous list, a deleted one loses it
+	broken := testXVMNetwork("tenant-a", k8s.XVMNetworkSpec{Subnet: "10.100.0.0/24"})
+	c.sync([]*k8s.XVMNetwork{broken})
+	if n, err := netconf.Load(pathA); err != nil || n.VxlanID != 100 {
+		t.Fatalf("Expected the previous list of tenant-a to be kept, got %+v, %v", n, err)
+	}
+	if _, err := os.Stat(pathB); !os.IsNotExist(err) {
+		t.Fatalf("Expected the list of tenant-b to be removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("Expected lists not rendered by the controller to be kept: %v", err)
+	}
+}
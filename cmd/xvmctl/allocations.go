@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func runAllocations(args []string) error {
+	flags := flag.NewFlagSet("allocations", flag.ExitOnError)
+	config := configFlag(flags)
+	asJSON := flags.Bool("json", false, "Print the allocations as JSON")
+	flags.Parse(args)
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+	entries, err := n.Allocations()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ATTACHMENT\tIP\tPOD\tHOST INTERFACES")
+	for _, e := range entries {
+		pod := "-"
+		if e.PodName != "" {
+			pod = e.PodNamespace + "/" + e.PodName
+		}
+		ifaces := "-"
+		if len(e.Interfaces) > 0 {
+			ifaces = strings.Join(e.Interfaces, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Attachment, e.IP, pod, ifaces)
+	}
+	return w.Flush()
+}
+
+func runRelease(args []string) error {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	config := configFlag(flags)
+	force := flags.Bool("force", false, "Release the address even if its attachment still has host interfaces")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: xvmctl release [flags] <ip>")
+	}
+	ip := net.ParseIP(flags.Arg(0))
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", flags.Arg(0))
+	}
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+	key, err := n.Release(ip, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Released %s from %s\n", ip, key)
+	return nil
+}
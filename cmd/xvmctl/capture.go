@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/capture"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func runCapture(args []string) error {
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	containerID := flags.String("container", "", "ID, or unique ID prefix, of the container to capture")
+	ifName := flags.String("ifname", "", "Container interface to capture, if the container has several attachments")
+	vni := flags.Int("vni", 0, "Capture the VXLAN interface of this VNI instead of a container")
+	duration := flags.Duration("duration", 10*time.Second, "How long to capture")
+	output := flags.String("w", "", "pcap file to write (default: <interface>-<time>.pcap)")
+	snapLen := flags.Int("snaplen", capture.DefaultSnapLen, "Bytes to capture of each packet")
+	flags.Parse(args)
+
+	// Resolve the host interface to capture
+	var iface string
+	switch {
+	case *containerID != "" && *vni != 0:
+		return fmt.Errorf("--container and --vni are mutually exclusive")
+	case *containerID != "":
+		var err error
+		if iface, err = netconf.ContainerInterface(*containerID, *ifName); err != nil {
+			return err
+		}
+	case *vni != 0:
+		var err error
+		if iface, err = netconf.VxlanDevice(*vni); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("either --container or --vni is required")
+	}
+
+	path := *output
+	if path == "" {
+		path = fmt.Sprintf("%s-%s.pcap", iface, time.Now().Format("20060102T150405"))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w, err := capture.NewPcapWriter(file, *snapLen)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Capturing on %s for %s\n", iface, *duration)
+	count, err := capture.Capture(iface, *duration, w)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	fmt.Fprintf(os.Stderr, "%d packets written to %s\n", count, path)
+	return nil
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+// defaultPluginPath is where "make install" puts the plugin
+const defaultPluginPath = "/opt/cni/bin/xvm-cni"
+
+// staleGrace is how long an allocation must lack host interfaces before it
+// is stale, so ADDs in progress, which allocate before they create the
+// interfaces, are left alone
+const staleGrace = 5 * time.Second
+
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	config := configFlag(flags)
+	plugin := flags.String("plugin", defaultPluginPath, "Plugin binary to run GC with")
+	release := flags.String("release", "", "Comma-separated attachments (<container ID>/<interface>) to collect, instead of those without host interfaces")
+	dryRun := flags.Bool("dry-run", false, "Print the attachments GC would collect without running it")
+	flags.Parse(args)
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+
+	// The runtime knows which attachments are valid. Without it, the
+	// allocations whose host-side interfaces are gone are stale.
+	var stale []string
+	for _, key := range strings.Split(*release, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		if !n.HasHostPorts() {
+			return fmt.Errorf("attachments of network %s have no host interfaces telling they are in use; name the stale ones with --release", n.Name)
+		}
+		if stale, err = orphanedAttachments(n); err != nil {
+			return err
+		}
+	}
+	sort.Strings(stale)
+	if *dryRun {
+		for _, key := range stale {
+			fmt.Printf("Would collect %s\n", key)
+		}
+		return nil
+	}
+	if len(stale) == 0 {
+		fmt.Println("Nothing to collect")
+		return nil
+	}
+
+	if err := runPluginGC(n, *plugin, stale); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		fmt.Printf("Collected %s\n", key)
+	}
+	return nil
+}
+
+// orphanedAttachments returns the attachments holding addresses without
+// host-side interfaces, both now and after staleGrace
+func orphanedAttachments(n *netconf.Network) ([]string, error) {
+	orphaned := func() (map[string]bool, error) {
+		entries, err := n.Allocations()
+		if err != nil {
+			return nil, err
+		}
+		keys := make(map[string]bool)
+		for _, e := range entries {
+			if len(e.Interfaces) == 0 {
+				keys[e.Attachment] = true
+			}
+		}
+		return keys, nil
+	}
+
+	first, err := orphaned()
+	if err != nil || len(first) == 0 {
+		return nil, err
+	}
+	time.Sleep(staleGrace)
+	second, err := orphaned()
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for key := range first {
+		if second[key] {
+			stale = append(stale, key)
+		}
+	}
+	return stale, nil
+}
+
+// runPluginGC runs the plugin's GC, as a runtime would, so it also removes
+// the stale attachments' devices, filters and flows
+func runPluginGC(n *netconf.Network, plugin string, stale []string) error {
+	conf := make(map[string]interface{}, len(n.Plugin)+1)
+	for k, v := range n.Plugin {
+		conf[k] = v
+	}
+	// GC was added in CNI 1.1.0
+	conf["cniVersion"] = "1.1.0"
+	conf["xvm-cni.dev/stale-attachments"] = stale
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Env = append(os.Environ(), "CNI_COMMAND=GC", "CNI_PATH="+filepath.Dir(plugin))
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// The plugin prints its error as JSON on stdout
+		if msg := strings.TrimSpace(stdout.String()); msg != "" {
+			return fmt.Errorf("GC failed: %s", msg)
+		}
+		return fmt.Errorf("GC failed: %v", err)
+	}
+	return nil
+}
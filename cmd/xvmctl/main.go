@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+// xvmctl is the administrative CLI for nodes running xvm-cni
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// defaultConfigPath is where "make install" puts the network configuration
+const defaultConfigPath = "/etc/cni/net.d/10-xvm.conf"
+
+// command is a subcommand of xvmctl
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{name: "show", summary: "Show a network's devices and attachments", run: runShow},
+	{name: "allocations", summary: "List a network's allocated addresses", run: runAllocations},
+	{name: "release", summary: "Release an allocated address", run: runRelease},
+	{name: "fdb", summary: "Dump the forwarding and neighbor entries of a VNI", run: runFDB},
+	{name: "gc", summary: "Collect the allocations and devices of removed containers", run: runGC},
+	{name: "sweep", summary: "Delete the host interfaces removed containers left behind", run: runSweep},
+	{name: "capture", summary: "Capture a container's traffic into a pcap file", run: runCapture},
+	{name: "state", summary: "Export or import the state of a network", run: runState},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "xvmctl %s: %v\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "xvmctl: unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+// configFlag adds the flag selecting the network configuration file
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", defaultConfigPath, "Network configuration file (.conf or .conflist)")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: xvmctl <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'xvmctl <command> -h' for the flags of a command.\n")
+}
@@ -0,0 +1,252 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func runShow(args []string) error {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	config := configFlag(flags)
+	flags.Parse(args)
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Network:  %s (mode %s, VNI %d)\n", n.Name, n.Mode, n.VxlanID)
+	if name := n.VxlanName(); name != "" {
+		fmt.Printf("VXLAN:    %s\n", describeLink(name))
+	}
+	fmt.Printf("L2:       %s\n", describeLink(n.L2Name()))
+
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return err
+	}
+	for _, i := range ipams {
+		count := 0
+		for _, ip := range i.Allocations {
+			if i.Subnet.Contains(ip) {
+				count++
+			}
+		}
+		fmt.Printf("Subnet:   %s, gateway %s, %d allocated\n", i.Subnet, i.Gateway, count)
+	}
+
+	// The attachments' host-side interfaces, on the network's L2 device or
+	// naming the network in their alias
+	l2, _ := netlink.LinkByName(n.L2Name())
+	links, err := netconf.HostLinks()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(links))
+	for key := range links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ATTACHMENT\tINTERFACE\tTYPE\tSTATE\tMAC\tPOD")
+	for _, key := range keys {
+		for _, l := range links[key] {
+			attrs := l.Link.Attrs()
+			onL2 := l2 != nil && attrs.MasterIndex == l2.Attrs().Index
+			if l.Network != n.Name && !onL2 {
+				continue
+			}
+			pod := l.Pod
+			if pod == "" {
+				pod = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key, attrs.Name, l.Link.Type(), attrs.OperState, attrs.HardwareAddr, pod)
+		}
+	}
+	return w.Flush()
+}
+
+// describeLink returns the state, MTU and addresses of a link
+func describeLink(name string) string {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Sprintf("%s (missing)", name)
+	}
+	attrs := link.Attrs()
+	desc := fmt.Sprintf("%s %s, mtu %d", name, attrs.OperState, attrs.MTU)
+	if v, ok := link.(*netlink.Vxlan); ok {
+		desc += fmt.Sprintf(", local %s, port %d", v.SrcAddr, v.Port)
+	}
+	if attrs.MasterIndex != 0 {
+		if master, err := netlink.LinkByIndex(attrs.MasterIndex); err == nil {
+			desc += ", master " + master.Attrs().Name
+		}
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err == nil {
+		var global []string
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() {
+				global = append(global, addr.IPNet.String())
+			}
+		}
+		if len(global) > 0 {
+			desc += ", addresses " + strings.Join(global, " ")
+		}
+	}
+	return desc
+}
+
+func runFDB(args []string) error {
+	flags := flag.NewFlagSet("fdb", flag.ExitOnError)
+	config := configFlag(flags)
+	vni := flags.Int("vni", 0, "Dump the VNI's state without reading a network configuration")
+	flags.Parse(args)
+
+	n := &netconf.Network{VxlanID: *vni, Mode: "bridge"}
+	if *vni == 0 {
+		var err error
+		if n, err = netconf.Load(*config); err != nil {
+			return err
+		}
+	}
+	if n.Mode == "ovs" {
+		return fmt.Errorf("network %s forwards with Open vSwitch; run 'ovs-appctl fdb/show %s' instead", n.Name, n.OVS.Bridge)
+	}
+	if n.Standalone {
+		return fmt.Errorf("network %s is standalone and has no VXLAN device; run 'bridge fdb show br %s' instead", n.Name, n.L2Name())
+	}
+
+	names, err := linkNames()
+	if err != nil {
+		return err
+	}
+	vxlanLink, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		return fmt.Errorf("VXLAN interface %s not found: %v", n.VxlanName(), err)
+	}
+
+	// Remote VTEPs and MACs learned or programmed on the VXLAN device, and
+	// the MACs the bridge learned on its ports
+	entries, err := netlink.NeighList(0, unix.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list forwarding entries: %v", err)
+	}
+	l2, _ := netlink.LinkByName(n.L2Name())
+	fmt.Printf("Forwarding database of %s:\n", n.VxlanName())
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tPORT\tREMOTE\tSTATE\tFLAGS")
+	for _, e := range entries {
+		onVxlan := e.LinkIndex == vxlanLink.Attrs().Index
+		onL2 := l2 != nil && e.MasterIndex == l2.Attrs().Index
+		if !onVxlan && !onL2 {
+			continue
+		}
+		remote := "-"
+		if e.IP != nil {
+			remote = e.IP.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.HardwareAddr, names[e.LinkIndex], remote, neighState(e.State), neighFlags(e.Flags))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// The neighbors of the gateway, on the bridge or shim
+	if l2 == nil {
+		return nil
+	}
+	neighs, err := netlink.NeighList(l2.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors: %v", err)
+	}
+	fmt.Printf("\nNeighbors of %s:\n", n.L2Name())
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tMAC\tSTATE")
+	for _, neigh := range neighs {
+		mac := "-"
+		if neigh.HardwareAddr != nil {
+			mac = neigh.HardwareAddr.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", neigh.IP, mac, neighState(neigh.State))
+	}
+	return w.Flush()
+}
+
+// linkNames returns the names of the links by index
+func linkNames() (map[int]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	names := make(map[int]string, len(links))
+	for _, link := range links {
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+	return names, nil
+}
+
+// neighState returns the names of a neighbor's NUD states, as "ip neigh"
+// prints them
+func neighState(state int) string {
+	names := []struct {
+		state int
+		name  string
+	}{
+		{netlink.NUD_INCOMPLETE, "INCOMPLETE"},
+		{netlink.NUD_REACHABLE, "REACHABLE"},
+		{netlink.NUD_STALE, "STALE"},
+		{netlink.NUD_DELAY, "DELAY"},
+		{netlink.NUD_PROBE, "PROBE"},
+		{netlink.NUD_FAILED, "FAILED"},
+		{netlink.NUD_NOARP, "NOARP"},
+		{netlink.NUD_PERMANENT, "PERMANENT"},
+	}
+	var set []string
+	for _, n := range names {
+		if state&n.state != 0 {
+			set = append(set, n.name)
+		}
+	}
+	if len(set) == 0 {
+		return "NONE"
+	}
+	return strings.Join(set, ",")
+}
+
+// neighFlags returns the names of a forwarding entry's flags
+func neighFlags(flags int) string {
+	names := []struct {
+		flag int
+		name string
+	}{
+		{netlink.NTF_SELF, "self"},
+		{netlink.NTF_MASTER, "master"},
+		{netlink.NTF_EXT_LEARNED, "extern_learn"},
+		{netlink.NTF_ROUTER, "router"},
+	}
+	var set []string
+	for _, n := range names {
+		if flags&n.flag != 0 {
+			set = append(set, n.name)
+		}
+	}
+	if len(set) == 0 {
+		return "-"
+	}
+	return strings.Join(set, ",")
+}
@@ -0,0 +1,421 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+// stateVersion is the version of the state document, raised on changes
+// older versions of xvmctl can't import
+const stateVersion = 1
+
+// state is the plugin-owned state of a network on a node
+type state struct {
+	Version int       `json:"version" yaml:"version"`
+	Time    time.Time `json:"time" yaml:"time"`
+	Node    string    `json:"node" yaml:"node"`
+	Network struct {
+		Name       string `json:"name" yaml:"name"`
+		Mode       string `json:"mode" yaml:"mode"`
+		VxlanID    int    `json:"vxlanID" yaml:"vxlanID"`
+		Subnet     string `json:"subnet,omitempty" yaml:"subnet,omitempty"`
+		IPv6Subnet string `json:"ipv6Subnet,omitempty" yaml:"ipv6Subnet,omitempty"`
+	} `json:"network" yaml:"network"`
+	Allocations []stateAllocation `json:"allocations" yaml:"allocations"`
+	Attachments []stateAttachment `json:"attachments" yaml:"attachments"`
+	Peers       []statePeer       `json:"peers" yaml:"peers"`
+	Interfaces  []stateInterface  `json:"interfaces" yaml:"interfaces"`
+}
+
+// stateAllocation is an address allocated to an attachment
+type stateAllocation struct {
+	Attachment string      `json:"attachment" yaml:"attachment"`
+	IP         string      `json:"ip" yaml:"ip"`
+	Owner      *stateOwner `json:"owner,omitempty" yaml:"owner,omitempty"`
+}
+
+// stateOwner is the pod an allocation belongs to
+type stateOwner struct {
+	PodNamespace string `json:"podNamespace,omitempty" yaml:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty" yaml:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty" yaml:"podUID,omitempty"`
+}
+
+// stateAttachment is an attachment with host-side interfaces
+type stateAttachment struct {
+	Attachment string   `json:"attachment" yaml:"attachment"`
+	Pod        string   `json:"pod,omitempty" yaml:"pod,omitempty"`
+	Interfaces []string `json:"interfaces" yaml:"interfaces"`
+}
+
+// statePeer is a forwarding entry of the VXLAN device to a remote VTEP
+type statePeer struct {
+	VTEP string `json:"vtep" yaml:"vtep"`
+	// MAC is the all-zeros MAC for flood entries
+	MAC string `json:"mac" yaml:"mac"`
+	// Permanent entries were programmed rather than learned
+	Permanent bool `json:"permanent" yaml:"permanent"`
+}
+
+// stateInterface is a device the plugin created
+type stateInterface struct {
+	Name   string `json:"name" yaml:"name"`
+	Type   string `json:"type" yaml:"type"`
+	MAC    string `json:"mac,omitempty" yaml:"mac,omitempty"`
+	MTU    int    `json:"mtu" yaml:"mtu"`
+	Master string `json:"master,omitempty" yaml:"master,omitempty"`
+	State  string `json:"state" yaml:"state"`
+	// Attachment is that of host-side interfaces
+	Attachment string `json:"attachment,omitempty" yaml:"attachment,omitempty"`
+}
+
+func runState(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runStateExport(args[1:])
+		case "import":
+			return runStateImport(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: xvmctl state export|import [flags]")
+}
+
+func runStateExport(args []string) error {
+	flags := flag.NewFlagSet("state export", flag.ExitOnError)
+	config := configFlag(flags)
+	format := flags.String("format", "json", "Format of the state, json or yaml")
+	output := flags.String("o", "-", "File to write the state to, - for stdout")
+	flags.Parse(args)
+	if *format != "json" && *format != "yaml" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+	// Read allocations and devices as of one point in time
+	unlock, err := n.Lock()
+	if err != nil {
+		return err
+	}
+	s, err := collectState(n)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if *format == "yaml" {
+		data, err = yaml.Marshal(s)
+	} else {
+		data, err = json.MarshalIndent(s, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0600)
+}
+
+// collectState reads the network's state. The caller holds the network
+// lock.
+func collectState(n *netconf.Network) (*state, error) {
+	s := &state{Version: stateVersion, Time: time.Now().UTC()}
+	s.Node, _ = os.Hostname()
+	s.Network.Name = n.Name
+	s.Network.Mode = n.Mode
+	s.Network.VxlanID = n.VxlanID
+	s.Network.Subnet = n.Subnet
+	s.Network.IPv6Subnet = n.IPv6Subnet
+
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return nil, err
+	}
+	s.Allocations = []stateAllocation{}
+	for _, i := range ipams {
+		for key, ip := range i.Allocations {
+			// Networks may share the data directory
+			if !i.Subnet.Contains(ip) {
+				continue
+			}
+			a := stateAllocation{Attachment: key, IP: ip.String()}
+			if owner, ok := i.Owners[key]; ok && !owner.IsEmpty() {
+				a.Owner = &stateOwner{PodNamespace: owner.PodNamespace, PodName: owner.PodName, PodUID: owner.PodUID}
+			}
+			s.Allocations = append(s.Allocations, a)
+		}
+	}
+	sort.Slice(s.Allocations, func(a, b int) bool {
+		if s.Allocations[a].Attachment != s.Allocations[b].Attachment {
+			return s.Allocations[a].Attachment < s.Allocations[b].Attachment
+		}
+		return s.Allocations[a].IP < s.Allocations[b].IP
+	})
+
+	names, err := linkNames()
+	if err != nil {
+		return nil, err
+	}
+	s.Interfaces = []stateInterface{}
+	addInterface := func(link netlink.Link, attachment string) {
+		attrs := link.Attrs()
+		iface := stateInterface{
+			Name:       attrs.Name,
+			Type:       link.Type(),
+			MTU:        attrs.MTU,
+			Master:     names[attrs.MasterIndex],
+			State:      attrs.OperState.String(),
+			Attachment: attachment,
+		}
+		if attrs.HardwareAddr != nil {
+			iface.MAC = attrs.HardwareAddr.String()
+		}
+		s.Interfaces = append(s.Interfaces, iface)
+	}
+	var vx, l2 netlink.Link
+	if name := n.VxlanName(); name != "" {
+		if vx, err = netlink.LinkByName(name); err == nil {
+			addInterface(vx, "")
+		}
+	}
+	if l2, err = netlink.LinkByName(n.L2Name()); err == nil {
+		addInterface(l2, "")
+	}
+
+	// The attachments' host-side interfaces, naming the network in their
+	// alias or on its L2 device
+	links, err := netconf.HostLinks()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(links))
+	for key := range links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s.Attachments = []stateAttachment{}
+	for _, key := range keys {
+		a := stateAttachment{Attachment: key}
+		for _, l := range links[key] {
+			onL2 := l2 != nil && l.Link.Attrs().MasterIndex == l2.Attrs().Index
+			if l.Network != n.Name && !onL2 {
+				continue
+			}
+			a.Pod = l.Pod
+			a.Interfaces = append(a.Interfaces, l.Link.Attrs().Name)
+			addInterface(l.Link, key)
+		}
+		if len(a.Interfaces) > 0 {
+			s.Attachments = append(s.Attachments, a)
+		}
+	}
+
+	s.Peers = []statePeer{}
+	if vx != nil {
+		entries, err := netlink.NeighList(vx.Attrs().Index, unix.AF_BRIDGE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list forwarding entries: %v", err)
+		}
+		for _, e := range entries {
+			// The multicast group's flood entry is the plugin's own
+			if e.IP == nil || e.IP.IsMulticast() {
+				continue
+			}
+			s.Peers = append(s.Peers, statePeer{
+				VTEP:      e.IP.String(),
+				MAC:       e.HardwareAddr.String(),
+				Permanent: e.State&netlink.NUD_PERMANENT != 0,
+			})
+		}
+	}
+	return s, nil
+}
+
+func runStateImport(args []string) error {
+	flags := flag.NewFlagSet("state import", flag.ExitOnError)
+	config := configFlag(flags)
+	dryRun := flags.Bool("dry-run", false, "Print what would be imported without importing it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: xvmctl state import [flags] <file, - for stdin>")
+	}
+
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	s, err := parseState(data)
+	if err != nil {
+		return err
+	}
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+	if s.Network.Name != n.Name {
+		return fmt.Errorf("state is of network %s, not %s", s.Network.Name, n.Name)
+	}
+	unlock, err := n.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return importState(n, s, *dryRun)
+}
+
+// parseState parses a state document in JSON or YAML, which JSON is a
+// subset of
+func parseState(data []byte) (*state, error) {
+	var s state
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(data, &s)
+	} else {
+		err = yaml.Unmarshal(data, &s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state: %v", err)
+	}
+	if s.Version < 1 || s.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	return &s, nil
+}
+
+// importState restores the allocations and the programmed peers of a
+// state. Interfaces are recreated by the plugin as the attachments are
+// added again, and learned peers are learned again, so neither is imported.
+// The caller holds the network lock.
+func importState(n *netconf.Network, s *state, dryRun bool) error {
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, a := range s.Allocations {
+		ip := net.ParseIP(a.IP)
+		var subnet *ipam.IPAM
+		for _, i := range ipams {
+			if ip != nil && i.Subnet.Contains(ip) {
+				subnet = i
+			}
+		}
+		if subnet == nil {
+			failed = append(failed, fmt.Sprintf("%s of %s: not in the network's subnets", a.IP, a.Attachment))
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would allocate %s to %s\n", ip, a.Attachment)
+			continue
+		}
+		if err := subnet.AllocateIP(a.Attachment, ip); err != nil {
+			if errors.Is(err, ipam.ErrConflict) || errors.Is(err, ipam.ErrOutOfRange) {
+				failed = append(failed, fmt.Sprintf("%s of %s: %v", ip, a.Attachment, err))
+				continue
+			}
+			return err
+		}
+		if a.Owner != nil {
+			owner := ipam.Owner{PodNamespace: a.Owner.PodNamespace, PodName: a.Owner.PodName, PodUID: a.Owner.PodUID}
+			if err := subnet.SetOwner(a.Attachment, owner); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Allocated %s to %s\n", ip, a.Attachment)
+	}
+
+	if err := importPeers(n, s.Peers, dryRun); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		for _, f := range failed {
+			fmt.Fprintf(os.Stderr, "Skipped %s\n", f)
+		}
+		return fmt.Errorf("%d allocations not imported", len(failed))
+	}
+	return nil
+}
+
+// importPeers programs the state's permanent forwarding entries into the
+// VXLAN device, if the plugin created it already
+func importPeers(n *netconf.Network, peers []statePeer, dryRun bool) error {
+	var permanent []statePeer
+	for _, p := range peers {
+		if p.Permanent {
+			permanent = append(permanent, p)
+		}
+	}
+	if len(permanent) == 0 {
+		return nil
+	}
+	if n.Standalone {
+		fmt.Fprintf(os.Stderr, "Skipped %d peers: network %s is standalone\n", len(permanent), n.Name)
+		return nil
+	}
+	vx, err := netlink.LinkByName(n.VxlanName())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipped %d peers: VXLAN device %s not found, import again once a container was added\n", len(permanent), n.VxlanName())
+		return nil
+	}
+	for _, p := range permanent {
+		vtep := net.ParseIP(p.VTEP)
+		mac, err := net.ParseMAC(p.MAC)
+		if vtep == nil || err != nil {
+			return fmt.Errorf("invalid peer %s via %s", p.MAC, p.VTEP)
+		}
+		if dryRun {
+			fmt.Printf("Would add forwarding entry %s via %s\n", mac, vtep)
+			continue
+		}
+		entry := &netlink.Neigh{
+			LinkIndex:    vx.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			IP:           vtep,
+			HardwareAddr: mac,
+		}
+		add := netlink.NeighSet
+		// Every flood destination is another entry for the all-zeros MAC
+		if bytes.Equal(mac, make(net.HardwareAddr, 6)) {
+			add = netlink.NeighAppend
+		}
+		if err := add(entry); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add forwarding entry %s via %s: %v", mac, vtep, err)
+		}
+		fmt.Printf("Added forwarding entry %s via %s\n", mac, vtep)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseState(t *testing.T) {
+	s := &state{Version: stateVersion, Node: "node-a"}
+	s.Network.Name = "xvm-net"
+	s.Allocations = []stateAllocation{{Attachment: "c1/eth0", IP: "10.244.0.5", Owner: &stateOwner{PodNamespace: "default", PodName: "web"}}}
+	s.Peers = []statePeer{{VTEP: "192.168.1.11", MAC: "00:00:00:00:00:00", Permanent: true}}
+
+	// Exports in either format import the same
+	asJSON, _ := json.Marshal(s)
+	asYAML, _ := yaml.Marshal(s)
+	for _, data := range [][]byte{asJSON, asYAML} {
+		parsed, err := parseState(data)
+		if err != nil {
+			t.Fatalf("Failed to parse state %s: %v", data, err)
+		}
+		if parsed.Network.Name != "xvm-net" || len(parsed.Allocations) != 1 || parsed.Allocations[0].Owner.PodName != "web" {
+			t.Fatalf("Unexpected state: %+v", parsed)
+		}
+		if len(parsed.Peers) != 1 || !parsed.Peers[0].Permanent || parsed.Peers[0].MAC != "00:00:00:00:00:00" {
+			t.Fatalf("Unexpected peers: %+v", parsed.Peers)
+		}
+	}
+
+	// States of later versions may hold what this one can't import
+	if _, err := parseState([]byte(`{"version": 2}`)); err == nil || !strings.Contains(err.Error(), "unsupported state version") {
+		t.Fatalf("Expected later version to be rejected, got %v", err)
+	}
+}
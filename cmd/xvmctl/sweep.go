@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/nohns/xvm-cni/pkg/netconf"
+)
+
+func runSweep(args []string) error {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	config := configFlag(flags)
+	dryRun := flags.Bool("dry-run", false, "Print the interfaces the sweep would delete without deleting them")
+	flags.Parse(args)
+
+	n, err := netconf.Load(*config)
+	if err != nil {
+		return err
+	}
+
+	// Interfaces orphaned both now and after staleGrace are left behind,
+	// rather than those of DELs in progress
+	first, err := lockedOrphans(n)
+	if err != nil {
+		return err
+	}
+	if len(first) > 0 {
+		time.Sleep(staleGrace)
+	}
+	unlock, err := n.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	second, err := n.Orphans()
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for _, o := range second {
+		if !first[orphanID(o)] {
+			continue
+		}
+		found++
+		name := o.Link.Attrs().Name
+		if *dryRun {
+			fmt.Printf("Would delete %s of %s: %s\n", name, o.Attachment, o.Why)
+			continue
+		}
+		if err := n.RemoveOrphan(o); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s of %s: %s\n", name, o.Attachment, o.Why)
+	}
+	if found == 0 {
+		fmt.Println("Nothing to sweep")
+	}
+	return nil
+}
+
+// lockedOrphans returns the network's orphaned interfaces, as found under
+// its lock
+func lockedOrphans(n *netconf.Network) (map[string]bool, error) {
+	unlock, err := n.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	orphans, err := n.Orphans()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(orphans))
+	for _, o := range orphans {
+		ids[orphanID(o)] = true
+	}
+	return ids, nil
+}
+
+// orphanID identifies an interface, telling it from one recreated under
+// the same name
+func orphanID(o netconf.Orphan) string {
+	return fmt.Sprintf("%s/%d", o.Link.Attrs().Name, o.Link.Attrs().Index)
+}
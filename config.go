@@ -0,0 +1,828 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/policy"
+	"github.com/nohns/xvm-cni/pkg/qos"
+	"github.com/nohns/xvm-cni/pkg/sublink"
+	"github.com/nohns/xvm-cni/pkg/vlan"
+	"github.com/nohns/xvm-cni/pkg/vrf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// networkNameRE matches the network names the CNI specification allows
+var networkNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+const (
+	// minMTU is the smallest MTU an IPv4 interface may use
+	minMTU = 68
+	// maxMTU is the largest MTU the kernel accepts
+	maxMTU = 65535
+)
+
+// PluginConf represents the plugin configuration
+type PluginConf struct {
+	types.NetConf
+
+	// Plugin-specific fields
+	HostInterface string `json:"hostInterface"`
+	VxlanID       int    `json:"vxlanID"`
+	VxlanPort     int    `json:"vxlanPort"`
+	Mode          string `json:"mode,omitempty"`
+	MTU           int    `json:"mtu"`
+	Subnet        string `json:"subnet"`
+	Gateway       string `json:"gateway"`
+	IPv6Subnet    string `json:"ipv6Subnet,omitempty"`
+	IPv6Gateway   string `json:"ipv6Gateway,omitempty"`
+	DataDir       string `json:"dataDir"`
+	IPMasq        bool   `json:"ipMasq,omitempty"`
+	HostRoutes    bool   `json:"hostRoutes,omitempty"`
+	NDPProxy      bool   `json:"ndpProxy,omitempty"`
+	HairpinMode   bool   `json:"hairpinMode,omitempty"`
+	PromiscMode   bool   `json:"promiscMode,omitempty"`
+	TxQueueLen    int    `json:"txQueueLen,omitempty"`
+	Qdisc         string `json:"qdisc,omitempty"`
+	VethQueues    int    `json:"vethQueues,omitempty"`
+	DisableIPv6   bool   `json:"disableIPv6,omitempty"`
+	DryRun        bool   `json:"dryRun,omitempty"`
+	AntiSpoofing  bool   `json:"antiSpoofing,omitempty"`
+
+	// NamespaceRanges place the pods of Kubernetes namespaces, named by
+	// K8S_POD_NAMESPACE in CNI_ARGS, in sub-ranges of the subnets
+	NamespaceRanges []NamespaceRange `json:"namespaceRanges,omitempty"`
+
+	// NamespaceVNIs put the pods of Kubernetes namespaces on VXLAN segments
+	// of their own, created on demand
+	NamespaceVNIs []NamespaceVNI `json:"namespaceVNIs,omitempty"`
+
+	// Attachments add further interfaces to the containers, each on a VXLAN
+	// segment of its own
+	Attachments []AttachmentConf `json:"attachments,omitempty"`
+
+	// Unmanaged marks the network's devices unmanaged for NetworkManager
+	// and systemd-networkd, so they don't reconfigure them
+	Unmanaged bool `json:"unmanaged,omitempty"`
+
+	// FirewallBackend is the tool managing NAT rules, "iptables",
+	// "nftables" or "firewalld", detected from the host if unset. Rules
+	// only go through firewalld when it is selected.
+	FirewallBackend string `json:"firewallBackend,omitempty"`
+	// FirewalldZone is the firewalld zone the network's subnets are bound to
+	// when rules go through firewalld, which requires one
+	FirewalldZone string `json:"firewalldZone,omitempty"`
+
+	// Standalone skips VXLAN, connecting only the containers of the node,
+	// e.g. on a developer's machine without a multicast-capable underlay
+	Standalone bool `json:"standalone,omitempty"`
+
+	// RateLimits caps the bandwidth of every container of the network
+	RateLimits
+
+	// DSCP marks the containers' traffic on their host-side port, and
+	// InheritDSCP copies the inner DSCP to the outer VXLAN header
+	DSCP        *int `json:"dscp,omitempty"`
+	InheritDSCP bool `json:"inheritDSCP,omitempty"`
+
+	// VLANFiltering has the bridge forward only between ports of the same
+	// VLAN, and VLAN places the containers in one other than the default
+	VLANFiltering bool `json:"vlanFiltering,omitempty"`
+	VLAN          int  `json:"vlan,omitempty"`
+
+	// Offloads turns segmentation and receive offloads of the devices the
+	// plugin creates on or off
+	Offloads *OffloadsConf `json:"offloads,omitempty"`
+
+	// ProxyARP sets proxy_arp and proxy_delay on the bridge or shim and the
+	// VXLAN interface
+	ProxyARP *ProxyARPConf `json:"proxyARP,omitempty"`
+
+	// VethNameTemplate names the host-side veths, e.g. "xvm{{.Hash}}"
+	VethNameTemplate string `json:"vethNameTemplate,omitempty"`
+
+	// VxlanNameTemplate and BridgeNameTemplate name the network's VXLAN
+	// interface and bridge, e.g. "vx-{{.NetworkName}}" or "xbr{{.Hash}}"
+	VxlanNameTemplate  string `json:"vxlanNameTemplate,omitempty"`
+	BridgeNameTemplate string `json:"bridgeNameTemplate,omitempty"`
+
+	// DefaultRoute controls the container's default route
+	DefaultRoute *DefaultRouteConf `json:"defaultRoute,omitempty"`
+
+	// Secondary marks a pod's further network, e.g. one Multus attaches,
+	// whose attachments get no default route unless asked for
+	Secondary bool `json:"secondary,omitempty"`
+
+	// Routes are installed in the container in addition to the default route
+	Routes []RouteConf `json:"routes,omitempty"`
+
+	// RouterAdvertisements has IPv6 containers learn their default route
+	// from router advertisements
+	RouterAdvertisements *RAConf `json:"routerAdvertisements,omitempty"`
+
+	// VRF places the host side of the overlay in a VRF, created if missing
+	VRF *VRFConf `json:"vrf,omitempty"`
+
+	// RouteTable puts the host routes in a dedicated routing table, selected
+	// by fwmark or source, rather than the host's main table
+	RouteTable *RouteTableConf `json:"routeTable,omitempty"`
+
+	// SourceRouting has the VXLAN traffic routed by a table of its own, so
+	// it leaves through hostInterface on nodes with several uplinks
+	SourceRouting *SourceRoutingConf `json:"sourceRouting,omitempty"`
+
+	// OpenFirewall has the node's firewall accept the network's VXLAN
+	// traffic from the peer nodes, ahead of restrictive input policies
+	OpenFirewall *OpenFirewallConf `json:"openFirewall,omitempty"`
+
+	// UnderlayVLAN has hostInterface be a VLAN sub-interface, created if
+	// missing, for VTEP traffic that must ride a tagged segment
+	UnderlayVLAN *UnderlayVLANConf `json:"underlayVLAN,omitempty"`
+
+	// Flooding selects how the VXLAN device floods traffic without a known
+	// destination: to a multicast group, to a static list of peers, or not
+	// at all
+	Flooding *FloodingConf `json:"flooding,omitempty"`
+
+	// MTUProbe has the underlay paths to peers checked before an MTU whose
+	// encapsulated frames exceed a standard underlay's is used
+	MTUProbe *MTUProbeConf `json:"mtuProbe,omitempty"`
+
+	// Policy holds the allow and deny rules filtering container traffic
+	Policy *PolicyConf `json:"policy,omitempty"`
+
+	// EgressRules filter the traffic the containers send out of the overlay
+	// through the node, for perimeter policies that don't need per-container
+	// chains
+	EgressRules []policy.Rule `json:"egressRules,omitempty"`
+
+	// AllowedIngressPorts has connections to the containers dropped unless
+	// to one of the ports, e.g. "443" or "53/udp"
+	AllowedIngressPorts []string `json:"allowedIngressPorts,omitempty"`
+
+	// EBPF moves parts of the datapath into eBPF programs on the network's
+	// devices
+	EBPF *EBPFConf `json:"ebpf,omitempty"`
+
+	// OVS configures the Open vSwitch bridge in ovs mode
+	OVS OVSConf `json:"ovs,omitempty"`
+
+	// Hooks are commands run around ADD and DEL, integrating the attachment
+	// with firewalls, DNS or inventory systems
+	Hooks *HooksConf `json:"hooks,omitempty"`
+
+	// Audit logs each invocation to journald or syslog for cluster-wide
+	// log pipelines
+	Audit *AuditConf `json:"audit,omitempty"`
+
+	// Kubernetes configures how the features integrating with Kubernetes
+	// reach the API server
+	Kubernetes *k8s.Settings `json:"kubernetes,omitempty"`
+
+	// PodAnnotations has ADD read the pod's xvm-cni.dev annotations from the
+	// API server, with the pod identity from CNI_ARGS
+	PodAnnotations bool `json:"podAnnotations,omitempty"`
+
+	// Tables sizes the node's neighbor tables and the bridge's forwarding
+	// database for large clusters
+	Tables *TablesConf `json:"tables,omitempty"`
+
+	// Sysctls are applied inside the container network namespace
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+
+	// DisableCheck and DisableGC make CHECK and GC succeed without doing
+	// anything, for nodes where an external controller owns reconciliation.
+	// Runtimes that honor the conflist flags of the same name skip the calls.
+	DisableCheck bool `json:"disableCheck,omitempty"`
+	DisableGC    bool `json:"disableGC,omitempty"`
+
+	// Timeouts bound how long each command may take
+	Timeouts *TimeoutsConf `json:"timeouts,omitempty"`
+
+	// CNIVersions restricts the CNI versions the network may be configured
+	// with, for runtimes that can't take the results of some
+	CNIVersions []string `json:"cniVersions,omitempty"`
+
+	// CheckRepairs has CHECK restore the attachment's addresses, routes and
+	// bridge port from its recorded result before verifying them
+	CheckRepairs bool `json:"checkRepairs,omitempty"`
+
+	// StaleAttachments has GC remove these attachments and keep all others
+	// rather than those in cni.dev/valid-attachments. xvmctl sets it.
+	StaleAttachments []string `json:"xvm-cni.dev/stale-attachments,omitempty"`
+
+	// Args holds per-attachment overrides set by the runtime
+	Args *ArgsConf `json:"args,omitempty"`
+
+	// RuntimeConfig holds values passed in by the runtime via capabilities
+	RuntimeConfig RuntimeConf `json:"runtimeConfig,omitempty"`
+
+	// devices caches the names of the network's shared devices for the
+	// invocation
+	devices *deviceNames
+}
+
+// RuntimeConf holds the capability arguments supported by the plugin
+type RuntimeConf struct {
+	DNS types.DNS `json:"dns,omitempty"`
+	Mac string    `json:"mac,omitempty"`
+	IPs []string  `json:"ips,omitempty"`
+
+	// PortMappings forward ports of the node to the container
+	PortMappings []fw.PortMapping `json:"portMappings,omitempty"`
+
+	// DeviceID is the PCI address of the VF allocated by a device plugin
+	DeviceID string `json:"deviceID,omitempty"`
+}
+
+// OVSConf holds the settings for attaching containers to Open vSwitch
+type OVSConf struct {
+	Bridge       string   `json:"bridge,omitempty"`
+	DatapathType string   `json:"datapathType,omitempty"`
+	Peers        []string `json:"peers,omitempty"`
+	VhostUser    bool     `json:"vhostUser,omitempty"`
+	SocketDir    string   `json:"socketDir,omitempty"`
+}
+
+// UnderlayVLANConf holds the VLAN sub-interface hostInterface is
+type UnderlayVLANConf struct {
+	// Parent and ID default to those of a hostInterface named
+	// "<parent>.<id>"
+	Parent string `json:"parent,omitempty"`
+	ID     int    `json:"id,omitempty"`
+	// MTU of a created sub-interface, defaulting to the parent's
+	MTU int `json:"mtu,omitempty"`
+	// Address is the VTEP address in CIDR notation assigned to a created
+	// sub-interface, required
+	Address string `json:"address,omitempty"`
+}
+
+// OffloadsConf holds the offloads of the devices the plugin creates
+type OffloadsConf struct {
+	// Veth applies to both ends of the attachments' veth pairs
+	Veth *offload.Settings `json:"veth,omitempty"`
+	// Vxlan applies to the network's VXLAN interface, where some kernels
+	// reorder packets with GRO
+	Vxlan *offload.Settings `json:"vxlan,omitempty"`
+}
+
+// MTUProbeConf holds the peers the underlay path MTU is probed to
+type MTUProbeConf struct {
+	// Peers are the IPv4 addresses of remote VTEPs, defaulting to ovs.peers
+	// in ovs mode
+	Peers []string `json:"peers,omitempty"`
+	// Timeout is how long, in seconds, a probe waits for the peer's reply
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// VRFConf holds the VRF the network's bridge or shim is placed in
+type VRFConf struct {
+	Name string `json:"name"`
+	// Table is the routing table of a VRF to create, optional if it exists
+	Table uint32 `json:"table,omitempty"`
+}
+
+// PolicyConf holds the network policy of the containers
+type PolicyConf struct {
+	policy.Policy
+
+	// NetworkPolicyDir holds Kubernetes NetworkPolicy manifests whose rules
+	// apply to the pods of their namespace
+	NetworkPolicyDir string `json:"networkPolicyDir,omitempty"`
+}
+
+// ArgsConf holds the "args" field of the network configuration
+type ArgsConf struct {
+	CNI CNIArgs `json:"cni,omitempty"`
+}
+
+// CNIArgs holds the plugin-specific overrides under args.cni
+type CNIArgs struct {
+	IPs                 []string          `json:"ips,omitempty"`
+	MTU                 int               `json:"mtu,omitempty"`
+	Routes              []RouteConf       `json:"routes,omitempty"`
+	Sysctls             map[string]string `json:"sysctls,omitempty"`
+	DefaultRoute        *DefaultRouteConf `json:"defaultRoute,omitempty"`
+	DSCP                *int              `json:"dscp,omitempty"`
+	VLAN                int               `json:"vlan,omitempty"`
+	AllowedIngressPorts []string          `json:"allowedIngressPorts,omitempty"`
+	VethQueues          int               `json:"vethQueues,omitempty"`
+	RateLimits
+}
+
+// parseConfig parses the network configuration and fills in defaults for
+// unset optional fields
+func parseConfig(data []byte) (*PluginConf, error) {
+	conf := &PluginConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, newError(types.ErrDecodingFailure, "failed to parse network configuration", err)
+	}
+
+	// Parse the previous result when running in a plugin chain
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, newError(types.ErrDecodingFailure, "failed to parse prevResult", err)
+	}
+
+	// Set default values if not specified
+	if conf.VxlanID == 0 {
+		conf.VxlanID = vxlan.DefaultVxlanVNI
+	}
+	if conf.VxlanPort == 0 {
+		conf.VxlanPort = vxlan.DefaultVxlanPort
+	}
+	if conf.MTU == 0 {
+		conf.MTU = vxlan.DefaultMTU
+	}
+	if conf.Mode == "" {
+		conf.Mode = modeBridge
+	}
+	if conf.DataDir == "" {
+		conf.DataDir = ipam.DefaultDataDir
+	}
+	if v := conf.UnderlayVLAN; v != nil && v.Parent == "" && v.ID == 0 {
+		v.Parent, v.ID, _ = vlan.ParseName(conf.HostInterface)
+	}
+	if p := conf.MTUProbe; p != nil && len(p.Peers) == 0 && conf.Mode == modeOVS {
+		p.Peers = conf.OVS.Peers
+	}
+	if conf.OVS.Bridge == "" {
+		conf.OVS.Bridge = ovs.BridgeName(conf.VxlanID)
+	}
+	if conf.OVS.SocketDir == "" {
+		conf.OVS.SocketDir = defaultSocketDir
+	}
+
+	if err := checkVersion(conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// dnsConfig returns the DNS settings for the container, preferring the
+// runtime-provided settings over the network configuration
+func (c *PluginConf) dnsConfig() types.DNS {
+	if !c.RuntimeConfig.DNS.IsEmpty() {
+		return c.RuntimeConfig.DNS
+	}
+	return c.DNS
+}
+
+// linkMTU returns the MTU of the attachment's interfaces, the per-attachment
+// value taking precedence. The shared devices keep the network's MTU.
+func (c *PluginConf) linkMTU() int {
+	if c.Args != nil && c.Args.CNI.MTU != 0 {
+		return c.Args.CNI.MTU
+	}
+	return c.MTU
+}
+
+// Validate checks the configuration for consistency and reports every
+// problem found at once
+func (c *PluginConf) Validate() error {
+	var problems []string
+
+	// The name names the network's directory in dataDir
+	if c.Name != "" && !networkNameRE.MatchString(c.Name) {
+		problems = append(problems, fmt.Sprintf("name %q must start with a letter or digit and hold only letters, digits, '_', '.' and '-'", c.Name))
+	}
+	if c.HostInterface == "" && !c.Standalone {
+		problems = append(problems, "hostInterface must be specified")
+	}
+	if c.UnderlayVLAN != nil {
+		problems = append(problems, c.UnderlayVLAN.validate()...)
+	}
+	if c.MTUProbe != nil {
+		problems = append(problems, c.MTUProbe.validate()...)
+	}
+	if c.VxlanID < 1 || c.VxlanID > vxlan.MaxVxlanVNI {
+		problems = append(problems, fmt.Sprintf("vxlanID %d out of range (1-%d)", c.VxlanID, vxlan.MaxVxlanVNI))
+	}
+	if c.VxlanPort < 1 || c.VxlanPort > 65535 {
+		problems = append(problems, fmt.Sprintf("vxlanPort %d out of range (1-65535)", c.VxlanPort))
+	}
+	if c.MTU < minMTU || c.MTU > maxMTU {
+		problems = append(problems, fmt.Sprintf("mtu %d out of range (%d-%d)", c.MTU, minMTU, maxMTU))
+	}
+	// A larger MTU than the bridge's would drop the attachment's big frames
+	if mtu := c.linkMTU(); mtu != c.MTU && (mtu < minMTU || mtu > c.MTU) {
+		problems = append(problems, fmt.Sprintf("args.cni.mtu %d out of range (%d-%d)", mtu, minMTU, c.MTU))
+	}
+
+	// Check subnet and gateway consistency
+	if c.Subnet == "" {
+		problems = append(problems, "subnet must be specified")
+	}
+	if c.Gateway == "" {
+		problems = append(problems, "gateway must be specified")
+	}
+	problems = append(problems, validateRange("subnet", c.Subnet, c.Gateway, false)...)
+	if c.IPv6Subnet != "" || c.IPv6Gateway != "" {
+		if c.IPv6Subnet == "" {
+			problems = append(problems, "ipv6Subnet must be specified with ipv6Gateway")
+		}
+		if c.IPv6Gateway == "" {
+			problems = append(problems, "ipv6Gateway must be specified with ipv6Subnet")
+		}
+		problems = append(problems, validateRange("ipv6Subnet", c.IPv6Subnet, c.IPv6Gateway, true)...)
+	}
+	problems = append(problems, c.validateNamespaceRanges()...)
+	problems = append(problems, c.validateNamespaceVNIs()...)
+	problems = append(problems, c.validateAttachments()...)
+
+	// Check the datapath mode and the options it supports
+	var unsupported map[string]bool
+	switch c.Mode {
+	case modeBridge:
+	case modeTap:
+		unsupported = map[string]bool{
+			"sysctls":       len(c.containerSysctls()) > 0,
+			"disableIPv6":   c.DisableIPv6,
+			"offloads.veth": !c.vethOffloads().IsEmpty(),
+		}
+	case modeOVS:
+		problems = append(problems, c.OVS.validate()...)
+		unsupported = map[string]bool{
+			"hairpinMode":        c.HairpinMode,
+			"promiscMode":        c.PromiscMode,
+			"inheritDSCP":        c.InheritDSCP,
+			"vlanFiltering":      c.VLANFiltering,
+			"vxlanNameTemplate":  c.VxlanNameTemplate != "",
+			"bridgeNameTemplate": c.BridgeNameTemplate != "",
+			"offloads.vxlan":     !c.vxlanOffloads().IsEmpty(),
+			"proxyARP.bridge":    c.bridgeProxyARP() != nil,
+			"proxyARP.vxlan":     c.vxlanProxyARP() != nil,
+			"sourceRouting":      c.SourceRouting != nil,
+			"namespaceVNIs":      len(c.NamespaceVNIs) > 0,
+			"attachments":        len(c.Attachments) > 0,
+		}
+		if c.OVS.VhostUser {
+			unsupported["offloads.veth"] = !c.vethOffloads().IsEmpty()
+			unsupported["sysctls"] = len(c.containerSysctls()) > 0
+			unsupported["disableIPv6"] = c.DisableIPv6
+			unsupported["vethQueues"] = c.vethQueues() != 0
+			unsupported["antiSpoofing"] = c.AntiSpoofing
+			unsupported["dscp"] = c.dscp() != nil
+			unsupported["ingressRate"] = c.rateLimits().IngressRate != 0
+			unsupported["egressRate"] = c.rateLimits().EgressRate != 0
+		}
+	case modeSRIOV:
+		if c.RuntimeConfig.DeviceID == "" {
+			problems = append(problems, "mode \"sriov\" requires a VF passed in runtimeConfig.deviceID")
+		}
+		unsupported = map[string]bool{
+			"vethNameTemplate": c.VethNameTemplate != "",
+			"vethQueues":       c.vethQueues() != 0,
+			"offloads.veth":    !c.vethOffloads().IsEmpty(),
+			"ingressRate":      c.rateLimits().IngressRate != 0,
+			"egressRate":       c.rateLimits().EgressRate != 0,
+			"attachments":      len(c.Attachments) > 0,
+		}
+	case sublink.ModeMacvlan, sublink.ModeIPvlan:
+		unsupported = map[string]bool{
+			"hairpinMode":        c.HairpinMode,
+			"promiscMode":        c.PromiscMode,
+			"vlanFiltering":      c.VLANFiltering,
+			"vethNameTemplate":   c.VethNameTemplate != "",
+			"bridgeNameTemplate": c.BridgeNameTemplate != "",
+			"vethQueues":         c.vethQueues() != 0,
+			"offloads.veth":      !c.vethOffloads().IsEmpty(),
+			"antiSpoofing":       c.AntiSpoofing,
+			"dscp":               c.dscp() != nil,
+			"ingressRate":        c.rateLimits().IngressRate != 0,
+			"egressRate":         c.rateLimits().EgressRate != 0,
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown mode %q", c.Mode))
+	}
+	for option, set := range unsupported {
+		if set {
+			problems = append(problems, fmt.Sprintf("%s isn't supported in mode %q", option, c.Mode))
+		}
+	}
+
+	// Check the options of standalone networks, which have no underlay and
+	// only attach containers to the bridge
+	if c.Standalone {
+		if !c.usesBridge() {
+			problems = append(problems, fmt.Sprintf("standalone isn't supported in mode %q", c.Mode))
+		}
+		for option, set := range map[string]bool{
+			"underlayVLAN":   c.UnderlayVLAN != nil,
+			"mtuProbe":       c.MTUProbe != nil,
+			"inheritDSCP":    c.InheritDSCP,
+			"offloads.vxlan": !c.vxlanOffloads().IsEmpty(),
+			"proxyARP.vxlan": c.vxlanProxyARP() != nil,
+			"sourceRouting":  c.SourceRouting != nil,
+			"openFirewall":   c.OpenFirewall != nil,
+		} {
+			if set {
+				problems = append(problems, fmt.Sprintf("%s can't be combined with standalone", option))
+			}
+		}
+		// The host routes are from the node's address on hostInterface
+		if c.HostRoutes && c.HostInterface == "" {
+			problems = append(problems, "hostRoutes requires hostInterface")
+		}
+	}
+
+	// Check the network policy, which filters on the Linux bridge
+	if c.Policy != nil {
+		if !c.usesBridge() {
+			problems = append(problems, fmt.Sprintf("policy isn't supported in mode %q", c.Mode))
+		}
+		problems = append(problems, c.Policy.Validate()...)
+	}
+	problems = append(problems, policy.ValidateRules("egressRules", c.EgressRules)...)
+
+	// Check the ingress port allowlist, which filters on the Linux bridge too
+	if ports := c.allowedIngressPorts(); len(ports) > 0 {
+		if !c.usesBridge() {
+			problems = append(problems, fmt.Sprintf("allowedIngressPorts isn't supported in mode %q", c.Mode))
+		}
+		problems = append(problems, policy.ValidatePorts("allowedIngressPorts", ports)...)
+	}
+
+	if c.EBPF != nil {
+		problems = append(problems, c.EBPF.validate(c)...)
+	}
+	if c.Flooding != nil {
+		problems = append(problems, c.Flooding.validate(c)...)
+	}
+	if c.Tables != nil {
+		problems = append(problems, c.Tables.validate(c)...)
+	}
+
+	if c.Hooks != nil {
+		problems = append(problems, c.Hooks.validate()...)
+	}
+	if c.Audit != nil {
+		problems = append(problems, c.Audit.validate()...)
+	}
+	problems = append(problems, c.validateVersions()...)
+	if c.Timeouts != nil {
+		problems = append(problems, c.Timeouts.validate()...)
+	}
+
+	if c.Kubernetes != nil {
+		problems = append(problems, c.Kubernetes.Validate()...)
+	}
+
+	// Check the VRF, which isolates the overlay from the main table host
+	// routes are installed in
+	if c.VRF != nil {
+		problems = append(problems, c.VRF.validate()...)
+		if c.HostRoutes {
+			problems = append(problems, "hostRoutes can't be combined with vrf")
+		}
+		if c.gatewayVLAN() != 0 {
+			problems = append(problems, "vlan can't be combined with vrf")
+		}
+	}
+
+	// Check the dedicated routing table and the rules selecting it
+	if c.RouteTable != nil {
+		problems = append(problems, c.RouteTable.validate(c)...)
+	}
+	if c.SourceRouting != nil {
+		problems = append(problems, c.SourceRouting.validate(c)...)
+	}
+	if c.OpenFirewall != nil {
+		problems = append(problems, c.OpenFirewall.validate(c)...)
+	}
+
+	// Check the NDP proxy, which answers for the containers' IPv6 addresses
+	// on hostInterface
+	if c.NDPProxy {
+		if c.IPv6Subnet == "" {
+			problems = append(problems, "ndpProxy requires ipv6Subnet")
+		}
+		if c.HostInterface == "" {
+			problems = append(problems, "ndpProxy requires hostInterface")
+		}
+	}
+
+	// Check the container's VLAN, which only a filtering bridge separates
+	if vid := c.vlan(); vid != 0 {
+		if vid < 1 || vid > bridge.MaxVLAN {
+			problems = append(problems, fmt.Sprintf("vlan %d out of range (1-%d)", vid, bridge.MaxVLAN))
+		}
+		if !c.VLANFiltering {
+			problems = append(problems, "vlan requires vlanFiltering")
+		}
+	}
+
+	// Check the DSCP marking
+	if dscp := c.dscp(); dscp != nil && (*dscp < 0 || *dscp > qos.MaxDSCP) {
+		problems = append(problems, fmt.Sprintf("dscp %d out of range (0-%d)", *dscp, qos.MaxDSCP))
+	}
+
+	// Check the rate limits
+	problems = append(problems, c.rateLimits().validate()...)
+
+	// Check the port mappings
+	for _, m := range c.RuntimeConfig.PortMappings {
+		problems = append(problems, m.Validate()...)
+	}
+
+	// Check the firewall backend
+	switch c.FirewallBackend {
+	case "", fw.BackendIPTables, fw.BackendNFTables, fw.BackendFirewalld:
+	default:
+		problems = append(problems, fmt.Sprintf("firewallBackend must be %q, %q or %q", fw.BackendIPTables, fw.BackendNFTables, fw.BackendFirewalld))
+	}
+	// The zone decides how the host filters the containers' traffic, which
+	// is the operator's call
+	if c.FirewallBackend == fw.BackendFirewalld && c.FirewalldZone == "" {
+		problems = append(problems, fmt.Sprintf("firewallBackend %q requires firewalldZone", fw.BackendFirewalld))
+	}
+	if c.FirewalldZone != "" && c.FirewallBackend != fw.BackendFirewalld {
+		problems = append(problems, fmt.Sprintf("firewalldZone requires firewallBackend %q", fw.BackendFirewalld))
+	}
+
+	// Check link tuning
+	if c.TxQueueLen < 0 {
+		problems = append(problems, fmt.Sprintf("txQueueLen %d must not be negative", c.TxQueueLen))
+	}
+	if c.Qdisc != "" && !supportedQdiscs[c.Qdisc] {
+		problems = append(problems, fmt.Sprintf("unsupported qdisc %q", c.Qdisc))
+	}
+	if c.VethQueues < 0 || c.VethQueues > maxQueues {
+		problems = append(problems, fmt.Sprintf("vethQueues %d out of range (0-%d)", c.VethQueues, maxQueues))
+	}
+	if q := c.vethQueues(); q != c.VethQueues && (q < 0 || q > maxQueues) {
+		problems = append(problems, fmt.Sprintf("args.cni.vethQueues %d out of range (0-%d)", q, maxQueues))
+	}
+
+	// Check the veth name template against a typical attachment
+	if _, err := renderVethName(c.VethNameTemplate, strings.Repeat("0", 64), "eth0"); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// Check the device name templates against the network
+	vx, err := devname.Render(c.VxlanNameTemplate, c.Name, c.VxlanID)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("vxlanNameTemplate %v", err))
+	}
+	br, err := devname.Render(c.BridgeNameTemplate, c.Name, c.VxlanID)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("bridgeNameTemplate %v", err))
+	}
+	if vx != "" && vx == br {
+		problems = append(problems, fmt.Sprintf("vxlanNameTemplate and bridgeNameTemplate both render %q", vx))
+	}
+
+	// Check mutually exclusive options
+	if c.HairpinMode && c.PromiscMode {
+		problems = append(problems, "hairpinMode and promiscMode are mutually exclusive")
+	}
+	if c.DisableIPv6 && c.IPv6Subnet != "" {
+		problems = append(problems, "disableIPv6 can't be combined with ipv6Subnet")
+	}
+
+	// Check container sysctls
+	for name := range c.containerSysctls() {
+		if err := validateSysctl(name); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// Check the proxy ARP delays
+	if c.ProxyARP != nil {
+		problems = append(problems, c.ProxyARP.validate()...)
+	}
+
+	// Check the default route and static routes
+	if c.RouterAdvertisements != nil {
+		problems = append(problems, c.RouterAdvertisements.validate(c)...)
+	}
+	dr := c.defaultRoute()
+	problems = append(problems, dr.validate(c.Subnet)...)
+	for _, route := range c.containerRoutes() {
+		problems = append(problems, route.validate()...)
+	}
+
+	if len(problems) > 0 {
+		return configError("invalid network configuration", errors.New(strings.Join(problems, "; ")))
+	}
+	return nil
+}
+
+// validate returns the problems with the OVS configuration
+func (o *OVSConf) validate() []string {
+	var problems []string
+	if len(o.Bridge) > maxIfNameLen {
+		problems = append(problems, fmt.Sprintf("ovs.bridge %q is longer than %d characters", o.Bridge, maxIfNameLen))
+	}
+	if len(o.Peers) == 0 {
+		problems = append(problems, "ovs.peers must list at least one remote VTEP")
+	}
+	for _, peer := range o.Peers {
+		if ip := net.ParseIP(peer); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid ovs peer %q", peer))
+		}
+	}
+	if o.VhostUser && o.DatapathType != ovs.DatapathNetdev {
+		problems = append(problems, fmt.Sprintf("ovs.vhostUser requires ovs.datapathType %q", ovs.DatapathNetdev))
+	}
+	return problems
+}
+
+// validate returns the problems with the underlay VLAN configuration
+func (v *UnderlayVLANConf) validate() []string {
+	var problems []string
+	if v.Parent == "" {
+		problems = append(problems, "underlayVLAN.parent must be specified unless hostInterface is named <parent>.<id>")
+	}
+	if v.ID < 1 || v.ID > vlan.MaxID {
+		problems = append(problems, fmt.Sprintf("underlayVLAN.id %d out of range (1-%d)", v.ID, vlan.MaxID))
+	}
+	if v.MTU != 0 && (v.MTU < minMTU || v.MTU > maxMTU) {
+		problems = append(problems, fmt.Sprintf("underlayVLAN.mtu %d out of range (%d-%d)", v.MTU, minMTU, maxMTU))
+	}
+	// A created sub-interface without an address has nothing for the VXLAN
+	// interface to send from
+	if v.Address == "" {
+		problems = append(problems, "underlayVLAN.address must be specified")
+	} else if ip, _, err := net.ParseCIDR(v.Address); err != nil || ip.To4() == nil {
+		problems = append(problems, fmt.Sprintf("invalid underlayVLAN.address %q: must be an IPv4 address in CIDR notation", v.Address))
+	}
+	return problems
+}
+
+// validate returns the problems with the MTU probe configuration
+func (p *MTUProbeConf) validate() []string {
+	var problems []string
+	if len(p.Peers) == 0 {
+		problems = append(problems, "mtuProbe.peers must list at least one remote VTEP")
+	}
+	for _, peer := range p.Peers {
+		if ip := net.ParseIP(peer); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid mtuProbe peer %q", peer))
+		}
+	}
+	if p.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("mtuProbe.timeout %d must not be negative", p.Timeout))
+	}
+	return problems
+}
+
+// validate returns the problems with the VRF configuration
+func (v *VRFConf) validate() []string {
+	var problems []string
+	if v.Name == "" || len(v.Name) > maxIfNameLen {
+		problems = append(problems, fmt.Sprintf("vrf.name %q must be 1-%d characters", v.Name, maxIfNameLen))
+	}
+	if v.Table != 0 && vrf.ReservedTable(v.Table) {
+		problems = append(problems, fmt.Sprintf("vrf.table %d is reserved", v.Table))
+	}
+	return problems
+}
+
+// validateRange returns the problems with a subnet and its gateway. Empty
+// values are skipped; the caller reports missing fields.
+func validateRange(field, cidr, gw string, ipv6 bool) []string {
+	var problems []string
+
+	var subnet *net.IPNet
+	if cidr != "" {
+		if _, ipnet, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q", field, cidr))
+		} else if (ipnet.IP.To4() == nil) != ipv6 {
+			problems = append(problems, fmt.Sprintf("%s %s has the wrong address family", field, ipnet))
+		} else {
+			subnet = ipnet
+		}
+	}
+
+	if gw != "" {
+		if gateway := net.ParseIP(gw); gateway == nil {
+			problems = append(problems, fmt.Sprintf("invalid gateway IP %q", gw))
+		} else if subnet != nil {
+			if !subnet.Contains(gateway) {
+				problems = append(problems, fmt.Sprintf("gateway %s is not inside %s %s", gateway, field, subnet))
+			} else if gateway.Equal(subnet.IP) {
+				problems = append(problems, fmt.Sprintf("gateway %s is the %s network address", gateway, field))
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,1511 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/neigh"
+	"github.com/nohns/xvm-cni/pkg/policy"
+)
+
+func TestValidate(t *testing.T) {
+	// Valid configuration with defaults applied
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1"
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// Invalid configuration reports every problem at once
+	conf, err = parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "../xvm-network",
+		"type": "xvm-cni",
+		"vxlanID": 16777216,
+		"vxlanPort": 70000,
+		"mtu": 10,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.245.0.1",
+		"hairpinMode": true,
+		"promiscMode": true,
+		"ipv6Subnet": "fd00::/64",
+		"ipv6Gateway": "fd00::1",
+		"disableIPv6": true,
+		"txQueueLen": -1,
+		"qdisc": "htb",
+		"vethQueues": 5000,
+		"routes": [{"dst": "10.96.0.0/12", "gw": "not-an-ip"}],
+		"egressRules": [{"action": "allow", "cidrs": ["10.0.0.0/33"]}],
+		"runtimeConfig": {"portMappings": [{"hostPort": 0, "containerPort": 80}]}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	err = conf.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation to fail")
+	}
+	cniErr, ok := err.(*types.Error)
+	if !ok || cniErr.Code != types.ErrInvalidNetworkConfig {
+		t.Fatalf("Expected invalid network config error, got: %v", err)
+	}
+	for _, field := range []string{"name", "hostInterface", "vxlanID", "vxlanPort", "mtu", "gateway", "txQueueLen", "qdisc", "vethQueues", "route", "mutually exclusive", "disableIPv6", "egressRules[0]", "port mapping 0:80"} {
+		if !strings.Contains(cniErr.Details, field) {
+			t.Fatalf("Expected problem with %s in %q", field, cniErr.Details)
+		}
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"dns": {"nameservers": ["10.96.0.10"]},
+		"runtimeConfig": {"dns": {"nameservers": ["1.1.1.1"], "search": ["svc.local"]}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+
+	// Runtime-provided DNS settings take precedence
+	dns := conf.dnsConfig()
+	if len(dns.Nameservers) != 1 || dns.Nameservers[0] != "1.1.1.1" {
+		t.Fatalf("Expected runtime nameservers, got %v", dns.Nameservers)
+	}
+
+	// Fall back to the network configuration
+	conf.RuntimeConfig.DNS = types.DNS{}
+	dns = conf.dnsConfig()
+	if len(dns.Nameservers) != 1 || dns.Nameservers[0] != "10.96.0.10" {
+		t.Fatalf("Expected network nameservers, got %v", dns.Nameservers)
+	}
+}
+
+func TestContainerSysctls(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"sysctls": {"net.ipv4.conf.eth0.rp_filter": "1", "net.ipv4.tcp_keepalive_time": "600"},
+		"args": {"cni": {"sysctls": {"net.ipv4.conf.eth0.rp_filter": "2"}}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// Per-attachment args take precedence
+	sysctls := conf.containerSysctls()
+	if sysctls["net.ipv4.conf.eth0.rp_filter"] != "2" || sysctls["net.ipv4.tcp_keepalive_time"] != "600" {
+		t.Fatalf("Unexpected sysctls: %v", sysctls)
+	}
+
+	// Devices with dots in their names are named with slashes
+	if err := validateSysctl("net/ipv4/conf/eth0.100/rp_filter"); err != nil {
+		t.Fatalf("Expected slash-separated sysctl to be accepted, got: %v", err)
+	}
+	if parts := sysctlParts("net/ipv4/conf/eth0.100/rp_filter"); len(parts) != 5 || parts[3] != "eth0.100" {
+		t.Fatalf("Unexpected sysctl path: %v", parts)
+	}
+
+	// Only network namespace sysctls are allowed
+	for _, name := range []string{"kernel.panic", "net..ipv4", "net.ipv4/../../kernel", "net/ipv4/../../kernel/panic", "/net/ipv4/ip_forward"} {
+		if err := validateSysctl(name); err == nil {
+			t.Fatalf("Expected sysctl %q to be rejected", name)
+		}
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"defaultRoute": {"gw": "10.244.0.254", "metric": 100}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	dr := conf.defaultRoute()
+	route := dr.netlinkRoute(3, net.ParseIP(conf.Gateway))
+	if !route.Gw.Equal(net.ParseIP("10.244.0.254")) || route.Priority != 100 || route.LinkIndex != 3 {
+		t.Fatalf("Unexpected default route: %+v", route)
+	}
+
+	// Per-attachment args replace the network's settings
+	conf.Args = &ArgsConf{CNI: CNIArgs{DefaultRoute: &DefaultRouteConf{Disabled: true}}}
+	if dr = conf.defaultRoute(); !dr.Disabled || dr.Metric != 0 {
+		t.Fatalf("Expected args to disable the default route, got %+v", dr)
+	}
+
+	// The next hop must be an IPv4 address in the subnet
+	for _, gw := range []string{"10.245.0.1", "fd00::1", "gateway"} {
+		conf.Args.CNI.DefaultRoute = &DefaultRouteConf{GW: gw}
+		if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "default route gateway") {
+			t.Fatalf("Expected default route gateway %q to be rejected, got: %v", gw, err)
+		}
+	}
+
+	// Several gateways make an ECMP route with a next hop each
+	conf.Args.CNI.DefaultRoute = &DefaultRouteConf{Gateways: []string{"10.244.0.1", "10.244.0.2"}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	dr = conf.defaultRoute()
+	route = dr.netlinkRoute(3, net.ParseIP(conf.Gateway))
+	if len(route.MultiPath) != 2 || route.MultiPath[1].LinkIndex != 3 || !route.MultiPath[1].Gw.Equal(net.ParseIP("10.244.0.2")) {
+		t.Fatalf("Unexpected ECMP default route: %+v", route)
+	}
+	// Routes the agent withdrew a gateway from still match
+	withdrawn := netlink.Route{LinkIndex: 3, Gw: net.ParseIP("10.244.0.2")}
+	other := netlink.Route{LinkIndex: 3, Gw: net.ParseIP("10.244.0.9")}
+	if !hasDefaultRouteVia([]netlink.Route{withdrawn}, route) || hasDefaultRouteVia([]netlink.Route{other}, route) {
+		t.Fatalf("Expected only routes through the gateways to match")
+	}
+	conf.Args.CNI.DefaultRoute.GW = "10.244.0.3"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "mutually exclusive") {
+		t.Fatalf("Expected gw with gateways to be rejected, got: %v", err)
+	}
+	if gws := nexthops(route); len(gws) != 2 || !gws[0].Equal(net.ParseIP("10.244.0.1")) {
+		t.Fatalf("Unexpected next hops: %v", gws)
+	}
+}
+
+func TestSecondaryDefaultRoute(t *testing.T) {
+	data := []byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ipv6Subnet": "fd00:10:244::/64",
+		"ipv6Gateway": "fd00:10:244::1"
+	}`)
+	for _, tt := range []struct {
+		name      string
+		secondary bool
+		args      *ArgsConf
+		disabled  bool
+	}{
+		{name: "primary"},
+		{name: "secondary", secondary: true, disabled: true},
+		// Secondary attachments asking for a default route get it
+		{name: "secondary with route", secondary: true, args: &ArgsConf{CNI: CNIArgs{DefaultRoute: &DefaultRouteConf{Metric: 200}}}},
+	} {
+		conf, err := parseConfig(data)
+		if err != nil {
+			t.Fatalf("Failed to parse configuration: %v", err)
+		}
+		conf.Secondary, conf.Args = tt.secondary, tt.args
+		conf.skipSecondaryDefaultRoute()
+		if dr := conf.defaultRoute(); dr.Disabled != tt.disabled {
+			t.Errorf("%s: expected default route disabled %v, got %+v", tt.name, tt.disabled, dr)
+		}
+		if route := conf.ipv6DefaultRoute(3); (route == nil) != tt.disabled {
+			t.Errorf("%s: expected IPv6 default route disabled %v, got %+v", tt.name, tt.disabled, route)
+		}
+	}
+}
+
+func TestArgsOverrides(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"mtu": 1450,
+		"routes": [{"dst": "10.96.0.0/12"}, {"dst": "192.168.0.0/16"}],
+		"vethQueues": 2,
+		"args": {"cni": {"mtu": 1400, "vethQueues": 8, "routes": [{"dst": "192.168.0.0/16", "metric": 10}, {"dst": "172.16.0.0/12"}]}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// The attachment's interfaces use its MTU, the shared devices the network's
+	if conf.linkMTU() != 1400 || conf.MTU != 1450 {
+		t.Fatalf("Unexpected MTUs %d/%d", conf.linkMTU(), conf.MTU)
+	}
+	if conf.vethQueues() != 8 {
+		t.Fatalf("Expected the attachment's 8 queues, got %d", conf.vethQueues())
+	}
+
+	// Per-attachment routes replace those to the same destination
+	routes := conf.containerRoutes()
+	if len(routes) != 3 || routes[0].Dst != "10.96.0.0/12" || routes[1].Metric != 10 || routes[2].Dst != "172.16.0.0/12" {
+		t.Fatalf("Unexpected routes: %+v", routes)
+	}
+
+	// The attachment's MTU can't exceed the bridge's, and its routes are
+	// validated as well
+	conf.Args.CNI.MTU = 9000
+	conf.Args.CNI.VethQueues = 5000
+	conf.Args.CNI.Routes = []RouteConf{{Dst: "not-a-cidr"}}
+	err = conf.Validate()
+	for _, problem := range []string{"args.cni.mtu", "args.cni.vethQueues", "invalid route destination"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem with %s, got: %v", problem, err)
+		}
+	}
+}
+
+func TestValidateMode(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1"
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if conf.Mode != modeBridge {
+		t.Fatalf("Expected default mode %q, got %q", modeBridge, conf.Mode)
+	}
+
+	// Bridge-only options are rejected in the other modes
+	conf.Mode = "macvlan"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.HairpinMode = true
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "hairpinMode") {
+		t.Fatalf("Expected hairpinMode to be rejected, got: %v", err)
+	}
+
+	// Tap mode has no container namespace to tune
+	conf.Mode = "tap"
+	conf.DisableIPv6 = true
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "disableIPv6") {
+		t.Fatalf("Expected disableIPv6 to be rejected, got: %v", err)
+	}
+
+	// OVS tunnels need their peers, and vhost-user the userspace datapath
+	conf.HairpinMode = false
+	conf.DisableIPv6 = false
+	conf.Mode = "ovs"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "peers") {
+		t.Fatalf("Expected missing peers to be rejected, got: %v", err)
+	}
+	conf.OVS.Peers = []string{"192.168.1.2"}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.OVS.VhostUser = true
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "netdev") {
+		t.Fatalf("Expected vhostUser without netdev datapath to be rejected, got: %v", err)
+	}
+	conf.OVS.DatapathType = "netdev"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// SR-IOV mode needs the VF from the device plugin
+	conf.Mode = "sriov"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "deviceID") {
+		t.Fatalf("Expected missing deviceID to be rejected, got: %v", err)
+	}
+	conf.RuntimeConfig.DeviceID = "0000:3b:02.1"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// Anti-spoofing filters need a host-side port
+	conf.AntiSpoofing = true
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.Mode = "ipvlan"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "antiSpoofing") {
+		t.Fatalf("Expected antiSpoofing to be rejected, got: %v", err)
+	}
+	conf.AntiSpoofing = false
+
+	// DSCP marking needs a host-side port as well, and a valid code point
+	dscp, override := 46, 64
+	conf.DSCP = &dscp
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "dscp") {
+		t.Fatalf("Expected dscp to be rejected, got: %v", err)
+	}
+	conf.Mode = "sriov"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.Args = &ArgsConf{CNI: CNIArgs{DSCP: &override}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "dscp 64 out of range") {
+		t.Fatalf("Expected per-attachment dscp to be checked, got: %v", err)
+	}
+	conf.DSCP = nil
+	conf.Args = nil
+
+	// Rate limits are overridden per direction, and need a rate for a burst
+	conf.Mode = "bridge"
+	conf.RateLimits = RateLimits{IngressRate: 1000000, EgressRate: 2000000}
+	conf.Args = &ArgsConf{CNI: CNIArgs{RateLimits: RateLimits{EgressBurst: 8000}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.Args.CNI.EgressRate = 500000
+	if limits := conf.rateLimits(); limits.IngressRate != 1000000 || limits.EgressRate != 500000 || limits.EgressBurst != 8000 {
+		t.Fatalf("Unexpected rate limits %+v", limits)
+	}
+	conf.RateLimits = RateLimits{IngressBurst: 8000}
+	conf.Args = nil
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "ingressBurst requires ingressRate") {
+		t.Fatalf("Expected burst without rate to be rejected, got: %v", err)
+	}
+	conf.RateLimits = RateLimits{}
+
+	// Network policy is enforced on the Linux bridge
+	conf.Mode = "sriov"
+	conf.Policy = &PolicyConf{Policy: policy.Policy{Ingress: []policy.Rule{{Action: "reject"}}}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "policy.ingress[0].action") {
+		t.Fatalf("Expected invalid policy rule to be rejected, got: %v", err)
+	}
+	conf.Policy.Ingress[0].Action = "allow"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.Mode = "ipvlan"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "policy isn't supported") {
+		t.Fatalf("Expected policy to be rejected, got: %v", err)
+	}
+	conf.Policy = nil
+
+	// Negative API server rate limits are rejected
+	conf.Kubernetes = &k8s.Settings{QPS: -5}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "kubernetes.qps") {
+		t.Fatalf("Expected negative qps to be rejected, got: %v", err)
+	}
+	conf.Kubernetes = nil
+
+	// Hooks are run without a shell, so they need the command's path
+	conf.Hooks = &HooksConf{PostAdd: []string{"register-dns", "--zone", "pods"}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "hooks.postAdd") {
+		t.Fatalf("Expected relative hook command to be rejected, got: %v", err)
+	}
+	conf.Hooks = nil
+
+	// Only known firewall backends are accepted
+	conf.FirewallBackend = "ebtables"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "firewallBackend") {
+		t.Fatalf("Expected unknown firewall backend to be rejected, got: %v", err)
+	}
+	// firewalld binds the subnets to a zone that must be chosen
+	conf.FirewallBackend = "firewalld"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "requires firewalldZone") {
+		t.Fatalf("Expected firewalld without zone to be rejected, got: %v", err)
+	}
+	conf.FirewalldZone = "internal"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.FirewallBackend = "nftables"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "firewalldZone requires") {
+		t.Fatalf("Expected zone without firewalld to be rejected, got: %v", err)
+	}
+	conf.FirewalldZone = ""
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// A VRF needs a name and a table of its own, and keeps host routes out
+	conf.VRF = &VRFConf{Table: 254}
+	conf.HostRoutes = true
+	err = conf.Validate()
+	for _, problem := range []string{"vrf.name", "vrf.table", "hostRoutes"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem with %s, got: %v", problem, err)
+		}
+	}
+	conf.VRF = &VRFConf{Name: "vrf-overlay", Table: 100}
+	conf.HostRoutes = false
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.VRF = nil
+
+	conf.Mode = "tunnel"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "unknown mode") {
+		t.Fatalf("Expected unknown mode to be rejected, got: %v", err)
+	}
+}
+
+func TestDisableCheckAndGC(t *testing.T) {
+	dataDir := t.TempDir()
+	conf := `{
+		"cniVersion": "1.1.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "xvm-missing0",
+		"vxlanID": 4000,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"dataDir": "` + dataDir + `",
+		"disableCheck": true,
+		"disableGC": true
+	}`
+
+	// Neither command looks at the node, whose network doesn't exist
+	args := &skel.CmdArgs{ContainerID: "c1", IfName: "eth0", StdinData: []byte(conf)}
+	if err := cmdCheck(context.Background(), args); err != nil {
+		t.Fatalf("Expected CHECK to be skipped, got: %v", err)
+	}
+	if err := cmdGC(context.Background(), args); err != nil {
+		t.Fatalf("Expected GC to be skipped, got: %v", err)
+	}
+	if entries, _ := os.ReadDir(dataDir); len(entries) != 0 {
+		t.Fatalf("Expected GC to leave the data directory alone, found %d entries", len(entries))
+	}
+
+	// CHECK runs when enabled
+	args.StdinData = []byte(strings.Replace(conf, `"disableCheck": true`, `"disableCheck": false`, 1))
+	if err := cmdCheck(context.Background(), args); err == nil {
+		t.Fatalf("Expected CHECK to fail on a missing network")
+	}
+}
+
+func TestRouterAdvertisements(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ipv6Subnet": "fd00:10::/64",
+		"ipv6Gateway": "fd00:10::1",
+		"routerAdvertisements": {"slaac": true}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// The advertisement carries the IPv6 subnet and the longest lifetime
+	router := conf.RouterAdvertisements.router(conf)
+	if router.Prefix.String() != "fd00:10::/64" || !router.Autonomous || router.Lifetime != defaultRouterLifetime {
+		t.Fatalf("Unexpected advertisement: %+v", router)
+	}
+	sysctls := raSysctls(conf, "eth0")
+	if sysctls["net.ipv6.conf.eth0.accept_ra"] != "2" || sysctls["net.ipv6.conf.eth0.autoconf"] != "1" {
+		t.Fatalf("Unexpected sysctls: %v", sysctls)
+	}
+
+	// SLAAC needs a /64 and unfiltered addresses
+	conf.IPv6Subnet, conf.IPv6Gateway = "fd00:10::/112", "fd00:10::1"
+	conf.AntiSpoofing = true
+	conf.RouterAdvertisements.RouterLifetime = 70000
+	err = conf.Validate()
+	for _, problem := range []string{"requires a /64", "antiSpoofing", "routerLifetime"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem with %s, got: %v", problem, err)
+		}
+	}
+
+	// vhost-user ports leave nothing to send the advertisements to
+	conf.IPv6Subnet = "fd00:10::/64"
+	conf.Mode, conf.OVS = modeOVS, OVSConf{VhostUser: true}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "requires external with ovs.vhostUser") {
+		t.Fatalf("Expected vhost-user ports to require external advertisements, got: %v", err)
+	}
+
+	// Without an IPv6 subnet there is nothing to advertise
+	conf = &PluginConf{HostInterface: "eth0", VxlanID: 1, VxlanPort: 4789, MTU: 1450, Mode: modeBridge,
+		Subnet: "10.244.0.0/16", Gateway: "10.244.0.1", RouterAdvertisements: &RAConf{External: true}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "requires ipv6Subnet") {
+		t.Fatalf("Expected missing ipv6Subnet to be rejected, got: %v", err)
+	}
+}
+
+func TestIPv6DefaultRoute(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ipv6Subnet": "fd00:10::/64",
+		"ipv6Gateway": "fd00:10::1",
+		"defaultRoute": {"metric": 100}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+
+	// Dual-stack networks get an IPv6 default route through ipv6Gateway,
+	// with the default route's metric
+	route := conf.ipv6DefaultRoute(3)
+	if route == nil || !route.Gw.Equal(net.ParseIP("fd00:10::1")) || route.Priority != 100 || route.LinkIndex != 3 {
+		t.Fatalf("Unexpected IPv6 default route: %+v", route)
+	}
+
+	// Previous results carry default routes per family
+	_, v4Default, _ := net.ParseCIDR("0.0.0.0/0")
+	result := &current.Result{Routes: []*types.Route{{Dst: *v4Default}}}
+	if !hasDefaultRoute(result, false) || hasDefaultRoute(result, true) {
+		t.Fatalf("Expected only an IPv4 default route in the result")
+	}
+
+	// Router advertisements provide the route instead, and disabling the
+	// default route disables both
+	conf.RouterAdvertisements = &RAConf{}
+	if route := conf.ipv6DefaultRoute(3); route != nil {
+		t.Fatalf("Expected no IPv6 default route with router advertisements, got %+v", route)
+	}
+	conf.RouterAdvertisements = nil
+	conf.DefaultRoute.Disabled = true
+	if route := conf.ipv6DefaultRoute(3); route != nil {
+		t.Fatalf("Expected no IPv6 default route when disabled, got %+v", route)
+	}
+}
+
+func TestUnderlayVLAN(t *testing.T) {
+	// The VLAN defaults to the one hostInterface is named after
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0.100",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"underlayVLAN": {"address": "192.168.100.10/24"}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if conf.UnderlayVLAN.Parent != "eth0" || conf.UnderlayVLAN.ID != 100 {
+		t.Fatalf("Unexpected underlay VLAN %+v", conf.UnderlayVLAN)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// Otherwise it must be given, and the VTEP address is IPv4
+	conf.HostInterface = "uplink"
+	conf.UnderlayVLAN = &UnderlayVLANConf{ID: 5000, MTU: 10, Address: "fd00::10/64"}
+	err = conf.Validate()
+	for _, problem := range []string{"underlayVLAN.parent", "underlayVLAN.id", "underlayVLAN.mtu", "underlayVLAN.address"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem with %s, got: %v", problem, err)
+		}
+	}
+
+	conf.UnderlayVLAN = &UnderlayVLANConf{Parent: "eth0", ID: 100}
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, "underlayVLAN.address must be specified") {
+		t.Fatalf("Expected missing address to be rejected, got: %v", err)
+	}
+}
+
+func TestVLAN(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"vlan": 100,
+		"args": {"cni": {"vlan": 200}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if vid := conf.vlan(); vid != 200 {
+		t.Fatalf("Expected args.cni.vlan to take precedence, got %d", vid)
+	}
+
+	// Without filtering the bridge would not separate the VLANs
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "vlanFiltering") {
+		t.Fatalf("Expected vlan without vlanFiltering to be rejected, got: %v", err)
+	}
+	conf.VLANFiltering = true
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.Args.CNI.VLAN = 4095
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "vlan 4095") {
+		t.Fatalf("Expected vlan 4095 to be rejected, got: %v", err)
+	}
+
+	// The gateway interface of the VLAN would be outside the VRF
+	conf.Args.CNI.VLAN = 200
+	conf.VRF = &VRFConf{Name: "vrf-xvm", Table: 100}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "vlan can't be combined with vrf") {
+		t.Fatalf("Expected vlan with vrf to be rejected, got: %v", err)
+	}
+	conf.Args.CNI.VLAN, conf.VLAN = 0, 1
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected the default VLAN in a VRF to be valid, got: %v", err)
+	}
+	conf.VRF = nil
+
+	// Only the bridge modes filter
+	conf.Args.CNI.VLAN = 0
+	conf.Mode = "macvlan"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "vlanFiltering") {
+		t.Fatalf("Expected vlanFiltering to be rejected, got: %v", err)
+	}
+}
+
+func TestMTUProbe(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"mode": "ovs",
+		"mtu": 8950,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ovs": {"peers": ["192.168.1.2"]},
+		"mtuProbe": {}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// OVS networks probe their tunnels' peers, and only jumbo MTUs are probed
+	if !conf.probesMTU() || len(conf.MTUProbe.Peers) != 1 || conf.MTUProbe.Peers[0] != "192.168.1.2" {
+		t.Fatalf("Expected the OVS peers to be probed, got %+v", conf.MTUProbe)
+	}
+	conf.MTU = 1450
+	if conf.probesMTU() {
+		t.Fatalf("Expected mtu 1450 not to be probed")
+	}
+
+	conf.MTUProbe = &MTUProbeConf{Peers: []string{"fd00::2"}, Timeout: -1}
+	err = conf.Validate()
+	for _, problem := range []string{"mtuProbe peer", "mtuProbe.timeout"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem with %s, got: %v", problem, err)
+		}
+	}
+}
+
+func TestAllowedIngressPorts(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"allowedIngressPorts": ["443"],
+		"args": {"cni": {"allowedIngressPorts": ["22", "53/udp"]}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if ports := conf.allowedIngressPorts(); len(ports) != 2 || ports[0] != "22" {
+		t.Fatalf("Expected args.cni.allowedIngressPorts to take precedence, got %v", ports)
+	}
+
+	// An empty list opens the attachment, with the network still filtering
+	conf.Args.CNI.AllowedIngressPorts = []string{}
+	if len(conf.allowedIngressPorts()) != 0 || !conf.filtersIngressPorts() {
+		t.Fatalf("Expected the attachment's ingress to be open on a filtering network")
+	}
+
+	conf.Args.CNI.AllowedIngressPorts = []string{"0", "80/icmp"}
+	err = conf.Validate()
+	for _, problem := range []string{`invalid port "0"`, `unsupported protocol in "80/icmp"`} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Fatalf("Expected problem %s, got: %v", problem, err)
+		}
+	}
+
+	// Only the bridge modes filter on the container's port
+	conf.Args = nil
+	conf.Mode = "macvlan"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "allowedIngressPorts isn't supported") {
+		t.Fatalf("Expected allowedIngressPorts to be rejected, got: %v", err)
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	// Standalone networks need no underlay interface
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"standalone": true,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1"
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if conf.usesVxlan() {
+		t.Fatalf("Expected no VXLAN interface for a standalone network")
+	}
+
+	// The shim and OVS modes need the VXLAN interface or tunnels
+	conf.Mode = "macvlan"
+	conf.MTUProbe = &MTUProbeConf{Peers: []string{"192.168.1.2"}}
+	conf.HostRoutes = true
+	conf.NDPProxy = true
+	err = conf.Validate()
+	for _, want := range []string{`standalone isn't supported in mode "macvlan"`, "mtuProbe can't be combined with standalone", "hostRoutes requires hostInterface", "ndpProxy requires ipv6Subnet", "ndpProxy requires hostInterface"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestDeviceNameTemplates(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 42,
+		"vxlanNameTemplate": "vx-{{.NetworkName}}",
+		"bridgeNameTemplate": "xbr{{.Hash}}",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1"
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if vxlanName(conf) != "vx-xvm-network" || l2Name(conf) != "xbr0dad75c4" {
+		t.Fatalf("Unexpected device names %s and %s", vxlanName(conf), l2Name(conf))
+	}
+
+	// Names must fit and tell the devices apart
+	conf.VxlanNameTemplate = "vxlan-{{.NetworkName}}"
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, "vxlanNameTemplate renders invalid interface name") {
+		t.Fatalf("Expected a too long name to be rejected, got: %v", err)
+	}
+	conf.VxlanNameTemplate = "xbr{{.Hash}}"
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, `both render "xbr0dad75c4"`) {
+		t.Fatalf("Expected clashing names to be rejected, got: %v", err)
+	}
+
+	// As must the networks
+	conf.VxlanNameTemplate = "vx{{.VNI}}"
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, `vxlanNameTemplate renders "vx42" for every network`) {
+		t.Fatalf("Expected a name shared by networks to be rejected, got: %v", err)
+	}
+}
+
+func TestOffloads(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"offloads": {"veth": {"tso": true}, "vxlan": {"gro": false}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if *conf.vxlanOffloads().GRO || !*conf.vethOffloads().TSO {
+		t.Fatalf("Unexpected offloads %+v", conf.Offloads)
+	}
+
+	// Taps aren't veths
+	conf.Mode = "tap"
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "offloads.veth") {
+		t.Fatalf("Expected offloads.veth to be rejected, got: %v", err)
+	}
+}
+
+func TestProxyARP(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"proxyARP": {"bridge": {"enabled": true, "delay": 0}, "vxlan": {"enabled": false}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	want := []proxyARPSysctl{{"ipv4/conf", "proxy_arp", "1"}, {"ipv4/neigh", "proxy_delay", "0"}}
+	if got := conf.bridgeProxyARP().sysctls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected sysctls %v, got %v", want, got)
+	}
+	want = []proxyARPSysctl{{"ipv4/conf", "proxy_arp", "0"}}
+	if got := conf.vxlanProxyARP().sysctls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected sysctls %v, got %v", want, got)
+	}
+
+	delay := -1
+	conf.ProxyARP.Vxlan.Delay = &delay
+	conf.Standalone = true
+	err = conf.Validate()
+	for _, want := range []string{"proxyARP.vxlan.delay -1 out of range", "proxyARP.vxlan can't be combined with standalone"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"hostRoutes": true,
+		"routeTable": {"id": 100, "fwmark": "0x100/0xff00", "from": ["10.244.0.0/16"]}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	s := routeSelector(conf)
+	if s.Table != 100 || s.Priority != 1000 || s.Mark != 0x100 || s.Mask != 0xff00 || len(s.Sources) != 1 {
+		t.Fatalf("Unexpected selector %+v", s)
+	}
+	// The node's traffic to the subnet looks up the host routes in the table
+	if len(s.Destinations) != 1 || s.Destinations[0].String() != "10.244.0.0/16" {
+		t.Fatalf("Expected the subnet as destination, got %v", s.Destinations)
+	}
+	if conf.routeTable() != 100 {
+		t.Fatalf("Expected host routes in table 100, got %d", conf.routeTable())
+	}
+
+	conf.RouteTable = &RouteTableConf{ID: 254, FwMark: "0"}
+	conf.VRF = &VRFConf{Name: "vrf-blue", Table: 10}
+	err = conf.Validate()
+	for _, want := range []string{"routeTable.id 254 is reserved", `invalid fwmark "0"`, "routeTable can't be combined with vrf"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+	conf.RouteTable = &RouteTableConf{ID: 100}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "routeTable requires fwmark or from") {
+		t.Fatalf("Expected a selector to be required, got: %v", err)
+	}
+}
+
+func TestSourceRouting(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth1",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"sourceRouting": {"table": 200, "gateway": "192.168.2.1"}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	rules := sourceSelector(conf, net.ParseIP("192.168.2.10")).Rules()
+	if len(rules) != 1 || rules[0].Src.String() != "192.168.2.10/32" || rules[0].Table != 200 || rules[0].Priority != 1000 {
+		t.Fatalf("Unexpected source routing rules %v", rules)
+	}
+
+	conf.SourceRouting = &SourceRoutingConf{Table: 100, Gateway: "fd00::1", Priority: 40000}
+	conf.RouteTable = &RouteTableConf{ID: 100, FwMark: "0x100"}
+	conf.Mode = "ovs"
+	conf.OVS.Peers = []string{"192.168.2.11"}
+	err = conf.Validate()
+	for _, want := range []string{`invalid sourceRouting.gateway "fd00::1"`, "sourceRouting.priority 40000 out of range", "sourceRouting.table and routeTable.id must differ", `sourceRouting isn't supported in mode "ovs"`} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestOpenFirewall(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"mode": "ovs",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ovs": {"peers": ["192.168.1.11"]},
+		"openFirewall": {}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	// OVS tunnels to its peers without a flood group
+	o := vxlanOpening(conf)
+	if o.Port != 8472 || len(o.Peers) != 1 || o.Peers[0] != "192.168.1.11" || o.Multicast {
+		t.Fatalf("Unexpected opening %+v", o)
+	}
+
+	// Multicast flooding doesn't name the peers, which must be given
+	conf.Mode = "bridge"
+	err = conf.Validate()
+	if want := "openFirewall requires peers"; err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+		t.Fatalf("Expected %q, got: %v", want, err)
+	}
+
+	conf.Standalone = true
+	conf.OpenFirewall.Peers = []string{"192.168.2.0/24", "fd00::1", "node-b"}
+	err = conf.Validate()
+	for _, want := range []string{`invalid openFirewall peer "fd00::1"`, `invalid openFirewall peer "node-b"`, "openFirewall can't be combined with standalone"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestUnmanagedPatterns(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"unmanaged": true
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	want := []string{l2Name(conf), vxlanName(conf), "veth*"}
+	if got := unmanagedPatterns(conf); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected patterns %v, got %v", want, got)
+	}
+
+	// Templated names are matched by their constant prefix
+	conf.VethNameTemplate = "xvm{{.Hash}}"
+	if pattern := hostPortPattern(conf); pattern != "xvm*" {
+		t.Fatalf("Expected pattern xvm*, got %q", pattern)
+	}
+	conf.VethNameTemplate = "{{.ShortID}}-{{.IfName}}"
+	if pattern := hostPortPattern(conf); pattern != "" {
+		t.Fatalf("Expected no pattern, got %q", pattern)
+	}
+	conf.VethNameTemplate = ""
+	conf.Mode = "ipvlan"
+	if pattern := hostPortPattern(conf); pattern != "" {
+		t.Fatalf("Expected no pattern for ipvlan, got %q", pattern)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"audit": {"target": "journald"}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	args := &skel.CmdArgs{ContainerID: "ctr-a", IfName: "eth0", Args: "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0"}
+	e := auditEvent("ADD", conf, args, 0, newError(types.ErrTryAgainLater, "network is busy", nil))
+	if e.Network != "xvm-network" || e.PodNamespace != "default" || e.PodName != "web-0" || e.ErrCode != types.ErrTryAgainLater {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+
+	conf.Audit.Target = "file"
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, `invalid audit target "file"`) {
+		t.Fatalf("Expected invalid target to be reported, got: %v", err)
+	}
+}
+
+func TestNamespaceRanges(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ipv6Subnet": "fd00:10:244::/64",
+		"ipv6Gateway": "fd00:10:244::1",
+		"namespaceRanges": [
+			{"namespaces": ["team-a", "team-a-staging"], "range": "10.244.16.0/20", "ipv6Range": "fd00:10:244::1:0/112"},
+			{"namespaces": ["team-b"], "range": "10.244.32.0/20"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	conf.DataDir = t.TempDir()
+	for _, tc := range []struct {
+		namespace string
+		want      []string
+	}{
+		{"team-a", []string{"10.244.16.0", "fd00:10:244::1:0"}},
+		{"team-b", []string{"10.244.32.0", "fd00:10:244::2"}},
+		// Pods of other namespaces stay outside every range
+		{"default", []string{"10.244.0.2", "fd00:10:244::2"}},
+		{"", []string{"10.244.0.2", "fd00:10:244::2"}},
+	} {
+		ipams, err := openIPAM(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restrictToNamespace(conf, ipams, tc.namespace)
+		ips, err := previewIPs(ipams, "ctr", nil)
+		if err != nil {
+			t.Fatalf("Failed to preview the addresses of %q: %v", tc.namespace, err)
+		}
+		for i, ipc := range ips {
+			if !ipc.Address.IP.Equal(net.ParseIP(tc.want[i])) {
+				t.Errorf("Expected %s for namespace %q, got %s", tc.want[i], tc.namespace, ipc.Address.IP)
+			}
+		}
+	}
+
+	conf.NamespaceRanges = []NamespaceRange{
+		{Namespaces: []string{"team-a"}, Range: "10.245.0.0/24"},
+		{Namespaces: []string{"team-a"}, Range: "10.244.0.0/8"},
+		{Namespaces: []string{"team-b"}, Range: "10.244.1.0/24"},
+		{Namespaces: []string{"team-c"}, Range: "10.244.1.128/25", IPv6Range: "10.244.2.0/24"},
+		{Range: "10.244.3.0/24"},
+		{Namespaces: []string{"team-d"}},
+	}
+	err = conf.Validate()
+	for _, problem := range []string{
+		"namespaceRanges[0].range 10.245.0.0/24 is not inside subnet",
+		"namespaceRanges[1].range 10.0.0.0/8 is not inside subnet",
+		"namespace team-a is in namespaceRanges[0] and namespaceRanges[1]",
+		"namespaceRanges[3].range 10.244.1.128/25 overlaps 10.244.1.0/24",
+		"namespaceRanges[3].ipv6Range 10.244.2.0/24 has the wrong address family",
+		"namespaceRanges[4].namespaces must be specified",
+		"namespaceRanges[5] must set range or ipv6Range",
+	} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Errorf("Expected problem %q, got: %v", problem, err)
+		}
+	}
+}
+
+func TestNamespaceVNIs(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 42,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"namespaceRanges": [{"namespaces": ["team-b"], "range": "10.244.16.0/20"}],
+		"namespaceVNIs": [
+			{"namespaces": ["team-a"], "vxlanID": 100, "subnet": "10.100.0.0/24", "gateway": "10.100.0.1"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.DataDir = t.TempDir()
+
+	args := &skel.CmdArgs{ContainerID: "ctr", IfName: "eth0", Args: "K8S_POD_NAMESPACE=team-a;K8S_POD_NAME=web"}
+	segment, err := attachmentNetwork(conf, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.Name != "xvm-network-vni100" || segment.VxlanID != 100 || segment.Subnet != "10.100.0.0/24" || segment.Gateway != "10.100.0.1" || segment.NamespaceRanges != nil {
+		t.Fatalf("Unexpected segment %+v", segment)
+	}
+	if err := segment.Validate(); err != nil {
+		t.Fatalf("Expected a valid segment, got: %v", err)
+	}
+	if l2Name(segment) == l2Name(conf) || vxlanName(segment) == vxlanName(conf) {
+		t.Fatalf("Expected the segment to have devices of its own")
+	}
+
+	// Other namespaces stay on the network
+	if c, err := attachmentNetwork(conf, &skel.CmdArgs{Args: "K8S_POD_NAMESPACE=team-b;K8S_POD_NAME=web"}); err != nil || c != conf {
+		t.Fatalf("Expected team-b on the network, got %+v, %v", c, err)
+	}
+
+	// Without CNI_ARGS, the attachment is found on the segment ADD recorded
+	// it on
+	noArgs := &skel.CmdArgs{ContainerID: "ctr", IfName: "eth0"}
+	if c, err := attachmentNetwork(conf, noArgs); err != nil || c != conf {
+		t.Fatalf("Expected an unrecorded attachment on the network, got %+v, %v", c, err)
+	}
+	if err := saveResult(segment, args, &current.Result{CNIVersion: "1.0.0"}, net.Interface{}, net.Interface{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := attachmentNetwork(conf, noArgs); err != nil || c.Name != "xvm-network-vni100" {
+		t.Fatalf("Expected the recorded segment, got %+v, %v", c, err)
+	}
+	// The record wins over the namespace, which may have moved since
+	moved := &skel.CmdArgs{ContainerID: "ctr", IfName: "eth0", Args: "K8S_POD_NAMESPACE=team-b;K8S_POD_NAME=web"}
+	if c, err := attachmentNetwork(conf, moved); err != nil || c.Name != "xvm-network-vni100" {
+		t.Fatalf("Expected the recorded segment, got %+v, %v", c, err)
+	}
+
+	conf.Name = ""
+	conf.Mode = "ovs"
+	conf.NamespaceVNIs = []NamespaceVNI{
+		{Namespaces: []string{"team-a"}, VxlanID: 42, Subnet: "10.100.0.0/24", Gateway: "10.101.0.1"},
+		{Namespaces: []string{"team-a"}, VxlanID: 16777216},
+		{VxlanID: 200, Subnet: "10.200.0.0/24", Gateway: "10.200.0.1", IPv6Gateway: "fd00:200::1"},
+		{Namespaces: []string{"team-c"}, VxlanID: 300, Subnet: "10.244.128.0/24", Gateway: "10.244.128.1"},
+		{Namespaces: []string{"team-d"}, VxlanID: 400, Subnet: "10.100.0.0/25", Gateway: "10.100.0.1"},
+	}
+	err = conf.Validate()
+	for _, problem := range []string{
+		"namespaceVNIs requires name",
+		"namespaceVNIs[0].vxlanID 42 is that of vxlanID",
+		"gateway 10.101.0.1 is not inside namespaceVNIs[0].subnet",
+		"namespace team-a is in namespaceVNIs[0] and namespaceVNIs[1]",
+		"namespaceVNIs[1].vxlanID 16777216 out of range",
+		"namespaceVNIs[1].subnet must be specified",
+		"namespaceVNIs[2].namespaces must be specified",
+		"namespaceVNIs[2].ipv6Subnet must be specified with ipv6Gateway",
+		"namespaceVNIs[3].subnet 10.244.128.0/24 overlaps subnet 10.244.0.0/16",
+		"namespaceVNIs[4].subnet 10.100.0.0/25 overlaps namespaceVNIs[0].subnet 10.100.0.0/24",
+		"namespaceVNIs isn't supported",
+	} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Errorf("Expected problem %q, got: %v", problem, err)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 42,
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"routes": [{"dst": "10.96.0.0/12"}],
+		"attachments": [
+			{"name": "back", "ifName": "eth1", "vxlanID": 43, "subnet": "10.245.0.0/24", "gateway": "10.245.0.1", "routes": [{"dst": "10.246.0.0/16"}]}
+		],
+		"runtimeConfig": {"ips": ["10.244.0.9/16"], "mac": "0a:58:0a:f4:00:09"}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	back := conf.attached(conf.Attachments[0])
+	if back.Name != "xvm-network-back" || back.VxlanID != 43 || back.Subnet != "10.245.0.0/24" || back.Gateway != "10.245.0.1" {
+		t.Fatalf("Unexpected attachment %+v", back)
+	}
+	if routes := back.containerRoutes(); len(routes) != 1 || routes[0].Dst != "10.246.0.0/16" {
+		t.Fatalf("Expected the attachment's routes, got %v", routes)
+	}
+	// The default route and the runtime's requests stay with the network's
+	// interface
+	if !back.defaultRoute().Disabled || len(back.RuntimeConfig.IPs) != 0 || back.RuntimeConfig.Mac != "" {
+		t.Fatalf("Unexpected attachment settings %+v", back)
+	}
+	if err := back.Validate(); err != nil {
+		t.Fatalf("Expected a valid attachment, got: %v", err)
+	}
+	args := attachedArgs(&skel.CmdArgs{IfName: "eth0", Args: "IgnoreUnknown=1;IP=10.244.0.9;K8S_POD_NAME=web;MAC=0a:58:0a:f4:00:09"}, conf.Attachments[0])
+	if args.IfName != "eth1" || args.Args != "IgnoreUnknown=1;K8S_POD_NAME=web" {
+		t.Fatalf("Unexpected attachment arguments %+v", args)
+	}
+
+	conf.Name = ""
+	conf.Attachments = []AttachmentConf{
+		{Name: "back", IfName: "eth1", VxlanID: 42, Subnet: "10.245.0.0/24", Gateway: "10.245.0.1"},
+		{Name: "back", IfName: "eth1", VxlanID: 44, Subnet: "10.246.0.0/24", Gateway: "10.246.0.1"},
+		{Name: "../x", VxlanID: 45},
+		{Name: "front", IfName: "eth2", VxlanID: 46, Subnet: "10.244.1.0/24", Gateway: "10.244.1.1"},
+		{Name: "wide", IfName: "eth3", VxlanID: 47, Subnet: "10.245.0.0/16", Gateway: "10.245.1.1"},
+	}
+	err = conf.Validate()
+	for _, problem := range []string{
+		"attachments requires name",
+		"attachments[0].vxlanID 42 is that of vxlanID",
+		"attachments[1].name back is that of attachments[0]",
+		"attachments[1].ifName eth1 is that of attachments[0]",
+		`attachments[2].name "../x" must start with a letter or digit`,
+		"attachments[2].ifName must be specified",
+		"attachments[2].subnet must be specified",
+		"attachments[3].subnet 10.244.1.0/24 overlaps subnet 10.244.0.0/16",
+		"attachments[4].subnet 10.245.0.0/16 overlaps attachments[0].subnet 10.245.0.0/24",
+	} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, problem) {
+			t.Errorf("Expected problem %q, got: %v", problem, err)
+		}
+	}
+}
+
+func TestEBPF(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"ebpf": {"fastPath": true}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if !conf.fastPath() || bpfDir(conf) != "/sys/fs/bpf/xvm-cni/xvm-network" {
+		t.Fatalf("Unexpected fast path in %s", bpfDir(conf))
+	}
+
+	conf.Mode = "tap"
+	conf.AntiSpoofing = true
+	conf.VLANFiltering = true
+	conf.EBPF.FSDir = "bpf"
+	err = conf.Validate()
+	for _, want := range []string{`ebpf.fsDir "bpf" must be an absolute path`, `ebpf.fastPath isn't supported in mode "tap"`, "antiSpoofing can't be combined with ebpf.fastPath", "vlanFiltering can't be combined with ebpf.fastPath"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+
+	// The program checking the sources runs ahead of the fast path
+	conf.Mode = "bridge"
+	conf.VLANFiltering = false
+	conf.EBPF.FSDir = ""
+	conf.EBPF.AntiSpoofing = true
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if !conf.bpfAntiSpoofing() {
+		t.Fatalf("Expected anti-spoofing by eBPF")
+	}
+	conf.AntiSpoofing = false
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "ebpf.antiSpoofing requires antiSpoofing") {
+		t.Fatalf("Expected ebpf.antiSpoofing to require antiSpoofing, got: %v", err)
+	}
+
+	// The guard's burst defaults to a second's worth of frames
+	conf.EBPF = &EBPFConf{BUMGuard: &BUMGuardConf{Rate: 100}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if limit := conf.bumGuard().limit(); limit.Rate != 100 || limit.Burst != 100 {
+		t.Fatalf("Unexpected BUM limit %+v", limit)
+	}
+	conf.EBPF.BUMGuard = &BUMGuardConf{Burst: -1}
+	conf.Standalone = true
+	err = conf.Validate()
+	for _, want := range []string{"ebpf.bumGuard.rate 0 out of range (1-1000000000)", "ebpf.bumGuard.burst -1 must not be negative", "ebpf.bumGuard requires a VXLAN interface"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestTables(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"tables": {"expectedPeers": 5000, "gcThresh3": 50000}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if got := conf.Tables.gcThresh(); got != (neigh.GCThresh{Thresh1: 5000, Thresh2: 10000, Thresh3: 50000}) {
+		t.Fatalf("Unexpected thresholds %+v", got)
+	}
+
+	// A lower limit on the bridge is raised, but none is kept
+	for _, c := range []struct{ cur, want int }{{0, 0}, {1000, 10000}, {20000, 20000}} {
+		if got := conf.Tables.fdbMaxLearned(c.cur); got != c.want {
+			t.Errorf("Expected limit %d raised to %d, got %d", c.cur, c.want, got)
+		}
+	}
+	conf.Tables.FDBMaxLearned = 8000
+	if got := conf.Tables.fdbMaxLearned(0); got != 8000 {
+		t.Fatalf("Expected configured limit, got %d", got)
+	}
+
+	conf.Mode = "macvlan"
+	conf.Tables = &TablesConf{ExpectedPeers: 5000, GCThresh2: 1000, FDBMaxLearned: 100}
+	err = conf.Validate()
+	for _, want := range []string{"tables thresholds 5000, 1000 and 20000 must not decrease", `tables.fdbMaxLearned isn't supported in mode "macvlan"`, "tables.fdbMaxLearned 100 is below expectedPeers 5000"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+	conf.Tables = &TablesConf{ExpectedPeers: -1, GCThresh1: -1}
+	err = conf.Validate()
+	for _, want := range []string{"tables.expectedPeers -1 out of range", "tables.gcThresh1 -1 out of range"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestFlooding(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"openFirewall": {},
+		"flooding": {"mode": "headEnd", "peers": ["192.168.1.11", "192.168.1.12"]}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if peers := conf.floodPeers(); len(peers) != 2 || !peers[1].Equal(net.ParseIP("192.168.1.12")) {
+		t.Fatalf("Unexpected flood peers %v", peers)
+	}
+	// Without a multicast group, the firewall needn't accept IGMP, and
+	// accepts the VXLAN port from the flood peers
+	if o := vxlanOpening(conf); o.Multicast || len(o.Peers) != 2 {
+		t.Fatalf("Expected no IGMP opening and the flood peers for head-end replication, got %+v", o)
+	}
+
+	// Flooding nowhere names no peers to accept the VXLAN port from, and
+	// leaves pods ARPing for those of other nodes on a shared subnet
+	conf.Flooding = &FloodingConf{Mode: "none"}
+	conf.OpenFirewall.Peers = []string{"192.168.1.0/24"}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, "requires flooding.perNodeSubnet or proxyARP.bridge") {
+		t.Fatalf("Expected flooding nowhere on a shared subnet to be rejected, got: %v", err)
+	}
+	conf.ProxyARP = &ProxyARPConf{Bridge: &ProxyARPSettings{Enabled: true}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	conf.ProxyARP = nil
+	conf.Flooding.PerNodeSubnet = true
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+	if conf.floodMode() != "none" || conf.floodPeers() != nil {
+		t.Fatalf("Unexpected flooding %q to %v", conf.floodMode(), conf.floodPeers())
+	}
+	conf.Flooding = nil
+	if conf.floodMode() != "multicast" || !vxlanOpening(conf).Multicast {
+		t.Fatalf("Expected multicast flooding by default")
+	}
+
+	conf.Standalone = true
+	conf.Flooding = &FloodingConf{Mode: "headEnd", Peers: []string{"2001:db8::1"}}
+	err = conf.Validate()
+	for _, want := range []string{`invalid flooding peer "2001:db8::1"`, "flooding requires a VXLAN interface"} {
+		if err == nil || !strings.Contains(err.(*types.Error).Details, want) {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+	}
+	conf.Standalone = false
+	conf.Flooding = &FloodingConf{Mode: "headEnd"}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, `flooding.mode "headEnd" requires flooding.peers`) {
+		t.Fatalf("Expected head-end replication to require peers, got: %v", err)
+	}
+	conf.Flooding = &FloodingConf{Mode: "multicast", Peers: []string{"192.168.1.11"}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, `flooding.peers requires flooding.mode "headEnd"`) {
+		t.Fatalf("Expected peers to require head-end replication, got: %v", err)
+	}
+	conf.Flooding = &FloodingConf{Mode: "unicast"}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.(*types.Error).Details, `unknown flooding.mode "unicast"`) {
+		t.Fatalf("Expected unknown mode to be rejected, got: %v", err)
+	}
+}
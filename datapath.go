@@ -0,0 +1,1024 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/antispoof"
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/policy"
+	"github.com/nohns/xvm-cni/pkg/qos"
+	"github.com/nohns/xvm-cni/pkg/retry"
+	"github.com/nohns/xvm-cni/pkg/rtable"
+	"github.com/nohns/xvm-cni/pkg/sriov"
+	"github.com/nohns/xvm-cni/pkg/sublink"
+	"github.com/nohns/xvm-cni/pkg/vlan"
+	"github.com/nohns/xvm-cni/pkg/vrf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+const (
+	// modeBridge attaches containers through veth pairs on the overlay bridge
+	modeBridge = "bridge"
+	// modeTap attaches VMs through tap devices on the overlay bridge
+	modeTap = "tap"
+	// modeOVS attaches containers to an Open vSwitch bridge
+	modeOVS = "ovs"
+	// modeSRIOV moves a VF into the container and bridges its representor
+	modeSRIOV = "sriov"
+
+	// defaultTapNameTemplate names tap devices unless vethNameTemplate is set.
+	// Taps need a stable name so DEL can find them again.
+	defaultTapNameTemplate = "tap{{.Hash}}"
+	// defaultVhostUserNameTemplate names vhost-user ports the same way
+	defaultVhostUserNameTemplate = "vhu{{.Hash}}"
+
+	// defaultSocketDir holds the vhost-user sockets of the VMs
+	defaultSocketDir = "/var/run/xvm-cni/vhost-user"
+)
+
+// usesBridge reports whether the containers attach to the overlay bridge
+func (c *PluginConf) usesBridge() bool {
+	return c.Mode == modeBridge || c.Mode == modeTap || c.Mode == modeSRIOV
+}
+
+// usesVxlan reports whether the network has a VXLAN interface, which OVS
+// terminates the tunnels without and standalone networks don't need
+func (c *PluginConf) usesVxlan() bool {
+	return c.Mode != modeOVS && !c.Standalone
+}
+
+// hasSandbox reports whether the container interface lives in the container
+// network namespace, rather than on the host for a VM runtime to pick up
+func (c *PluginConf) hasSandbox() bool {
+	return c.Mode != modeTap && !(c.Mode == modeOVS && c.OVS.VhostUser)
+}
+
+// deviceNames holds the names of a network's shared devices once resolved.
+// Resolving them looks up the devices of earlier versions, so it's done
+// once per invocation rather than by every step using the devices.
+type deviceNames struct {
+	// network and vxlanID tell the network the names are of, as the
+	// configurations of segments and attachments are copies of the network's
+	network string
+	vxlanID int
+	l2      string
+	vxlan   string
+}
+
+// deviceNames returns the cached names of the network's shared devices
+func (c *PluginConf) deviceNames() *deviceNames {
+	if d := c.devices; d != nil && d.network == c.Name && d.vxlanID == c.VxlanID {
+		return d
+	}
+	c.devices = &deviceNames{network: c.Name, vxlanID: c.VxlanID}
+	return c.devices
+}
+
+// l2Name returns the name of the host-side device the containers of the
+// network attach to: the bridge, or the shim in macvlan and ipvlan mode.
+// bridgeNameTemplate names the bridge if set.
+func l2Name(conf *PluginConf) string {
+	d := conf.deviceNames()
+	if d.l2 == "" {
+		d.l2 = resolveL2Name(conf)
+	}
+	return d.l2
+}
+
+// resolveL2Name looks up the name of the network's bridge or shim
+func resolveL2Name(conf *PluginConf) string {
+	switch {
+	case conf.Mode == modeOVS:
+		return conf.OVS.Bridge
+	case conf.usesBridge():
+		if name, _ := devname.Render(conf.BridgeNameTemplate, conf.Name, conf.VxlanID); name != "" {
+			return name
+		}
+		return devname.Resolve(bridge.BridgeName(conf.Name, conf.VxlanID), bridge.BridgeName("", conf.VxlanID), linkExists)
+	}
+	return devname.Resolve(sublink.ShimName(conf.Name, conf.VxlanID), sublink.ShimName("", conf.VxlanID), linkExists)
+}
+
+// vxlanName returns the name of the network's VXLAN interface, which
+// vxlanNameTemplate names if set
+func vxlanName(conf *PluginConf) string {
+	d := conf.deviceNames()
+	if d.vxlan == "" {
+		d.vxlan = resolveVxlanName(conf)
+	}
+	return d.vxlan
+}
+
+// resolveVxlanName looks up the name of the network's VXLAN interface
+func resolveVxlanName(conf *PluginConf) string {
+	if name, _ := devname.Render(conf.VxlanNameTemplate, conf.Name, conf.VxlanID); name != "" {
+		return name
+	}
+	return devname.Resolve(vxlan.DeviceName(conf.Name, conf.VxlanID), vxlan.DeviceName("", conf.VxlanID), linkExists)
+}
+
+// linkExists reports whether a link of the name exists
+func linkExists(name string) bool {
+	_, err := ops.LinkByName(name)
+	return err == nil
+}
+
+// vmPortName returns the name of the attachment's tap device or vhost-user
+// port
+func vmPortName(conf *PluginConf, containerID, ifName string) (string, error) {
+	tmpl := conf.VethNameTemplate
+	if tmpl == "" {
+		tmpl = defaultTapNameTemplate
+		if conf.Mode == modeOVS {
+			tmpl = defaultVhostUserNameTemplate
+		}
+	}
+	return renderVethName(tmpl, containerID, ifName)
+}
+
+// socketPath returns the path of a vhost-user port's socket
+func socketPath(conf *PluginConf, port string) string {
+	return filepath.Join(conf.OVS.SocketDir, port+".sock")
+}
+
+// setupNetwork enables forwarding and sets up the devices shared by the
+// network's containers: the VXLAN interface, unless OVS terminates the
+// tunnels itself or the network is standalone, and the bridge or shim
+// holding the gateway addresses
+func setupNetwork(conf *PluginConf) (*netlink.Vxlan, *netlink.Bridge, netlink.Link, error) {
+	// Enable IP forwarding
+	_, err := sysctl.Sysctl("net.ipv4.ip_forward", "1")
+	if err != nil {
+		return nil, nil, nil, newError(types.ErrInternal, "failed to enable IP forwarding", err)
+	}
+	if conf.IPv6Subnet != "" {
+		if _, err := sysctl.Sysctl("net.ipv6.conf.all.forwarding", "1"); err != nil {
+			return nil, nil, nil, newError(types.ErrInternal, "failed to enable IPv6 forwarding", err)
+		}
+	}
+
+	// Hand the devices off before creating them, as udev marks them unmanaged
+	// as they appear
+	if conf.Unmanaged {
+		if err := setupUnmanaged(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Setup the VLAN sub-interface the VTEP traffic leaves on
+	if conf.UnderlayVLAN != nil {
+		if err := setupUnderlayVLAN(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Probe the underlay for jumbo frames when the network is first set up
+	// on the node, rather than delaying every ADD
+	if conf.probesMTU() && !linkExists(l2Name(conf)) {
+		if err := probeMTU(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Setup VXLAN network
+	var vxlanIface *netlink.Vxlan
+	if conf.usesVxlan() {
+		vxlanConfig := &vxlan.VxlanConfig{
+			Name:          vxlanName(conf),
+			HostInterface: conf.HostInterface,
+			VxlanID:       conf.VxlanID,
+			MTU:           conf.MTU,
+			Port:          conf.VxlanPort,
+			TxQLen:        conf.TxQueueLen,
+			InheritTOS:    conf.InheritDSCP,
+			Flooding:      conf.floodMode(),
+		}
+		vxlanIface, err = vxlan.SetupVxlan(vxlanConfig)
+		if err != nil {
+			return nil, nil, nil, newError(ErrVxlanSetup, "failed to setup VXLAN", err)
+		}
+		if err := setupFlooding(conf, vxlanIface); err != nil {
+			return nil, nil, nil, err
+		}
+		if conf.Qdisc != "" {
+			if err := setQdisc(vxlanIface, conf.Qdisc); err != nil {
+				return nil, nil, nil, netlinkError("failed to tune VXLAN interface", err)
+			}
+		}
+		if err := offload.Apply(vxlanIface.Name, conf.vxlanOffloads()); err != nil {
+			return nil, nil, nil, netlinkError("failed to tune VXLAN interface", err)
+		}
+		if err := setProxyARP(conf, vxlanIface.Name, conf.vxlanProxyARP()); err != nil {
+			return nil, nil, nil, err
+		}
+		if conf.SourceRouting != nil {
+			if err := setupSourceRouting(conf); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	// Setup the host side of the overlay the containers attach to
+	var br *netlink.Bridge
+	var l2 netlink.Link
+	switch {
+	case conf.Mode == modeOVS:
+		l2, err = setupOVS(conf)
+	case conf.usesBridge():
+		// Standalone bridges have no uplink, which a nil *netlink.Vxlan
+		// wouldn't be as a netlink.Link
+		var uplink netlink.Link
+		if vxlanIface != nil {
+			uplink = vxlanIface
+		}
+		br, err = setupBridge(conf, uplink)
+		l2 = br
+	default:
+		l2, err = setupShim(conf, vxlanIface)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if conf.VRF != nil {
+		if err := joinVRF(conf, l2); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if conf.RouteTable != nil {
+		if err := setupRouteTable(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if err := setProxyARP(conf, l2.Attrs().Name, conf.bridgeProxyARP()); err != nil {
+		return nil, nil, nil, err
+	}
+	if conf.Tables != nil {
+		if err := setupTables(conf, br); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if conf.OpenFirewall != nil {
+		if err := setupVxlanOpening(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if err := setupFirewalldZone(conf); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Keep the peers' broadcast storms off the node's CPU
+	if conf.bumGuard() != nil {
+		if err := setupBUMGuard(conf); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Have the traffic of known MACs skip the bridge
+	if conf.fastPath() {
+		// A nil *netlink.Vxlan isn't a nil netlink.Link either
+		var uplink netlink.Link
+		if vxlanIface != nil {
+			uplink = vxlanIface
+		}
+		if err := setupFastPathUplink(conf, uplink); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return vxlanIface, br, l2, nil
+}
+
+// setupUnderlayVLAN creates hostInterface as VLAN sub-interface if it's
+// missing. It's left in place when the network is torn down, as other
+// networks may share the underlay.
+func setupUnderlayVLAN(conf *PluginConf) error {
+	v := conf.UnderlayVLAN
+	addr, err := netlink.ParseIPNet(v.Address)
+	if err != nil {
+		return configError("invalid underlayVLAN.address", err)
+	}
+	config := &vlan.Config{
+		Name:    conf.HostInterface,
+		Parent:  v.Parent,
+		ID:      v.ID,
+		MTU:     v.MTU,
+		Address: addr,
+	}
+	if _, err := vlan.Setup(config); err != nil {
+		return netlinkError("failed to setup underlay VLAN", err)
+	}
+	return nil
+}
+
+// joinVRF places the bridge or shim in the network's VRF, creating the VRF
+// if missing, so the routes to the containers live in its table rather than
+// the host's main table
+func joinVRF(conf *PluginConf, l2 netlink.Link) error {
+	v, err := vrf.Setup(conf.VRF.Name, conf.VRF.Table)
+	if err != nil {
+		return netlinkError("failed to setup VRF", err)
+	}
+	moved, err := vrf.Join(v, l2)
+	if err != nil {
+		return netlinkError("failed to add overlay to VRF", err)
+	}
+	if !moved {
+		return nil
+	}
+
+	// Joining cycles the device, which drops the IPv6 gateway address
+	for _, gateway := range gatewayAddrs(conf) {
+		addr := &netlink.Addr{IPNet: gateway}
+		if err := retry.Do(func() error { return netlink.AddrReplace(l2, addr) }); err != nil {
+			return netlinkError("failed to configure gateway", err)
+		}
+	}
+	return nil
+}
+
+// networkExists reports whether the devices shared by the network's
+// containers are already set up, judged by the bridge or shim
+func networkExists(conf *PluginConf) bool {
+	if conf.Mode == modeOVS {
+		exists, err := ovs.New(nil).BridgeExists(conf.OVS.Bridge)
+		return err != nil || exists
+	}
+	_, err := netlink.LinkByName(l2Name(conf))
+	return err == nil
+}
+
+// teardownNetwork restores the proxy ARP sysctls of the network's devices,
+// removes the devices shared by the network's containers, the VRF if no
+// other network uses it, and the network's nftables tables
+func teardownNetwork(conf *PluginConf) error {
+	if err := teardownProxyARP(conf); err != nil {
+		return err
+	}
+	switch {
+	case conf.Mode == modeOVS:
+		// The tunnel ports go with the bridge
+		if err := ovs.New(nil).DelBridge(conf.OVS.Bridge); err != nil {
+			return newError(types.ErrInternal, "failed to remove OVS bridge", err)
+		}
+	case conf.usesBridge():
+		if err := bridge.CleanupBridge(l2Name(conf)); err != nil {
+			return netlinkError("failed to remove bridge", err)
+		}
+	default:
+		if err := sublink.CleanupShim(l2Name(conf)); err != nil {
+			return netlinkError("failed to remove shim", err)
+		}
+	}
+	if conf.usesVxlan() {
+		if err := vxlan.CleanupVxlan(vxlanName(conf)); err != nil {
+			return netlinkError("failed to remove VXLAN interface", err)
+		}
+	}
+	if conf.VRF != nil {
+		if err := vrf.Cleanup(conf.VRF.Name); err != nil {
+			return netlinkError("failed to remove VRF", err)
+		}
+	}
+	if conf.RouteTable != nil {
+		if err := rtable.Cleanup(routeSelector(conf), routeRefs(conf)); err != nil {
+			return netlinkError("failed to remove routing table rules", err)
+		}
+	}
+	if conf.OpenFirewall != nil {
+		if err := teardownVxlanOpening(conf); err != nil {
+			return err
+		}
+	}
+	if err := teardownFirewalldZone(conf); err != nil {
+		return err
+	}
+	if err := teardownUnmanaged(conf); err != nil {
+		return err
+	}
+	if conf.AntiSpoofing && !conf.bpfAntiSpoofing() {
+		if err := antispoof.DeleteTable(antispoof.TableName(conf.VxlanID)); err != nil {
+			return newError(types.ErrInternal, "failed to remove anti-spoofing table", err)
+		}
+	}
+	// The tables of features turned off since are removed as well
+	if err := qos.DeleteTable(qos.TableName(conf.VxlanID)); err != nil {
+		return newError(types.ErrInternal, "failed to remove DSCP marking table", err)
+	}
+	if conf.Policy != nil {
+		if err := policy.DeleteTable(policy.TableName(conf.VxlanID)); err != nil {
+			return newError(types.ErrInternal, "failed to remove network policy table", err)
+		}
+	}
+	if err := policy.DeleteTable(policy.PortsTableName(conf.VxlanID)); err != nil {
+		return newError(types.ErrInternal, "failed to remove ingress port allowlist table", err)
+	}
+	if err := policy.DeleteEgressTable(policy.EgressTableName(conf.VxlanID)); err != nil {
+		return newError(types.ErrInternal, "failed to remove egress rules table", err)
+	}
+	if conf.bumGuard() != nil {
+		if err := teardownBUMGuard(conf); err != nil {
+			return err
+		}
+	}
+	if conf.EBPF != nil {
+		if err := removeBPFMaps(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnusedNetwork removes the shared devices a failed ADD set up, unless
+// another container got an address on the network in the meantime. Like
+// all undoing, it isn't bound by the command's deadline.
+func removeUnusedNetwork(conf *PluginConf) error {
+	unlock, err := lockNetwork(context.Background(), conf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return err
+	}
+	for _, ipamInstance := range ipams {
+		if ipamInstance.Count() > 0 {
+			return nil // Still in use
+		}
+	}
+	return teardownNetwork(conf)
+}
+
+// deleteHostLinks deletes the host-side interfaces of the attachment still
+// left, such as the host veth of a container whose namespace the runtime
+// didn't pass, and returns their MAC addresses. VF representors belong to the
+// host and are only released.
+func deleteHostLinks(args *skel.CmdArgs) ([]net.HardwareAddr, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, netlinkError("failed to list links", err)
+	}
+	var macs []net.HardwareAddr
+	for _, link := range links {
+		if !ownedBy(link.Attrs().Alias, args.ContainerID, args.IfName) {
+			continue
+		}
+		if link.Type() == "device" {
+			if err := releaseRepresentor(link); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		macs = append(macs, link.Attrs().HardwareAddr)
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, netlinkError(fmt.Sprintf("failed to delete host interface %s", link.Attrs().Name), err)
+		}
+	}
+	return macs, nil
+}
+
+// reclaimContainerIface makes room for the container interface when a
+// retried ADD finds the one an earlier attempt of the attachment left behind:
+// it is removed along with its host side, keeping the addresses, and set up
+// again. It's recreated rather than adopted because nothing records how far
+// the earlier attempt got: the host side may be unattached, or the
+// addresses, routes and sysctls partly applied, and ADD sets the interface
+// up from scratch. Its MAC may change with it, unless requested, but the
+// earlier attempt failed, so the runtime never got a result holding the old
+// one, whose forwarding entries are pruned. An interface of that name the
+// attachment doesn't own may still be on its way out, e.g. while the
+// runtime cleans up another attachment, so the runtime is asked to try
+// again later.
+func reclaimContainerIface(conf *PluginConf, args *skel.CmdArgs, netns ns.NetNS, contHandle *netlink.Handle, held []bool) error {
+	existing, err := contHandle.LinkByName(args.IfName)
+	if err != nil {
+		return nil
+	}
+	owned, err := ownsContainerIface(conf, args, existing, held)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return newError(types.ErrTryAgainLater, fmt.Sprintf("interface %s already exists in the container namespace", args.IfName), nil)
+	}
+
+	if conf.Mode == modeSRIOV {
+		if err := sriov.Release(args.IfName, netns); err != nil {
+			return netlinkError("failed to release VF", err)
+		}
+	} else {
+		if err := contHandle.LinkDel(existing); err != nil {
+			return netlinkError("failed to delete container interface", err)
+		}
+	}
+	macs, err := deleteHostLinks(args)
+	if err != nil {
+		return err
+	}
+	return pruneNeighbors(conf, append(macs, existing.Attrs().HardwareAddr), nil)
+}
+
+// ownsContainerIface reports whether the container interface was set up by
+// an earlier ADD of the attachment: a veth whose peer or a VF whose
+// representor carries the attachment's alias, or a macvlan or ipvlan
+// interface of an attachment holding addresses
+func ownsContainerIface(conf *PluginConf, args *skel.CmdArgs, link netlink.Link, held []bool) (bool, error) {
+	if !conf.usesBridge() && conf.Mode != modeOVS {
+		for _, h := range held {
+			if h {
+				return link.Type() == conf.Mode, nil
+			}
+		}
+		return false, nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return false, netlinkError("failed to list links", err)
+	}
+	for _, hostLink := range links {
+		if !ownedBy(hostLink.Attrs().Alias, args.ContainerID, args.IfName) {
+			continue
+		}
+		switch hostLink.Type() {
+		case "veth":
+			if link.Type() == "veth" && link.Attrs().ParentIndex == hostLink.Attrs().Index {
+				return true, nil
+			}
+		case "device":
+			if conf.Mode == modeSRIOV {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// pruneNeighbors removes the FDB and neighbor entries of released MACs and
+// addresses from the network's shared devices, so they don't point a new
+// container reusing an address at the old one
+func pruneNeighbors(conf *PluginConf, macs []net.HardwareAddr, ips []net.IP) error {
+	names := []string{l2Name(conf)}
+	if conf.usesBridge() && conf.usesVxlan() {
+		names = append(names, vxlanName(conf))
+	}
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue // Already removed
+		}
+		if err := vxlan.PruneNeighbors(link, macs, ips); err != nil {
+			return netlinkError("failed to prune neighbor entries", err)
+		}
+	}
+	return nil
+}
+
+// setupBridge sets up the overlay bridge with the VXLAN interface, if any,
+// as uplink port and the gateway addresses assigned
+func setupBridge(conf *PluginConf, vxlanIface netlink.Link) (*netlink.Bridge, error) {
+	bridgeConfig := &bridge.BridgeConfig{
+		Name: l2Name(conf),
+		MTU:  conf.MTU,
+	}
+	br, err := bridge.SetupBridge(bridgeConfig)
+	if err != nil {
+		return nil, netlinkError("failed to setup bridge", err)
+	}
+	if vxlanIface != nil {
+		if err := bridge.AddPort(br, vxlanIface); err != nil {
+			return nil, netlinkError("failed to connect VXLAN to bridge", err)
+		}
+	}
+	if conf.VLANFiltering {
+		if err := enableVLANFiltering(br, vxlanIface); err != nil {
+			return nil, err
+		}
+	}
+	if conf.PromiscMode {
+		if err := netlink.SetPromiscOn(br); err != nil {
+			return nil, netlinkError("failed to set bridge promiscuous", err)
+		}
+	}
+
+	// Assign gateway addresses to the bridge
+	for _, gateway := range gatewayAddrs(conf) {
+		if err := bridge.ConfigureGateway(br, gateway); err != nil {
+			return nil, netlinkError("failed to configure gateway", err)
+		}
+	}
+
+	return br, nil
+}
+
+// createVeth creates the veth pair from the host namespace, with the
+// requested MAC on the container end, and returns the host and container
+// ends. The container end is configured along with its addresses.
+func createVeth(conf *PluginConf, args *skel.CmdArgs, mac string, netns ns.NetNS, contHandle *netlink.Handle, undo *rollback) (net.Interface, net.Interface, netlink.Link, error) {
+	hostVethName, err := renderVethName(conf.VethNameTemplate, args.ContainerID, args.IfName)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, nil, configError("failed to name host veth", err)
+	}
+	hostLink, containerVeth, err := setupVeth(conf, args.IfName, hostVethName, mac, netns, contHandle)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, nil, netlinkError("failed to setup veth pair", err)
+	}
+	// Deleting the host end deletes the container end as well
+	hostVethName = hostLink.Attrs().Name
+	undo.add(func() error { return deleteLink(hostVethName) })
+
+	if err := netlink.LinkSetUp(hostLink); err != nil {
+		return net.Interface{}, net.Interface{}, nil, netlinkError("failed to set host veth up", err)
+	}
+	hostVeth := linkInterface(hostLink)
+	if conf.Qdisc != "" {
+		if err := setQdisc(hostLink, conf.Qdisc); err != nil {
+			return net.Interface{}, net.Interface{}, nil, netlinkError("failed to tune host veth", err)
+		}
+	}
+	if err := setVethOffloads(conf, hostVeth.Name); err != nil {
+		return net.Interface{}, net.Interface{}, nil, err
+	}
+
+	// Tag host veth so GC can tell which attachment owns it, and operators
+	// which workload
+	if err := tagHostLink(hostLink, conf, args, true); err != nil {
+		return net.Interface{}, net.Interface{}, nil, netlinkError("failed to set host veth alias", err)
+	}
+
+	return hostVeth, containerVeth, hostLink, nil
+}
+
+// attachVeth connects the container to the bridge through a veth pair and
+// returns the host and container ends
+func attachVeth(conf *PluginConf, args *skel.CmdArgs, br *netlink.Bridge, mac string, netns ns.NetNS, contHandle *netlink.Handle, undo *rollback) (net.Interface, net.Interface, error) {
+	hostVeth, containerVeth, hostLink, err := createVeth(conf, args, mac, netns, contHandle, undo)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, err
+	}
+
+	// Connect host veth to the overlay bridge
+	if err := bridge.AddPort(br, hostLink); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to connect host veth to bridge", err)
+	}
+	if err := netlink.LinkSetHairpin(hostLink, conf.HairpinMode); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to set hairpin mode on host veth", err)
+	}
+	if err := setPortVLAN(conf, br, hostLink); err != nil {
+		return net.Interface{}, net.Interface{}, err
+	}
+
+	return hostVeth, containerVeth, nil
+}
+
+// attachTap creates a persistent tap device on the overlay bridge for a VM
+// runtime to open
+func attachTap(conf *PluginConf, args *skel.CmdArgs, br *netlink.Bridge, undo *rollback) (net.Interface, error) {
+	name, err := vmPortName(conf, args.ContainerID, args.IfName)
+	if err != nil {
+		return net.Interface{}, configError("failed to name tap device", err)
+	}
+
+	// Reuse the tap if a previous ADD already created it
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.NewLinkAttrs(),
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+		}
+		tap.Name = name
+		if conf.vethQueues() > 1 {
+			tap.Queues = conf.vethQueues()
+			tap.Flags |= netlink.TUNTAP_MULTI_QUEUE
+		}
+		if err := retry.Do(func() error { return netlink.LinkAdd(tap) }); err != nil {
+			return net.Interface{}, netlinkError(fmt.Sprintf("failed to create tap device %s", name), err)
+		}
+		undo.add(func() error { return deleteLink(name) })
+		// The device persists, the VM runtime opens its own queues
+		for _, fd := range tap.Fds {
+			fd.Close()
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return net.Interface{}, netlinkError("failed to get tap device", err)
+		}
+	} else if link.Type() != "tuntap" {
+		return net.Interface{}, configError(fmt.Sprintf("interface %s already exists but is not a tap device", name), nil)
+	}
+
+	// Apply link attributes, which can't be set on creation
+	if err := netlink.LinkSetMTU(link, conf.linkMTU()); err != nil {
+		return net.Interface{}, netlinkError("failed to set tap MTU", err)
+	}
+	if conf.TxQueueLen > 0 {
+		if err := netlink.LinkSetTxQLen(link, conf.TxQueueLen); err != nil {
+			return net.Interface{}, netlinkError("failed to set tap transmit queue length", err)
+		}
+	}
+
+	// Connect the tap to the overlay bridge
+	if err := bridge.AddPort(br, link); err != nil {
+		return net.Interface{}, netlinkError("failed to connect tap to bridge", err)
+	}
+	if err := netlink.LinkSetHairpin(link, conf.HairpinMode); err != nil {
+		return net.Interface{}, netlinkError("failed to set hairpin mode on tap", err)
+	}
+	if err := setPortVLAN(conf, br, link); err != nil {
+		return net.Interface{}, err
+	}
+	if conf.Qdisc != "" {
+		if err := setQdisc(link, conf.Qdisc); err != nil {
+			return net.Interface{}, netlinkError("failed to tune tap", err)
+		}
+	}
+	if err := tagHostLink(link, conf, args, true); err != nil {
+		return net.Interface{}, netlinkError("failed to set tap alias", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return net.Interface{}, netlinkError("failed to set tap up", err)
+	}
+
+	return linkInterface(link), nil
+}
+
+// attachSRIOV moves the VF allocated to the container into its namespace and
+// connects the VF's representor to the overlay bridge. It returns the
+// representor and the container interface.
+func attachSRIOV(conf *PluginConf, args *skel.CmdArgs, br *netlink.Bridge, mac string, netns ns.NetNS, undo *rollback) (net.Interface, net.Interface, error) {
+	var hwAddr net.HardwareAddr
+	if mac != "" {
+		var err error
+		hwAddr, err = net.ParseMAC(mac)
+		if err != nil {
+			return net.Interface{}, net.Interface{}, configError(fmt.Sprintf("invalid MAC address %q", mac), err)
+		}
+	}
+
+	vf, err := sriov.LookupVF(conf.RuntimeConfig.DeviceID)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, configError("failed to look up VF", err)
+	}
+	switchdev, err := sriov.IsSwitchdev(vf)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to get eswitch mode", err)
+	}
+	if !switchdev {
+		return net.Interface{}, net.Interface{}, configError(fmt.Sprintf("physical function %s must be in switchdev mode", vf.PF), nil)
+	}
+
+	// Connect the representor to the overlay bridge
+	repName, err := sriov.Representor(vf)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, newError(types.ErrInternal, "failed to find VF representor", err)
+	}
+	rep, err := netlink.LinkByName(repName)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to get VF representor", err)
+	}
+	if err := netlink.LinkSetMTU(rep, conf.linkMTU()); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to set representor MTU", err)
+	}
+	if err := bridge.AddPort(br, rep); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to connect representor to bridge", err)
+	}
+	undo.add(func() error { return releaseRepresentor(rep) })
+	if err := netlink.LinkSetHairpin(rep, conf.HairpinMode); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to set hairpin mode on representor", err)
+	}
+	if err := setPortVLAN(conf, br, rep); err != nil {
+		return net.Interface{}, net.Interface{}, err
+	}
+	if conf.Qdisc != "" {
+		if err := setQdisc(rep, conf.Qdisc); err != nil {
+			return net.Interface{}, net.Interface{}, netlinkError("failed to tune representor", err)
+		}
+	}
+	// The representor belongs to the host, which may name it as it likes
+	if err := tagHostLink(rep, conf, args, false); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to set representor alias", err)
+	}
+	if err := netlink.LinkSetUp(rep); err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to set representor up", err)
+	}
+
+	containerIface, err := sriov.Attach(vf, args.IfName, conf.linkMTU(), hwAddr, netns)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, netlinkError("failed to move VF into container", err)
+	}
+	undo.add(func() error { return sriov.Release(args.IfName, netns) })
+	return linkInterface(rep), containerIface, nil
+}
+
+// releaseVF returns the attachment's VF to the host and disconnects its
+// representor from the overlay bridge
+func releaseVF(conf *PluginConf, args *skel.CmdArgs) error {
+	// The VF returns to the host on its own once the namespace is gone
+	if netns, err := ns.GetNS(args.Netns); err == nil {
+		defer netns.Close()
+		if err := sriov.Release(args.IfName, netns); err != nil {
+			return netlinkError("failed to release VF", err)
+		}
+	}
+
+	// Nothing left to do if the VF is gone as well
+	vf, err := sriov.LookupVF(conf.RuntimeConfig.DeviceID)
+	if err != nil {
+		return nil
+	}
+	repName, err := sriov.Representor(vf)
+	if err != nil {
+		return nil
+	}
+	rep, err := netlink.LinkByName(repName)
+	if err != nil || !ownedBy(rep.Attrs().Alias, args.ContainerID, args.IfName) {
+		return nil
+	}
+	return releaseRepresentor(rep)
+}
+
+// releaseRepresentor disconnects a VF representor from the overlay bridge
+// and restores its default qdisc
+func releaseRepresentor(rep netlink.Link) error {
+	if err := clearQdisc(rep); err != nil {
+		return netlinkError("failed to reset representor qdisc", err)
+	}
+	if err := netlink.LinkSetNoMaster(rep); err != nil {
+		return netlinkError("failed to disconnect representor from bridge", err)
+	}
+	if err := netlink.LinkSetAlias(rep, ""); err != nil {
+		return netlinkError("failed to clear representor alias", err)
+	}
+	return nil
+}
+
+// setupShim sets up the host shim next to the containers in macvlan and
+// ipvlan mode, with the gateway addresses assigned
+func setupShim(conf *PluginConf, vxlanIface netlink.Link) (netlink.Link, error) {
+	shim, err := sublink.SetupShim(&sublink.LinkConfig{
+		Mode:   conf.Mode,
+		Parent: vxlanIface,
+		Name:   l2Name(conf),
+		MTU:    conf.MTU,
+	})
+	if err != nil {
+		return nil, netlinkError("failed to setup shim", err)
+	}
+
+	// Assign gateway addresses to the shim
+	for _, gateway := range gatewayAddrs(conf) {
+		if err := sublink.ConfigureGateway(shim, gateway); err != nil {
+			return nil, netlinkError("failed to configure gateway", err)
+		}
+	}
+
+	return shim, nil
+}
+
+// attachSublink creates the container interface as a macvlan or ipvlan child
+// of the VXLAN interface
+func attachSublink(conf *PluginConf, args *skel.CmdArgs, vxlanIface netlink.Link, mac string, netns ns.NetNS, undo *rollback) (net.Interface, error) {
+	var hwAddr net.HardwareAddr
+	if mac != "" {
+		var err error
+		hwAddr, err = net.ParseMAC(mac)
+		if err != nil {
+			return net.Interface{}, configError(fmt.Sprintf("invalid MAC address %q", mac), err)
+		}
+		if conf.Mode == sublink.ModeIPvlan {
+			return net.Interface{}, configError("a MAC address can't be requested in ipvlan mode", nil)
+		}
+	}
+
+	iface, err := sublink.Create(&sublink.LinkConfig{
+		Mode:         conf.Mode,
+		Parent:       vxlanIface,
+		Name:         args.IfName,
+		MTU:          conf.linkMTU(),
+		HardwareAddr: hwAddr,
+	}, netns)
+	if err != nil {
+		return net.Interface{}, netlinkError(fmt.Sprintf("failed to setup %s interface", conf.Mode), err)
+	}
+	undo.add(func() error {
+		return netns.Do(func(ns.NetNS) error { return deleteLink(args.IfName) })
+	})
+	return iface, nil
+}
+
+// setupOVS sets up the OVS bridge with a VXLAN tunnel port to every peer and
+// the gateway addresses assigned to its internal interface
+func setupOVS(conf *PluginConf) (netlink.Link, error) {
+	client := ovs.New(nil)
+	if err := client.SetupBridge(conf.OVS.Bridge, conf.OVS.DatapathType); err != nil {
+		return nil, newError(types.ErrInternal, "failed to setup OVS bridge", err)
+	}
+
+	// Connect the bridge to the other hosts
+	localIP, err := vxlan.LocalIP(conf.HostInterface)
+	if err != nil {
+		return nil, newError(ErrVxlanSetup, "failed to setup VXLAN", err)
+	}
+	for _, peer := range conf.OVS.Peers {
+		if err := client.AddVxlanPort(conf.OVS.Bridge, conf.VxlanID, conf.VxlanPort, localIP, net.ParseIP(peer)); err != nil {
+			return nil, newError(ErrVxlanSetup, "failed to setup VXLAN", err)
+		}
+	}
+
+	// Assign gateway addresses to the bridge's internal interface
+	link, err := netlink.LinkByName(conf.OVS.Bridge)
+	if err != nil {
+		return nil, netlinkError("failed to get OVS bridge interface", err)
+	}
+	if err := netlink.LinkSetMTU(link, conf.MTU); err != nil {
+		return nil, netlinkError("failed to set OVS bridge MTU", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, netlinkError("failed to set OVS bridge up", err)
+	}
+	for _, gateway := range gatewayAddrs(conf) {
+		addr := &netlink.Addr{IPNet: gateway}
+		if err := retry.Do(func() error { return netlink.AddrReplace(link, addr) }); err != nil {
+			return nil, netlinkError("failed to configure gateway", err)
+		}
+	}
+
+	return link, nil
+}
+
+// attachOVSVeth connects the container to the OVS bridge through a veth pair
+// and returns the host and container ends
+func attachOVSVeth(conf *PluginConf, args *skel.CmdArgs, mac string, netns ns.NetNS, contHandle *netlink.Handle, undo *rollback) (net.Interface, net.Interface, error) {
+	hostVeth, containerVeth, _, err := createVeth(conf, args, mac, netns, contHandle, undo)
+	if err != nil {
+		return net.Interface{}, net.Interface{}, err
+	}
+
+	// Connect host veth to the OVS bridge
+	key := attachmentKey(args.ContainerID, args.IfName)
+	if err := ovs.New(nil).AddPort(conf.OVS.Bridge, hostVeth.Name, key); err != nil {
+		return net.Interface{}, net.Interface{}, newError(types.ErrInternal, "failed to connect host veth to OVS bridge", err)
+	}
+	undo.add(func() error { return detachOVS(conf, args) })
+
+	return hostVeth, containerVeth, nil
+}
+
+// attachVhostUser adds a vhost-user port for a DPDK-backed VM and returns it
+// together with the socket the VM is expected to create
+func attachVhostUser(conf *PluginConf, args *skel.CmdArgs, undo *rollback) (net.Interface, string, error) {
+	name, err := vmPortName(conf, args.ContainerID, args.IfName)
+	if err != nil {
+		return net.Interface{}, "", configError("failed to name vhost-user port", err)
+	}
+	if err := os.MkdirAll(conf.OVS.SocketDir, 0755); err != nil {
+		return net.Interface{}, "", newError(types.ErrInternal, "failed to create vhost-user socket directory", err)
+	}
+
+	path := socketPath(conf, name)
+	key := attachmentKey(args.ContainerID, args.IfName)
+	if err := ovs.New(nil).AddVhostUserPort(conf.OVS.Bridge, name, path, key); err != nil {
+		return net.Interface{}, "", newError(types.ErrInternal, "failed to add vhost-user port", err)
+	}
+	undo.add(func() error { return detachOVS(conf, args) })
+
+	return net.Interface{Name: name}, path, nil
+}
+
+// detachOVS removes the attachment's port from the OVS bridge, along with
+// the socket of a vhost-user port
+func detachOVS(conf *PluginConf, args *skel.CmdArgs) error {
+	client := ovs.New(nil)
+	if exists, err := client.BridgeExists(conf.OVS.Bridge); err != nil || !exists {
+		return err
+	}
+	port, err := client.FindPort(conf.OVS.Bridge, attachmentKey(args.ContainerID, args.IfName))
+	if err != nil || port == "" {
+		return err
+	}
+	if err := client.DelPort(conf.OVS.Bridge, port); err != nil {
+		return err
+	}
+	if conf.OVS.VhostUser {
+		if err := os.Remove(socketPath(conf, port)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,608 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/nohns/xvm-cni/pkg/antispoof"
+	"github.com/nohns/xvm-cni/pkg/bumguard"
+	"github.com/nohns/xvm-cni/pkg/fastpath"
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/netmgr"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/policy"
+	"github.com/nohns/xvm-cni/pkg/qos"
+	"github.com/nohns/xvm-cni/pkg/rtable"
+	"github.com/nohns/xvm-cni/pkg/sublink"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// dryRunEnv enables dry-run mode for a single invocation, like the dryRun
+// configuration field
+const dryRunEnv = "XVM_CNI_DRY_RUN"
+
+// operation is a change ADD would make to the host or the container
+type operation struct {
+	Action string            `json:"action"`
+	Target string            `json:"target"`
+	Netns  string            `json:"netns,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// plan lists the changes ADD would make, in order
+type plan struct {
+	DryRun     bool         `json:"dryRun"`
+	Operations []*operation `json:"operations"`
+}
+
+// add appends an operation on the host to the plan
+func (p *plan) add(action, target string, params map[string]string) *operation {
+	op := &operation{Action: action, Target: target, Params: params}
+	p.Operations = append(p.Operations, op)
+	return op
+}
+
+// dryRun reports whether ADD should only print the changes it would make
+func (c *PluginConf) dryRun() bool {
+	if c.DryRun {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(os.Getenv(dryRunEnv))
+	return enabled
+}
+
+// printPlan writes the plan to stdout in place of the CNI result
+func printPlan(p *plan) error {
+	data, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return newError(types.ErrInternal, "failed to marshal dry-run plan", err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout, string(data)); err != nil {
+		return newError(types.ErrIOFailure, "failed to write dry-run plan", err)
+	}
+	return nil
+}
+
+// planAdd computes the changes ADD would make for the attachment, in the
+// order it makes them, without touching the kernel or saving allocations
+func planAdd(conf *PluginConf, args *skel.CmdArgs, envArgs *EnvArgs, pod *k8s.Pod, result *current.Result, mac string) (*plan, error) {
+	p := &plan{DryRun: true}
+	planHook(p, conf, hookPreAdd)
+
+	// Forwarding
+	p.add("set-sysctl", "net.ipv4.ip_forward", map[string]string{"value": "1"})
+	if conf.IPv6Subnet != "" {
+		p.add("set-sysctl", "net.ipv6.conf.all.forwarding", map[string]string{"value": "1"})
+	}
+
+	// Network managers' hand-off, if outdated
+	if conf.Unmanaged {
+		patterns := unmanagedPatterns(conf)
+		stale := make(map[string]bool)
+		for _, path := range netmgr.Stale(conf.Name, patterns) {
+			stale[path] = true
+		}
+		for _, f := range netmgr.Files(conf.Name, patterns) {
+			if stale[f.Path] {
+				p.add("write-file", f.Path, map[string]string{"manager": f.Manager, "devices": strings.Join(patterns, ",")})
+			}
+		}
+	}
+
+	// Underlay VLAN sub-interface, if missing
+	if v := conf.UnderlayVLAN; v != nil && !linkExists(conf.HostInterface) {
+		params := map[string]string{"kind": "vlan", "parent": v.Parent, "id": strconv.Itoa(v.ID)}
+		if v.MTU != 0 {
+			params["mtu"] = strconv.Itoa(v.MTU)
+		}
+		p.add("create-link", conf.HostInterface, params)
+		p.add("add-address", conf.HostInterface, map[string]string{"address": v.Address})
+	}
+
+	// Underlay path MTU probe
+	if conf.probesMTU() && !linkExists(l2Name(conf)) {
+		p.add("probe-mtu", conf.HostInterface, map[string]string{
+			"peers": strings.Join(conf.MTUProbe.Peers, ","),
+			"size":  strconv.Itoa(conf.MTU + vxlan.Overhead),
+		})
+	}
+
+	// VXLAN interface
+	vx := vxlanName(conf)
+	if conf.usesVxlan() {
+		txQLen := conf.TxQueueLen
+		if txQLen == 0 {
+			txQLen = vxlan.DefaultTxQLen
+		}
+		params := map[string]string{
+			"kind":       "vxlan",
+			"vni":        strconv.Itoa(conf.VxlanID),
+			"port":       strconv.Itoa(conf.VxlanPort),
+			"dev":        conf.HostInterface,
+			"mtu":        strconv.Itoa(conf.MTU),
+			"txQueueLen": strconv.Itoa(txQLen),
+		}
+		if conf.InheritDSCP {
+			params["tos"] = "inherit"
+		}
+		params["flooding"] = conf.floodMode()
+		p.add("create-link", vx, params)
+		for _, peer := range conf.floodPeers() {
+			p.add("add-flood-entry", vx, map[string]string{"remote": peer.String()})
+		}
+		planQdisc(p, conf, vx)
+		planOffloads(p, vx, conf.vxlanOffloads())
+		planProxyARP(p, vx, conf.vxlanProxyARP())
+		if conf.SourceRouting != nil {
+			planSourceRouting(p, conf)
+		}
+	}
+
+	// Host side of the overlay
+	l2 := l2Name(conf)
+	switch {
+	case conf.Mode == modeOVS:
+		params := map[string]string{}
+		if conf.OVS.DatapathType != "" {
+			params["datapathType"] = conf.OVS.DatapathType
+		}
+		p.add("ovs-add-bridge", l2, params)
+		for _, peer := range conf.OVS.Peers {
+			p.add("ovs-add-port", conf.OVS.Bridge, map[string]string{
+				"port":   ovs.VxlanPortName(conf.VxlanID, net.ParseIP(peer)),
+				"type":   "vxlan",
+				"key":    strconv.Itoa(conf.VxlanID),
+				"remote": peer,
+			})
+		}
+	case conf.usesBridge():
+		p.add("create-link", l2, map[string]string{"kind": "bridge", "mtu": strconv.Itoa(conf.MTU)})
+		if conf.usesVxlan() {
+			p.add("set-master", vx, map[string]string{"master": l2})
+		}
+		if conf.VLANFiltering {
+			params := map[string]string{}
+			if conf.usesVxlan() {
+				params["trunk"] = vx
+			}
+			p.add("set-vlan-filtering", l2, params)
+		}
+		if conf.PromiscMode {
+			p.add("set-promisc", l2, nil)
+		}
+	default:
+		p.add("create-link", l2, map[string]string{"kind": conf.Mode, "parent": vx, "mtu": strconv.Itoa(conf.MTU)})
+	}
+	if conf.VRF != nil {
+		// Reused if it exists
+		p.add("create-link", conf.VRF.Name, map[string]string{"kind": "vrf", "table": strconv.FormatUint(uint64(conf.VRF.Table), 10)})
+		p.add("set-master", l2, map[string]string{"master": conf.VRF.Name})
+	}
+	if conf.RouteTable != nil {
+		// Existing rules are kept
+		for _, r := range routeSelector(conf).Rules() {
+			p.add("add-rule", rtable.Describe(r), map[string]string{"priority": strconv.Itoa(r.Priority)})
+		}
+	}
+	for _, gateway := range gatewayAddrs(conf) {
+		p.add("add-address", l2, map[string]string{"address": gateway.String()})
+	}
+	planProxyARP(p, l2, conf.bridgeProxyARP())
+	if conf.Tables != nil {
+		planTables(p, conf)
+	}
+	if conf.OpenFirewall != nil {
+		backend, err := firewall(conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range backend.VxlanOpeningRules(conf.Name, vxlanOpening(conf)) {
+			p.add("add-firewall-rule", rule.Chain, map[string]string{
+				"backend": backend.Name(),
+				"table":   rule.Table,
+				"rule":    strings.Join(rule.Spec, " "),
+			})
+		}
+	}
+	if conf.usesFirewalld() {
+		// Sources bound already are kept
+		for _, subnet := range networkSubnets(conf) {
+			p.add("add-firewalld-source", conf.firewalldZone(), map[string]string{"source": subnet.String()})
+		}
+	}
+	if conf.fastPath() || conf.bpfAntiSpoofing() {
+		p.add("pin-bpf-maps", bpfDir(conf), nil)
+	}
+	if g := conf.bumGuard(); g != nil {
+		p.add("attach-xdp", conf.HostInterface, map[string]string{
+			"program": bumguard.ProgramName,
+			"vni":     strconv.Itoa(conf.VxlanID),
+			"rate":    strconv.Itoa(g.limit().Rate),
+			"burst":   strconv.Itoa(g.limit().Burst),
+		})
+	}
+	if conf.fastPath() && conf.usesVxlan() {
+		p.add("attach-bpf", vx, map[string]string{"program": fastpath.UplinkFilter, "hook": "ingress"})
+	}
+
+	// Addresses
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := pinnedIPs(pod, args.IfName)
+	if err != nil {
+		return nil, err
+	}
+	restrictToNamespace(conf, ipams, envArgs.owner().PodNamespace)
+	key := attachmentKey(args.ContainerID, args.IfName)
+	containerIPs, err := previewIPs(ipams, key, requestedIPs(conf, envArgs, pinned))
+	if err != nil {
+		return nil, err
+	}
+	for _, ipc := range containerIPs {
+		p.add("allocate-ip", key, map[string]string{"address": ipc.Address.String()})
+	}
+	if conf.IPMasq {
+		backend, err := firewall(conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipamInstance := range ipams {
+			for _, rule := range backend.MasqueradeRules(conf.Name, ipamInstance.Subnet) {
+				p.add("add-firewall-rule", rule.Chain, map[string]string{
+					"backend": backend.Name(),
+					"table":   rule.Table,
+					"rule":    strings.Join(rule.Spec, " "),
+				})
+			}
+		}
+	}
+	if len(conf.RuntimeConfig.PortMappings) > 0 {
+		backend, err := firewall(conf)
+		if err != nil {
+			return nil, err
+		}
+		mappings := portMappings(conf, containerIPs)
+		for _, rule := range backend.PortMappingRules(conf.Name, key, mappings) {
+			p.add("add-firewall-rule", rule.Chain, map[string]string{
+				"backend": backend.Name(),
+				"table":   rule.Table,
+				"rule":    strings.Join(rule.Spec, " "),
+			})
+		}
+		if fw.NeedsLoopbackRouting(mappings) {
+			for _, rule := range backend.LoopbackGuardRules(conf.Name, l2Name(conf)) {
+				p.add("add-firewall-rule", rule.Chain, map[string]string{
+					"backend": backend.Name(),
+					"table":   rule.Table,
+					"rule":    strings.Join(rule.Spec, " "),
+				})
+			}
+			p.add("set-sysctl", fmt.Sprintf("net.ipv4.conf.%s.route_localnet", l2Name(conf)), map[string]string{"value": "1"})
+		}
+	}
+	if len(conf.EgressRules) > 0 {
+		p.add("add-nft-chain", policy.EgressChain, map[string]string{
+			"table":  policy.EgressTableName(conf.VxlanID),
+			"device": l2Name(conf),
+			"rules":  strconv.Itoa(len(conf.EgressRules)),
+		})
+	}
+
+	// Container interface
+	if mac != "" && !conf.hasSandbox() {
+		return nil, configError("a MAC address can't be requested without a container namespace", nil)
+	}
+	if err := planAttach(p, conf, args, mac); err != nil {
+		return nil, err
+	}
+	if conf.bpfAntiSpoofing() {
+		p.add("attach-bpf", key, map[string]string{"program": antispoof.Filter, "hook": "ingress"})
+	} else if conf.AntiSpoofing {
+		p.add("add-nft-chain", antispoof.ChainName(key), map[string]string{
+			"table":      antispoof.TableName(conf.VxlanID),
+			"attachment": key,
+		})
+	}
+	if dscp := conf.dscp(); dscp != nil {
+		p.add("add-nft-chain", qos.ChainName(key), map[string]string{
+			"table":      qos.TableName(conf.VxlanID),
+			"attachment": key,
+			"dscp":       strconv.Itoa(*dscp),
+		})
+	}
+	if conf.Policy != nil {
+		ingress, egress := policy.ChainNames(key)
+		for _, chain := range []string{ingress, egress} {
+			p.add("add-nft-chain", chain, map[string]string{
+				"table":      policy.TableName(conf.VxlanID),
+				"attachment": key,
+			})
+		}
+	}
+	if ports := conf.allowedIngressPorts(); len(ports) > 0 {
+		ingress, _ := policy.ChainNames(key)
+		p.add("add-nft-chain", ingress, map[string]string{
+			"table":      policy.PortsTableName(conf.VxlanID),
+			"attachment": key,
+			"ports":      strings.Join(ports, ","),
+		})
+	}
+	if conf.installsHostRoutes() {
+		for _, ipc := range containerIPs {
+			params := map[string]string{"dst": hostRouteDst(ipc.Address.IP).String()}
+			if conf.RouteTable != nil {
+				params["table"] = strconv.Itoa(conf.routeTable())
+			}
+			p.add("add-route", hostRouteLinkName(conf), params)
+		}
+	}
+	if conf.NDPProxy {
+		p.add("set-sysctl", fmt.Sprintf("net.ipv6.conf.%s.proxy_ndp", conf.HostInterface), map[string]string{"value": "1"})
+		for _, ipc := range containerIPs {
+			if ipc.Address.IP.To4() == nil {
+				p.add("add-neigh-proxy", conf.HostInterface, map[string]string{"address": ipc.Address.IP.String()})
+			}
+		}
+	}
+	if !conf.hasSandbox() {
+		planRouterAdvertisement(p, conf)
+		return p, nil
+	}
+
+	// Container configuration
+	inNetns := func(op *operation) { op.Netns = args.Netns }
+	if conf.DisableIPv6 {
+		inNetns(p.add("set-sysctl", "net/ipv6/conf/"+args.IfName+"/disable_ipv6", map[string]string{"value": "1"}))
+	}
+	sysctls := conf.containerSysctls()
+	names := make([]string, 0, len(sysctls))
+	for name := range sysctls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		inNetns(p.add("set-sysctl", name, map[string]string{"value": sysctls[name]}))
+	}
+	if conf.RouterAdvertisements != nil {
+		sysctls := raSysctls(conf, args.IfName)
+		for _, name := range []string{fmt.Sprintf("net.ipv6.conf.%s.accept_ra", args.IfName), fmt.Sprintf("net.ipv6.conf.%s.autoconf", args.IfName)} {
+			inNetns(p.add("set-sysctl", name, map[string]string{"value": sysctls[name]}))
+		}
+	}
+	for _, ipc := range containerIPs {
+		inNetns(p.add("add-address", args.IfName, map[string]string{"address": ipc.Address.String()}))
+	}
+	inNetns(p.add("set-link-up", args.IfName, nil))
+	gateway := net.ParseIP(conf.Gateway)
+	if dr := conf.defaultRoute(); !dr.Disabled && (dr.Metric != 0 || !hasDefaultRoute(result, false)) {
+		// Skipped as well if another attachment already installed one
+		params := map[string]string{"dst": "default", "gw": dr.gateway(gateway).String()}
+		if len(dr.Gateways) > 0 {
+			params["gw"] = strings.Join(dr.Gateways, ",")
+		}
+		if dr.Metric != 0 {
+			params["metric"] = strconv.Itoa(dr.Metric)
+		}
+		inNetns(p.add("add-route", args.IfName, params))
+	}
+	if route := conf.ipv6DefaultRoute(0); route != nil && (route.Priority != 0 || !hasDefaultRoute(result, true)) {
+		params := map[string]string{"dst": "default", "gw": route.Gw.String()}
+		if route.Priority != 0 {
+			params["metric"] = strconv.Itoa(route.Priority)
+		}
+		inNetns(p.add("add-route", args.IfName, params))
+	}
+	for _, route := range conf.containerRoutes() {
+		params := map[string]string{"dst": route.Dst, "gw": route.gateway(gateway).String()}
+		if route.MTU != 0 {
+			params["mtu"] = strconv.Itoa(route.MTU)
+		}
+		if route.Metric != 0 {
+			params["metric"] = strconv.Itoa(route.Metric)
+		}
+		inNetns(p.add("add-route", args.IfName, params))
+	}
+	for _, ipc := range containerIPs {
+		inNetns(p.add("announce-address", args.IfName, map[string]string{"address": ipc.Address.IP.String()}))
+	}
+	planRouterAdvertisement(p, conf)
+	planHook(p, conf, hookPostAdd)
+
+	return p, nil
+}
+
+// planHook adds running the command configured for the hook, if any
+func planHook(p *plan, conf *PluginConf, hook string) {
+	if argv := conf.Hooks.command(hook); len(argv) > 0 {
+		p.add("run-hook", hook, map[string]string{"command": strings.Join(argv, " ")})
+	}
+}
+
+// planRouterAdvertisement adds advertising the IPv6 gateway to the
+// container
+func planRouterAdvertisement(p *plan, conf *PluginConf) {
+	ra := conf.RouterAdvertisements
+	if ra == nil || ra.External {
+		return
+	}
+	router := ra.router(conf)
+	p.add("advertise-router", l2Name(conf), map[string]string{
+		"prefix":   router.Prefix.String(),
+		"lifetime": strconv.Itoa(int(router.Lifetime)),
+		"slaac":    strconv.FormatBool(router.Autonomous),
+	})
+}
+
+// planAttach adds the operations creating the container interface and its
+// host side
+func planAttach(p *plan, conf *PluginConf, args *skel.CmdArgs, mac string) error {
+	alias := hostAlias(conf, args)
+	altName := hostAltName(conf, args)
+	key := attachmentKey(args.ContainerID, args.IfName)
+	l2 := l2Name(conf)
+
+	containerParams := map[string]string{"mtu": strconv.Itoa(conf.linkMTU())}
+	if mac != "" {
+		containerParams["mac"] = mac
+	}
+
+	switch {
+	case conf.Mode == modeBridge || (conf.Mode == modeOVS && !conf.OVS.VhostUser):
+		hostName := "(random)"
+		if conf.VethNameTemplate != "" {
+			name, err := renderVethName(conf.VethNameTemplate, args.ContainerID, args.IfName)
+			if err != nil {
+				return configError("failed to name host veth", err)
+			}
+			hostName = name
+		}
+		params := map[string]string{"kind": "veth", "peer": args.IfName, "peerNetns": args.Netns}
+		for k, v := range containerParams {
+			params[k] = v
+		}
+		if conf.vethQueues() > 0 {
+			params["queues"] = strconv.Itoa(conf.vethQueues())
+		}
+		if conf.TxQueueLen > 0 {
+			params["txQueueLen"] = strconv.Itoa(conf.TxQueueLen)
+		}
+		p.add("create-link", hostName, params)
+		planQdisc(p, conf, hostName)
+		planOffloads(p, hostName, conf.vethOffloads())
+		if op := planOffloads(p, args.IfName, conf.vethOffloads()); op != nil {
+			op.Netns = args.Netns
+		}
+		planRateLimits(p, conf, args, hostName)
+		p.add("set-alias", hostName, map[string]string{"alias": alias, "altname": altName})
+		if conf.Mode == modeOVS {
+			p.add("ovs-add-port", l2, map[string]string{"port": hostName, "attachment": key})
+		} else {
+			p.add("set-master", hostName, map[string]string{"master": l2, "hairpin": strconv.FormatBool(conf.HairpinMode)})
+			planPortVLAN(p, conf, hostName)
+			if conf.fastPath() {
+				p.add("attach-bpf", hostName, map[string]string{"program": fastpath.PortFilter, "hook": "ingress"})
+			}
+		}
+	case conf.Mode == modeTap:
+		name, err := vmPortName(conf, args.ContainerID, args.IfName)
+		if err != nil {
+			return configError("failed to name tap device", err)
+		}
+		params := map[string]string{"kind": "tap", "mtu": strconv.Itoa(conf.linkMTU())}
+		if conf.vethQueues() > 1 {
+			params["queues"] = strconv.Itoa(conf.vethQueues())
+		}
+		p.add("create-link", name, params)
+		p.add("set-master", name, map[string]string{"master": l2, "hairpin": strconv.FormatBool(conf.HairpinMode)})
+		planPortVLAN(p, conf, name)
+		planQdisc(p, conf, name)
+		planRateLimits(p, conf, args, name)
+		p.add("set-alias", name, map[string]string{"alias": alias, "altname": altName})
+		p.add("set-link-up", name, nil)
+	case conf.Mode == modeOVS:
+		name, err := vmPortName(conf, args.ContainerID, args.IfName)
+		if err != nil {
+			return configError("failed to name vhost-user port", err)
+		}
+		p.add("ovs-add-port", l2, map[string]string{
+			"port":       name,
+			"type":       "dpdkvhostuserclient",
+			"socket":     socketPath(conf, name),
+			"attachment": key,
+		})
+	case conf.Mode == modeSRIOV:
+		representor := fmt.Sprintf("(representor of %s)", conf.RuntimeConfig.DeviceID)
+		p.add("set-master", representor, map[string]string{"master": l2, "hairpin": strconv.FormatBool(conf.HairpinMode)})
+		planPortVLAN(p, conf, representor)
+		planQdisc(p, conf, representor)
+		p.add("set-alias", representor, map[string]string{"alias": alias})
+		params := map[string]string{"name": args.IfName, "netns": args.Netns}
+		for k, v := range containerParams {
+			params[k] = v
+		}
+		p.add("move-link", conf.RuntimeConfig.DeviceID, params)
+	default:
+		if mac != "" && conf.Mode == sublink.ModeIPvlan {
+			return configError("a MAC address can't be requested in ipvlan mode", nil)
+		}
+		containerParams["kind"] = conf.Mode
+		containerParams["parent"] = vxlanName(conf)
+		p.add("create-link", args.IfName, containerParams).Netns = args.Netns
+	}
+	return nil
+}
+
+// planPortVLAN adds placing the attachment's bridge port in its VLAN, and
+// the gateway interface of the VLAN
+func planPortVLAN(p *plan, conf *PluginConf, port string) {
+	if vid := conf.vlan(); vid != 0 {
+		p.add("set-vlan", port, map[string]string{"vid": strconv.Itoa(vid), "pvid": "true", "untagged": "true"})
+	}
+	if vid := conf.gatewayVLAN(); vid != 0 {
+		name := gatewayVLANName(conf, vid)
+		p.add("set-vlan", l2Name(conf), map[string]string{"vid": strconv.Itoa(vid), "self": "true"})
+		p.add("create-link", name, map[string]string{"kind": "vlan", "parent": l2Name(conf), "id": strconv.Itoa(vid)})
+		for _, gateway := range gatewayAddrs(conf) {
+			p.add("add-address", name, map[string]string{"address": hostRouteDst(gateway.IP).String()})
+		}
+	}
+}
+
+// planQdisc adds setting the configured root qdisc on the device
+func planQdisc(p *plan, conf *PluginConf, dev string) {
+	if conf.Qdisc != "" {
+		p.add("set-qdisc", dev, map[string]string{"qdisc": conf.Qdisc})
+	}
+}
+
+// planSourceRouting adds the default route of the source routing table and
+// the rule selecting it for the VTEP address, if it can be found yet
+func planSourceRouting(p *plan, conf *PluginConf) {
+	table := strconv.FormatUint(uint64(conf.SourceRouting.Table), 10)
+	params := map[string]string{"dst": "default", "table": table}
+	if conf.SourceRouting.Gateway != "" {
+		params["gateway"] = conf.SourceRouting.Gateway
+	}
+	p.add("add-route", conf.HostInterface, params)
+	rule := fmt.Sprintf("from <address of %s> lookup %s", conf.HostInterface, table)
+	if vtep, err := vxlan.LocalIP(conf.HostInterface); err == nil {
+		rule = rtable.Describe(sourceSelector(conf, vtep).Rules()[0])
+	}
+	p.add("add-rule", rule, nil)
+}
+
+// planProxyARP adds setting the device's proxy ARP sysctls
+func planProxyARP(p *plan, dev string, s *ProxyARPSettings) {
+	if s == nil {
+		return
+	}
+	for _, sysctl := range s.sysctls() {
+		name := "net." + strings.ReplaceAll(sysctl.table, "/", ".") + "." + dev + "." + sysctl.name
+		p.add("set-sysctl", name, map[string]string{"value": sysctl.value})
+	}
+}
+
+// planOffloads adds setting the offloads of the device, returning the
+// operation if there is one
+func planOffloads(p *plan, dev string, offloads *offload.Settings) *operation {
+	if offloads.IsEmpty() {
+		return nil
+	}
+	return p.add("set-offloads", dev, map[string]string{"offloads": offloads.String()})
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func TestPlanAdd(t *testing.T) {
+	dataDir := t.TempDir()
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 10,
+		"subnet": "10.244.0.0/24",
+		"gateway": "10.244.0.1",
+		"ipMasq": true,
+		"firewallBackend": "iptables",
+		"dataDir": "` + dataDir + `",
+		"vethNameTemplate": "xvm{{.Hash}}",
+		"routes": [{"dst": "10.96.0.0/12"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	args := &skel.CmdArgs{ContainerID: "c1", Netns: "/var/run/netns/c1", IfName: "eth0"}
+
+	p, err := planAdd(conf, args, &EnvArgs{}, nil, &current.Result{}, "")
+	if err != nil {
+		t.Fatalf("Failed to plan ADD: %v", err)
+	}
+	find := func(action, target string) *operation {
+		for _, op := range p.Operations {
+			if op.Action == action && op.Target == target {
+				return op
+			}
+		}
+		t.Fatalf("Plan lacks %s %s: %+v", action, target, p.Operations)
+		return nil
+	}
+
+	if op := find("create-link", "xvx-xvm-network"); op.Params["vni"] != "10" || op.Params["dev"] != "eth0" {
+		t.Fatalf("Unexpected VXLAN interface: %+v", op.Params)
+	}
+	find("set-master", "xvx-xvm-network")
+	find("add-address", "xbr-xvm-network")
+	if op := find("allocate-ip", "c1/eth0"); op.Params["address"] != "10.244.0.2/24" {
+		t.Fatalf("Expected allocation of 10.244.0.2/24, got %+v", op.Params)
+	}
+	if op := find("add-firewall-rule", "POSTROUTING"); op.Params["backend"] != "iptables" || op.Params["table"] != "nat" {
+		t.Fatalf("Unexpected masquerade rule: %+v", op.Params)
+	}
+	hostVeth, err := renderVethName(conf.VethNameTemplate, "c1", "eth0")
+	if err != nil {
+		t.Fatalf("Failed to render veth name: %v", err)
+	}
+	find("create-link", hostVeth)
+	if op := find("add-route", "eth0"); op.Netns != args.Netns || op.Params["dst"] != "default" {
+		t.Fatalf("Unexpected default route: %+v", op)
+	}
+
+	// The dry run leaves no allocation behind
+	if _, err := os.Stat(filepath.Join(dataDir, "allocations.json")); !os.IsNotExist(err) {
+		t.Fatalf("Dry run saved allocations")
+	}
+}
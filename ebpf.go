@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+// EBPFConf holds the parts of the datapath moved into eBPF programs
+type EBPFConf struct {
+	// FastPath redirects the traffic between the containers' host veths and
+	// to the MACs learned behind the VXLAN interface directly, past the
+	// bridge
+	FastPath bool `json:"fastPath,omitempty"`
+	// AntiSpoofing has a tc program check the source MAC and addresses of
+	// antiSpoofing rather than nftables
+	AntiSpoofing bool `json:"antiSpoofing,omitempty"`
+	// BUMGuard limits the broadcast and multicast frames each remote VTEP
+	// sends into the network's VNI with an XDP program on the host
+	// interface
+	BUMGuard *BUMGuardConf `json:"bumGuard,omitempty"`
+	// FSDir is where the BPF file system the programs' maps are pinned to is
+	// mounted, mounted by the plugin if it isn't (default: /sys/fs/bpf)
+	FSDir string `json:"fsDir,omitempty"`
+}
+
+// validate returns the problems with the eBPF datapath settings
+func (e *EBPFConf) validate(c *PluginConf) []string {
+	var problems []string
+	if e.FSDir != "" && !filepath.IsAbs(e.FSDir) {
+		problems = append(problems, fmt.Sprintf("ebpf.fsDir %q must be an absolute path", e.FSDir))
+	}
+	if e.AntiSpoofing && !c.AntiSpoofing {
+		problems = append(problems, "ebpf.antiSpoofing requires antiSpoofing")
+	}
+	if e.BUMGuard != nil {
+		problems = append(problems, e.BUMGuard.validate(c)...)
+	}
+	if !e.FastPath {
+		return problems
+	}
+	if c.Mode != modeBridge {
+		problems = append(problems, fmt.Sprintf("ebpf.fastPath isn't supported in mode %q", c.Mode))
+	}
+	// The redirected traffic skips the netdev filters after tc and the
+	// bridge's filtering
+	for option, set := range map[string]bool{
+		"antiSpoofing":        c.AntiSpoofing && !e.AntiSpoofing,
+		"dscp":                c.dscp() != nil,
+		"policy":              c.Policy != nil,
+		"allowedIngressPorts": len(c.allowedIngressPorts()) > 0,
+		"vlanFiltering":       c.VLANFiltering,
+	} {
+		if set {
+			problems = append(problems, fmt.Sprintf("%s can't be combined with ebpf.fastPath", option))
+		}
+	}
+	return problems
+}
+
+// fastPath reports whether the network's traffic takes the eBPF fast path
+func (c *PluginConf) fastPath() bool {
+	return c.EBPF != nil && c.EBPF.FastPath
+}
+
+// bpfAntiSpoofing reports whether a tc program checks the sources of the
+// attachments' traffic
+func (c *PluginConf) bpfAntiSpoofing() bool {
+	return c.AntiSpoofing && c.EBPF != nil && c.EBPF.AntiSpoofing
+}
+
+// bpfFSDir returns where the BPF file system is mounted
+func (c *PluginConf) bpfFSDir() string {
+	if c.EBPF == nil || c.EBPF.FSDir == "" {
+		return bpf.DefaultFSDir
+	}
+	return c.EBPF.FSDir
+}
+
+// bpfDir returns the directory the network's maps are pinned in
+func bpfDir(conf *PluginConf) string {
+	return filepath.Join(conf.bpfFSDir(), bpf.PinDir(conf.Name))
+}
+
+// mountBPF mounts the BPF file system if needed and creates the directory
+// of the network's maps
+func mountBPF(conf *PluginConf) error {
+	if err := bpf.MountFS(conf.bpfFSDir(), bpf.PinDir(conf.Name)); err != nil {
+		return newError(types.ErrInternal, "failed to set up BPF file system", err)
+	}
+	return nil
+}
+
+// removeBPFMaps removes the network's pinned maps
+func removeBPFMaps(conf *PluginConf) error {
+	if err := os.RemoveAll(bpfDir(conf)); err != nil {
+		return newError(types.ErrInternal, "failed to remove BPF maps", err)
+	}
+	return nil
+}
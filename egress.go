@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/policy"
+)
+
+// setupEgressRules installs the network's egress rules, filtering what the
+// containers send out of the overlay through the node. ADD reinstalls them,
+// so configuration changes apply with the next container, and rules removed
+// from the configuration are removed from the node.
+func setupEgressRules(conf *PluginConf) error {
+	if len(conf.EgressRules) == 0 {
+		if err := policy.DeleteEgressTable(policy.EgressTableName(conf.VxlanID)); err != nil {
+			return newError(types.ErrInternal, "failed to remove egress rules", err)
+		}
+		return nil
+	}
+	if err := policy.SetupEgress(policy.EgressTableName(conf.VxlanID), l2Name(conf), conf.EgressRules); err != nil {
+		return newError(types.ErrInternal, "failed to install egress rules", err)
+	}
+	return nil
+}
+
+// teardownEgressRules removes the network's egress rules once no container
+// holds an address in any of its subnets anymore
+func teardownEgressRules(conf *PluginConf, ipams []*ipam.IPAM) error {
+	for _, ipamInstance := range ipams {
+		if ipamInstance.Count() > 0 {
+			return nil // Still in use
+		}
+	}
+	if err := policy.DeleteEgressTable(policy.EgressTableName(conf.VxlanID)); err != nil {
+		return newError(types.ErrInternal, "failed to remove egress rules", err)
+	}
+	return nil
+}
+
+// checkEgressRules verifies that the network's egress rules are installed
+func checkEgressRules(conf *PluginConf) error {
+	installed, err := policy.HasEgress(policy.EgressTableName(conf.VxlanID))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list egress rules", err)
+	}
+	if !installed {
+		return newError(types.ErrInternal, "egress rules are not installed", nil)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// Plugin-specific error codes. The CNI spec reserves codes 100 and up for
+// plugins.
+const (
+	// ErrIPAMExhausted means the subnet has no free addresses left
+	ErrIPAMExhausted uint = 100
+	// ErrIPAMFailure means the allocation store could not be read or written
+	ErrIPAMFailure uint = 101
+	// ErrVxlanSetup means the shared VXLAN interface could not be set up
+	ErrVxlanSetup uint = 102
+	// ErrIPConflict means a requested address is held by another container
+	ErrIPConflict uint = 103
+	// ErrPathMTU means the underlay path to a peer doesn't carry the
+	// encapsulated frames of the network's MTU
+	ErrPathMTU uint = 104
+)
+
+// newError returns a CNI error with the given code, carrying the cause (if
+// any) in the error details
+func newError(code uint, msg string, err error) *types.Error {
+	details := ""
+	if err != nil {
+		details = err.Error()
+	}
+	return types.NewError(code, msg, details)
+}
+
+// configError returns a CNI error for invalid network configuration
+func configError(msg string, err error) *types.Error {
+	return newError(types.ErrInvalidNetworkConfig, msg, err)
+}
+
+// netlinkError returns a CNI error for a failed netlink operation, marking
+// transient kernel errors that persisted through our own retries as
+// retryable by the runtime
+func netlinkError(msg string, err error) *types.Error {
+	code := types.ErrInternal
+	if retry.IsTransient(err) {
+		code = types.ErrTryAgainLater
+	}
+	return newError(code, msg, err)
+}
+
+// ipamError returns a CNI error for a failed IPAM operation
+func ipamError(msg string, err error) *types.Error {
+	switch {
+	case errors.Is(err, ipam.ErrExhausted):
+		return newError(ErrIPAMExhausted, msg, err)
+	case errors.Is(err, ipam.ErrConflict):
+		return newError(ErrIPConflict, msg, err)
+	case errors.Is(err, ipam.ErrOutOfRange):
+		return configError(msg, err)
+	}
+	return newError(ErrIPAMFailure, msg, err)
+}
+
+// warn reports a failure that doesn't fail the command on stderr, which
+// runtimes log, as stdout carries the result
+func warn(err error) {
+	fmt.Fprintf(os.Stderr, "xvm-cni: warning: %v\n", err)
+}
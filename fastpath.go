@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+	"github.com/nohns/xvm-cni/pkg/fastpath"
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+)
+
+// openFastPath opens the network's fast path maps, mounting the BPF file
+// system and creating the maps if needed
+func openFastPath(conf *PluginConf) (*fastpath.Maps, error) {
+	if err := mountBPF(conf); err != nil {
+		return nil, err
+	}
+	maps, err := fastpath.Open(bpfDir(conf))
+	if err != nil {
+		return nil, newError(types.ErrInternal, "failed to open fast path maps", err)
+	}
+	return maps, nil
+}
+
+// setupFastPathUplink creates the network's fast path maps and attaches the
+// program learning remote MACs to the VXLAN interface, if any
+func setupFastPathUplink(conf *PluginConf, vxlanIface netlink.Link) error {
+	maps, err := openFastPath(conf)
+	if err != nil {
+		return err
+	}
+	defer maps.Close()
+	if vxlanIface == nil {
+		return nil
+	}
+	attached, err := bpf.IngressAttached(vxlanIface, fastpath.UplinkFilter, fastpath.Priority)
+	if err != nil {
+		return netlinkError("failed to list VXLAN interface filters", err)
+	}
+	if attached {
+		return nil
+	}
+	prog, err := fastpath.UplinkProgram(maps)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load fast path program", err)
+	}
+	defer prog.Close()
+	if err := bpf.AttachIngress(vxlanIface, prog, fastpath.UplinkFilter, fastpath.Priority); err != nil {
+		return netlinkError("failed to attach fast path program", err)
+	}
+	return nil
+}
+
+// setupFastPath attaches the fast path program to the attachment's host
+// veth and has the traffic to the container's MAC redirected to it
+func setupFastPath(conf *PluginConf, hostPort, containerIface net.Interface, undo *rollback) error {
+	maps, err := openFastPath(conf)
+	if err != nil {
+		return err
+	}
+	defer maps.Close()
+	link, err := netlink.LinkByIndex(hostPort.Index)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to find %s", hostPort.Name), err)
+	}
+	prog, err := fastpath.PortProgram(maps)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load fast path program", err)
+	}
+	defer prog.Close()
+	if err := bpf.AttachIngress(link, prog, fastpath.PortFilter, fastpath.Priority); err != nil {
+		return netlinkError("failed to attach fast path program", err)
+	}
+
+	mac := containerIface.HardwareAddr
+	if err := maps.AddPort(mac, hostPort.Index); err != nil {
+		return newError(types.ErrInternal, "failed to add fast path port", err)
+	}
+	undo.add(func() error { return teardownFastPath(conf, []net.HardwareAddr{mac}) })
+	return nil
+}
+
+// teardownFastPath leaves the traffic to the MACs to the bridge. The
+// programs go with the host veths.
+func teardownFastPath(conf *PluginConf, macs []net.HardwareAddr) error {
+	maps, err := fastpath.OpenExisting(bpfDir(conf))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open fast path maps", err)
+	}
+	defer maps.Close()
+	for _, mac := range macs {
+		if err := maps.DeletePort(mac); err != nil {
+			return newError(types.ErrInternal, "failed to remove fast path port", err)
+		}
+	}
+	return nil
+}
+
+// checkFastPath verifies that the fast path program is attached to the
+// attachment's host veth and the traffic to its recorded MAC is redirected
+// there
+func checkFastPath(conf *PluginConf, args *skel.CmdArgs, recorded *resultcache.Record) error {
+	name, err := hostPortName(conf, args)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", name), err)
+	}
+	attached, err := bpf.IngressAttached(link, fastpath.PortFilter, fastpath.Priority)
+	if err != nil {
+		return netlinkError("failed to list filters", err)
+	}
+	if !attached {
+		return newError(types.ErrInternal, fmt.Sprintf("no fast path program on %s", name), nil)
+	}
+
+	mac := recordedMAC(recorded)
+	if mac == nil {
+		return nil
+	}
+	maps, err := fastpath.OpenExisting(bpfDir(conf))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open fast path maps", err)
+	}
+	defer maps.Close()
+	ifindex, err := maps.Port(mac)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to look up fast path port", err)
+	}
+	if ifindex != link.Attrs().Index {
+		return newError(types.ErrInternal, fmt.Sprintf("fast path doesn't redirect %s to %s", mac, name), nil)
+	}
+	return nil
+}
+
+// gcFastPath removes the fast path ports whose host veths are gone or no
+// longer ports of the bridge
+func gcFastPath(conf *PluginConf, br netlink.Link) error {
+	maps, err := fastpath.OpenExisting(bpfDir(conf))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to open fast path maps", err)
+	}
+	defer maps.Close()
+	ports, err := maps.Ports()
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list fast path ports", err)
+	}
+	for s, ifindex := range ports {
+		if link, err := netlink.LinkByIndex(ifindex); err == nil && link.Attrs().MasterIndex == br.Attrs().Index {
+			continue
+		}
+		mac, _ := net.ParseMAC(s)
+		if err := maps.DeletePort(mac); err != nil {
+			return newError(types.ErrInternal, "failed to remove stale fast path port", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/firewalld"
+	"github.com/nohns/xvm-cni/pkg/fw"
+)
+
+// firewalldZone returns the firewalld zone of the network's subnets
+func (c *PluginConf) firewalldZone() string {
+	return c.FirewalldZone
+}
+
+// usesFirewalld reports whether the network's rules go through firewalld,
+// which only happens when firewallBackend selects it
+func (c *PluginConf) usesFirewalld() bool {
+	return c.FirewallBackend == fw.BackendFirewalld
+}
+
+// networkSubnets returns the network's subnets
+func networkSubnets(conf *PluginConf) []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, gateway := range gatewayAddrs(conf) {
+		subnets = append(subnets, &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask})
+	}
+	return subnets
+}
+
+// setupFirewalldZone binds the network's subnets to its firewalld zone when
+// rules go through firewalld, so firewalld doesn't reject the containers'
+// forwarded traffic by the default zone's policy
+func setupFirewalldZone(conf *PluginConf) error {
+	if !conf.usesFirewalld() {
+		return nil
+	}
+	if err := fw.SetupZone(conf.firewalldZone(), networkSubnets(conf)); err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("failed to bind subnets to firewalld zone %s", conf.firewalldZone()), err)
+	}
+	return nil
+}
+
+// teardownFirewalldZone unbinds the network's subnets from its firewalld
+// zone, if firewalld runs, whichever backend the network uses now
+func teardownFirewalldZone(conf *PluginConf) error {
+	if conf.firewalldZone() == "" || !firewalld.Running() {
+		return nil
+	}
+	if err := fw.TeardownZone(conf.firewalldZone(), networkSubnets(conf)); err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("failed to unbind subnets from firewalld zone %s", conf.firewalldZone()), err)
+	}
+	return nil
+}
+
+// checkFirewalldZone verifies that the network's subnets are bound to its
+// firewalld zone when rules go through firewalld
+func checkFirewalldZone(conf *PluginConf) error {
+	if !conf.usesFirewalld() {
+		return nil
+	}
+	ok, err := fw.HasZone(conf.firewalldZone(), networkSubnets(conf))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check firewalld zone", err)
+	}
+	if !ok {
+		return newError(types.ErrInternal, fmt.Sprintf("subnets aren't bound to firewalld zone %s", conf.firewalldZone()), nil)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// FloodingConf selects how the VXLAN device floods broadcast, unknown
+// unicast and multicast traffic, trading the underlay's requirements for
+// the work of keeping the peers known
+type FloodingConf struct {
+	// Mode is "multicast", "headEnd" or "none" (default: "multicast")
+	Mode string `json:"mode,omitempty"`
+	// Peers are the IPv4 addresses of the remote VTEPs "headEnd" replicates
+	// to
+	Peers []string `json:"peers,omitempty"`
+	// PerNodeSubnet tells that each node's network has a subnet of its
+	// own, so pods reach those of other nodes through the gateway, as
+	// "none" requires unless the bridge answers ARP for them
+	PerNodeSubnet bool `json:"perNodeSubnet,omitempty"`
+}
+
+// validate returns the problems with the flooding settings
+func (f *FloodingConf) validate(c *PluginConf) []string {
+	var problems []string
+	switch f.Mode {
+	case "", vxlan.FloodMulticast, vxlan.FloodNone:
+		if len(f.Peers) > 0 {
+			problems = append(problems, fmt.Sprintf("flooding.peers requires flooding.mode %q", vxlan.FloodHeadEnd))
+		}
+		// ARP for pods of other nodes on the subnet goes unanswered
+		// without flooding
+		if f.Mode == vxlan.FloodNone && !f.PerNodeSubnet {
+			if p := c.bridgeProxyARP(); p == nil || !p.Enabled {
+				problems = append(problems, fmt.Sprintf("flooding.mode %q requires flooding.perNodeSubnet or proxyARP.bridge", vxlan.FloodNone))
+			}
+		}
+	case vxlan.FloodHeadEnd:
+		if len(f.Peers) == 0 {
+			problems = append(problems, fmt.Sprintf("flooding.mode %q requires flooding.peers", vxlan.FloodHeadEnd))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown flooding.mode %q (must be %q, %q or %q)", f.Mode, vxlan.FloodMulticast, vxlan.FloodHeadEnd, vxlan.FloodNone))
+	}
+	for _, peer := range f.Peers {
+		if ip := net.ParseIP(peer); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid flooding peer %q", peer))
+		}
+	}
+	if !c.usesVxlan() {
+		problems = append(problems, "flooding requires a VXLAN interface")
+	}
+	return problems
+}
+
+// floodMode returns the flooding mode of the network's VXLAN device
+func (c *PluginConf) floodMode() string {
+	if c.Flooding == nil || c.Flooding.Mode == "" {
+		return vxlan.FloodMulticast
+	}
+	return c.Flooding.Mode
+}
+
+// floodPeers returns the peers the VXLAN device replicates to
+func (c *PluginConf) floodPeers() []net.IP {
+	if c.floodMode() != vxlan.FloodHeadEnd {
+		return nil
+	}
+	peers := make([]net.IP, 0, len(c.Flooding.Peers))
+	for _, peer := range c.Flooding.Peers {
+		peers = append(peers, net.ParseIP(peer))
+	}
+	return peers
+}
+
+// setupFlooding adds the flood entries of the peers the VXLAN device
+// replicates to, and removes those of the peers the network was set up with
+// before but no longer lists. The entries the agent's node watcher adds
+// for the other peers are left alone. The caller holds the network lock.
+func setupFlooding(conf *PluginConf, vx *netlink.Vxlan) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	peers := conf.floodPeers()
+	var stale []net.IP
+	for _, p := range state.FloodPeers {
+		if ip := net.ParseIP(p); ip != nil && !containsIP(peers, ip) {
+			stale = append(stale, ip)
+		}
+	}
+	if err := vxlan.DelFloodPeers(vx, stale); err != nil {
+		return netlinkError("failed to remove flood peers", err)
+	}
+	if err := vxlan.AddFloodPeers(vx, peers); err != nil {
+		return netlinkError("failed to add flood peers", err)
+	}
+
+	recorded := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		recorded = append(recorded, peer.String())
+	}
+	if len(stale) == 0 && len(recorded) == len(state.FloodPeers) {
+		return nil
+	}
+	state.FloodPeers = recorded
+	if err := state.Save(dir); err != nil {
+		return newError(types.ErrInternal, "failed to save host state", err)
+	}
+	return nil
+}
+
+// containsIP reports whether the address is among the addresses
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFlooding verifies that the VXLAN device floods as configured
+func checkFlooding(conf *PluginConf, link netlink.Link) error {
+	vx, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return newError(types.ErrInternal, fmt.Sprintf("%s is a %s device, not VXLAN", link.Attrs().Name, link.Type()), nil)
+	}
+	want := conf.floodMode()
+	if mode := vxlan.FloodMode(vx); mode != want {
+		return newError(types.ErrInternal, fmt.Sprintf("VXLAN interface %s floods in mode %q, expected %q", vx.Name, mode, want), nil)
+	}
+	peers, err := vxlan.FloodPeers(vx)
+	if err != nil {
+		return netlinkError("failed to check flooding", err)
+	}
+	switch want {
+	case vxlan.FloodMulticast:
+		ok, err := vxlan.HasFloodEntry(vx)
+		if err != nil {
+			return netlinkError("failed to check flooding", err)
+		}
+		if !ok {
+			return newError(types.ErrInternal, fmt.Sprintf("VXLAN interface %s has no flood entry to %s", vx.Name, vxlan.MulticastGroup), nil)
+		}
+	case vxlan.FloodHeadEnd:
+	next:
+		for _, peer := range conf.floodPeers() {
+			for _, p := range peers {
+				if p.Equal(peer) {
+					continue next
+				}
+			}
+			return newError(types.ErrInternal, fmt.Sprintf("VXLAN interface %s doesn't flood to peer %s", vx.Name, peer), nil)
+		}
+	case vxlan.FloodNone:
+		if len(peers) > 0 {
+			return newError(types.ErrInternal, fmt.Sprintf("VXLAN interface %s floods to %s", vx.Name, peers[0]), nil)
+		}
+	}
+	return nil
+}
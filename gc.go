@@ -0,0 +1,449 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// aliasPrefix marks host-side interfaces owned by xvm-cni
+const aliasPrefix = "xvm-cni:"
+
+const (
+	// maxAliasLen is the longest interface alias the kernel keeps
+	maxAliasLen = 255
+	// maxAltNameLen is the longest alternative interface name
+	maxAltNameLen = 127
+)
+
+// attachmentKey identifies an attachment of a container to the network, so
+// a container can be attached more than once
+func attachmentKey(containerID, ifName string) string {
+	return containerID + "/" + ifName
+}
+
+// attachmentAlias returns the interface alias identifying an attachment
+func attachmentAlias(containerID, ifName string) string {
+	return aliasPrefix + attachmentKey(containerID, ifName)
+}
+
+// hostAlias returns the alias of the attachment's host-side interfaces: the
+// attachment alias followed by the network and, if the runtime passed it, the
+// pod, so `ip link` tells which workload an interface belongs to
+func hostAlias(conf *PluginConf, args *skel.CmdArgs) string {
+	alias := attachmentAlias(args.ContainerID, args.IfName) + " network=" + conf.Name
+	if pod := podName(args); pod != "" {
+		alias += " pod=" + pod
+	}
+	if len(alias) > maxAliasLen {
+		alias = alias[:maxAliasLen]
+	}
+	return alias
+}
+
+// hostAltName returns the alternative name of the attachment's host-side
+// interface, made of the network, the pod or the short container ID, and
+// the container interface name
+func hostAltName(conf *PluginConf, args *skel.CmdArgs) string {
+	workload := args.ContainerID
+	if len(workload) > 12 {
+		workload = workload[:12]
+	}
+	if pod := podName(args); pod != "" {
+		workload = pod
+	}
+	name := strings.Map(func(r rune) rune {
+		// Interface names can't hold slashes, colons or whitespace
+		if r == '/' || r == ':' || unicode.IsSpace(r) {
+			return '.'
+		}
+		return r
+	}, conf.Name+"."+workload+"."+args.IfName)
+	if len(name) > maxAltNameLen {
+		name = name[:maxAltNameLen]
+	}
+	return name
+}
+
+// podName returns the namespace and name of the pod passed in CNI_ARGS, or
+// an empty string if there is none
+func podName(args *skel.CmdArgs) string {
+	envArgs, err := parseEnvArgs(args.Args)
+	if err != nil || envArgs.K8S_POD_NAME == "" {
+		return ""
+	}
+	return string(envArgs.K8S_POD_NAMESPACE) + "/" + string(envArgs.K8S_POD_NAME)
+}
+
+// parseAttachmentAlias returns the attachment key encoded in an interface
+// alias, or false if the interface is not owned by xvm-cni
+func parseAttachmentAlias(alias string) (string, bool) {
+	if !strings.HasPrefix(alias, aliasPrefix) {
+		return "", false
+	}
+	// The network and pod follow the key
+	key, _, _ := strings.Cut(strings.TrimPrefix(alias, aliasPrefix), " ")
+	return key, true
+}
+
+// aliasNetwork returns the network an interface alias names, if any
+func aliasNetwork(alias string) (string, bool) {
+	_, rest, ok := strings.Cut(alias, " network=")
+	if !ok {
+		return "", false
+	}
+	network, _, _ := strings.Cut(rest, " pod=")
+	return network, true
+}
+
+// ownedBy reports whether an interface alias marks the interface as one of
+// the attachment's
+func ownedBy(alias, containerID, ifName string) bool {
+	key, owned := parseAttachmentAlias(alias)
+	return owned && key == attachmentKey(containerID, ifName)
+}
+
+// tagHostLink sets the alias identifying the attachment on one of its
+// host-side interfaces, and, where the kernel supports them, its
+// alternative name
+func tagHostLink(link netlink.Link, conf *PluginConf, args *skel.CmdArgs, altName bool) error {
+	if err := netlink.LinkSetAlias(link, hostAlias(conf, args)); err != nil {
+		return err
+	}
+	if !altName {
+		return nil
+	}
+	// Alternative names are cosmetic: kernels before 5.5 lack them, and
+	// another interface may hold the name already
+	name := hostAltName(conf, args)
+	for _, existing := range link.Attrs().AltNames {
+		if existing == name {
+			return nil
+		}
+	}
+	_ = netlink.LinkAddAltName(link, name)
+	return nil
+}
+
+// keptAttachments returns the attachments holding addresses or host-side
+// interfaces, but the stale ones
+func keptAttachments(ipams []*ipam.IPAM, stale []string) (map[string]bool, error) {
+	kept := make(map[string]bool)
+	for _, ipamInstance := range ipams {
+		for key := range ipamInstance.Allocations {
+			kept[key] = true
+		}
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, netlinkError("failed to list links", err)
+	}
+	for _, link := range links {
+		if key, owned := parseAttachmentAlias(link.Attrs().Alias); owned {
+			kept[key] = true
+		}
+	}
+	for _, key := range stale {
+		delete(kept, key)
+	}
+	return kept, nil
+}
+
+func cmdGC(ctx context.Context, args *skel.CmdArgs) error {
+	// Parse network configuration
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.DisableGC {
+		return nil
+	}
+	// The namespaces' segments and the further attachments' networks are
+	// collected along with the network
+	networks := append([]*PluginConf{conf}, conf.segments()...)
+	for _, c := range append(networks, conf.attachedNetworks()...) {
+		if err := gcNetwork(ctx, c); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return deadlineError(ctx, "collecting the networks")
+		}
+	}
+	return nil
+}
+
+// gcNetwork releases the resources of the network's stale attachments, and
+// the network's devices once no container is left
+func gcNetwork(ctx context.Context, conf *PluginConf) error {
+	// Collect the attachments the runtime still considers valid. Allocations
+	// made before they were keyed by attachment use the container ID.
+	validAllocations := make(map[string]bool)
+	validAttachments := make(map[string]bool)
+	for _, attachment := range conf.ValidAttachments {
+		key := attachmentKey(attachment.ContainerID, attachment.IfName)
+		validAllocations[attachment.ContainerID] = true
+		validAllocations[key] = true
+		validAttachments[key] = true
+	}
+
+	// Keep concurrent ADDs from recreating the devices or allocating while
+	// they are removed
+	unlock, err := lockNetwork(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Release stale allocations
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return err
+	}
+	// xvmctl names the stale attachments instead, as it can't know the
+	// valid ones. Those of ADDs in progress hold their addresses by now.
+	if len(conf.StaleAttachments) > 0 {
+		kept, err := keptAttachments(ipams, conf.StaleAttachments)
+		if err != nil {
+			return err
+		}
+		validAllocations, validAttachments = kept, kept
+	}
+	var staleIPs []net.IP
+	allocated := 0
+	for _, ipamInstance := range ipams {
+		released, err := ipamInstance.ReleaseStale(validAllocations)
+		if err != nil {
+			return ipamError("failed to release stale allocations", err)
+		}
+		for _, ip := range released {
+			staleIPs = append(staleIPs, ip)
+		}
+		allocated += ipamInstance.Count()
+	}
+
+	if err := forgetAttachments(conf, ipams); err != nil {
+		return err
+	}
+	// The records hold the DSCP the annotations of stale pods set
+	if conf.dscp() == nil && conf.PodAnnotations {
+		if err := gcAnnotatedDSCP(conf, validAttachments); err != nil {
+			return err
+		}
+	}
+	// The recorded MACs cover stale attachments whose ports are gone
+	staleMACs, err := gcResults(conf, validAttachments)
+	if err != nil {
+		return err
+	}
+
+	// Forget the flows of the stale addresses
+	if err := flushConntrack(staleIPs); err != nil {
+		return err
+	}
+
+	// Remove the host routes to the stale addresses
+	if conf.HostRoutes || conf.VLANFiltering {
+		if err := deleteHostRoutes(conf, staleIPs); err != nil {
+			return err
+		}
+	}
+
+	// Stop answering for the stale addresses
+	if conf.NDPProxy {
+		if err := deleteNDPProxy(conf, staleIPs); err != nil {
+			return err
+		}
+	}
+
+	// Remove masquerade rules if no container is left
+	if conf.IPMasq {
+		if err := teardownIPMasq(conf, ipams); err != nil {
+			return err
+		}
+	}
+
+	// Remove the port forwarding rules of stale attachments
+	if err := gcPortMappings(conf, validAttachments); err != nil {
+		return err
+	}
+
+	// Remove egress rules if no container is left
+	if err := teardownEgressRules(conf, ipams); err != nil {
+		return err
+	}
+
+	// Remove the anti-spoofing filters of stale attachments
+	if conf.AntiSpoofing {
+		if err := gcAntiSpoofing(conf, validAttachments); err != nil {
+			return err
+		}
+	}
+
+	// Remove the IFB devices shaping the egress of stale attachments
+	if err := gcIFBs(conf, validAttachments); err != nil {
+		return err
+	}
+
+	// Remove the DSCP marking of stale attachments
+	if err := gcDSCP(conf, validAttachments); err != nil {
+		return err
+	}
+
+	// Remove the network policy of stale attachments
+	if conf.Policy != nil {
+		if err := gcPolicy(conf, validAttachments); err != nil {
+			return err
+		}
+	}
+
+	// Remove the ingress port allowlists of stale attachments
+	if err := gcPortAllowlist(conf, validAttachments); err != nil {
+		return err
+	}
+
+	if conf.Mode == modeOVS {
+		return gcOVS(conf, validAttachments, staleMACs, staleIPs, allocated)
+	}
+
+	// Containers in macvlan and ipvlan mode have no host-side interfaces, so
+	// only the shim's neighbor entries and the shared devices are left
+	if !conf.usesBridge() {
+		return gcShim(conf, staleMACs, staleIPs, allocated)
+	}
+
+	// Nothing left to clean up if the overlay bridge is gone
+	bridgeName := l2Name(conf)
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		if err := vxlan.CleanupVxlan(vxlanName(conf)); err != nil {
+			return netlinkError("failed to remove VXLAN interface", err)
+		}
+		return nil
+	}
+
+	// Remove orphaned host veths and taps attached to the bridge, and
+	// disconnect the representors of orphaned VFs
+	links, err := netlink.LinkList()
+	if err != nil {
+		return netlinkError("failed to list links", err)
+	}
+	ports := 0
+	for _, link := range links {
+		if (link.Type() != "veth" && link.Type() != "tuntap" && link.Type() != "device") || link.Attrs().MasterIndex != br.Attrs().Index {
+			continue
+		}
+		key, owned := parseAttachmentAlias(link.Attrs().Alias)
+		if !owned || validAttachments[key] {
+			ports++
+			continue
+		}
+		if link.Type() == "device" {
+			if err := releaseRepresentor(link); err != nil {
+				return err
+			}
+			continue
+		}
+		staleMACs = append(staleMACs, link.Attrs().HardwareAddr)
+		if err := netlink.LinkDel(link); err != nil {
+			return netlinkError(fmt.Sprintf("failed to delete orphaned interface %s", link.Attrs().Name), err)
+		}
+	}
+
+	// Stop redirecting traffic to the ports gone
+	if conf.fastPath() {
+		if err := gcFastPath(conf, br); err != nil {
+			return err
+		}
+	}
+
+	// Remove FDB and neighbor entries of the stale attachments
+	if err := pruneNeighbors(conf, staleMACs, staleIPs); err != nil {
+		return err
+	}
+
+	// Remove the bridge and VXLAN interface once nothing uses them anymore
+	if ports == 0 && allocated == 0 {
+		return teardownNetwork(conf)
+	}
+
+	return nil
+}
+
+// gcShim removes the neighbor entries of stale attachments from the shim, and
+// the shim and VXLAN interface once no container holds an address anymore
+func gcShim(conf *PluginConf, staleMACs []net.HardwareAddr, staleIPs []net.IP, allocated int) error {
+	if err := pruneNeighbors(conf, staleMACs, staleIPs); err != nil {
+		return err
+	}
+
+	if allocated == 0 {
+		return teardownNetwork(conf)
+	}
+
+	return nil
+}
+
+// gcOVS removes the OVS ports of stale attachments, and the OVS bridge once
+// no container holds an address anymore
+func gcOVS(conf *PluginConf, validAttachments map[string]bool, staleMACs []net.HardwareAddr, staleIPs []net.IP, allocated int) error {
+	client := ovs.New(nil)
+	exists, err := client.BridgeExists(conf.OVS.Bridge)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to find OVS bridge", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	// Remove ports of attachments the runtime no longer knows about
+	ports, err := client.Attachments(conf.OVS.Bridge)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list OVS ports", err)
+	}
+	remaining := 0
+	for port, attachment := range ports {
+		if validAttachments[attachment] {
+			remaining++
+			continue
+		}
+		if err := client.DelPort(conf.OVS.Bridge, port); err != nil {
+			return newError(types.ErrInternal, "failed to remove orphaned OVS port", err)
+		}
+		if link, err := netlink.LinkByName(port); err == nil {
+			if err := netlink.LinkDel(link); err != nil {
+				return netlinkError(fmt.Sprintf("failed to delete orphaned interface %s", port), err)
+			}
+		}
+		if conf.OVS.VhostUser {
+			if err := os.Remove(socketPath(conf, port)); err != nil && !os.IsNotExist(err) {
+				return newError(types.ErrInternal, "failed to remove vhost-user socket", err)
+			}
+		}
+	}
+
+	// Remove neighbor entries of the stale attachments
+	if err := pruneNeighbors(conf, staleMACs, staleIPs); err != nil {
+		return err
+	}
+
+	// Remove the bridge with its tunnel ports once nothing uses it anymore
+	if remaining == 0 && allocated == 0 {
+		return teardownNetwork(conf)
+	}
+
+	return nil
+}
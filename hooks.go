@@ -0,0 +1,192 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	// defaultHookTimeout bounds hooks without a timeout of their own
+	defaultHookTimeout = 10 * time.Second
+	// maxHookOutput is how much of a failed hook's output the error carries
+	maxHookOutput = 4 << 10
+)
+
+// Hook names, as set in the context's "hook" field
+const (
+	hookPreAdd  = "preAdd"
+	hookPostAdd = "postAdd"
+	hookPreDel  = "preDel"
+	hookPostDel = "postDel"
+)
+
+// HooksConf holds commands run around ADD and DEL, given the attachment on
+// stdin as JSON. Each is the command's absolute path followed by its
+// arguments; no shell is involved.
+type HooksConf struct {
+	// PreAdd runs before ADD changes anything; failing aborts the ADD
+	PreAdd []string `json:"preAdd,omitempty"`
+	// PostAdd runs once the attachment is set up; failing rolls it back
+	PostAdd []string `json:"postAdd,omitempty"`
+	// PreDel runs before DEL removes anything; a failure is reported on
+	// stderr and the DEL goes on
+	PreDel []string `json:"preDel,omitempty"`
+	// PostDel runs once the attachment is gone; a failure is reported on
+	// stderr and the DEL goes on
+	PostDel []string `json:"postDel,omitempty"`
+	// Timeout is how long, in seconds, a hook may run before it is killed
+	// and counts as failed (default: 10)
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// validate returns the problems with the hook settings
+func (h *HooksConf) validate() []string {
+	var problems []string
+	for _, hook := range []struct {
+		name string
+		argv []string
+	}{
+		{hookPreAdd, h.PreAdd},
+		{hookPostAdd, h.PostAdd},
+		{hookPreDel, h.PreDel},
+		{hookPostDel, h.PostDel},
+	} {
+		if hook.argv == nil {
+			continue
+		}
+		if len(hook.argv) == 0 || !filepath.IsAbs(hook.argv[0]) {
+			problems = append(problems, fmt.Sprintf("hooks.%s must start with the command's absolute path", hook.name))
+		}
+	}
+	if h.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("hooks.timeout %d must not be negative", h.Timeout))
+	}
+	return problems
+}
+
+// hookContext is the attachment as hooks receive it on stdin
+type hookContext struct {
+	Hook        string   `json:"hook"`
+	Network     string   `json:"network"`
+	Mode        string   `json:"mode"`
+	VxlanID     int      `json:"vxlanID"`
+	ContainerID string   `json:"containerID"`
+	Netns       string   `json:"netns,omitempty"`
+	IfName      string   `json:"ifName"`
+	Pod         *hookPod `json:"pod,omitempty"`
+	// IPs are the attachment's addresses: those allocated for postAdd,
+	// held for preDel and released for postDel
+	IPs []string `json:"ips,omitempty"`
+	// Result is the CNI result ADD returns, for postAdd
+	Result *current.Result `json:"result,omitempty"`
+}
+
+// hookPod identifies the Kubernetes pod of the attachment
+type hookPod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// newHookContext returns the context of the attachment for a hook
+func newHookContext(hook string, conf *PluginConf, args *skel.CmdArgs, envArgs *EnvArgs, ips []net.IP) *hookContext {
+	hc := &hookContext{
+		Hook:        hook,
+		Network:     conf.Name,
+		Mode:        conf.Mode,
+		VxlanID:     conf.VxlanID,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+	}
+	if owner := envArgs.owner(); !owner.IsEmpty() {
+		hc.Pod = &hookPod{Namespace: owner.PodNamespace, Name: owner.PodName, UID: owner.PodUID}
+	}
+	for _, ip := range ips {
+		hc.IPs = append(hc.IPs, ip.String())
+	}
+	return hc
+}
+
+// command returns the command configured for the hook, or nil
+func (h *HooksConf) command(hook string) []string {
+	if h == nil {
+		return nil
+	}
+	switch hook {
+	case hookPreAdd:
+		return h.PreAdd
+	case hookPostAdd:
+		return h.PostAdd
+	case hookPreDel:
+		return h.PreDel
+	case hookPostDel:
+		return h.PostDel
+	}
+	return nil
+}
+
+// hasHook reports whether a command is configured for the hook
+func (c *PluginConf) hasHook(hook string) bool {
+	return len(c.Hooks.command(hook)) > 0
+}
+
+// runHook runs the command configured for the context's hook, if any, with
+// the context on stdin. The plugin's environment, CNI_* variables included,
+// is passed on. Output is only kept to report failures, as stdout carries
+// the plugin's result.
+func runHook(ctx context.Context, conf *PluginConf, hc *hookContext) error {
+	argv := conf.Hooks.command(hc.Hook)
+	if len(argv) == 0 {
+		return nil
+	}
+	input, err := json.Marshal(hc)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("failed to marshal %s hook context", hc.Hook), err)
+	}
+
+	timeout := defaultHookTimeout
+	if conf.Hooks.Timeout > 0 {
+		timeout = time.Duration(conf.Hooks.Timeout) * time.Second
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait for children the hook left holding the output open
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return deadlineError(ctx, fmt.Sprintf("running %s hook %s", hc.Hook, argv[0]))
+		}
+		if hookCtx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		if out := strings.TrimSpace(output.String()); out != "" {
+			if len(out) > maxHookOutput {
+				out = out[len(out)-maxHookOutput:]
+			}
+			err = fmt.Errorf("%v: %s", err, out)
+		}
+		return newError(types.ErrInternal, fmt.Sprintf("%s hook %s failed", hc.Hook, argv[0]), err)
+	}
+	return nil
+}
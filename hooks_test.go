@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestRunHook(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "context.json")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = fail ] && { echo \"no capacity\" >&2; exit 3; }\n[ \"$1\" = hang ] && exec sleep 10\ncat > \""+out+"\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &PluginConf{VxlanID: 42, Mode: modeBridge, Hooks: &HooksConf{PostAdd: []string{script}}}
+	conf.Name = "xvm-network"
+	args := &skel.CmdArgs{ContainerID: "abc", Netns: "/var/run/netns/abc", IfName: "eth0"}
+	envArgs := &EnvArgs{}
+	envArgs.K8S_POD_NAMESPACE = "default"
+	envArgs.K8S_POD_NAME = "web"
+
+	// The hook receives the attachment on stdin
+	hc := newHookContext(hookPostAdd, conf, args, envArgs, []net.IP{net.ParseIP("10.244.0.2")})
+	if err := runHook(context.Background(), conf, hc); err != nil {
+		t.Fatalf("Hook failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Hook didn't run: %v", err)
+	}
+	var got hookContext
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Invalid hook context %q: %v", data, err)
+	}
+	if got.Hook != hookPostAdd || got.Network != "xvm-network" || got.VxlanID != 42 || got.ContainerID != "abc" ||
+		got.Pod == nil || got.Pod.Name != "web" || len(got.IPs) != 1 || got.IPs[0] != "10.244.0.2" {
+		t.Fatalf("Unexpected hook context %s", data)
+	}
+
+	// Hooks that aren't configured don't run
+	if err := runHook(context.Background(), conf, newHookContext(hookPreDel, conf, args, envArgs, nil)); err != nil {
+		t.Fatalf("Expected unconfigured hook to be skipped, got: %v", err)
+	}
+
+	// Failures carry the hook's output
+	conf.Hooks.PostAdd = []string{script, "fail"}
+	err = runHook(context.Background(), conf, hc)
+	if err == nil || !strings.Contains(err.(*types.Error).Details, "no capacity") {
+		t.Fatalf("Expected hook failure with its output, got: %v", err)
+	}
+
+	// Hooks running past the timeout are killed
+	conf.Hooks.PostAdd = []string{script, "hang"}
+	conf.Hooks.Timeout = 1
+	err = runHook(context.Background(), conf, hc)
+	if err == nil || !strings.Contains(err.(*types.Error).Details, "timed out") {
+		t.Fatalf("Expected hook to time out, got: %v", err)
+	}
+}
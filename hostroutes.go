@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// installsHostRoutes reports whether the attachment gets host routes, as
+// configured or to reach it through its VLAN's gateway interface
+func (c *PluginConf) installsHostRoutes() bool {
+	return c.HostRoutes || c.gatewayVLAN() != 0
+}
+
+// hostRouteLinkName returns the device the host routes to the attachment go
+// through: the gateway interface of its VLAN, if any, or the bridge or shim
+func hostRouteLinkName(conf *PluginConf) string {
+	if vid := conf.gatewayVLAN(); vid != 0 {
+		return gatewayVLANName(conf, vid)
+	}
+	return l2Name(conf)
+}
+
+// hostRoute returns the host route to a container address through the
+// device the network's containers attach to, sourced from src if set, in the
+// network's routing table
+func hostRoute(conf *PluginConf, link netlink.Link, ip, src net.IP) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostRouteDst(ip),
+		Src:       src,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     conf.routeTable(),
+	}
+}
+
+// hostRouteDst returns the single-address prefix of ip
+func hostRouteDst(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// hostAddress returns the node's first global address on the host interface
+// in the family of ip, or nil if it has none
+func hostAddress(conf *PluginConf, ip net.IP) (net.IP, error) {
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return nil, err
+	}
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			return addr.IP, nil
+		}
+	}
+	return nil, nil
+}
+
+// hostAddresses returns the node's addresses host routes are sourced from
+func hostAddresses(conf *PluginConf) ([]net.IP, error) {
+	var addrs []net.IP
+	for _, family := range []net.IP{net.IPv4zero, net.IPv6zero} {
+		addr, err := hostAddress(conf, family)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// setupHostRoutes installs host routes to the container's addresses, so
+// processes on the node, e.g. the kubelet probing a pod, reach the container
+// from the node's own address rather than the gateway address shared by
+// every node of the network. Without hostRoutes, they only lead to the
+// container's VLAN.
+func setupHostRoutes(conf *PluginConf, containerIPs []*current.IPConfig, undo *rollback) error {
+	name := hostRouteLinkName(conf)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to get interface %s", name), err)
+	}
+	for _, ipc := range containerIPs {
+		ip := ipc.Address.IP
+		var src net.IP
+		if conf.HostRoutes {
+			if src, err = hostAddress(conf, ip); err != nil {
+				return netlinkError("failed to get host address", err)
+			}
+		}
+		route := hostRoute(conf, link, ip, src)
+		if err := retry.Do(func() error { return netlink.RouteReplace(route) }); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add host route to %s", ip), err)
+		}
+		undo.add(func() error { return deleteHostRoutes(conf, []net.IP{ip}) })
+	}
+	return nil
+}
+
+// deleteHostRoutes removes the host routes to released addresses, through
+// whichever device they go
+func deleteHostRoutes(conf *PluginConf, ips []net.IP) error {
+	for _, ip := range ips {
+		route := &netlink.Route{Dst: hostRouteDst(ip), Scope: netlink.SCOPE_LINK, Table: conf.routeTable()}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return netlinkError(fmt.Sprintf("failed to delete host route to %s", ip), err)
+		}
+	}
+	return nil
+}
+
+// checkHostRoutes verifies that the host routes to the attachment's
+// addresses are installed
+func checkHostRoutes(conf *PluginConf, ipams []*ipam.IPAM, key string) error {
+	name := hostRouteLinkName(conf)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", name), err)
+	}
+	for _, ipamInstance := range ipams {
+		ip, ok := ipamInstance.Allocations[key]
+		if !ok {
+			continue
+		}
+		want := hostRoute(conf, link, ip, nil)
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, want, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return netlinkError("failed to list host routes", err)
+		}
+		if len(routes) == 0 {
+			return newError(types.ErrInternal, fmt.Sprintf("no host route to %s", ip), nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// releaseRebootedAttachments releases the addresses and port mappings of the
+// attachments a reboot took away, those whose network namespace is gone,
+// when the first ADD after the reboot sets up the network again. The caller
+// holds the network lock.
+func releaseRebootedAttachments(conf *PluginConf, ipams []*ipam.IPAM) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	bootID, err := hoststate.BootID()
+	if err != nil {
+		return newError(types.ErrInternal, "failed to get boot ID", err)
+	}
+	if !state.Rebooted(bootID) {
+		return nil
+	}
+	for _, key := range state.Stale() {
+		if err := state.Release(dir, key, ipams); err != nil {
+			return newError(types.ErrInternal, "failed to release attachment gone with the reboot", err)
+		}
+	}
+	state.BootID = bootID
+	if err := state.Save(dir); err != nil {
+		return newError(types.ErrInternal, "failed to save host state", err)
+	}
+	return nil
+}
+
+// recordAttachment records the attachment's network namespace and the
+// current boot in the network's host state. The caller holds the network
+// lock.
+func recordAttachment(conf *PluginConf, key, netns string) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	bootID, err := hoststate.BootID()
+	if err != nil {
+		return newError(types.ErrInternal, "failed to get boot ID", err)
+	}
+	if state.BootID != bootID {
+		state.BootID = bootID
+		state.Attachments[key] = netns
+		if err := state.Save(dir); err != nil {
+			return newError(types.ErrInternal, "failed to save host state", err)
+		}
+		return nil
+	}
+	if err := state.Attach(dir, key, netns); err != nil {
+		return newError(types.ErrInternal, "failed to save host state", err)
+	}
+	return nil
+}
+
+// forgetAttachments removes the attachments holding no address anymore from
+// the network's host state. The caller holds the network lock.
+func forgetAttachments(conf *PluginConf, ipams []*ipam.IPAM) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	changed := false
+	for key := range state.Attachments {
+		if !holdsAddress(ipams, key) {
+			delete(state.Attachments, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := state.Save(dir); err != nil {
+		return newError(types.ErrInternal, "failed to save host state", err)
+	}
+	return nil
+}
+
+// holdsAddress reports whether the attachment holds an address in any of
+// the network's subnets
+func holdsAddress(ipams []*ipam.IPAM, key string) bool {
+	for _, i := range ipams {
+		if _, ok := i.Allocations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+const (
+	// lockTimeout bounds how long an invocation waits for another one to
+	// finish setting up the network's shared devices
+	lockTimeout = 30 * time.Second
+	// lockPollInterval is how often a busy lock is retried
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// lockNetwork takes the node-wide lock of the network's shared devices, so
+// concurrent invocations don't race on creating and addressing them. The
+// lock is kept in the network's directory, or keyed by VNI for networks
+// without a name, as the devices are. It returns the function releasing the
+// lock, which may be called more than once.
+func lockNetwork(ctx context.Context, conf *PluginConf) (func(), error) {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, newError(types.ErrIOFailure, "failed to create data directory", err)
+	}
+	path := ipam.LockFile(conf.DataDir, conf.Name, conf.VxlanID)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, newError(types.ErrIOFailure, "failed to open network lock", err)
+	}
+
+	// Poll rather than block, so a stuck invocation can't hang every
+	// following one
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, newError(types.ErrIOFailure, "failed to take network lock", err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, newError(types.ErrTryAgainLater, fmt.Sprintf("timed out waiting for network lock %s", path), nil)
+		}
+		if ctx.Err() != nil {
+			file.Close()
+			return nil, deadlineError(ctx, fmt.Sprintf("waiting for network lock %s", path))
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Closing the file releases the lock
+	var once sync.Once
+	return func() { once.Do(func() { file.Close() }) }, nil
+}
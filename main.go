@@ -4,9 +4,12 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"runtime"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -15,27 +18,21 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/vishvananda/netlink"
+	nlns "github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 
-	"github.com/nohns/xvm-cni/pkg/ipam"
-	"github.com/nohns/xvm-cni/pkg/vxlan"
+	"github.com/nohns/xvm-cni/pkg/announce"
+	"github.com/nohns/xvm-cni/pkg/netops"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/retry"
+	"github.com/nohns/xvm-cni/pkg/vrf"
 )
 
-// PluginConf represents the plugin configuration
-type PluginConf struct {
-	types.NetConf
-
-	// Plugin-specific fields
-	HostInterface string `json:"hostInterface"`
-	VxlanID       int    `json:"vxlanID"`
-	MTU           int    `json:"mtu"`
-	Subnet        string `json:"subnet"`
-	Gateway       string `json:"gateway"`
-	DataDir       string `json:"dataDir"`
-}
+// ops makes the plugin's netlink requests; tests replace it with a fake
+var ops netops.Ops = netops.Kernel{}
 
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
@@ -45,263 +42,1051 @@ func init() {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("xvm-cni"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:   audited("ADD", bounded("ADD", cmdAdd)),
+		Check: audited("CHECK", bounded("CHECK", cmdCheck)),
+		Del:   audited("DEL", bounded("DEL", cmdDel)),
+		GC:    audited("GC", bounded("GC", cmdGC)),
+		// Runtimes poll STATUS, which would flood the audit log
+		Status: bounded("STATUS", cmdStatus),
+	}, advertisedVersions(), bv.BuildString("xvm-cni"))
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	// Parse network configuration
-	conf := &PluginConf{}
-	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to parse network configuration: %v", err)
+// advertisedVersions returns the CNI versions for the network configuration
+// on stdin, which is left for skel to read again. Without CNI_COMMAND, skel
+// prints its usage rather than reading stdin.
+func advertisedVersions() version.PluginInfo {
+	if os.Getenv("CNI_COMMAND") == "" {
+		return version.All
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return version.All
 	}
+	stdin, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return version.All
+	}
+	go func() {
+		w.Write(stdin)
+		w.Close()
+	}()
+	os.Stdin = r
+	return pluginVersions(stdin)
+}
 
-	// Set default values if not specified
-	if conf.VxlanID == 0 {
-		conf.VxlanID = vxlan.DefaultVxlanVNI
+func cmdAdd(ctx context.Context, args *skel.CmdArgs) error {
+	// Parse and validate network configuration
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
 	}
-	if conf.MTU == 0 {
-		conf.MTU = vxlan.DefaultMTU
+	if err := conf.Validate(); err != nil {
+		return err
 	}
-	if conf.HostInterface == "" {
-		return fmt.Errorf("hostInterface must be specified")
+	// Attach the pods of namespaces with a VNI of their own to its segment
+	conf, err = attachmentNetwork(conf, args)
+	if err != nil {
+		return err
 	}
-	if conf.Subnet == "" {
-		return fmt.Errorf("subnet must be specified")
+	result, p, err := addAttachment(ctx, conf, args)
+	if err != nil {
+		return err
 	}
-	if conf.Gateway == "" {
-		return fmt.Errorf("gateway must be specified")
+	if len(conf.Attachments) > 0 {
+		if result, p, err = addFurtherAttachments(ctx, conf, args, result, p); err != nil {
+			return err
+		}
 	}
+	if p != nil {
+		return printPlan(p)
+	}
+	return result.Print()
+}
 
-	// Enable IP forwarding
-	_, err := sysctl.Sysctl("net.ipv4.ip_forward", "1")
+// addAttachment attaches the container to the network, and returns the
+// result or, in dry-run mode, the plan
+func addAttachment(ctx context.Context, conf *PluginConf, args *skel.CmdArgs) (_ types.Result, _ *plan, err error) {
+	conf.skipSecondaryDefaultRoute()
+
+	// Start from the previous plugin's result when running in a chain
+	result, err := prevResult(conf, args)
 	if err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+		return nil, nil, err
 	}
 
-	// Setup VXLAN network
-	vxlanConfig := &vxlan.VxlanConfig{
-		HostInterface: conf.HostInterface,
-		VxlanID:       conf.VxlanID,
-		MTU:           conf.MTU,
+	// Parse CNI_ARGS and resolve the requested container MAC, if any
+	envArgs, err := parseEnvArgs(args.Args)
+	if err != nil {
+		return nil, nil, err
 	}
-	vxlanIface, err := vxlan.SetupVxlan(vxlanConfig)
+	mac, err := containerMAC(conf, envArgs)
 	if err != nil {
-		return fmt.Errorf("failed to setup VXLAN: %v", err)
+		return nil, nil, err
 	}
 
-	// Parse subnet
-	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	// Read the pod's annotations, if the network honors them
+	pod, err := lookupPod(ctx, conf, envArgs)
 	if err != nil {
-		return fmt.Errorf("invalid subnet: %v", err)
+		return nil, nil, err
+	}
+	pinned, err := pinnedIPs(pod, args.IfName)
+	if err != nil {
+		return nil, nil, err
+	}
+	annotated, err := annotatedQoS(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	if annotated != nil {
+		annotated.apply(conf)
+		if err := conf.Validate(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Configure VXLAN network
-	if err := vxlan.ConfigureVxlanNetwork(vxlanIface, subnet); err != nil {
-		return fmt.Errorf("failed to configure VXLAN network: %v", err)
+	// Only print the planned changes in dry-run mode
+	if conf.dryRun() {
+		p, err := planAdd(conf, args, envArgs, pod, result, mac)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, p, nil
 	}
 
-	// Initialize IPAM
-	ipamConfig := &ipam.Config{
-		Subnet:  conf.Subnet,
-		Gateway: conf.Gateway,
-		DataDir: conf.DataDir,
+	// Let the site's hook veto the attachment before anything changes
+	if err := runHook(ctx, conf, newHookContext(hookPreAdd, conf, args, envArgs, nil)); err != nil {
+		return nil, nil, err
 	}
-	ipamInstance, err := ipam.New(ipamConfig)
+
+	// Undo the changes made so far if a later step fails. Deferred before
+	// taking the network lock, as undoing shared changes takes it again,
+	// and before closing the container's namespace, which the undoing of
+	// the container's interface enters.
+	var netns ns.NetNS
+	var contHandle *netlink.Handle
+	undo := &rollback{}
+	defer func() {
+		undo.runOnError(err)
+		if contHandle != nil {
+			contHandle.Close()
+		}
+		if netns != nil {
+			netns.Close()
+		}
+	}()
+
+	// Set up the state shared by the network's containers and allocate the
+	// addresses one invocation at a time, so GC can't remove the devices
+	// before the allocation holds on to them
+	unlock, err := lockNetwork(ctx, conf)
 	if err != nil {
-		return fmt.Errorf("failed to initialize IPAM: %v", err)
+		return nil, nil, err
 	}
-
-	// Allocate IP for container
-	containerIP, err := ipamInstance.Allocate(args.ContainerID)
+	defer unlock()
+	if !networkExists(conf) {
+		undo.add(func() error { return removeUnusedNetwork(conf) })
+	}
+	vxlanIface, br, l2, err := setupNetwork(conf)
 	if err != nil {
-		return fmt.Errorf("failed to allocate IP: %v", err)
+		return nil, nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, nil, deadlineError(ctx, "setting up the network")
 	}
 
-	// Create veth pair
-	netns, err := ns.GetNS(args.Netns)
+	// Allocate IPs for container
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Release the addresses of the attachments gone with a reboot first
+	if err := releaseRebootedAttachments(conf, ipams); err != nil {
+		return nil, nil, err
+	}
+	// Allocate from the range of the pod's namespace, if any
+	restrictToNamespace(conf, ipams, envArgs.owner().PodNamespace)
+	key := attachmentKey(args.ContainerID, args.IfName)
+	held := heldIPs(ipams, key)
+	undo.add(func() error { return rollbackIPs(conf, key, held) })
+	containerIPs, err := allocateIPs(ipams, key, requestedIPs(conf, envArgs, pinned), envArgs.owner())
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return nil, nil, err
+	}
+	sandbox := ""
+	if conf.hasSandbox() {
+		sandbox = args.Netns
+	}
+	if err := recordAttachment(conf, key, sandbox); err != nil {
+		return nil, nil, err
 	}
-	defer netns.Close()
 
-	hostVeth, containerVeth, err := ip.SetupVeth(args.IfName, conf.MTU, "", netns)
+	// Masquerade traffic leaving the overlay
+	if conf.IPMasq {
+		if err := setupIPMasq(conf, ipams); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Filter traffic leaving the overlay
+	if err := setupEgressRules(conf); err != nil {
+		return nil, nil, err
+	}
+
+	// Forward the node's ports the runtime maps to the container
+	if len(conf.RuntimeConfig.PortMappings) > 0 {
+		if err := setupPortMappings(conf, args, containerIPs, undo); err != nil {
+			return nil, nil, err
+		}
+	}
+	unlock()
+	if ctx.Err() != nil {
+		return nil, nil, deadlineError(ctx, "allocating the addresses")
+	}
+
+	// Open container network namespace
+	netns, err = ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to setup veth pair: %v", err)
+		return nil, nil, newError(types.ErrInvalidNetNS, fmt.Sprintf("failed to open netns %q", args.Netns), err)
 	}
 
-	// Configure container network namespace
-	err = ns.WithNetNSPath(args.Netns, func(netns ns.NetNS) error {
-		// Get container veth
-		link, err := netlink.LinkByName(args.IfName)
+	// Create the container interface, with the requested MAC
+	if mac != "" && !conf.hasSandbox() {
+		return nil, nil, configError("a MAC address can't be requested without a container namespace", nil)
+	}
+	// Look into it through a netlink handle of its own rather than entering
+	// it, which ADD does once to configure the container interface
+	if conf.hasSandbox() {
+		contHandle, err = netlink.NewHandleAt(nlns.NsHandle(netns.Fd()), unix.NETLINK_ROUTE)
 		if err != nil {
-			return fmt.Errorf("failed to get container veth: %v", err)
+			return nil, nil, netlinkError(fmt.Sprintf("failed to open netns %q", args.Netns), err)
 		}
+		if err := reclaimContainerIface(conf, args, netns, contHandle, held); err != nil {
+			return nil, nil, err
+		}
+	}
+	var hostVeth, containerIface net.Interface
+	var vhostSocket string
+	switch {
+	case conf.Mode == modeBridge:
+		hostVeth, containerIface, err = attachVeth(conf, args, br, mac, netns, contHandle, undo)
+	case conf.Mode == modeTap:
+		containerIface, err = attachTap(conf, args, br, undo)
+	case conf.Mode == modeOVS && conf.OVS.VhostUser:
+		containerIface, vhostSocket, err = attachVhostUser(conf, args, undo)
+	case conf.Mode == modeOVS:
+		hostVeth, containerIface, err = attachOVSVeth(conf, args, mac, netns, contHandle, undo)
+	case conf.Mode == modeSRIOV:
+		hostVeth, containerIface, err = attachSRIOV(conf, args, br, mac, netns, undo)
+	default:
+		containerIface, err = attachSublink(conf, args, vxlanIface, mac, netns, undo)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, nil, deadlineError(ctx, "attaching the container")
+	}
 
-		// Add IP address to container veth
-		addr := &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   containerIP,
-				Mask: subnet.Mask,
-			},
+	// Let the attachment send only from its own MAC and addresses
+	if conf.AntiSpoofing {
+		if err := setupAntiSpoofing(conf, args, hostVeth, containerIface, containerIPs, undo); err != nil {
+			return nil, nil, err
 		}
-		if err := netlink.AddrAdd(link, addr); err != nil {
-			return fmt.Errorf("failed to add IP address to container veth: %v", err)
+	}
+
+	// Redirect the traffic to and from the attachment past the bridge
+	if conf.fastPath() {
+		if err := setupFastPath(conf, hostVeth, containerIface, undo); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		// Set container veth up
-		if err := netlink.LinkSetUp(link); err != nil {
-			return fmt.Errorf("failed to set container veth up: %v", err)
+	// Mark the attachment's traffic for the underlay's QoS
+	if conf.dscp() != nil {
+		if err := setupDSCP(conf, args, hostVeth, containerIface, undo); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		// Add default route to container
-		gateway := net.ParseIP(conf.Gateway)
-		if gateway == nil {
-			return fmt.Errorf("invalid gateway IP: %s", conf.Gateway)
+	// Cap the attachment's bandwidth
+	if !conf.rateLimits().isEmpty() {
+		if err := setupRateLimits(conf, args, hostVeth, containerIface, undo); err != nil {
+			return nil, nil, err
 		}
-		defaultRoute := &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Gw:        gateway,
-			Dst:       nil, // Default route
+	}
+
+	// Filter the attachment's traffic by the network policy
+	if conf.Policy != nil {
+		if err := setupPolicy(conf, args, envArgs, hostVeth, containerIface, undo); err != nil {
+			return nil, nil, err
 		}
-		if err := netlink.RouteAdd(defaultRoute); err != nil {
-			return fmt.Errorf("failed to add default route: %v", err)
+	}
+
+	// Drop connections to the attachment outside its allowed ports
+	if len(conf.allowedIngressPorts()) > 0 {
+		if err := setupPortAllowlist(conf, args, hostVeth, containerIface, undo); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		return nil
+	// Let processes on the node reach the container from the node address
+	if conf.installsHostRoutes() {
+		if err := setupHostRoutes(conf, containerIPs, undo); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Let routers of the underlay resolve the container's IPv6 addresses
+	if conf.NDPProxy {
+		if err := setupNDPProxy(conf, containerIPs, undo); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Configure container network namespace. VM runtimes configure the
+	// guest behind a tap device or vhost-user port themselves.
+	if ctx.Err() != nil {
+		return nil, nil, deadlineError(ctx, "setting up the port")
+	}
+	if conf.hasSandbox() {
+		if err := configureContainer(conf, args, netns, result, containerIPs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Advertise the IPv6 gateway, which the new container takes as its
+	// default router
+	if ra := conf.RouterAdvertisements; ra != nil && !ra.External {
+		var ips []net.IP
+		for _, ipc := range containerIPs {
+			ips = append(ips, ipc.Address.IP)
+		}
+		if err := advertiseRouter(conf, l2, hostIfaces(conf, hostVeth, containerIface), containerIface.HardwareAddr, ips); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Prepare result, appending to the previous result when chained
+	containerIndex := len(result.Interfaces)
+	if conf.hasSandbox() {
+		iface := &current.Interface{
+			Name:    args.IfName,
+			Mac:     containerIface.HardwareAddr.String(),
+			Mtu:     conf.linkMTU(),
+			Sandbox: args.Netns,
+		}
+		if conf.Mode == modeSRIOV {
+			iface.PciID = conf.RuntimeConfig.DeviceID
+		}
+		result.Interfaces = append(result.Interfaces, iface)
+	} else {
+		// The port lives on the host for the VM runtime to pick up
+		iface := &current.Interface{
+			Name:       containerIface.Name,
+			Mac:        containerIface.HardwareAddr.String(),
+			SocketPath: vhostSocket,
+		}
+		if conf.Mode == modeTap {
+			iface.Mtu = conf.linkMTU()
+		}
+		result.Interfaces = append(result.Interfaces, iface)
+	}
+	if hostVeth.Name != "" {
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: hostVeth.Name,
+			Mac:  hostVeth.HardwareAddr.String(),
+		})
+	}
+	if vxlanIface != nil {
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: vxlanIface.Attrs().Name,
+			Mac:  vxlanIface.Attrs().HardwareAddr.String(),
+		})
+	}
+	result.Interfaces = append(result.Interfaces, &current.Interface{
+		Name: l2.Attrs().Name,
+		Mac:  l2.Attrs().HardwareAddr.String(),
 	})
+	for _, ipc := range containerIPs {
+		ipc.Interface = current.Int(containerIndex)
+		result.IPs = append(result.IPs, ipc)
+	}
+	for _, route := range conf.containerRoutes() {
+		result.Routes = append(result.Routes, route.cniRoute(net.ParseIP(conf.Gateway)))
+	}
+	if dns := conf.dnsConfig(); !dns.IsEmpty() {
+		result.DNS = dns
+	}
+
+	// Hand the attachment to the site's hook; failing rolls it back
+	var ips []net.IP
+	for _, ipc := range containerIPs {
+		ips = append(ips, ipc.Address.IP)
+	}
+	hc := newHookContext(hookPostAdd, conf, args, envArgs, ips)
+	hc.Result = result
+	if err := runHook(ctx, conf, hc); err != nil {
+		return nil, nil, err
+	}
+
+	// Undo the attachment rather than report it once the runtime stopped
+	// waiting for it
+	if ctx.Err() != nil {
+		return nil, nil, deadlineError(ctx, "setting up the attachment")
+	}
+
+	// Convert the result to the runtime's CNI version and record it for DEL,
+	// CHECK and GC
+	versioned, err := versionedResult(result, conf.CNIVersion)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if err := saveResult(conf, args, versioned, hostVeth, containerIface, containerIPs, annotated); err != nil {
+		return nil, nil, err
 	}
 
-	// Connect host veth to VXLAN bridge
-	hostLink, err := netlink.LinkByName(hostVeth.Name)
-	if err != nil {
-		return fmt.Errorf("failed to get host veth: %v", err)
-	}
-	if err := netlink.LinkSetMaster(hostLink, vxlanIface); err != nil {
-		return fmt.Errorf("failed to connect host veth to VXLAN: %v", err)
-	}
-
-	// Prepare result
-	result := &current.Result{
-		CNIVersion: conf.CNIVersion,
-		Interfaces: []*current.Interface{
-			{
-				Name:    args.IfName,
-				Mac:     containerVeth.HardwareAddr.String(),
-				Sandbox: args.Netns,
-			},
-			{
-				Name: hostVeth.Name,
-				Mac:  hostVeth.HardwareAddr.String(),
-			},
-			{
-				Name: vxlanIface.Attrs().Name,
-				Mac:  vxlanIface.Attrs().HardwareAddr.String(),
-			},
-		},
-		IPs: []*current.IPConfig{
-			{
-				Interface: current.Int(0),
-				Address: net.IPNet{
-					IP:   containerIP,
-					Mask: subnet.Mask,
-				},
-				Gateway: net.ParseIP(conf.Gateway),
-			},
-		},
-	}
-
-	return types.PrintResult(result, conf.CNIVersion)
+	return versioned, nil, nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+// configureContainer assigns the addresses and routes to the container
+// interface inside the container network namespace
+func configureContainer(conf *PluginConf, args *skel.CmdArgs, netns ns.NetNS, result *current.Result, containerIPs []*current.IPConfig) error {
+	return netns.Do(func(ns.NetNS) error {
+		return setupContainerIface(conf, args, result, containerIPs)
+	})
+}
+
+// setupContainerIface assigns the addresses and routes to the container
+// interface in the current network namespace
+func setupContainerIface(conf *PluginConf, args *skel.CmdArgs, result *current.Result, containerIPs []*current.IPConfig) error {
+	// Get container veth
+	link, err := ops.LinkByName(args.IfName)
+	if err != nil {
+		return netlinkError("failed to get container veth", err)
+	}
+
+	// Keep IPv4-only containers free of link-local IPv6 traffic
+	if conf.DisableIPv6 {
+		if err := disableIPv6(args.IfName); err != nil {
+			return newError(types.ErrInternal, "failed to disable IPv6", err)
+		}
+	}
+
+	// Apply network tunables before the interface carries traffic
+	if offloads := conf.vethOffloads(); !offloads.IsEmpty() {
+		if err := offload.Apply(args.IfName, offloads); err != nil {
+			return netlinkError("failed to tune container veth", err)
+		}
+	}
+	if err := applySysctls(conf.containerSysctls()); err != nil {
+		return newError(types.ErrInternal, "failed to apply container sysctls", err)
+	}
+	if conf.RouterAdvertisements != nil {
+		if err := applySysctls(raSysctls(conf, args.IfName)); err != nil {
+			return newError(types.ErrInternal, "failed to accept router advertisements", err)
+		}
+	}
+
+	// Add IP addresses to container veth. IPv6 addresses skip duplicate
+	// address detection, as IPAM already made them unique, so they are
+	// usable, and can be announced, right away rather than tentative.
+	for _, ipc := range containerIPs {
+		addr := &netlink.Addr{IPNet: &ipc.Address}
+		if ipc.Address.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := retry.Do(func() error { return ops.AddrAdd(link, addr) }); err != nil {
+			return netlinkError("failed to add IP address to container veth", err)
+		}
+	}
+
+	// Set container veth up
+	if err := ops.LinkSetUp(link); err != nil {
+		return netlinkError("failed to set container veth up", err)
+	}
+
+	// Add default route to container
+	gateway := net.ParseIP(conf.Gateway)
+	if gateway == nil {
+		return configError(fmt.Sprintf("invalid gateway IP: %s", conf.Gateway), nil)
+	}
+	if dr := conf.defaultRoute(); !dr.Disabled {
+		// Unless it has a metric to tell it apart, skip it if a previous
+		// plugin or another attachment already owns the default route
+		installed := false
+		if dr.Metric == 0 {
+			installed, err = defaultRouteInstalled(netlink.FAMILY_V4)
+			if err != nil {
+				return netlinkError("failed to list routes", err)
+			}
+			installed = installed || hasDefaultRoute(result, false)
+		}
+		// Let the kernel skip gateways whose neighbor entry failed,
+		// withdrawing dead gateway nodes from the ECMP route
+		if len(dr.Gateways) > 1 {
+			if err := applySysctls(map[string]string{"net.ipv4.fib_multipath_use_neigh": "1"}); err != nil {
+				return newError(types.ErrInternal, "failed to enable neighbor-aware multipath routing", err)
+			}
+		}
+		if !installed {
+			defaultRoute := dr.netlinkRoute(link.Attrs().Index, gateway)
+			if err := retry.Do(func() error { return ops.RouteAdd(defaultRoute) }); err != nil {
+				return netlinkError("failed to add default route", err)
+			}
+		}
+	}
+
+	// Add the IPv6 default route of dual-stack networks, skipped the same
+	// way
+	if route := conf.ipv6DefaultRoute(link.Attrs().Index); route != nil {
+		installed := false
+		if route.Priority == 0 {
+			installed, err = defaultRouteInstalled(netlink.FAMILY_V6)
+			if err != nil {
+				return netlinkError("failed to list routes", err)
+			}
+			installed = installed || hasDefaultRoute(result, true)
+		}
+		if !installed {
+			if err := retry.Do(func() error { return ops.RouteAdd(route) }); err != nil {
+				return netlinkError("failed to add IPv6 default route", err)
+			}
+		}
+	}
+
+	// Add static routes to container
+	for _, route := range conf.containerRoutes() {
+		r := route.netlinkRoute(link.Attrs().Index, gateway)
+		if err := retry.Do(func() error { return ops.RouteAdd(r) }); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add route to %s", route.Dst), err)
+		}
+	}
+
+	// Announce the addresses so the bridge and remote VTEPs learn the
+	// container's MAC right away. This is best effort: without it they
+	// learn it from the container's first packets.
+	var ips []net.IP
+	for _, ipc := range containerIPs {
+		ips = append(ips, ipc.Address.IP)
+	}
+	if iface, err := net.InterfaceByName(args.IfName); err == nil {
+		_ = announce.Addresses(iface, ips)
+	}
+
+	return nil
+}
+
+// deleteContainerIface removes the static routes and the container interface
+// in the current network namespace, and returns the interface's MAC. VFs are
+// kept, as they can't be deleted. An interface already gone is skipped.
+func deleteContainerIface(conf *PluginConf, args *skel.CmdArgs) (net.HardwareAddr, error) {
+	link, err := ops.LinkByName(args.IfName)
+	if err != nil {
+		return nil, nil // Already removed
+	}
+	mac := link.Attrs().HardwareAddr
+	for _, route := range conf.containerRoutes() {
+		r := route.netlinkRoute(link.Attrs().Index, net.ParseIP(conf.Gateway))
+		if err := ops.RouteDel(r); err != nil && !errors.Is(err, unix.ESRCH) {
+			return mac, netlinkError(fmt.Sprintf("failed to delete route to %s", route.Dst), err)
+		}
+	}
+	// A VF can't be deleted, it is returned to the host
+	if conf.Mode == modeSRIOV {
+		return mac, nil
+	}
+	if err := ops.LinkDel(link); err != nil && !errors.Is(err, unix.ENODEV) {
+		return mac, netlinkError("failed to delete container veth", err)
+	}
+	return mac, nil
+}
+
+func cmdDel(ctx context.Context, args *skel.CmdArgs) error {
 	// Parse network configuration
-	conf := &PluginConf{}
-	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to parse network configuration: %v", err)
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	conf, err = attachmentNetwork(conf, args)
+	if err != nil {
+		return err
+	}
+	// Remove the further attachments first, in the reverse order of ADD
+	for i := len(conf.Attachments) - 1; i >= 0; i-- {
+		a := conf.Attachments[i]
+		if err := delAttachment(ctx, conf.attached(a), attachedArgs(args, a)); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return deadlineError(ctx, "removing the further attachments")
+		}
+	}
+	return delAttachment(ctx, conf, args)
+}
+
+// delAttachment detaches the container from the network
+func delAttachment(ctx context.Context, conf *PluginConf, args *skel.CmdArgs) error {
+	// DEL has to succeed with the arguments of ADD, whatever they were
+	envArgs, err := parseEnvArgs(args.Args)
+	if err != nil {
+		envArgs = &EnvArgs{}
+	}
+	// Fall back on what ADD recorded where the runtime doesn't pass it
+	recorded, err := loadResult(conf, args)
+	if err != nil {
+		return err
+	}
+	// Apply the QoS the pod's annotations set on ADD
+	annotated, err := recordedQoS(recorded)
+	if err != nil {
+		return err
 	}
+	annotated.apply(conf)
 
-	// Initialize IPAM
-	ipamConfig := &ipam.Config{
-		Subnet:  conf.Subnet,
-		Gateway: conf.Gateway,
-		DataDir: conf.DataDir,
+	// Let the site's hook see the attachment before anything is removed
+	if conf.hasHook(hookPreDel) {
+		held, err := attachmentIPs(ctx, conf, args.ContainerID, args.IfName)
+		if err != nil {
+			return err
+		}
+		// A failing DEL is retried, which the hook would fail again, so the
+		// attachment would never be removed
+		if err := runHook(ctx, conf, newHookContext(hookPreDel, conf, args, envArgs, held)); err != nil {
+			warn(err)
+		}
 	}
-	ipamInstance, err := ipam.New(ipamConfig)
+
+	// Release IPs, holding the network lock so the allocations saved don't
+	// drop those of a concurrent ADD
+	unlock, err := lockNetwork(ctx, conf)
 	if err != nil {
-		return fmt.Errorf("failed to initialize IPAM: %v", err)
+		return err
+	}
+	defer unlock()
+	ipams, err := openIPAM(conf)
+	if err != nil {
+		return err
+	}
+	releasedIPs, err := releaseIPs(ipams, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if err := forgetAttachments(conf, ipams); err != nil {
+		return err
+	}
+
+	// Forget the flows of the released addresses
+	if err := flushConntrack(releasedIPs); err != nil {
+		return err
+	}
+
+	// Remove the host routes to the released addresses, which those in a
+	// VLAN have too
+	if conf.HostRoutes || conf.VLANFiltering {
+		if err := deleteHostRoutes(conf, releasedIPs); err != nil {
+			return err
+		}
+	}
+
+	// Stop answering for the released addresses, and for those recorded,
+	// which a retried DEL released already
+	proxied := recordedNDPProxies(recorded)
+	if conf.NDPProxy {
+		proxied = append(proxied, releasedIPs...)
+	}
+	if len(proxied) > 0 {
+		if err := deleteNDPProxy(conf, proxied); err != nil {
+			return err
+		}
+	}
+
+	// Remove masquerade rules once the last container is gone
+	if conf.IPMasq {
+		if err := teardownIPMasq(conf, ipams); err != nil {
+			return err
+		}
+	}
+
+	// Remove the egress rules with them, including those of an earlier
+	// configuration
+	if err := teardownEgressRules(conf, ipams); err != nil {
+		return err
+	}
+
+	// Remove the port forwarding rules of the attachment
+	if err := teardownPortMappings(conf, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	unlock()
+	if ctx.Err() != nil {
+		return deadlineError(ctx, "releasing the addresses")
+	}
+
+	// Remove the anti-spoofing filters of the port
+	if conf.AntiSpoofing {
+		if err := teardownAntiSpoofing(conf, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+
+	// Remove the DSCP marking of the port, which it keeps if the network
+	// stopped marking since
+	if err := teardownDSCP(conf, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	// Remove the network policy of the port
+	if conf.Policy != nil {
+		if err := teardownPolicy(conf, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
 	}
 
-	// Release IP
-	if err := ipamInstance.Release(args.ContainerID); err != nil {
-		return fmt.Errorf("failed to release IP: %v", err)
+	// Remove the ingress port allowlist of the port, which it keeps if the
+	// network stopped filtering since
+	if err := teardownPortAllowlist(conf, args.ContainerID, args.IfName); err != nil {
+		return err
 	}
 
-	// Remove veth pair
-	if args.Netns != "" {
-		_, err := ip.DelLinkByNameAddr(args.IfName)
+	// Remove the port from the OVS bridge
+	if conf.Mode == modeOVS {
+		if err := detachOVS(conf, args); err != nil {
+			return newError(types.ErrInternal, "failed to remove OVS port", err)
+		}
+	}
+
+	// Remove the tap device
+	if conf.Mode == modeTap {
+		name, err := tapName(conf, args, recorded)
 		if err != nil {
+			return configError("failed to name tap device", err)
+		}
+		if err := ip.DelLinkByName(name); err != nil && err != ip.ErrLinkNotFound {
+			return netlinkError("failed to delete tap device", err)
+		}
+	}
+
+	// Remove static routes and veth pair
+	var releasedMACs []net.HardwareAddr
+	if netns := attachmentNetns(args, recorded); conf.hasSandbox() && netns != "" {
+		err := ns.WithNetNSPath(netns, func(netns ns.NetNS) error {
+			mac, err := deleteContainerIface(conf, args)
+			if mac != nil {
+				releasedMACs = append(releasedMACs, mac)
+			}
 			return err
+		})
+		if err != nil {
+			// The runtime may have already removed the netns
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return err
+			}
 		}
 	}
 
+	// Return the VF to the host
+	if conf.Mode == modeSRIOV {
+		if err := releaseVF(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Remove host-side interfaces the container interface didn't take along
+	hostMACs, err := deleteHostLinks(args)
+	if err != nil {
+		return err
+	}
+
+	// Remove FDB and neighbor entries of the attachment, also those of its
+	// recorded MAC if the container interface was gone already
+	if len(releasedMACs) == 0 {
+		if mac := recordedMAC(recorded); mac != nil {
+			releasedMACs = append(releasedMACs, mac)
+		}
+	}
+	if err := pruneNeighbors(conf, append(releasedMACs, hostMACs...), releasedIPs); err != nil {
+		return err
+	}
+
+	// Leave the traffic to the released MACs to the bridge
+	if conf.fastPath() {
+		if err := teardownFastPath(conf, releasedMACs); err != nil {
+			return err
+		}
+	}
+	if err := removeResult(conf, args); err != nil {
+		return err
+	}
+
+	// Tell the site's hook the attachment is gone
+	if err := runHook(ctx, conf, newHookContext(hookPostDel, conf, args, envArgs, releasedIPs)); err != nil {
+		warn(err)
+	}
 	return nil
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
-	// Parse network configuration
-	conf := &PluginConf{}
-	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to parse network configuration: %v", err)
+func cmdCheck(ctx context.Context, args *skel.CmdArgs) error {
+	// Parse and validate network configuration
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.DisableCheck {
+		return nil
+	}
+	if err := conf.Validate(); err != nil {
+		return err
 	}
+	conf, err = attachmentNetwork(conf, args)
+	if err != nil {
+		return err
+	}
+	if err := checkAttachment(ctx, conf, args); err != nil {
+		return err
+	}
+	for _, a := range conf.Attachments {
+		if err := checkAttachment(ctx, conf.attached(a), attachedArgs(args, a)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Check if VXLAN interface exists
-	vxlanName := fmt.Sprintf("vxlan%d", conf.VxlanID)
-	_, err := netlink.LinkByName(vxlanName)
+// checkAttachment verifies the container's attachment to the network
+func checkAttachment(ctx context.Context, conf *PluginConf, args *skel.CmdArgs) error {
+	conf.skipSecondaryDefaultRoute()
+	// Repairs change the network's state, so they don't race ADD, DEL or GC
+	if conf.CheckRepairs {
+		unlock, err := lockNetwork(ctx, conf)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	recorded, err := loadResult(conf, args)
+	if err != nil {
+		return err
+	}
+	// Apply the QoS the pod's annotations set on ADD
+	annotated, err := recordedQoS(recorded)
 	if err != nil {
-		return fmt.Errorf("VXLAN interface %s not found: %v", vxlanName, err)
+		return err
 	}
+	annotated.apply(conf)
 
-	// Check container network namespace
-	err = ns.WithNetNSPath(args.Netns, func(netns ns.NetNS) error {
-		// Check if container interface exists
-		link, err := netlink.LinkByName(args.IfName)
+	// Check if VXLAN interface exists
+	if conf.usesVxlan() {
+		name := vxlanName(conf)
+		vx, err := ops.LinkByName(name)
+		if err != nil {
+			return newError(types.ErrInternal, fmt.Sprintf("VXLAN interface %s not found", name), err)
+		}
+		if err := checkFlooding(conf, vx); err != nil {
+			return err
+		}
+		if offloads := conf.vxlanOffloads(); !offloads.IsEmpty() {
+			if err := checkOffloads(name, offloads); err != nil {
+				return err
+			}
+		}
+		if err := checkProxyARP(name, conf.vxlanProxyARP()); err != nil {
+			return err
+		}
+		if conf.SourceRouting != nil {
+			if err := checkSourceRouting(conf); err != nil {
+				return err
+			}
+		}
+		if conf.bumGuard() != nil {
+			if err := checkBUMGuard(conf); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Check if the overlay bridge or shim exists, in the VRF if any
+	l2, err := ops.LinkByName(l2Name(conf))
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", l2Name(conf)), err)
+	}
+	if conf.VRF != nil {
+		member, err := vrf.Member(conf.VRF.Name, l2)
 		if err != nil {
-			return fmt.Errorf("container interface %s not found: %v", args.IfName, err)
+			return newError(types.ErrInternal, "failed to check VRF", err)
+		}
+		if !member {
+			return newError(types.ErrInternal, fmt.Sprintf("interface %s is not in VRF %s", l2Name(conf), conf.VRF.Name), nil)
+		}
+	}
+	if conf.RouteTable != nil {
+		if err := checkRouteTable(conf); err != nil {
+			return err
+		}
+	}
+	if conf.OpenFirewall != nil {
+		if err := checkVxlanOpening(conf); err != nil {
+			return err
+		}
+	}
+	if err := checkFirewalldZone(conf); err != nil {
+		return err
+	}
+	if conf.Unmanaged {
+		if err := checkUnmanaged(conf); err != nil {
+			return err
 		}
+	}
+	if err := checkProxyARP(l2Name(conf), conf.bridgeProxyARP()); err != nil {
+		return err
+	}
+	if conf.Tables != nil {
+		if err := checkTables(conf, l2); err != nil {
+			return err
+		}
+	}
 
-		// Check if container interface is up
-		if link.Attrs().Flags&net.FlagUp == 0 {
-			return fmt.Errorf("container interface %s is down", args.IfName)
+	// Refresh the container's default route before its lifetime runs out
+	if ra := conf.RouterAdvertisements; ra != nil && !ra.External && recorded != nil {
+		if err := advertiseRouter(conf, l2, recorded.HostInterfaces, recordedMAC(recorded), recordedIPs(recorded)); err != nil {
+			return err
 		}
+	}
 
-		// Check if container has an IP address
-		addrs, err := netlink.AddrList(link, unix.AF_INET)
+	// Check the host interfaces the attachment was set up with, restored
+	// first with checkRepairs
+	if err := checkRecordedHostIfaces(conf, recorded, l2); err != nil {
+		return err
+	}
+
+	// Check the anti-spoofing filters of the attachment
+	if conf.AntiSpoofing {
+		if err := checkAntiSpoofing(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the fast path of the attachment
+	if conf.fastPath() {
+		if err := checkFastPath(conf, args, recorded); err != nil {
+			return err
+		}
+	}
+
+	// Check the DSCP marking of the attachment
+	if conf.dscp() != nil {
+		if err := checkDSCP(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the VLAN of the attachment's bridge port
+	if conf.vlan() != 0 && conf.Mode != modeSRIOV {
+		if err := checkPortVLAN(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the rate limits of the attachment
+	if !conf.rateLimits().isEmpty() {
+		if err := checkRateLimits(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the network policy of the attachment
+	if conf.Policy != nil {
+		if err := checkPolicy(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the ingress port allowlist of the attachment
+	if len(conf.allowedIngressPorts()) > 0 {
+		if err := checkPortAllowlist(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the port forwarding rules of the attachment
+	if len(conf.RuntimeConfig.PortMappings) > 0 {
+		if err := checkPortMappings(conf, args); err != nil {
+			return err
+		}
+	}
+
+	// Check the egress rules of the network
+	if len(conf.EgressRules) > 0 {
+		if err := checkEgressRules(conf); err != nil {
+			return err
+		}
+	}
+
+	// Check the host routes to the attachment's addresses
+	if conf.installsHostRoutes() {
+		ipams, err := openIPAM(conf)
 		if err != nil {
-			return fmt.Errorf("failed to get addresses for container interface: %v", err)
+			return err
 		}
-		if len(addrs) == 0 {
-			return fmt.Errorf("container interface %s has no IPv4 address", args.IfName)
+		if err := checkHostRoutes(conf, ipams, attachmentKey(args.ContainerID, args.IfName)); err != nil {
+			return err
 		}
+	}
 
-		// Check if container has a default route
-		routes, err := netlink.RouteList(link, unix.AF_INET)
+	// Check the NDP proxy entries of the attachment's addresses
+	if conf.NDPProxy {
+		ipams, err := openIPAM(conf)
 		if err != nil {
-			return fmt.Errorf("failed to get routes for container interface: %v", err)
+			return err
 		}
-		hasDefaultRoute := false
-		for _, route := range routes {
-			if route.Dst == nil {
-				hasDefaultRoute = true
-				break
-			}
+		if err := checkNDPProxy(conf, ipams, attachmentKey(args.ContainerID, args.IfName)); err != nil {
+			return err
 		}
-		if !hasDefaultRoute {
-			return fmt.Errorf("container interface %s has no default route", args.IfName)
+	}
+
+	// Check the OVS port of the attachment
+	if conf.Mode == modeOVS {
+		port, err := ovs.New(nil).FindPort(conf.OVS.Bridge, attachmentKey(args.ContainerID, args.IfName))
+		if err != nil {
+			return newError(types.ErrInternal, "failed to find OVS port", err)
+		}
+		if port == "" {
+			return newError(types.ErrInternal, fmt.Sprintf("no port for %s on OVS bridge %s", args.IfName, conf.OVS.Bridge), nil)
 		}
+		if conf.OVS.VhostUser {
+			return nil
+		}
+	}
 
+	// Check the tap device of VM runtimes
+	if conf.Mode == modeTap {
+		name, err := tapName(conf, args, recorded)
+		if err != nil {
+			return configError("failed to name tap device", err)
+		}
+		link, err := ops.LinkByName(name)
+		if err != nil {
+			return newError(types.ErrInternal, fmt.Sprintf("tap device %s not found", name), err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return newError(types.ErrInternal, fmt.Sprintf("tap device %s is down", name), nil)
+		}
 		return nil
+	}
+
+	// Check container network namespace
+	err = ns.WithNetNSPath(attachmentNetns(args, recorded), func(netns ns.NetNS) error {
+		if conf.CheckRepairs {
+			if err := repairContainerIface(conf, args, recorded); err != nil {
+				return err
+			}
+		}
+		if err := checkContainerIface(conf, args); err != nil {
+			return err
+		}
+		return checkRecordedIface(args, recorded)
 	})
 	if err != nil {
 		return err
@@ -309,3 +1094,103 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	return nil
 }
+
+// checkContainerIface verifies the container interface, its addresses and
+// its routes in the current network namespace
+func checkContainerIface(conf *PluginConf, args *skel.CmdArgs) error {
+	// Check if container interface exists
+	link, err := ops.LinkByName(args.IfName)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s not found", args.IfName), err)
+	}
+
+	// Check if container interface is up, with the attachment's MTU
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s is down", args.IfName), nil)
+	}
+	if link.Attrs().MTU != conf.linkMTU() {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s has MTU %d, not %d", args.IfName, link.Attrs().MTU, conf.linkMTU()), nil)
+	}
+	if q := conf.vethQueues(); q > 0 && link.Attrs().NumTxQueues != q {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s has %d queues, not %d", args.IfName, link.Attrs().NumTxQueues, q), nil)
+	}
+	if offloads := conf.vethOffloads(); !offloads.IsEmpty() {
+		if err := checkOffloads(args.IfName, offloads); err != nil {
+			return err
+		}
+	}
+
+	// Check if container has an IP address of each family
+	addrs, err := ops.AddrList(link, unix.AF_INET)
+	if err != nil {
+		return netlinkError("failed to get addresses for container interface", err)
+	}
+	if len(addrs) == 0 {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s has no IPv4 address", args.IfName), nil)
+	}
+	if conf.IPv6Subnet != "" {
+		addrs, err := ops.AddrList(link, unix.AF_INET6)
+		if err != nil {
+			return netlinkError("failed to get addresses for container interface", err)
+		}
+		if !hasGlobalAddress(addrs) {
+			return newError(types.ErrInternal, fmt.Sprintf("container interface %s has no IPv6 address", args.IfName), nil)
+		}
+	}
+
+	// Check if container has the default routes, and that their
+	// gateways resolve. Without a metric a default route may be owned by
+	// another attachment or plugin. Multipath routes have no interface
+	// of their own, so all routes are searched.
+	routes, err := ops.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get routes for container interface", err)
+	}
+	allRoutes, err := ops.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get routes", err)
+	}
+	var gateways [][]net.IP
+	if dr := conf.defaultRoute(); !dr.Disabled {
+		defaultRoute := dr.netlinkRoute(link.Attrs().Index, net.ParseIP(conf.Gateway))
+		if hasDefaultRouteVia(allRoutes, defaultRoute) {
+			gateways = append(gateways, nexthops(defaultRoute))
+		} else {
+			installed, err := defaultRouteInstalled(netlink.FAMILY_V4)
+			if err != nil {
+				return netlinkError("failed to list routes", err)
+			}
+			if dr.Metric != 0 || !installed {
+				return newError(types.ErrInternal, fmt.Sprintf("container interface %s has no default route", args.IfName), nil)
+			}
+		}
+	}
+	if defaultRoute := conf.ipv6DefaultRoute(link.Attrs().Index); defaultRoute != nil {
+		if hasDefaultRouteVia(allRoutes, defaultRoute) {
+			gateways = append(gateways, nexthops(defaultRoute))
+		} else {
+			installed, err := defaultRouteInstalled(netlink.FAMILY_V6)
+			if err != nil {
+				return netlinkError("failed to list routes", err)
+			}
+			if defaultRoute.Priority != 0 || !installed {
+				return newError(types.ErrInternal, fmt.Sprintf("container interface %s has no IPv6 default route", args.IfName), nil)
+			}
+		}
+	}
+	// An ECMP route works as long as one of its gateways does
+	for _, nhs := range gateways {
+		if err := checkGateways(link, nhs); err != nil {
+			return err
+		}
+	}
+
+	// Check if container has the configured static routes
+	for _, route := range conf.containerRoutes() {
+		if !hasRoute(routes, route.netlinkRoute(link.Attrs().Index, net.ParseIP(conf.Gateway))) {
+			return newError(types.ErrInternal, fmt.Sprintf("container interface %s has no route to %s", args.IfName, route.Dst), nil)
+		}
+	}
+
+	return nil
+}
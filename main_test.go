@@ -0,0 +1,403 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/netops"
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+)
+
+func TestContainerIface(t *testing.T) {
+	fake := netops.NewFake()
+	ops = fake
+	defer func() { ops = netops.Kernel{} }()
+
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 10,
+		"subnet": "10.244.0.0/24",
+		"gateway": "10.244.0.1",
+		"routes": [{"dst": "10.96.0.0/12"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	// A name no host has, so announcing the addresses finds no interface
+	args := &skel.CmdArgs{ContainerID: "abc", IfName: "xvmtest0"}
+	mac, _ := net.ParseMAC("02:00:0a:f4:00:05")
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: args.IfName, MTU: conf.linkMTU(), HardwareAddr: mac}}
+	if err := fake.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+	containerIPs := []*current.IPConfig{{
+		Address: net.IPNet{IP: net.ParseIP("10.244.0.5"), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.ParseIP("10.244.0.1"),
+	}}
+
+	if err := setupContainerIface(conf, args, &current.Result{}, containerIPs); err != nil {
+		t.Fatalf("Failed to set up container interface: %v", err)
+	}
+	addrs, _ := fake.AddrList(link, netlink.FAMILY_V4)
+	if len(addrs) != 1 || !addrs[0].IP.Equal(containerIPs[0].Address.IP) {
+		t.Fatalf("Expected container address, got %v", addrs)
+	}
+	routes := fake.Routes()
+	if len(routes) != 2 || routes[0].Dst != nil || routes[1].Dst.String() != "10.96.0.0/12" {
+		t.Fatalf("Expected default and static route, got %v", routes)
+	}
+
+	// CHECK passes once the gateway resolves
+	gw := &netlink.Neigh{LinkIndex: link.Index, IP: net.ParseIP("10.244.0.1"), HardwareAddr: mac, State: netlink.NUD_REACHABLE}
+	if err := fake.NeighSet(gw); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkContainerIface(conf, args); err != nil {
+		t.Fatalf("Expected container interface to check out, got: %v", err)
+	}
+	if err := fake.RouteDel(&routes[1]); err != nil {
+		t.Fatal(err)
+	}
+	err = checkContainerIface(conf, args)
+	if err == nil || !strings.Contains(err.(*types.Error).Msg, "no route to 10.96.0.0/12") {
+		t.Fatalf("Expected missing static route to be reported, got: %v", err)
+	}
+
+	// DEL removes the interface, skipping the route already gone
+	got, err := deleteContainerIface(conf, args)
+	if err != nil {
+		t.Fatalf("Failed to delete container interface: %v", err)
+	}
+	if got.String() != mac.String() {
+		t.Fatalf("Expected MAC %s, got %s", mac, got)
+	}
+	if _, err := fake.LinkByName(args.IfName); err == nil {
+		t.Fatalf("Expected container interface to be deleted")
+	}
+	if got, err := deleteContainerIface(conf, args); got != nil || err != nil {
+		t.Fatalf("Expected repeated DEL to succeed, got %v, %v", got, err)
+	}
+}
+
+func TestRecordedIface(t *testing.T) {
+	fake := netops.NewFake()
+	ops = fake
+	defer func() { ops = netops.Kernel{} }()
+
+	args := &skel.CmdArgs{ContainerID: "abc", IfName: "xvmtest0"}
+	mac, _ := net.ParseMAC("02:00:0a:f4:00:05")
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: args.IfName, HardwareAddr: mac}}
+	if err := fake.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.244.0.5"), Mask: net.CIDRMask(24, 32)}}
+	if err := fake.AddrAdd(link, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attachments without a record check out
+	if err := checkRecordedIface(args, nil); err != nil {
+		t.Fatalf("Expected attachment without record to check out, got: %v", err)
+	}
+	recorded := &resultcache.Record{MAC: mac.String(), IPs: []string{"10.244.0.5/24"}, HostInterfaces: []string{"xvmtest1"}}
+	if err := checkRecordedIface(args, recorded); err != nil {
+		t.Fatalf("Expected container interface to match its record, got: %v", err)
+	}
+	recorded.IPs = append(recorded.IPs, "fd00:10:244::5/64")
+	err := checkRecordedIface(args, recorded)
+	if err == nil || !strings.Contains(err.(*types.Error).Msg, "lacks address fd00:10:244::5/64") {
+		t.Fatalf("Expected missing address to be reported, got: %v", err)
+	}
+	recorded.MAC = "02:00:0a:f4:00:06"
+	err = checkRecordedIface(args, recorded)
+	if err == nil || !strings.Contains(err.(*types.Error).Msg, "has MAC") {
+		t.Fatalf("Expected changed MAC to be reported, got: %v", err)
+	}
+
+	// The recorded host interfaces have to exist
+	err = checkRecordedHostIfaces(&PluginConf{}, recorded, nil)
+	if err == nil || !strings.Contains(err.(*types.Error).Msg, "xvmtest1") {
+		t.Fatalf("Expected missing host interface to be reported, got: %v", err)
+	}
+}
+
+func TestRepairContainerIface(t *testing.T) {
+	fake := netops.NewFake()
+	ops = fake
+	defer func() { ops = netops.Kernel{} }()
+
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"vxlanID": 10,
+		"subnet": "10.244.0.0/24",
+		"gateway": "10.244.0.1",
+		"routes": [{"dst": "10.96.0.0/12"}],
+		"checkRepairs": true
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	args := &skel.CmdArgs{ContainerID: "abc", IfName: "xvmtest0"}
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: args.IfName, MTU: conf.linkMTU()}}
+	if err := fake.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is restored without a record
+	if err := repairContainerIface(conf, args, nil); err != nil {
+		t.Fatalf("Expected attachment without record to be skipped, got: %v", err)
+	}
+	if addrs, _ := fake.AddrList(link, netlink.FAMILY_ALL); len(addrs) != 0 {
+		t.Fatalf("Expected no addresses restored, got %v", addrs)
+	}
+
+	recorded := &resultcache.Record{IPs: []string{"10.244.0.5/24"}}
+	for i := 0; i < 2; i++ {
+		if err := repairContainerIface(conf, args, recorded); err != nil {
+			t.Fatalf("Failed to repair container interface: %v", err)
+		}
+	}
+	addrs, _ := fake.AddrList(link, netlink.FAMILY_ALL)
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "10.244.0.5/24" {
+		t.Fatalf("Expected recorded address restored, got %v", addrs)
+	}
+	if l, _ := fake.LinkByName(args.IfName); l.Attrs().Flags&net.FlagUp == 0 {
+		t.Fatalf("Expected container interface set up")
+	}
+	routes := fake.Routes()
+	if len(routes) != 2 || routes[0].Dst != nil || routes[1].Dst.String() != "10.96.0.0/12" {
+		t.Fatalf("Expected default and static route restored once, got %v", routes)
+	}
+}
+
+func TestRepairHostIface(t *testing.T) {
+	fake := netops.NewFake()
+	ops = fake
+	defer func() { ops = netops.Kernel{} }()
+
+	conf := &PluginConf{Mode: modeBridge, HairpinMode: true}
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "xvmtestbr"}}
+	port := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "xvmtest1"}}
+	for _, link := range []netlink.Link{br, port} {
+		if err := fake.LinkAdd(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Interfaces that are gone are left for the check to report
+	if err := repairHostIface(conf, "xvmtest2", br); err != nil {
+		t.Fatalf("Expected missing interface to be skipped, got: %v", err)
+	}
+
+	if err := repairHostIface(conf, port.Name, br); err != nil {
+		t.Fatalf("Failed to repair host interface: %v", err)
+	}
+	l, _ := fake.LinkByName(port.Name)
+	if l.Attrs().MasterIndex != br.Index {
+		t.Fatalf("Expected host interface back on the bridge")
+	}
+	if l.Attrs().Protinfo == nil || !l.Attrs().Protinfo.Hairpin {
+		t.Fatalf("Expected hairpin mode restored")
+	}
+	if l.Attrs().Flags&net.FlagUp == 0 {
+		t.Fatalf("Expected host interface set up")
+	}
+}
+
+func TestRecordedNDPProxies(t *testing.T) {
+	conf := &PluginConf{NetConf: types.NetConf{Name: "xvm-network"}, DataDir: t.TempDir(), NDPProxy: true}
+	args := &skel.CmdArgs{ContainerID: "abc", IfName: "eth0"}
+	var ips []*current.IPConfig
+	for _, cidr := range []string{"10.244.0.5/24", "fd00:10:244::5/64"} {
+		ip, subnet, _ := net.ParseCIDR(cidr)
+		ips = append(ips, &current.IPConfig{Address: net.IPNet{IP: ip, Mask: subnet.Mask}})
+	}
+	if err := saveResult(conf, args, &current.Result{CNIVersion: "1.0.0"}, net.Interface{}, net.Interface{}, ips, nil); err != nil {
+		t.Fatalf("Failed to save result: %v", err)
+	}
+
+	// A retried DEL finds the entries to remove in the record, as the
+	// addresses are released already
+	recorded, err := loadResult(conf, args)
+	if err != nil {
+		t.Fatalf("Failed to load result: %v", err)
+	}
+	proxied := recordedNDPProxies(recorded)
+	if len(proxied) != 1 || !proxied[0].Equal(net.ParseIP("fd00:10:244::5")) {
+		t.Fatalf("Expected the IPv6 address recorded, got %v", proxied)
+	}
+}
+
+func TestTeardownProxyARP(t *testing.T) {
+	fake := netops.NewFake()
+	ops = fake
+	defer func() { ops = netops.Kernel{} }()
+
+	conf := &PluginConf{NetConf: types.NetConf{Name: "xvm-network"}, DataDir: t.TempDir()}
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, _ := hoststate.Load(dir, conf.Name)
+	state.ProxyARP = map[string]string{"xvmbr10/ipv4/conf/proxy_arp": "0"}
+	if err := state.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	device, sysctl, ok := parseProxyARPKey("xvmbr10/ipv4/conf/proxy_arp")
+	if !ok || device != "xvmbr10" || sysctl.table != "ipv4/conf" || sysctl.name != "proxy_arp" {
+		t.Fatalf("Unexpected key parsed: %s %+v", device, sysctl)
+	}
+
+	// Devices that are gone are only forgotten
+	if err := teardownProxyARP(conf); err != nil {
+		t.Fatalf("Failed to tear down proxy ARP: %v", err)
+	}
+	if state, _ := hoststate.Load(dir, conf.Name); len(state.ProxyARP) != 0 {
+		t.Fatalf("Expected recorded values forgotten, got %v", state.ProxyARP)
+	}
+}
+
+func TestAttachmentNetns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "net")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := &skel.CmdArgs{}
+	recorded := &resultcache.Record{Netns: path, NetnsInode: netnsInode(path)}
+	if got := attachmentNetns(args, recorded); got != path {
+		t.Fatalf("Expected recorded namespace %s, got %q", path, got)
+	}
+
+	// A path naming another namespace by now is taken as gone
+	recorded.NetnsInode++
+	if got := attachmentNetns(args, recorded); got != "" {
+		t.Fatalf("Expected reused namespace path to be skipped, got %q", got)
+	}
+
+	// The runtime's namespace wins
+	args.Netns = "/var/run/netns/ctr"
+	if got := attachmentNetns(args, recorded); got != args.Netns {
+		t.Fatalf("Expected runtime's namespace, got %q", got)
+	}
+}
+
+// BenchmarkAdd measures ADD of containers to a network already set up on the
+// node, as on nodes creating hundreds of sandboxes a minute, and reports the
+// 99th percentile along with the mean
+func BenchmarkAdd(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("Benchmark requires root privileges")
+	}
+	node, err := testutils.NewNS()
+	if err != nil {
+		b.Fatalf("Failed to create node namespace: %v", err)
+	}
+	defer testutils.UnmountNS(node)
+	defer node.Close()
+	conf := []byte(fmt.Sprintf(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-bench",
+		"type": "xvm-cni",
+		"hostInterface": "underlay0",
+		"vxlanID": 4243,
+		"subnet": "10.243.0.0/16",
+		"gateway": "10.243.0.1",
+		"dataDir": %q
+	}`, b.TempDir()))
+
+	// The result goes to stdout
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	latencies := make([]time.Duration, 0, b.N)
+	err = node.Do(func(ns.NetNS) error {
+		underlay := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "underlay0"}, PeerName: "underlay1"}
+		if err := netlink.LinkAdd(underlay); err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("192.168.243.1/24")
+		if err := netlink.AddrAdd(underlay, addr); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(underlay); err != nil {
+			return err
+		}
+
+		// Warm up with the network's first container, which sets it up
+		add := func(i int) (ns.NetNS, *skel.CmdArgs, error) {
+			container, err := testutils.NewNS()
+			if err != nil {
+				return nil, nil, err
+			}
+			args := &skel.CmdArgs{ContainerID: fmt.Sprintf("bench%d", i), Netns: container.Path(), IfName: "eth0", StdinData: conf}
+			return container, args, cmdAdd(context.Background(), args)
+		}
+		remove := func(container ns.NetNS, args *skel.CmdArgs) error {
+			err := cmdDel(context.Background(), args)
+			container.Close()
+			testutils.UnmountNS(container)
+			return err
+		}
+		first, firstArgs, err := add(-1)
+		if err != nil {
+			return err
+		}
+		defer remove(first, firstArgs)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			container, err := testutils.NewNS()
+			if err != nil {
+				return err
+			}
+			args := &skel.CmdArgs{ContainerID: fmt.Sprintf("bench%d", i), Netns: container.Path(), IfName: "eth0", StdinData: conf}
+			b.StartTimer()
+			start := time.Now()
+			err = cmdAdd(context.Background(), args)
+			latencies = append(latencies, time.Since(start))
+			b.StopTimer()
+			if err != nil {
+				return err
+			}
+			if err := remove(container, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("ADD failed: %v", err)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+}
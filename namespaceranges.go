@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// NamespaceRange places the pods of Kubernetes namespaces in a sub-range of
+// each subnet, so their addresses tell their tenant
+type NamespaceRange struct {
+	Namespaces []string `json:"namespaces"`
+	Range      string   `json:"range,omitempty"`
+	IPv6Range  string   `json:"ipv6Range,omitempty"`
+}
+
+// validateNamespaceRanges returns the problems with the namespace ranges
+func (c *PluginConf) validateNamespaceRanges() []string {
+	var problems []string
+	seen := make(map[string]int)
+	var ranges []*net.IPNet
+	for i, nr := range c.NamespaceRanges {
+		field := fmt.Sprintf("namespaceRanges[%d]", i)
+		if len(nr.Namespaces) == 0 {
+			problems = append(problems, field+".namespaces must be specified")
+		}
+		for _, ns := range nr.Namespaces {
+			if j, ok := seen[ns]; ok && j != i {
+				problems = append(problems, fmt.Sprintf("namespace %s is in namespaceRanges[%d] and %s", ns, j, field))
+			}
+			seen[ns] = i
+		}
+		if nr.Range == "" && nr.IPv6Range == "" {
+			problems = append(problems, field+" must set range or ipv6Range")
+		}
+		if nr.IPv6Range != "" && c.IPv6Subnet == "" {
+			problems = append(problems, field+".ipv6Range requires ipv6Subnet")
+		}
+		for _, r := range [][3]string{{"range", nr.Range, c.Subnet}, {"ipv6Range", nr.IPv6Range, c.IPv6Subnet}} {
+			if r[1] == "" {
+				continue
+			}
+			ipv6 := r[0] == "ipv6Range"
+			rng, problem := parseNamespaceRange(field+"."+r[0], r[1], r[2], ipv6)
+			if problem != "" {
+				problems = append(problems, problem)
+				continue
+			}
+			for _, other := range ranges {
+				if other.Contains(rng.IP) || rng.Contains(other.IP) {
+					problems = append(problems, fmt.Sprintf("%s.%s %s overlaps %s", field, r[0], rng, other))
+				}
+			}
+			ranges = append(ranges, rng)
+		}
+	}
+	return problems
+}
+
+// parseNamespaceRange parses a namespace range, which must lie in the
+// subnet of its address family
+func parseNamespaceRange(field, cidr, subnet string, ipv6 bool) (*net.IPNet, string) {
+	_, rng, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Sprintf("invalid %s %q", field, cidr)
+	}
+	if (rng.IP.To4() == nil) != ipv6 {
+		return nil, fmt.Sprintf("%s %s has the wrong address family", field, rng)
+	}
+	_, sn, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, "" // Reported with the subnet
+	}
+	rangeOnes, _ := rng.Mask.Size()
+	subnetOnes, _ := sn.Mask.Size()
+	if !sn.Contains(rng.IP) || rangeOnes < subnetOnes {
+		return nil, fmt.Sprintf("%s %s is not inside subnet %s", field, rng, sn)
+	}
+	return rng, ""
+}
+
+// restrictToNamespace has the IPAM instances allocate from the ranges of
+// the pod's namespace, and the pods of other namespaces, or attachments of
+// no known pod, from outside every range
+func restrictToNamespace(conf *PluginConf, ipams []*ipam.IPAM, namespace string) {
+	if len(conf.NamespaceRanges) == 0 {
+		return
+	}
+	for _, ipamInstance := range ipams {
+		ipv6 := ipamInstance.Subnet.IP.To4() == nil
+		r := &ipam.Range{}
+		for _, nr := range conf.NamespaceRanges {
+			cidr := nr.Range
+			if ipv6 {
+				cidr = nr.IPv6Range
+			}
+			_, rng, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue // Unset, or rejected by validation
+			}
+			if hasNamespace(nr.Namespaces, namespace) {
+				r.Include = rng
+			} else {
+				r.Exclude = append(r.Exclude, rng)
+			}
+		}
+		// Ranges of the namespace don't overlap those of others
+		if r.Include != nil {
+			r.Exclude = nil
+		}
+		ipamInstance.Range = r
+	}
+}
+
+// hasNamespace reports whether the namespaces include the pod's namespace,
+// which is empty for attachments of no known pod
+func hasNamespace(namespaces []string, namespace string) bool {
+	for _, ns := range namespaces {
+		if ns == namespace && namespace != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// NamespaceVNI puts the pods of Kubernetes namespaces on a VXLAN segment of
+// their own, with its own bridge and subnets, so tenants share no L2
+// adjacency
+type NamespaceVNI struct {
+	Namespaces  []string `json:"namespaces"`
+	VxlanID     int      `json:"vxlanID"`
+	Subnet      string   `json:"subnet"`
+	Gateway     string   `json:"gateway"`
+	IPv6Subnet  string   `json:"ipv6Subnet,omitempty"`
+	IPv6Gateway string   `json:"ipv6Gateway,omitempty"`
+}
+
+// validateNamespaceVNIs returns the problems with the namespace VNIs
+func (c *PluginConf) validateNamespaceVNIs() []string {
+	if len(c.NamespaceVNIs) == 0 {
+		return nil
+	}
+	var problems []string
+	// The segments keep their state under names derived from the network's
+	if c.Name == "" {
+		problems = append(problems, "namespaceVNIs requires name")
+	}
+	seen := make(map[string]int)
+	vnis := map[int]string{c.VxlanID: "vxlanID"}
+	subnets := newSubnetSet(c)
+	for i, nv := range c.NamespaceVNIs {
+		field := fmt.Sprintf("namespaceVNIs[%d]", i)
+		if len(nv.Namespaces) == 0 {
+			problems = append(problems, field+".namespaces must be specified")
+		}
+		for _, ns := range nv.Namespaces {
+			if j, ok := seen[ns]; ok && j != i {
+				problems = append(problems, fmt.Sprintf("namespace %s is in namespaceVNIs[%d] and %s", ns, j, field))
+			}
+			seen[ns] = i
+		}
+		if nv.VxlanID < 1 || nv.VxlanID > vxlan.MaxVxlanVNI {
+			problems = append(problems, fmt.Sprintf("%s.vxlanID %d out of range (1-%d)", field, nv.VxlanID, vxlan.MaxVxlanVNI))
+		} else if other, ok := vnis[nv.VxlanID]; ok {
+			problems = append(problems, fmt.Sprintf("%s.vxlanID %d is that of %s", field, nv.VxlanID, other))
+		}
+		vnis[nv.VxlanID] = field
+		if nv.Subnet == "" {
+			problems = append(problems, field+".subnet must be specified")
+		}
+		if nv.Gateway == "" {
+			problems = append(problems, field+".gateway must be specified")
+		}
+		problems = append(problems, validateRange(field+".subnet", nv.Subnet, nv.Gateway, false)...)
+		if nv.IPv6Subnet != "" || nv.IPv6Gateway != "" {
+			if nv.IPv6Subnet == "" {
+				problems = append(problems, field+".ipv6Subnet must be specified with ipv6Gateway")
+			}
+			if nv.IPv6Gateway == "" {
+				problems = append(problems, field+".ipv6Gateway must be specified with ipv6Subnet")
+			}
+			problems = append(problems, validateRange(field+".ipv6Subnet", nv.IPv6Subnet, nv.IPv6Gateway, true)...)
+		}
+		problems = append(problems, subnets.add(field+".subnet", nv.Subnet)...)
+		problems = append(problems, subnets.add(field+".ipv6Subnet", nv.IPv6Subnet)...)
+	}
+	return problems
+}
+
+// segment returns the configuration of the namespaces' segment: the
+// network's, on the segment's VNI and subnets, and named after both so its
+// addresses, records and lock are its own
+func (c *PluginConf) segment(nv NamespaceVNI) *PluginConf {
+	s := *c
+	s.Name = fmt.Sprintf("%s-vni%d", c.Name, nv.VxlanID)
+	s.VxlanID = nv.VxlanID
+	s.Subnet, s.Gateway = nv.Subnet, nv.Gateway
+	s.IPv6Subnet, s.IPv6Gateway = nv.IPv6Subnet, nv.IPv6Gateway
+	// The ranges of the network's subnets don't apply to the segment's
+	s.NamespaceRanges = nil
+	s.NamespaceVNIs = nil
+	return &s
+}
+
+// segments returns the configurations of the network's namespace segments
+func (c *PluginConf) segments() []*PluginConf {
+	var segments []*PluginConf
+	for _, nv := range c.NamespaceVNIs {
+		segments = append(segments, c.segment(nv))
+	}
+	return segments
+}
+
+// attachmentNetwork returns the configuration of the network the attachment
+// is on: the segment ADD recorded it on, so it's found there even after the
+// namespaces moved between segments, or else the segment of its pod's
+// namespace passed in CNI_ARGS, or the network itself
+func attachmentNetwork(conf *PluginConf, args *skel.CmdArgs) (*PluginConf, error) {
+	if len(conf.NamespaceVNIs) == 0 {
+		return conf, nil
+	}
+	for _, segment := range conf.segments() {
+		r, err := loadResult(segment, args)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return segment, nil
+		}
+	}
+	if envArgs, err := parseEnvArgs(args.Args); err == nil && envArgs.K8S_POD_NAMESPACE != "" {
+		for _, nv := range conf.NamespaceVNIs {
+			if hasNamespace(nv.Namespaces, string(envArgs.K8S_POD_NAMESPACE)) {
+				return conf.segment(nv), nil
+			}
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// maxIfNameLen is the longest interface name the kernel accepts
+const maxIfNameLen = 15
+
+// vethNameData holds the values available to the veth name template
+type vethNameData struct {
+	// Hash is a stable 8 character hash of the container ID and ifname
+	Hash string
+	// ShortID is the first 8 characters of the container ID
+	ShortID string
+	// IfName is the container-side interface name
+	IfName string
+}
+
+// renderVethName renders the host veth name template for an attachment.
+// An empty template yields an empty name, leaving the choice to the kernel.
+func renderVethName(tmpl, containerID, ifName string) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+
+	t, err := template.New("veth").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid vethNameTemplate: %v", err)
+	}
+
+	hash := sha256.Sum256([]byte(containerID + "/" + ifName))
+	shortID := containerID
+	if len(shortID) > 8 {
+		shortID = shortID[:8]
+	}
+	data := vethNameData{
+		Hash:    hex.EncodeToString(hash[:])[:8],
+		ShortID: shortID,
+		IfName:  ifName,
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid vethNameTemplate: %v", err)
+	}
+	name := buf.String()
+	if name == "" || len(name) > maxIfNameLen || strings.ContainsAny(name, "/ \t\n:") {
+		return "", fmt.Errorf("vethNameTemplate renders invalid interface name %q (1-%d characters, no '/', ':' or whitespace)", name, maxIfNameLen)
+	}
+	return name, nil
+}
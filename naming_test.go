@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func TestRenderVethName(t *testing.T) {
+	containerID := strings.Repeat("a1b2c3d4", 8)
+
+	// No template leaves naming to the kernel
+	name, err := renderVethName("", containerID, "eth0")
+	if err != nil || name != "" {
+		t.Fatalf("Expected empty name, got %q (%v)", name, err)
+	}
+
+	// Hash-based names are stable and unique per attachment
+	name, err = renderVethName("xvm{{.Hash}}", containerID, "eth0")
+	if err != nil {
+		t.Fatalf("Failed to render name: %v", err)
+	}
+	if len(name) != 11 || !strings.HasPrefix(name, "xvm") {
+		t.Fatalf("Unexpected name %q", name)
+	}
+	again, _ := renderVethName("xvm{{.Hash}}", containerID, "eth0")
+	if again != name {
+		t.Fatalf("Name is not deterministic: %q != %q", again, name)
+	}
+	other, _ := renderVethName("xvm{{.Hash}}", containerID, "net1")
+	if other == name {
+		t.Fatalf("Different attachments share name %q", name)
+	}
+
+	// Short container IDs
+	name, err = renderVethName("veth{{.ShortID}}", containerID, "eth0")
+	if err != nil || name != "vetha1b2c3d4" {
+		t.Fatalf("Expected vetha1b2c3d4, got %q (%v)", name, err)
+	}
+
+	// Names longer than the kernel limit and unknown fields are rejected
+	if _, err := renderVethName("xvm-{{.ShortID}}-{{.Hash}}", containerID, "eth0"); err == nil {
+		t.Fatalf("Expected overlong name to be rejected")
+	}
+	if _, err := renderVethName("xvm{{.Pod}}", containerID, "eth0"); err == nil {
+		t.Fatalf("Expected unknown field to be rejected")
+	}
+}
+
+func TestHostAlias(t *testing.T) {
+	conf := &PluginConf{}
+	conf.Name = "xvm net"
+	args := &skel.CmdArgs{ContainerID: strings.Repeat("a1b2c3d4", 8), IfName: "eth0"}
+
+	// Without a pod, the short container ID names the workload
+	alias := hostAlias(conf, args)
+	if alias != attachmentAlias(args.ContainerID, "eth0")+" network=xvm net" {
+		t.Fatalf("Unexpected alias %q", alias)
+	}
+	if name := hostAltName(conf, args); name != "xvm.net.a1b2c3d4a1b2.eth0" {
+		t.Fatalf("Unexpected altname %q", name)
+	}
+
+	args.Args = "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web"
+	alias = hostAlias(conf, args)
+	if !strings.HasSuffix(alias, " pod=default/web") {
+		t.Fatalf("Expected pod in alias, got %q", alias)
+	}
+	if name := hostAltName(conf, args); name != "xvm.net.default.web.eth0" {
+		t.Fatalf("Unexpected altname %q", name)
+	}
+
+	// The attachment stays parseable from the longer alias
+	key, owned := parseAttachmentAlias(alias)
+	if !owned || key != attachmentKey(args.ContainerID, "eth0") {
+		t.Fatalf("Failed to parse alias %q: %q", alias, key)
+	}
+	if !ownedBy(alias, args.ContainerID, "eth0") || ownedBy(alias, args.ContainerID, "net1") {
+		t.Fatalf("Wrong owner for alias %q", alias)
+	}
+	if !ownedBy(attachmentAlias(args.ContainerID, "eth0"), args.ContainerID, "eth0") {
+		t.Fatalf("Expected aliases without network to stay owned")
+	}
+	if network, ok := aliasNetwork(alias); !ok || network != "xvm net" {
+		t.Fatalf("Expected network xvm net in alias %q, got %q", alias, network)
+	}
+	if _, ok := aliasNetwork(attachmentAlias(args.ContainerID, "eth0")); ok {
+		t.Fatalf("Expected no network in alias without one")
+	}
+
+	// Long names are cut to the kernel limits
+	conf.Name = strings.Repeat("n", 300)
+	if alias := hostAlias(conf, args); len(alias) != maxAliasLen {
+		t.Fatalf("Expected alias of %d bytes, got %d", maxAliasLen, len(alias))
+	}
+	if name := hostAltName(conf, args); len(name) != maxAltNameLen {
+		t.Fatalf("Expected altname of %d bytes, got %d", maxAltNameLen, len(name))
+	}
+}
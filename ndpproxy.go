@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// ndpProxyEntry returns the entry answering neighbor solicitations for the
+// container address on the host interface
+func ndpProxyEntry(link netlink.Link, ip net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    netlink.FAMILY_V6,
+		Flags:     netlink.NTF_PROXY,
+		IP:        ip,
+	}
+}
+
+// setupNDPProxy has the node answer neighbor solicitations for the
+// container's IPv6 addresses on the host interface, so routers of the
+// underlay resolve them to the node, which routes them to the overlay
+func setupNDPProxy(conf *PluginConf, containerIPs []*current.IPConfig, undo *rollback) error {
+	if err := setDeviceSysctl("ipv6/conf", conf.HostInterface, "proxy_ndp", "1"); err != nil {
+		return newError(types.ErrInternal, "failed to enable NDP proxying", err)
+	}
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to get interface %s", conf.HostInterface), err)
+	}
+	for _, ipc := range containerIPs {
+		ip := ipc.Address.IP
+		if ip.To4() != nil {
+			continue
+		}
+		entry := ndpProxyEntry(link, ip)
+		if err := retry.Do(func() error { return netlink.NeighSet(entry) }); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add NDP proxy entry for %s", ip), err)
+		}
+		undo.add(func() error { return deleteNDPProxy(conf, []net.IP{ip}) })
+	}
+	return nil
+}
+
+// deleteNDPProxy removes the NDP proxy entries of released addresses
+func deleteNDPProxy(conf *PluginConf, ips []net.IP) error {
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return nil // Gone along with its entries
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		if err := netlink.NeighDel(ndpProxyEntry(link, ip)); err != nil && !errors.Is(err, unix.ENOENT) {
+			return netlinkError(fmt.Sprintf("failed to delete NDP proxy entry for %s", ip), err)
+		}
+	}
+	return nil
+}
+
+// checkNDPProxy verifies that the NDP proxy entries of the attachment's
+// IPv6 addresses are installed
+func checkNDPProxy(conf *PluginConf, ipams []*ipam.IPAM, key string) error {
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", conf.HostInterface), err)
+	}
+	entries, err := netlink.NeighProxyList(link.Attrs().Index, netlink.FAMILY_V6)
+	if err != nil {
+		return netlinkError("failed to list NDP proxy entries", err)
+	}
+	for _, ipamInstance := range ipams {
+		ip, ok := ipamInstance.Allocations[key]
+		if !ok || ip.To4() != nil {
+			continue
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.IP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newError(types.ErrInternal, fmt.Sprintf("no NDP proxy entry for %s on %s", ip, conf.HostInterface), nil)
+		}
+	}
+	return nil
+}
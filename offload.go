@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/offload"
+)
+
+// vethOffloads returns the offloads of the attachments' veth pairs, nil if
+// unset
+func (c *PluginConf) vethOffloads() *offload.Settings {
+	if c.Offloads == nil {
+		return nil
+	}
+	return c.Offloads.Veth
+}
+
+// vxlanOffloads returns the offloads of the network's VXLAN interface, nil if
+// unset
+func (c *PluginConf) vxlanOffloads() *offload.Settings {
+	if c.Offloads == nil {
+		return nil
+	}
+	return c.Offloads.Vxlan
+}
+
+// setVethOffloads sets the offloads of the host end of the attachment's veth
+// pair. The container end's are set along with its addresses.
+func setVethOffloads(conf *PluginConf, hostName string) error {
+	offloads := conf.vethOffloads()
+	if offloads.IsEmpty() {
+		return nil
+	}
+	if err := offload.Apply(hostName, offloads); err != nil {
+		return netlinkError("failed to tune host veth", err)
+	}
+	return nil
+}
+
+// checkOffloads verifies the offloads of a device in the current network
+// namespace
+func checkOffloads(device string, offloads *offload.Settings) error {
+	differing, err := offload.Check(device, offloads)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check offloads", err)
+	}
+	if len(differing) > 0 {
+		return newError(types.ErrInternal, fmt.Sprintf("%s should have %s", device, strings.Join(differing, ", ")), nil)
+	}
+	return nil
+}
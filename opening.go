@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// OpenFirewallConf has the node's firewall accept the network's VXLAN
+// traffic, for hosts whose restrictive input policy drops it otherwise
+type OpenFirewallConf struct {
+	// Peers are the underlay addresses or prefixes of the peer nodes the
+	// traffic is accepted from, defaulting to ovs.peers in ovs mode and to
+	// flooding.peers with head-end replication
+	Peers []string `json:"peers,omitempty"`
+}
+
+// openingPeers returns the peers the network's VXLAN traffic is accepted
+// from, none if they aren't known
+func (c *PluginConf) openingPeers() []string {
+	switch {
+	case len(c.OpenFirewall.Peers) > 0:
+		return c.OpenFirewall.Peers
+	case c.Mode == modeOVS:
+		return c.OVS.Peers
+	case c.floodMode() == vxlan.FloodHeadEnd:
+		return c.Flooding.Peers
+	}
+	return nil
+}
+
+// validate returns the problems with the firewall opening settings. The
+// peers are required, as the port would be open to the whole underlay
+// otherwise.
+func (o *OpenFirewallConf) validate(c *PluginConf) []string {
+	var problems []string
+	if len(c.openingPeers()) == 0 {
+		problems = append(problems, "openFirewall requires peers, unless ovs.peers or flooding.peers name them")
+	}
+	for _, peer := range o.Peers {
+		ip := net.ParseIP(peer)
+		if _, prefix, err := net.ParseCIDR(peer); err == nil {
+			ip = prefix.IP
+		}
+		if ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid openFirewall peer %q", peer))
+		}
+	}
+	return problems
+}
+
+// vxlanOpening returns the VXLAN traffic the node's firewall accepts: the
+// VXLAN port from the peers, and IGMP for the flood group unless OVS
+// tunnels to the peers directly or the VXLAN device floods without it
+func vxlanOpening(conf *PluginConf) *fw.VxlanOpening {
+	return &fw.VxlanOpening{
+		Port:      conf.VxlanPort,
+		Peers:     conf.openingPeers(),
+		Multicast: conf.usesVxlan() && conf.floodMode() == vxlan.FloodMulticast,
+	}
+}
+
+// setupVxlanOpening has the node's firewall accept the network's VXLAN
+// traffic, unless the rules are in place already
+func setupVxlanOpening(conf *PluginConf) error {
+	backend, err := firewall(conf)
+	if err != nil {
+		return err
+	}
+	opening := vxlanOpening(conf)
+	if ok, err := backend.HasVxlanOpening(conf.Name, opening); err == nil && ok {
+		return nil
+	}
+	if err := backend.SetupVxlanOpening(conf.Name, opening); err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("failed to open firewall to VXLAN port %d", conf.VxlanPort), err)
+	}
+	return nil
+}
+
+// teardownVxlanOpening removes the rules accepting the network's VXLAN
+// traffic with every backend on the host, so none are left behind if the
+// backend changed since they were installed
+func teardownVxlanOpening(conf *PluginConf) error {
+	for _, backend := range fw.Available() {
+		if err := backend.TeardownVxlanOpening(conf.Name); err != nil {
+			return newError(types.ErrInternal, "failed to remove VXLAN firewall openings", err)
+		}
+	}
+	return nil
+}
+
+// checkVxlanOpening verifies that the rules accepting the network's VXLAN
+// traffic are installed
+func checkVxlanOpening(conf *PluginConf) error {
+	backend, err := firewall(conf)
+	if err != nil {
+		return err
+	}
+	ok, err := backend.HasVxlanOpening(conf.Name, vxlanOpening(conf))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check VXLAN firewall openings", err)
+	}
+	if !ok {
+		return newError(types.ErrInternal, fmt.Sprintf("firewall rules accepting VXLAN port %d are missing", conf.VxlanPort), nil)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/pmtu"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// probesMTU reports whether the underlay paths to the peers are probed
+// before the network is set up, which is when its MTU is above the one a
+// standard underlay carries encapsulated
+func (c *PluginConf) probesMTU() bool {
+	return c.MTUProbe != nil && c.MTU > vxlan.SafeMTU
+}
+
+// probeMTU checks that the underlay carries the encapsulated frames of the
+// network's MTU to each peer that answers ICMP echo, rather than letting
+// the overlay drop its large packets
+func probeMTU(conf *PluginConf) error {
+	peers := make([]net.IP, 0, len(conf.MTUProbe.Peers))
+	for _, peer := range conf.MTUProbe.Peers {
+		peers = append(peers, net.ParseIP(peer))
+	}
+	timeout := time.Duration(conf.MTUProbe.Timeout) * time.Second
+	err := pmtu.ProbePeers(conf.HostInterface, peers, conf.MTU+vxlan.Overhead, timeout)
+	var perr *pmtu.Error
+	if errors.As(err, &perr) {
+		return newError(ErrPathMTU, fmt.Sprintf("underlay does not carry mtu %d, lower it or raise the underlay's MTU to %d", conf.MTU, perr.Size), err)
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to probe underlay path MTU", err)
+	}
+	return nil
+}
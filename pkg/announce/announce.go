@@ -0,0 +1,225 @@
+//go:build linux
+// +build linux
+
+package announce
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	// minFrameLen is the length of the shortest Ethernet frame, without FCS
+	minFrameLen = 60
+)
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// allNodesMAC is the multicast MAC of ff02::1
+	allNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// Addresses announces the addresses of the interface to its link: IPv4
+// addresses with a gratuitous ARP request, IPv6 addresses with an
+// unsolicited neighbor advertisement. Neighbors and bridges then learn the
+// interface's MAC right away rather than once their entries time out.
+func Addresses(iface *net.Interface, ips []net.IP) error {
+	for _, ip := range ips {
+		var frame []byte
+		if ip.To4() != nil {
+			frame = GratuitousARP(iface.HardwareAddr, ip)
+		} else {
+			frame = UnsolicitedNA(iface.HardwareAddr, ip)
+		}
+		if err := send(iface, frame); err != nil {
+			return fmt.Errorf("failed to announce %s on %s: %v", ip, iface.Name, err)
+		}
+	}
+	return nil
+}
+
+// GratuitousARP returns a broadcast ARP request for ip sent from and to ip
+// itself, as "arping -U" sends
+func GratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, minFrameLen)
+	ethernet(frame, broadcastMAC, mac, etherTypeARP)
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(arp[2:], 0x0800) // IPv4
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], 1) // Request
+	copy(arp[8:], mac)
+	copy(arp[14:], ip.To4())
+	copy(arp[24:], ip.To4())
+	return frame
+}
+
+// UnsolicitedNA returns a neighbor advertisement for ip to all nodes, with
+// the override flag set so it replaces cached entries
+func UnsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	const icmpLen = 32
+	frame := make([]byte, 14+40+icmpLen)
+	ethernet(frame, allNodesMAC, mac, etherTypeIPv6)
+
+	ipv6 := frame[14:]
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:], icmpLen)
+	ipv6[6] = unix.IPPROTO_ICMPV6
+	ipv6[7] = 255 // Hop limit required by RFC 4861
+	copy(ipv6[8:], ip.To16())
+	copy(ipv6[24:], net.IPv6linklocalallnodes)
+
+	icmp := ipv6[40:]
+	icmp[0] = 136  // Neighbor advertisement
+	icmp[4] = 0x20 // Override
+	copy(icmp[8:], ip.To16())
+	icmp[24], icmp[25] = 2, 1 // Target link-layer address option, 8 bytes
+	copy(icmp[26:], mac)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(ipv6[8:24], ipv6[24:40], icmp))
+	return frame
+}
+
+// Router holds what a router advertisement tells the hosts of a link
+type Router struct {
+	// Lifetime is how long, in seconds, hosts use the router as their
+	// default router
+	Lifetime uint16
+	// MTU is the link MTU hosts use, if not 0
+	MTU uint32
+	// Prefix is the on-link prefix, if set
+	Prefix *net.IPNet
+	// Autonomous lets hosts configure addresses in the prefix with SLAAC
+	Autonomous bool
+}
+
+// Destination is the host a router advertisement is sent to. Unset, it is
+// sent to all nodes of the link.
+type Destination struct {
+	MAC net.HardwareAddr
+	IP  net.IP
+}
+
+// Advertise sends an unsolicited router advertisement through the interface
+// to dst, from the router's MAC and link-local address src. The interface
+// may be a port of the router's bridge, leaving the others out.
+func Advertise(iface *net.Interface, mac net.HardwareAddr, src net.IP, dst Destination, router Router) error {
+	if err := send(iface, RouterAdvertisement(mac, src, dst, router)); err != nil {
+		return fmt.Errorf("failed to advertise router on %s: %v", iface.Name, err)
+	}
+	return nil
+}
+
+// RouterAdvertisement returns a router advertisement to dst from the
+// link-local address src, with the source link-layer address option and the
+// MTU and prefix information options if set
+func RouterAdvertisement(mac net.HardwareAddr, src net.IP, dst Destination, router Router) []byte {
+	icmpLen := 16 + 8
+	if router.MTU != 0 {
+		icmpLen += 8
+	}
+	if router.Prefix != nil {
+		icmpLen += 32
+	}
+	dstMAC, dstIP := allNodesMAC, net.IPv6linklocalallnodes
+	if dst.MAC != nil {
+		dstMAC, dstIP = dst.MAC, dst.IP
+	}
+	frame := make([]byte, 14+40+icmpLen)
+	ethernet(frame, dstMAC, mac, etherTypeIPv6)
+
+	ipv6 := frame[14:]
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:], uint16(icmpLen))
+	ipv6[6] = unix.IPPROTO_ICMPV6
+	ipv6[7] = 255 // Hop limit required by RFC 4861
+	copy(ipv6[8:], src.To16())
+	copy(ipv6[24:], dstIP.To16())
+
+	icmp := ipv6[40:]
+	icmp[0] = 134 // Router advertisement
+	icmp[4] = 64  // Current hop limit
+	binary.BigEndian.PutUint16(icmp[6:], router.Lifetime)
+	opts := icmp[16:]
+	opts[0], opts[1] = 1, 1 // Source link-layer address option, 8 bytes
+	copy(opts[2:], mac)
+	opts = opts[8:]
+	if router.MTU != 0 {
+		opts[0], opts[1] = 5, 1 // MTU option, 8 bytes
+		binary.BigEndian.PutUint32(opts[4:], router.MTU)
+		opts = opts[8:]
+	}
+	if router.Prefix != nil {
+		ones, _ := router.Prefix.Mask.Size()
+		opts[0], opts[1] = 3, 4 // Prefix information option, 32 bytes
+		opts[2] = byte(ones)
+		opts[3] = 0x80 // On-link
+		if router.Autonomous {
+			opts[3] |= 0x40
+		}
+		// The prefix stays valid for as long as the network exists
+		binary.BigEndian.PutUint32(opts[4:], 0xffffffff)
+		binary.BigEndian.PutUint32(opts[8:], 0xffffffff)
+		copy(opts[16:], router.Prefix.IP.Mask(router.Prefix.Mask).To16())
+	}
+	binary.BigEndian.PutUint16(icmp[2:], checksum(ipv6[8:24], ipv6[24:40], icmp))
+	return frame
+}
+
+// ethernet fills in the Ethernet header of the frame
+func ethernet(frame []byte, dst, src net.HardwareAddr, etherType uint16) {
+	copy(frame[0:], dst)
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+}
+
+// checksum returns the ICMPv6 checksum of the message, covering the IPv6
+// pseudo-header
+func checksum(src, dst, msg []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(msg))
+	pseudo = append(pseudo, src...)
+	pseudo = append(pseudo, dst...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(msg)))
+	pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_ICMPV6)
+	pseudo = append(pseudo, msg...)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i:]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// send transmits the Ethernet frame on the interface
+func send(iface *net.Interface, frame []byte) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(binary.BigEndian.Uint16(frame[12:])),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], frame[0:6])
+	return unix.Sendto(fd, frame, 0, addr)
+}
+
+// htons converts a short from host to network byte order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
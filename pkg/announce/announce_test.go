@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package announce
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestGratuitousARP(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:f4:00:02")
+	ip := net.ParseIP("10.244.0.2")
+	frame := GratuitousARP(mac, ip)
+
+	if len(frame) != minFrameLen {
+		t.Fatalf("Expected a %d byte frame, got %d", minFrameLen, len(frame))
+	}
+	if !bytes.Equal(frame[0:6], broadcastMAC) || !bytes.Equal(frame[6:12], mac) {
+		t.Fatalf("Unexpected Ethernet addresses: %x", frame[0:12])
+	}
+	arp := frame[14:]
+	if op := binary.BigEndian.Uint16(arp[6:]); op != 1 {
+		t.Fatalf("Expected an ARP request, got operation %d", op)
+	}
+	if !bytes.Equal(arp[8:14], mac) {
+		t.Fatalf("Unexpected sender MAC %x", arp[8:14])
+	}
+	// Sender and target address are both the announced address
+	if !net.IP(arp[14:18]).Equal(ip) || !net.IP(arp[24:28]).Equal(ip) {
+		t.Fatalf("Unexpected sender/target address %v/%v", net.IP(arp[14:18]), net.IP(arp[24:28]))
+	}
+}
+
+func TestUnsolicitedNA(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:f4:00:02")
+	ip := net.ParseIP("fd00::2")
+	frame := UnsolicitedNA(mac, ip)
+
+	if !bytes.Equal(frame[0:6], allNodesMAC) || binary.BigEndian.Uint16(frame[12:]) != etherTypeIPv6 {
+		t.Fatalf("Unexpected Ethernet header: %x", frame[0:14])
+	}
+	ipv6 := frame[14:]
+	if ipv6[7] != 255 || !net.IP(ipv6[8:24]).Equal(ip) || !net.IP(ipv6[24:40]).Equal(net.IPv6linklocalallnodes) {
+		t.Fatalf("Unexpected IPv6 header: %x", ipv6[0:40])
+	}
+	icmp := ipv6[40:]
+	if icmp[0] != 136 || icmp[4] != 0x20 || !net.IP(icmp[8:24]).Equal(ip) || !bytes.Equal(icmp[26:32], mac) {
+		t.Fatalf("Unexpected neighbor advertisement: %x", icmp)
+	}
+
+	// A message with its checksum filled in sums up to zero
+	if sum := checksum(ipv6[8:24], ipv6[24:40], icmp); sum != 0 {
+		t.Fatalf("Invalid checksum, verification sum is %#04x", sum)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("Loopback interface not available: %v", err)
+	}
+	if err := Addresses(iface, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}); err != nil {
+		t.Fatalf("Failed to announce addresses: %v", err)
+	}
+}
+
+func TestRouterAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:f4:00:01")
+	src := net.ParseIP("fe80::42:aff:fef4:1")
+	_, prefix, _ := net.ParseCIDR("fd00:10::/64")
+	frame := RouterAdvertisement(mac, src, Destination{}, Router{Lifetime: 1800, MTU: 1450, Prefix: prefix, Autonomous: true})
+
+	if !bytes.Equal(frame[0:6], allNodesMAC) || !bytes.Equal(frame[6:12], mac) {
+		t.Fatalf("Unexpected Ethernet addresses: %x", frame[0:12])
+	}
+	ipv6 := frame[14:]
+	if ipv6[7] != 255 || !net.IP(ipv6[8:24]).Equal(src) || !net.IP(ipv6[24:40]).Equal(net.IPv6linklocalallnodes) {
+		t.Fatalf("Unexpected IPv6 header: %x", ipv6[0:40])
+	}
+	icmp := ipv6[40:]
+	if len(icmp) != 64 || int(binary.BigEndian.Uint16(ipv6[4:])) != len(icmp) {
+		t.Fatalf("Unexpected payload length %d", len(icmp))
+	}
+	if icmp[0] != 134 || binary.BigEndian.Uint16(icmp[6:]) != 1800 {
+		t.Fatalf("Unexpected router advertisement: %x", icmp[0:16])
+	}
+
+	// Source link-layer address, MTU and prefix information options
+	opts := icmp[16:]
+	if opts[0] != 1 || !bytes.Equal(opts[2:8], mac) {
+		t.Fatalf("Unexpected source link-layer address option: %x", opts[0:8])
+	}
+	if opts[8] != 5 || binary.BigEndian.Uint32(opts[12:]) != 1450 {
+		t.Fatalf("Unexpected MTU option: %x", opts[8:16])
+	}
+	pi := opts[16:]
+	if pi[0] != 3 || pi[2] != 64 || pi[3] != 0xc0 || !net.IP(pi[16:32]).Equal(prefix.IP) {
+		t.Fatalf("Unexpected prefix information option: %x", pi)
+	}
+	if sum := checksum(ipv6[8:24], ipv6[24:40], icmp); sum != 0 {
+		t.Fatalf("Invalid checksum, verification sum is %#04x", sum)
+	}
+
+	// Without a prefix or MTU, only the link-layer address is advertised
+	if frame := RouterAdvertisement(mac, src, Destination{}, Router{Lifetime: 0}); len(frame) != 14+40+24 {
+		t.Fatalf("Expected a bare advertisement, got %d bytes", len(frame))
+	}
+
+	// Advertisements to a single host are addressed to it alone
+	dstMAC, _ := net.ParseMAC("02:42:0a:f4:00:02")
+	dstIP := net.ParseIP("fd00:10::2")
+	frame = RouterAdvertisement(mac, src, Destination{MAC: dstMAC, IP: dstIP}, Router{Lifetime: 1800})
+	if !bytes.Equal(frame[0:6], dstMAC) || !net.IP(frame[14+24:14+40]).Equal(dstIP) {
+		t.Fatalf("Unexpected destination %x, %v", frame[0:6], net.IP(frame[14+24:14+40]))
+	}
+	if sum := checksum(frame[14+8:14+24], frame[14+24:14+40], frame[14+40:]); sum != 0 {
+		t.Fatalf("Invalid checksum, verification sum is %#04x", sum)
+	}
+}
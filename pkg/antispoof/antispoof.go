@@ -0,0 +1,134 @@
+//go:build linux
+// +build linux
+
+package antispoof
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// family is the nftables family of the filters. Its ingress hook sees
+	// the port's traffic before the Linux bridge or Open vSwitch does.
+	family = "netdev"
+	// chainPrefix is the prefix of the per-port chains
+	chainPrefix = "port-"
+	// priority runs the filters ahead of other ingress hooks
+	priority = -500
+)
+
+// Port describes the host-side port of an attachment and the addresses the
+// attachment may send from
+type Port struct {
+	// Attachment is the "<container ID>/<interface name>" key of the port,
+	// stored as the chain's comment
+	Attachment string
+	// Device is the host-side interface, e.g. the host veth
+	Device string
+	// MAC is the only source MAC allowed, unchecked if nil
+	MAC net.HardwareAddr
+	// IPs are the only source addresses allowed, besides IPv6 link-local
+	// addresses and the unspecified addresses used by duplicate address
+	// detection
+	IPs []net.IP
+}
+
+// TableName returns the nftables table holding the filters of a network
+func TableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-vni%d", vni)
+}
+
+// ChainName returns the name of the chain filtering an attachment's port
+func ChainName(attachment string) string {
+	hash := sha256.Sum256([]byte(attachment))
+	return chainPrefix + hex.EncodeToString(hash[:])[:16]
+}
+
+// Ruleset returns the nft script Setup applies for the port. It creates the
+// port's chain, or flushes it if it exists, and fills it.
+func Ruleset(table string, port *Port) string {
+	chain := ChainName(port.Attachment)
+	var ipv4, ipv6 []string
+	for _, ip := range port.IPs {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", family, table)
+	fmt.Fprintf(&b, "add chain %s %s %s { type filter hook ingress device \"%s\" priority %d; policy accept; comment \"%s\"; }\n",
+		family, table, chain, port.Device, priority, port.Attachment)
+	fmt.Fprintf(&b, "flush chain %s %s %s\n", family, table, chain)
+	rule := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, "add rule %s %s %s %s\n", family, table, chain, fmt.Sprintf(format, args...))
+	}
+
+	// Tagged frames could carry anything past the checks below
+	rule("ether type { 8021q, 8021ad } drop")
+	if port.MAC != nil {
+		rule("ether saddr != %s drop", port.MAC)
+		rule("arp saddr ether != %s drop", port.MAC)
+	}
+	rule("arp saddr ip != { %s } drop", strings.Join(append(ipv4, "0.0.0.0"), ", "))
+	if len(ipv4) > 0 {
+		rule("ip saddr != { %s } drop", strings.Join(ipv4, ", "))
+	} else {
+		rule("ether type ip drop")
+	}
+	rule("ip6 saddr != { %s } drop", strings.Join(append(ipv6, "fe80::/10", "::"), ", "))
+	return b.String()
+}
+
+// Setup installs the filters of the port, replacing any it had before
+func Setup(table string, port *Port) error {
+	if err := nft.Apply(Ruleset(table, port)); err != nil {
+		return fmt.Errorf("failed to install filters on %s: %v", port.Device, err)
+	}
+	return nil
+}
+
+// Teardown removes the filters of an attachment's port. It is idempotent.
+func Teardown(table, attachment string) error {
+	chain := ChainName(attachment)
+	// Adding the chain first makes deleting it succeed if it's gone already
+	script := fmt.Sprintf("add table %[1]s %[2]s\nadd chain %[1]s %[2]s %[3]s\ndelete chain %[1]s %[2]s %[3]s\n", family, table, chain)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove chain %s: %v", chain, err)
+	}
+	return nil
+}
+
+// DeleteTable removes the network's table with the filters of any ports
+// left. It is idempotent.
+func DeleteTable(table string) error {
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// Attachments returns the attachments with filters in the table, by chain
+// name
+func Attachments(table string) (map[string]string, error) {
+	objects, err := nft.ListTable(family, table)
+	if err != nil {
+		return nil, err
+	}
+	attachments := make(map[string]string)
+	for _, object := range objects {
+		if object.Chain != nil && strings.HasPrefix(object.Chain.Name, chainPrefix) {
+			attachments[object.Chain.Name] = object.Chain.Comment
+		}
+	}
+	return attachments, nil
+}
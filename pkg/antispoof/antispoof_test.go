@@ -0,0 +1,366 @@
+//go:build linux
+// +build linux
+
+package antispoof
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+func TestRuleset(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:f4:00:02")
+	port := &Port{
+		Attachment: "c1/eth0",
+		Device:     "veth1234",
+		MAC:        mac,
+		IPs:        []net.IP{net.ParseIP("10.244.0.2"), net.ParseIP("fd00::2")},
+	}
+	table := TableName(42)
+	chain := ChainName(port.Attachment)
+	ruleset := Ruleset(table, port)
+
+	for _, want := range []string{
+		"add chain netdev xvm-cni-vni42 " + chain + " { type filter hook ingress device \"veth1234\" priority -500; policy accept; comment \"c1/eth0\"; }",
+		"flush chain netdev xvm-cni-vni42 " + chain,
+		"add rule netdev xvm-cni-vni42 " + chain + " ether saddr != 02:42:0a:f4:00:02 drop",
+		"add rule netdev xvm-cni-vni42 " + chain + " arp saddr ether != 02:42:0a:f4:00:02 drop",
+		"add rule netdev xvm-cni-vni42 " + chain + " arp saddr ip != { 10.244.0.2, 0.0.0.0 } drop",
+		"add rule netdev xvm-cni-vni42 " + chain + " ip saddr != { 10.244.0.2 } drop",
+		"add rule netdev xvm-cni-vni42 " + chain + " ip6 saddr != { fd00::2, fe80::/10, :: } drop",
+	} {
+		if !strings.Contains(ruleset, want+"\n") {
+			t.Errorf("Ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+
+	// Without a known MAC only the addresses are checked
+	port.MAC = nil
+	if ruleset := Ruleset(table, port); strings.Contains(ruleset, "ether saddr") {
+		t.Errorf("Expected no MAC check without a MAC:\n%s", ruleset)
+	}
+
+	// Chain names are stable and differ between attachments
+	if chain != ChainName("c1/eth0") || chain == ChainName("c1/eth1") {
+		t.Errorf("Chain names are not unique per attachment")
+	}
+}
+
+func TestSetupTeardown(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not available")
+	}
+
+	port := &Port{
+		Attachment: "antispoof-test/eth0",
+		Device:     "lo",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	table := TableName(16777215)
+	defer DeleteTable(table)
+
+	// Setup twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := Setup(table, port); err != nil {
+			t.Fatalf("Failed to setup filters: %v", err)
+		}
+	}
+	attachments, err := Attachments(table)
+	if err != nil {
+		t.Fatalf("Failed to list attachments: %v", err)
+	}
+	if attachments[ChainName(port.Attachment)] != port.Attachment {
+		t.Fatalf("Expected chain of %s, got %v", port.Attachment, attachments)
+	}
+
+	// Teardown twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := Teardown(table, port.Attachment); err != nil {
+			t.Fatalf("Failed to remove filters: %v", err)
+		}
+	}
+	if attachments, err := Attachments(table); err != nil || len(attachments) != 0 {
+		t.Fatalf("Expected no attachments left, got %v (%v)", attachments, err)
+	}
+}
+
+// frame returns an Ethernet frame from the MAC with the EtherType and
+// payload
+func frame(src string, etherType uint16, payload ...byte) []byte {
+	mac, _ := net.ParseMAC(src)
+	f := append([]byte{0x02, 0, 0, 0, 0, 0x01}, mac...)
+	f = append(f, byte(etherType>>8), byte(etherType))
+	f = append(f, payload...)
+	return append(f, make([]byte, 64)...)
+}
+
+// ipv4 returns an IPv4 header from the address
+func ipv4(src string) []byte {
+	h := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0}
+	h = append(h, net.ParseIP(src).To4()...)
+	return append(h, 10, 244, 0, 1)
+}
+
+// ipv6 returns an IPv6 header from the address
+func ipv6(src string) []byte {
+	h := []byte{0x60, 0, 0, 0, 0, 0, 17, 64}
+	h = append(h, net.ParseIP(src).To16()...)
+	return append(h, net.ParseIP("fd00::1").To16()...)
+}
+
+// arp returns an ARP request from the MAC and address
+func arp(mac, ip string) []byte {
+	hw, _ := net.ParseMAC(mac)
+	p := append([]byte{0, 1, 0x08, 0x00, 6, 4, 0, 1}, hw...)
+	p = append(p, net.ParseIP(ip).To4()...)
+	p = append(p, 0, 0, 0, 0, 0, 0)
+	return append(p, 10, 244, 0, 1)
+}
+
+func TestProgram(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	fs := t.TempDir()
+	if err := bpf.MountFS(fs, bpf.PinDir("antispoof-test")); err != nil {
+		t.Skipf("BPF file system not available: %v", err)
+	}
+	defer unix.Unmount(fs, unix.MNT_DETACH)
+	dir := filepath.Join(fs, bpf.PinDir("antispoof-test"))
+
+	maps, err := OpenMaps(dir)
+	if err != nil {
+		t.Fatalf("Failed to open maps: %v", err)
+	}
+	defer maps.Close()
+	prog, err := Program(maps)
+	if err != nil {
+		t.Fatalf("Failed to load program: %v", err)
+	}
+	defer prog.Close()
+
+	mac, _ := net.ParseMAC("02:42:0a:f4:00:02")
+	port := &Port{
+		Device: "lo",
+		MAC:    mac,
+		IPs:    []net.IP{net.ParseIP("10.244.0.3"), net.ParseIP("fd00::3")},
+	}
+	// Test runs take place on the loopback interface
+	if err := maps.SetPort(1, port); err != nil {
+		t.Fatalf("Failed to set port: %v", err)
+	}
+	// Setting the port again replaces its addresses
+	port.IPs = []net.IP{net.ParseIP("10.244.0.2"), net.ParseIP("fd00::2")}
+	if err := maps.SetPort(1, port); err != nil {
+		t.Fatalf("Failed to set port: %v", err)
+	}
+
+	// The maps are pinned, so opening them again sees the port
+	again, err := OpenExistingMaps(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen maps: %v", err)
+	}
+	defer again.Close()
+	if ports, err := again.Ports(); err != nil || len(ports) != 1 || ports[0] != 1 {
+		t.Errorf("Unexpected ports %v (%v)", ports, err)
+	}
+
+	own, other := "02:42:0a:f4:00:02", "02:42:0a:f4:00:09"
+	cases := []struct {
+		name  string
+		frame []byte
+		want  int32
+	}{
+		{"ipv4", frame(own, 0x0800, ipv4("10.244.0.2")...), bpf.ActUnspec},
+		{"ipv4 from other address", frame(own, 0x0800, ipv4("10.244.0.9")...), bpf.ActShot},
+		{"ipv4 from replaced address", frame(own, 0x0800, ipv4("10.244.0.3")...), bpf.ActShot},
+		{"ipv4 from other MAC", frame(other, 0x0800, ipv4("10.244.0.2")...), bpf.ActShot},
+		{"tagged", frame(own, 0x8100, 0, 1, 0x08, 0x00), bpf.ActShot},
+		{"arp", frame(own, 0x0806, arp(own, "10.244.0.2")...), bpf.ActUnspec},
+		{"arp probe", frame(own, 0x0806, arp(own, "0.0.0.0")...), bpf.ActUnspec},
+		{"arp from other address", frame(own, 0x0806, arp(own, "10.244.0.9")...), bpf.ActShot},
+		{"arp from other MAC", frame(own, 0x0806, arp(other, "10.244.0.2")...), bpf.ActShot},
+		{"ipv6", frame(own, 0x86dd, ipv6("fd00::2")...), bpf.ActUnspec},
+		{"ipv6 link-local", frame(own, 0x86dd, ipv6("fe80::42:aff:fef4:2")...), bpf.ActUnspec},
+		{"ipv6 unspecified", frame(own, 0x86dd, ipv6("::")...), bpf.ActUnspec},
+		{"ipv6 from other address", frame(own, 0x86dd, ipv6("fd00::9")...), bpf.ActShot},
+		{"other", frame(own, 0x88cc), bpf.ActUnspec},
+	}
+	for _, tc := range cases {
+		got, err := prog.Test(tc.frame)
+		if err != nil {
+			t.Fatalf("%s: failed to run program: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+
+	// Without a known MAC only the addresses are checked
+	port.MAC = nil
+	if err := maps.SetPort(1, port); err != nil {
+		t.Fatalf("Failed to set port: %v", err)
+	}
+	if got, err := prog.Test(frame(other, 0x0800, ipv4("10.244.0.2")...)); err != nil || got != bpf.ActUnspec {
+		t.Errorf("Expected unchecked MAC to pass, got %d: %v", got, err)
+	}
+
+	// The traffic of unknown ports is dropped
+	if err := maps.DeletePort(1); err != nil {
+		t.Fatalf("Failed to delete port: %v", err)
+	}
+	if got, err := prog.Test(frame(own, 0x0800, ipv4("10.244.0.2")...)); err != nil || got != bpf.ActShot {
+		t.Errorf("Expected unknown port to be dropped, got %d: %v", got, err)
+	}
+	if has, err := maps.HasPort(1); err != nil || has {
+		t.Errorf("Expected port deleted, got %v (%v)", has, err)
+	}
+	if keys, err := maps.addrs.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("Expected addresses deleted, got %d (%v)", len(keys), err)
+	}
+}
+
+func TestProgramTaggedFrames(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	fs := t.TempDir()
+	if err := bpf.MountFS(fs, bpf.PinDir("antispoof-test")); err != nil {
+		t.Skipf("BPF file system not available: %v", err)
+	}
+	defer unix.Unmount(fs, unix.MNT_DETACH)
+	dir := filepath.Join(fs, bpf.PinDir("antispoof-test"))
+
+	// The receive path moves a frame's tag into the packet's metadata before
+	// tc sees it, which a test run can't, so frames go over a veth pair in a
+	// namespace of their own. The thread stays locked, so it exits with the
+	// goroutine rather than rejoin the test's namespace
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		errc <- sendTagged(dir)
+	}()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendTagged sends a frame from a port with and without a priority tag and
+// checks that only the untagged frame arrives
+func sendTagged(dir string) error {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ctr"}, PeerName: "host"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to add veth: %v", err)
+	}
+	ctr, err := netlink.LinkByName("ctr")
+	if err != nil {
+		return err
+	}
+	host, err := netlink.LinkByName("host")
+	if err != nil {
+		return err
+	}
+	addr, _ := netlink.ParseAddr("10.244.0.1/24")
+	if err := netlink.AddrAdd(host, addr); err != nil {
+		return fmt.Errorf("failed to add address: %v", err)
+	}
+	for _, link := range []netlink.Link{ctr, host} {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %s up: %v", link.Attrs().Name, err)
+		}
+	}
+
+	maps, err := OpenMaps(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open maps: %v", err)
+	}
+	defer maps.Close()
+	prog, err := Program(maps)
+	if err != nil {
+		return fmt.Errorf("failed to load program: %v", err)
+	}
+	defer prog.Close()
+	port := &Port{Device: "host", MAC: ctr.Attrs().HardwareAddr, IPs: []net.IP{net.ParseIP("10.244.0.2")}}
+	if err := maps.SetPort(host.Attrs().Index, port); err != nil {
+		return fmt.Errorf("failed to set port: %v", err)
+	}
+	if err := bpf.AttachIngress(host, prog, Filter, FilterPriority); err != nil {
+		return fmt.Errorf("failed to attach program: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("10.244.0.1")})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	to := &unix.SockaddrLinklayer{Ifindex: ctr.Attrs().Index}
+
+	udp := []byte{0x0f, 0xa0, 0, 0, 0, 9, 0, 0, 'x'}
+	binary.BigEndian.PutUint16(udp[2:], uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+	ip := []byte{0x45, 0, 0, byte(20 + len(udp)), 0, 0, 0, 0, 64, 17, 0, 0, 10, 244, 0, 2, 10, 244, 0, 1}
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	untagged := append([]byte{}, host.Attrs().HardwareAddr...)
+	untagged = append(untagged, ctr.Attrs().HardwareAddr...)
+	tagged := append(append([]byte{}, untagged...), 0x81, 0x00, 0, 0, 0x08, 0x00)
+	untagged = append(untagged, 0x08, 0x00)
+
+	buf := make([]byte, 16)
+	for _, tc := range []struct {
+		name   string
+		frame  []byte
+		arrive bool
+	}{
+		{"untagged", append(untagged, append(ip, udp...)...), true},
+		{"priority-tagged", append(tagged, append(ip, udp...)...), false},
+	} {
+		if err := unix.Sendto(fd, tc.frame, 0, to); err != nil {
+			return fmt.Errorf("%s: failed to send: %v", tc.name, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(buf)
+		if arrived := err == nil; arrived != tc.arrive {
+			return fmt.Errorf("%s: expected arrival %v, got %v (%v)", tc.name, tc.arrive, arrived, err)
+		}
+	}
+	return nil
+}
+
+// checksum returns the Internet checksum of the header
+func checksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(h); i += 2 {
+		sum += uint32(h[i])<<8 | uint32(h[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
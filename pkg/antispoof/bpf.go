@@ -0,0 +1,343 @@
+//go:build linux
+// +build linux
+
+package antispoof
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+const (
+	// Filter names the tc program checking the ports' traffic
+	Filter = "xvm-antispoof"
+	// FilterPriority is the program's tc filter priority, ahead of the
+	// redirects of rate limiting and the fast path
+	FilterPriority = 5
+
+	// portsMap and addrsMap name the pinned maps, of the ports' MACs and of
+	// the addresses they may send from
+	portsMap = "antispoof-ports"
+	addrsMap = "antispoof-addrs"
+	// maxPorts and maxAddrs bound the maps
+	maxPorts = 4096
+	maxAddrs = 16384
+
+	// A port's key is its interface index, its value its MAC followed by a
+	// byte telling whether the MAC is checked
+	portKeySize   = 4
+	portValueSize = 8
+	// An address's key is the port's interface index, the address family
+	// and the address; the value is unused
+	addrKeySize   = 24
+	addrValueSize = 4
+)
+
+// Offsets of the fields of struct __sk_buff the program reads
+const (
+	skbVlanPresent = 20
+	skbIfindex     = 40
+	skbData        = 76
+	skbDataEnd     = 80
+)
+
+// Where the program keeps the map keys on its stack
+const (
+	portKeyAt = -32
+	addrKeyAt = -24
+)
+
+// Maps holds the maps of the ports the program checks
+type Maps struct {
+	ports *bpf.Map
+	addrs *bpf.Map
+}
+
+// OpenMaps opens the maps pinned in dir, creating and pinning those missing
+func OpenMaps(dir string) (*Maps, error) {
+	ports, err := bpf.OpenOrCreateMap(filepath.Join(dir, portsMap), bpf.Hash, portKeySize, portValueSize, maxPorts)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := bpf.OpenOrCreateMap(filepath.Join(dir, addrsMap), bpf.Hash, addrKeySize, addrValueSize, maxAddrs)
+	if err != nil {
+		ports.Close()
+		return nil, err
+	}
+	return &Maps{ports: ports, addrs: addrs}, nil
+}
+
+// OpenExistingMaps opens the maps pinned in dir, returning os.ErrNotExist
+// if they aren't
+func OpenExistingMaps(dir string) (*Maps, error) {
+	ports, err := bpf.OpenMap(filepath.Join(dir, portsMap), portKeySize, portValueSize)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := bpf.OpenMap(filepath.Join(dir, addrsMap), addrKeySize, addrValueSize)
+	if err != nil {
+		ports.Close()
+		return nil, err
+	}
+	return &Maps{ports: ports, addrs: addrs}, nil
+}
+
+// Close releases the maps, which stay pinned
+func (m *Maps) Close() {
+	m.ports.Close()
+	m.addrs.Close()
+}
+
+// portKey returns the key of the port with the interface index
+func portKey(ifindex int) []byte {
+	k := make([]byte, portKeySize)
+	binary.NativeEndian.PutUint32(k, uint32(ifindex))
+	return k
+}
+
+// addrKey returns the key of an address of the port with the interface
+// index
+func addrKey(ifindex int, ip net.IP) []byte {
+	k := make([]byte, addrKeySize)
+	binary.NativeEndian.PutUint32(k, uint32(ifindex))
+	if ip4 := ip.To4(); ip4 != nil {
+		binary.NativeEndian.PutUint32(k[4:], 4)
+		copy(k[8:], ip4)
+	} else {
+		binary.NativeEndian.PutUint32(k[4:], 6)
+		copy(k[8:], ip.To16())
+	}
+	return k
+}
+
+// SetPort has the program check the traffic of the port with the interface
+// index against the port's MAC and addresses, replacing those it had
+func (m *Maps) SetPort(ifindex int, port *Port) error {
+	keep := make(map[string]bool)
+	for _, ip := range port.IPs {
+		k := addrKey(ifindex, ip)
+		if err := m.addrs.Update(k, make([]byte, addrValueSize)); err != nil {
+			return fmt.Errorf("failed to add address %s of %s: %v", ip, port.Device, err)
+		}
+		keep[string(k)] = true
+	}
+
+	value := make([]byte, portValueSize)
+	if port.MAC != nil {
+		copy(value, port.MAC)
+		value[6] = 1
+	}
+	if err := m.ports.Update(portKey(ifindex), value); err != nil {
+		return fmt.Errorf("failed to add port %s: %v", port.Device, err)
+	}
+
+	// Drop the addresses the port had before
+	return m.deleteAddrs(ifindex, keep)
+}
+
+// DeletePort removes the port with the interface index, whose traffic the
+// program then drops
+func (m *Maps) DeletePort(ifindex int) error {
+	if err := m.ports.Delete(portKey(ifindex)); err != nil {
+		return fmt.Errorf("failed to delete port %d: %v", ifindex, err)
+	}
+	return m.deleteAddrs(ifindex, nil)
+}
+
+// deleteAddrs deletes the addresses of the port with the interface index
+// but those to keep
+func (m *Maps) deleteAddrs(ifindex int, keep map[string]bool) error {
+	keys, err := m.addrs.Keys()
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %v", err)
+	}
+	for _, k := range keys {
+		if int(binary.NativeEndian.Uint32(k)) != ifindex || keep[string(k)] {
+			continue
+		}
+		if err := m.addrs.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete address of port %d: %v", ifindex, err)
+		}
+	}
+	return nil
+}
+
+// HasPort reports whether the program knows the port with the interface
+// index
+func (m *Maps) HasPort(ifindex int) (bool, error) {
+	_, err := m.ports.Lookup(portKey(ifindex))
+	if errors.Is(err, bpf.ErrKeyNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up port %d: %v", ifindex, err)
+	}
+	return true, nil
+}
+
+// Ports returns the interface indexes of the ports the program knows
+func (m *Maps) Ports() ([]int, error) {
+	keys, err := m.ports.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %v", err)
+	}
+	ifindexes := make([]int, 0, len(keys))
+	for _, k := range keys {
+		ifindexes = append(ifindexes, int(binary.NativeEndian.Uint32(k)))
+	}
+	return ifindexes, nil
+}
+
+// etherType returns the EtherType as the program loads it from a frame
+func etherType(t uint16) int32 {
+	return int32(binary.NativeEndian.Uint16([]byte{byte(t >> 8), byte(t)}))
+}
+
+// lookup looks up the key on the stack at fp+at in the map, leaving the
+// value's address in R0, or 0
+func lookup(m *bpf.Map, at int32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMap(bpf.R1, m),
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R2, at),
+		bpf.Call(bpf.MapLookupElem),
+	}
+}
+
+// minLen drops frames shorter than n bytes. The frame's bounds are in R7
+// and R8.
+func minLen(n int32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.MovReg(bpf.R4, bpf.R7),
+		bpf.ALU64Imm(bpf.Add, bpf.R4, n),
+		bpf.JumpReg(bpf.JGT, bpf.R4, bpf.R8, "drop"),
+	}
+}
+
+// checkMAC drops frames whose MAC at offset off differs from the port's,
+// whose value R9 points to, if the port's MAC is checked. It continues at
+// label next.
+func checkMAC(off int16, next string) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R9, 6),
+		bpf.JumpImm(bpf.JEq, bpf.R4, 0, next),
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, off),
+		bpf.LoadMem(bpf.Word, bpf.R5, bpf.R9, 0),
+		bpf.JumpReg(bpf.JNE, bpf.R4, bpf.R5, "drop"),
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R7, off+4),
+		bpf.LoadMem(bpf.Half, bpf.R5, bpf.R9, 4),
+		bpf.JumpReg(bpf.JNE, bpf.R4, bpf.R5, "drop"),
+	}
+}
+
+// Program returns the program on the ports. Like the nftables filters, it
+// drops the frames of unknown ports, tagged frames, whether the tag is in
+// the frame or already in the packet's metadata, and frames not from the
+// port's MAC, if checked, and addresses. ARP probes, IPv6 link-local
+// addresses and the unspecified address used by duplicate address detection
+// are allowed.
+func Program(m *Maps) (*bpf.Program, error) {
+	// R6 holds the context, R7 and R8 the frame's bounds
+	insns := []bpf.Instruction{
+		bpf.MovReg(bpf.R6, bpf.R1),
+		bpf.LoadMem(bpf.Word, bpf.R7, bpf.R6, skbData),
+		bpf.LoadMem(bpf.Word, bpf.R8, bpf.R6, skbDataEnd),
+	}
+	insns = append(insns, minLen(14)...)
+
+	// R9 points to the port's value
+	insns = append(insns,
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R6, skbIfindex),
+		bpf.StoreMem(bpf.Word, bpf.R10, portKeyAt, bpf.R4),
+	)
+	insns = append(insns, lookup(m.ports, portKeyAt)...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R0, 0, "drop"),
+		bpf.MovReg(bpf.R9, bpf.R0),
+	)
+	insns = append(insns, checkMAC(6, "ethertype")...)
+
+	// Tagged frames could carry anything past the checks below, whether
+	// the tag is in the frame or, as the receive path and TX VLAN offload
+	// leave it, in the packet's metadata
+	insns = append(insns,
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R6, skbVlanPresent).Labeled("ethertype"),
+		bpf.JumpImm(bpf.JNE, bpf.R4, 0, "drop"),
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R7, 12),
+		bpf.JumpImm(bpf.JEq, bpf.R4, etherType(0x8100), "drop"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, etherType(0x88a8), "drop"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, etherType(0x0806), "arp"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, etherType(0x0800), "ipv4"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, etherType(0x86dd), "ipv6"),
+		bpf.Jump("pass"),
+	)
+
+	// ARP's sender MAC is the port's, its sender address one of the port's
+	// or unspecified
+	arp := minLen(42)
+	arp[0] = arp[0].Labeled("arp")
+	insns = append(insns, arp...)
+	insns = append(insns, checkMAC(22, "arp-ip")...)
+	insns = append(insns,
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, 28).Labeled("arp-ip"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, 0, "pass"),
+		bpf.Jump("addr4"),
+	)
+
+	// R4 holds the IPv4 source address
+	ipv4 := minLen(34)
+	ipv4[0] = ipv4[0].Labeled("ipv4")
+	insns = append(insns, ipv4...)
+	insns = append(insns,
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, 26),
+		bpf.StoreImm(bpf.DoubleWord, bpf.R10, addrKeyAt+8, 0).Labeled("addr4"),
+		bpf.StoreImm(bpf.DoubleWord, bpf.R10, addrKeyAt+16, 0),
+		bpf.StoreMem(bpf.Word, bpf.R10, addrKeyAt+8, bpf.R4),
+		bpf.StoreImm(bpf.Word, bpf.R10, addrKeyAt+4, 4),
+		bpf.Jump("addr"),
+	)
+
+	// IPv6 link-local and unspecified source addresses pass
+	ipv6 := minLen(38)
+	ipv6[0] = ipv6[0].Labeled("ipv6")
+	insns = append(insns, ipv6...)
+	insns = append(insns,
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, 22),
+		bpf.JumpImm(bpf.JNE, bpf.R4, 0xfe, "ipv6-addr"),
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, 23),
+		bpf.ALU64Imm(bpf.And, bpf.R4, 0xc0),
+		bpf.JumpImm(bpf.JEq, bpf.R4, 0x80, "pass"),
+		bpf.MovImm(bpf.R5, 0).Labeled("ipv6-addr"),
+	)
+	for i := int16(0); i < 4; i++ {
+		insns = append(insns,
+			bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, 22+4*i),
+			bpf.StoreMem(bpf.Word, bpf.R10, addrKeyAt+8+4*i, bpf.R4),
+			bpf.ALU64Reg(bpf.Or, bpf.R5, bpf.R4),
+		)
+	}
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R5, 0, "pass"),
+		bpf.StoreImm(bpf.Word, bpf.R10, addrKeyAt+4, 6),
+	)
+
+	// The address must be one of the port's
+	insns = append(insns,
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R6, skbIfindex).Labeled("addr"),
+		bpf.StoreMem(bpf.Word, bpf.R10, addrKeyAt, bpf.R4),
+	)
+	insns = append(insns, lookup(m.addrs, addrKeyAt)...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R0, 0, "drop"),
+		bpf.MovImm(bpf.R0, bpf.ActUnspec).Labeled("pass"),
+		bpf.Exit(),
+		bpf.MovImm(bpf.R0, bpf.ActShot).Labeled("drop"),
+		bpf.Exit(),
+	)
+	return bpf.LoadProgram(bpf.SchedCLS, Filter, insns)
+}
@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+// Package audit logs the plugin's invocations to journald, with the
+// attachment and outcome in fields of their own, or to syslog where
+// journald doesn't run, so log pipelines collecting either can audit the
+// attachments made and removed on a node.
+package audit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Targets an event is logged to
+const (
+	TargetJournald = "journald"
+	TargetSyslog   = "syslog"
+)
+
+// identifier tags the entries of the plugin
+const identifier = "xvm-cni"
+
+// journalSocket is journald's native protocol socket, replaced in tests
+var journalSocket = "/run/systemd/journal/socket"
+
+// Event is an invocation of the plugin
+type Event struct {
+	// Command is the CNI command, e.g. ADD
+	Command     string
+	Network     string
+	ContainerID string
+	IfName      string
+	Netns       string
+	// Args is CNI_ARGS as the runtime passed it
+	Args string
+	// PodNamespace, PodName and PodUID identify the Kubernetes pod of the
+	// attachment, if any
+	PodNamespace string
+	PodName      string
+	PodUID       string
+	Duration     time.Duration
+	// ErrCode and Err are the CNI error code and message the invocation
+	// failed with, 0 and "" on success
+	ErrCode uint
+	Err     string
+}
+
+// field is a journal field
+type field struct {
+	key, value string
+}
+
+// fields returns the event's journal fields, leaving out those unset
+func (e *Event) fields() []field {
+	priority := syslog.LOG_INFO
+	outcome := "success"
+	if e.ErrCode != 0 || e.Err != "" {
+		priority = syslog.LOG_ERR
+		outcome = "failure"
+	}
+	all := []field{
+		{"MESSAGE", e.message()},
+		{"PRIORITY", strconv.Itoa(int(priority))},
+		{"SYSLOG_IDENTIFIER", identifier},
+		{"CNI_COMMAND", e.Command},
+		{"CNI_NETWORK", e.Network},
+		{"CNI_CONTAINERID", e.ContainerID},
+		{"CNI_IFNAME", e.IfName},
+		{"CNI_NETNS", e.Netns},
+		{"CNI_ARGS", e.Args},
+		{"K8S_POD_NAMESPACE", e.PodNamespace},
+		{"K8S_POD_NAME", e.PodName},
+		{"K8S_POD_UID", e.PodUID},
+		{"CNI_OUTCOME", outcome},
+		{"CNI_DURATION_USEC", strconv.FormatInt(e.Duration.Microseconds(), 10)},
+	}
+	if e.ErrCode != 0 {
+		all = append(all, field{"CNI_ERROR_CODE", strconv.FormatUint(uint64(e.ErrCode), 10)})
+	}
+	all = append(all, field{"CNI_ERROR", e.Err})
+	var fields []field
+	for _, f := range all {
+		if f.value != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// message returns the event as a line of text
+func (e *Event) message() string {
+	msg := fmt.Sprintf("%s %s/%s on network %s", e.Command, e.ContainerID, e.IfName, e.Network)
+	if e.ErrCode != 0 || e.Err != "" {
+		return fmt.Sprintf("%s failed in %s: %s", msg, e.Duration.Round(time.Millisecond), e.Err)
+	}
+	return fmt.Sprintf("%s succeeded in %s", msg, e.Duration.Round(time.Millisecond))
+}
+
+// Log logs the event to the target, or to journald if it runs and to
+// syslog otherwise if the target is empty
+func Log(target string, e *Event) error {
+	switch target {
+	case TargetJournald:
+		return logJournal(e)
+	case TargetSyslog:
+		return logSyslog(e)
+	}
+	if _, err := os.Stat(journalSocket); err == nil {
+		return logJournal(e)
+	}
+	return logSyslog(e)
+}
+
+// logJournal sends the event to journald over its native protocol
+func logJournal(e *Event) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to journald: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(encodeJournal(e.fields())); err != nil {
+		return fmt.Errorf("failed to send to journald: %v", err)
+	}
+	return nil
+}
+
+// encodeJournal encodes fields in journald's native protocol. Values with
+// newlines, like multi-line errors, are sent length-prefixed.
+func encodeJournal(fields []field) []byte {
+	var b bytes.Buffer
+	for _, f := range fields {
+		if !strings.Contains(f.value, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", f.key, f.value)
+			continue
+		}
+		b.WriteString(f.key)
+		b.WriteByte('\n')
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(f.value)))
+		b.WriteString(f.value)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// logSyslog sends the event to the local syslog daemon, the fields
+// appended to the message as key="value" pairs
+func logSyslog(e *Event) error {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	defer w.Close()
+	var b strings.Builder
+	b.WriteString(e.message())
+	for _, f := range e.fields() {
+		if !strings.HasPrefix(f.key, "CNI_") && !strings.HasPrefix(f.key, "K8S_") {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%q", strings.ToLower(f.key), f.value)
+	}
+	if e.ErrCode != 0 || e.Err != "" {
+		return w.Err(b.String())
+	}
+	return w.Info(b.String())
+}
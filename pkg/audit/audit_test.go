@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package audit
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeJournal(t *testing.T) {
+	got := encodeJournal([]field{{"MESSAGE", "ADD failed"}, {"CNI_ERROR", "a\nb"}})
+	want := "MESSAGE=ADD failed\nCNI_ERROR\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if string(got) != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestLogJournal(t *testing.T) {
+	journalSocket = filepath.Join(t.TempDir(), "socket")
+	defer func() { journalSocket = "/run/systemd/journal/socket" }()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	e := &Event{
+		Command:     "DEL",
+		Network:     "xvm-network",
+		ContainerID: "ctr-a",
+		IfName:      "eth0",
+		Duration:    1500 * time.Microsecond,
+		ErrCode:     11,
+		Err:         "failed to lock network",
+	}
+	// Without a target, journald is picked as it runs
+	if err := Log("", e); err != nil {
+		t.Fatalf("Failed to log: %v", err)
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	entry := string(buf[:n])
+	for _, want := range []string{
+		"MESSAGE=DEL ctr-a/eth0 on network xvm-network failed in 2ms: failed to lock network\n",
+		"PRIORITY=3\n",
+		"SYSLOG_IDENTIFIER=xvm-cni\n",
+		"CNI_CONTAINERID=ctr-a\n",
+		"CNI_OUTCOME=failure\n",
+		"CNI_DURATION_USEC=1500\n",
+		"CNI_ERROR_CODE=11\n",
+	} {
+		if !strings.Contains(entry, want) {
+			t.Errorf("Expected %q in entry %q", want, entry)
+		}
+	}
+	// Unset fields are left out
+	if bytes.Contains(buf[:n], []byte("CNI_NETNS")) {
+		t.Errorf("Expected no netns field in entry %q", entry)
+	}
+}
@@ -0,0 +1,685 @@
+//go:build linux
+// +build linux
+
+// Package bgp is a minimal BGP-4 speaker (RFC 4271) announcing IPv4
+// prefixes to a fixed set of peers, so routers outside the overlay reach its
+// workloads without NAT. It only originates routes: the peers' UPDATEs are
+// read and ignored. It connects to the peers but doesn't accept connections,
+// so they have to be configured to wait for it, as with a passive neighbor.
+// Sessions can be signed with TCP MD5 (RFC 2385), and survive restarts of
+// the speaker with graceful restart (RFC 4724).
+//
+// Announcing a list of prefixes is all the agent needs of BGP, which this
+// covers without the dependencies of a full implementation such as GoBGP.
+package bgp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultPort is the port BGP peers listen on
+	DefaultPort = 179
+	// DefaultHoldTime is the hold time proposed to the peers
+	DefaultHoldTime = 90 * time.Second
+	// reconnectDelay is how long a session waits before connecting again
+	// after it failed or was closed
+	reconnectDelay = 10 * time.Second
+	// openHoldTime bounds the wait for the peer's OPEN, as RFC 4271
+	// suggests
+	openHoldTime = 4 * time.Minute
+	// writeTimeout bounds writes to a peer that stopped reading
+	writeTimeout = 30 * time.Second
+	// MaxRestartTime is the longest restart time graceful restart can
+	// announce
+	MaxRestartTime = 4095 * time.Second
+	// maxPasswordLen is the longest TCP MD5 key the kernel takes
+	maxPasswordLen = unix.TCP_MD5SIG_MAXKEYLEN
+)
+
+// Message types
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+	// maxPrefixesPerUpdate keeps UPDATEs well within maxMessageLen, with up
+	// to five bytes per prefix
+	maxPrefixesPerUpdate = 700
+	// asTrans stands in for 4-octet AS numbers where only two octets fit
+	// (RFC 6793)
+	asTrans = 23456
+)
+
+// Session states, as reported by Status
+const (
+	StateIdle        = "Idle"
+	StateConnect     = "Connect"
+	StateOpenSent    = "OpenSent"
+	StateOpenConfirm = "OpenConfirm"
+	StateEstablished = "Established"
+)
+
+// Config is how the speaker presents itself and its routes
+type Config struct {
+	LocalAS uint32
+	// RouterID is the speaker's BGP identifier, an IPv4 address
+	RouterID net.IP
+	// NextHop is the IPv4 address the peers route the prefixes to
+	NextHop net.IP
+	// HoldTime is proposed to the peers, DefaultHoldTime if 0
+	HoldTime time.Duration
+	// RestartTime, if set, is how long the peers keep forwarding to the
+	// prefixes after the session closed without a NOTIFICATION, e.g. as
+	// the speaker restarts, before they withdraw them
+	RestartTime time.Duration
+}
+
+// Peer is a router the speaker connects to
+type Peer struct {
+	Address net.IP
+	// Port is DefaultPort if 0
+	Port int
+	AS   uint32
+	// Password signs the session's segments with TCP MD5, if set
+	Password string
+}
+
+func (p Peer) String() string {
+	port := p.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(p.Address.String(), strconv.Itoa(port))
+}
+
+// Status is the state of the session with a peer
+type Status struct {
+	Peer  string `json:"peer"`
+	AS    uint32 `json:"as"`
+	State string `json:"state"`
+	// Since is when the session entered the state
+	Since time.Time `json:"since"`
+	// Advertised is how many prefixes the peer was sent
+	Advertised int `json:"advertised"`
+	// Error is why the session last failed
+	Error string `json:"error,omitempty"`
+}
+
+// Speaker keeps a session to each peer and announces the prefixes to them
+type Speaker struct {
+	conf     Config
+	sessions []*session
+
+	mu sync.Mutex
+	// prefixes are the prefixes to announce, by their string form
+	prefixes map[string]*net.IPNet
+}
+
+// NewSpeaker returns a speaker for the peers, which starts connecting to
+// them once run
+func NewSpeaker(conf Config, peers []Peer) (*Speaker, error) {
+	if conf.LocalAS == 0 {
+		return nil, fmt.Errorf("local AS must be set")
+	}
+	if conf.RouterID.To4() == nil {
+		return nil, fmt.Errorf("router ID %v must be an IPv4 address", conf.RouterID)
+	}
+	if conf.NextHop.To4() == nil {
+		return nil, fmt.Errorf("next hop %v must be an IPv4 address", conf.NextHop)
+	}
+	if conf.HoldTime == 0 {
+		conf.HoldTime = DefaultHoldTime
+	}
+	if conf.HoldTime < 3*time.Second || conf.HoldTime > 65535*time.Second {
+		return nil, fmt.Errorf("hold time %s must be between 3s and 65535s", conf.HoldTime)
+	}
+	if conf.RestartTime < 0 || conf.RestartTime > MaxRestartTime {
+		return nil, fmt.Errorf("restart time %s must be between 0s and %s", conf.RestartTime, MaxRestartTime)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers given")
+	}
+	s := &Speaker{conf: conf, prefixes: make(map[string]*net.IPNet)}
+	for _, p := range peers {
+		if p.Address == nil || p.AS == 0 {
+			return nil, fmt.Errorf("peer %v needs an address and AS", p.Address)
+		}
+		if len(p.Password) > maxPasswordLen {
+			return nil, fmt.Errorf("password of peer %v is longer than %d bytes", p.Address, maxPasswordLen)
+		}
+		s.sessions = append(s.sessions, &session{
+			s:      s,
+			peer:   p,
+			notify: make(chan struct{}, 1),
+			status: Status{Peer: p.String(), AS: p.AS, State: StateIdle, Since: time.Now().UTC()},
+		})
+	}
+	return s, nil
+}
+
+// Run keeps the sessions up until ctx is done, then closes them
+func (s *Speaker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sess := range s.sessions {
+		wg.Add(1)
+		go func(sess *session) {
+			defer wg.Done()
+			sess.run(ctx)
+		}(sess)
+	}
+	wg.Wait()
+}
+
+// Announce replaces the prefixes announced to the peers. Prefixes other
+// than IPv4 are skipped.
+func (s *Speaker) Announce(prefixes []*net.IPNet) {
+	want := make(map[string]*net.IPNet)
+	for _, p := range prefixes {
+		ip := p.IP.To4()
+		ones, bits := p.Mask.Size()
+		if bits == 8*net.IPv6len {
+			ones -= 96
+		}
+		if ip == nil || bits == 0 || ones < 0 {
+			continue
+		}
+		mask := net.CIDRMask(ones, 32)
+		prefix := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		want[prefix.String()] = prefix
+	}
+	s.mu.Lock()
+	s.prefixes = want
+	s.mu.Unlock()
+	for _, sess := range s.sessions {
+		select {
+		case sess.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the sessions' states, in the order of the peers
+func (s *Speaker) Status() []Status {
+	statuses := make([]Status, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		statuses = append(statuses, sess.status)
+		sess.mu.Unlock()
+	}
+	return statuses
+}
+
+// wanted returns the prefixes to announce
+func (s *Speaker) wanted() map[string]*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prefixes
+}
+
+// session is the connection to a peer
+type session struct {
+	s      *Speaker
+	peer   Peer
+	notify chan struct{}
+
+	mu     sync.Mutex
+	status Status
+}
+
+// setState records the session's state
+func (sess *session) setState(state string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.status.State != state {
+		sess.status.State = state
+		sess.status.Since = time.Now().UTC()
+	}
+	if state == StateEstablished {
+		sess.status.Error = ""
+	}
+}
+
+// setAdvertised records how many prefixes the peer was sent
+func (sess *session) setAdvertised(n int) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.status.Advertised = n
+}
+
+// run connects to the peer until ctx is done, waiting between attempts
+func (sess *session) run(ctx context.Context) {
+	for {
+		err := sess.connect(ctx)
+		sess.setState(StateIdle)
+		sess.setAdvertised(0)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			sess.mu.Lock()
+			sess.status.Error = err.Error()
+			sess.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// connect opens the session and keeps the peer's prefixes in line with the
+// speaker's until the session fails or ctx is done
+func (sess *session) connect(ctx context.Context) error {
+	sess.setState(StateConnect)
+	var d net.Dialer
+	if sess.peer.Password != "" {
+		d.Control = func(_, _ string, c syscall.RawConn) error {
+			return setPassword(c, sess.peer.Address, sess.peer.Password)
+		}
+	}
+	conn, err := d.DialContext(ctx, "tcp", sess.peer.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Stop waiting for the peer once ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	conf := sess.s.conf
+	sess.setState(StateOpenSent)
+	conn.SetDeadline(time.Now().Add(openHoldTime))
+	if err := writeMessage(conn, msgOpen, openBody(conf.LocalAS, uint16(conf.HoldTime/time.Second), conf.RouterID, uint16(conf.RestartTime/time.Second))); err != nil {
+		return err
+	}
+	typ, body, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if typ != msgOpen {
+		return unexpected(typ, body, "OPEN")
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		writeMessage(conn, msgNotification, []byte{2, 0})
+		return err
+	}
+	if open.AS != sess.peer.AS {
+		writeMessage(conn, msgNotification, []byte{2, 2})
+		return fmt.Errorf("peer is AS %d, expected %d", open.AS, sess.peer.AS)
+	}
+	hold := conf.HoldTime
+	if peerHold := time.Duration(open.HoldTime) * time.Second; peerHold < hold {
+		hold = peerHold
+	}
+	if hold != 0 && hold < 3*time.Second {
+		writeMessage(conn, msgNotification, []byte{2, 6})
+		return fmt.Errorf("peer's hold time %s is too short", hold)
+	}
+
+	sess.setState(StateOpenConfirm)
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		return err
+	}
+	if typ, body, err = readMessage(conn); err != nil {
+		return err
+	}
+	if typ != msgKeepalive {
+		return unexpected(typ, body, "KEEPALIVE")
+	}
+	sess.setState(StateEstablished)
+
+	// Read until the session fails, the peer's KEEPALIVEs holding it open
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if hold != 0 {
+				conn.SetReadDeadline(time.Now().Add(hold))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			typ, body, err := readMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			switch typ {
+			case msgKeepalive, msgUpdate:
+			default:
+				readErr <- unexpected(typ, body, "KEEPALIVE or UPDATE")
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if hold != 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	attrs := pathAttrs(conf, sess.peer.AS, open.FourOctetAS)
+	advertised := make(map[string]*net.IPNet)
+	update := func() error {
+		want := sess.s.wanted()
+		var withdrawn, announced []*net.IPNet
+		for key, p := range advertised {
+			if want[key] == nil {
+				withdrawn = append(withdrawn, p)
+			}
+		}
+		for key, p := range want {
+			if advertised[key] == nil {
+				announced = append(announced, p)
+			}
+		}
+		if err := sendUpdates(conn, withdrawn, announced, attrs); err != nil {
+			return err
+		}
+		advertised = want
+		sess.setAdvertised(len(advertised))
+		return nil
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	// With graceful restart, the peer replaces the routes it kept from
+	// before once the End-of-RIB marker, an empty UPDATE, tells it all are
+	// announced
+	if conf.RestartTime != 0 {
+		if err := writeMessage(conn, msgUpdate, updateBody(nil, nil, nil)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return sess.close(conn)
+		case err := <-readErr:
+			// The read fails as well once ctx is done
+			if ctx.Err() != nil {
+				return sess.close(conn)
+			}
+			return err
+		case <-sess.notify:
+			if err := update(); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// close ends the session as the speaker stops: with a Cease, or, with
+// graceful restart, by closing the connection alone, so the peer keeps the
+// routes until the speaker is back
+func (sess *session) close(conn net.Conn) error {
+	if sess.s.conf.RestartTime == 0 {
+		writeMessage(conn, msgNotification, []byte{6, 2})
+	}
+	return nil
+}
+
+// setPassword has the connection to the peer signed with TCP MD5
+func setPassword(c syscall.RawConn, peer net.IP, password string) error {
+	sig := &unix.TCPMD5Sig{Keylen: uint16(len(password))}
+	copy(sig.Key[:], password)
+	// The address is a struct sockaddr_in or sockaddr_in6
+	if ip := peer.To4(); ip != nil {
+		sig.Addr.Family = unix.AF_INET
+		copy(sig.Addr.Data[2:], ip)
+	} else {
+		sig.Addr.Family = unix.AF_INET6
+		copy(sig.Addr.Data[6:], peer.To16())
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptTCPMD5Sig(int(fd), unix.IPPROTO_TCP, unix.TCP_MD5SIG, sig)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set TCP MD5 password: %w", err)
+	}
+	return nil
+}
+
+// unexpected returns the error of a message the session didn't expect,
+// with the peer's reason if it is a NOTIFICATION
+func unexpected(typ byte, body []byte, expected string) error {
+	if typ == msgNotification && len(body) >= 2 {
+		return fmt.Errorf("peer sent NOTIFICATION %d/%d", body[0], body[1])
+	}
+	return fmt.Errorf("peer sent message type %d, expected %s", typ, expected)
+}
+
+// writeMessage writes a message of the type with the body
+func writeMessage(w net.Conn, typ byte, body []byte) error {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = typ
+	w.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// readMessage reads a message, returning its type and body
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return 0, nil, errors.New("message header lacks the marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// openMsg is what the session needs of an OPEN
+type openMsg struct {
+	AS       uint32
+	HoldTime uint16
+	ID       net.IP
+	// FourOctetAS is whether the speaker supports 4-octet AS numbers
+	FourOctetAS bool
+	// RestartTime is the speaker's graceful restart time in seconds, if it
+	// announces graceful restart
+	RestartTime uint16
+	// GracefulRestart is whether the speaker announces graceful restart
+	GracefulRestart bool
+}
+
+// openBody returns an OPEN announcing IPv4 unicast and 4-octet AS numbers,
+// and graceful restart with the forwarding state of IPv4 unicast kept if
+// the restart time is set
+func openBody(as uint32, holdTime uint16, routerID net.IP, restartTime uint16) []byte {
+	as2 := uint16(asTrans)
+	if as <= 0xffff {
+		as2 = uint16(as)
+	}
+	caps := []byte{
+		1, 4, 0, 1, 0, 1, // Multiprotocol: IPv4 unicast
+		65, 4, 0, 0, 0, 0, // 4-octet AS number
+	}
+	binary.BigEndian.PutUint32(caps[8:], as)
+	if restartTime != 0 {
+		caps = append(caps, 64, 6, byte(restartTime>>8)&0x0f, byte(restartTime), 0, 1, 1, 0x80)
+	}
+
+	body := []byte{4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[1:], as2)
+	binary.BigEndian.PutUint16(body[3:], holdTime)
+	body = append(body, routerID.To4()...)
+	body = append(body, byte(2+len(caps)), 2, byte(len(caps)))
+	return append(body, caps...)
+}
+
+// parseOpen parses the body of an OPEN
+func parseOpen(body []byte) (*openMsg, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("OPEN too short")
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	open := &openMsg{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: binary.BigEndian.Uint16(body[3:]),
+		ID:       net.IP(append([]byte(nil), body[5:9]...)),
+	}
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("OPEN optional parameters length mismatch")
+	}
+	for len(params) >= 2 {
+		typ, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			return nil, fmt.Errorf("OPEN optional parameter truncated")
+		}
+		value := params[2 : 2+length]
+		params = params[2+length:]
+		if typ != 2 {
+			continue
+		}
+		// Capabilities
+		for len(value) >= 2 {
+			code, capLen := value[0], int(value[1])
+			if len(value) < 2+capLen {
+				return nil, fmt.Errorf("OPEN capability truncated")
+			}
+			if code == 65 && capLen == 4 {
+				open.AS = binary.BigEndian.Uint32(value[2:])
+				open.FourOctetAS = true
+			}
+			if code == 64 && capLen >= 2 {
+				open.RestartTime = binary.BigEndian.Uint16(value[2:]) & 0x0fff
+				open.GracefulRestart = true
+			}
+			value = value[2+capLen:]
+		}
+	}
+	return open, nil
+}
+
+// pathAttrs returns the path attributes of the announced prefixes: IGP
+// origin, an AS path of the local AS towards external peers, the next hop,
+// and the default local preference towards internal ones
+func pathAttrs(conf Config, peerAS uint32, fourOctet bool) []byte {
+	attrs := []byte{0x40, 1, 1, 0}
+	switch {
+	case peerAS == conf.LocalAS:
+		attrs = append(attrs, 0x40, 2, 0)
+	case fourOctet:
+		attrs = append(attrs, 0x40, 2, 6, 2, 1)
+		attrs = binary.BigEndian.AppendUint32(attrs, conf.LocalAS)
+	case conf.LocalAS <= 0xffff:
+		attrs = append(attrs, 0x40, 2, 4, 2, 1)
+		attrs = binary.BigEndian.AppendUint16(attrs, uint16(conf.LocalAS))
+	default:
+		// The peer sees AS_TRANS and the actual AS in AS4_PATH
+		attrs = append(attrs, 0x40, 2, 4, 2, 1)
+		attrs = binary.BigEndian.AppendUint16(attrs, asTrans)
+		attrs = append(attrs, 0xc0, 17, 6, 2, 1)
+		attrs = binary.BigEndian.AppendUint32(attrs, conf.LocalAS)
+	}
+	attrs = append(attrs, 0x40, 3, 4)
+	attrs = append(attrs, conf.NextHop.To4()...)
+	if peerAS == conf.LocalAS {
+		attrs = append(attrs, 0x40, 5, 4, 0, 0, 0, 100)
+	}
+	return attrs
+}
+
+// sendUpdates withdraws and announces the prefixes, in UPDATEs of at most
+// maxPrefixesPerUpdate prefixes each
+func sendUpdates(conn net.Conn, withdrawn, announced []*net.IPNet, attrs []byte) error {
+	sortPrefixes(withdrawn)
+	sortPrefixes(announced)
+	for len(withdrawn) > 0 {
+		n := len(withdrawn)
+		if n > maxPrefixesPerUpdate {
+			n = maxPrefixesPerUpdate
+		}
+		if err := writeMessage(conn, msgUpdate, updateBody(withdrawn[:n], nil, nil)); err != nil {
+			return err
+		}
+		withdrawn = withdrawn[n:]
+	}
+	for len(announced) > 0 {
+		n := len(announced)
+		if n > maxPrefixesPerUpdate {
+			n = maxPrefixesPerUpdate
+		}
+		if err := writeMessage(conn, msgUpdate, updateBody(nil, announced[:n], attrs)); err != nil {
+			return err
+		}
+		announced = announced[n:]
+	}
+	return nil
+}
+
+// sortPrefixes sorts the prefixes, so UPDATEs are the same for the same
+// prefixes
+func sortPrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].String() < prefixes[j].String() })
+}
+
+// updateBody returns an UPDATE withdrawing and announcing the prefixes
+func updateBody(withdrawn, announced []*net.IPNet, attrs []byte) []byte {
+	routes := encodePrefixes(withdrawn)
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(routes)))
+	body = append(body, routes...)
+	if len(announced) == 0 {
+		attrs = nil
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	return append(body, encodePrefixes(announced)...)
+}
+
+// encodePrefixes encodes the prefixes as their length in bits followed by
+// the octets holding them
+func encodePrefixes(prefixes []*net.IPNet) []byte {
+	var b []byte
+	for _, p := range prefixes {
+		ones, _ := p.Mask.Size()
+		b = append(b, byte(ones))
+		b = append(b, p.IP.To4()[:(ones+7)/8]...)
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+//go:build linux
+// +build linux
+
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// decodePrefixes parses prefixes encoded by encodePrefixes
+func decodePrefixes(b []byte) ([]string, error) {
+	var prefixes []string
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+n {
+			return nil, fmt.Errorf("invalid prefix")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String())
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
+
+// readUpdate reads messages until an UPDATE and returns its withdrawn
+// prefixes, path attributes and announced prefixes
+func readUpdate(t *testing.T, conn net.Conn) ([]string, []byte, []string) {
+	t.Helper()
+	for {
+		typ, body, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read UPDATE: %v", err)
+		}
+		if typ == msgKeepalive {
+			continue
+		}
+		if typ != msgUpdate {
+			t.Fatalf("Expected UPDATE, got message type %d", typ)
+		}
+		withdrawnLen := int(binary.BigEndian.Uint16(body))
+		withdrawn, err := decodePrefixes(body[2 : 2+withdrawnLen])
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = body[2+withdrawnLen:]
+		attrsLen := int(binary.BigEndian.Uint16(body))
+		attrs := body[2 : 2+attrsLen]
+		announced, err := decodePrefixes(body[2+attrsLen:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return withdrawn, attrs, announced
+	}
+}
+
+func TestSpeaker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewSpeaker(Config{
+		LocalAS:  4200000001,
+		RouterID: net.ParseIP("10.0.0.1"),
+		NextHop:  net.ParseIP("192.168.1.10"),
+	}, []Peer{{Address: net.ParseIP("127.0.0.1"), Port: ln.Addr().(*net.TCPAddr).Port, AS: 65000}})
+	if err != nil {
+		t.Fatalf("Failed to create speaker: %v", err)
+	}
+	var prefixes []*net.IPNet
+	for _, cidr := range []string{"10.244.0.6/32", "10.244.0.5/32", "fd00::5/128"} {
+		_, p, _ := net.ParseCIDR(cidr)
+		prefixes = append(prefixes, p)
+	}
+	s.Announce(prefixes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The speaker opens with its 4-octet AS
+	typ, body, err := readMessage(conn)
+	if err != nil || typ != msgOpen {
+		t.Fatalf("Expected OPEN, got %d, %v", typ, err)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		t.Fatalf("Failed to parse OPEN: %v", err)
+	}
+	if open.AS != 4200000001 || !open.FourOctetAS || open.HoldTime != 90 || !open.ID.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Unexpected OPEN %+v", open)
+	}
+	if err := writeMessage(conn, msgOpen, openBody(65000, 30, net.ParseIP("10.0.0.2"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once established, the IPv4 prefixes are announced through the node
+	withdrawn, attrs, announced := readUpdate(t, conn)
+	if len(withdrawn) != 0 || fmt.Sprint(announced) != "[10.244.0.5/32 10.244.0.6/32]" {
+		t.Fatalf("Unexpected UPDATE withdrawing %v, announcing %v", withdrawn, announced)
+	}
+	asPath := []byte{0x40, 2, 6, 2, 1, 0xfa, 0x56, 0xea, 0x01}
+	nextHop := []byte{0x40, 3, 4, 192, 168, 1, 10}
+	if !bytes.Contains(attrs, asPath) || !bytes.Contains(attrs, nextHop) {
+		t.Fatalf("Unexpected path attributes %x", attrs)
+	}
+
+	// Prefixes no longer announced are withdrawn
+	s.Announce(prefixes[:1])
+	withdrawn, _, announced = readUpdate(t, conn)
+	if fmt.Sprint(withdrawn) != "[10.244.0.5/32]" || len(announced) != 0 {
+		t.Fatalf("Unexpected UPDATE withdrawing %v, announcing %v", withdrawn, announced)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		status := s.Status()[0]
+		if status.State == StateEstablished && status.Advertised == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected status %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping the speaker ends the session with a Cease
+	cancel()
+	for {
+		typ, body, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("Expected NOTIFICATION, got %v", err)
+		}
+		if typ == msgNotification {
+			if !bytes.Equal(body, []byte{6, 2}) {
+				t.Fatalf("Unexpected NOTIFICATION %v", body)
+			}
+			break
+		}
+	}
+}
+
+// establish answers the speaker's OPEN on the connection and returns it
+func establish(t *testing.T, conn net.Conn) *openMsg {
+	t.Helper()
+	typ, body, err := readMessage(conn)
+	if err != nil || typ != msgOpen {
+		t.Fatalf("Expected OPEN, got %d, %v", typ, err)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		t.Fatalf("Failed to parse OPEN: %v", err)
+	}
+	if err := writeMessage(conn, msgOpen, openBody(65000, 30, net.ParseIP("10.0.0.2"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		t.Fatal(err)
+	}
+	return open
+}
+
+// runSpeaker runs a speaker of AS 65010 announcing the prefix to a peer of
+// AS 65000 on the listener, until the returned function stops it
+func runSpeaker(t *testing.T, conf Config, ln net.Listener, password string, prefix string) func() {
+	t.Helper()
+	conf.LocalAS, conf.RouterID, conf.NextHop = 65010, net.ParseIP("10.0.0.1"), net.ParseIP("192.168.1.10")
+	peer := Peer{Address: net.ParseIP("127.0.0.1"), Port: ln.Addr().(*net.TCPAddr).Port, AS: 65000, Password: password}
+	s, err := NewSpeaker(conf, []Peer{peer})
+	if err != nil {
+		t.Fatalf("Failed to create speaker: %v", err)
+	}
+	_, p, _ := net.ParseCIDR(prefix)
+	s.Announce([]*net.IPNet{p})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestGracefulRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	stop := runSpeaker(t, Config{RestartTime: 120 * time.Second}, ln, "", "10.244.0.5/32")
+	defer stop()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The speaker announces graceful restart, then the End-of-RIB marker
+	// after its prefixes
+	if open := establish(t, conn); !open.GracefulRestart || open.RestartTime != 120 {
+		t.Fatalf("Expected graceful restart in 120s, got %+v", open)
+	}
+	if _, _, announced := readUpdate(t, conn); fmt.Sprint(announced) != "[10.244.0.5/32]" {
+		t.Fatalf("Unexpected UPDATE announcing %v", announced)
+	}
+	if withdrawn, attrs, announced := readUpdate(t, conn); len(withdrawn)+len(attrs)+len(announced) != 0 {
+		t.Fatalf("Expected End-of-RIB, got UPDATE withdrawing %v, announcing %v", withdrawn, announced)
+	}
+
+	// Stopping the speaker closes the session without a Cease, so the peer
+	// keeps the routes
+	stop()
+	for {
+		typ, _, err := readMessage(conn)
+		if err != nil {
+			break
+		}
+		if typ == msgNotification {
+			t.Fatalf("Expected no NOTIFICATION with graceful restart")
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// The peer only accepts segments signed with the password
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return setPassword(c, net.ParseIP("127.0.0.1"), "secret")
+	}}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if errors.Is(err, unix.ENOPROTOOPT) {
+		t.Skip("TCP MD5 not supported by the kernel")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tcp := ln.(*net.TCPListener)
+
+	stop := runSpeaker(t, Config{}, ln, "wrong", "10.244.0.5/32")
+	tcp.SetDeadline(time.Now().Add(time.Second))
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+		t.Fatalf("Expected the connection with the wrong password to fail")
+	}
+	stop()
+
+	stop = runSpeaker(t, Config{}, ln, "secret", "10.244.0.5/32")
+	defer stop()
+	tcp.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Expected the connection with the password to succeed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	establish(t, conn)
+	if _, _, announced := readUpdate(t, conn); fmt.Sprint(announced) != "[10.244.0.5/32]" {
+		t.Fatalf("Unexpected UPDATE announcing %v", announced)
+	}
+}
+
+func TestPathAttrs(t *testing.T) {
+	conf := Config{LocalAS: 65010, NextHop: net.ParseIP("192.168.1.10")}
+
+	// Internal peers get an empty AS path and the local preference
+	attrs := pathAttrs(conf, 65010, true)
+	if !bytes.Contains(attrs, []byte{0x40, 2, 0}) || !bytes.Contains(attrs, []byte{0x40, 5, 4, 0, 0, 0, 100}) {
+		t.Fatalf("Unexpected internal path attributes %x", attrs)
+	}
+
+	// Peers without 4-octet AS numbers get 2-octet paths, with AS_TRANS
+	// standing in for a 4-octet local AS
+	attrs = pathAttrs(conf, 65000, false)
+	if !bytes.Contains(attrs, []byte{0x40, 2, 4, 2, 1, 0xfd, 0xf2}) {
+		t.Fatalf("Unexpected 2-octet path attributes %x", attrs)
+	}
+	conf.LocalAS = 4200000001
+	attrs = pathAttrs(conf, 65000, false)
+	if !bytes.Contains(attrs, []byte{0x40, 2, 4, 2, 1, 0x5b, 0xa0}) || !bytes.Contains(attrs, []byte{0xc0, 17, 6, 2, 1, 0xfa, 0x56, 0xea, 0x01}) {
+		t.Fatalf("Unexpected AS4_PATH attributes %x", attrs)
+	}
+}
@@ -0,0 +1,243 @@
+//go:build linux
+// +build linux
+
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Register is one of the eBPF machine's registers. R0 holds return values,
+// R1-R5 the arguments of helper calls, R6-R9 survive calls and R10 is the
+// read-only frame pointer.
+type Register uint8
+
+const (
+	R0 Register = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// Size is the width of a memory access
+type Size uint8
+
+const (
+	Word       Size = 0x00
+	Half       Size = 0x08
+	Byte       Size = 0x10
+	DoubleWord Size = 0x18
+)
+
+// ALUOp is an arithmetic operation
+type ALUOp uint8
+
+const (
+	Add ALUOp = 0x00
+	Sub ALUOp = 0x10
+	Mul ALUOp = 0x20
+	Or  ALUOp = 0x40
+	And ALUOp = 0x50
+	LSh ALUOp = 0x60
+	RSh ALUOp = 0x70
+	Xor ALUOp = 0xa0
+	Mov ALUOp = 0xb0
+)
+
+// JumpOp is a conditional jump's comparison
+type JumpOp uint8
+
+const (
+	JEq  JumpOp = 0x10
+	JGT  JumpOp = 0x20
+	JGE  JumpOp = 0x30
+	JSet JumpOp = 0x40
+	JNE  JumpOp = 0x50
+	JLT  JumpOp = 0xa0
+	JLE  JumpOp = 0xb0
+)
+
+// Helper is a kernel function programs call
+type Helper int32
+
+const (
+	MapLookupElem Helper = 1
+	MapUpdateElem Helper = 2
+	MapDeleteElem Helper = 3
+	KtimeGetNS    Helper = 5
+	Redirect      Helper = 23
+)
+
+// Instruction classes, modes and sources of the encoding
+const (
+	classLD    = 0x00
+	classLDX   = 0x01
+	classST    = 0x02
+	classSTX   = 0x03
+	classJMP   = 0x05
+	classALU64 = 0x07
+
+	modeIMM = 0x00
+	modeMEM = 0x60
+
+	srcK = 0x00
+	srcX = 0x08
+
+	opJA   = 0x00
+	opCall = 0x80
+	opExit = 0x90
+
+	// pseudoMapFD has a 64-bit load take a map's file descriptor, which
+	// the kernel replaces with the map's address
+	pseudoMapFD = 1
+)
+
+// Instruction is an eBPF instruction. Jumps name the label of their target
+// rather than giving its offset, which Assemble resolves.
+type Instruction struct {
+	OpCode   uint8
+	Dst, Src Register
+	Offset   int16
+	Constant int64
+
+	// Label names the instruction for jumps to it
+	Label string
+	// Target is the label a jump goes to
+	Target string
+}
+
+// Labeled returns the instruction named label
+func (i Instruction) Labeled(label string) Instruction {
+	i.Label = label
+	return i
+}
+
+// wide reports whether the instruction takes two slots, as 64-bit loads do
+func (i Instruction) wide() bool {
+	return i.OpCode == classLD|modeIMM|uint8(DoubleWord)
+}
+
+// ALU64Imm applies op to dst and the constant
+func ALU64Imm(op ALUOp, dst Register, imm int32) Instruction {
+	return Instruction{OpCode: classALU64 | uint8(op) | srcK, Dst: dst, Constant: int64(imm)}
+}
+
+// ALU64Reg applies op to dst and src
+func ALU64Reg(op ALUOp, dst, src Register) Instruction {
+	return Instruction{OpCode: classALU64 | uint8(op) | srcX, Dst: dst, Src: src}
+}
+
+// MovImm sets dst to the constant
+func MovImm(dst Register, imm int32) Instruction {
+	return ALU64Imm(Mov, dst, imm)
+}
+
+// MovReg copies src to dst
+func MovReg(dst, src Register) Instruction {
+	return ALU64Reg(Mov, dst, src)
+}
+
+// LoadImm64 sets dst to a 64-bit constant
+func LoadImm64(dst Register, imm int64) Instruction {
+	return Instruction{OpCode: classLD | modeIMM | uint8(DoubleWord), Dst: dst, Constant: imm}
+}
+
+// LoadMap sets dst to the map, as the first argument of map helpers
+func LoadMap(dst Register, m *Map) Instruction {
+	return Instruction{OpCode: classLD | modeIMM | uint8(DoubleWord), Dst: dst, Src: pseudoMapFD, Constant: int64(m.fd)}
+}
+
+// LoadMem loads the value of the size at src+off into dst
+func LoadMem(size Size, dst, src Register, off int16) Instruction {
+	return Instruction{OpCode: classLDX | modeMEM | uint8(size), Dst: dst, Src: src, Offset: off}
+}
+
+// StoreMem stores src at dst+off
+func StoreMem(size Size, dst Register, off int16, src Register) Instruction {
+	return Instruction{OpCode: classSTX | modeMEM | uint8(size), Dst: dst, Src: src, Offset: off}
+}
+
+// StoreImm stores the constant at dst+off
+func StoreImm(size Size, dst Register, off int16, imm int32) Instruction {
+	return Instruction{OpCode: classST | modeMEM | uint8(size), Dst: dst, Offset: off, Constant: int64(imm)}
+}
+
+// JumpImm jumps to target if dst compares to the constant
+func JumpImm(op JumpOp, dst Register, imm int32, target string) Instruction {
+	return Instruction{OpCode: classJMP | uint8(op) | srcK, Dst: dst, Constant: int64(imm), Target: target}
+}
+
+// JumpReg jumps to target if dst compares to src
+func JumpReg(op JumpOp, dst, src Register, target string) Instruction {
+	return Instruction{OpCode: classJMP | uint8(op) | srcX, Dst: dst, Src: src, Target: target}
+}
+
+// Jump jumps to target
+func Jump(target string) Instruction {
+	return Instruction{OpCode: classJMP | opJA, Target: target}
+}
+
+// Call calls the helper, with the arguments in R1-R5 and the result in R0
+func Call(helper Helper) Instruction {
+	return Instruction{OpCode: classJMP | opCall, Constant: int64(helper)}
+}
+
+// Exit returns R0
+func Exit() Instruction {
+	return Instruction{OpCode: classJMP | opExit}
+}
+
+// Assemble encodes the instructions in the kernel's format, resolving the
+// jumps' labels
+func Assemble(insns []Instruction) ([]byte, error) {
+	// Find the slot of every label, 64-bit loads taking two
+	labels := make(map[string]int)
+	slot := 0
+	for _, insn := range insns {
+		if insn.Label != "" {
+			if _, ok := labels[insn.Label]; ok {
+				return nil, fmt.Errorf("duplicate label %q", insn.Label)
+			}
+			labels[insn.Label] = slot
+		}
+		slot++
+		if insn.wide() {
+			slot++
+		}
+	}
+
+	buf := make([]byte, 0, slot*8)
+	slot = 0
+	for _, insn := range insns {
+		off := insn.Offset
+		if insn.Target != "" {
+			target, ok := labels[insn.Target]
+			if !ok {
+				return nil, fmt.Errorf("undefined label %q", insn.Target)
+			}
+			off = int16(target - slot - 1)
+		}
+		buf = appendSlot(buf, insn.OpCode, insn.Dst, insn.Src, off, int32(insn.Constant))
+		slot++
+		if insn.wide() {
+			buf = appendSlot(buf, 0, 0, 0, 0, int32(insn.Constant>>32))
+			slot++
+		}
+	}
+	return buf, nil
+}
+
+// appendSlot appends one 8-byte instruction slot
+func appendSlot(buf []byte, op uint8, dst, src Register, off int16, imm int32) []byte {
+	buf = append(buf, op, uint8(src)<<4|uint8(dst)&0x0f)
+	buf = binary.NativeEndian.AppendUint16(buf, uint16(off))
+	return binary.NativeEndian.AppendUint32(buf, uint32(imm))
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package bpf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	code, err := Assemble([]Instruction{
+		JumpImm(JEq, R1, 0, "out"),
+		LoadImm64(R0, 1<<32|2),
+		Jump("out"),
+		MovImm(R0, -1).Labeled("out"),
+		Exit(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to assemble: %v", err)
+	}
+	if len(code) != 6*8 {
+		t.Fatalf("Expected 6 slots, got %d bytes", len(code))
+	}
+	// The jumps skip the 64-bit load's two slots
+	if off := int16(code[2]) | int16(code[3])<<8; off != 3 {
+		t.Errorf("Expected first jump by 3 slots, got %d", off)
+	}
+	if off := int16(code[3*8+2]) | int16(code[3*8+3])<<8; off != 0 {
+		t.Errorf("Expected second jump by 0 slots, got %d", off)
+	}
+	if !bytes.Equal(code[8:24], []byte{0x18, 0x00, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}) {
+		t.Errorf("Unexpected 64-bit load % x", code[8:24])
+	}
+	if !bytes.Equal(code[32:40], []byte{0xb7, 0x00, 0, 0, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("Unexpected move % x", code[32:40])
+	}
+
+	if _, err := Assemble([]Instruction{Jump("nowhere")}); err == nil {
+		t.Errorf("Expected undefined label to be rejected")
+	}
+	if _, err := Assemble([]Instruction{Exit().Labeled("a"), Exit().Labeled("a")}); err == nil {
+		t.Errorf("Expected duplicate label to be rejected")
+	}
+}
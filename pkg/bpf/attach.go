@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Return codes of direct-action tc programs
+const (
+	// ActUnspec continues with the hook's next filter
+	ActUnspec = -1
+	// ActOK passes the packet on
+	ActOK = 0
+	// ActShot drops the packet
+	ActShot = 2
+)
+
+// Return codes of XDP programs
+const (
+	// XDPDrop drops the packet
+	XDPDrop = 1
+	// XDPPass passes the packet on to the kernel's stack
+	XDPPass = 2
+)
+
+// filterHandle is the handle of the filters attached, one per priority, so
+// attaching again replaces the filter rather than adding another
+const filterHandle = 1
+
+// ensureIngressQdisc adds the ingress qdisc filters on the link's ingress
+// hook hang off, unless it or a clsact qdisc is there already
+func ensureIngressQdisc(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs on %s: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent == netlink.HANDLE_INGRESS {
+			return nil
+		}
+	}
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add ingress qdisc on %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// AttachIngress attaches the program in direct-action mode to the link's
+// ingress hook, as the filter named name at the priority. Filters of lower
+// priority values run first; a filter at the priority is replaced.
+func AttachIngress(link netlink.Link, prog *Program, name string, priority uint16) error {
+	if err := ensureIngressQdisc(link); err != nil {
+		return err
+	}
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    filterHandle,
+			Priority:  priority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           prog.fd,
+		Name:         name,
+		DirectAction: true,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("failed to attach %s to %s: %v", name, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// DetachIngress removes the filters at the priority from the link's
+// ingress hook, if any
+func DetachIngress(link netlink.Link, priority uint16) error {
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  priority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+	}
+	err := netlink.FilterDel(filter)
+	if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to detach filter from %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// IngressAttached reports whether the program named name is attached to the
+// link's ingress hook at the priority
+func IngressAttached(link netlink.Link, name string, priority uint16) (bool, error) {
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		return false, fmt.Errorf("failed to list filters on %s: %v", link.Attrs().Name, err)
+	}
+	for _, f := range filters {
+		if bf, ok := f.(*netlink.BpfFilter); ok && bf.Priority == priority && bf.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AttachXDP attaches the program to the link's XDP hook, generically unless
+// native is set. Many drivers reset their rings or flap the link to take a
+// program, and some refuse one above an MTU, so attaching in the driver is
+// left to those who know theirs. It fails if another program is attached.
+func AttachXDP(link netlink.Link, prog *Program, native bool) error {
+	mode := unix.XDP_FLAGS_SKB_MODE
+	if native {
+		mode = unix.XDP_FLAGS_DRV_MODE
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, prog.fd, unix.XDP_FLAGS_UPDATE_IF_NOEXIST|mode); err != nil {
+		return fmt.Errorf("failed to attach XDP program to %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// DetachXDP removes the program from the link's XDP hook, if any, in the
+// mode it was attached in
+func DetachXDP(link netlink.Link) error {
+	mode := 0
+	if current, err := netlink.LinkByIndex(link.Attrs().Index); err == nil && current.Attrs().Xdp != nil {
+		switch current.Attrs().Xdp.AttachMode {
+		case nl.XDP_ATTACHED_SKB:
+			mode = unix.XDP_FLAGS_SKB_MODE
+		case nl.XDP_ATTACHED_DRV:
+			mode = unix.XDP_FLAGS_DRV_MODE
+		}
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, -1, mode); err != nil {
+		return fmt.Errorf("failed to detach XDP program from %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// XDPProgramID returns the ID of the program attached to the XDP hook of the
+// link with the index, or 0 if none is
+func XDPProgramID(ifindex int) (uint32, error) {
+	link, err := netlink.LinkByIndex(ifindex)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find interface %d: %v", ifindex, err)
+	}
+	if xdp := link.Attrs().Xdp; xdp != nil && xdp.Attached {
+		return xdp.ProgId, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,453 @@
+//go:build linux
+// +build linux
+
+// Package bpf loads the eBPF programs and maps of the plugin's datapath and
+// attaches them to devices, with no dependency beyond the bpf() system call
+// and netlink
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultFSDir is where the BPF file system holding pinned maps is mounted
+const DefaultFSDir = "/sys/fs/bpf"
+
+// ErrKeyNotExist is returned for keys a map doesn't hold
+var ErrKeyNotExist = errors.New("key does not exist")
+
+// MapType is the kind of a map
+type MapType uint32
+
+const (
+	Hash    MapType = unix.BPF_MAP_TYPE_HASH
+	Array   MapType = unix.BPF_MAP_TYPE_ARRAY
+	LRUHash MapType = unix.BPF_MAP_TYPE_LRU_HASH
+)
+
+// ProgramType is the kind of a program, which decides where it attaches
+type ProgramType uint32
+
+const (
+	SchedCLS ProgramType = unix.BPF_PROG_TYPE_SCHED_CLS
+	XDP      ProgramType = unix.BPF_PROG_TYPE_XDP
+)
+
+// mapCreateAttr is the BPF_MAP_CREATE variant of union bpf_attr
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+// mapElemAttr is the variant of the element commands
+type mapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// objAttr is the variant of BPF_OBJ_PIN and BPF_OBJ_GET
+type objAttr struct {
+	pathname uint64
+	fd       uint32
+	flags    uint32
+}
+
+// progLoadAttr is the variant of BPF_PROG_LOAD
+type progLoadAttr struct {
+	progType    uint32
+	insnCount   uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	flags       uint32
+	name        [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+// infoAttr is the variant of BPF_OBJ_GET_INFO_BY_FD
+type infoAttr struct {
+	fd      uint32
+	infoLen uint32
+	info    uint64
+}
+
+// testRunAttr is the variant of BPF_PROG_TEST_RUN
+type testRunAttr struct {
+	progFD      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      uint64
+	dataOut     uint64
+	repeat      uint32
+	duration    uint32
+}
+
+// bpf issues the command, returning the new file descriptor of commands
+// creating one
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// pointer returns the address of the buffer as the kernel takes it
+func pointer(b []byte) uint64 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+// cString returns s NUL-terminated
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Map is a map loaded in the kernel, shared with the programs referring to
+// it
+type Map struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+// NewMap creates a map of the type, with keys and values of the sizes in
+// bytes
+func NewMap(typ MapType, keySize, valueSize, maxEntries int) (*Map, error) {
+	attr := mapCreateAttr{
+		mapType:    uint32(typ),
+		keySize:    uint32(keySize),
+		valueSize:  uint32(valueSize),
+		maxEntries: uint32(maxEntries),
+	}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create map: %v", err)
+	}
+	return &Map{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+// OpenMap opens the map pinned at the path, whose keys and values must be
+// of the sizes given
+func OpenMap(path string, keySize, valueSize int) (*Map, error) {
+	fd, err := getPinned(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Map{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+// OpenOrCreateMap opens the map pinned at the path, or creates the map as
+// NewMap does and pins it there
+func OpenOrCreateMap(path string, typ MapType, keySize, valueSize, maxEntries int) (*Map, error) {
+	m, err := OpenMap(path, keySize, valueSize)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return m, err
+	}
+	m, err = NewMap(typ, keySize, valueSize, maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Pin(path); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// FD returns the map's file descriptor
+func (m *Map) FD() int {
+	return m.fd
+}
+
+// Close releases the map, which lives on while pinned or used by a program
+func (m *Map) Close() error {
+	return unix.Close(m.fd)
+}
+
+// Pin pins the map at the path on the BPF file system, so it outlives the
+// process
+func (m *Map) Pin(path string) error {
+	return pin(m.fd, path)
+}
+
+// Lookup returns the value of the key
+func (m *Map) Lookup(key []byte) ([]byte, error) {
+	if err := m.checkKey(key); err != nil {
+		return nil, err
+	}
+	value := make([]byte, m.valueSize)
+	attr := mapElemAttr{mapFD: uint32(m.fd), key: pointer(key), value: pointer(value)}
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	if errors.Is(err, unix.ENOENT) {
+		return nil, ErrKeyNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up key: %v", err)
+	}
+	return value, nil
+}
+
+// Update sets the value of the key, adding it if missing
+func (m *Map) Update(key, value []byte) error {
+	if err := m.checkKey(key); err != nil {
+		return err
+	}
+	if len(value) != m.valueSize {
+		return fmt.Errorf("value of %d bytes, map holds %d", len(value), m.valueSize)
+	}
+	attr := mapElemAttr{mapFD: uint32(m.fd), key: pointer(key), value: pointer(value), flags: unix.BPF_ANY}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	if err != nil {
+		return fmt.Errorf("failed to update key: %v", err)
+	}
+	return nil
+}
+
+// Delete removes the key, if present
+func (m *Map) Delete(key []byte) error {
+	if err := m.checkKey(key); err != nil {
+		return err
+	}
+	attr := mapElemAttr{mapFD: uint32(m.fd), key: pointer(key)}
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to delete key: %v", err)
+	}
+	return nil
+}
+
+// Keys returns the keys the map holds. Keys added or removed meanwhile may
+// be missed.
+func (m *Map) Keys() ([][]byte, error) {
+	var keys [][]byte
+	var key []byte
+	for {
+		next := make([]byte, m.keySize)
+		attr := mapElemAttr{mapFD: uint32(m.fd), key: pointer(key), value: pointer(next)}
+		_, err := bpf(unix.BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(key)
+		runtime.KeepAlive(next)
+		if errors.Is(err, unix.ENOENT) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate keys: %v", err)
+		}
+		keys = append(keys, next)
+		key = next
+	}
+}
+
+func (m *Map) checkKey(key []byte) error {
+	if len(key) != m.keySize {
+		return fmt.Errorf("key of %d bytes, map holds %d", len(key), m.keySize)
+	}
+	return nil
+}
+
+// Program is a program loaded in the kernel
+type Program struct {
+	fd int
+}
+
+// LoadProgram loads the instructions as a program of the type named name.
+// The verifier's log is part of the error if it rejects them.
+func LoadProgram(typ ProgramType, name string, insns []Instruction) (*Program, error) {
+	code, err := Assemble(insns)
+	if err != nil {
+		return nil, err
+	}
+	license := cString("GPL")
+	attr := progLoadAttr{
+		progType:  uint32(typ),
+		insnCount: uint32(len(code) / 8),
+		insns:     pointer(code),
+		license:   pointer(license),
+	}
+	copy(attr.name[:unix.BPF_OBJ_NAME_LEN-1], objName(name))
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		runtime.KeepAlive(code)
+		runtime.KeepAlive(license)
+		return &Program{fd: fd}, nil
+	}
+
+	// Load again with the verifier's log to explain the rejection
+	log := make([]byte, 64*1024)
+	attr.logLevel = 1
+	attr.logSize = uint32(len(log))
+	attr.logBuf = pointer(log)
+	if fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return &Program{fd: fd}, nil
+	}
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if n := indexNUL(log); n > 0 {
+		return nil, fmt.Errorf("failed to load program %s: %v: %s", name, err, log[:n])
+	}
+	return nil, fmt.Errorf("failed to load program %s: %v", name, err)
+}
+
+// OpenProgram opens the program pinned at the path
+func OpenProgram(path string) (*Program, error) {
+	fd, err := getPinned(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{fd: fd}, nil
+}
+
+// FD returns the program's file descriptor
+func (p *Program) FD() int {
+	return p.fd
+}
+
+// Pin pins the program at the path on the BPF file system, so it stays
+// loaded when detached
+func (p *Program) Pin(path string) error {
+	return pin(p.fd, path)
+}
+
+// ID returns the program's ID, by which netlink reports attached programs
+func (p *Program) ID() (uint32, error) {
+	// struct bpf_prog_info starts with the type and the ID
+	info := make([]byte, 8)
+	attr := infoAttr{fd: uint32(p.fd), infoLen: uint32(len(info)), info: pointer(info)}
+	_, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(info)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get program info: %v", err)
+	}
+	return binary.NativeEndian.Uint32(info[4:]), nil
+}
+
+// Close releases the program, which stays loaded while attached
+func (p *Program) Close() error {
+	return unix.Close(p.fd)
+}
+
+// Test runs the program once on the packet, which must hold at least an
+// Ethernet header, and returns the program's return value. Helpers acting on
+// the packet, like redirects, only record their action.
+func (p *Program) Test(packet []byte) (int32, error) {
+	out := make([]byte, len(packet)+256)
+	attr := testRunAttr{
+		progFD:      uint32(p.fd),
+		dataSizeIn:  uint32(len(packet)),
+		dataSizeOut: uint32(len(out)),
+		dataIn:      pointer(packet),
+		dataOut:     pointer(out),
+		repeat:      1,
+	}
+	_, err := bpf(unix.BPF_PROG_TEST_RUN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(packet)
+	runtime.KeepAlive(out)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run program: %v", err)
+	}
+	return int32(attr.retval), nil
+}
+
+// objName returns name with the characters object names can't hold
+// replaced by '_'
+func objName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func indexNUL(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// pin pins the object at the path, replacing an object pinned there
+func pin(fd int, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to unpin %s: %v", path, err)
+	}
+	name := cString(path)
+	attr := objAttr{pathname: pointer(name), fd: uint32(fd)}
+	_, err := bpf(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(name)
+	if err != nil {
+		return fmt.Errorf("failed to pin %s: %v", path, err)
+	}
+	return nil
+}
+
+// getPinned opens the object pinned at the path
+func getPinned(path string) (int, error) {
+	name := cString(path)
+	attr := objAttr{pathname: pointer(name)}
+	fd, err := bpf(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(name)
+	if errors.Is(err, unix.ENOENT) {
+		return -1, os.ErrNotExist
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return fd, nil
+}
+
+// PinDir returns the directory below the BPF file system holding the maps
+// of a network
+func PinDir(network string) string {
+	return filepath.Join("xvm-cni", network)
+}
+
+// MountFS mounts the BPF file system at dir, unless it is mounted there
+// already, and creates sub below it
+func MountFS(dir, sub string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %v", dir, err)
+	}
+	if uint32(st.Type) != unix.BPF_FS_MAGIC {
+		if err := unix.Mount("bpf", dir, "bpf", 0, "mode=0700"); err != nil {
+			return fmt.Errorf("failed to mount BPF file system at %s: %v", dir, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Join(dir, sub), err)
+	}
+	return nil
+}
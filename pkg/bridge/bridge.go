@@ -0,0 +1,294 @@
+//go:build linux
+// +build linux
+
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// BridgeConfig holds the configuration for an overlay bridge
+type BridgeConfig struct {
+	Name string
+	MTU  int
+}
+
+// BridgeName returns the name of the overlay bridge of a network, or of a
+// VXLAN ID for networks without a name as earlier versions named it
+func BridgeName(network string, vxlanID int) string {
+	if network == "" {
+		return fmt.Sprintf("xvmbr%d", vxlanID)
+	}
+	return devname.For("xbr-", network)
+}
+
+// SetupBridge creates the bridge if it doesn't exist yet and sets it up
+func SetupBridge(config *BridgeConfig) (*netlink.Bridge, error) {
+	// Reuse the bridge if it already exists
+	existing, err := netlink.LinkByName(config.Name)
+	if err == nil {
+		br, ok := existing.(*netlink.Bridge)
+		if !ok {
+			return nil, fmt.Errorf("interface %s already exists but is not a bridge", config.Name)
+		}
+		if br.Attrs().Flags&net.FlagUp == 0 {
+			if err := netlink.LinkSetUp(br); err != nil {
+				return nil, fmt.Errorf("failed to set bridge %s up: %v", config.Name, err)
+			}
+		}
+		return br, nil
+	}
+
+	// Create the bridge
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   config.Name,
+			MTU:    config.MTU,
+			TxQLen: -1,
+		},
+	}
+	// Another invocation may have created it concurrently, use theirs then
+	err = retry.Do(func() error { return netlink.LinkAdd(br) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create bridge %s: %v", config.Name, err)
+	}
+
+	// Set the bridge up
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set bridge %s up: %v", config.Name, err)
+	}
+
+	// Re-read the bridge to pick up kernel-assigned attributes
+	link, err := netlink.LinkByName(config.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bridge %s: %v", config.Name, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("interface %s is not a bridge", config.Name)
+	}
+
+	return br, nil
+}
+
+// AddPort enslaves the link to the bridge
+func AddPort(br *netlink.Bridge, link netlink.Link) error {
+	if link.Attrs().MasterIndex == br.Attrs().Index {
+		return nil // Already a port
+	}
+	if err := retry.Do(func() error { return netlink.LinkSetMaster(link, br) }); err != nil {
+		return fmt.Errorf("failed to add %s to bridge %s: %v", link.Attrs().Name, br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// DefaultVLAN is the VLAN ports are untagged members of unless placed in
+// another one, and the one the bridge's own addresses are in
+const DefaultVLAN = 1
+
+// MaxVLAN is the largest VLAN ID
+const MaxVLAN = 4094
+
+// EnableVLANFiltering has the bridge forward frames only between ports of
+// the same VLAN. The uplink, if any, carries every other VLAN tagged, next to
+// the default one untagged, so containers of a VLAN reach those of other
+// nodes.
+func EnableVLANFiltering(br *netlink.Bridge, uplink netlink.Link) error {
+	if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+		return fmt.Errorf("failed to enable VLAN filtering on bridge %s: %w", br.Attrs().Name, err)
+	}
+	if uplink == nil {
+		return nil
+	}
+	if err := netlink.BridgeVlanAddRange(uplink, DefaultVLAN+1, MaxVLAN, false, false, false, true); err != nil {
+		return fmt.Errorf("failed to add VLANs to %s: %v", uplink.Attrs().Name, err)
+	}
+	return nil
+}
+
+// SetPortVLAN makes the port an untagged member of the VLAN instead of the
+// default one
+func SetPortVLAN(port netlink.Link, vid int) error {
+	if vid == DefaultVLAN {
+		return nil
+	}
+	if err := netlink.BridgeVlanAdd(port, uint16(vid), true, true, false, true); err != nil {
+		return fmt.Errorf("failed to add %s to VLAN %d: %v", port.Attrs().Name, vid, err)
+	}
+	if err := netlink.BridgeVlanDel(port, DefaultVLAN, false, false, false, true); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to remove %s from VLAN %d: %v", port.Attrs().Name, DefaultVLAN, err)
+	}
+	return nil
+}
+
+// GatewayVLANName returns the name of the VLAN interface on a network's
+// bridge that carries the gateway addresses into the VLAN
+func GatewayVLANName(network string, vid int) string {
+	return devname.For(fmt.Sprintf("xgw%d-", vid), network)
+}
+
+// SetupGatewayVLAN creates the VLAN interface on the bridge if it doesn't
+// exist yet and makes the bridge itself a tagged member of the VLAN. Frames
+// the node sends through the bridge are in the default VLAN, so the ports of
+// another VLAN reach the node's addresses only through such an interface.
+func SetupGatewayVLAN(br *netlink.Bridge, name string, vid int) (netlink.Link, error) {
+	if err := netlink.BridgeVlanAdd(br, uint16(vid), false, false, true, false); err != nil {
+		return nil, fmt.Errorf("failed to add bridge %s to VLAN %d: %v", br.Attrs().Name, vid, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		vlan := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: br.Attrs().Index, MTU: br.Attrs().MTU},
+			VlanId:    vid,
+		}
+		if err := netlink.LinkAdd(vlan); err != nil && !errors.Is(err, unix.EEXIST) {
+			return nil, fmt.Errorf("failed to create VLAN interface %s: %v", name, err)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, fmt.Errorf("failed to get VLAN interface %s: %v", name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set VLAN interface %s up: %v", name, err)
+	}
+	return link, nil
+}
+
+// PortVLAN returns the VLAN untagged frames received on the port are in, 0
+// if they are dropped
+func PortVLAN(port netlink.Link) (int, error) {
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list VLANs: %v", err)
+	}
+	for _, v := range vlans[int32(port.Attrs().Index)] {
+		if v.PortVID() {
+			return int(v.Vid), nil
+		}
+	}
+	return 0, nil
+}
+
+// ConfigureGateway assigns the gateway address to the bridge so it routes
+// for the containers attached to it
+func ConfigureGateway(br *netlink.Bridge, gateway *net.IPNet) error {
+	addr := &netlink.Addr{IPNet: gateway}
+	if err := retry.Do(func() error { return netlink.AddrReplace(br, addr) }); err != nil {
+		return fmt.Errorf("failed to add gateway %s to bridge %s: %v", gateway, br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// CleanupBridge removes the bridge
+func CleanupBridge(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// If the bridge doesn't exist, that's fine
+		return nil
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// ErrNoFDBLimit is returned on kernels older than 6.8, whose bridges learn
+// any number of forwarding entries
+var ErrNoFDBLimit = errors.New("kernel doesn't limit the forwarding entries bridges learn")
+
+// FDBLimit is the count of forwarding entries a bridge learned, and the
+// most it learns, 0 if any number
+type FDBLimit struct {
+	Learned    int
+	MaxLearned int
+}
+
+// SetFDBMaxLearned limits the forwarding entries the bridge learns, 0 for no
+// limit. Entries added explicitly don't count.
+func SetFDBMaxLearned(br netlink.Link, max int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+	info := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	info.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := info.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(unix.IFLA_BR_FDB_MAX_LEARNED, nl.Uint32Attr(uint32(max)))
+	req.AddData(info)
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to limit forwarding entries of bridge %s: %v", br.Attrs().Name, err)
+	}
+
+	// Older kernels ignore the attribute rather than reject it
+	limit, err := FDBLimitOf(br)
+	if err != nil {
+		return err
+	}
+	if limit.MaxLearned != max {
+		return fmt.Errorf("bridge %s kept its limit of %d forwarding entries", br.Attrs().Name, limit.MaxLearned)
+	}
+	return nil
+}
+
+// FDBLimitOf returns the forwarding entries the bridge learned and its limit
+// of them, or ErrNoFDBLimit
+func FDBLimitOf(br netlink.Link) (FDBLimit, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return FDBLimit{}, fmt.Errorf("failed to get bridge %s: %v", br.Attrs().Name, err)
+	}
+	if len(msgs) != 1 || len(msgs[0]) < unix.SizeofIfInfomsg {
+		return FDBLimit{}, fmt.Errorf("unexpected reply for bridge %s", br.Attrs().Name)
+	}
+
+	var limit FDBLimit
+	var learned, maxLearned bool
+	attrs, err := nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+	if err != nil {
+		return FDBLimit{}, fmt.Errorf("failed to parse bridge %s: %v", br.Attrs().Name, err)
+	}
+	for _, data := range nested(nested(attrs, unix.IFLA_LINKINFO), nl.IFLA_INFO_DATA) {
+		switch data.Attr.Type & nl.NLA_TYPE_MASK {
+		case unix.IFLA_BR_FDB_N_LEARNED:
+			limit.Learned = int(nl.NativeEndian().Uint32(data.Value))
+			learned = true
+		case unix.IFLA_BR_FDB_MAX_LEARNED:
+			limit.MaxLearned = int(nl.NativeEndian().Uint32(data.Value))
+			maxLearned = true
+		}
+	}
+	if !learned || !maxLearned {
+		return FDBLimit{}, ErrNoFDBLimit
+	}
+	return limit, nil
+}
+
+// nested returns the attributes nested in the one of the given type, if any
+func nested(attrs []syscall.NetlinkRouteAttr, typ uint16) []syscall.NetlinkRouteAttr {
+	for _, attr := range attrs {
+		if attr.Attr.Type&nl.NLA_TYPE_MASK == typ {
+			children, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil
+			}
+			return children
+		}
+	}
+	return nil
+}
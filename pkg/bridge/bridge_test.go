@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package bridge
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetupBridge(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	config := &BridgeConfig{
+		Name: BridgeName("", 99), // Use a high ID to avoid conflicts
+		MTU:  1500,
+	}
+
+	// Setup twice to verify the bridge is reused
+	br, err := SetupBridge(config)
+	if err != nil {
+		t.Fatalf("Failed to setup bridge: %v", err)
+	}
+	defer CleanupBridge(config.Name)
+	again, err := SetupBridge(config)
+	if err != nil {
+		t.Fatalf("Failed to setup existing bridge: %v", err)
+	}
+	if again.Attrs().Index != br.Attrs().Index {
+		t.Fatalf("Existing bridge was recreated")
+	}
+
+	// Configure gateway twice to verify idempotency
+	gateway := &net.IPNet{IP: net.ParseIP("10.99.0.1"), Mask: net.CIDRMask(24, 32)}
+	for i := 0; i < 2; i++ {
+		if err := ConfigureGateway(br, gateway); err != nil {
+			t.Fatalf("Failed to configure gateway: %v", err)
+		}
+	}
+	addrs, err := netlink.AddrList(br, unix.AF_INET)
+	if err != nil {
+		t.Fatalf("Failed to list bridge addresses: %v", err)
+	}
+	if len(addrs) != 1 || !addrs[0].IP.Equal(gateway.IP) {
+		t.Fatalf("Expected gateway %s on bridge, got %v", gateway.IP, addrs)
+	}
+
+	// Clean up
+	if err := CleanupBridge(config.Name); err != nil {
+		t.Fatalf("Failed to cleanup bridge: %v", err)
+	}
+	if _, err := netlink.LinkByName(config.Name); err == nil {
+		t.Fatalf("Bridge still exists after cleanup")
+	}
+}
+
+func TestVLANFiltering(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	config := &BridgeConfig{Name: BridgeName("", 98), MTU: 1500}
+	br, err := SetupBridge(config)
+	if err != nil {
+		t.Fatalf("Failed to setup bridge: %v", err)
+	}
+	defer CleanupBridge(config.Name)
+
+	// Ports are veths, one standing in for the VXLAN interface
+	var ports []netlink.Link
+	for _, name := range []string{"xvmvlt0", "xvmvlt1"} {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatalf("Failed to create veth: %v", err)
+		}
+		defer netlink.LinkDel(veth)
+		link, _ := netlink.LinkByName(name)
+		if err := AddPort(br, link); err != nil {
+			t.Fatalf("Failed to add port: %v", err)
+		}
+		ports = append(ports, link)
+	}
+	uplink, port := ports[0], ports[1]
+
+	if err := EnableVLANFiltering(br, uplink); errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("Bridge VLAN filtering not supported by the kernel")
+	} else if err != nil {
+		t.Fatalf("Failed to enable VLAN filtering: %v", err)
+	}
+	if err := SetPortVLAN(port, 100); err != nil {
+		t.Fatalf("Failed to set port VLAN: %v", err)
+	}
+	if vid, err := PortVLAN(port); err != nil || vid != 100 {
+		t.Fatalf("Expected port in VLAN 100, got %d: %v", vid, err)
+	}
+
+	// The uplink stays in the default VLAN and carries the others tagged
+	if vid, err := PortVLAN(uplink); err != nil || vid != DefaultVLAN {
+		t.Fatalf("Expected uplink in VLAN %d, got %d: %v", DefaultVLAN, vid, err)
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := false
+	for _, v := range vlans[int32(uplink.Attrs().Index)] {
+		if v.Vid == 100 && !v.EngressUntag() {
+			tagged = true
+		}
+	}
+	if !tagged {
+		t.Fatalf("Expected uplink to carry VLAN 100 tagged, got %v", vlans[int32(uplink.Attrs().Index)])
+	}
+}
+
+func TestFDBLimit(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	config := &BridgeConfig{Name: BridgeName("", 97), MTU: 1500}
+	br, err := SetupBridge(config)
+	if err != nil {
+		t.Fatalf("Failed to setup bridge: %v", err)
+	}
+	defer CleanupBridge(config.Name)
+
+	limit, err := FDBLimitOf(br)
+	if errors.Is(err, ErrNoFDBLimit) {
+		t.Skip("Kernel doesn't limit learned forwarding entries")
+	}
+	if err != nil {
+		t.Fatalf("Failed to get limit: %v", err)
+	}
+	if limit.MaxLearned != 0 {
+		t.Fatalf("Expected new bridge to learn any number, got limit %d", limit.MaxLearned)
+	}
+	if err := SetFDBMaxLearned(br, 5000); err != nil {
+		t.Fatalf("Failed to set limit: %v", err)
+	}
+	if limit, err := FDBLimitOf(br); err != nil || limit.MaxLearned != 5000 {
+		t.Fatalf("Expected limit 5000, got %+v (%v)", limit, err)
+	}
+}
@@ -0,0 +1,422 @@
+//go:build linux
+// +build linux
+
+// Package bumguard limits the VXLAN-encapsulated broadcast and multicast
+// frames each remote VTEP sends into a VNI, with an XDP program on the
+// node's underlay interface. Frames beyond a peer's limit are dropped before
+// they reach the kernel's stack, so a misbehaving peer's broadcast storm
+// can't take the node's CPU. Unknown unicast frames can't be told apart
+// from known ones on receipt and aren't limited.
+package bumguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+const (
+	// ProgramName names the XDP program
+	ProgramName = "xvm-bumguard"
+
+	// vnisMap, peersMap and progPin name the pinned maps, of the limits of
+	// the VNIs and of the peers' token buckets, and the pinned program
+	vnisMap  = "vnis"
+	peersMap = "peers"
+	progPin  = "prog"
+	// maxVNIs and maxPeers bound the maps. Peers beyond the bound evict
+	// those least recently seen.
+	maxVNIs  = 4096
+	maxPeers = 65536
+
+	// A VNI's key is the VXLAN port and the VNI as they are on the wire, its
+	// value the cost of a frame and the bucket's size, in nanoseconds
+	vniKeySize   = 8
+	vniValueSize = 16
+	// A peer's key is the VNI's followed by the peer's address, its value
+	// the time the bucket was last filled and the credit it holds
+	peerKeySize   = 24
+	peerValueSize = 16
+)
+
+// Offsets of the fields of struct xdp_md the program reads
+const (
+	xdpData    = 0
+	xdpDataEnd = 4
+)
+
+// Where the program keeps the map keys, the time and a new bucket on its
+// stack
+const (
+	keyAt    = -32
+	nowAt    = -40
+	bucketAt = -56
+)
+
+// Limit is the BUM traffic a peer may send into a VNI
+type Limit struct {
+	// Rate is the frames per second, at most 1e9
+	Rate int
+	// Burst is the frames a peer may send at once after being quiet
+	Burst int
+}
+
+// value returns the VNI's map value of the limit: the nanoseconds of
+// credit a frame costs and the most credit a bucket holds
+func (l Limit) value() []byte {
+	cost := uint64(1e9 / l.Rate)
+	v := make([]byte, vniValueSize)
+	binary.NativeEndian.PutUint64(v, cost)
+	binary.NativeEndian.PutUint64(v[8:], cost*uint64(l.Burst))
+	return v
+}
+
+// Dir returns the directory below the BPF file system holding the guard of
+// an interface. It is shared by the networks on the interface, as XDP takes
+// a single program; network names can't start with '_', so it doesn't
+// clash with theirs.
+func Dir(iface string) string {
+	return filepath.Join(bpf.PinDir("_bumguard"), iface)
+}
+
+// Lock takes the lock of the guard in dir, serializing the networks sharing
+// it. It returns the function releasing the lock, or an error satisfying
+// os.ErrNotExist if dir is missing.
+func Lock(dir string) (func(), error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// Maps holds the maps of an interface's guard
+type Maps struct {
+	vnis  *bpf.Map
+	peers *bpf.Map
+}
+
+// Open opens the maps pinned in dir, creating and pinning those missing
+func Open(dir string) (*Maps, error) {
+	vnis, err := bpf.OpenOrCreateMap(filepath.Join(dir, vnisMap), bpf.Hash, vniKeySize, vniValueSize, maxVNIs)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := bpf.OpenOrCreateMap(filepath.Join(dir, peersMap), bpf.LRUHash, peerKeySize, peerValueSize, maxPeers)
+	if err != nil {
+		vnis.Close()
+		return nil, err
+	}
+	return &Maps{vnis: vnis, peers: peers}, nil
+}
+
+// OpenExisting opens the maps pinned in dir, returning os.ErrNotExist if
+// they aren't
+func OpenExisting(dir string) (*Maps, error) {
+	vnis, err := bpf.OpenMap(filepath.Join(dir, vnisMap), vniKeySize, vniValueSize)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := bpf.OpenMap(filepath.Join(dir, peersMap), peerKeySize, peerValueSize)
+	if err != nil {
+		vnis.Close()
+		return nil, err
+	}
+	return &Maps{vnis: vnis, peers: peers}, nil
+}
+
+// Close releases the maps, which stay pinned
+func (m *Maps) Close() {
+	m.vnis.Close()
+	m.peers.Close()
+}
+
+// vniKey returns the key of the VNI on the VXLAN port
+func vniKey(port, vni int) []byte {
+	return []byte{byte(port >> 8), byte(port), 0, 0, byte(vni >> 16), byte(vni >> 8), byte(vni), 0}
+}
+
+// SetVNI limits the BUM traffic each peer sends into the VNI on the VXLAN
+// port
+func (m *Maps) SetVNI(port, vni int, limit Limit) error {
+	if err := m.vnis.Update(vniKey(port, vni), limit.value()); err != nil {
+		return fmt.Errorf("failed to set limit of VNI %d: %v", vni, err)
+	}
+	return nil
+}
+
+// Limits reports whether the BUM traffic into the VNI on the VXLAN port is
+// limited as limit
+func (m *Maps) Limits(port, vni int, limit Limit) (bool, error) {
+	value, err := m.vnis.Lookup(vniKey(port, vni))
+	if errors.Is(err, bpf.ErrKeyNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up limit of VNI %d: %v", vni, err)
+	}
+	return string(value) == string(limit.value()), nil
+}
+
+// DeleteVNI stops limiting the traffic into the VNI on the VXLAN port and
+// forgets its peers
+func (m *Maps) DeleteVNI(port, vni int) error {
+	key := vniKey(port, vni)
+	if err := m.vnis.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete limit of VNI %d: %v", vni, err)
+	}
+	keys, err := m.peers.Keys()
+	if err != nil {
+		return fmt.Errorf("failed to list peers: %v", err)
+	}
+	for _, k := range keys {
+		if string(k[:vniKeySize]) != string(key) {
+			continue
+		}
+		if err := m.peers.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete peer of VNI %d: %v", vni, err)
+		}
+	}
+	return nil
+}
+
+// Empty reports whether the guard limits no VNI
+func (m *Maps) Empty() (bool, error) {
+	keys, err := m.vnis.Keys()
+	if err != nil {
+		return false, fmt.Errorf("failed to list VNIs: %v", err)
+	}
+	return len(keys) == 0, nil
+}
+
+// Attach attaches the guard's program to the link, loading it and pinning
+// it in dir unless it is pinned there, in the driver if native is set. It
+// does nothing if the program is attached already, and fails if another one
+// is.
+func Attach(link netlink.Link, dir string, m *Maps, native bool) error {
+	prog, err := bpf.OpenProgram(filepath.Join(dir, progPin))
+	if errors.Is(err, os.ErrNotExist) {
+		if prog, err = Program(m); err != nil {
+			return err
+		}
+		if err := prog.Pin(filepath.Join(dir, progPin)); err != nil {
+			prog.Close()
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	id, err := prog.ID()
+	if err != nil {
+		return err
+	}
+	attached, err := bpf.XDPProgramID(link.Attrs().Index)
+	if err != nil || attached == id {
+		return err
+	}
+	return bpf.AttachXDP(link, prog, native)
+}
+
+// Attached reports whether the guard's program pinned in dir is attached
+// to the link
+func Attached(link netlink.Link, dir string) (bool, error) {
+	prog, err := bpf.OpenProgram(filepath.Join(dir, progPin))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer prog.Close()
+	id, err := prog.ID()
+	if err != nil {
+		return false, err
+	}
+	attached, err := bpf.XDPProgramID(link.Attrs().Index)
+	return attached == id, err
+}
+
+// Detach detaches the guard's program from the link, if attached, and
+// unpins the program
+func Detach(link netlink.Link, dir string) error {
+	attached, err := Attached(link, dir)
+	if err != nil {
+		return err
+	}
+	if attached {
+		if err := bpf.DetachXDP(link); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, progPin)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to unpin program: %v", err)
+	}
+	return nil
+}
+
+// be16 returns the big-endian 16-bit value as the program loads it from a
+// packet
+func be16(v uint16) int32 {
+	return int32(binary.NativeEndian.Uint16([]byte{byte(v >> 8), byte(v)}))
+}
+
+// minLen passes packets shorter than n bytes on. The packet's bounds are in
+// R7 and R8.
+func minLen(n int32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.MovReg(bpf.R4, bpf.R7),
+		bpf.ALU64Imm(bpf.Add, bpf.R4, n),
+		bpf.JumpReg(bpf.JGT, bpf.R4, bpf.R8, "pass"),
+	}
+}
+
+// lookup looks up the key on the stack at fp+at in the map, leaving the
+// value's address in R0, or 0
+func lookup(m *bpf.Map, at int32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMap(bpf.R1, m),
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R2, at),
+		bpf.Call(bpf.MapLookupElem),
+	}
+}
+
+// encap returns the instructions storing the peer key of a VXLAN packet
+// whose UDP header starts at udp, and passing packets to other ports or
+// carrying unicast frames on. It continues at label "limit".
+func encap(udp int16) []bpf.Instruction {
+	return []bpf.Instruction{
+		// The VXLAN port, then the VNI without the reserved byte
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R7, udp+2),
+		bpf.StoreMem(bpf.Half, bpf.R10, keyAt, bpf.R4),
+		bpf.StoreImm(bpf.Half, bpf.R10, keyAt+2, 0),
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, udp+12),
+		bpf.ALU64Imm(bpf.And, bpf.R4, int32(binary.NativeEndian.Uint32([]byte{0xff, 0xff, 0xff, 0}))),
+		bpf.StoreMem(bpf.Word, bpf.R10, keyAt+4, bpf.R4),
+		// The inner destination's group bit
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, udp+16),
+		bpf.JumpImm(bpf.JSet, bpf.R4, 1, "limit"),
+		bpf.Jump("pass"),
+	}
+}
+
+// Program returns the XDP program, which drops the VXLAN-encapsulated
+// broadcast and multicast frames a peer sends into a limited VNI beyond
+// the VNI's limit. Each peer has a token bucket per VNI, holding credit in
+// nanoseconds: it fills as time passes, up to the burst's cost, and each
+// frame costs the nanoseconds between frames at the rate. IPv4 packets
+// with options or fragmented, and IPv6 packets with extension headers,
+// are passed on.
+func Program(m *Maps) (*bpf.Program, error) {
+	// R6 holds the context, R7 and R8 the packet's bounds
+	insns := []bpf.Instruction{
+		bpf.MovReg(bpf.R6, bpf.R1),
+		bpf.LoadMem(bpf.Word, bpf.R7, bpf.R6, xdpData),
+		bpf.LoadMem(bpf.Word, bpf.R8, bpf.R6, xdpDataEnd),
+	}
+	// Ethernet, IPv4, UDP and VXLAN headers and the inner Ethernet header
+	insns = append(insns, minLen(14+20+8+8+14)...)
+	insns = append(insns,
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R7, 12),
+		bpf.JumpImm(bpf.JEq, bpf.R4, be16(0x0800), "ipv4"),
+		bpf.JumpImm(bpf.JEq, bpf.R4, be16(0x86dd), "ipv6"),
+		bpf.Jump("pass"),
+
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, 14).Labeled("ipv4"),
+		bpf.JumpImm(bpf.JNE, bpf.R4, 0x45, "pass"),
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, 23),
+		bpf.JumpImm(bpf.JNE, bpf.R4, unix.IPPROTO_UDP, "pass"),
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R7, 20),
+		bpf.JumpImm(bpf.JSet, bpf.R4, be16(0x3fff), "pass"),
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, 26),
+		bpf.StoreMem(bpf.Word, bpf.R10, keyAt+8, bpf.R4),
+		bpf.StoreImm(bpf.Word, bpf.R10, keyAt+12, 0),
+		bpf.StoreImm(bpf.DoubleWord, bpf.R10, keyAt+16, 0),
+	)
+	insns = append(insns, encap(34)...)
+
+	ipv6 := minLen(14 + 40 + 8 + 8 + 14)
+	ipv6[0] = ipv6[0].Labeled("ipv6")
+	insns = append(insns, ipv6...)
+	insns = append(insns,
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R7, 20),
+		bpf.JumpImm(bpf.JNE, bpf.R4, unix.IPPROTO_UDP, "pass"),
+	)
+	for i := int16(0); i < 4; i++ {
+		insns = append(insns,
+			bpf.LoadMem(bpf.Word, bpf.R4, bpf.R7, 22+4*i),
+			bpf.StoreMem(bpf.Word, bpf.R10, keyAt+8+4*i, bpf.R4),
+		)
+	}
+	insns = append(insns, encap(54)...)
+
+	// R9 points to the VNI's limit
+	limit := lookup(m.vnis, keyAt)
+	limit[0] = limit[0].Labeled("limit")
+	insns = append(insns, limit...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R0, 0, "pass"),
+		bpf.MovReg(bpf.R9, bpf.R0),
+		bpf.Call(bpf.KtimeGetNS),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R10, nowAt, bpf.R0),
+	)
+	insns = append(insns, lookup(m.peers, keyAt)...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R0, 0, "new"),
+
+		// Fill the bucket by the time passed, unless another CPU did
+		bpf.LoadMem(bpf.DoubleWord, bpf.R2, bpf.R0, 0),
+		bpf.LoadMem(bpf.DoubleWord, bpf.R3, bpf.R0, 8),
+		bpf.LoadMem(bpf.DoubleWord, bpf.R4, bpf.R10, nowAt),
+		bpf.JumpReg(bpf.JLE, bpf.R4, bpf.R2, "charge"),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R0, 0, bpf.R4),
+		bpf.ALU64Reg(bpf.Sub, bpf.R4, bpf.R2),
+		bpf.ALU64Reg(bpf.Add, bpf.R3, bpf.R4),
+		bpf.LoadMem(bpf.DoubleWord, bpf.R5, bpf.R9, 8),
+		bpf.JumpReg(bpf.JLE, bpf.R3, bpf.R5, "charge"),
+		bpf.MovReg(bpf.R3, bpf.R5),
+
+		// Drop the frame unless the bucket holds its cost
+		bpf.LoadMem(bpf.DoubleWord, bpf.R5, bpf.R9, 0).Labeled("charge"),
+		bpf.JumpReg(bpf.JLT, bpf.R3, bpf.R5, "drop"),
+		bpf.ALU64Reg(bpf.Sub, bpf.R3, bpf.R5),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R0, 8, bpf.R3),
+		bpf.Jump("pass"),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R0, 8, bpf.R3).Labeled("drop"),
+		bpf.MovImm(bpf.R0, bpf.XDPDrop),
+		bpf.Exit(),
+
+		// A new peer starts with a full bucket, less the frame's cost
+		bpf.LoadMem(bpf.DoubleWord, bpf.R4, bpf.R10, nowAt).Labeled("new"),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R10, bucketAt, bpf.R4),
+		bpf.LoadMem(bpf.DoubleWord, bpf.R3, bpf.R9, 8),
+		bpf.LoadMem(bpf.DoubleWord, bpf.R5, bpf.R9, 0),
+		bpf.ALU64Reg(bpf.Sub, bpf.R3, bpf.R5),
+		bpf.StoreMem(bpf.DoubleWord, bpf.R10, bucketAt+8, bpf.R3),
+		bpf.LoadMap(bpf.R1, m.peers),
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R2, keyAt),
+		bpf.MovReg(bpf.R3, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R3, bucketAt),
+		bpf.MovImm(bpf.R4, 0),
+		bpf.Call(bpf.MapUpdateElem),
+
+		bpf.MovImm(bpf.R0, bpf.XDPPass).Labeled("pass"),
+		bpf.Exit(),
+	)
+	return bpf.LoadProgram(bpf.XDP, ProgramName, insns)
+}
@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package bumguard
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+// packet returns a VXLAN packet from the peer to the port, carrying a
+// frame to the inner destination MAC on the VNI
+func packet(peer string, port, vni int, dst string) []byte {
+	ip := net.ParseIP(peer)
+	eth := []byte{0x02, 0, 0, 0, 0, 0x01, 0x02, 0, 0, 0, 0, 0x02}
+	var p []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		p = append(eth, 0x08, 0x00)
+		p = append(p, 0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, unix.IPPROTO_UDP, 0, 0)
+		p = append(p, ip4...)
+		p = append(p, 192, 0, 2, 1)
+	} else {
+		p = append(eth, 0x86, 0xdd)
+		p = append(p, 0x60, 0, 0, 0, 0, 0, unix.IPPROTO_UDP, 64)
+		p = append(p, ip.To16()...)
+		p = append(p, net.ParseIP("2001:db8::1").To16()...)
+	}
+	p = append(p, 0x30, 0x39, byte(port>>8), byte(port), 0, 0, 0, 0)
+	p = append(p, 0x08, 0, 0, 0, byte(vni>>16), byte(vni>>8), byte(vni), 0)
+	mac, _ := net.ParseMAC(dst)
+	p = append(p, mac...)
+	p = append(p, 0x02, 0, 0, 0, 0, 0x09, 0x08, 0x06)
+	return append(p, make([]byte, 28)...)
+}
+
+func TestProgram(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	fs := t.TempDir()
+	if err := bpf.MountFS(fs, Dir("test0")); err != nil {
+		t.Skipf("BPF file system not available: %v", err)
+	}
+	defer unix.Unmount(fs, unix.MNT_DETACH)
+	dir := filepath.Join(fs, Dir("test0"))
+
+	unlock, err := Lock(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock guard: %v", err)
+	}
+	defer unlock()
+	maps, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open maps: %v", err)
+	}
+	defer maps.Close()
+	prog, err := Program(maps)
+	if err != nil {
+		t.Fatalf("Failed to load program: %v", err)
+	}
+	defer prog.Close()
+
+	// A frame a second, so the bucket doesn't fill during the test
+	limit := Limit{Rate: 1, Burst: 3}
+	if err := maps.SetVNI(4789, 42, limit); err != nil {
+		t.Fatalf("Failed to set VNI: %v", err)
+	}
+	if ok, err := maps.Limits(4789, 42, limit); err != nil || !ok {
+		t.Errorf("Expected VNI limited, got %v (%v)", ok, err)
+	}
+	if ok, err := maps.Limits(4789, 42, Limit{Rate: 2, Burst: 3}); err != nil || ok {
+		t.Errorf("Expected other limit not to match, got %v (%v)", ok, err)
+	}
+
+	run := func(name string, p []byte, want int32) {
+		t.Helper()
+		got, err := prog.Test(p)
+		if err != nil {
+			t.Fatalf("%s: failed to run program: %v", name, err)
+		}
+		if got != want {
+			t.Errorf("%s: expected %d, got %d", name, want, got)
+		}
+	}
+	const broadcast = "ff:ff:ff:ff:ff:ff"
+	for i := 0; i < limit.Burst; i++ {
+		run("burst", packet("192.0.2.10", 4789, 42, broadcast), bpf.XDPPass)
+	}
+	run("beyond burst", packet("192.0.2.10", 4789, 42, broadcast), bpf.XDPDrop)
+	run("multicast beyond burst", packet("192.0.2.10", 4789, 42, "33:33:00:00:00:01"), bpf.XDPDrop)
+	run("unicast", packet("192.0.2.10", 4789, 42, "02:00:00:00:00:07"), bpf.XDPPass)
+	run("other peer", packet("192.0.2.11", 4789, 42, broadcast), bpf.XDPPass)
+	run("other VNI", packet("192.0.2.10", 4789, 43, broadcast), bpf.XDPPass)
+	run("other port", packet("192.0.2.10", 4790, 42, broadcast), bpf.XDPPass)
+	for i := 0; i < limit.Burst; i++ {
+		run("ipv6 burst", packet("2001:db8::10", 4789, 42, broadcast), bpf.XDPPass)
+	}
+	run("ipv6 beyond burst", packet("2001:db8::10", 4789, 42, broadcast), bpf.XDPDrop)
+
+	if err := maps.DeleteVNI(4789, 42); err != nil {
+		t.Fatalf("Failed to delete VNI: %v", err)
+	}
+	run("deleted VNI", packet("192.0.2.10", 4789, 42, broadcast), bpf.XDPPass)
+	if keys, err := maps.peers.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("Expected peers deleted, got %d (%v)", len(keys), err)
+	}
+	if empty, err := maps.Empty(); err != nil || !empty {
+		t.Errorf("Expected no VNIs left, got %v (%v)", empty, err)
+	}
+}
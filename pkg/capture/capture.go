@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval bounds how long a read blocks, so a capture stops on time on
+// an idle interface
+const pollInterval = 100 * time.Millisecond
+
+// Capture records the packets sent and received on the interface for the
+// given duration and returns how many were written
+func Capture(ifName string, duration time.Duration, w *PcapWriter) (int, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get interface %s: %v", ifName, err)
+	}
+
+	protocol := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index}); err != nil {
+		return 0, fmt.Errorf("failed to bind packet socket to %s: %v", ifName, err)
+	}
+	timeout := unix.NsecToTimeval(pollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return 0, fmt.Errorf("failed to set packet socket timeout: %v", err)
+	}
+
+	buf := make([]byte, w.snapLen)
+	deadline := time.Now().Add(duration)
+	count := 0
+	for time.Now().Before(deadline) {
+		// MSG_TRUNC returns the length on the wire, even if it exceeds buf
+		n, _, err := unix.Recvfrom(fd, buf, unix.MSG_TRUNC)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return count, fmt.Errorf("failed to read from %s: %v", ifName, err)
+		}
+		captured := n
+		if captured > len(buf) {
+			captured = len(buf)
+		}
+		if err := w.WritePacket(time.Now(), buf[:captured], n); err != nil {
+			return count, fmt.Errorf("failed to write packet: %v", err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// htons converts a short from host to network byte order
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultSnapLen captures whole packets, including GSO super-frames
+	DefaultSnapLen = 262144
+
+	// linkTypeEthernet is the pcap link type of Ethernet frames
+	linkTypeEthernet = 1
+
+	// pcapMagic marks a pcap file with microsecond timestamps
+	pcapMagic = 0xa1b2c3d4
+)
+
+// PcapWriter writes packets in the classic pcap file format, which tcpdump
+// and Wireshark read
+type PcapWriter struct {
+	w       io.Writer
+	snapLen int
+}
+
+// NewPcapWriter writes the pcap file header and returns a writer for the
+// packets
+func NewPcapWriter(w io.Writer, snapLen int) (*PcapWriter, error) {
+	if snapLen <= 0 {
+		snapLen = DefaultSnapLen
+	}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], uint32(snapLen))
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w, snapLen: snapLen}, nil
+}
+
+// WritePacket writes a packet captured at ts. The data is truncated to the
+// snap length; origLen is the length of the packet on the wire.
+func (p *PcapWriter) WritePacket(ts time.Time, data []byte, origLen int) error {
+	if len(data) > p.snapLen {
+		data = data[:p.snapLen]
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(origLen))
+	if _, err := p.w.Write(header); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
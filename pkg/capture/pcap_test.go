@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, 4)
+	if err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	if buf.Len() != 24 || binary.LittleEndian.Uint32(buf.Bytes()) != pcapMagic {
+		t.Fatalf("Unexpected file header: %x", buf.Bytes())
+	}
+	if snapLen := binary.LittleEndian.Uint32(buf.Bytes()[16:]); snapLen != 4 {
+		t.Fatalf("Expected snap length 4, got %d", snapLen)
+	}
+
+	// Packets longer than the snap length are truncated
+	ts := time.Unix(1700000000, 123456000)
+	if err := w.WritePacket(ts, []byte{1, 2, 3, 4, 5, 6}, 6); err != nil {
+		t.Fatalf("Failed to write packet: %v", err)
+	}
+	record := buf.Bytes()[24:]
+	if len(record) != 16+4 {
+		t.Fatalf("Expected a 20 byte record, got %d bytes", len(record))
+	}
+	if sec, usec := binary.LittleEndian.Uint32(record[0:]), binary.LittleEndian.Uint32(record[4:]); sec != 1700000000 || usec != 123456 {
+		t.Fatalf("Unexpected timestamp %d.%06d", sec, usec)
+	}
+	if incl, orig := binary.LittleEndian.Uint32(record[8:]), binary.LittleEndian.Uint32(record[12:]); incl != 4 || orig != 6 {
+		t.Fatalf("Expected captured/original length 4/6, got %d/%d", incl, orig)
+	}
+	if !bytes.Equal(record[16:], []byte{1, 2, 3, 4}) {
+		t.Fatalf("Unexpected packet data: %x", record[16:])
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+// Package devname names the devices a network's containers share after the
+// network, so the devices keep their names when the network's VNI changes
+// and `ip link` output tells which network they belong to
+package devname
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// maxLen is the longest interface name the kernel accepts
+const maxLen = 15
+
+// hashLen is the length of the hash telling apart long network names that
+// start alike
+const hashLen = 4
+
+// For returns the name of the network's device with the given prefix: the
+// prefix followed by the network's name, or by as much of it as fits along
+// with a hash of the full name
+func For(prefix, network string) string {
+	name := prefix + network
+	if len(name) <= maxLen {
+		return name
+	}
+	hash := sha256.Sum256([]byte(network))
+	return name[:maxLen-hashLen] + hex.EncodeToString(hash[:])[:hashLen]
+}
+
+// Resolve returns the name of a device that earlier versions named legacy:
+// name, unless only a device named legacy exists. Devices created by earlier
+// versions are thus used under their name until the network is torn down.
+func Resolve(name, legacy string, exists func(name string) bool) string {
+	if name == legacy || exists(name) || !exists(legacy) {
+		return name
+	}
+	return legacy
+}
+
+// templateHashLen is the length of the hash of the network's name
+// available to device name templates
+const templateHashLen = 8
+
+// Data holds the values available to device name templates
+type Data struct {
+	// NetworkName is the name of the network
+	NetworkName string
+	// VNI is the network's VXLAN ID
+	VNI int
+	// Hash is a stable 8 character hash of the network's name
+	Hash string
+}
+
+// newData returns the template values of a network
+func newData(network string, vni int) Data {
+	hash := sha256.Sum256([]byte(network))
+	return Data{NetworkName: network, VNI: vni, Hash: hex.EncodeToString(hash[:])[:templateHashLen]}
+}
+
+// Render renders a device name template for a network, such as
+// "vx-{{.NetworkName}}" or "xbr{{.Hash}}", for sites whose conventions the
+// default names don't follow. An empty template renders an empty name.
+// Networks may share a VNI on different ports, so templates must render a
+// name of its own for each network name.
+func Render(tmpl, network string, vni int) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	t, err := template.New("device").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("isn't a valid template: %v", err)
+	}
+	render := func(data Data) (string, error) {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("isn't a valid template: %v", err)
+		}
+		return buf.String(), nil
+	}
+	name, err := render(newData(network, vni))
+	if err != nil {
+		return "", err
+	}
+	if name == "" || len(name) > maxLen || strings.ContainsAny(name, "/ \t\n:") {
+		return "", fmt.Errorf("renders invalid interface name %q (1-%d characters, no '/', ':' or whitespace)", name, maxLen)
+	}
+	// Another network of the same VNI must get another name
+	other, err := render(newData(network+"-", vni))
+	if err != nil {
+		return "", err
+	}
+	if other == name {
+		return "", fmt.Errorf("renders %q for every network; include .NetworkName or .Hash", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package devname
+
+import "testing"
+
+func TestFor(t *testing.T) {
+	if name := For("xbr-", "xvm-net"); name != "xbr-xvm-net" {
+		t.Fatalf("Expected xbr-xvm-net, got %s", name)
+	}
+
+	// Long names are cut short, with a hash telling them apart
+	a, b := For("xbr-", "production-east"), For("xbr-", "production-west")
+	if len(a) != maxLen || len(b) != maxLen {
+		t.Fatalf("Expected %d character names, got %q and %q", maxLen, a, b)
+	}
+	if a == b || a[:maxLen-hashLen] != "xbr-product" {
+		t.Fatalf("Unexpected names %q and %q", a, b)
+	}
+	if For("xbr-", "production-east") != a {
+		t.Fatalf("Names aren't stable")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	links := map[string]bool{}
+	exists := func(name string) bool { return links[name] }
+
+	// New networks use the new name
+	if name := Resolve("xbr-net", "xvmbr10", exists); name != "xbr-net" {
+		t.Fatalf("Expected xbr-net, got %s", name)
+	}
+
+	// A device of an earlier version keeps being used
+	links["xvmbr10"] = true
+	if name := Resolve("xbr-net", "xvmbr10", exists); name != "xvmbr10" {
+		t.Fatalf("Expected xvmbr10, got %s", name)
+	}
+
+	// Unless the new one exists as well
+	links["xbr-net"] = true
+	if name := Resolve("xbr-net", "xvmbr10", exists); name != "xbr-net" {
+		t.Fatalf("Expected xbr-net, got %s", name)
+	}
+}
+
+func TestRender(t *testing.T) {
+	if name, err := Render("vx-{{.NetworkName}}", "xvm-net", 10); err != nil || name != "vx-xvm-net" {
+		t.Fatalf("Expected vx-xvm-net, got %q: %v", name, err)
+	}
+	if name, err := Render("xbr{{.Hash}}", "xvm-net", 10); err != nil || name != "xbr9f1d4784" {
+		t.Fatalf("Expected xbr9f1d4784, got %q: %v", name, err)
+	}
+	if name, err := Render("vx{{.VNI}}-{{.NetworkName}}", "xvm-net", 10); err != nil || name != "vx10-xvm-net" {
+		t.Fatalf("Expected vx10-xvm-net, got %q: %v", name, err)
+	}
+	if name, err := Render("", "xvm-net", 10); err != nil || name != "" {
+		t.Fatalf("Expected no name, got %q: %v", name, err)
+	}
+
+	// Names the kernel rejects, unknown fields and names networks of the
+	// same VNI would share are errors
+	for _, tmpl := range []string{"vxlan-{{.NetworkName}}-overlay", "vx/{{.Hash}}", "{{.ShortID}}", "{{", "xvmbr", "xvmbr{{.VNI}}"} {
+		if name, err := Render(tmpl, "xvm-net", 10); err == nil {
+			t.Fatalf("Expected %q to be rejected, got %q", tmpl, name)
+		}
+	}
+}
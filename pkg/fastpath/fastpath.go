@@ -0,0 +1,267 @@
+//go:build linux
+// +build linux
+
+// Package fastpath implements the eBPF datapath forwarding the traffic of
+// known MACs between the attachments' ports and the VXLAN interface
+// directly, without passing the Linux bridge. Unknown, broadcast and
+// multicast destinations are left to the bridge.
+package fastpath
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+const (
+	// PortFilter and UplinkFilter name the programs on the ports and the
+	// VXLAN interface
+	PortFilter   = "xvm-fastpath"
+	UplinkFilter = "xvm-fastpath-vx"
+	// Priority is the programs' tc filter priority, after the ingress
+	// redirect of rate limiting
+	Priority = 20
+
+	// portsMap and remotesMap name the pinned maps, of the local MACs and
+	// their ports, and of the MACs learned behind the VXLAN interface
+	portsMap   = "ports"
+	remotesMap = "remotes"
+	// maxPorts and maxRemotes bound the maps. Remote MACs beyond the bound
+	// evict those least recently seen.
+	maxPorts   = 4096
+	maxRemotes = 65536
+
+	// keySize is a MAC padded to 8 bytes, valueSize an interface index
+	keySize   = 8
+	valueSize = 4
+)
+
+// Offsets of the fields of struct __sk_buff the programs read
+const (
+	skbIfindex = 40
+	skbData    = 76
+	skbDataEnd = 80
+)
+
+// Maps holds the maps of a network's fast path
+type Maps struct {
+	ports   *bpf.Map
+	remotes *bpf.Map
+}
+
+// Open opens the maps pinned in dir, creating and pinning those missing
+func Open(dir string) (*Maps, error) {
+	ports, err := bpf.OpenOrCreateMap(filepath.Join(dir, portsMap), bpf.Hash, keySize, valueSize, maxPorts)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := bpf.OpenOrCreateMap(filepath.Join(dir, remotesMap), bpf.LRUHash, keySize, valueSize, maxRemotes)
+	if err != nil {
+		ports.Close()
+		return nil, err
+	}
+	return &Maps{ports: ports, remotes: remotes}, nil
+}
+
+// OpenExisting opens the maps pinned in dir, returning os.ErrNotExist if
+// they aren't
+func OpenExisting(dir string) (*Maps, error) {
+	ports, err := bpf.OpenMap(filepath.Join(dir, portsMap), keySize, valueSize)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := bpf.OpenMap(filepath.Join(dir, remotesMap), keySize, valueSize)
+	if err != nil {
+		ports.Close()
+		return nil, err
+	}
+	return &Maps{ports: ports, remotes: remotes}, nil
+}
+
+// Close releases the maps, which stay pinned
+func (m *Maps) Close() {
+	m.ports.Close()
+	m.remotes.Close()
+}
+
+// key returns the maps' key of a MAC
+func key(mac net.HardwareAddr) []byte {
+	k := make([]byte, keySize)
+	copy(k, mac)
+	return k
+}
+
+// AddPort has traffic to the MAC sent to the port with the interface index
+func (m *Maps) AddPort(mac net.HardwareAddr, ifindex int) error {
+	value := make([]byte, valueSize)
+	binary.NativeEndian.PutUint32(value, uint32(ifindex))
+	if err := m.ports.Update(key(mac), value); err != nil {
+		return fmt.Errorf("failed to add port of %s: %v", mac, err)
+	}
+	return nil
+}
+
+// DeletePort stops the traffic to the MAC taking the fast path, leaving it
+// to the bridge
+func (m *Maps) DeletePort(mac net.HardwareAddr) error {
+	if err := m.ports.Delete(key(mac)); err != nil {
+		return fmt.Errorf("failed to delete port of %s: %v", mac, err)
+	}
+	return nil
+}
+
+// Port returns the interface index of the MAC's port, or 0 if it has none
+func (m *Maps) Port(mac net.HardwareAddr) (int, error) {
+	value, err := m.ports.Lookup(key(mac))
+	if errors.Is(err, bpf.ErrKeyNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up port of %s: %v", mac, err)
+	}
+	return int(binary.NativeEndian.Uint32(value)), nil
+}
+
+// Ports returns the interface index of the port of every MAC, by MAC
+func (m *Maps) Ports() (map[string]int, error) {
+	keys, err := m.ports.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %v", err)
+	}
+	ports := make(map[string]int, len(keys))
+	for _, k := range keys {
+		mac := net.HardwareAddr(k[:6])
+		ifindex, err := m.Port(mac)
+		if err != nil {
+			return nil, err
+		}
+		if ifindex != 0 {
+			ports[mac.String()] = ifindex
+		}
+	}
+	return ports, nil
+}
+
+// loadFrame loads the packet's bounds into R2 and R3, continuing at label
+// fail unless they hold an Ethernet header. R6 holds the context after.
+func loadFrame(fail string) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.MovReg(bpf.R6, bpf.R1),
+		bpf.LoadMem(bpf.Word, bpf.R2, bpf.R6, skbData),
+		bpf.LoadMem(bpf.Word, bpf.R3, bpf.R6, skbDataEnd),
+		bpf.MovReg(bpf.R4, bpf.R2),
+		bpf.ALU64Imm(bpf.Add, bpf.R4, 14),
+		bpf.JumpReg(bpf.JGT, bpf.R4, bpf.R3, fail),
+	}
+}
+
+// storeKey stores the key of the MAC at offset off of the frame in R2 on
+// the stack at fp+at, clobbering R4
+func storeKey(off, at int16) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.StoreImm(bpf.DoubleWord, bpf.R10, at, 0),
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R2, off),
+		bpf.StoreMem(bpf.Word, bpf.R10, at, bpf.R4),
+		bpf.LoadMem(bpf.Half, bpf.R4, bpf.R2, off+4),
+		bpf.StoreMem(bpf.Half, bpf.R10, at+4, bpf.R4),
+	}
+}
+
+// lookup looks up the key on the stack at fp+at in the map, leaving the
+// value's address in R0, or 0
+func lookup(m *bpf.Map, at int32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMap(bpf.R1, m),
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R2, at),
+		bpf.Call(bpf.MapLookupElem),
+	}
+}
+
+// redirect sends the packet out of the interface whose index R0 points to
+func redirect() []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMem(bpf.Word, bpf.R1, bpf.R0, 0),
+		bpf.MovImm(bpf.R2, 0),
+		bpf.Call(bpf.Redirect),
+		bpf.Exit(),
+	}
+}
+
+// pass leaves the packet to the filters after and the bridge
+func pass() []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.MovImm(bpf.R0, bpf.ActUnspec).Labeled("pass"),
+		bpf.Exit(),
+	}
+}
+
+// PortProgram returns the program on the ports, which redirects frames to a
+// MAC of another port to it, and those to a MAC learned behind the VXLAN
+// interface to that
+func PortProgram(m *Maps) (*bpf.Program, error) {
+	var insns []bpf.Instruction
+	insns = append(insns, loadFrame("pass")...)
+	insns = append(insns, storeKey(0, -8)...)
+
+	// Redirect to the destination's port, unless it is the sender's own
+	insns = append(insns, lookup(m.ports, -8)...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JEq, bpf.R0, 0, "remote"),
+		bpf.LoadMem(bpf.Word, bpf.R1, bpf.R0, 0),
+		bpf.LoadMem(bpf.Word, bpf.R2, bpf.R6, skbIfindex),
+		bpf.JumpReg(bpf.JEq, bpf.R1, bpf.R2, "pass"),
+	)
+	insns = append(insns, redirect()...)
+
+	// Redirect to the VXLAN interface the destination was seen behind
+	remote := lookup(m.remotes, -8)
+	remote[0] = remote[0].Labeled("remote")
+	insns = append(insns, remote...)
+	insns = append(insns, bpf.JumpImm(bpf.JEq, bpf.R0, 0, "pass"))
+	insns = append(insns, redirect()...)
+	insns = append(insns, pass()...)
+	return bpf.LoadProgram(bpf.SchedCLS, PortFilter, insns)
+}
+
+// UplinkProgram returns the program on the VXLAN interface, which learns
+// the unicast source MACs of the frames it receives as remote and
+// redirects frames to the MAC of a port to it
+func UplinkProgram(m *Maps) (*bpf.Program, error) {
+	var insns []bpf.Instruction
+	insns = append(insns, loadFrame("pass")...)
+	insns = append(insns, storeKey(0, -8)...)
+	insns = append(insns, storeKey(6, -16)...)
+
+	// Learn the source unless it is a group address or known already
+	insns = append(insns,
+		bpf.LoadMem(bpf.Byte, bpf.R4, bpf.R2, 6),
+		bpf.JumpImm(bpf.JSet, bpf.R4, 1, "local"),
+		bpf.LoadMem(bpf.Word, bpf.R4, bpf.R6, skbIfindex),
+		bpf.StoreMem(bpf.Word, bpf.R10, -20, bpf.R4),
+	)
+	insns = append(insns, lookup(m.remotes, -16)...)
+	insns = append(insns,
+		bpf.JumpImm(bpf.JNE, bpf.R0, 0, "local"),
+		bpf.LoadMap(bpf.R1, m.remotes),
+		bpf.MovReg(bpf.R2, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R2, -16),
+		bpf.MovReg(bpf.R3, bpf.R10),
+		bpf.ALU64Imm(bpf.Add, bpf.R3, -20),
+		bpf.MovImm(bpf.R4, 0),
+		bpf.Call(bpf.MapUpdateElem),
+	)
+
+	// Redirect to the destination's port
+	local := lookup(m.ports, -8)
+	local[0] = local[0].Labeled("local")
+	insns = append(insns, local...)
+	insns = append(insns, bpf.JumpImm(bpf.JEq, bpf.R0, 0, "pass"))
+	insns = append(insns, redirect()...)
+	insns = append(insns, pass()...)
+	return bpf.LoadProgram(bpf.SchedCLS, UplinkFilter, insns)
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package fastpath
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+)
+
+// actRedirect is what tc programs return after a redirect
+const actRedirect = 7
+
+// frame returns an Ethernet frame from src to dst
+func frame(dst, src string) []byte {
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	f := append(append([]byte{}, d...), s...)
+	f = append(f, 0x08, 0x00)
+	return append(f, make([]byte, 46)...)
+}
+
+func TestPrograms(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	fs := t.TempDir()
+	if err := bpf.MountFS(fs, bpf.PinDir("fastpath-test")); err != nil {
+		t.Skipf("BPF file system not available: %v", err)
+	}
+	defer unix.Unmount(fs, unix.MNT_DETACH)
+	dir := filepath.Join(fs, bpf.PinDir("fastpath-test"))
+
+	maps, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open maps: %v", err)
+	}
+	defer maps.Close()
+	port, err := PortProgram(maps)
+	if err != nil {
+		t.Fatalf("Failed to load port program: %v", err)
+	}
+	defer port.Close()
+	uplink, err := UplinkProgram(maps)
+	if err != nil {
+		t.Fatalf("Failed to load uplink program: %v", err)
+	}
+	defer uplink.Close()
+
+	local, _ := net.ParseMAC("02:00:00:00:00:01")
+	self, _ := net.ParseMAC("02:00:00:00:00:02")
+	if err := maps.AddPort(local, 4242); err != nil {
+		t.Fatalf("Failed to add port: %v", err)
+	}
+	// Test runs take place on the loopback interface
+	if err := maps.AddPort(self, 1); err != nil {
+		t.Fatalf("Failed to add port: %v", err)
+	}
+
+	// The maps are pinned, so opening them again sees the port
+	again, err := OpenExisting(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen maps: %v", err)
+	}
+	defer again.Close()
+	ports, err := again.Ports()
+	if err != nil {
+		t.Fatalf("Failed to list ports: %v", err)
+	}
+	if len(ports) != 2 || ports[local.String()] != 4242 {
+		t.Errorf("Unexpected ports %v", ports)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		prog    *bpf.Program
+		frame   []byte
+		want    int32
+		learned bool
+	}{
+		{"port to unknown", port, frame("02:00:00:00:00:09", "02:00:00:00:00:02"), bpf.ActUnspec, false},
+		{"port to local", port, frame("02:00:00:00:00:01", "02:00:00:00:00:02"), actRedirect, false},
+		{"port to itself", port, frame("02:00:00:00:00:02", "02:00:00:00:00:01"), bpf.ActUnspec, false},
+		{"port to broadcast", port, frame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01"), bpf.ActUnspec, false},
+		{"uplink learns", uplink, frame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:09"), bpf.ActUnspec, true},
+		{"port to remote", port, frame("02:00:00:00:00:09", "02:00:00:00:00:02"), actRedirect, true},
+		{"uplink to local", uplink, frame("02:00:00:00:00:01", "02:00:00:00:00:09"), actRedirect, true},
+	} {
+		got, err := tc.prog.Test(tc.frame)
+		if err != nil {
+			t.Fatalf("%s: failed to run program: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+		remote, _ := net.ParseMAC("02:00:00:00:00:09")
+		_, err = maps.remotes.Lookup(key(remote))
+		if learned := err == nil; learned != tc.learned {
+			t.Errorf("%s: expected remote learned %v, got %v", tc.name, tc.learned, learned)
+		}
+	}
+
+	// Group source addresses aren't learned
+	if _, err := uplink.Test(frame("02:00:00:00:00:01", "03:00:00:00:00:07")); err != nil {
+		t.Fatalf("Failed to run program: %v", err)
+	}
+	group, _ := net.ParseMAC("03:00:00:00:00:07")
+	if _, err := maps.remotes.Lookup(key(group)); err == nil {
+		t.Errorf("Expected group address not to be learned")
+	}
+
+	if err := maps.DeletePort(local); err != nil {
+		t.Fatalf("Failed to delete port: %v", err)
+	}
+	if got, err := port.Test(frame("02:00:00:00:00:01", "02:00:00:00:00:02")); err != nil || got != bpf.ActUnspec {
+		t.Errorf("Expected deleted port to be left to the bridge, got %d: %v", got, err)
+	}
+}
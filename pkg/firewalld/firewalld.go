@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+// Package firewalld manages rules through firewalld's D-Bus API. Changes are
+// made to both the runtime and the permanent configuration, so a firewalld
+// reload, which rebuilds the firewall from the permanent one, keeps them.
+package firewalld
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	busName    = "org.fedoraproject.FirewallD1"
+	objectPath = "/org/fedoraproject/FirewallD1"
+	configPath = "/org/fedoraproject/FirewallD1/config"
+
+	directInterface       = busName + ".direct"
+	zoneInterface         = busName + ".zone"
+	configInterface       = busName + ".config"
+	configDirectInterface = busName + ".config.direct"
+	configZoneInterface   = busName + ".config.zone"
+)
+
+// Error codes of firewalld's exceptions, which prefix their message
+const (
+	codeAlreadyEnabled = "ALREADY_ENABLED"
+	codeNotEnabled     = "NOT_ENABLED"
+	codeUnknownSource  = "UNKNOWN_SOURCE"
+)
+
+// Running reports whether firewalld is running on the system bus
+func Running() bool {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	var owned bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, busName).Store(&owned); err != nil {
+		return false
+	}
+	return owned
+}
+
+// Client is a connection to firewalld
+type Client struct {
+	conn *dbus.Conn
+}
+
+// New connects to firewalld on the system bus
+func New() (*Client, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the system bus: %v", err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// DirectRule is a rule of firewalld's direct interface, in iptables syntax.
+// Rules of a chain are ordered by priority, lowest first.
+type DirectRule struct {
+	// IPv is "ipv4" or "ipv6"
+	IPv      string
+	Table    string
+	Chain    string
+	Priority int32
+	Args     []string
+}
+
+// String formats the rule like firewall-cmd --direct --get-all-rules does
+func (r DirectRule) String() string {
+	return fmt.Sprintf("%s %s %s %d %s", r.IPv, r.Table, r.Chain, r.Priority, strings.Join(r.Args, " "))
+}
+
+// AddChain adds a direct chain. An existing chain is kept.
+func (c *Client) AddChain(ipv, table, chain string) error {
+	return c.both(func(obj dbus.BusObject, iface string) error {
+		return ignore(obj.Call(iface+".addChain", 0, ipv, table, chain).Err, codeAlreadyEnabled)
+	})
+}
+
+// RemoveChain removes a direct chain, which must be empty. A missing chain
+// is skipped.
+func (c *Client) RemoveChain(ipv, table, chain string) error {
+	return c.both(func(obj dbus.BusObject, iface string) error {
+		return ignore(obj.Call(iface+".removeChain", 0, ipv, table, chain).Err, codeNotEnabled)
+	})
+}
+
+// AddRule adds a direct rule. An existing rule is kept.
+func (c *Client) AddRule(r DirectRule) error {
+	return c.both(func(obj dbus.BusObject, iface string) error {
+		return ignore(obj.Call(iface+".addRule", 0, r.IPv, r.Table, r.Chain, r.Priority, r.Args).Err, codeAlreadyEnabled)
+	})
+}
+
+// RemoveRule removes a direct rule. A missing rule is skipped.
+func (c *Client) RemoveRule(r DirectRule) error {
+	return c.both(func(obj dbus.BusObject, iface string) error {
+		return ignore(obj.Call(iface+".removeRule", 0, r.IPv, r.Table, r.Chain, r.Priority, r.Args).Err, codeNotEnabled)
+	})
+}
+
+// HasRule reports whether a direct rule is in the runtime configuration
+func (c *Client) HasRule(r DirectRule) (bool, error) {
+	var ok bool
+	err := c.runtime().Call(directInterface+".queryRule", 0, r.IPv, r.Table, r.Chain, r.Priority, r.Args).Store(&ok)
+	if err != nil {
+		return false, fmt.Errorf("failed to query direct rule: %v", err)
+	}
+	return ok, nil
+}
+
+// Rules returns the direct rules of a chain in the runtime configuration
+func (c *Client) Rules(ipv, table, chain string) ([]DirectRule, error) {
+	var entries []struct {
+		Priority int32
+		Args     []string
+	}
+	if err := c.runtime().Call(directInterface+".getRules", 0, ipv, table, chain).Store(&entries); err != nil {
+		return nil, fmt.Errorf("failed to list direct rules of %s: %v", chain, err)
+	}
+	rules := make([]DirectRule, 0, len(entries))
+	for _, e := range entries {
+		rules = append(rules, DirectRule{IPv: ipv, Table: table, Chain: chain, Priority: e.Priority, Args: e.Args})
+	}
+	return rules, nil
+}
+
+// AddSource binds a source address or prefix to a zone. A source already
+// bound to the zone is kept.
+func (c *Client) AddSource(zone, source string) error {
+	if err := ignore(c.runtime().Call(zoneInterface+".addSource", 0, zone, source).Err, codeAlreadyEnabled); err != nil {
+		return fmt.Errorf("failed to add source %s to zone %s: %v", source, zone, err)
+	}
+	obj, err := c.configZone(zone)
+	if err != nil {
+		return err
+	}
+	if err := ignore(obj.Call(configZoneInterface+".addSource", 0, source).Err, codeAlreadyEnabled); err != nil {
+		return fmt.Errorf("failed to add source %s to permanent zone %s: %v", source, zone, err)
+	}
+	return nil
+}
+
+// RemoveSource unbinds a source from a zone. A source not bound to it is
+// skipped.
+func (c *Client) RemoveSource(zone, source string) error {
+	err := c.runtime().Call(zoneInterface+".removeSource", 0, zone, source).Err
+	if err := ignore(err, codeNotEnabled, codeUnknownSource); err != nil {
+		return fmt.Errorf("failed to remove source %s from zone %s: %v", source, zone, err)
+	}
+	obj, err := c.configZone(zone)
+	if err != nil {
+		return err
+	}
+	err = obj.Call(configZoneInterface+".removeSource", 0, source).Err
+	if err := ignore(err, codeNotEnabled, codeUnknownSource); err != nil {
+		return fmt.Errorf("failed to remove source %s from permanent zone %s: %v", source, zone, err)
+	}
+	return nil
+}
+
+// HasSource reports whether a source is bound to a zone in the runtime
+// configuration
+func (c *Client) HasSource(zone, source string) (bool, error) {
+	var ok bool
+	if err := c.runtime().Call(zoneInterface+".querySource", 0, zone, source).Store(&ok); err != nil {
+		return false, fmt.Errorf("failed to query source %s of zone %s: %v", source, zone, err)
+	}
+	return ok, nil
+}
+
+// runtime returns the object of the runtime configuration
+func (c *Client) runtime() dbus.BusObject {
+	return c.conn.Object(busName, objectPath)
+}
+
+// configZone returns the object of a zone's permanent configuration
+func (c *Client) configZone(zone string) (dbus.BusObject, error) {
+	var path dbus.ObjectPath
+	err := c.conn.Object(busName, configPath).Call(configInterface+".getZoneByName", 0, zone).Store(&path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permanent zone %s: %v", zone, err)
+	}
+	return c.conn.Object(busName, path), nil
+}
+
+// both applies a change of the direct interface to the runtime
+// configuration, and then to the permanent one
+func (c *Client) both(change func(obj dbus.BusObject, iface string) error) error {
+	if err := change(c.runtime(), directInterface); err != nil {
+		return err
+	}
+	if err := change(c.conn.Object(busName, configPath), configDirectInterface); err != nil {
+		return fmt.Errorf("permanent configuration: %v", err)
+	}
+	return nil
+}
+
+// ignore returns nil for firewalld exceptions with one of the codes, which
+// it raises for changes already in effect
+func ignore(err error, codes ...string) error {
+	if err == nil {
+		return nil
+	}
+	code := errorCode(err)
+	for _, c := range codes {
+		if code == c {
+			return nil
+		}
+	}
+	return err
+}
+
+// errorCode returns the code of a firewalld exception, e.g.
+// "ALREADY_ENABLED", or "" for other errors
+func errorCode(err error) string {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) || len(dbusErr.Body) == 0 {
+		return ""
+	}
+	msg, ok := dbusErr.Body[0].(string)
+	if !ok {
+		return ""
+	}
+	code, _, _ := strings.Cut(msg, ":")
+	return strings.TrimSpace(code)
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package firewalld
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestIgnore(t *testing.T) {
+	exception := func(msg string) error {
+		return dbus.Error{Name: busName + ".Exception", Body: []interface{}{msg}}
+	}
+
+	if err := ignore(exception("ALREADY_ENABLED: '10.244.0.0/16' already in 'trusted'"), codeAlreadyEnabled); err != nil {
+		t.Fatalf("Expected change in effect to be ignored, got %v", err)
+	}
+	if err := ignore(exception("NOT_ENABLED"), codeNotEnabled, codeUnknownSource); err != nil {
+		t.Fatalf("Expected code without message to be ignored, got %v", err)
+	}
+	if err := ignore(exception("ZONE_CONFLICT: '10.244.0.0/16' already bound to 'public'"), codeAlreadyEnabled); err == nil {
+		t.Fatalf("Expected conflict to be returned")
+	}
+	if err := ignore(errors.New("ALREADY_ENABLED"), codeAlreadyEnabled); err == nil {
+		t.Fatalf("Expected errors other than exceptions to be returned")
+	}
+}
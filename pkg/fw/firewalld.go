@@ -0,0 +1,331 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/nohns/xvm-cni/pkg/firewalld"
+)
+
+// firewalldBackend manages rules through firewalld's direct interface, in
+// its runtime and permanent configuration, so firewalld reloads keep them.
+// The rules are the iptables backend's, in the same chains; firewalld puts
+// those of the built-in chains in its *_direct chains, ahead of its zones.
+type firewalldBackend struct {
+	iptables iptablesBackend
+}
+
+// Name implements Backend
+func (b *firewalldBackend) Name() string {
+	return BackendFirewalld
+}
+
+// SetupMasquerade implements Backend
+func (b *firewalldBackend) SetupMasquerade(network string, subnet *net.IPNet) error {
+	rules := b.MasqueradeRules(network, subnet)
+	return withFirewalld(func(c *firewalld.Client) error {
+		return installDirect(c, []string{MasqChainName(network)}, directRules(rules, subnet.IP.To4() == nil))
+	})
+}
+
+// TeardownMasquerade implements Backend
+func (b *firewalldBackend) TeardownMasquerade(network string, subnet *net.IPNet) error {
+	return withFirewalld(func(c *firewalld.Client) error {
+		return uninstallDirect(c, ipv(subnet.IP.To4() == nil), "nat", []string{MasqChainName(network)}, []string{"POSTROUTING"})
+	})
+}
+
+// MasqueradeRules implements Backend
+func (b *firewalldBackend) MasqueradeRules(network string, subnet *net.IPNet) []Rule {
+	return b.iptables.MasqueradeRules(network, subnet)
+}
+
+// SetupPortMappings implements Backend
+func (b *firewalldBackend) SetupPortMappings(network, attachment string, mappings []PortMapping) error {
+	chains := []string{HostPortChainName(network, attachment), HairpinChainName(network, attachment)}
+	return withFirewalld(func(c *firewalld.Client) error {
+		for _, ipv6 := range []bool{false, true} {
+			rules := b.iptables.portMappingRules(network, attachment, filterMappings(mappings, ipv6))
+			if len(rules) == 0 {
+				// Drop the family's rules of earlier mappings, if it has any
+				if err := uninstallDirect(c, ipv(ipv6), "nat", chains, portMappingHooks); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := installDirect(c, chains, directRules(rules, ipv6)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TeardownPortMappings implements Backend
+func (b *firewalldBackend) TeardownPortMappings(network, attachment string) error {
+	chains := []string{HostPortChainName(network, attachment), HairpinChainName(network, attachment)}
+	return withFirewalld(func(c *firewalld.Client) error {
+		for _, ipv6 := range []bool{false, true} {
+			if err := uninstallDirect(c, ipv(ipv6), "nat", chains, portMappingHooks); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HasPortMappings implements Backend
+func (b *firewalldBackend) HasPortMappings(network, attachment string, mappings []PortMapping) (bool, error) {
+	var rules []firewalld.DirectRule
+	for _, ipv6 := range []bool{false, true} {
+		rules = append(rules, directRules(b.iptables.portMappingRules(network, attachment, filterMappings(mappings, ipv6)), ipv6)...)
+	}
+	return hasDirect(rules)
+}
+
+// PortMappingRules implements Backend
+func (b *firewalldBackend) PortMappingRules(network, attachment string, mappings []PortMapping) []Rule {
+	return b.iptables.PortMappingRules(network, attachment, mappings)
+}
+
+// SetupVxlanOpening implements Backend
+func (b *firewalldBackend) SetupVxlanOpening(network string, o *VxlanOpening) error {
+	rules := b.VxlanOpeningRules(network, o)
+	return withFirewalld(func(c *firewalld.Client) error {
+		return installDirect(c, []string{OpeningChainName(network)}, directRules(rules, false))
+	})
+}
+
+// TeardownVxlanOpening implements Backend
+func (b *firewalldBackend) TeardownVxlanOpening(network string) error {
+	return withFirewalld(func(c *firewalld.Client) error {
+		return uninstallDirect(c, ipv(false), "filter", []string{OpeningChainName(network)}, []string{"INPUT"})
+	})
+}
+
+// HasVxlanOpening implements Backend
+func (b *firewalldBackend) HasVxlanOpening(network string, o *VxlanOpening) (bool, error) {
+	return hasDirect(directRules(b.VxlanOpeningRules(network, o), false))
+}
+
+// VxlanOpeningRules implements Backend
+func (b *firewalldBackend) VxlanOpeningRules(network string, o *VxlanOpening) []Rule {
+	return b.iptables.VxlanOpeningRules(network, o)
+}
+
+// SetupLoopbackGuard implements Backend
+func (b *firewalldBackend) SetupLoopbackGuard(network, device string) error {
+	rules := b.LoopbackGuardRules(network, device)
+	return withFirewalld(func(c *firewalld.Client) error {
+		return installDirect(c, []string{LoopbackChainName(network)}, directRules(rules, false))
+	})
+}
+
+// TeardownLoopbackGuard implements Backend
+func (b *firewalldBackend) TeardownLoopbackGuard(network string) error {
+	return withFirewalld(func(c *firewalld.Client) error {
+		return uninstallDirect(c, ipv(false), "filter", []string{LoopbackChainName(network)}, []string{"INPUT"})
+	})
+}
+
+// HasLoopbackGuard implements Backend
+func (b *firewalldBackend) HasLoopbackGuard(network, device string) (bool, error) {
+	return hasDirect(directRules(b.LoopbackGuardRules(network, device), false))
+}
+
+// LoopbackGuardRules implements Backend
+func (b *firewalldBackend) LoopbackGuardRules(network, device string) []Rule {
+	return b.iptables.LoopbackGuardRules(network, device)
+}
+
+// portMappingHooks are the chains jumping to the port forwarding and
+// hairpin chains
+var portMappingHooks = append(append([]string{}, dnatChains...), "POSTROUTING")
+
+// ipv returns firewalld's name of the address family
+func ipv(ipv6 bool) string {
+	if ipv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// directRules converts iptables rules to direct rules of the address family.
+// The rules of each chain are prioritized in their order, as firewalld
+// doesn't keep the order of rules of equal priority.
+func directRules(rules []Rule, ipv6 bool) []firewalld.DirectRule {
+	position := make(map[string]int32)
+	direct := make([]firewalld.DirectRule, 0, len(rules))
+	for _, r := range rules {
+		key := r.Table + "/" + r.Chain
+		direct = append(direct, firewalld.DirectRule{
+			IPv:      ipv(ipv6),
+			Table:    r.Table,
+			Chain:    r.Chain,
+			Priority: position[key],
+			Args:     r.Spec,
+		})
+		position[key]++
+	}
+	return direct
+}
+
+// installDirect creates the plugin's chains, replaces their rules with the
+// given ones, and adds the given jumps to them. The rules are of one table
+// and address family.
+func installDirect(c *firewalld.Client, chains []string, rules []firewalld.DirectRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	family, table := rules[0].IPv, rules[0].Table
+	wanted := make(map[string]bool)
+	for _, r := range rules {
+		wanted[r.String()] = true
+	}
+	for _, chain := range chains {
+		if err := c.AddChain(family, table, chain); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", chain, err)
+		}
+		installed, err := c.Rules(family, table, chain)
+		if err != nil {
+			return err
+		}
+		for _, r := range installed {
+			if wanted[r.String()] {
+				continue
+			}
+			if err := c.RemoveRule(r); err != nil {
+				return fmt.Errorf("failed to delete rule from chain %s: %v", chain, err)
+			}
+		}
+	}
+	for _, r := range rules {
+		if err := c.AddRule(r); err != nil {
+			return fmt.Errorf("failed to add rule to chain %s: %v", r.Chain, err)
+		}
+	}
+	return nil
+}
+
+// uninstallDirect removes the jumps to the plugin's chains from the hooks,
+// and then the chains with their rules
+func uninstallDirect(c *firewalld.Client, family, table string, chains, hooks []string) error {
+	ours := make(map[string]bool)
+	for _, chain := range chains {
+		ours[chain] = true
+	}
+	for _, hook := range hooks {
+		rules, err := c.Rules(family, table, hook)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			if len(r.Args) < 2 || r.Args[len(r.Args)-2] != "-j" || !ours[r.Args[len(r.Args)-1]] {
+				continue
+			}
+			if err := c.RemoveRule(r); err != nil {
+				return fmt.Errorf("failed to delete %s rule: %v", hook, err)
+			}
+		}
+	}
+	for _, chain := range chains {
+		rules, err := c.Rules(family, table, chain)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			if err := c.RemoveRule(r); err != nil {
+				return fmt.Errorf("failed to delete rule from chain %s: %v", chain, err)
+			}
+		}
+		if err := c.RemoveChain(family, table, chain); err != nil {
+			return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+		}
+	}
+	return nil
+}
+
+// hasDirect reports whether all of the direct rules are in firewalld's
+// runtime configuration
+func hasDirect(rules []firewalld.DirectRule) (bool, error) {
+	ok := true
+	err := withFirewalld(func(c *firewalld.Client) error {
+		for _, r := range rules {
+			has, err := c.HasRule(r)
+			if err != nil {
+				return err
+			}
+			if !has {
+				ok = false
+				return nil
+			}
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
+
+// withFirewalld runs fn with a connection to firewalld
+func withFirewalld(fn func(c *firewalld.Client) error) error {
+	c, err := firewalld.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fn(c)
+}
+
+// SetupZone binds the subnets to the firewalld zone, so firewalld accepts
+// and forwards the containers' traffic by the zone's policy rather than
+// rejecting it by the default zone's. Subnets bound already are skipped.
+func SetupZone(zone string, subnets []*net.IPNet) error {
+	return withFirewalld(func(c *firewalld.Client) error {
+		for _, subnet := range subnets {
+			ok, err := c.HasSource(zone, subnet.String())
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			if err := c.AddSource(zone, subnet.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TeardownZone unbinds the subnets from the firewalld zone
+func TeardownZone(zone string, subnets []*net.IPNet) error {
+	return withFirewalld(func(c *firewalld.Client) error {
+		for _, subnet := range subnets {
+			if err := c.RemoveSource(zone, subnet.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HasZone reports whether the subnets are bound to the firewalld zone
+func HasZone(zone string, subnets []*net.IPNet) (bool, error) {
+	ok := true
+	err := withFirewalld(func(c *firewalld.Client) error {
+		for _, subnet := range subnets {
+			has, err := c.HasSource(zone, subnet.String())
+			if err != nil {
+				return err
+			}
+			if !has {
+				ok = false
+				return nil
+			}
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDirectRules(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd00:244::/64")
+	rules := directRules((&firewalldBackend{}).MasqueradeRules("xvm-network", subnet), true)
+	if len(rules) != 4 {
+		t.Fatalf("Expected 4 rules, got %+v", rules)
+	}
+
+	// The chain's rules keep their order, the jump is the first of its chain
+	chain := MasqChainName("xvm-network")
+	for i, r := range rules[:3] {
+		if r.IPv != "ipv6" || r.Table != "nat" || r.Chain != chain || r.Priority != int32(i) {
+			t.Fatalf("Unexpected rule %s", r)
+		}
+	}
+	jump := rules[3]
+	if jump.Chain != "POSTROUTING" || jump.Priority != 0 || jump.Args[len(jump.Args)-1] != chain {
+		t.Fatalf("Unexpected jump %s", jump)
+	}
+	if !strings.HasPrefix(jump.String(), "ipv6 nat POSTROUTING 0 -s fd00:244::/64 ") {
+		t.Fatalf("Unexpected formatting %q", jump.String())
+	}
+}
@@ -0,0 +1,191 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+
+	"github.com/nohns/xvm-cni/pkg/firewalld"
+)
+
+const (
+	// BackendIPTables manages rules with iptables, in whichever mode the
+	// host's iptables runs
+	BackendIPTables = "iptables"
+	// BackendNFTables manages rules with nft
+	BackendNFTables = "nftables"
+	// BackendFirewalld manages rules through firewalld's D-Bus API, so its
+	// reloads keep them
+	BackendFirewalld = "firewalld"
+
+	// multicastNet is the IPv4 multicast range, which must never be NATed
+	multicastNet = "224.0.0.0/4"
+	// multicastNet6 is the IPv6 multicast range
+	multicastNet6 = "ff00::/8"
+)
+
+// Backend manages the plugin's NAT rules with one of the host's firewall
+// tools
+type Backend interface {
+	// Name returns the name of the backend, e.g. "nftables"
+	Name() string
+	// SetupMasquerade installs rules that masquerade traffic from the
+	// subnet to any destination outside of it. It is idempotent.
+	SetupMasquerade(network string, subnet *net.IPNet) error
+	// TeardownMasquerade removes the masquerade rules of a network's
+	// subnet. It is idempotent.
+	TeardownMasquerade(network string, subnet *net.IPNet) error
+	// MasqueradeRules returns the rules SetupMasquerade installs, in order
+	MasqueradeRules(network string, subnet *net.IPNet) []Rule
+
+	// SetupPortMappings installs rules forwarding the ports of the node to
+	// an attachment's container, replacing those it had. The mappings are
+	// bound to container addresses by ExpandPortMappings.
+	SetupPortMappings(network, attachment string, mappings []PortMapping) error
+	// TeardownPortMappings removes the port forwarding rules of an
+	// attachment. It is idempotent.
+	TeardownPortMappings(network, attachment string) error
+	// HasPortMappings reports whether all of the port forwarding rules of
+	// an attachment are installed
+	HasPortMappings(network, attachment string, mappings []PortMapping) (bool, error)
+	// PortMappingRules returns the rules SetupPortMappings installs
+	PortMappingRules(network, attachment string, mappings []PortMapping) []Rule
+
+	// SetupVxlanOpening installs rules accepting the network's VXLAN
+	// traffic ahead of the host's input rules, replacing those it had
+	SetupVxlanOpening(network string, o *VxlanOpening) error
+	// TeardownVxlanOpening removes the rules accepting the network's VXLAN
+	// traffic. It is idempotent.
+	TeardownVxlanOpening(network string) error
+	// HasVxlanOpening reports whether all of the rules accepting the
+	// network's VXLAN traffic are installed
+	HasVxlanOpening(network string, o *VxlanOpening) (bool, error)
+	// VxlanOpeningRules returns the rules SetupVxlanOpening installs
+	VxlanOpeningRules(network string, o *VxlanOpening) []Rule
+
+	// SetupLoopbackGuard installs rules dropping the packets to loopback
+	// addresses that arrive on the network's device without being
+	// forwarded by a port mapping, which route_localnet would otherwise let
+	// the containers send to the node's local services (CVE-2020-8558). It
+	// is idempotent.
+	SetupLoopbackGuard(network, device string) error
+	// TeardownLoopbackGuard removes the network's loopback guard. It is
+	// idempotent.
+	TeardownLoopbackGuard(network string) error
+	// HasLoopbackGuard reports whether all of the rules of the network's
+	// loopback guard are installed
+	HasLoopbackGuard(network, device string) (bool, error)
+	// LoopbackGuardRules returns the rules SetupLoopbackGuard installs
+	LoopbackGuardRules(network, device string) []Rule
+}
+
+// Rule is a firewall rule as the backend's tool takes it
+type Rule struct {
+	Table string   `json:"table"`
+	Chain string   `json:"chain"`
+	Spec  []string `json:"spec"`
+}
+
+// New returns the named backend, or the one Detect picks if name is empty
+func New(name string) (Backend, error) {
+	if name == "" {
+		detected, err := Detect()
+		if err != nil {
+			return nil, err
+		}
+		name = detected
+	}
+	switch name {
+	case BackendIPTables:
+		return &iptablesBackend{}, nil
+	case BackendNFTables:
+		return &nftablesBackend{}, nil
+	case BackendFirewalld:
+		return &firewalldBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", name)
+}
+
+// Available returns the backends whose tools are installed on the host, and
+// firewalld if it's running
+func Available() []Backend {
+	var backends []Backend
+	if _, err := exec.LookPath("iptables"); err == nil {
+		backends = append(backends, &iptablesBackend{})
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		backends = append(backends, &nftablesBackend{})
+	}
+	if firewalld.Running() {
+		backends = append(backends, &firewalldBackend{})
+	}
+	return backends
+}
+
+// Detect picks the backend matching the host's other rules. firewalld is
+// never picked, as binding the subnets to a zone changes how the host
+// filters them; it has to be selected. A host whose iptables runs in legacy
+// mode keeps its rules in the legacy tables, so they're managed with
+// iptables too. Otherwise nft is preferred, falling back to iptables in
+// nf_tables mode if nft isn't installed.
+func Detect() (string, error) {
+	mode := ""
+	if out, err := exec.Command("iptables", "--version").Output(); err == nil {
+		mode = iptablesMode(string(out))
+	}
+	if mode == "legacy" {
+		return BackendIPTables, nil
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return BackendNFTables, nil
+	}
+	if mode != "" {
+		return BackendIPTables, nil
+	}
+	return "", errors.New("neither iptables nor nft found")
+}
+
+// iptablesModeRE matches the mode in the output of "iptables --version",
+// e.g. "iptables v1.8.7 (nf_tables)"
+var iptablesModeRE = regexp.MustCompile(`^ip6?tables v\d+\.\d+\.\d+(?: \((\w+)\))?`)
+
+// iptablesMode returns the mode of the iptables whose version output is
+// given, or "" if it isn't iptables. Releases predating nf_tables mode
+// don't report one and are legacy.
+func iptablesMode(version string) string {
+	match := iptablesModeRE.FindStringSubmatch(version)
+	if match == nil {
+		return ""
+	}
+	if match[1] == "" {
+		return "legacy"
+	}
+	return match[1]
+}
+
+// networkHash returns a stable short hash of the network name, to name its
+// chains and tables
+func networkHash(network string) string {
+	hash := sha256.Sum256([]byte(network))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// ruleComment returns the comment marking a network's rules
+func ruleComment(network string) string {
+	return fmt.Sprintf("xvm-cni: %s", network)
+}
+
+// multicast returns the multicast range of the subnet's address family
+func multicast(subnet *net.IPNet) string {
+	if subnet.IP.To4() == nil {
+		return multicastNet6
+	}
+	return multicastNet
+}
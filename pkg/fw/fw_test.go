@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import "testing"
+
+func TestIPTablesMode(t *testing.T) {
+	tests := []struct {
+		version string
+		mode    string
+	}{
+		{version: "iptables v1.8.7 (nf_tables)\n", mode: "nf_tables"},
+		{version: "iptables v1.8.7 (legacy)\n", mode: "legacy"},
+		{version: "ip6tables v1.8.4 (legacy)\n", mode: "legacy"},
+		{version: "iptables v1.6.1\n", mode: "legacy"},
+		{version: "nft v1.0.2\n", mode: ""},
+	}
+
+	for _, tt := range tests {
+		if mode := iptablesMode(tt.version); mode != tt.mode {
+			t.Errorf("iptablesMode(%q) = %q, expected %q", tt.version, mode, tt.mode)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{BackendIPTables, BackendNFTables, BackendFirewalld} {
+		backend, err := New(name)
+		if err != nil {
+			t.Fatalf("Failed to create backend %s: %v", name, err)
+		}
+		if backend.Name() != name {
+			t.Fatalf("Expected backend %s, got %s", name, backend.Name())
+		}
+	}
+	if _, err := New("ebtables"); err == nil {
+		t.Fatalf("Expected unknown backend to be rejected")
+	}
+}
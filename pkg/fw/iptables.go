@@ -0,0 +1,499 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// masqChainPrefix is the prefix of the per-network iptables masquerade
+	// chains
+	masqChainPrefix = "XVM-MASQ-"
+	// hostPortChainPrefix is the prefix of the per-attachment iptables port
+	// forwarding chains
+	hostPortChainPrefix = "XVM-HP-"
+	// hairpinChainPrefix is the prefix of the per-attachment iptables
+	// hairpin masquerade chains
+	hairpinChainPrefix = "XVM-HPM-"
+	// openingChainPrefix is the prefix of the per-network iptables chains
+	// accepting VXLAN traffic
+	openingChainPrefix = "XVM-VX-"
+	// loopbackChainPrefix is the prefix of the per-network iptables chains
+	// guarding loopback routing
+	loopbackChainPrefix = "XVM-LO-"
+)
+
+// errNoIPTables is returned for address families whose iptables isn't
+// installed
+var errNoIPTables = errors.New("failed to locate iptables")
+
+// dnatChains are the chains of the nat table jumping to the port forwarding
+// chains, for connections from other hosts and from the node itself
+var dnatChains = []string{"PREROUTING", "OUTPUT"}
+
+// iptablesBackend manages rules with iptables
+type iptablesBackend struct{}
+
+// MasqChainName returns the name of the iptables masquerade chain for a
+// network
+func MasqChainName(network string) string {
+	return masqChainPrefix + networkHash(network)
+}
+
+// Name implements Backend
+func (b *iptablesBackend) Name() string {
+	return BackendIPTables
+}
+
+// SetupMasquerade implements Backend
+func (b *iptablesBackend) SetupMasquerade(network string, subnet *net.IPNet) error {
+	ipt, err := newIPTables(subnet)
+	if err != nil {
+		return err
+	}
+	chain := MasqChainName(network)
+
+	// Create the network's chain if missing and add the rules it lacks in
+	// place, rather than flushing it, so every ADD doesn't briefly send the
+	// subnet's traffic out unmasqueraded
+	exists, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to check chain %s: %v", chain, err)
+	}
+	if !exists {
+		if err := ipt.NewChain("nat", chain); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", chain, err)
+		}
+	}
+	rules := b.MasqueradeRules(network, subnet)
+	for i, rule := range rules[:len(rules)-1] {
+		ok, err := ipt.Exists(rule.Table, rule.Chain, rule.Spec...)
+		if err != nil {
+			return fmt.Errorf("failed to check chain %s: %v", chain, err)
+		}
+		if ok {
+			continue
+		}
+		if err := ipt.Insert(rule.Table, rule.Chain, i+1, rule.Spec...); err != nil {
+			return fmt.Errorf("failed to add rule to chain %s: %v", chain, err)
+		}
+	}
+
+	// Send traffic from the subnet through the chain
+	jump := rules[len(rules)-1]
+	if err := ipt.AppendUnique(jump.Table, jump.Chain, jump.Spec...); err != nil {
+		return fmt.Errorf("failed to add POSTROUTING rule: %v", err)
+	}
+
+	return nil
+}
+
+// MasqueradeRules implements Backend. The last rule sends the subnet's
+// traffic through the network's chain.
+func (b *iptablesBackend) MasqueradeRules(network string, subnet *net.IPNet) []Rule {
+	chain := MasqChainName(network)
+	comment := ruleComment(network)
+	return []Rule{
+		{Table: "nat", Chain: chain, Spec: []string{"-d", subnet.String(), "-m", "comment", "--comment", comment, "-j", "RETURN"}},
+		{Table: "nat", Chain: chain, Spec: []string{"-d", multicast(subnet), "-m", "comment", "--comment", comment, "-j", "RETURN"}},
+		{Table: "nat", Chain: chain, Spec: []string{"-m", "comment", "--comment", comment, "-j", "MASQUERADE"}},
+		{Table: "nat", Chain: "POSTROUTING", Spec: []string{"-s", subnet.String(), "-m", "comment", "--comment", comment, "-j", chain}},
+	}
+}
+
+// TeardownMasquerade implements Backend
+func (b *iptablesBackend) TeardownMasquerade(network string, subnet *net.IPNet) error {
+	ipt, err := newIPTables(subnet)
+	if err != nil {
+		return err
+	}
+	chain := MasqChainName(network)
+
+	// Remove the jump before the chain it points to
+	jump := []string{"-s", subnet.String(), "-m", "comment", "--comment", ruleComment(network), "-j", chain}
+	if err := ipt.DeleteIfExists("nat", "POSTROUTING", jump...); err != nil {
+		return fmt.Errorf("failed to delete POSTROUTING rule: %v", err)
+	}
+
+	exists, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to check chain %s: %v", chain, err)
+	}
+	if !exists {
+		return nil // Nothing to remove
+	}
+	if err := ipt.ClearAndDeleteChain("nat", chain); err != nil {
+		return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+	}
+
+	return nil
+}
+
+// HostPortChainName returns the name of the iptables port forwarding chain
+// of a network's attachment
+func HostPortChainName(network, attachment string) string {
+	return hostPortChainPrefix + attachmentHash(network, attachment)
+}
+
+// HairpinChainName returns the name of the iptables chain masquerading the
+// connections to a network's attachment that must be hairpinned
+func HairpinChainName(network, attachment string) string {
+	return hairpinChainPrefix + attachmentHash(network, attachment)
+}
+
+// SetupPortMappings implements Backend
+func (b *iptablesBackend) SetupPortMappings(network, attachment string, mappings []PortMapping) error {
+	chains := []string{HostPortChainName(network, attachment), HairpinChainName(network, attachment)}
+	for _, ipv6 := range []bool{false, true} {
+		ipt, err := newIPTablesFamily(ipv6)
+		family := filterMappings(mappings, ipv6)
+		if len(family) == 0 {
+			// Drop the family's rules of earlier mappings, if it has any
+			if err == nil {
+				err = teardownPortMappings(ipt, network, chains)
+			}
+			if err != nil && !errors.Is(err, errNoIPTables) {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Create (or flush) the attachment's chains and fill them, then send
+		// connections through them
+		for _, chain := range chains {
+			if err := ipt.ClearChain("nat", chain); err != nil {
+				return fmt.Errorf("failed to create chain %s: %v", chain, err)
+			}
+		}
+		for _, rule := range b.portMappingRules(network, attachment, family) {
+			if rule.Chain == chains[0] || rule.Chain == chains[1] {
+				err = ipt.Append(rule.Table, rule.Chain, rule.Spec...)
+			} else {
+				err = ipt.AppendUnique(rule.Table, rule.Chain, rule.Spec...)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to add rule to chain %s: %v", rule.Chain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PortMappingRules implements Backend. The jumps to the attachment's chains
+// come last.
+func (b *iptablesBackend) PortMappingRules(network, attachment string, mappings []PortMapping) []Rule {
+	return append(b.portMappingRules(network, attachment, filterMappings(mappings, false)),
+		b.portMappingRules(network, attachment, filterMappings(mappings, true))...)
+}
+
+// portMappingRules returns the rules of the mappings of one address family
+func (b *iptablesBackend) portMappingRules(network, attachment string, mappings []PortMapping) []Rule {
+	if len(mappings) == 0 {
+		return nil
+	}
+	chain := HostPortChainName(network, attachment)
+	hairpin := HairpinChainName(network, attachment)
+	comment := ruleComment(network)
+	var rules []Rule
+	for _, m := range mappings {
+		spec := []string{"-p", m.protocol()}
+		if m.HostIP != "" {
+			spec = append(spec, "-d", m.HostIP)
+		}
+		spec = append(spec, "--dport", strconv.Itoa(m.HostPort), "-m", "comment", "--comment", comment, "-j", "DNAT", "--to-destination", m.destination())
+		rules = append(rules, Rule{Table: "nat", Chain: chain, Spec: spec})
+	}
+	for _, m := range mappings {
+		for _, src := range m.hairpinSources() {
+			rules = append(rules, Rule{Table: "nat", Chain: hairpin, Spec: []string{
+				"-s", src, "-d", m.ContainerIP.String(), "-p", m.protocol(), "--dport", strconv.Itoa(m.ContainerPort),
+				"-m", "comment", "--comment", comment, "-j", "MASQUERADE",
+			}})
+		}
+	}
+	for _, hook := range dnatChains {
+		rules = append(rules, Rule{Table: "nat", Chain: hook, Spec: dnatJump(network, chain)})
+	}
+	rules = append(rules, Rule{Table: "nat", Chain: "POSTROUTING", Spec: hairpinJump(network, hairpin)})
+	return rules
+}
+
+// TeardownPortMappings implements Backend
+func (b *iptablesBackend) TeardownPortMappings(network, attachment string) error {
+	chains := []string{HostPortChainName(network, attachment), HairpinChainName(network, attachment)}
+	for _, ipv6 := range []bool{false, true} {
+		ipt, err := newIPTablesFamily(ipv6)
+		if errors.Is(err, errNoIPTables) {
+			continue // Nothing to remove without the tool
+		}
+		if err != nil {
+			return err
+		}
+		if err := teardownPortMappings(ipt, network, chains); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownPortMappings removes the port forwarding and hairpin chains and
+// the jumps to them from one address family's nat table
+func teardownPortMappings(ipt *iptables.IPTables, network string, chains []string) error {
+	forward, hairpin := chains[0], chains[1]
+	jumps := map[string][]string{forward: dnatChains, hairpin: {"POSTROUTING"}}
+	for _, chain := range chains {
+		exists, err := ipt.ChainExists("nat", chain)
+		if err != nil {
+			return fmt.Errorf("failed to check chain %s: %v", chain, err)
+		}
+		if !exists {
+			continue // Nothing to remove
+		}
+
+		// Remove the jumps before the chain they point to
+		spec := dnatJump(network, chain)
+		if chain == hairpin {
+			spec = hairpinJump(network, chain)
+		}
+		for _, hook := range jumps[chain] {
+			if err := ipt.DeleteIfExists("nat", hook, spec...); err != nil {
+				return fmt.Errorf("failed to delete %s rule: %v", hook, err)
+			}
+		}
+		if err := ipt.ClearAndDeleteChain("nat", chain); err != nil {
+			return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+		}
+	}
+	return nil
+}
+
+// dnatJump returns the spec of the rules sending connections to the node's
+// addresses through a port forwarding chain
+func dnatJump(network, chain string) []string {
+	return []string{"-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", ruleComment(network), "-j", chain}
+}
+
+// hairpinJump returns the spec of the rule sending forwarded connections
+// through a hairpin chain
+func hairpinJump(network, chain string) []string {
+	return []string{"-m", "conntrack", "--ctstate", "DNAT", "-m", "comment", "--comment", ruleComment(network), "-j", chain}
+}
+
+// HasPortMappings implements Backend
+func (b *iptablesBackend) HasPortMappings(network, attachment string, mappings []PortMapping) (bool, error) {
+	chains := []string{HostPortChainName(network, attachment), HairpinChainName(network, attachment)}
+	for _, ipv6 := range []bool{false, true} {
+		rules := b.portMappingRules(network, attachment, filterMappings(mappings, ipv6))
+		if len(rules) == 0 {
+			continue
+		}
+		ipt, err := newIPTablesFamily(ipv6)
+		if err != nil {
+			return false, err
+		}
+		for _, chain := range chains {
+			exists, err := ipt.ChainExists("nat", chain)
+			if err != nil {
+				return false, fmt.Errorf("failed to check chain %s: %v", chain, err)
+			}
+			if !exists {
+				return false, nil
+			}
+		}
+		for _, rule := range rules {
+			ok, err := ipt.Exists(rule.Table, rule.Chain, rule.Spec...)
+			if err != nil {
+				return false, fmt.Errorf("failed to check rule in chain %s: %v", rule.Chain, err)
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// OpeningChainName returns the name of the iptables and nftables chain
+// accepting a network's VXLAN traffic
+func OpeningChainName(network string) string {
+	return openingChainPrefix + networkHash(network)
+}
+
+// SetupVxlanOpening implements Backend. The chain is jumped to from the top
+// of INPUT, ahead of the host's rules.
+func (b *iptablesBackend) SetupVxlanOpening(network string, o *VxlanOpening) error {
+	return setupInputChain(OpeningChainName(network), b.VxlanOpeningRules(network, o))
+}
+
+// VxlanOpeningRules implements Backend. The last rule sends the node's input
+// through the network's chain.
+func (b *iptablesBackend) VxlanOpeningRules(network string, o *VxlanOpening) []Rule {
+	chain := OpeningChainName(network)
+	comment := openingComment(network)
+	var rules []Rule
+	for _, src := range o.Peers {
+		spec := []string{"-s", src, "-p", "udp", "--dport", strconv.Itoa(o.Port), "-m", "comment", "--comment", comment, "-j", "ACCEPT"}
+		rules = append(rules, Rule{Table: "filter", Chain: chain, Spec: spec})
+	}
+	if o.Multicast {
+		rules = append(rules, Rule{Table: "filter", Chain: chain, Spec: []string{"-p", "igmp", "-m", "comment", "--comment", comment, "-j", "ACCEPT"}})
+	}
+	return append(rules, Rule{Table: "filter", Chain: "INPUT", Spec: []string{"-m", "comment", "--comment", comment, "-j", chain}})
+}
+
+// TeardownVxlanOpening implements Backend
+func (b *iptablesBackend) TeardownVxlanOpening(network string) error {
+	return teardownInputChain(OpeningChainName(network), openingComment(network))
+}
+
+// HasVxlanOpening implements Backend
+func (b *iptablesBackend) HasVxlanOpening(network string, o *VxlanOpening) (bool, error) {
+	return hasInputChain(OpeningChainName(network), b.VxlanOpeningRules(network, o))
+}
+
+// LoopbackChainName returns the name of the iptables chain guarding a
+// network's loopback routing
+func LoopbackChainName(network string) string {
+	return loopbackChainPrefix + networkHash(network)
+}
+
+// SetupLoopbackGuard implements Backend. The chain is jumped to from the top
+// of INPUT, ahead of the host's rules.
+func (b *iptablesBackend) SetupLoopbackGuard(network, device string) error {
+	return setupInputChain(LoopbackChainName(network), b.LoopbackGuardRules(network, device))
+}
+
+// LoopbackGuardRules implements Backend. The drop is kube-proxy's, sparing
+// the node's own connections and those port mappings forwarded. The last
+// rule sends the node's input through the network's chain.
+func (b *iptablesBackend) LoopbackGuardRules(network, device string) []Rule {
+	chain := LoopbackChainName(network)
+	comment := loopbackComment(network)
+	return []Rule{
+		{Table: "filter", Chain: chain, Spec: []string{"-i", device, "-d", loopbackNet, "!", "-s", loopbackNet, "-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED,DNAT", "-m", "comment", "--comment", comment, "-j", "DROP"}},
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-m", "comment", "--comment", comment, "-j", chain}},
+	}
+}
+
+// TeardownLoopbackGuard implements Backend
+func (b *iptablesBackend) TeardownLoopbackGuard(network string) error {
+	return teardownInputChain(LoopbackChainName(network), loopbackComment(network))
+}
+
+// HasLoopbackGuard implements Backend
+func (b *iptablesBackend) HasLoopbackGuard(network, device string) (bool, error) {
+	return hasInputChain(LoopbackChainName(network), b.LoopbackGuardRules(network, device))
+}
+
+// setupInputChain creates (or flushes) one of the plugin's IPv4 filter
+// chains, fills it with the rules but the last, and inserts the last, the
+// jump to the chain, at the top of INPUT
+func setupInputChain(chain string, rules []Rule) error {
+	ipt, err := newIPTablesFamily(false)
+	if err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("filter", chain); err != nil {
+		return fmt.Errorf("failed to create chain %s: %v", chain, err)
+	}
+	for _, rule := range rules[:len(rules)-1] {
+		if err := ipt.Append(rule.Table, rule.Chain, rule.Spec...); err != nil {
+			return fmt.Errorf("failed to add rule to chain %s: %v", chain, err)
+		}
+	}
+
+	jump := rules[len(rules)-1]
+	exists, err := ipt.Exists(jump.Table, jump.Chain, jump.Spec...)
+	if err != nil {
+		return fmt.Errorf("failed to check INPUT rule: %v", err)
+	}
+	if !exists {
+		if err := ipt.Insert(jump.Table, jump.Chain, 1, jump.Spec...); err != nil {
+			return fmt.Errorf("failed to add INPUT rule: %v", err)
+		}
+	}
+	return nil
+}
+
+// teardownInputChain removes the jump to one of the plugin's IPv4 filter
+// chains, marked with the comment, and then the chain
+func teardownInputChain(chain, comment string) error {
+	ipt, err := newIPTablesFamily(false)
+	if errors.Is(err, errNoIPTables) {
+		return nil // Nothing to remove without the tool
+	}
+	if err != nil {
+		return err
+	}
+
+	// Remove the jump before the chain it points to
+	jump := []string{"-m", "comment", "--comment", comment, "-j", chain}
+	if err := ipt.DeleteIfExists("filter", "INPUT", jump...); err != nil {
+		return fmt.Errorf("failed to delete INPUT rule: %v", err)
+	}
+	exists, err := ipt.ChainExists("filter", chain)
+	if err != nil {
+		return fmt.Errorf("failed to check chain %s: %v", chain, err)
+	}
+	if !exists {
+		return nil // Nothing to remove
+	}
+	if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+		return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+	}
+	return nil
+}
+
+// hasInputChain reports whether one of the plugin's IPv4 filter chains
+// exists with all of the rules
+func hasInputChain(chain string, rules []Rule) (bool, error) {
+	ipt, err := newIPTablesFamily(false)
+	if err != nil {
+		return false, err
+	}
+	exists, err := ipt.ChainExists("filter", chain)
+	if err != nil {
+		return false, fmt.Errorf("failed to check chain %s: %v", chain, err)
+	}
+	if !exists {
+		return false, nil
+	}
+	for _, rule := range rules {
+		ok, err := ipt.Exists(rule.Table, rule.Chain, rule.Spec...)
+		if err != nil {
+			return false, fmt.Errorf("failed to check rule in chain %s: %v", rule.Chain, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// newIPTables returns an iptables handle for the subnet's address family
+func newIPTables(subnet *net.IPNet) (*iptables.IPTables, error) {
+	return newIPTablesFamily(subnet.IP.To4() == nil)
+}
+
+// newIPTablesFamily returns an iptables handle for IPv4 or IPv6
+func newIPTablesFamily(ipv6 bool) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if ipv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoIPTables, err)
+	}
+	return ipt, nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestMasqChainName(t *testing.T) {
+	name := MasqChainName("xvm-network")
+
+	// Chain names must be stable and fit iptables' 28 character limit
+	if name != MasqChainName("xvm-network") {
+		t.Fatalf("Chain name is not deterministic")
+	}
+	if len(name) > 28 {
+		t.Fatalf("Chain name %s is longer than 28 characters", name)
+	}
+	if !strings.HasPrefix(name, masqChainPrefix) {
+		t.Fatalf("Chain name %s lacks prefix %s", name, masqChainPrefix)
+	}
+	if name == MasqChainName("other-network") {
+		t.Fatalf("Different networks share chain name %s", name)
+	}
+}
+
+func TestIPTablesMasquerade(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		t.Skip("iptables not available")
+	}
+
+	backend := &iptablesBackend{}
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/24")
+	network := "xvm-fw-test"
+	chain := MasqChainName(network)
+
+	// Setup twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := backend.SetupMasquerade(network, subnet); err != nil {
+			t.Fatalf("Failed to setup masquerading: %v", err)
+		}
+	}
+	rules, err := ipt.List("nat", chain)
+	if err != nil {
+		t.Fatalf("Failed to list chain %s: %v", chain, err)
+	}
+	// The first rule is the chain declaration
+	if len(rules) != 4 {
+		t.Fatalf("Expected 3 rules in chain %s, got %d", chain, len(rules)-1)
+	}
+
+	// Clean up
+	if err := backend.TeardownMasquerade(network, subnet); err != nil {
+		t.Fatalf("Failed to teardown masquerading: %v", err)
+	}
+	exists, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		t.Fatalf("Failed to check chain %s: %v", chain, err)
+	}
+	if exists {
+		t.Fatalf("Chain %s still exists after teardown", chain)
+	}
+}
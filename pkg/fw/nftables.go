@@ -0,0 +1,438 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// masqTablePrefix is the prefix of the per-network nftables masquerade
+	// tables
+	masqTablePrefix = "xvm-cni-masq-"
+	// masqChain is the NAT chain of the masquerade tables
+	masqChain = "postrouting"
+	// srcnatPriority is the priority of the source NAT hook, "srcnat" in
+	// newer nft releases
+	srcnatPriority = 100
+
+	// hostPortTablePrefix is the prefix of the per-attachment nftables port
+	// forwarding tables
+	hostPortTablePrefix = "xvm-cni-hostport-"
+	// dstnatPriority is the priority of the destination NAT hooks, "dstnat"
+	// in newer nft releases
+	dstnatPriority = -100
+
+	// loopbackTablePrefix is the prefix of the per-network nftables tables
+	// guarding loopback routing
+	loopbackTablePrefix = "xvm-cni-lo-"
+	// filterPriority is the priority of the filter hooks, "filter" in newer
+	// nft releases
+	filterPriority = 0
+)
+
+// dnatHooks are the hooks of the port forwarding chains, for connections
+// from other hosts and from the node itself
+var dnatHooks = []string{"prerouting", "output"}
+
+// hairpinChain is the chain of the port forwarding tables masquerading the
+// connections that must be hairpinned
+const hairpinChain = "postrouting"
+
+// nftablesBackend manages rules with nft
+type nftablesBackend struct{}
+
+// MasqTableName returns the family and name of the nftables masquerade
+// table for a network's subnet
+func MasqTableName(network string, subnet *net.IPNet) (string, string) {
+	family := "ip"
+	if subnet.IP.To4() == nil {
+		family = "ip6"
+	}
+	return family, masqTablePrefix + networkHash(network)
+}
+
+// Name implements Backend
+func (b *nftablesBackend) Name() string {
+	return BackendNFTables
+}
+
+// SetupMasquerade implements Backend. The table of the network's subnet is
+// recreated in the same transaction, so no traffic sees it half-filled.
+func (b *nftablesBackend) SetupMasquerade(network string, subnet *net.IPNet) error {
+	family, table := MasqTableName(network, subnet)
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table %[1]s %[2]s\ndelete table %[1]s %[2]s\nadd table %[1]s %[2]s\n", family, table)
+	fmt.Fprintf(&script, "add chain %s %s %s { type nat hook postrouting priority %d; policy accept; }\n", family, table, masqChain, srcnatPriority)
+	for _, rule := range b.MasqueradeRules(network, subnet) {
+		fmt.Fprintf(&script, "add rule %s %s %s\n", rule.Table, rule.Chain, strings.Join(rule.Spec, " "))
+	}
+	if err := nft.Apply(script.String()); err != nil {
+		return fmt.Errorf("failed to create table %s: %v", table, err)
+	}
+	return nil
+}
+
+// MasqueradeRules implements Backend. The table is given with its family.
+func (b *nftablesBackend) MasqueradeRules(network string, subnet *net.IPNet) []Rule {
+	family, table := MasqTableName(network, subnet)
+	comment := []string{"comment", strconv.Quote(ruleComment(network))}
+	from := []string{family, "saddr", subnet.String()}
+	return []Rule{
+		{Table: family + " " + table, Chain: masqChain, Spec: concat(from, []string{family, "daddr", subnet.String(), "return"}, comment)},
+		{Table: family + " " + table, Chain: masqChain, Spec: concat(from, []string{family, "daddr", multicast(subnet), "return"}, comment)},
+		{Table: family + " " + table, Chain: masqChain, Spec: concat(from, []string{"masquerade"}, comment)},
+	}
+}
+
+// TeardownMasquerade implements Backend
+func (b *nftablesBackend) TeardownMasquerade(network string, subnet *net.IPNet) error {
+	family, table := MasqTableName(network, subnet)
+	// Adding the table first makes deleting it succeed if it's gone already
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// HostPortTableName returns the name of the nftables port forwarding table
+// of a network's attachment. The table is of the inet family, holding the
+// rules of both address families.
+func HostPortTableName(network, attachment string) string {
+	return hostPortTablePrefix + attachmentHash(network, attachment)
+}
+
+// SetupPortMappings implements Backend. The attachment's table is recreated
+// in the same transaction, so no connection sees it half-filled.
+func (b *nftablesBackend) SetupPortMappings(network, attachment string, mappings []PortMapping) error {
+	table := HostPortTableName(network, attachment)
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table inet %[1]s\ndelete table inet %[1]s\nadd table inet %[1]s\n", table)
+	for _, hook := range dnatHooks {
+		fmt.Fprintf(&script, "add chain inet %s %s { type nat hook %s priority %d; policy accept; }\n", table, hook, hook, dstnatPriority)
+	}
+	fmt.Fprintf(&script, "add chain inet %s %s { type nat hook postrouting priority %d; policy accept; }\n", table, hairpinChain, srcnatPriority)
+	for _, rule := range b.PortMappingRules(network, attachment, mappings) {
+		fmt.Fprintf(&script, "add rule %s %s %s\n", rule.Table, rule.Chain, strings.Join(rule.Spec, " "))
+	}
+	if err := nft.Apply(script.String()); err != nil {
+		return fmt.Errorf("failed to create table %s: %v", table, err)
+	}
+	return nil
+}
+
+// PortMappingRules implements Backend. The table is given with its family.
+// Mappings without a host IP forward connections to any of the node's
+// addresses. Forwarded connections that must be hairpinned are masqueraded.
+func (b *nftablesBackend) PortMappingRules(network, attachment string, mappings []PortMapping) []Rule {
+	table := "inet " + HostPortTableName(network, attachment)
+	comment := []string{"comment", strconv.Quote(ruleComment(network))}
+	var rules []Rule
+	for _, hook := range dnatHooks {
+		for _, m := range mappings {
+			family, nfproto := "ip", "ipv4"
+			if m.ipv6() {
+				family, nfproto = "ip6", "ipv6"
+			}
+			to := []string{"meta", "nfproto", nfproto, "fib", "daddr", "type", "local"}
+			if m.HostIP != "" {
+				to = []string{family, "daddr", m.HostIP}
+			}
+			forward := []string{m.protocol(), "dport", strconv.Itoa(m.HostPort), "dnat", family, "to", m.destination()}
+			rules = append(rules, Rule{Table: table, Chain: hook, Spec: concat(to, forward, comment)})
+		}
+	}
+	for _, m := range mappings {
+		family := "ip"
+		if m.ipv6() {
+			family = "ip6"
+		}
+		for _, src := range m.hairpinSources() {
+			match := []string{family, "saddr", src, family, "daddr", m.ContainerIP.String(), m.protocol(), "dport", strconv.Itoa(m.ContainerPort)}
+			rules = append(rules, Rule{Table: table, Chain: hairpinChain, Spec: concat(match, []string{"ct", "status", "dnat", "masquerade"}, comment)})
+		}
+	}
+	return rules
+}
+
+// TeardownPortMappings implements Backend
+func (b *nftablesBackend) TeardownPortMappings(network, attachment string) error {
+	table := HostPortTableName(network, attachment)
+	// Adding the table first makes deleting it succeed if it's gone already
+	script := fmt.Sprintf("add table inet %[1]s\ndelete table inet %[1]s\n", table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// HasPortMappings implements Backend. A table with as many rules as the
+// mappings make is taken as intact.
+func (b *nftablesBackend) HasPortMappings(network, attachment string, mappings []PortMapping) (bool, error) {
+	objects, err := nft.ListTable("inet", HostPortTableName(network, attachment))
+	if err != nil {
+		return false, err
+	}
+	rules := 0
+	for _, object := range objects {
+		if object.Rule != nil {
+			rules++
+		}
+	}
+	return len(objects) > 0 && rules == len(b.PortMappingRules(network, attachment, mappings)), nil
+}
+
+// inputChains returns the host's filter chains on the input hook, of the
+// families IPv4 traffic passes. An accept only ends a packet's traversal of
+// its own base chain, so the openings are jumped to from the chains that may
+// drop it rather than hooked in a table of the plugin's.
+func inputChains() ([]*nft.Chain, error) {
+	objects, err := nft.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	var chains []*nft.Chain
+	for _, object := range objects {
+		c := object.Chain
+		if c == nil || c.Type != "filter" || c.Hook != "input" || (c.Family != "ip" && c.Family != "inet") {
+			continue
+		}
+		if strings.HasPrefix(c.Table, "xvm-cni-") {
+			continue
+		}
+		chains = append(chains, c)
+	}
+	return chains, nil
+}
+
+// inputTables returns the tables of the chains, once each, as the chains
+// standing for them
+func inputTables(chains []*nft.Chain) []*nft.Chain {
+	seen := make(map[string]bool)
+	var tables []*nft.Chain
+	for _, c := range chains {
+		if key := c.Family + " " + c.Table; !seen[key] {
+			seen[key] = true
+			tables = append(tables, c)
+		}
+	}
+	return tables
+}
+
+// openingJumps returns the handles of the jumps to the network's VXLAN
+// openings in the chain
+func openingJumps(network string, c *nft.Chain) ([]int, error) {
+	objects, err := nft.ListChain(c.Family, c.Table, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	var handles []int
+	for _, object := range objects {
+		if object.Rule != nil && object.Rule.Comment == openingComment(network) {
+			handles = append(handles, object.Rule.Handle)
+		}
+	}
+	return handles, nil
+}
+
+// SetupVxlanOpening implements Backend. The rules are in a chain of the
+// network's added to each table with filter chains on the input hook, and
+// jumped to from the top of those chains, in one transaction. The host's
+// chains only get the jump, tagged with the network's comment. Without such
+// chains nothing drops the traffic.
+func (b *nftablesBackend) SetupVxlanOpening(network string, o *VxlanOpening) error {
+	chains, err := inputChains()
+	if err != nil {
+		return err
+	}
+	rules := b.VxlanOpeningRules(network, o)
+	accepts, jump := rules[:len(rules)-1], rules[len(rules)-1]
+	chain := OpeningChainName(network)
+	var script strings.Builder
+	for _, t := range inputTables(chains) {
+		fmt.Fprintf(&script, "add chain %[1]s %[2]s %[3]s\nflush chain %[1]s %[2]s %[3]s\n", t.Family, t.Table, chain)
+		for _, rule := range accepts {
+			fmt.Fprintf(&script, "add rule %s %s %s %s\n", t.Family, t.Table, chain, strings.Join(rule.Spec, " "))
+		}
+	}
+	for _, c := range chains {
+		handles, err := openingJumps(network, c)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %d\n", c.Family, c.Table, c.Name, handle)
+		}
+		fmt.Fprintf(&script, "insert rule %s %s %s %s\n", c.Family, c.Table, c.Name, strings.Join(jump.Spec, " "))
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	if err := nft.Apply(script.String()); err != nil {
+		return fmt.Errorf("failed to add VXLAN openings: %v", err)
+	}
+	return nil
+}
+
+// VxlanOpeningRules implements Backend. The rules go into the network's
+// chain in each of the host's tables with filter chains on the input hook,
+// which the table stands for, and the last one jumps to it from those
+// chains.
+func (b *nftablesBackend) VxlanOpeningRules(network string, o *VxlanOpening) []Rule {
+	chain := OpeningChainName(network)
+	var rules []Rule
+	for _, src := range o.Peers {
+		rules = append(rules, Rule{Table: "*", Chain: chain, Spec: []string{"ip", "saddr", src, "udp", "dport", strconv.Itoa(o.Port), "accept"}})
+	}
+	if o.Multicast {
+		rules = append(rules, Rule{Table: "*", Chain: chain, Spec: []string{"ip", "protocol", "igmp", "accept"}})
+	}
+	return append(rules, Rule{Table: "*", Chain: "input", Spec: []string{"jump", chain, "comment", strconv.Quote(openingComment(network))}})
+}
+
+// TeardownVxlanOpening implements Backend
+func (b *nftablesBackend) TeardownVxlanOpening(network string) error {
+	chains, err := inputChains()
+	if err != nil {
+		return err
+	}
+	var script strings.Builder
+	for _, c := range chains {
+		handles, err := openingJumps(network, c)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %d\n", c.Family, c.Table, c.Name, handle)
+		}
+	}
+	// Adding the chain first makes deleting it succeed if it's gone already
+	chain := OpeningChainName(network)
+	for _, t := range inputTables(chains) {
+		fmt.Fprintf(&script, "add chain %[1]s %[2]s %[3]s\ndelete chain %[1]s %[2]s %[3]s\n", t.Family, t.Table, chain)
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	if err := nft.Apply(script.String()); err != nil {
+		return fmt.Errorf("failed to remove VXLAN openings: %v", err)
+	}
+	return nil
+}
+
+// HasVxlanOpening implements Backend. The openings are taken as intact if
+// each of the host's chains jumps to the network's chain once, and the chain
+// has as many rules as the network makes in each table.
+func (b *nftablesBackend) HasVxlanOpening(network string, o *VxlanOpening) (bool, error) {
+	chains, err := inputChains()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range chains {
+		handles, err := openingJumps(network, c)
+		if err != nil {
+			return false, err
+		}
+		if len(handles) != 1 {
+			return false, nil
+		}
+	}
+	want := len(b.VxlanOpeningRules(network, o)) - 1
+	chain := OpeningChainName(network)
+	for _, t := range inputTables(chains) {
+		objects, err := nft.ListTable(t.Family, t.Table)
+		if err != nil {
+			return false, err
+		}
+		rules := 0
+		for _, object := range objects {
+			if object.Rule != nil && object.Rule.Chain == chain {
+				rules++
+			}
+		}
+		if rules != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// LoopbackTableName returns the name of the nftables table guarding a
+// network's loopback routing. The table is of the ip family.
+func LoopbackTableName(network string) string {
+	return loopbackTablePrefix + networkHash(network)
+}
+
+// SetupLoopbackGuard implements Backend. The network's table is recreated in
+// the same transaction; a drop in it is final whatever the host's other
+// tables accept.
+func (b *nftablesBackend) SetupLoopbackGuard(network, device string) error {
+	table := LoopbackTableName(network)
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table ip %[1]s\ndelete table ip %[1]s\nadd table ip %[1]s\n", table)
+	fmt.Fprintf(&script, "add chain ip %s input { type filter hook input priority %d; policy accept; }\n", table, filterPriority)
+	for _, rule := range b.LoopbackGuardRules(network, device) {
+		fmt.Fprintf(&script, "add rule %s %s %s\n", rule.Table, rule.Chain, strings.Join(rule.Spec, " "))
+	}
+	if err := nft.Apply(script.String()); err != nil {
+		return fmt.Errorf("failed to create table %s: %v", table, err)
+	}
+	return nil
+}
+
+// LoopbackGuardRules implements Backend. The table is given with its
+// family. As kube-proxy's drop, the rules spare the node's own connections
+// and those port mappings forwarded.
+func (b *nftablesBackend) LoopbackGuardRules(network, device string) []Rule {
+	table := "ip " + LoopbackTableName(network)
+	comment := []string{"comment", strconv.Quote(loopbackComment(network))}
+	to := []string{"iifname", strconv.Quote(device), "ip", "daddr", loopbackNet}
+	return []Rule{
+		{Table: table, Chain: "input", Spec: concat(to, []string{"ct", "state", "established,related", "return"}, comment)},
+		{Table: table, Chain: "input", Spec: concat(to, []string{"ct", "status", "dnat", "return"}, comment)},
+		{Table: table, Chain: "input", Spec: concat(to, []string{"ip", "saddr", "!=", loopbackNet, "drop"}, comment)},
+	}
+}
+
+// TeardownLoopbackGuard implements Backend
+func (b *nftablesBackend) TeardownLoopbackGuard(network string) error {
+	table := LoopbackTableName(network)
+	// Adding the table first makes deleting it succeed if it's gone already
+	script := fmt.Sprintf("add table ip %[1]s\ndelete table ip %[1]s\n", table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// HasLoopbackGuard implements Backend. A table with as many rules as the
+// guard makes is taken as intact.
+func (b *nftablesBackend) HasLoopbackGuard(network, device string) (bool, error) {
+	objects, err := nft.ListTable("ip", LoopbackTableName(network))
+	if err != nil {
+		return false, err
+	}
+	rules := 0
+	for _, object := range objects {
+		if object.Rule != nil {
+			rules++
+		}
+	}
+	return len(objects) > 0 && rules == len(b.LoopbackGuardRules(network, device)), nil
+}
+
+// concat joins the parts of a rule
+func concat(parts ...[]string) []string {
+	var spec []string
+	for _, part := range parts {
+		spec = append(spec, part...)
+	}
+	return spec
+}
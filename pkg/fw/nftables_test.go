@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+func TestNFTablesMasqueradeRules(t *testing.T) {
+	backend := &nftablesBackend{}
+	_, subnet, _ := net.ParseCIDR("10.244.0.0/16")
+	family, table := MasqTableName("xvm-network", subnet)
+	if family != "ip" || !strings.HasPrefix(table, masqTablePrefix) {
+		t.Fatalf("Unexpected table %s %s", family, table)
+	}
+
+	var rules []string
+	for _, rule := range backend.MasqueradeRules("xvm-network", subnet) {
+		if rule.Table != "ip "+table || rule.Chain != masqChain {
+			t.Fatalf("Unexpected rule location %s %s", rule.Table, rule.Chain)
+		}
+		rules = append(rules, strings.Join(rule.Spec, " "))
+	}
+	want := []string{
+		`ip saddr 10.244.0.0/16 ip daddr 10.244.0.0/16 return comment "xvm-cni: xvm-network"`,
+		`ip saddr 10.244.0.0/16 ip daddr 224.0.0.0/4 return comment "xvm-cni: xvm-network"`,
+		`ip saddr 10.244.0.0/16 masquerade comment "xvm-cni: xvm-network"`,
+	}
+	if strings.Join(rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected rules:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(rules, "\n"))
+	}
+
+	// IPv6 subnets get a table of their own
+	_, subnet6, _ := net.ParseCIDR("fd00::/64")
+	if family6, table6 := MasqTableName("xvm-network", subnet6); family6 != "ip6" || table6 != table {
+		t.Fatalf("Unexpected IPv6 table %s %s", family6, table6)
+	}
+}
+
+func TestNFTablesMasquerade(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not available")
+	}
+
+	backend := &nftablesBackend{}
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/24")
+	network := "xvm-fw-test"
+	family, table := MasqTableName(network, subnet)
+
+	// Setup twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := backend.SetupMasquerade(network, subnet); err != nil {
+			t.Fatalf("Failed to setup masquerading: %v", err)
+		}
+	}
+	objects, err := nft.ListTable(family, table)
+	if err != nil {
+		t.Fatalf("Failed to list table %s: %v", table, err)
+	}
+	rules := 0
+	for _, object := range objects {
+		if object.Rule != nil {
+			rules++
+		}
+	}
+	if rules != 3 {
+		t.Fatalf("Expected 3 rules in table %s, got %d", table, rules)
+	}
+
+	// Clean up
+	for i := 0; i < 2; i++ {
+		if err := backend.TeardownMasquerade(network, subnet); err != nil {
+			t.Fatalf("Failed to teardown masquerading: %v", err)
+		}
+	}
+	if objects, err := nft.ListTable(family, table); err != nil || objects != nil {
+		t.Fatalf("Table %s still exists after teardown (%v)", table, err)
+	}
+}
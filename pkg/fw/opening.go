@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import "fmt"
+
+// VxlanOpening is the VXLAN traffic of a network the node's firewall
+// accepts from the peer nodes, for hosts with restrictive input policies
+type VxlanOpening struct {
+	// Port is the VXLAN UDP port
+	Port int
+	// Peers are the underlay addresses or prefixes of the peer nodes the
+	// traffic is accepted from
+	Peers []string
+	// Multicast accepts IGMP as well, so the node answers the underlay's
+	// queriers and snooping switches keep forwarding the flood group
+	Multicast bool
+}
+
+// openingComment returns the comment marking a network's VXLAN openings,
+// told apart from its other rules where they share the host's chains
+func openingComment(network string) string {
+	return fmt.Sprintf("xvm-cni: %s vxlan", network)
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVxlanOpeningRules(t *testing.T) {
+	o := &VxlanOpening{Port: 4789, Peers: []string{"192.168.1.11", "192.168.2.0/24"}, Multicast: true}
+
+	var rules []string
+	for _, rule := range (&nftablesBackend{}).VxlanOpeningRules("xvm-network", o) {
+		rules = append(rules, strings.Join(rule.Spec, " "))
+	}
+	want := []string{
+		`ip saddr 192.168.1.11 udp dport 4789 accept`,
+		`ip saddr 192.168.2.0/24 udp dport 4789 accept`,
+		`ip protocol igmp accept`,
+		`jump ` + OpeningChainName("xvm-network") + ` comment "xvm-cni: xvm-network vxlan"`,
+	}
+	if strings.Join(rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected nftables rules:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(rules, "\n"))
+	}
+
+	// The iptables chain is jumped to from INPUT last
+	chain := OpeningChainName("xvm-network")
+	if len(chain) > 28 || chain == OpeningChainName("other-network") {
+		t.Fatalf("Chain name %s is too long or not unique", chain)
+	}
+	iptRules := (&iptablesBackend{}).VxlanOpeningRules("xvm-network", &VxlanOpening{Port: 8472, Peers: []string{"192.168.1.11"}})
+	if len(iptRules) != 2 {
+		t.Fatalf("Expected 2 rules, got %+v", iptRules)
+	}
+	if spec := strings.Join(iptRules[0].Spec, " "); iptRules[0].Chain != chain || !strings.HasPrefix(spec, "-s 192.168.1.11 -p udp --dport 8472 ") {
+		t.Fatalf("Unexpected rule %s: %s", iptRules[0].Chain, spec)
+	}
+	if iptRules[1].Table != "filter" || iptRules[1].Chain != "INPUT" || iptRules[1].Spec[len(iptRules[1].Spec)-1] != chain {
+		t.Fatalf("Unexpected jump %+v", iptRules[1])
+	}
+}
@@ -0,0 +1,302 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// portMappingsDir is the directory of a network's data directory
+	// holding the port mappings of its attachments
+	portMappingsDir = "portmappings"
+
+	// loopbackNet is the source of the node's connections to 127.0.0.1,
+	// forwarded once the bridge routes loopback addresses. IPv6 has no such
+	// setting, so connections to ::1 stay on the node.
+	loopbackNet = "127.0.0.0/8"
+)
+
+// PortMapping forwards connections to a port of the node to a port of a
+// container, as runtimes pass them with the portMappings capability
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+	// HostIP restricts the mapping to one of the node's addresses
+	HostIP string `json:"hostIP,omitempty"`
+	// ContainerIP is the container address connections are forwarded to,
+	// and Subnet the container's subnet, set by ExpandPortMappings
+	ContainerIP net.IP `json:"containerIP,omitempty"`
+	Subnet      string `json:"subnet,omitempty"`
+}
+
+// Validate returns the problems with the port mapping
+func (m *PortMapping) Validate() []string {
+	var problems []string
+	for _, port := range []int{m.HostPort, m.ContainerPort} {
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("port mapping %d:%d: port out of range (1-65535)", m.HostPort, m.ContainerPort))
+			break
+		}
+	}
+	switch strings.ToLower(m.Protocol) {
+	case "", "tcp", "udp", "sctp":
+	default:
+		problems = append(problems, fmt.Sprintf("port mapping %d:%d: unsupported protocol %q", m.HostPort, m.ContainerPort, m.Protocol))
+	}
+	if m.HostIP != "" && net.ParseIP(m.HostIP) == nil {
+		problems = append(problems, fmt.Sprintf("port mapping %d:%d: invalid host IP %q", m.HostPort, m.ContainerPort, m.HostIP))
+	}
+	return problems
+}
+
+// protocol returns the mapping's protocol, tcp if unset
+func (m *PortMapping) protocol() string {
+	if m.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(m.Protocol)
+}
+
+// ipv6 reports whether the mapping forwards to an IPv6 address
+func (m *PortMapping) ipv6() bool {
+	return m.ContainerIP.To4() == nil
+}
+
+// destination returns the address and port connections are forwarded to
+func (m *PortMapping) destination() string {
+	return net.JoinHostPort(m.ContainerIP.String(), strconv.Itoa(m.ContainerPort))
+}
+
+// hairpinSources returns the sources whose forwarded connections must be
+// masqueraded, or the container would answer them directly rather than
+// through the node that forwarded them: the containers of its subnet, the
+// container itself included, and the node's loopback addresses
+func (m *PortMapping) hairpinSources() []string {
+	var sources []string
+	if m.Subnet != "" {
+		sources = append(sources, m.Subnet)
+	}
+	if !m.ipv6() {
+		sources = append(sources, loopbackNet)
+	}
+	return sources
+}
+
+// ExpandPortMappings binds the mappings to the container's addresses: each
+// one to every address of the family of its host IP, or of both families
+// if it has none. The addresses come with the prefix length of their
+// subnet.
+func ExpandPortMappings(mappings []PortMapping, containerIPs []net.IPNet) []PortMapping {
+	var expanded []PortMapping
+	for _, m := range mappings {
+		hostIP := net.ParseIP(m.HostIP)
+		for _, ip := range containerIPs {
+			if hostIP != nil && (hostIP.To4() == nil) != (ip.IP.To4() == nil) {
+				continue
+			}
+			m := m
+			m.Protocol = m.protocol()
+			m.ContainerIP = ip.IP
+			m.Subnet = (&net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}).String()
+			expanded = append(expanded, m)
+		}
+	}
+	return expanded
+}
+
+// NeedsLoopbackRouting reports whether any of the mappings forwards the
+// node's connections to 127.0.0.1, which takes loopback routing on the
+// device the container is behind
+func NeedsLoopbackRouting(mappings []PortMapping) bool {
+	return len(filterMappings(mappings, false)) > 0
+}
+
+// EnableLoopbackRouting has the device route packets from loopback
+// addresses, which the kernel drops as martians otherwise. The device's
+// setting is kept in the network's data directory first, for
+// RestoreLoopbackRouting; the loopback guard must be in place already.
+func EnableLoopbackRouting(dir, network, device string) error {
+	saved := loopbackRoutingFile(dir, network)
+	if _, err := os.Stat(saved); errors.Is(err, os.ErrNotExist) {
+		data, err := os.ReadFile(routeLocalnetFile(device))
+		if err != nil {
+			return fmt.Errorf("failed to read route_localnet of %s: %v", device, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(saved), 0755); err != nil {
+			return fmt.Errorf("failed to create port mapping directory: %v", err)
+		}
+		if err := os.WriteFile(saved, data, 0644); err != nil {
+			return fmt.Errorf("failed to save route_localnet of %s: %v", device, err)
+		}
+	}
+	if err := os.WriteFile(routeLocalnetFile(device), []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable route_localnet on %s: %v", device, err)
+	}
+	return nil
+}
+
+// RestoreLoopbackRouting returns the device's route_localnet to the setting
+// EnableLoopbackRouting found. It is idempotent, and leaves a device that is
+// gone alone.
+func RestoreLoopbackRouting(dir, network, device string) error {
+	saved := loopbackRoutingFile(dir, network)
+	data, err := os.ReadFile(saved)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read saved route_localnet of %s: %v", device, err)
+	}
+	if err := os.WriteFile(routeLocalnetFile(device), data, 0644); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to restore route_localnet on %s: %v", device, err)
+	}
+	if err := os.Remove(saved); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove saved route_localnet of %s: %v", device, err)
+	}
+	return nil
+}
+
+// LoopbackRouting reports whether the device routes packets from loopback
+// addresses
+func LoopbackRouting(device string) (bool, error) {
+	data, err := os.ReadFile(routeLocalnetFile(device))
+	if err != nil {
+		return false, fmt.Errorf("failed to read route_localnet of %s: %v", device, err)
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+// routeLocalnetFile returns the path of the device's route_localnet sysctl
+func routeLocalnetFile(device string) string {
+	return filepath.Join("/proc/sys/net/ipv4/conf", device, "route_localnet")
+}
+
+// loopbackRoutingFile returns the file holding the network's device's
+// route_localnet from before EnableLoopbackRouting
+func loopbackRoutingFile(dir, network string) string {
+	return filepath.Join(dir, portMappingsDir, networkHash(network)+".route_localnet")
+}
+
+// loopbackComment returns the comment marking a network's loopback guard
+func loopbackComment(network string) string {
+	return fmt.Sprintf("xvm-cni: %s loopback", network)
+}
+
+// filterMappings returns the mappings forwarding to one address family
+func filterMappings(mappings []PortMapping, ipv6 bool) []PortMapping {
+	var filtered []PortMapping
+	for _, m := range mappings {
+		if m.ipv6() == ipv6 {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// attachmentHash returns a stable short hash of a network's attachment, to
+// name its port mapping chains, tables and state file
+func attachmentHash(network, attachment string) string {
+	return networkHash(network + "/" + attachment)
+}
+
+// StoredPortMappings are the port mappings of an attachment as the plugin
+// installed them. They are kept in the network's data directory for the
+// agent to restore them once something resets the host's firewall rules.
+type StoredPortMappings struct {
+	Network    string        `json:"network"`
+	Attachment string        `json:"attachment"`
+	Backend    string        `json:"backend"`
+	Mappings   []PortMapping `json:"mappings"`
+}
+
+// portMappingsFile returns the file holding the attachment's port mappings
+// in the network's data directory
+func portMappingsFile(dir, network, attachment string) string {
+	return filepath.Join(dir, portMappingsDir, attachmentHash(network, attachment)+".json")
+}
+
+// SavePortMappings stores the port mappings of an attachment in the
+// network's data directory
+func SavePortMappings(dir string, s *StoredPortMappings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := portMappingsFile(dir, s.Network, s.Attachment)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create port mapping directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write port mappings: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write port mappings: %v", err)
+	}
+	return nil
+}
+
+// LoadPortMappings returns the port mappings stored in the network's data
+// directory, sorted by attachment
+func LoadPortMappings(dir, network string) ([]*StoredPortMappings, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, portMappingsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var stored []*StoredPortMappings
+	for _, path := range paths {
+		s, err := readPortMappings(path)
+		if err != nil {
+			return nil, err
+		}
+		// Networks without a name share the data directory
+		if s != nil && s.Network == network {
+			stored = append(stored, s)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Attachment < stored[j].Attachment })
+	return stored, nil
+}
+
+// LoadAttachmentPortMappings returns the port mappings stored for the
+// attachment, or nil if it has none
+func LoadAttachmentPortMappings(dir, network, attachment string) (*StoredPortMappings, error) {
+	return readPortMappings(portMappingsFile(dir, network, attachment))
+}
+
+// RemovePortMappings removes the attachment's port mappings from the
+// network's data directory. It is idempotent.
+func RemovePortMappings(dir, network, attachment string) error {
+	if err := os.Remove(portMappingsFile(dir, network, attachment)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove port mappings: %v", err)
+	}
+	return nil
+}
+
+// readPortMappings reads a port mapping file, returning nil if it doesn't
+// exist
+func readPortMappings(path string) (*StoredPortMappings, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read port mappings: %v", err)
+	}
+	s := &StoredPortMappings{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,183 @@
+//go:build linux
+// +build linux
+
+package fw
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandPortMappings(t *testing.T) {
+	ips := []net.IPNet{
+		{IP: net.ParseIP("10.244.0.5"), Mask: net.CIDRMask(16, 32)},
+		{IP: net.ParseIP("fd00::5"), Mask: net.CIDRMask(64, 128)},
+	}
+	mappings := ExpandPortMappings([]PortMapping{
+		{HostPort: 8080, ContainerPort: 80},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "UDP", HostIP: "192.168.1.10"},
+	}, ips)
+
+	// Mappings without a host IP forward to both families
+	if len(mappings) != 3 {
+		t.Fatalf("Expected 3 mappings, got %+v", mappings)
+	}
+	if mappings[0].Protocol != "tcp" || mappings[0].Subnet != "10.244.0.0/16" || mappings[1].destination() != "[fd00::5]:80" {
+		t.Fatalf("Unexpected mappings %+v", mappings)
+	}
+	if m := mappings[2]; m.Protocol != "udp" || m.destination() != "10.244.0.5:53" {
+		t.Fatalf("Unexpected mapping %+v", m)
+	}
+
+	if problems := (&PortMapping{HostPort: 0, ContainerPort: 80, Protocol: "icmp", HostIP: "nope"}).Validate(); len(problems) != 3 {
+		t.Fatalf("Expected port, protocol and host IP problems, got %v", problems)
+	}
+	if !NeedsLoopbackRouting(mappings) || NeedsLoopbackRouting(mappings[1:2]) {
+		t.Fatalf("Expected loopback routing for the IPv4 mappings only")
+	}
+}
+
+func TestPortMappingRules(t *testing.T) {
+	mappings := []PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", ContainerIP: net.ParseIP("10.244.0.5"), Subnet: "10.244.0.0/16"},
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "fd00:1::10", ContainerIP: net.ParseIP("fd00::5"), Subnet: "fd00::/64"},
+	}
+
+	var rules []string
+	for _, rule := range (&nftablesBackend{}).PortMappingRules("xvm-network", "c1/eth0", mappings) {
+		rules = append(rules, rule.Chain+": "+strings.Join(rule.Spec, " "))
+	}
+	want := []string{
+		`prerouting: meta nfproto ipv4 fib daddr type local tcp dport 8080 dnat ip to 10.244.0.5:80 comment "xvm-cni: xvm-network"`,
+		`prerouting: ip6 daddr fd00:1::10 tcp dport 8080 dnat ip6 to [fd00::5]:80 comment "xvm-cni: xvm-network"`,
+		`output: meta nfproto ipv4 fib daddr type local tcp dport 8080 dnat ip to 10.244.0.5:80 comment "xvm-cni: xvm-network"`,
+		`output: ip6 daddr fd00:1::10 tcp dport 8080 dnat ip6 to [fd00::5]:80 comment "xvm-cni: xvm-network"`,
+		// The node's connections to ::1 aren't forwarded
+		`postrouting: ip saddr 10.244.0.0/16 ip daddr 10.244.0.5 tcp dport 80 ct status dnat masquerade comment "xvm-cni: xvm-network"`,
+		`postrouting: ip saddr 127.0.0.0/8 ip daddr 10.244.0.5 tcp dport 80 ct status dnat masquerade comment "xvm-cni: xvm-network"`,
+		`postrouting: ip6 saddr fd00::/64 ip6 daddr fd00::5 tcp dport 80 ct status dnat masquerade comment "xvm-cni: xvm-network"`,
+	}
+	if strings.Join(rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected nftables rules:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(rules, "\n"))
+	}
+
+	// iptables rules come per family, each with the jumps to its chain
+	chain := HostPortChainName("xvm-network", "c1/eth0")
+	hairpin := HairpinChainName("xvm-network", "c1/eth0")
+	for _, name := range []string{chain, hairpin} {
+		if len(name) > 28 || name == HostPortChainName("xvm-network", "c1/eth1") || name == HairpinChainName("xvm-network", "c1/eth1") {
+			t.Fatalf("Chain name %s is too long or not unique", name)
+		}
+	}
+	iptRules := (&iptablesBackend{}).PortMappingRules("xvm-network", "c1/eth0", mappings)
+	// IPv4: a DNAT rule, two hairpin rules and three jumps; IPv6: a DNAT
+	// rule, one hairpin rule and three jumps
+	if len(iptRules) != 11 {
+		t.Fatalf("Expected 11 rules, got %+v", iptRules)
+	}
+	if spec := strings.Join(iptRules[0].Spec, " "); iptRules[0].Chain != chain || !strings.HasSuffix(spec, "-j DNAT --to-destination 10.244.0.5:80") {
+		t.Fatalf("Unexpected rule %s: %s", iptRules[0].Chain, spec)
+	}
+	if spec := strings.Join(iptRules[2].Spec, " "); iptRules[2].Chain != hairpin || !strings.HasPrefix(spec, "-s 127.0.0.0/8 -d 10.244.0.5 -p tcp --dport 80") {
+		t.Fatalf("Unexpected hairpin rule %s: %s", iptRules[2].Chain, spec)
+	}
+	if iptRules[3].Chain != "PREROUTING" || iptRules[4].Chain != "OUTPUT" || iptRules[5].Chain != "POSTROUTING" {
+		t.Fatalf("Expected the jumps after the chains' rules, got %+v", iptRules[3:6])
+	}
+}
+
+func TestPortMappingStore(t *testing.T) {
+	dir := t.TempDir()
+	stored := &StoredPortMappings{
+		Network:    "xvm-network",
+		Attachment: "c1/eth0",
+		Backend:    BackendNFTables,
+		Mappings:   []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", ContainerIP: net.ParseIP("10.244.0.5")}},
+	}
+	if err := SavePortMappings(dir, stored); err != nil {
+		t.Fatalf("Failed to save port mappings: %v", err)
+	}
+	// Networks without a name share the directory
+	other := *stored
+	other.Network = "other-network"
+	if err := SavePortMappings(dir, &other); err != nil {
+		t.Fatalf("Failed to save port mappings: %v", err)
+	}
+
+	loaded, err := LoadPortMappings(dir, "xvm-network")
+	if err != nil || len(loaded) != 1 {
+		t.Fatalf("Expected the network's port mappings, got %v: %v", loaded, err)
+	}
+	if m := loaded[0].Mappings[0]; loaded[0].Attachment != "c1/eth0" || !m.ContainerIP.Equal(net.ParseIP("10.244.0.5")) {
+		t.Fatalf("Unexpected port mappings %+v", loaded[0])
+	}
+
+	// Removing is idempotent
+	for i := 0; i < 2; i++ {
+		if err := RemovePortMappings(dir, "xvm-network", "c1/eth0"); err != nil {
+			t.Fatalf("Failed to remove port mappings: %v", err)
+		}
+	}
+	if s, err := LoadAttachmentPortMappings(dir, "xvm-network", "c1/eth0"); s != nil || err != nil {
+		t.Fatalf("Expected no port mappings, got %+v: %v", s, err)
+	}
+}
+
+func TestLoopbackGuard(t *testing.T) {
+	var rules []string
+	for _, rule := range (&nftablesBackend{}).LoopbackGuardRules("xvm-network", "xbr-xvm-network") {
+		rules = append(rules, strings.Join(rule.Spec, " "))
+	}
+	want := []string{
+		`iifname "xbr-xvm-network" ip daddr 127.0.0.0/8 ct state established,related return comment "xvm-cni: xvm-network loopback"`,
+		`iifname "xbr-xvm-network" ip daddr 127.0.0.0/8 ct status dnat return comment "xvm-cni: xvm-network loopback"`,
+		`iifname "xbr-xvm-network" ip daddr 127.0.0.0/8 ip saddr != 127.0.0.0/8 drop comment "xvm-cni: xvm-network loopback"`,
+	}
+	if strings.Join(rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected nftables rules:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(rules, "\n"))
+	}
+
+	// The iptables drop is jumped to from INPUT last
+	chain := LoopbackChainName("xvm-network")
+	iptRules := (&iptablesBackend{}).LoopbackGuardRules("xvm-network", "xbr-xvm-network")
+	if len(iptRules) != 2 || iptRules[0].Chain != chain || iptRules[1].Chain != "INPUT" || iptRules[1].Spec[len(iptRules[1].Spec)-1] != chain {
+		t.Fatalf("Unexpected rules %+v", iptRules)
+	}
+	if spec := strings.Join(iptRules[0].Spec, " "); !strings.HasPrefix(spec, "-i xbr-xvm-network -d 127.0.0.0/8 ! -s 127.0.0.0/8 -m conntrack ! --ctstate RELATED,ESTABLISHED,DNAT ") || !strings.HasSuffix(spec, "-j DROP") {
+		t.Fatalf("Unexpected drop %s", spec)
+	}
+}
+
+func TestLoopbackRouting(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	dir := t.TempDir()
+	before, err := LoopbackRouting("lo")
+	if err != nil {
+		t.Fatalf("Failed to read route_localnet: %v", err)
+	}
+	if before {
+		t.Skip("Test requires route_localnet disabled on lo")
+	}
+	// Enabling twice keeps the setting from before the first time
+	for i := 0; i < 2; i++ {
+		if err := EnableLoopbackRouting(dir, "xvm-network", "lo"); err != nil {
+			t.Fatalf("Failed to enable route_localnet: %v", err)
+		}
+	}
+	if on, err := LoopbackRouting("lo"); err != nil || !on {
+		t.Fatalf("Expected route_localnet enabled, got %v: %v", on, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := RestoreLoopbackRouting(dir, "xvm-network", "lo"); err != nil {
+			t.Fatalf("Failed to restore route_localnet: %v", err)
+		}
+	}
+	if on, err := LoopbackRouting("lo"); err != nil || on {
+		t.Fatalf("Expected route_localnet restored, got %v: %v", on, err)
+	}
+}
@@ -0,0 +1,263 @@
+//go:build linux
+// +build linux
+
+// Package hoststate records which boot a network's host state was set up in
+// and the network namespaces of its attachments. The devices, addresses and
+// forwarding entries are gone after a reboot, but the allocations kept in
+// the data directory aren't; the record tells the attachments the reboot
+// took away, whose namespaces are gone as well, from those that survived,
+// so the former's addresses are released before the devices are restored.
+package hoststate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// stateFile is the file in the network's data directory holding the state
+const stateFile = "host-state.json"
+
+// journalFile is the file next to the state file holding the attachments
+// recorded since it was written, one record per line
+const journalFile = stateFile + ".journal"
+
+// compactionThreshold is how many attachments are journaled at least before
+// the journal is folded into the state file. Past it, the journal is
+// compacted once it has as many records as there are attachments.
+var compactionThreshold = 1024
+
+// bootIDFile holds the kernel's random ID of the current boot, replaced in
+// tests
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// State is the host state of a network as the plugin recorded it
+type State struct {
+	Network string `json:"network"`
+	// BootID is the boot the network's devices were last set up in
+	BootID string `json:"bootID"`
+	// Attachments maps the attachments' keys to the paths of their network
+	// namespaces, "" for the ports of VM runtimes living on the host
+	Attachments map[string]string `json:"attachments"`
+	// FloodPeers are the peers the network's VXLAN device was last set up
+	// to replicate to
+	FloodPeers []string `json:"floodPeers,omitempty"`
+	// ProxyARP holds the values the proxy ARP sysctls of the network's
+	// devices had before the plugin set them, by "<device>/<table>/<name>"
+	ProxyARP map[string]string `json:"proxyARP,omitempty"`
+
+	// snapshotted tells whether the state file holds the network's state,
+	// which the journal's records apply to
+	snapshotted bool
+	// journaled counts the records in the journal
+	journaled int
+}
+
+// record is a journal entry, setting the network namespace of an attachment
+type record struct {
+	Key   string `json:"key"`
+	Netns string `json:"netns"`
+}
+
+// BootID returns the ID of the current boot
+func BootID() (string, error) {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read boot ID: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Load reads the network's state from its data directory, replaying the
+// journal over the state file, or returns an empty one if none was recorded
+func Load(dir, network string) (*State, error) {
+	s := &State{Network: network, Attachments: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host state: %v", err)
+	}
+	stored := &State{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filepath.Join(dir, stateFile), err)
+	}
+	// Networks without a name share the data directory
+	if stored.Network != network {
+		return s, nil
+	}
+	if stored.Attachments == nil {
+		stored.Attachments = make(map[string]string)
+	}
+	stored.snapshotted = true
+	if err := stored.replayJournal(dir); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// replayJournal applies the records of the journal, if any
+func (s *State) replayJournal(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read host state journal: %v", err)
+	}
+	// A record without its newline is being appended, or was cut short by
+	// a crash, and hasn't taken effect. It's skipped without touching the
+	// file; the next append cuts it.
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("failed to parse host state journal: %v", err)
+		}
+		s.Attachments[r.Key] = r.Netns
+		s.journaled++
+	}
+	return nil
+}
+
+// Attach records the attachment's network namespace. It's appended to the
+// journal rather than rewriting the state file, which ADD would otherwise
+// do every time, unless the journal has grown enough to be compacted.
+func (s *State) Attach(dir, key, netns string) error {
+	s.Attachments[key] = netns
+	if !s.snapshotted || s.journaled+1 >= max(compactionThreshold, len(s.Attachments)) {
+		return s.Save(dir)
+	}
+	data, err := json.Marshal(record{Key: key, Netns: netns})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open host state journal: %v", err)
+	}
+	err = cutTornRecord(f)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write host state journal: %v", err)
+	}
+	s.journaled++
+	return nil
+}
+
+// cutTornRecord truncates the journal to its last complete record, so a
+// record a crash cut short doesn't run into the next one. Only writers, who
+// hold the network lock, call it, so no append is in progress.
+func cutTornRecord(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+}
+
+// Save writes the state to the network's data directory, replacing the
+// state file and emptying the journal
+func (s *State) Save(dir string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	path := filepath.Join(dir, stateFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write host state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write host state: %v", err)
+	}
+	s.snapshotted = true
+	// The file holds everything the journal did
+	if err := os.Remove(filepath.Join(dir, journalFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove host state journal: %v", err)
+	}
+	s.journaled = 0
+	return nil
+}
+
+// Rebooted reports whether the node rebooted since the state was recorded
+func (s *State) Rebooted(bootID string) bool {
+	return s.BootID != "" && s.BootID != bootID
+}
+
+// Stale returns the keys of the attachments whose network namespace is
+// gone, sorted. VM ports are gone with a reboot regardless, so they're
+// stale after one.
+func (s *State) Stale() []string {
+	var stale []string
+	for key, netns := range s.Attachments {
+		if netns == "" {
+			stale = append(stale, key)
+			continue
+		}
+		if _, err := os.Stat(netns); err != nil {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Release releases the addresses of an attachment, removes its port
+// mappings, with every firewall backend as firewalld keeps them across
+// reboots, and forgets the attachment
+func (s *State) Release(dir, key string, ipams []*ipam.IPAM) error {
+	for _, i := range ipams {
+		if err := i.Release(key); err != nil {
+			return fmt.Errorf("failed to release addresses of %s: %v", key, err)
+		}
+	}
+	stored, err := fw.LoadAttachmentPortMappings(dir, s.Network, key)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		for _, backend := range fw.Available() {
+			if err := backend.TeardownPortMappings(s.Network, key); err != nil {
+				return fmt.Errorf("failed to remove port mappings of %s: %v", key, err)
+			}
+		}
+		if err := fw.RemovePortMappings(dir, s.Network, key); err != nil {
+			return err
+		}
+	}
+	delete(s.Attachments, key)
+	return nil
+}
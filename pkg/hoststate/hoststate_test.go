@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package hoststate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+func TestLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Load(dir, "xvm-network")
+	if err != nil {
+		t.Fatalf("Failed to load missing state: %v", err)
+	}
+	if s.BootID != "" || len(s.Attachments) != 0 {
+		t.Fatalf("Expected empty state, got %+v", s)
+	}
+
+	s.BootID = "boot-a"
+	s.Attachments["ctr-a/eth0"] = "/var/run/netns/cni-a"
+	if err := s.Save(dir); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	loaded, err := Load(dir, "xvm-network")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, s) {
+		t.Fatalf("Expected %+v, got %+v", s, loaded)
+	}
+
+	// The state of another network sharing the directory isn't taken
+	if other, err := Load(dir, "other-network"); err != nil || len(other.Attachments) != 0 {
+		t.Fatalf("Expected empty state for other network, got %+v, err %v", other, err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Load(dir, "xvm-network")
+	s.BootID = "boot-a"
+	// Without a state file to apply to, the attachment is saved in one
+	if err := s.Attach(dir, "ctr-a/eth0", "/var/run/netns/cni-a"); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no journal before the state file, got err %v", err)
+	}
+	if err := s.Attach(dir, "ctr-b/eth0", "/var/run/netns/cni-b"); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); err != nil {
+		t.Fatalf("Expected the attachment journaled: %v", err)
+	}
+	loaded, err := Load(dir, "xvm-network")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Attachments, s.Attachments) || loaded.BootID != "boot-a" {
+		t.Fatalf("Expected %+v, got %+v", s, loaded)
+	}
+
+	// A torn record is skipped, and cut by the next append
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"key":"ctr-c/eth0","ne`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	loaded, err = Load(dir, "xvm-network")
+	if err != nil {
+		t.Fatalf("Failed to load state with torn record: %v", err)
+	}
+	if _, ok := loaded.Attachments["ctr-c/eth0"]; ok || len(loaded.Attachments) != 2 {
+		t.Fatalf("Expected the torn record skipped, got %v", loaded.Attachments)
+	}
+	if err := loaded.Attach(dir, "ctr-d/eth0", "/var/run/netns/cni-d"); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	if loaded, err = Load(dir, "xvm-network"); err != nil || len(loaded.Attachments) != 3 {
+		t.Fatalf("Expected 3 attachments after the torn record was cut, got %v, err %v", loaded.Attachments, err)
+	}
+
+	// Saving folds the journal into the state file
+	if err := loaded.Save(dir); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the journal removed, got err %v", err)
+	}
+	if saved, err := Load(dir, "xvm-network"); err != nil || !reflect.DeepEqual(saved.Attachments, loaded.Attachments) {
+		t.Fatalf("Expected %v, got %v, err %v", loaded.Attachments, saved.Attachments, err)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	defer func(n int) { compactionThreshold = n }(compactionThreshold)
+	compactionThreshold = 3
+	dir := t.TempDir()
+	s, _ := Load(dir, "xvm-network")
+	if err := s.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"ctr-a/eth0", "ctr-b/eth0", "ctr-c/eth0"} {
+		if err := s.Attach(dir, key, ""); err != nil {
+			t.Fatalf("Failed to attach: %v", err)
+		}
+		_, err := os.Stat(filepath.Join(dir, journalFile))
+		if compacted := os.IsNotExist(err); compacted != (i == 2) {
+			t.Fatalf("Unexpected compaction state %v after %d records", compacted, i+1)
+		}
+	}
+	loaded, err := Load(dir, "xvm-network")
+	if err != nil || len(loaded.Attachments) != 3 {
+		t.Fatalf("Expected 3 attachments, got %v, err %v", loaded.Attachments, err)
+	}
+}
+
+func TestRebootedStale(t *testing.T) {
+	dir := t.TempDir()
+	bootIDFile = filepath.Join(dir, "boot_id")
+	defer func() { bootIDFile = "/proc/sys/kernel/random/boot_id" }()
+	if err := os.WriteFile(bootIDFile, []byte("boot-b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bootID, err := BootID()
+	if err != nil || bootID != "boot-b" {
+		t.Fatalf("Expected boot ID boot-b, got %q, err %v", bootID, err)
+	}
+
+	netns := filepath.Join(dir, "cni-kept")
+	if err := os.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &State{Network: "xvm-network", Attachments: map[string]string{
+		"ctr-a/eth0": netns,
+		"ctr-b/eth0": filepath.Join(dir, "cni-gone"),
+		"vm-c/eth0":  "",
+	}}
+	if s.Rebooted(bootID) {
+		t.Fatalf("Expected state without boot ID not to count as rebooted")
+	}
+	s.BootID = "boot-a"
+	if !s.Rebooted(bootID) {
+		t.Fatalf("Expected reboot to be detected")
+	}
+	if stale := s.Stale(); !reflect.DeepEqual(stale, []string{"ctr-b/eth0", "vm-c/eth0"}) {
+		t.Fatalf("Unexpected stale attachments %v", stale)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	dir := t.TempDir()
+	i, err := ipam.New(&ipam.Config{Subnet: "10.244.0.0/24", Gateway: "10.244.0.1", DataDir: dir, Network: "xvm-network"})
+	if err != nil {
+		t.Fatalf("Failed to create IPAM: %v", err)
+	}
+	if _, err := i.Allocate("ctr-b/eth0"); err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	s := &State{Network: "xvm-network", Attachments: map[string]string{"ctr-b/eth0": "/var/run/netns/cni-b"}}
+	if err := s.Release(ipam.NetworkDir(dir, "xvm-network"), "ctr-b/eth0", []*ipam.IPAM{i}); err != nil {
+		t.Fatalf("Failed to release: %v", err)
+	}
+	if i.Count() != 0 || len(s.Attachments) != 0 {
+		t.Fatalf("Expected attachment released and forgotten, got %d allocations, %v", i.Count(), s.Attachments)
+	}
+}
@@ -1,28 +1,143 @@
 package ipam
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
 )
 
+var (
+	// ErrExhausted is returned when the subnet has no free addresses left
+	ErrExhausted = errors.New("no available IP addresses in subnet")
+	// ErrConflict is returned when a requested address is already allocated
+	ErrConflict = errors.New("IP address already allocated")
+	// ErrOutOfRange is returned when a requested address can't be allocated
+	// from the subnet
+	ErrOutOfRange = errors.New("IP address not allocatable from subnet")
+)
+
 // IPAM represents the IP Address Management system
 type IPAM struct {
 	Subnet     *net.IPNet
 	Gateway    net.IP
 	Allocations map[string]net.IP
+	Owners     map[string]Owner
+	// Range, if set, restricts the addresses handed out from the subnet
+	Range      *Range
 	mutex      sync.Mutex
 	dataDir    string
+	file       string
+	// journaled counts the records appended to the journal since the
+	// allocations file was last written
+	journaled int
+	// snapshotted is set once the allocations file exists
+	snapshotted bool
+}
+
+// Owner identifies the pod an allocation belongs to
+type Owner struct {
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+}
+
+// IsEmpty returns true if no pod identity is known
+func (o Owner) IsEmpty() bool {
+	return o == Owner{}
+}
+
+// Range is the part of the subnet an allocation is made from: the addresses
+// of Include, or of the whole subnet if nil, outside every one of Exclude
+type Range struct {
+	Include *net.IPNet
+	Exclude []*net.IPNet
+}
+
+// Contains reports whether ip is in the range. A nil range holds every
+// address.
+func (r *Range) Contains(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	if r.Include != nil && !r.Include.Contains(ip) {
+		return false
+	}
+	for _, excluded := range r.Exclude {
+		if excluded.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocation is the on-disk record of a single allocation
+type allocation struct {
+	IP    string `json:"ip"`
+	Owner *Owner `json:"owner,omitempty"`
+}
+
+// UnmarshalJSON accepts both allocation records and the plain IP strings
+// written by earlier versions
+func (a *allocation) UnmarshalJSON(data []byte) error {
+	var ip string
+	if err := json.Unmarshal(data, &ip); err == nil {
+		a.IP = ip
+		return nil
+	}
+
+	type record allocation
+	return json.Unmarshal(data, (*record)(a))
+}
+
+// record is a journal entry, setting the allocation of an ID or, without an
+// IP, releasing it
+type record struct {
+	ID    string `json:"id"`
+	IP    string `json:"ip,omitempty"`
+	Owner *Owner `json:"owner,omitempty"`
 }
 
+// compactionThreshold is how many journal records are appended at least
+// before the journal is folded into the allocations file. Past it, the
+// journal is compacted once it has as many records as there are
+// allocations, so rewriting the file stays amortized over the changes.
+var compactionThreshold = 1024
+
+// DefaultDataDir holds the allocations unless configured otherwise
+const DefaultDataDir = "/var/lib/cni/xvm-cni"
+
 // Config represents the IPAM configuration
 type Config struct {
 	Subnet  string `json:"subnet"`
 	Gateway string `json:"gateway"`
 	DataDir string `json:"dataDir"`
+	// Network is the name of the network, whose allocations are kept in a
+	// directory of their own under DataDir, apart from other networks'
+	Network string `json:"network,omitempty"`
+}
+
+// NetworkDir returns the directory the state of the named network is kept
+// in, or dataDir itself for networks without a name
+func NetworkDir(dataDir, network string) string {
+	if network == "" {
+		return dataDir
+	}
+	return filepath.Join(dataDir, network)
+}
+
+// LockFile returns the path of the lock the plugin takes while changing the
+// named network, or the network of the VXLAN ID for networks without a name
+func LockFile(dataDir, network string, vxlanID int) string {
+	if network == "" {
+		return filepath.Join(dataDir, fmt.Sprintf("vni%d.lock", vxlanID))
+	}
+	return filepath.Join(NetworkDir(dataDir, network), "network.lock")
 }
 
 // New creates a new IPAM instance
@@ -38,29 +153,67 @@ func New(config *Config) (*IPAM, error) {
 	}
 
 	// Create data directory if it doesn't exist
-	dataDir := config.DataDir
-	if dataDir == "" {
-		dataDir = "/var/lib/cni/xvm-cni"
+	sharedDir := config.DataDir
+	if sharedDir == "" {
+		sharedDir = DefaultDataDir
 	}
+	dataDir := NetworkDir(sharedDir, config.Network)
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
+	// Keep IPv6 allocations apart from the IPv4 ones
+	file := "allocations.json"
+	if subnet.IP.To4() == nil {
+		file = "allocations6.json"
+	}
+
 	ipam := &IPAM{
 		Subnet:     subnet,
 		Gateway:    gateway,
 		Allocations: make(map[string]net.IP),
+		Owners:     make(map[string]Owner),
 		dataDir:    dataDir,
+		file:       filepath.Join(dataDir, file),
 	}
 
 	// Load existing allocations
 	if err := ipam.loadAllocations(); err != nil {
 		return nil, err
 	}
+	if !ipam.snapshotted && ipam.journaled == 0 && dataDir != sharedDir {
+		if err := ipam.adopt(filepath.Join(sharedDir, file)); err != nil {
+			return nil, err
+		}
+	}
 
 	return ipam, nil
 }
 
+// adopt takes over the allocations from the subnet kept in the shared data
+// directory by earlier versions. They are saved in the network's directory
+// with the first change, leaving the shared file to other networks.
+func (i *IPAM) adopt(file string) error {
+	shared := &IPAM{
+		Allocations: make(map[string]net.IP),
+		Owners:      make(map[string]Owner),
+		file:        file,
+	}
+	if err := shared.loadAllocations(); err != nil {
+		return err
+	}
+	for id, ip := range shared.Allocations {
+		if !i.Subnet.Contains(ip) {
+			continue // Another network's
+		}
+		i.Allocations[id] = ip
+		if owner, ok := shared.Owners[id]; ok {
+			i.Owners[id] = owner
+		}
+	}
+	return nil
+}
+
 // Allocate allocates an IP address for the given container ID
 func (i *IPAM) Allocate(containerID string) (net.IP, error) {
 	i.mutex.Lock()
@@ -79,13 +232,97 @@ func (i *IPAM) Allocate(containerID string) (net.IP, error) {
 
 	// Save the allocation
 	i.Allocations[containerID] = ip
-	if err := i.saveAllocations(); err != nil {
+	if err := i.journal(i.record(containerID)); err != nil {
 		return nil, err
 	}
 
 	return ip, nil
 }
 
+// AllocateIP allocates the requested IP address for the given container ID
+func (i *IPAM) AllocateIP(containerID string, ip net.IP) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	allocated, err := i.checkAvailable(containerID, ip)
+	if err != nil || allocated {
+		return err
+	}
+
+	// Save the allocation
+	i.Allocations[containerID] = ip
+	if err := i.journal(i.record(containerID)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Preview returns the address Allocate would assign to the given container
+// ID, or AllocateIP if ip is set, without saving the allocation
+func (i *IPAM) Preview(containerID string, ip net.IP) (net.IP, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if ip != nil {
+		if _, err := i.checkAvailable(containerID, ip); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+	if ip, ok := i.Allocations[containerID]; ok {
+		return ip, nil
+	}
+	return i.findAvailableIP()
+}
+
+// checkAvailable checks that the address can be allocated to the given
+// container ID, and reports whether it already is
+func (i *IPAM) checkAvailable(containerID string, ip net.IP) (bool, error) {
+	// Check that the address is usable in the subnet
+	if !i.Subnet.Contains(ip) || ip.Equal(i.Subnet.IP) || ip.Equal(i.Gateway) {
+		return false, fmt.Errorf("%w: %s", ErrOutOfRange, ip)
+	}
+	if !i.Range.Contains(ip) {
+		return false, fmt.Errorf("%w: %s is outside the allocation range", ErrOutOfRange, ip)
+	}
+
+	// Check that no other container holds the address
+	for id, allocatedIP := range i.Allocations {
+		if ip.Equal(allocatedIP) {
+			if id == containerID {
+				return true, nil // Already allocated to this container
+			}
+			return false, fmt.Errorf("%w: %s", ErrConflict, ip)
+		}
+	}
+	if _, ok := i.Allocations[containerID]; ok {
+		return false, fmt.Errorf("%w: container %s already has a different address", ErrConflict, containerID)
+	}
+	return false, nil
+}
+
+// SetOwner records the pod identity of the given container's allocation
+func (i *IPAM) SetOwner(containerID string, owner Owner) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	// Check if container has an allocation
+	if _, ok := i.Allocations[containerID]; !ok {
+		return fmt.Errorf("no allocation for container %s", containerID)
+	}
+	if i.Owners[containerID] == owner {
+		return nil // Nothing changed
+	}
+
+	i.Owners[containerID] = owner
+	if err := i.journal(i.record(containerID)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Release releases the IP address for the given container ID
 func (i *IPAM) Release(containerID string) error {
 	i.mutex.Lock()
@@ -98,32 +335,75 @@ func (i *IPAM) Release(containerID string) error {
 
 	// Remove the allocation
 	delete(i.Allocations, containerID)
-	if err := i.saveAllocations(); err != nil {
+	delete(i.Owners, containerID)
+	if err := i.journal(record{ID: containerID}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// findAvailableIP finds an available IP address in the subnet
-func (i *IPAM) findAvailableIP() (net.IP, error) {
-	// Start from the first IP in the subnet
-	ip := make(net.IP, len(i.Subnet.IP))
-	copy(ip, i.Subnet.IP)
+// ReleaseStale releases every allocation from the subnet whose ID is not in
+// valid and returns the released allocations
+func (i *IPAM) ReleaseStale(valid map[string]bool) (map[string]net.IP, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	released := make(map[string]net.IP)
+	for id, ip := range i.Allocations {
+		// Leave allocations of other networks sharing the data directory alone
+		if !valid[id] && i.Subnet.Contains(ip) {
+			released[id] = ip
+		}
+	}
+	if len(released) == 0 {
+		return released, nil // Nothing to release
+	}
+
+	// Remove the stale allocations
+	records := make([]record, 0, len(released))
+	for id := range released {
+		delete(i.Allocations, id)
+		delete(i.Owners, id)
+		records = append(records, record{ID: id})
+	}
+	if err := i.journal(records...); err != nil {
+		return nil, err
+	}
+
+	return released, nil
+}
+
+// Count returns the number of allocations from the subnet
+func (i *IPAM) Count() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
 
-	// Increment to the first usable IP (network address + 1)
-	inc(ip)
+	count := 0
+	for _, ip := range i.Allocations {
+		if i.Subnet.Contains(ip) {
+			count++
+		}
+	}
+	return count
+}
 
-	// Skip the gateway IP
-	if ip.Equal(i.Gateway) {
-		inc(ip)
+// findAvailableIP finds an available IP address in the range, or the
+// subnet
+func (i *IPAM) findAvailableIP() (net.IP, error) {
+	// Start from the first IP of the range
+	pool := i.Subnet
+	if i.Range != nil && i.Range.Include != nil {
+		pool = i.Range.Include
 	}
+	ip := make(net.IP, len(pool.IP))
+	copy(ip, pool.IP)
 
 	// Check each IP until we find an available one
-	for {
-		// Check if IP is in subnet
-		if !i.Subnet.Contains(ip) {
-			return nil, fmt.Errorf("no available IP addresses in subnet")
+	for ; pool.Contains(ip); inc(ip) {
+		// Skip the network address, the gateway and excluded IPs
+		if ip.Equal(i.Subnet.IP) || ip.Equal(i.Gateway) || !i.Range.Contains(ip) {
+			continue
 		}
 
 		// Check if IP is already allocated
@@ -138,13 +418,8 @@ func (i *IPAM) findAvailableIP() (net.IP, error) {
 		if !allocated {
 			return ip, nil
 		}
-
-		// Try the next IP
-		inc(ip)
-		if ip.Equal(i.Gateway) {
-			inc(ip)
-		}
 	}
+	return nil, ErrExhausted
 }
 
 // inc increments the IP address
@@ -157,40 +432,168 @@ func inc(ip net.IP) {
 	}
 }
 
-// loadAllocations loads the IP allocations from disk
+// journalFile returns the path of the journal of changes made since the
+// allocations file was written
+func (i *IPAM) journalFile() string {
+	return i.file + ".journal"
+}
+
+// record returns the journal record of the ID's current allocation
+func (i *IPAM) record(id string) record {
+	r := record{ID: id, IP: i.Allocations[id].String()}
+	if owner, ok := i.Owners[id]; ok && !owner.IsEmpty() {
+		r.Owner = &owner
+	}
+	return r
+}
+
+// apply applies a journal record to the allocations
+func (i *IPAM) apply(r record) error {
+	if r.IP == "" {
+		delete(i.Allocations, r.ID)
+		delete(i.Owners, r.ID)
+		return nil
+	}
+	ip := net.ParseIP(r.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address in allocations: %s", r.IP)
+	}
+	i.Allocations[r.ID] = ip
+	delete(i.Owners, r.ID)
+	if r.Owner != nil {
+		i.Owners[r.ID] = *r.Owner
+	}
+	return nil
+}
+
+// loadAllocations loads the IP allocations from disk, replaying the journal
+// over the allocations file
 func (i *IPAM) loadAllocations() error {
-	file := filepath.Join(i.dataDir, "allocations.json")
-	data, err := os.ReadFile(file)
+	data, err := os.ReadFile(i.file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read allocations file: %v", err)
+	}
+	if err == nil {
+		i.snapshotted = true
+
+		allocations := make(map[string]allocation)
+		if err := json.Unmarshal(data, &allocations); err != nil {
+			return fmt.Errorf("failed to parse allocations file: %v", err)
+		}
+
+		// Convert string IPs to net.IP
+		for id, alloc := range allocations {
+			if net.ParseIP(alloc.IP) == nil {
+				return fmt.Errorf("invalid IP address in allocations: %s", alloc.IP)
+			}
+			if err := i.apply(record{ID: id, IP: alloc.IP, Owner: alloc.Owner}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return i.replayJournal()
+}
+
+// replayJournal applies the records of the journal, if any
+func (i *IPAM) replayJournal() error {
+	data, err := os.ReadFile(i.journalFile())
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // No allocations file yet
+			return nil // Nothing changed since the allocations file was written
 		}
-		return fmt.Errorf("failed to read allocations file: %v", err)
+		return fmt.Errorf("failed to read allocations journal: %v", err)
+	}
+
+	// A record without its newline is being appended, or was cut short by
+	// a crash, and hasn't taken effect. It's skipped without touching the
+	// file, as readers don't hold the network lock; the next append cuts it.
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("failed to parse allocations journal: %v", err)
+		}
+		if err := i.apply(r); err != nil {
+			return err
+		}
+		i.journaled++
 	}
 
-	allocations := make(map[string]string)
-	if err := json.Unmarshal(data, &allocations); err != nil {
-		return fmt.Errorf("failed to parse allocations file: %v", err)
+	return nil
+}
+
+// journal appends the records to the journal in a single write, compacting
+// it into the allocations file once it has grown enough
+func (i *IPAM) journal(records ...record) error {
+	if !i.snapshotted || i.journaled+len(records) >= max(compactionThreshold, len(i.Allocations)) {
+		return i.saveAllocations()
 	}
 
-	// Convert string IPs to net.IP
-	for id, ipStr := range allocations {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			return fmt.Errorf("invalid IP address in allocations: %s", ipStr)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("failed to marshal allocation: %v", err)
 		}
-		i.Allocations[id] = ip
 	}
 
+	f, err := os.OpenFile(i.journalFile(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open allocations journal: %v", err)
+	}
+	err = cutTornRecord(f)
+	if err == nil {
+		_, err = f.Write(buf.Bytes())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write allocations journal: %v", err)
+	}
+
+	i.journaled += len(records)
 	return nil
 }
 
-// saveAllocations saves the IP allocations to disk
+// cutTornRecord truncates the journal to its last complete record, so a
+// record a crash cut short doesn't run into the next one. Only writers, who
+// hold the network lock, call it, so no append is in progress.
+func cutTornRecord(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+}
+
+// saveAllocations saves the IP allocations to disk, replacing the
+// allocations file and emptying the journal
 func (i *IPAM) saveAllocations() error {
 	// Convert net.IP to string for JSON serialization
-	allocations := make(map[string]string)
+	allocations := make(map[string]allocation)
 	for id, ip := range i.Allocations {
-		allocations[id] = ip.String()
+		alloc := allocation{IP: ip.String()}
+		if owner, ok := i.Owners[id]; ok && !owner.IsEmpty() {
+			alloc.Owner = &owner
+		}
+		allocations[id] = alloc
 	}
 
 	data, err := json.Marshal(allocations)
@@ -198,10 +601,23 @@ func (i *IPAM) saveAllocations() error {
 		return fmt.Errorf("failed to marshal allocations: %v", err)
 	}
 
-	file := filepath.Join(i.dataDir, "allocations.json")
-	if err := os.WriteFile(file, data, 0644); err != nil {
+	// Write a new file in place of the old one, so a crash leaves either
+	// complete
+	tmp := i.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
 		return fmt.Errorf("failed to write allocations file: %v", err)
 	}
+	if err := os.Rename(tmp, i.file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write allocations file: %v", err)
+	}
+	i.snapshotted = true
+
+	// The file holds everything the journal did
+	if err := os.Remove(i.journalFile()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove allocations journal: %v", err)
+	}
+	i.journaled = 0
 
 	return nil
-}
\ No newline at end of file
+}
@@ -1,6 +1,8 @@
 package ipam
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -108,4 +110,501 @@ func TestIPAM(t *testing.T) {
 	if !ip3.Equal(ip1) {
 		t.Logf("Note: Released IP was not reused, this is acceptable but not optimal")
 	}
-}
\ No newline at end of file
+}
+
+func TestReleaseStale(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ipamInstance, err := New(&Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+
+	for _, id := range []string{"keep", "stale1", "stale2"} {
+		if _, err := ipamInstance.Allocate(id); err != nil {
+			t.Fatalf("Failed to allocate IP for %s: %v", id, err)
+		}
+	}
+
+	// Release everything except the valid container
+	released, err := ipamInstance.ReleaseStale(map[string]bool{"keep": true})
+	if err != nil {
+		t.Fatalf("Failed to release stale allocations: %v", err)
+	}
+	if len(released) != 2 {
+		t.Fatalf("Expected 2 released allocations, got %d", len(released))
+	}
+	if _, ok := ipamInstance.Allocations["keep"]; !ok {
+		t.Fatalf("Valid allocation was released")
+	}
+
+	// Verify the release was persisted
+	reloaded, err := New(&Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if len(reloaded.Allocations) != 1 {
+		t.Fatalf("Expected 1 persisted allocation, got %d", len(reloaded.Allocations))
+	}
+
+	// Allocations of another network sharing the data directory are kept
+	other, err := New(&Config{
+		Subnet:  "10.245.0.0/24",
+		Gateway: "10.245.0.1",
+		DataDir: tempDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	if _, err := other.Allocate("other"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if other.Count() != 1 {
+		t.Fatalf("Expected 1 allocation from the other subnet, got %d", other.Count())
+	}
+	if released, err := other.ReleaseStale(map[string]bool{"other": true}); err != nil || len(released) != 0 {
+		t.Fatalf("Expected only the other subnet's allocations to be considered, released %v: %v", released, err)
+	}
+}
+
+func TestAllocateIP(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ipamInstance, err := New(&Config{
+		Subnet:  "fd00:10:244::/64",
+		Gateway: "fd00:10:244::1",
+		DataDir: tempDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+
+	// Allocate a requested address
+	requested := net.ParseIP("fd00:10:244::20")
+	if err := ipamInstance.AllocateIP("container1", requested); err != nil {
+		t.Fatalf("Failed to allocate requested IP: %v", err)
+	}
+	if !ipamInstance.Allocations["container1"].Equal(requested) {
+		t.Fatalf("Requested IP was not recorded")
+	}
+
+	// Requesting it again for the same container is a no-op
+	if err := ipamInstance.AllocateIP("container1", requested); err != nil {
+		t.Fatalf("Repeated request failed: %v", err)
+	}
+
+	// Another container can't take it
+	if err := ipamInstance.AllocateIP("container2", requested); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected conflict, got %v", err)
+	}
+
+	// The gateway and addresses outside the subnet are rejected
+	if err := ipamInstance.AllocateIP("container2", net.ParseIP("fd00:10:244::1")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Expected out of range for gateway, got %v", err)
+	}
+	if err := ipamInstance.AllocateIP("container2", net.ParseIP("10.244.0.5")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Expected out of range for foreign address, got %v", err)
+	}
+
+	// IPv6 allocations are stored separately from IPv4 ones
+	if _, err := os.Stat(filepath.Join(tempDir, "allocations6.json")); err != nil {
+		t.Fatalf("IPv6 allocations file was not created: %v", err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ipamInstance, err := New(&Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	_, tenant, _ := net.ParseCIDR("10.244.0.0/30")
+	_, other, _ := net.ParseCIDR("10.244.0.128/25")
+
+	// The range skips the network address and the gateway
+	ipamInstance.Range = &Range{Include: tenant}
+	for _, want := range []string{"10.244.0.2", "10.244.0.3"} {
+		ip, err := ipamInstance.Allocate(want)
+		if err != nil || !ip.Equal(net.ParseIP(want)) {
+			t.Fatalf("Expected %s from the range, got %v, %v", want, ip, err)
+		}
+	}
+	if _, err := ipamInstance.Allocate("container3"); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Expected the range to be exhausted, got %v", err)
+	}
+	if err := ipamInstance.AllocateIP("container3", net.ParseIP("10.244.0.200")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Expected out of range for an address outside the range, got %v", err)
+	}
+
+	// Allocations outside the ranges skip them
+	ipamInstance.Range = &Range{Exclude: []*net.IPNet{tenant, other}}
+	ip, err := ipamInstance.Allocate("container3")
+	if err != nil || !ip.Equal(net.ParseIP("10.244.0.4")) {
+		t.Fatalf("Expected 10.244.0.4 outside the ranges, got %v, %v", ip, err)
+	}
+	if err := ipamInstance.AllocateIP("container4", net.ParseIP("10.244.0.200")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Expected out of range for an excluded address, got %v", err)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Start from an allocations file in the legacy format
+	legacy := []byte(`{"legacy":"10.244.0.2"}`)
+	if err := os.WriteFile(filepath.Join(tempDir, "allocations.json"), legacy, 0644); err != nil {
+		t.Fatalf("Failed to write legacy allocations: %v", err)
+	}
+
+	config := &Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	}
+	ipamInstance, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	if !ipamInstance.Allocations["legacy"].Equal(net.ParseIP("10.244.0.2")) {
+		t.Fatalf("Legacy allocation was not loaded")
+	}
+
+	// Record the pod owning a new allocation
+	if _, err := ipamInstance.Allocate("container1"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	owner := Owner{PodNamespace: "default", PodName: "web", PodUID: "1234"}
+	if err := ipamInstance.SetOwner("container1", owner); err != nil {
+		t.Fatalf("Failed to set owner: %v", err)
+	}
+	if err := ipamInstance.SetOwner("unknown", owner); err == nil {
+		t.Fatalf("Expected setting owner without allocation to fail")
+	}
+
+	// Verify the owner was persisted next to the allocation
+	reloaded, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if reloaded.Owners["container1"] != owner {
+		t.Fatalf("Expected owner %+v, got %+v", owner, reloaded.Owners["container1"])
+	}
+	if _, ok := reloaded.Owners["legacy"]; ok {
+		t.Fatalf("Legacy allocation should have no owner")
+	}
+
+	// Releasing drops the owner
+	if err := reloaded.Release("container1"); err != nil {
+		t.Fatalf("Failed to release IP: %v", err)
+	}
+	if _, ok := reloaded.Owners["container1"]; ok {
+		t.Fatalf("Owner was not removed on release")
+	}
+}
+
+func TestPreview(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := &Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	}
+	ipamInstance, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	if err := ipamInstance.AllocateIP("container1", net.ParseIP("10.244.0.2")); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+
+	// Previews pick the same address as an allocation would
+	ip, err := ipamInstance.Preview("container2", nil)
+	if err != nil {
+		t.Fatalf("Failed to preview IP: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.244.0.3")) {
+		t.Fatalf("Expected 10.244.0.3, got %s", ip)
+	}
+	if ip, _ := ipamInstance.Preview("container1", nil); !ip.Equal(net.ParseIP("10.244.0.2")) {
+		t.Fatalf("Expected existing allocation 10.244.0.2, got %s", ip)
+	}
+	if _, err := ipamInstance.Preview("container2", net.ParseIP("10.244.0.2")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected conflict, got: %v", err)
+	}
+
+	// Nothing is saved
+	if _, ok := ipamInstance.Allocations["container2"]; ok {
+		t.Fatalf("Preview saved an allocation")
+	}
+	reloaded, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if len(reloaded.Allocations) != 1 {
+		t.Fatalf("Expected 1 persisted allocation, got %d", len(reloaded.Allocations))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	threshold := compactionThreshold
+	compactionThreshold = 4
+	defer func() { compactionThreshold = threshold }()
+
+	config := &Config{
+		Subnet:  "10.244.0.0/24",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	}
+	ipamInstance, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	allocFile := filepath.Join(tempDir, "allocations.json")
+	journalFile := allocFile + ".journal"
+
+	// The first change writes the allocations file, later ones are appended
+	// to the journal
+	if _, err := ipamInstance.Allocate("container1"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if _, err := os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected no journal after the first allocation, got %v", err)
+	}
+	snapshot, _ := ioutil.ReadFile(allocFile)
+	if _, err := ipamInstance.Allocate("container2"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if err := ipamInstance.SetOwner("container2", Owner{PodNamespace: "default", PodName: "web"}); err != nil {
+		t.Fatalf("Failed to set owner: %v", err)
+	}
+	if err := ipamInstance.Release("container1"); err != nil {
+		t.Fatalf("Failed to release IP: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(allocFile); string(data) != string(snapshot) {
+		t.Fatalf("Allocations file was rewritten before compaction")
+	}
+
+	// Reloading replays the journal over the allocations file
+	reloaded, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if _, ok := reloaded.Allocations["container1"]; ok || len(reloaded.Allocations) != 1 {
+		t.Fatalf("Expected only container2's allocation, got %v", reloaded.Allocations)
+	}
+	if reloaded.Owners["container2"].PodName != "web" {
+		t.Fatalf("Owner was not replayed, got %+v", reloaded.Owners["container2"])
+	}
+
+	// A record cut short by a crash is dropped, and appending carries on
+	f, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	f.WriteString(`{"id":"container3","ip":"10.2`)
+	f.Close()
+	torn, _ := ioutil.ReadFile(journalFile)
+	reloaded, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance with a torn journal: %v", err)
+	}
+	if _, ok := reloaded.Allocations["container3"]; ok {
+		t.Fatalf("Torn record was applied")
+	}
+	// Loading leaves it to the writer, as it may still be appended
+	if data, _ := ioutil.ReadFile(journalFile); string(data) != string(torn) {
+		t.Fatalf("Loading changed the journal")
+	}
+
+	// Reaching the threshold folds the journal into the allocations file
+	if _, err := reloaded.Allocate("container3"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if _, err := os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected journal to be compacted, got %v", err)
+	}
+	reloaded, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if len(reloaded.Allocations) != 2 || reloaded.Owners["container2"].PodName != "web" {
+		t.Fatalf("Unexpected allocations after compaction: %v %v", reloaded.Allocations, reloaded.Owners)
+	}
+}
+
+func TestNetworkDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Allocations kept in the shared directory by earlier versions, for two
+	// networks
+	legacy := []byte(`{"old1":{"ip":"10.244.0.2","owner":{"podName":"web"}},"other":"10.245.0.2"}`)
+	if err := os.WriteFile(filepath.Join(tempDir, "allocations.json"), legacy, 0644); err != nil {
+		t.Fatalf("Failed to write legacy allocations: %v", err)
+	}
+
+	configA := &Config{Subnet: "10.244.0.0/24", Gateway: "10.244.0.1", DataDir: tempDir, Network: "net-a"}
+	configB := &Config{Subnet: "10.244.0.0/24", Gateway: "10.244.0.1", DataDir: tempDir, Network: "net-b"}
+	a, err := New(configA)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+
+	// The network takes over its allocations from the shared file
+	if !a.Allocations["old1"].Equal(net.ParseIP("10.244.0.2")) || a.Owners["old1"].PodName != "web" {
+		t.Fatalf("Legacy allocation was not adopted: %v %v", a.Allocations, a.Owners)
+	}
+	if _, ok := a.Allocations["other"]; ok {
+		t.Fatalf("Allocation of another subnet was adopted")
+	}
+	if err := a.Release("old1"); err != nil {
+		t.Fatalf("Failed to release IP: %v", err)
+	}
+	if _, err := a.Allocate("container1"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "net-a", "allocations.json")); err != nil {
+		t.Fatalf("Allocations were not saved in the network's directory: %v", err)
+	}
+
+	// Once saved, the network's directory is authoritative
+	a, err = New(configA)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if _, ok := a.Allocations["old1"]; ok || len(a.Allocations) != 1 {
+		t.Fatalf("Expected only container1's allocation, got %v", a.Allocations)
+	}
+
+	// Another network with the same subnet and data directory sees neither
+	// them nor changes to them, and its changes aren't seen either
+	b, err := New(configB)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	if _, ok := b.Allocations["container1"]; ok {
+		t.Fatalf("Network saw another network's allocation")
+	}
+	if err := b.AllocateIP("container2", net.ParseIP("10.244.0.9")); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	a, err = New(configA)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if _, ok := a.Allocations["container2"]; ok {
+		t.Fatalf("Network saw another network's allocation")
+	}
+}
+
+func TestJournalConcurrentReader(t *testing.T) {
+	tempDir := t.TempDir()
+	config := &Config{
+		Subnet:  "10.244.0.0/22",
+		Gateway: "10.244.0.1",
+		DataDir: tempDir,
+	}
+	writer, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create IPAM instance: %v", err)
+	}
+	journalFile := filepath.Join(tempDir, "allocations.json.journal")
+
+	// Readers, such as CHECK and xvmctl, load the allocations while a writer
+	// holding the network lock appends to the journal
+	const allocations = 500
+	done := make(chan struct{})
+	readerErr := make(chan error, 1)
+	go func() {
+		defer close(readerErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := New(config); err != nil {
+				readerErr <- err
+				return
+			}
+		}
+	}()
+	for n := 0; n < allocations; n++ {
+		if _, err := writer.Allocate(fmt.Sprintf("container%d", n)); err != nil {
+			t.Fatalf("Failed to allocate IP: %v", err)
+		}
+	}
+	close(done)
+	if err := <-readerErr; err != nil {
+		t.Fatalf("Reader failed: %v", err)
+	}
+
+	reloaded, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if len(reloaded.Allocations) != allocations {
+		t.Fatalf("Expected %d allocations, got %d", allocations, len(reloaded.Allocations))
+	}
+
+	// The writer cuts a torn record before appending the next one
+	f, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	f.WriteString(`{"id":"torn","ip":"10.2`)
+	f.Close()
+	if _, err := writer.Allocate("last"); err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	reloaded, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reload IPAM instance: %v", err)
+	}
+	if _, ok := reloaded.Allocations["last"]; !ok || len(reloaded.Allocations) != allocations+1 {
+		t.Fatalf("Expected the record after the torn one to be replayed, got %d allocations", len(reloaded.Allocations))
+	}
+}
@@ -0,0 +1,343 @@
+//go:build linux
+// +build linux
+
+// Package k8s is a minimal client of the Kubernetes API for the node
+// agent, covering the few resources it watches and updates
+package k8s
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials Kubernetes mounts into pods
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// watchTimeout has the API server end watches, so they are renewed
+	// before proxies on the way drop them
+	watchTimeout = 5 * time.Minute
+	// requestTimeout bounds requests other than watches
+	requestTimeout = 30 * time.Second
+)
+
+// ErrGone is returned by watches when the resource version is too old to
+// watch from; the caller lists again
+var ErrGone = errors.New("resource version expired")
+
+// Config holds how to reach and authenticate to the API server
+type Config struct {
+	// Server is the API server's URL
+	Server string
+	// CAFile or CAData verifies the API server's certificate; the system
+	// roots are used if both are empty
+	CAFile string
+	CAData []byte
+	// Insecure skips verifying the API server's certificate
+	Insecure bool
+	// Token is the bearer token, or TokenFile holds it, re-read for every
+	// request as Kubernetes rotates projected tokens
+	Token     string
+	TokenFile string
+	// CertFile and KeyFile, or CertData and KeyData, hold the client
+	// certificate to authenticate with instead of a token
+	CertFile string
+	KeyFile  string
+	CertData []byte
+	KeyData  []byte
+	// QPS and Burst limit the rate of requests, DefaultQPS and DefaultBurst
+	// if zero
+	QPS   float64
+	Burst int
+}
+
+// InClusterConfig returns the configuration of a pod's service account
+func InClusterConfig() (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	return &Config{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		CAFile:    serviceAccountDir + "/ca.crt",
+		TokenFile: serviceAccountDir + "/token",
+	}, nil
+}
+
+// Client makes requests to the API server
+type Client struct {
+	server    *url.URL
+	http      *http.Client
+	token     string
+	tokenFile string
+	limiter   *rateLimiter
+}
+
+// NewClient returns a client for the configured API server
+func NewClient(config *Config) (*Client, error) {
+	server, err := url.Parse(config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API server URL %q: %v", config.Server, err)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+	caPEM := config.CAData
+	if config.CAFile != "" {
+		if caPEM, err = os.ReadFile(config.CAFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+	}
+	if caPEM != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no CA certificates found")
+		}
+	}
+	certPEM, keyPEM := config.CertData, config.KeyData
+	if config.CertFile != "" {
+		if certPEM, err = os.ReadFile(config.CertFile); err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %v", err)
+		}
+	}
+	if config.KeyFile != "" {
+		if keyPEM, err = os.ReadFile(config.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read client key: %v", err)
+		}
+	}
+	if certPEM != nil || keyPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	qps, burst := config.QPS, config.Burst
+	if qps == 0 {
+		qps = DefaultQPS
+	}
+	if burst == 0 {
+		burst = DefaultBurst
+	}
+	return &Client{
+		server:    server,
+		http:      &http.Client{Transport: transport},
+		token:     config.Token,
+		tokenFile: config.TokenFile,
+		limiter:   newRateLimiter(qps, burst),
+	}, nil
+}
+
+// statusError is an error the API server answered with
+type statusError struct {
+	Code    int
+	Message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API server returned %d: %s", e.Code, e.Message)
+}
+
+// IsNotFound reports whether the API server answered that the object
+// doesn't exist
+func IsNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// IsStatus reports whether the error is an answer of the API server, rather
+// than a failure to reach it
+func IsStatus(err error) bool {
+	var se *statusError
+	return errors.As(err, &se)
+}
+
+// do sends a request once the rate limit allows it, and returns the response
+// if it succeeded
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (*http.Response, error) {
+	u := *c.server
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &statusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	return resp, nil
+}
+
+// getJSON decodes the response to a GET into v
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ListNodes returns the cluster's nodes and the resource version to watch
+// them from
+func (c *Client) ListNodes(ctx context.Context) (*NodeList, error) {
+	var list NodeList
+	if err := c.getJSON(ctx, "/api/v1/nodes", nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	return &list, nil
+}
+
+// NodeEvent is a change of a node seen by a watch
+type NodeEvent struct {
+	// Type is ADDED, MODIFIED, DELETED or BOOKMARK
+	Type string `json:"type"`
+	Node Node   `json:"object"`
+}
+
+// WatchNodes calls fn with the changes of nodes after the resource version
+// until the API server ends the watch, ctx is done, or fn fails. It returns
+// the resource version to continue from, and ErrGone if the caller has to
+// list the nodes again.
+func (c *Client) WatchNodes(ctx context.Context, resourceVersion string, fn func(NodeEvent) error) (string, error) {
+	return c.watch(ctx, "/api/v1/nodes", "node", resourceVersion, func(eventType string, object json.RawMessage) error {
+		event := NodeEvent{Type: eventType}
+		if err := json.Unmarshal(object, &event.Node); err != nil {
+			return fmt.Errorf("failed to decode node: %v", err)
+		}
+		return fn(event)
+	})
+}
+
+// watch calls fn with the type and object of the changes of the resources
+// at path after the resource version, as WatchNodes does for nodes
+func (c *Client) watch(ctx context.Context, path, what, resourceVersion string, fn func(string, json.RawMessage) error) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, query, "", nil)
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) && se.Code == http.StatusGone {
+			return resourceVersion, ErrGone
+		}
+		return resourceVersion, fmt.Errorf("failed to watch %ss: %w", what, err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var raw struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return resourceVersion, nil
+			}
+			return resourceVersion, fmt.Errorf("failed to read %s watch: %v", what, err)
+		}
+		if raw.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(raw.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, ErrGone
+			}
+			return resourceVersion, fmt.Errorf("%s watch failed: %s", what, status.Message)
+		}
+		var meta struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw.Object, &meta); err != nil {
+			return resourceVersion, fmt.Errorf("failed to decode %s: %v", what, err)
+		}
+		resourceVersion = meta.Metadata.ResourceVersion
+		if raw.Type == "BOOKMARK" {
+			continue
+		}
+		if err := fn(raw.Type, raw.Object); err != nil {
+			return resourceVersion, err
+		}
+	}
+}
+
+// AnnotateNode sets annotations of a node, leaving the others alone. An
+// empty value removes the annotation.
+func (c *Client) AnnotateNode(ctx context.Context, name string, annotations map[string]string) error {
+	values := make(map[string]interface{}, len(annotations))
+	for k, v := range annotations {
+		if v == "" {
+			values[k] = nil
+		} else {
+			values[k] = v
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": values},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodPatch, "/api/v1/nodes/"+url.PathEscape(name), nil, "application/merge-patch+json", patch)
+	if err != nil {
+		return fmt.Errorf("failed to annotate node %s: %w", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
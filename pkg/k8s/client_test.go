@@ -0,0 +1,189 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+	c, err := NewClient(&Config{Server: srv.URL, TokenFile: token})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return c
+}
+
+func TestListNodes(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"metadata": {"resourceVersion": "12"}, "items": [
+			{"metadata": {"name": "node-a"}, "spec": {"podCIDR": "10.244.1.0/24"},
+			 "status": {"addresses": [{"type": "Hostname", "address": "node-a"}, {"type": "InternalIP", "address": "192.168.1.11"}]}},
+			{"metadata": {"name": "node-b"}, "spec": {"podCIDRs": ["10.244.2.0/24", "fd00:2::/64", "invalid"]}}
+		]}`)
+	})
+	list, err := c.ListNodes(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list nodes: %v", err)
+	}
+	if list.Metadata.ResourceVersion != "12" || len(list.Items) != 2 {
+		t.Fatalf("Unexpected list: %+v", list)
+	}
+	a, b := &list.Items[0], &list.Items[1]
+	if cidrs := a.PodCIDRs(); len(cidrs) != 1 || cidrs[0].String() != "10.244.1.0/24" {
+		t.Fatalf("Expected podCIDR to be used without podCIDRs, got %v", cidrs)
+	}
+	if ip := a.InternalIP(false); ip.String() != "192.168.1.11" {
+		t.Fatalf("Expected InternalIP 192.168.1.11, got %v", ip)
+	}
+	if ip := a.InternalIP(true); ip != nil {
+		t.Fatalf("Expected no IPv6 InternalIP, got %v", ip)
+	}
+	if cidrs := b.PodCIDRs(); len(cidrs) != 2 {
+		t.Fatalf("Expected both valid pod CIDRs, got %v", cidrs)
+	}
+}
+
+func TestWatchNodes(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "1" {
+			t.Errorf("Expected a watch, got %s", r.URL)
+		}
+		switch r.URL.Query().Get("resourceVersion") {
+		case "12":
+			fmt.Fprintln(w, `{"type": "ADDED", "object": {"metadata": {"name": "node-c", "resourceVersion": "13"}}}`)
+			fmt.Fprintln(w, `{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "15"}}}`)
+			fmt.Fprintln(w, `{"type": "DELETED", "object": {"metadata": {"name": "node-a", "resourceVersion": "16"}}}`)
+		case "16":
+			fmt.Fprintln(w, `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`)
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	})
+
+	var events []NodeEvent
+	rv, err := c.WatchNodes(context.Background(), "12", func(e NodeEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch nodes: %v", err)
+	}
+	if rv != "16" {
+		t.Fatalf("Expected to continue from resource version 16, got %q", rv)
+	}
+	// Bookmarks only advance the resource version
+	if len(events) != 2 || events[0].Type != "ADDED" || events[1].Node.Metadata.Name != "node-a" {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+
+	// Expiry is reported in the stream by newer API servers, and as the
+	// response status by older ones
+	for _, rv := range []string{"16", "1"} {
+		if _, err := c.WatchNodes(context.Background(), rv, func(NodeEvent) error { return nil }); !errors.Is(err, ErrGone) {
+			t.Fatalf("Expected ErrGone watching from %s, got %v", rv, err)
+		}
+	}
+}
+
+func TestAnnotateNode(t *testing.T) {
+	var patch map[string]map[string]map[string]interface{}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/api/v1/nodes/node-a" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "message": "nodes \"node-b\" not found"}`)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &patch); err != nil {
+			t.Errorf("Invalid patch %s: %v", data, err)
+		}
+		fmt.Fprint(w, `{}`)
+	})
+
+	err := c.AnnotateNode(context.Background(), "node-a", map[string]string{"a": "1", "b": ""})
+	if err != nil {
+		t.Fatalf("Failed to annotate node: %v", err)
+	}
+	annotations := patch["metadata"]["annotations"]
+	if annotations["a"] != "1" {
+		t.Fatalf("Expected annotation a to be set, got %v", annotations)
+	}
+	// A merge patch removes keys set to null
+	if v, ok := annotations["b"]; !ok || v != nil {
+		t.Fatalf("Expected annotation b to be removed, got %v", annotations)
+	}
+
+	err = c.AnnotateNode(context.Background(), "node-b", map[string]string{"a": "1"})
+	if !IsNotFound(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestGetPod(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/web-0" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "message": "pods \"web-1\" not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"metadata": {"name": "web-0", "namespace": "default", "uid": "4d2c", "annotations": {"xvm-cni.dev/ip": "10.244.0.50"}}}`)
+	})
+
+	pod, err := c.GetPod(context.Background(), "default", "web-0")
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	if pod.Metadata.UID != "4d2c" || pod.Metadata.Annotations["xvm-cni.dev/ip"] != "10.244.0.50" {
+		t.Fatalf("Unexpected pod %+v", pod)
+	}
+	if _, err := c.GetPod(context.Background(), "default", "web-1"); !IsNotFound(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100, 2)
+	start := time.Now()
+	// The burst passes at once, then requests are spaced out
+	for i := 0; i < 4; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Fatalf("Expected 2 requests over the burst to wait 20ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newRateLimiter(0.001, 1)
+	l.wait(ctx)
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Fatalf("Expected cancellation while waiting, got %v", err)
+	}
+}
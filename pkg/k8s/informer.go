@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// minRetryInterval and maxRetryInterval bound the backoff between
+	// listing the nodes again after the API server failed
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+// NodeInformer caches the cluster's nodes, listing them once and then
+// following their changes with a watch, so readers don't make requests of
+// their own. Watches ended by the API server are resumed from the last
+// resource version rather than listing again.
+type NodeInformer struct {
+	*informer[Node]
+}
+
+// NewNodeInformer returns an informer calling onChange after every change
+// of the cached nodes, and onError, if not nil, with the failures it
+// retries
+func NewNodeInformer(client *Client, onChange func(), onError func(error)) *NodeInformer {
+	return &NodeInformer{&informer[Node]{
+		list: func(ctx context.Context) ([]Node, string, error) {
+			list, err := client.ListNodes(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			return list.Items, list.Metadata.ResourceVersion, nil
+		},
+		watch: func(ctx context.Context, rv string, fn func(string, *Node)) (string, error) {
+			return client.WatchNodes(ctx, rv, func(e NodeEvent) error {
+				fn(e.Type, &e.Node)
+				return nil
+			})
+		},
+		name:     func(n *Node) string { return n.Metadata.Name },
+		onChange: onChange,
+		onError:  onError,
+		objects:  make(map[string]*Node),
+	}}
+}
+
+// informer caches the objects of a resource for the informers of each kind
+type informer[T any] struct {
+	// list returns the objects and the resource version to watch from
+	list func(context.Context) ([]T, string, error)
+	// watch calls fn with the type and object of each change
+	watch func(context.Context, string, func(string, *T)) (string, error)
+	name  func(*T) string
+	// onChange is called after the cache changed, without holding its lock
+	onChange func()
+	// onError is called with the errors listing or watching
+	onError func(error)
+
+	mu      sync.RWMutex
+	objects map[string]*T
+	synced  bool
+}
+
+// Run keeps the cache up to date until ctx is done
+func (i *informer[T]) Run(ctx context.Context) {
+	backoff := minRetryInterval
+	for ctx.Err() == nil {
+		listed, err := i.listAndWatch(ctx)
+		if listed {
+			backoff = minRetryInterval
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if i.onError != nil {
+			i.onError(err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if backoff *= 2; backoff > maxRetryInterval {
+			backoff = maxRetryInterval
+		}
+	}
+}
+
+// listAndWatch lists the objects into the cache and watches them until the
+// watch fails. It reports whether listing succeeded, and returns nil when
+// the objects have to be listed again.
+func (i *informer[T]) listAndWatch(ctx context.Context) (bool, error) {
+	items, rv, err := i.list(ctx)
+	if err != nil {
+		return false, err
+	}
+	objects := make(map[string]*T, len(items))
+	for j := range items {
+		objects[i.name(&items[j])] = &items[j]
+	}
+	i.mu.Lock()
+	i.objects, i.synced = objects, true
+	i.mu.Unlock()
+	i.changed()
+
+	for ctx.Err() == nil {
+		rv, err = i.watch(ctx, rv, func(eventType string, object *T) {
+			i.mu.Lock()
+			if eventType == "DELETED" {
+				delete(i.objects, i.name(object))
+			} else {
+				i.objects[i.name(object)] = object
+			}
+			i.mu.Unlock()
+			i.changed()
+		})
+		if errors.Is(err, ErrGone) {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (i *informer[T]) changed() {
+	if i.onChange != nil {
+		i.onChange()
+	}
+}
+
+// HasSynced reports whether the objects were listed
+func (i *informer[T]) HasSynced() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.synced
+}
+
+// Get returns the cached object with the name, or nil. The object must not
+// be modified.
+func (i *informer[T]) Get(name string) *T {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.objects[name]
+}
+
+// List returns the cached objects sorted by name. The objects must not be
+// modified.
+func (i *informer[T]) List() []*T {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	objects := make([]*T, 0, len(i.objects))
+	for _, object := range i.objects {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(a, b int) bool { return i.name(objects[a]) < i.name(objects[b]) })
+	return objects
+}
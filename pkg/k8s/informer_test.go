@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNodeInformer(t *testing.T) {
+	var lists, watches int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			atomic.AddInt32(&lists, 1)
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "1"}, "items": [{"metadata": {"name": "node-a"}}, {"metadata": {"name": "node-b"}}]}`)
+			return
+		}
+		switch atomic.AddInt32(&watches, 1) {
+		case 1:
+			// The API server ends the watch after some changes
+			fmt.Fprintln(w, `{"type": "ADDED", "object": {"metadata": {"name": "node-c", "resourceVersion": "2"}}}`)
+			fmt.Fprintln(w, `{"type": "DELETED", "object": {"metadata": {"name": "node-a", "resourceVersion": "3"}}}`)
+		case 2:
+			if rv := r.URL.Query().Get("resourceVersion"); rv != "3" {
+				t.Errorf("Expected watch to resume from resource version 3, got %s", rv)
+			}
+			<-r.Context().Done()
+		}
+	})
+
+	changes := make(chan struct{}, 10)
+	i := NewNodeInformer(c, func() { changes <- struct{}{} }, nil)
+	if i.HasSynced() {
+		t.Fatalf("Expected informer not to be synced before listing")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		i.Run(ctx)
+		close(done)
+	}()
+	for n := 0; n < 3; n++ {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for change %d", n+1)
+		}
+	}
+	cancel()
+	<-done
+
+	nodes := i.List()
+	if len(nodes) != 2 || nodes[0].Metadata.Name != "node-b" || nodes[1].Metadata.Name != "node-c" {
+		t.Fatalf("Expected node-b and node-c, got %d nodes", len(nodes))
+	}
+	if i.Get("node-a") != nil || i.Get("node-c") == nil {
+		t.Fatalf("Expected deleted node to be gone and added node cached")
+	}
+	if lists != 1 {
+		t.Fatalf("Expected a single list, got %d", lists)
+	}
+}
+
+func TestXVMNetworkInformer(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/xvm-cni.dev/v1alpha1/xvmnetworks" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "1"}, "items": [{"metadata": {"name": "tenant-a"}, "spec": {"vni": 100, "subnet": "10.100.0.0/16", "policy": {"defaultIngress": "deny"}}}]}`)
+			return
+		}
+		fmt.Fprintln(w, `{"type": "MODIFIED", "object": {"metadata": {"name": "tenant-a", "resourceVersion": "2"}, "spec": {"vni": 100, "subnet": "10.100.0.0/16", "mtu": 9000}}}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	changes := make(chan struct{}, 10)
+	i := NewXVMNetworkInformer(c, func() { changes <- struct{}{} }, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		i.Run(ctx)
+		close(done)
+	}()
+	for n := 0; n < 2; n++ {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for change %d", n+1)
+		}
+	}
+	cancel()
+	<-done
+
+	xn := i.Get("tenant-a")
+	if xn == nil || xn.Spec.VNI != 100 || xn.Spec.MTU != 9000 || xn.Metadata.ResourceVersion != "2" {
+		t.Fatalf("Expected the modified XVMNetwork, got %+v", xn)
+	}
+}
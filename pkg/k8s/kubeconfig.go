@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultQPS and DefaultBurst limit the requests to the API server,
+	// matching the defaults of the Kubernetes clients
+	DefaultQPS   = 5
+	DefaultBurst = 10
+)
+
+// Settings is the "kubernetes" block of a network configuration, shared by
+// the features talking to the API server
+type Settings struct {
+	// Kubeconfig is the kubeconfig to connect with; the pod's service
+	// account is used if empty
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// QPS and Burst limit the rate of requests, DefaultQPS and DefaultBurst
+	// if zero
+	QPS   float64 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// Validate returns the problems of the settings
+func (s *Settings) Validate() []string {
+	var problems []string
+	if s.QPS < 0 {
+		problems = append(problems, fmt.Sprintf("kubernetes.qps %v must not be negative", s.QPS))
+	}
+	if s.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("kubernetes.burst %d must not be negative", s.Burst))
+	}
+	return problems
+}
+
+// Config returns the client configuration of the settings, which may be nil
+// to run in-cluster with the default limits
+func (s *Settings) Config() (*Config, error) {
+	if s == nil {
+		s = &Settings{}
+	}
+	var config *Config
+	var err error
+	if s.Kubeconfig != "" {
+		config, err = LoadKubeconfig(s.Kubeconfig)
+	} else {
+		config, err = InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.QPS, config.Burst = s.QPS, s.Burst
+	return config, nil
+}
+
+// kubeconfig holds the parts of a kubeconfig file the client supports
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// LoadKubeconfig returns the configuration of a kubeconfig file's current
+// context. Files it refers to are relative to its directory.
+func LoadKubeconfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig: %v", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %v", path, err)
+	}
+
+	// A single context needs no current-context
+	ctxIndex := -1
+	for i := range kc.Contexts {
+		if kc.Contexts[i].Name == kc.CurrentContext || (kc.CurrentContext == "" && len(kc.Contexts) == 1) {
+			ctxIndex = i
+		}
+	}
+	if ctxIndex < 0 {
+		return nil, fmt.Errorf("kubeconfig %s: context %q not found", path, kc.CurrentContext)
+	}
+	ctx := kc.Contexts[ctxIndex].Context
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	decode := func(field, s string) ([]byte, error) {
+		if s == "" {
+			return nil, nil
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig %s: invalid %s: %v", path, field, err)
+		}
+		return b, nil
+	}
+
+	config := &Config{}
+	found := false
+	for _, c := range kc.Clusters {
+		if c.Name != ctx.Cluster {
+			continue
+		}
+		found = true
+		config.Server = c.Cluster.Server
+		config.CAFile = resolve(c.Cluster.CertificateAuthority)
+		config.Insecure = c.Cluster.InsecureSkipTLSVerify
+		if config.CAData, err = decode("certificate-authority-data", c.Cluster.CertificateAuthorityData); err != nil {
+			return nil, err
+		}
+	}
+	if !found || config.Server == "" {
+		return nil, fmt.Errorf("kubeconfig %s: cluster %q not found", path, ctx.Cluster)
+	}
+	for _, u := range kc.Users {
+		if u.Name != ctx.User {
+			continue
+		}
+		config.Token = u.User.Token
+		config.TokenFile = resolve(u.User.TokenFile)
+		config.CertFile = resolve(u.User.ClientCertificate)
+		config.KeyFile = resolve(u.User.ClientKey)
+		if config.CertData, err = decode("client-certificate-data", u.User.ClientCertificateData); err != nil {
+			return nil, err
+		}
+		if config.KeyData, err = decode("client-key-data", u.User.ClientKeyData); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
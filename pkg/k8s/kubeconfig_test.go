@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: xvm
+clusters:
+- name: other
+  cluster:
+    server: https://other.example:6443
+- name: cluster
+  cluster:
+    server: https://10.0.0.1:6443
+    certificate-authority: pki/ca.crt
+contexts:
+- name: admin
+  context: {cluster: other, user: admin}
+- name: xvm
+  context:
+    cluster: cluster
+    user: xvm-agent
+users:
+- name: xvm-agent
+  user:
+    token: secret
+    client-key-data: a2V5
+`
+
+func TestLoadKubeconfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatalf("Failed to write kubeconfig: %v", err)
+	}
+	config, err := LoadKubeconfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load kubeconfig: %v", err)
+	}
+	if config.Server != "https://10.0.0.1:6443" || config.Token != "secret" {
+		t.Fatalf("Expected the current context's cluster and user, got %+v", config)
+	}
+	// Files are relative to the kubeconfig, data is base64
+	if config.CAFile != filepath.Join(filepath.Dir(path), "pki/ca.crt") {
+		t.Fatalf("Expected CA file next to the kubeconfig, got %q", config.CAFile)
+	}
+	if string(config.KeyData) != "key" {
+		t.Fatalf("Expected decoded key data, got %q", config.KeyData)
+	}
+
+	// Settings carry the rate limits over
+	config, err = (&Settings{Kubeconfig: path, QPS: 20, Burst: 40}).Config()
+	if err != nil || config.QPS != 20 || config.Burst != 40 {
+		t.Fatalf("Expected the settings' limits, got %+v, %v", config, err)
+	}
+
+	invalid := strings.Replace(testKubeconfig, "current-context: xvm", "current-context: missing", 1)
+	if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+		t.Fatalf("Failed to write kubeconfig: %v", err)
+	}
+	if _, err := LoadKubeconfig(path); err == nil || !strings.Contains(err.Error(), `context "missing" not found`) {
+		t.Fatalf("Expected missing context error, got %v", err)
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	if problems := (&Settings{QPS: 2.5, Burst: 5}).Validate(); len(problems) != 0 {
+		t.Fatalf("Expected valid settings, got %v", problems)
+	}
+	if problems := (&Settings{QPS: -1, Burst: -1}).Validate(); len(problems) != 2 {
+		t.Fatalf("Expected negative limits to be invalid, got %v", problems)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"net"
+)
+
+// Node holds the parts of a Kubernetes Node (v1) the agent uses
+type Node struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		PodCIDR  string   `json:"podCIDR,omitempty"`
+		PodCIDRs []string `json:"podCIDRs,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses,omitempty"`
+	} `json:"status"`
+}
+
+// NodeList is a list of nodes as of a resource version
+type NodeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []Node `json:"items"`
+}
+
+// PodCIDRs returns the node's pod CIDRs, skipping invalid ones. Older API
+// servers only set podCIDR.
+func (n *Node) PodCIDRs() []*net.IPNet {
+	cidrs := n.Spec.PodCIDRs
+	if len(cidrs) == 0 && n.Spec.PodCIDR != "" {
+		cidrs = []string{n.Spec.PodCIDR}
+	}
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+// InternalIP returns the node's first InternalIP address of the family, or
+// nil if it has none
+func (n *Node) InternalIP(ipv6 bool) net.IP {
+	for _, addr := range n.Status.Addresses {
+		if addr.Type != "InternalIP" {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		if ip != nil && (ip.To4() == nil) == ipv6 {
+			return ip
+		}
+	}
+	return nil
+}
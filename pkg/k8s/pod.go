@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Pod holds the parts of a Kubernetes Pod (v1) the plugin uses
+type Pod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+}
+
+// GetPod returns the pod of the namespace with the name
+func (c *Client) GetPod(ctx context.Context, namespace, name string) (*Pod, error) {
+	var pod Pod
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(name)
+	if err := c.getJSON(ctx, path, nil, &pod); err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	return &pod, nil
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// xvmNetworksPath is where the API server serves the cluster-scoped
+// XVMNetwork custom resources
+const xvmNetworksPath = "/apis/xvm-cni.dev/v1alpha1/xvmnetworks"
+
+// XVMNetwork is the custom resource defining an xvm-cni network for the
+// whole cluster, which the agent renders into each node's configuration
+type XVMNetwork struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec XVMNetworkSpec `json:"spec"`
+}
+
+// XVMNetworkSpec holds the settings of an XVMNetwork
+type XVMNetworkSpec struct {
+	VNI           int    `json:"vni"`
+	Subnet        string `json:"subnet,omitempty"`
+	Gateway       string `json:"gateway,omitempty"`
+	IPv6Subnet    string `json:"ipv6Subnet,omitempty"`
+	IPv6Gateway   string `json:"ipv6Gateway,omitempty"`
+	MTU           int    `json:"mtu,omitempty"`
+	Mode          string `json:"mode,omitempty"`
+	HostInterface string `json:"hostInterface,omitempty"`
+	// Policy is the network's policy block, passed to the plugin as is
+	Policy json.RawMessage `json:"policy,omitempty"`
+	// Config holds further settings of the plugin's configuration
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// XVMNetworkList is a list of XVMNetworks as of a resource version
+type XVMNetworkList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []XVMNetwork `json:"items"`
+}
+
+// XVMNetworkEvent is a change of an XVMNetwork seen by a watch
+type XVMNetworkEvent struct {
+	// Type is ADDED, MODIFIED or DELETED
+	Type    string
+	Network XVMNetwork
+}
+
+// ListXVMNetworks returns the cluster's XVMNetworks and the resource
+// version to watch them from
+func (c *Client) ListXVMNetworks(ctx context.Context) (*XVMNetworkList, error) {
+	var list XVMNetworkList
+	if err := c.getJSON(ctx, xvmNetworksPath, nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list XVMNetworks: %w", err)
+	}
+	return &list, nil
+}
+
+// WatchXVMNetworks calls fn with the changes of XVMNetworks after the
+// resource version, as WatchNodes does for nodes
+func (c *Client) WatchXVMNetworks(ctx context.Context, resourceVersion string, fn func(XVMNetworkEvent) error) (string, error) {
+	return c.watch(ctx, xvmNetworksPath, "XVMNetwork", resourceVersion, func(eventType string, object json.RawMessage) error {
+		event := XVMNetworkEvent{Type: eventType}
+		if err := json.Unmarshal(object, &event.Network); err != nil {
+			return fmt.Errorf("failed to decode XVMNetwork: %v", err)
+		}
+		return fn(event)
+	})
+}
+
+// XVMNetworkInformer caches the cluster's XVMNetworks like NodeInformer
+// does its nodes
+type XVMNetworkInformer struct {
+	*informer[XVMNetwork]
+}
+
+// NewXVMNetworkInformer returns an informer calling onChange after every
+// change of the cached XVMNetworks, and onError, if not nil, with the
+// failures it retries
+func NewXVMNetworkInformer(client *Client, onChange func(), onError func(error)) *XVMNetworkInformer {
+	return &XVMNetworkInformer{&informer[XVMNetwork]{
+		list: func(ctx context.Context) ([]XVMNetwork, string, error) {
+			list, err := client.ListXVMNetworks(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			return list.Items, list.Metadata.ResourceVersion, nil
+		},
+		watch: func(ctx context.Context, rv string, fn func(string, *XVMNetwork)) (string, error) {
+			return client.WatchXVMNetworks(ctx, rv, func(e XVMNetworkEvent) error {
+				fn(e.Type, &e.Network)
+				return nil
+			})
+		},
+		name:     func(n *XVMNetwork) string { return n.Metadata.Name },
+		onChange: onChange,
+		onError:  onError,
+		objects:  make(map[string]*XVMNetwork),
+	}}
+}
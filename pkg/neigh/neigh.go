@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+// Package neigh sizes the kernel's neighbor tables, whose default limits
+// hold about a thousand entries before the kernel starts evicting reachable
+// neighbors and refusing new ones
+package neigh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Families are the neighbor tables, by their sysctl directory
+var Families = []string{"ipv4", "ipv6"}
+
+// GCThresh are the thresholds of a neighbor table: below Thresh1 entries
+// are never collected, above Thresh2 they are collected once they are five
+// seconds old, and no more than Thresh3 are kept
+type GCThresh struct {
+	Thresh1 int
+	Thresh2 int
+	Thresh3 int
+}
+
+// ForPeers returns thresholds holding the neighbors of the given number of
+// peers without collecting reachable ones. The tables are shared by every
+// network namespace on the node, so containers talking to the same peers
+// each add entries of their own.
+func ForPeers(peers int) GCThresh {
+	return GCThresh{Thresh1: peers, Thresh2: 2 * peers, Thresh3: 4 * peers}
+}
+
+// Covers reports whether each threshold is at least the other's
+func (t GCThresh) Covers(o GCThresh) bool {
+	return t.Thresh1 >= o.Thresh1 && t.Thresh2 >= o.Thresh2 && t.Thresh3 >= o.Thresh3
+}
+
+// Max returns the larger of each threshold
+func (t GCThresh) Max(o GCThresh) GCThresh {
+	return GCThresh{
+		Thresh1: max(t.Thresh1, o.Thresh1),
+		Thresh2: max(t.Thresh2, o.Thresh2),
+		Thresh3: max(t.Thresh3, o.Thresh3),
+	}
+}
+
+// dir returns the sysctl directory of the family's default thresholds
+func dir(family string) string {
+	return filepath.Join("/proc/sys/net", family, "neigh/default")
+}
+
+// Sizable reports whether the family's thresholds can be set from the
+// current network namespace. Only the initial one has them, as the tables
+// are the node's.
+func Sizable(family string) bool {
+	_, err := os.Stat(filepath.Join(dir(family), "gc_thresh3"))
+	return err == nil
+}
+
+// Thresholds returns the family's current thresholds
+func Thresholds(family string) (GCThresh, error) {
+	var t GCThresh
+	for i, v := range []*int{&t.Thresh1, &t.Thresh2, &t.Thresh3} {
+		name := fmt.Sprintf("gc_thresh%d", i+1)
+		data, err := os.ReadFile(filepath.Join(dir(family), name))
+		if err != nil {
+			return GCThresh{}, fmt.Errorf("failed to read %s %s: %v", family, name, err)
+		}
+		if *v, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return GCThresh{}, fmt.Errorf("invalid %s %s: %v", family, name, err)
+		}
+	}
+	return t, nil
+}
+
+// Raise raises the family's thresholds to at least the given ones, leaving
+// those already higher, and returns the resulting thresholds
+func Raise(family string, want GCThresh) (GCThresh, error) {
+	cur, err := Thresholds(family)
+	if err != nil {
+		return GCThresh{}, err
+	}
+	next := cur.Max(want)
+
+	// Largest first, so the thresholds stay ordered in between
+	for i, v := range []struct{ cur, next int }{{cur.Thresh3, next.Thresh3}, {cur.Thresh2, next.Thresh2}, {cur.Thresh1, next.Thresh1}} {
+		if v.next == v.cur {
+			continue
+		}
+		name := fmt.Sprintf("gc_thresh%d", 3-i)
+		if err := os.WriteFile(filepath.Join(dir(family), name), []byte(strconv.Itoa(v.next)), 0644); err != nil {
+			return GCThresh{}, fmt.Errorf("failed to set %s %s: %v", family, name, err)
+		}
+	}
+	return next, nil
+}
+
+// Count returns the entries of the family's table in the current network
+// namespace
+func Count(family string) (int, error) {
+	af := unix.AF_INET
+	if family == "ipv6" {
+		af = unix.AF_INET6
+	}
+	neighs, err := netlink.NeighList(0, af)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s neighbors: %v", family, err)
+	}
+	return len(neighs), nil
+}
@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package neigh
+
+import (
+	"os"
+	"testing"
+)
+
+func TestForPeers(t *testing.T) {
+	want := ForPeers(5000)
+	if want != (GCThresh{Thresh1: 5000, Thresh2: 10000, Thresh3: 20000}) {
+		t.Fatalf("Unexpected thresholds: %+v", want)
+	}
+
+	// Raising leaves the thresholds already higher
+	cur := GCThresh{Thresh1: 128, Thresh2: 512, Thresh3: 40000}
+	got := cur.Max(want)
+	if got != (GCThresh{Thresh1: 5000, Thresh2: 10000, Thresh3: 40000}) {
+		t.Fatalf("Unexpected raised thresholds: %+v", got)
+	}
+	if !got.Covers(want) || cur.Covers(want) {
+		t.Fatalf("Expected only raised thresholds to cover %+v", want)
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	if !Sizable("ipv4") {
+		t.Skip("Neighbor tables not sizable from this network namespace")
+	}
+	cur, err := Thresholds("ipv4")
+	if err != nil {
+		t.Fatalf("Failed to read thresholds: %v", err)
+	}
+	if cur.Thresh1 == 0 || cur.Thresh3 < cur.Thresh1 {
+		t.Fatalf("Unexpected thresholds: %+v", cur)
+	}
+
+	// Raising to lower thresholds changes nothing
+	got, err := Raise("ipv4", GCThresh{Thresh1: 1, Thresh2: 1, Thresh3: 1})
+	if err != nil {
+		t.Fatalf("Failed to raise thresholds: %v", err)
+	}
+	if got != cur {
+		t.Fatalf("Expected thresholds %+v kept, got %+v", cur, got)
+	}
+	if n, err := Count("ipv4"); err != nil || n < 0 {
+		t.Fatalf("Failed to count neighbors: %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,643 @@
+//go:build linux
+// +build linux
+
+// Package netconf reads xvm-cni network configurations for the tools
+// managing a node's networks outside of plugin invocations
+package netconf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/offload"
+	"github.com/nohns/xvm-cni/pkg/ovs"
+	"github.com/nohns/xvm-cni/pkg/pmtu"
+	"github.com/nohns/xvm-cni/pkg/sublink"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+const (
+	// PluginType is the type of the plugin in network configurations
+	PluginType = "xvm-cni"
+	// AliasPrefix marks the host-side interfaces the plugin creates. The
+	// rest of the alias is "<container ID>/<interface name>", optionally
+	// followed by "network=<name>" and "pod=<namespace>/<name>".
+	AliasPrefix = "xvm-cni:"
+	// ModeOVS attaches containers to an Open vSwitch bridge
+	ModeOVS = "ovs"
+
+	// lockTimeout bounds how long a tool waits for the plugin to finish
+	// with the network, as long as the plugin itself waits
+	lockTimeout      = 30 * time.Second
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// ErrOtherPlugin is returned for configurations of plugins other than
+// xvm-cni
+var ErrOtherPlugin = errors.New("not an xvm-cni network configuration")
+
+// Network holds the settings of an xvm-cni network, read from its
+// configuration file
+type Network struct {
+	CNIVersion    string `json:"cniVersion"`
+	Name          string `json:"name"`
+	HostInterface string `json:"hostInterface"`
+	VxlanID       int    `json:"vxlanID"`
+	VxlanPort     int    `json:"vxlanPort"`
+	MTU           int    `json:"mtu"`
+	TxQueueLen    int    `json:"txQueueLen"`
+	InheritDSCP   bool   `json:"inheritDSCP"`
+	PromiscMode   bool   `json:"promiscMode"`
+	VLANFiltering bool   `json:"vlanFiltering"`
+	Mode          string `json:"mode"`
+	Standalone    bool   `json:"standalone"`
+	// VxlanNameTemplate and BridgeNameTemplate name the devices as the
+	// plugin does
+	VxlanNameTemplate  string `json:"vxlanNameTemplate"`
+	BridgeNameTemplate string `json:"bridgeNameTemplate"`
+	Subnet             string `json:"subnet"`
+	Gateway            string `json:"gateway"`
+	IPv6Subnet         string `json:"ipv6Subnet"`
+	IPv6Gateway        string `json:"ipv6Gateway"`
+	DataDir            string `json:"dataDir"`
+	OVS                struct {
+		Bridge    string   `json:"bridge"`
+		Peers     []string `json:"peers"`
+		VhostUser bool     `json:"vhostUser"`
+	} `json:"ovs"`
+	// Flooding is how the VXLAN device floods traffic without a known
+	// destination
+	Flooding *struct {
+		Mode  string   `json:"mode"`
+		Peers []string `json:"peers"`
+	} `json:"flooding"`
+	// MTUProbe lists the peers the underlay path MTU is probed to
+	MTUProbe *struct {
+		Peers   []string `json:"peers"`
+		Timeout int      `json:"timeout"`
+	} `json:"mtuProbe"`
+	// VRF holds the VRF the bridge or shim is in
+	VRF *struct {
+		Name  string `json:"name"`
+		Table uint32 `json:"table"`
+	} `json:"vrf"`
+	// DefaultRoute holds the gateways of the containers' ECMP default
+	// routes, which the agent withdraws those that are down from
+	DefaultRoute *struct {
+		Gateways []string `json:"gateways"`
+		Metric   int      `json:"metric"`
+	} `json:"defaultRoute"`
+	// RouteTable holds the routing table the routes to the overlay go to
+	RouteTable *struct {
+		ID int `json:"id"`
+	} `json:"routeTable"`
+	// Offloads holds the VXLAN device's offloads, restored along with it
+	Offloads *struct {
+		Vxlan *offload.Settings `json:"vxlan"`
+	} `json:"offloads"`
+	// Kubernetes configures how the agent reaches the API server
+	Kubernetes *k8s.Settings `json:"kubernetes"`
+	// NamespaceVNIs puts the pods of namespaces on VXLAN segments of their
+	// own
+	NamespaceVNIs []struct {
+		VxlanID     int    `json:"vxlanID"`
+		Subnet      string `json:"subnet"`
+		Gateway     string `json:"gateway"`
+		IPv6Subnet  string `json:"ipv6Subnet"`
+		IPv6Gateway string `json:"ipv6Gateway"`
+	} `json:"namespaceVNIs"`
+	// Attachments add further interfaces to the containers, each on a VXLAN
+	// segment of its own
+	Attachments []struct {
+		Name        string `json:"name"`
+		VxlanID     int    `json:"vxlanID"`
+		Subnet      string `json:"subnet"`
+		Gateway     string `json:"gateway"`
+		IPv6Subnet  string `json:"ipv6Subnet"`
+		IPv6Gateway string `json:"ipv6Gateway"`
+	} `json:"attachments"`
+
+	// Plugin is the plugin's configuration as the runtime passes it
+	Plugin map[string]interface{} `json:"-"`
+}
+
+// Load reads the xvm-cni network from a configuration file. In a conflist,
+// the xvm-cni plugin gets the list's name and version, as the runtime passes
+// them.
+func Load(path string) (*Network, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// LoadDir reads the xvm-cni networks from the configuration files in a
+// directory, such as /etc/cni/net.d, skipping those of other plugins
+func LoadDir(dir string) ([]*Network, error) {
+	var paths []string
+	for _, pattern := range []string{"*.conf", "*.conflist", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	var networks []*Network
+	for _, path := range paths {
+		n, err := Load(path)
+		if errors.Is(err, ErrOtherPlugin) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// Parse parses a network configuration or configuration list and fills in
+// the plugin's defaults
+func Parse(data []byte) (*Network, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	plugin := raw
+	if plugins, ok := raw["plugins"].([]interface{}); ok {
+		plugin = nil
+		for _, p := range plugins {
+			if p, ok := p.(map[string]interface{}); ok && p["type"] == PluginType {
+				plugin = p
+				break
+			}
+		}
+		if plugin == nil {
+			return nil, fmt.Errorf("no %s plugin in network configuration list: %w", PluginType, ErrOtherPlugin)
+		}
+		plugin["name"] = raw["name"]
+		plugin["cniVersion"] = raw["cniVersion"]
+	} else if raw["type"] != PluginType {
+		return nil, fmt.Errorf("network configuration is for plugin %v: %w", raw["type"], ErrOtherPlugin)
+	}
+
+	data, err := json.Marshal(plugin)
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{Plugin: plugin}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if n.VxlanID == 0 {
+		n.VxlanID = vxlan.DefaultVxlanVNI
+	}
+	if n.VxlanPort == 0 {
+		n.VxlanPort = vxlan.DefaultVxlanPort
+	}
+	if n.MTU == 0 {
+		n.MTU = vxlan.DefaultMTU
+	}
+	if n.Mode == "" {
+		n.Mode = "bridge"
+	}
+	if n.DataDir == "" {
+		n.DataDir = ipam.DefaultDataDir
+	}
+	if n.OVS.Bridge == "" {
+		n.OVS.Bridge = ovs.BridgeName(n.VxlanID)
+	}
+	if p := n.MTUProbe; p != nil && len(p.Peers) == 0 && n.Mode == ModeOVS {
+		p.Peers = n.OVS.Peers
+	}
+	return n, nil
+}
+
+// Segments returns the networks of the namespaces with a VNI of their own
+// and of the further attachments, named and configured as the plugin
+// derives them from the network
+func (n *Network) Segments() []*Network {
+	var segments []*Network
+	for _, nv := range n.NamespaceVNIs {
+		name := fmt.Sprintf("%s-vni%d", n.Name, nv.VxlanID)
+		segments = append(segments, n.segment(name, nv.VxlanID, nv.Subnet, nv.Gateway, nv.IPv6Subnet, nv.IPv6Gateway))
+	}
+	for _, a := range n.Attachments {
+		segments = append(segments, n.segment(n.Name+"-"+a.Name, a.VxlanID, a.Subnet, a.Gateway, a.IPv6Subnet, a.IPv6Gateway))
+	}
+	return segments
+}
+
+// segment returns the network on the VNI and subnets under the name
+func (n *Network) segment(name string, vni int, subnet, gateway, ipv6Subnet, ipv6Gateway string) *Network {
+	s := *n
+	s.Name = name
+	s.VxlanID = vni
+	s.Subnet, s.Gateway = subnet, gateway
+	s.IPv6Subnet, s.IPv6Gateway = ipv6Subnet, ipv6Gateway
+	s.NamespaceVNIs = nil
+	s.Attachments = nil
+	s.Plugin = make(map[string]interface{}, len(n.Plugin))
+	for k, v := range n.Plugin {
+		s.Plugin[k] = v
+	}
+	for _, k := range []string{"namespaceVNIs", "namespaceRanges", "attachments"} {
+		delete(s.Plugin, k)
+	}
+	for k, v := range map[string]interface{}{
+		"name":        s.Name,
+		"vxlanID":     s.VxlanID,
+		"subnet":      s.Subnet,
+		"gateway":     s.Gateway,
+		"ipv6Subnet":  s.IPv6Subnet,
+		"ipv6Gateway": s.IPv6Gateway,
+	} {
+		s.Plugin[k] = v
+	}
+	return &s
+}
+
+// ProbeMTU checks that the underlay carries the encapsulated frames of the
+// network's MTU to each configured peer that answers ICMP echo, as the
+// plugin does when it sets the network up. Networks without peers to probe
+// or whose MTU a standard underlay carries pass.
+func (n *Network) ProbeMTU() error {
+	if n.MTUProbe == nil || n.MTU <= vxlan.SafeMTU {
+		return nil
+	}
+	var peers []net.IP
+	for _, peer := range n.MTUProbe.Peers {
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return fmt.Errorf("invalid mtuProbe peer %q", peer)
+		}
+		peers = append(peers, ip)
+	}
+	timeout := time.Duration(n.MTUProbe.Timeout) * time.Second
+	return pmtu.ProbePeers(n.HostInterface, peers, n.MTU+vxlan.Overhead, timeout)
+}
+
+// VxlanOffloads returns the offloads of the network's VXLAN device, nil if
+// unset
+func (n *Network) VxlanOffloads() *offload.Settings {
+	if n.Offloads == nil {
+		return nil
+	}
+	return n.Offloads.Vxlan
+}
+
+// RouteTableID returns the routing table of the routes to the overlay, 0 for
+// the main table
+func (n *Network) RouteTableID() int {
+	if n.RouteTable == nil {
+		return 0
+	}
+	return n.RouteTable.ID
+}
+
+// UsesBridge reports whether the network's containers attach to a Linux
+// bridge, rather than next to a shim or to an OVS bridge
+func (n *Network) UsesBridge() bool {
+	switch n.Mode {
+	case ModeOVS, sublink.ModeMacvlan, sublink.ModeIPvlan:
+		return false
+	}
+	return true
+}
+
+// L2Name returns the name of the bridge, shim or OVS bridge the network's
+// containers attach to. A device named after the VNI by earlier versions is
+// used as long as it exists.
+func (n *Network) L2Name() string {
+	switch n.Mode {
+	case ModeOVS:
+		return n.OVS.Bridge
+	case sublink.ModeMacvlan, sublink.ModeIPvlan:
+		return devname.Resolve(sublink.ShimName(n.Name, n.VxlanID), sublink.ShimName("", n.VxlanID), linkExists)
+	}
+	if name, _ := devname.Render(n.BridgeNameTemplate, n.Name, n.VxlanID); name != "" {
+		return name
+	}
+	return devname.Resolve(bridge.BridgeName(n.Name, n.VxlanID), bridge.BridgeName("", n.VxlanID), linkExists)
+}
+
+// FloodMode returns the flooding mode of the network's VXLAN device
+func (n *Network) FloodMode() string {
+	if n.Flooding == nil || n.Flooding.Mode == "" {
+		return vxlan.FloodMulticast
+	}
+	return n.Flooding.Mode
+}
+
+// FloodPeers returns the peers the network's VXLAN device replicates to
+func (n *Network) FloodPeers() []net.IP {
+	if n.FloodMode() != vxlan.FloodHeadEnd {
+		return nil
+	}
+	var peers []net.IP
+	for _, peer := range n.Flooding.Peers {
+		if ip := net.ParseIP(peer); ip != nil {
+			peers = append(peers, ip)
+		}
+	}
+	return peers
+}
+
+// VxlanName returns the name of the network's VXLAN device, which OVS and
+// standalone networks don't have
+func (n *Network) VxlanName() string {
+	if n.Mode == ModeOVS || n.Standalone {
+		return ""
+	}
+	if name, _ := devname.Render(n.VxlanNameTemplate, n.Name, n.VxlanID); name != "" {
+		return name
+	}
+	return devname.Resolve(vxlan.DeviceName(n.Name, n.VxlanID), vxlan.DeviceName("", n.VxlanID), linkExists)
+}
+
+// VxlanDevice returns the name of the VXLAN device with the VNI
+func VxlanDevice(vni int) (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if vx, ok := link.(*netlink.Vxlan); ok && vx.VxlanId == vni {
+			return vx.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no VXLAN device with VNI %d", vni)
+}
+
+// linkExists reports whether a link of the name exists
+func linkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+// HasHostPorts reports whether every attachment of the network has a
+// host-side interface carrying its alias
+func (n *Network) HasHostPorts() bool {
+	switch n.Mode {
+	case sublink.ModeMacvlan, sublink.ModeIPvlan:
+		return false
+	case ModeOVS:
+		return !n.OVS.VhostUser
+	}
+	return true
+}
+
+// GatewayAddrs returns the gateway addresses of every configured subnet, as
+// the plugin assigns them to the bridge or shim
+func (n *Network) GatewayAddrs() ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	ranges := [][2]string{{n.Subnet, n.Gateway}, {n.IPv6Subnet, n.IPv6Gateway}}
+	for _, r := range ranges {
+		if r[0] == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(r[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", r[0], err)
+		}
+		gw := net.ParseIP(r[1])
+		if gw == nil {
+			return nil, fmt.Errorf("invalid gateway %q of subnet %s", r[1], r[0])
+		}
+		addrs = append(addrs, &net.IPNet{IP: gw, Mask: subnet.Mask})
+	}
+	return addrs, nil
+}
+
+// OpenIPAM opens the allocations of the network's subnets
+func (n *Network) OpenIPAM() ([]*ipam.IPAM, error) {
+	ranges := [][2]string{{n.Subnet, n.Gateway}, {n.IPv6Subnet, n.IPv6Gateway}}
+	var ipams []*ipam.IPAM
+	for _, r := range ranges {
+		if r[0] == "" {
+			continue
+		}
+		i, err := ipam.New(&ipam.Config{Subnet: r[0], Gateway: r[1], DataDir: n.DataDir, Network: n.Name})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open allocations of %s: %v", r[0], err)
+		}
+		ipams = append(ipams, i)
+	}
+	return ipams, nil
+}
+
+// Lock takes the plugin's lock of the network, so neither allocations nor
+// the shared devices change under the caller. It returns the function
+// releasing the lock.
+func (n *Network) Lock() (func(), error) {
+	if err := os.MkdirAll(ipam.NetworkDir(n.DataDir, n.Name), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	path := ipam.LockFile(n.DataDir, n.Name, n.VxlanID)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network lock: %v", err)
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return func() { file.Close() }, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, fmt.Errorf("failed to take network lock: %v", err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("timed out waiting for network lock %s", path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// HostLink is a host-side interface of an attachment
+type HostLink struct {
+	Link netlink.Link
+	// Network and Pod are those of the alias, if it names them
+	Network string
+	Pod     string
+}
+
+// HostLinks returns the host-side interfaces the plugin created, by
+// attachment key
+func HostLinks() (map[string][]HostLink, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	byKey := make(map[string][]HostLink)
+	for _, link := range links {
+		key, fields, ok := ParseAlias(link.Attrs().Alias)
+		if !ok {
+			continue
+		}
+		byKey[key] = append(byKey[key], HostLink{Link: link, Network: fields["network"], Pod: fields["pod"]})
+	}
+	return byKey, nil
+}
+
+// ParseAlias returns the attachment key of an interface alias and the
+// "name=value" fields following it, or false if the plugin didn't create
+// the interface
+func ParseAlias(alias string) (string, map[string]string, bool) {
+	if !strings.HasPrefix(alias, AliasPrefix) {
+		return "", nil, false
+	}
+	parts := strings.Fields(strings.TrimPrefix(alias, AliasPrefix))
+	if len(parts) == 0 {
+		return "", nil, false
+	}
+	fields := make(map[string]string)
+	for _, part := range parts[1:] {
+		if name, value, ok := strings.Cut(part, "="); ok {
+			fields[name] = value
+		}
+	}
+	return parts[0], fields, true
+}
+
+// Allocation is an address allocated to an attachment
+type Allocation struct {
+	Attachment   string `json:"attachment"`
+	IP           string `json:"ip"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	// Interfaces are the attachment's host-side interfaces
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+// Allocations returns the network's allocations, sorted by attachment and
+// address
+func (n *Network) Allocations() ([]Allocation, error) {
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return nil, err
+	}
+	links, err := HostLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Allocation
+	for _, i := range ipams {
+		for key, ip := range i.Allocations {
+			// Networks may share the data directory
+			if !i.Subnet.Contains(ip) {
+				continue
+			}
+			owner := i.Owners[key]
+			entry := Allocation{
+				Attachment:   key,
+				IP:           ip.String(),
+				PodNamespace: owner.PodNamespace,
+				PodName:      owner.PodName,
+			}
+			for _, l := range links[key] {
+				entry.Interfaces = append(entry.Interfaces, l.Link.Attrs().Name)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].Attachment != entries[b].Attachment {
+			return entries[a].Attachment < entries[b].Attachment
+		}
+		return entries[a].IP < entries[b].IP
+	})
+	return entries, nil
+}
+
+// Release releases an allocated address under the network's lock and
+// returns the attachment it was allocated to. Addresses of attachments that
+// still have host interfaces, and so are most likely in use, are only
+// released if forced.
+func (n *Network) Release(ip net.IP, force bool) (string, error) {
+	unlock, err := n.Lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	ipams, err := n.OpenIPAM()
+	if err != nil {
+		return "", err
+	}
+	for _, i := range ipams {
+		if !i.Subnet.Contains(ip) {
+			continue
+		}
+		for key, allocated := range i.Allocations {
+			if !allocated.Equal(ip) {
+				continue
+			}
+			links, err := HostLinks()
+			if err != nil {
+				return "", err
+			}
+			if len(links[key]) > 0 && !force {
+				return "", fmt.Errorf("%s is allocated to %s, which still has interface %s; delete the container or force the release", ip, key, links[key][0].Link.Attrs().Name)
+			}
+			if err := i.Release(key); err != nil {
+				return "", err
+			}
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not allocated in network %s", ip, n.Name)
+}
+
+// ContainerInterface returns the host-side interface, such as the host veth
+// or tap, of a container's attachment. The container ID may be abbreviated
+// to a unique prefix, and ifName may be empty if the container has a single
+// attachment.
+func ContainerInterface(containerID, ifName string) (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("failed to list links: %v", err)
+	}
+
+	var matches []string
+	for _, link := range links {
+		key, _, ok := ParseAlias(link.Attrs().Alias)
+		if !ok {
+			continue // Not created by the plugin
+		}
+		id, name, _ := strings.Cut(key, "/")
+		if !strings.HasPrefix(id, containerID) || (ifName != "" && name != ifName) {
+			continue
+		}
+		matches = append(matches, fmt.Sprintf("%s (%s)", link.Attrs().Name, key))
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no host interface found for container %s; macvlan and ipvlan attachments have none, capture their VNI instead", containerID)
+	case 1:
+		return strings.Fields(matches[0])[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("container %s matches several attachments, select one by interface: %s", containerID, strings.Join(matches, ", "))
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package netconf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParse(t *testing.T) {
+	// A conflist's xvm-cni plugin gets the list's name and version
+	n, err := Parse([]byte(`{
+		"cniVersion": "1.1.0",
+		"name": "xvm-net",
+		"plugins": [
+			{"type": "xvm-cni", "hostInterface": "eth0", "vxlanID": 42, "mode": "macvlan", "subnet": "10.42.0.0/16", "gateway": "10.42.0.1"},
+			{"type": "portmap"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse conflist: %v", err)
+	}
+	if n.Name != "xvm-net" || n.VxlanID != 42 || n.Plugin["cniVersion"] != "1.1.0" || n.Plugin["hostInterface"] != "eth0" {
+		t.Fatalf("Unexpected network: %+v", n)
+	}
+	if n.L2Name() != "xgw-xvm-net" || n.HasHostPorts() {
+		t.Fatalf("Unexpected devices for mode %s: %s", n.Mode, n.L2Name())
+	}
+
+	// Defaults match the plugin's
+	n, err = Parse([]byte(`{"cniVersion": "1.0.0", "name": "xvm-net", "type": "xvm-cni"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if n.VxlanID != 10 || n.Mode != "bridge" || n.DataDir != "/var/lib/cni/xvm-cni" || n.VxlanName() != "xvx-xvm-net" || !n.HasHostPorts() {
+		t.Fatalf("Unexpected defaults: %+v", n)
+	}
+
+	if n.VxlanPort != 8472 || n.MTU != 1500 || !n.UsesBridge() {
+		t.Fatalf("Unexpected defaults: %+v", n)
+	}
+
+	// Other plugins' configurations are rejected
+	if _, err := Parse([]byte(`{"name": "other", "type": "bridge"}`)); !errors.Is(err, ErrOtherPlugin) {
+		t.Fatalf("Expected configuration of another plugin to be rejected, got %v", err)
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	key, fields, ok := ParseAlias("xvm-cni:c1/eth0 network=xvm-net pod=default/web")
+	if !ok || key != "c1/eth0" || fields["network"] != "xvm-net" || fields["pod"] != "default/web" {
+		t.Fatalf("Unexpected alias parse: %q %v %v", key, fields, ok)
+	}
+	if key, _, ok := ParseAlias("xvm-cni:c1/eth0"); !ok || key != "c1/eth0" {
+		t.Fatalf("Expected plain alias to parse, got %q", key)
+	}
+	if _, _, ok := ParseAlias("uplink"); ok {
+		t.Fatalf("Expected foreign alias to be rejected")
+	}
+}
+
+func TestGatewayAddrs(t *testing.T) {
+	n, err := Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "subnet": "10.42.0.0/16", "gateway": "10.42.0.1", "ipv6Subnet": "fd42::/64", "ipv6Gateway": "fd42::1"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	addrs, err := n.GatewayAddrs()
+	if err != nil {
+		t.Fatalf("Failed to get gateway addresses: %v", err)
+	}
+	if len(addrs) != 2 || addrs[0].String() != "10.42.0.1/16" || addrs[1].String() != "fd42::1/64" {
+		t.Fatalf("Unexpected gateway addresses: %v", addrs)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-xvm.conf":       `{"cniVersion": "1.0.0", "name": "xvm-net", "type": "xvm-cni", "vxlanID": 42}`,
+		"20-other.conf":     `{"cniVersion": "1.0.0", "name": "other", "type": "bridge"}`,
+		"30-xvm.conflist":   `{"cniVersion": "1.0.0", "name": "xvm-list", "plugins": [{"type": "xvm-cni", "vxlanID": 43}]}`,
+		"40-notes.txt":      `not a configuration`,
+		"50-other.conflist": `{"cniVersion": "1.0.0", "name": "other-list", "plugins": [{"type": "bridge"}]}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	networks, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to load directory: %v", err)
+	}
+	if len(networks) != 2 || networks[0].Name != "xvm-net" || networks[1].Name != "xvm-list" || networks[1].VxlanID != 43 {
+		t.Fatalf("Unexpected networks: %+v", networks)
+	}
+}
+
+func TestOrphansOVS(t *testing.T) {
+	n, err := Parse([]byte(`{"name": "xvm-net", "type": "xvm-cni", "hostInterface": "eth0", "mode": "ovs"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	// Deleting OVS ports' veths would leave the ports in the database
+	if _, err := n.Orphans(); err == nil || !strings.Contains(err.Error(), "ovs-vsctl") {
+		t.Fatalf("Expected OVS networks not to be swept, got %v", err)
+	}
+}
+
+func TestNsfsMounts(t *testing.T) {
+	if got := unescapeMountPath(`/run/netns/a\040b\134c`); got != `/run/netns/a b\c` {
+		t.Fatalf("Unexpected unescaped path %q", got)
+	}
+
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	// A bind-mounted namespace is live without a process in it
+	path := filepath.Join(t.TempDir(), "pinned ns")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("/proc/self/ns/net", path, "", unix.MS_BIND, ""); err != nil {
+		t.Skipf("Can't bind-mount network namespaces: %v", err)
+	}
+	defer unix.Unmount(path, unix.MNT_DETACH)
+	found := false
+	for _, p := range nsfsMounts("/") {
+		found = found || p == path
+	}
+	if !found {
+		t.Fatalf("Expected %s among the bind-mounted namespaces %v", path, nsfsMounts("/"))
+	}
+}
+
+func TestSegments(t *testing.T) {
+	n, err := Parse([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-net",
+		"type": "xvm-cni",
+		"vxlanID": 42,
+		"subnet": "10.42.0.0/16",
+		"gateway": "10.42.0.1",
+		"namespaceVNIs": [{"namespaces": ["team-a"], "vxlanID": 100, "subnet": "10.100.0.0/24", "gateway": "10.100.0.1"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	segments := n.Segments()
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, got %d", len(segments))
+	}
+	s := segments[0]
+	if s.Name != "xvm-net-vni100" || s.VxlanID != 100 || s.Subnet != "10.100.0.0/24" || s.VxlanName() == n.VxlanName() {
+		t.Fatalf("Unexpected segment: %+v", s)
+	}
+	if s.Plugin["name"] != "xvm-net-vni100" || s.Plugin["vxlanID"] != 100 || s.Plugin["namespaceVNIs"] != nil {
+		t.Fatalf("Unexpected segment plugin configuration: %v", s.Plugin)
+	}
+	if n.Plugin["name"] != "xvm-net" {
+		t.Fatalf("Expected the network's plugin configuration to be left alone, got %v", n.Plugin)
+	}
+}
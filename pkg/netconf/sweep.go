@@ -0,0 +1,233 @@
+//go:build linux
+// +build linux
+
+package netconf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// Orphan is a host-side interface left behind by an attachment that is gone
+type Orphan struct {
+	Attachment string
+	Link       netlink.Link
+	// Why tells what makes the interface an orphan
+	Why string
+}
+
+// Orphans returns the network's host-side interfaces whose attachment is
+// gone: those of attachments holding no address in the network, and those
+// of attachments with a veth whose peer's network namespace has no process
+// left and isn't bind-mounted, as when a runtime crashed before deleting its
+// sandboxes. Interfaces
+// are the network's if their alias names it or, for aliases of older
+// versions naming no network, if they are ports of its bridge. The caller
+// holds the network lock.
+func (n *Network) Orphans() ([]Orphan, error) {
+	// Deleting the veth would leave its port in the OVS database
+	if n.Mode == ModeOVS {
+		return nil, fmt.Errorf("network %s forwards with Open vSwitch, whose ports are removed with ovs-vsctl", n.Name)
+	}
+	links, err := HostLinks()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := n.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	allocated := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		allocated[e.Attachment] = true
+	}
+	l2Index := 0
+	if l2, err := netlink.LinkByName(n.L2Name()); err == nil {
+		l2Index = l2.Attrs().Index
+	}
+	live, sighted, err := liveNetNsIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(links))
+	for key := range links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var orphans []Orphan
+	for _, key := range keys {
+		var owned []netlink.Link
+		for _, l := range links[key] {
+			// SR-IOV representors are returned to the host rather than
+			// deleted, which takes the plugin
+			if l.Link.Type() == "device" {
+				continue
+			}
+			if l.Network == n.Name || (l.Network == "" && l2Index != 0 && l.Link.Attrs().MasterIndex == l2Index) {
+				owned = append(owned, l.Link)
+			}
+		}
+		if len(owned) == 0 {
+			continue
+		}
+
+		why := ""
+		if !allocated[key] {
+			why = "its attachment holds no address"
+		} else if sighted {
+			for _, link := range owned {
+				if id := link.Attrs().NetNsID; link.Type() == "veth" && id >= 0 && !live[id] {
+					why = "no process is left in its peer's network namespace"
+				}
+			}
+		}
+		if why == "" {
+			continue
+		}
+		for _, link := range owned {
+			orphans = append(orphans, Orphan{Attachment: key, Link: link, Why: why})
+		}
+	}
+	return orphans, nil
+}
+
+// liveNetNsIDs returns the IDs, as seen from this network namespace, of the
+// namespaces processes are in or that are bind-mounted, as runtimes pin
+// their sandboxes' before starting any process in them. It also reports
+// whether processes in other namespaces are in sight at all; they aren't in
+// a container without the host's PID namespace, where every namespace would
+// look abandoned.
+func liveNetNsIDs() (map[int]bool, bool, error) {
+	self, err := os.Stat("/proc/self/ns/net")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read own network namespace: %v", err)
+	}
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list processes: %v", err)
+	}
+	seen := map[uint64]bool{self.Sys().(*syscall.Stat_t).Ino: true}
+	ids := make(map[int]bool)
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while they are listed
+		fi, err := os.Stat(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			continue
+		}
+		ino := fi.Sys().(*syscall.Stat_t).Ino
+		if seen[ino] {
+			continue
+		}
+		seen[ino] = true
+		if id, err := netlink.GetNetNsIdByPid(pid); err == nil && id >= 0 {
+			ids[id] = true
+		}
+	}
+	sighted := len(seen) > 1
+	// The mounts are the agent's own and, as it may run in a container
+	// with a mount namespace of its own, the host's
+	for _, root := range []string{"/", "/proc/1/root"} {
+		for _, path := range nsfsMounts(root) {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			if id, err := netlink.GetNetNsIdByFd(int(f.Fd())); err == nil && id >= 0 {
+				ids[id] = true
+			}
+			f.Close()
+		}
+	}
+	return ids, sighted, nil
+}
+
+// nsfsMounts returns the namespaces bind-mounted in the mount namespace of
+// the process whose root is root, as paths from this one
+func nsfsMounts(root string) []string {
+	mountinfo := "/proc/self/mountinfo"
+	if root != "/" {
+		mountinfo = filepath.Join(filepath.Dir(root), "mountinfo")
+	}
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The filesystem type follows the separator after the optional
+		// fields
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok || !strings.HasPrefix(post, "nsfs ") {
+			continue
+		}
+		fields := strings.Fields(pre)
+		if len(fields) < 5 {
+			continue
+		}
+		paths = append(paths, filepath.Join(root, unescapeMountPath(fields[4])))
+	}
+	return paths
+}
+
+// unescapeMountPath decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in mountinfo's paths
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// RemoveOrphan detaches and deletes an orphaned interface, which removes a
+// veth's peer as well, and prunes the forwarding and neighbor entries of its
+// MAC address from the network's bridge or shim and VXLAN device
+func (n *Network) RemoveOrphan(o Orphan) error {
+	name := o.Link.Attrs().Name
+	if o.Link.Attrs().MasterIndex != 0 {
+		if err := netlink.LinkSetNoMaster(o.Link); err != nil && !errors.Is(err, unix.ENODEV) {
+			return fmt.Errorf("failed to detach %s: %v", name, err)
+		}
+	}
+	if err := netlink.LinkDel(o.Link); err != nil && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+	macs := []net.HardwareAddr{o.Link.Attrs().HardwareAddr}
+	for _, device := range []string{n.L2Name(), n.VxlanName()} {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			continue // Not created
+		}
+		if err := vxlan.PruneNeighbors(link, macs, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
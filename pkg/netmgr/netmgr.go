@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+// Package netmgr keeps the host's network managers off the plugin's devices.
+// NetworkManager and systemd-networkd otherwise take over devices matching
+// their catch-all profiles, flushing the gateway addresses or bringing the
+// devices down. Both get runtime configuration in /run marking the devices
+// unmanaged: a udev rule setting NM_UNMANAGED for NetworkManager, and a
+// network file for systemd-networkd.
+package netmgr
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+var (
+	// udevRulesDir holds runtime udev rules, replaced in tests
+	udevRulesDir = "/run/udev/rules.d"
+	// networkdDir holds runtime systemd-networkd configuration, replaced in
+	// tests
+	networkdDir = "/run/systemd/network"
+	// reloadNetworkd has systemd-networkd reload its configuration,
+	// replaced in tests
+	reloadNetworkd = reloadNetworkdBus
+)
+
+// File is a configuration file marking devices unmanaged
+type File struct {
+	// Manager is the network manager reading the file
+	Manager string
+	Path    string
+	Content string
+}
+
+// Files returns the files marking a network's devices matching the name
+// patterns, e.g. "veth*", unmanaged
+func Files(network string, patterns []string) []File {
+	udev := fmt.Sprintf(
+		"# Written by xvm-cni for network %s, so NetworkManager leaves its devices alone\n"+
+			"SUBSYSTEM==\"net\", ACTION==\"add|change|move\", KERNEL==\"%s\", ENV{NM_UNMANAGED}=\"1\"\n",
+		network, strings.Join(patterns, "|"))
+	networkd := fmt.Sprintf(
+		"# Written by xvm-cni for network %s, so systemd-networkd leaves its devices alone\n"+
+			"[Match]\nName=%s\n\n[Link]\nUnmanaged=yes\n",
+		network, strings.Join(patterns, " "))
+	return []File{
+		// Named to sort before the host's own network files, as the first
+		// file matching a device applies
+		{Manager: "NetworkManager", Path: filepath.Join(udevRulesDir, fmt.Sprintf("80-xvm-cni-%s.rules", network)), Content: udev},
+		{Manager: "systemd-networkd", Path: filepath.Join(networkdDir, fmt.Sprintf("05-xvm-cni-%s.network", network)), Content: networkd},
+	}
+}
+
+// Setup writes the files marking a network's devices unmanaged, for the
+// managers whose runtime directory exists, and has systemd-networkd reload
+// its configuration once its file changed. Files already current are left
+// alone. The devices must be created afterwards, as udev applies the rule
+// to new devices only.
+func Setup(network string, patterns []string) error {
+	for _, f := range Files(network, patterns) {
+		if _, err := os.Stat(filepath.Dir(filepath.Dir(f.Path))); err != nil {
+			continue // The manager isn't on the host
+		}
+		current, err := os.ReadFile(f.Path)
+		if err == nil && bytes.Equal(current, []byte(f.Content)) {
+			continue
+		}
+		if err := writeFile(f.Path, f.Content); err != nil {
+			return err
+		}
+		if f.Manager == "systemd-networkd" {
+			if err := reloadNetworkd(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the files marking a network's devices unmanaged. Missing
+// files are skipped.
+func Cleanup(network string) error {
+	for _, f := range Files(network, nil) {
+		err := os.Remove(f.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %v", f.Path, err)
+		}
+		if f.Manager == "systemd-networkd" {
+			if err := reloadNetworkd(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stale returns the paths of the files marking a network's devices
+// unmanaged that are missing or outdated, of the managers on the host
+func Stale(network string, patterns []string) []string {
+	var stale []string
+	for _, f := range Files(network, patterns) {
+		if _, err := os.Stat(filepath.Dir(filepath.Dir(f.Path))); err != nil {
+			continue
+		}
+		current, err := os.ReadFile(f.Path)
+		if err != nil || !bytes.Equal(current, []byte(f.Content)) {
+			stale = append(stale, f.Path)
+		}
+	}
+	return stale
+}
+
+// writeFile writes the file atomically, so the manager never reads it half
+// written
+func writeFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename %s: %v", tmp, err)
+	}
+	return nil
+}
+
+// reloadNetworkdBus has systemd-networkd reload its configuration, like
+// networkctl reload does, if it's running
+func reloadNetworkdBus() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil // No bus, so no networkd either
+	}
+	defer conn.Close()
+	const name = "org.freedesktop.network1"
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&running); err != nil || !running {
+		return nil
+	}
+	if err := conn.Object(name, "/org/freedesktop/network1").Call(name+".Manager.Reload", 0).Err; err != nil {
+		return fmt.Errorf("failed to reload systemd-networkd: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package netmgr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRun points the managers' runtime directories to a temporary /run with
+// both managers on the host, counting networkd reloads
+func fakeRun(t *testing.T) *int {
+	run := t.TempDir()
+	for _, dir := range []string{"udev", "systemd"} {
+		if err := os.Mkdir(filepath.Join(run, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	udev, networkd, reload := udevRulesDir, networkdDir, reloadNetworkd
+	udevRulesDir = filepath.Join(run, "udev", "rules.d")
+	networkdDir = filepath.Join(run, "systemd", "network")
+	reloads := 0
+	reloadNetworkd = func() error { reloads++; return nil }
+	t.Cleanup(func() { udevRulesDir, networkdDir, reloadNetworkd = udev, networkd, reload })
+	return &reloads
+}
+
+func TestFiles(t *testing.T) {
+	files := Files("xvm-network", []string{"xvmbr100", "vxlan100", "veth*"})
+	if !strings.Contains(files[0].Content, `KERNEL=="xvmbr100|vxlan100|veth*", ENV{NM_UNMANAGED}="1"`) {
+		t.Fatalf("Unexpected udev rule:\n%s", files[0].Content)
+	}
+	if !strings.Contains(files[1].Content, "Name=xvmbr100 vxlan100 veth*\n") || !strings.Contains(files[1].Content, "Unmanaged=yes") {
+		t.Fatalf("Unexpected network file:\n%s", files[1].Content)
+	}
+}
+
+func TestSetupCleanup(t *testing.T) {
+	reloads := fakeRun(t)
+	patterns := []string{"xvmbr100", "vxlan100"}
+
+	if stale := Stale("xvm-network", patterns); len(stale) != 2 {
+		t.Fatalf("Expected both files stale before setup, got %v", stale)
+	}
+	if err := Setup("xvm-network", patterns); err != nil {
+		t.Fatalf("Failed to setup: %v", err)
+	}
+	if stale := Stale("xvm-network", patterns); len(stale) != 0 {
+		t.Fatalf("Expected no stale files, got %v", stale)
+	}
+
+	// Current files aren't rewritten, nor is networkd reloaded for them
+	if err := Setup("xvm-network", patterns); err != nil {
+		t.Fatalf("Failed to setup again: %v", err)
+	}
+	if *reloads != 1 {
+		t.Fatalf("Expected 1 networkd reload, got %d", *reloads)
+	}
+	if stale := Stale("xvm-network", append(patterns, "veth*")); len(stale) != 2 {
+		t.Fatalf("Expected both files stale for new patterns, got %v", stale)
+	}
+
+	if err := Cleanup("xvm-network"); err != nil {
+		t.Fatalf("Failed to cleanup: %v", err)
+	}
+	if err := Cleanup("xvm-network"); err != nil {
+		t.Fatalf("Failed to cleanup removed files: %v", err)
+	}
+	if *reloads != 2 {
+		t.Fatalf("Expected 2 networkd reloads, got %d", *reloads)
+	}
+}
+
+func TestSetupWithoutManagers(t *testing.T) {
+	fakeRun(t)
+	if err := os.RemoveAll(filepath.Dir(networkdDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup("xvm-network", []string{"xvmbr100"}); err != nil {
+		t.Fatalf("Failed to setup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(networkdDir)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no networkd configuration without systemd, got %v", err)
+	}
+	if stale := Stale("xvm-network", []string{"xvmbr100"}); len(stale) != 0 {
+		t.Fatalf("Expected only the managers on the host checked, got %v", stale)
+	}
+}
@@ -0,0 +1,405 @@
+//go:build linux
+// +build linux
+
+package netops
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Fake keeps links, addresses, routes and neighbors in memory, failing the
+// way the kernel does where callers tell errors apart: EEXIST for what
+// exists already, ESRCH for missing routes and ENOENT for missing
+// neighbors. Links are stored as added, with an index assigned, and handed
+// out again by LinkByName.
+type Fake struct {
+	mu        sync.Mutex
+	nextIndex int
+	links     map[int]netlink.Link
+	addrs     map[int][]netlink.Addr
+	routes    []netlink.Route
+	neighs    []netlink.Neigh
+}
+
+var _ Ops = (*Fake)(nil)
+
+// NewFake returns a fake without links
+func NewFake() *Fake {
+	return &Fake{
+		nextIndex: 1,
+		links:     make(map[int]netlink.Link),
+		addrs:     make(map[int][]netlink.Addr),
+	}
+}
+
+// Routes returns all routes, in the order they were added
+func (f *Fake) Routes() []netlink.Route {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]netlink.Route(nil), f.routes...)
+}
+
+// Neighs returns all neighbors and forwarding entries, in the order they
+// were added
+func (f *Fake) Neighs() []netlink.Neigh {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]netlink.Neigh(nil), f.neighs...)
+}
+
+func (f *Fake) linkByName(name string) (netlink.Link, error) {
+	for _, link := range f.links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("Link %s not found", name)
+}
+
+// link returns the stored link the caller's link stands for
+func (f *Fake) link(link netlink.Link) (netlink.Link, error) {
+	if l, ok := f.links[link.Attrs().Index]; ok && link.Attrs().Index != 0 {
+		return l, nil
+	}
+	return f.linkByName(link.Attrs().Name)
+}
+
+func (f *Fake) LinkByName(name string) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.linkByName(name)
+}
+
+func (f *Fake) LinkAdd(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.linkByName(link.Attrs().Name); err == nil {
+		return unix.EEXIST
+	}
+	link.Attrs().Index = f.nextIndex
+	f.nextIndex++
+	f.links[link.Attrs().Index] = link
+	return nil
+}
+
+func (f *Fake) LinkDel(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(link)
+	if err != nil {
+		return unix.ENODEV
+	}
+	index := l.Attrs().Index
+	delete(f.links, index)
+	delete(f.addrs, index)
+	// The kernel flushes what referred to the link along with it
+	routes := f.routes[:0]
+	for _, r := range f.routes {
+		if r.LinkIndex != index {
+			routes = append(routes, r)
+		}
+	}
+	f.routes = routes
+	neighs := f.neighs[:0]
+	for _, n := range f.neighs {
+		if n.LinkIndex != index {
+			neighs = append(neighs, n)
+		}
+	}
+	f.neighs = neighs
+	return nil
+}
+
+func (f *Fake) LinkSetUp(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(link)
+	if err != nil {
+		return unix.ENODEV
+	}
+	l.Attrs().Flags |= net.FlagUp
+	l.Attrs().OperState = netlink.OperUp
+	return nil
+}
+
+func (f *Fake) LinkSetMaster(link, master netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(link)
+	if err != nil {
+		return unix.ENODEV
+	}
+	m, err := f.link(master)
+	if err != nil {
+		return unix.ENODEV
+	}
+	l.Attrs().MasterIndex = m.Attrs().Index
+	return nil
+}
+
+func (f *Fake) LinkSetHairpin(link netlink.Link, mode bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(link)
+	if err != nil {
+		return unix.ENODEV
+	}
+	if l.Attrs().Protinfo == nil {
+		l.Attrs().Protinfo = &netlink.Protinfo{}
+	}
+	l.Attrs().Protinfo.Hairpin = mode
+	return nil
+}
+
+func (f *Fake) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var indexes []int
+	if link != nil {
+		l, err := f.link(link)
+		if err != nil {
+			return nil, err
+		}
+		indexes = []int{l.Attrs().Index}
+	} else {
+		for index := range f.links {
+			indexes = append(indexes, index)
+		}
+	}
+	var addrs []netlink.Addr
+	for _, index := range indexes {
+		for _, addr := range f.addrs[index] {
+			if matchFamily(family, addr.IP) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+func (f *Fake) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(link)
+	if err != nil {
+		return unix.ENODEV
+	}
+	index := l.Attrs().Index
+	for _, a := range f.addrs[index] {
+		if a.IP.Equal(addr.IP) {
+			return unix.EEXIST
+		}
+	}
+	a := *addr
+	a.LinkIndex = index
+	f.addrs[index] = append(f.addrs[index], a)
+	return nil
+}
+
+func (f *Fake) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index := 0
+	if link != nil {
+		l, err := f.link(link)
+		if err != nil {
+			return nil, err
+		}
+		index = l.Attrs().Index
+	}
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		if (index == 0 || r.LinkIndex == index) && matchFamily(family, routeIP(&r)) {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (f *Fake) RouteAdd(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(route.MultiPath) == 0 {
+		if _, ok := f.links[route.LinkIndex]; !ok {
+			return unix.ENODEV
+		}
+	}
+	for _, r := range f.routes {
+		if sameRoute(&r, route) {
+			return unix.EEXIST
+		}
+	}
+	r := *route
+	if r.Table == 0 {
+		r.Table = unix.RT_TABLE_MAIN
+	}
+	if r.Family == 0 {
+		r.Family = family(routeIP(&r))
+	}
+	f.routes = append(f.routes, r)
+	return nil
+}
+
+func (f *Fake) RouteDel(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, r := range f.routes {
+		if sameRoute(&r, route) && (route.LinkIndex == 0 || r.LinkIndex == route.LinkIndex) {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ESRCH
+}
+
+func (f *Fake) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var neighs []netlink.Neigh
+	for _, n := range f.neighs {
+		if (linkIndex == 0 || n.LinkIndex == linkIndex) && (family == unix.AF_UNSPEC || n.Family == family) {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (f *Fake) NeighSet(neigh *netlink.Neigh) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.neigh(neigh)
+	if err != nil {
+		return err
+	}
+	for i, e := range f.neighs {
+		if sameNeigh(&e, &n) {
+			f.neighs[i] = n
+			return nil
+		}
+	}
+	f.neighs = append(f.neighs, n)
+	return nil
+}
+
+func (f *Fake) NeighAppend(neigh *netlink.Neigh) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.neigh(neigh)
+	if err != nil {
+		return err
+	}
+	// Forwarding entries may repeat a MAC, for another destination
+	for _, e := range f.neighs {
+		if sameNeigh(&e, &n) && e.IP.Equal(n.IP) {
+			return unix.EEXIST
+		}
+	}
+	f.neighs = append(f.neighs, n)
+	return nil
+}
+
+func (f *Fake) NeighAppendVia(neigh *netlink.Neigh, vtepDevIndex int) error {
+	n := *neigh
+	n.Family = unix.AF_BRIDGE
+	return f.NeighAppend(&n)
+}
+
+func (f *Fake) NeighDel(neigh *netlink.Neigh) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.neigh(neigh)
+	if err != nil {
+		return err
+	}
+	for i, e := range f.neighs {
+		if sameNeigh(&e, &n) && (n.IP == nil || e.IP.Equal(n.IP)) {
+			f.neighs = append(f.neighs[:i], f.neighs[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ENOENT
+}
+
+// neigh returns the neighbor as stored, with its family set
+func (f *Fake) neigh(neigh *netlink.Neigh) (netlink.Neigh, error) {
+	if _, ok := f.links[neigh.LinkIndex]; !ok {
+		return netlink.Neigh{}, unix.ENODEV
+	}
+	n := *neigh
+	if n.Family == 0 {
+		n.Family = family(n.IP)
+	}
+	return n, nil
+}
+
+// sameNeigh reports whether two entries have the same key: the MAC for
+// forwarding entries, the address for neighbors
+func sameNeigh(a, b *netlink.Neigh) bool {
+	if a.LinkIndex != b.LinkIndex || a.Family != b.Family {
+		return false
+	}
+	if a.Family == unix.AF_BRIDGE {
+		return bytes.Equal(a.HardwareAddr, b.HardwareAddr)
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// sameRoute reports whether two routes have the same key: destination,
+// table and metric
+func sameRoute(a, b *netlink.Route) bool {
+	table := func(t int) int {
+		if t == 0 {
+			return unix.RT_TABLE_MAIN
+		}
+		return t
+	}
+	return dst(a) == dst(b) && table(a.Table) == table(b.Table) && a.Priority == b.Priority &&
+		family(routeIP(a)) == family(routeIP(b))
+}
+
+// dst returns the route's destination, empty for default routes
+func dst(r *netlink.Route) string {
+	if r.Dst == nil {
+		return ""
+	}
+	if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+		return ""
+	}
+	return r.Dst.String()
+}
+
+// routeIP returns an address telling the route's family
+func routeIP(r *netlink.Route) net.IP {
+	switch {
+	case r.Dst != nil:
+		return r.Dst.IP
+	case r.Gw != nil:
+		return r.Gw
+	case len(r.MultiPath) > 0:
+		return r.MultiPath[0].Gw
+	}
+	return r.Src
+}
+
+// family returns the address family of an address
+func family(ip net.IP) int {
+	if ip == nil {
+		return unix.AF_UNSPEC
+	}
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// matchFamily reports whether the address is of the family, any matching
+// FAMILY_ALL
+func matchFamily(want int, ip net.IP) bool {
+	return want == netlink.FAMILY_ALL || family(ip) == want
+}
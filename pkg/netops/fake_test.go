@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package netops
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFake(t *testing.T) {
+	f := NewFake()
+	link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "xvmbr10"}}
+	if err := f.LinkAdd(link); err != nil || link.Index == 0 {
+		t.Fatalf("Failed to add link: %v", err)
+	}
+	if err := f.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "xvmbr10"}}); !errors.Is(err, unix.EEXIST) {
+		t.Fatalf("Expected EEXIST for a taken name, got %v", err)
+	}
+
+	// Routes are keyed by destination and metric, and default to the main
+	// table like the kernel's
+	_, dst, _ := net.ParseCIDR("10.96.0.0/12")
+	route := &netlink.Route{LinkIndex: link.Index, Dst: dst}
+	if err := f.RouteAdd(route); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := f.RouteAdd(route); !errors.Is(err, unix.EEXIST) {
+		t.Fatalf("Expected EEXIST for a duplicate route, got %v", err)
+	}
+	if routes, _ := f.RouteList(nil, netlink.FAMILY_V6); len(routes) != 0 {
+		t.Fatalf("Expected no IPv6 routes, got %v", routes)
+	}
+	if routes, _ := f.RouteList(link, netlink.FAMILY_V4); len(routes) != 1 || routes[0].Table != unix.RT_TABLE_MAIN {
+		t.Fatalf("Expected route in the main table, got %v", routes)
+	}
+
+	// Flood entries share the all-zeros MAC, so they are appended
+	zero := make(net.HardwareAddr, 6)
+	for _, vtep := range []string{"192.168.1.2", "192.168.1.3"} {
+		e := &netlink.Neigh{LinkIndex: link.Index, Family: unix.AF_BRIDGE, HardwareAddr: zero, IP: net.ParseIP(vtep)}
+		if err := f.NeighAppend(e); err != nil {
+			t.Fatalf("Failed to append entry: %v", err)
+		}
+	}
+	if fdb, _ := f.NeighList(link.Index, unix.AF_BRIDGE); len(fdb) != 2 {
+		t.Fatalf("Expected 2 forwarding entries, got %v", fdb)
+	}
+	if err := f.NeighDel(&netlink.Neigh{LinkIndex: link.Index, IP: net.ParseIP("10.244.0.1")}); !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("Expected ENOENT for a missing neighbor, got %v", err)
+	}
+
+	// Deleting the link flushes what referred to it
+	if err := f.LinkDel(link); err != nil {
+		t.Fatalf("Failed to delete link: %v", err)
+	}
+	if len(f.Routes()) != 0 || len(f.Neighs()) != 0 {
+		t.Fatalf("Expected routes and entries to be flushed, got %v, %v", f.Routes(), f.Neighs())
+	}
+	if err := f.RouteDel(route); !errors.Is(err, unix.ESRCH) {
+		t.Fatalf("Expected ESRCH for a missing route, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+// Package netops is the netlink operations the plugin makes, behind an
+// interface, so the logic making them can be tested against an in-memory
+// fake and other datapaths can stand in for the kernel's
+package netops
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Ops makes netlink requests in the current network namespace. The methods
+// behave like the vishvananda/netlink functions of the same name.
+type Ops interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetMaster(link, master netlink.Link) error
+	LinkSetHairpin(link netlink.Link, mode bool) error
+
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+
+	// RouteList lists the routes of the link, or of all links if nil
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+
+	// NeighList lists the neighbors of the link, or of all links if the
+	// index is 0; AF_BRIDGE lists forwarding entries
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	NeighSet(neigh *netlink.Neigh) error
+	NeighAppend(neigh *netlink.Neigh) error
+	// NeighAppendVia appends a forwarding entry of a VXLAN device sent
+	// through the underlay device with the given index, which NeighAppend
+	// can't name
+	NeighAppendVia(neigh *netlink.Neigh, vtepDevIndex int) error
+	NeighDel(neigh *netlink.Neigh) error
+}
+
+// Kernel makes the requests to the kernel
+type Kernel struct{}
+
+var _ Ops = Kernel{}
+
+func (Kernel) LinkByName(name string) (netlink.Link, error) { return netlink.LinkByName(name) }
+func (Kernel) LinkAdd(link netlink.Link) error              { return netlink.LinkAdd(link) }
+func (Kernel) LinkDel(link netlink.Link) error              { return netlink.LinkDel(link) }
+func (Kernel) LinkSetUp(link netlink.Link) error            { return netlink.LinkSetUp(link) }
+
+func (Kernel) LinkSetMaster(link, master netlink.Link) error {
+	return netlink.LinkSetMaster(link, master)
+}
+func (Kernel) LinkSetHairpin(link netlink.Link, mode bool) error {
+	return netlink.LinkSetHairpin(link, mode)
+}
+
+func (Kernel) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+func (Kernel) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (Kernel) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+func (Kernel) RouteAdd(route *netlink.Route) error { return netlink.RouteAdd(route) }
+func (Kernel) RouteDel(route *netlink.Route) error { return netlink.RouteDel(route) }
+
+func (Kernel) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(linkIndex, family)
+}
+func (Kernel) NeighSet(neigh *netlink.Neigh) error    { return netlink.NeighSet(neigh) }
+func (Kernel) NeighAppend(neigh *netlink.Neigh) error { return netlink.NeighAppend(neigh) }
+func (Kernel) NeighDel(neigh *netlink.Neigh) error    { return netlink.NeighDel(neigh) }
+
+func (Kernel) NeighAppendVia(neigh *netlink.Neigh, vtepDevIndex int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWNEIGH, unix.NLM_F_CREATE|unix.NLM_F_APPEND|unix.NLM_F_ACK)
+	req.AddData(&netlink.Ndmsg{
+		Family: unix.AF_BRIDGE,
+		Index:  uint32(neigh.LinkIndex),
+		State:  uint16(neigh.State),
+		Flags:  uint8(neigh.Flags),
+	})
+	req.AddData(nl.NewRtAttr(netlink.NDA_LLADDR, []byte(neigh.HardwareAddr)))
+	dst := neigh.IP.To4()
+	if dst == nil {
+		dst = neigh.IP.To16()
+	}
+	req.AddData(nl.NewRtAttr(netlink.NDA_DST, dst))
+	if vtepDevIndex != 0 {
+		req.AddData(nl.NewRtAttr(netlink.NDA_IFINDEX, nl.Uint32Attr(uint32(vtepDevIndex))))
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package nft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Object is an entry of the JSON output of nft list commands. Only the
+// fields the plugin reads are decoded.
+type Object struct {
+	Table *Table `json:"table,omitempty"`
+	Chain *Chain `json:"chain,omitempty"`
+	Rule  *Rule  `json:"rule,omitempty"`
+}
+
+// Table is a table in nft's JSON output
+type Table struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+}
+
+// Chain is a chain in nft's JSON output. Base chains have a type and hook.
+type Chain struct {
+	Family  string `json:"family"`
+	Table   string `json:"table"`
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+	Type    string `json:"type"`
+	Hook    string `json:"hook"`
+}
+
+// Rule is a rule in nft's JSON output
+type Rule struct {
+	Family  string `json:"family"`
+	Table   string `json:"table"`
+	Chain   string `json:"chain"`
+	Handle  int    `json:"handle"`
+	Comment string `json:"comment"`
+}
+
+// Apply runs the nft script. nft applies a script as one transaction, so
+// either all of its commands take effect or none.
+func Apply(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// HasTable reports whether the table exists. Without nft installed, none of
+// the plugin's tables can.
+func HasTable(family, table string) (bool, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false, nil
+	}
+	tables, err := list("list", "tables", family)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range tables {
+		if object.Table != nil && object.Table.Name == table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListTable returns the objects of the table, or none if it doesn't exist
+func ListTable(family, table string) ([]Object, error) {
+	found, err := HasTable(family, table)
+	if err != nil || !found {
+		return nil, err
+	}
+	return list("list", "table", family, table)
+}
+
+// ListChains returns the chains of every table
+func ListChains() ([]Object, error) {
+	return list("list", "chains")
+}
+
+// ListChain returns the chain and its rules
+func ListChain(family, table, chain string) ([]Object, error) {
+	return list("list", "chain", family, table, chain)
+}
+
+// list runs an nft list command and decodes its JSON output
+func list(args ...string) ([]Object, error) {
+	out, err := exec.Command("nft", append([]string{"--json"}, args...)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to %s: %v", strings.Join(args, " "), err)
+	}
+	var output struct {
+		Nftables []Object `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse output of %s: %v", strings.Join(args, " "), err)
+	}
+	return output.Nftables, nil
+}
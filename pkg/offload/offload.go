@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+// Package offload turns the segmentation and receive offloads of the devices
+// the plugin creates on or off, for kernels and NICs where the defaults hurt,
+// such as GRO on VXLAN devices reordering packets
+package offload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/safchain/ethtool"
+)
+
+// features maps the settings to the ethtool features they toggle
+var features = map[string][]string{
+	"gso": {"tx-generic-segmentation"},
+	"tso": {"tx-tcp-segmentation", "tx-tcp6-segmentation"},
+	"gro": {"rx-gro"},
+}
+
+// Settings holds the offloads of a device. Unset ones keep the kernel's
+// default.
+type Settings struct {
+	// GSO is generic segmentation offload
+	GSO *bool `json:"gso,omitempty"`
+	// TSO is TCP segmentation offload, for IPv4 and IPv6
+	TSO *bool `json:"tso,omitempty"`
+	// GRO is generic receive offload
+	GRO *bool `json:"gro,omitempty"`
+}
+
+// IsEmpty reports whether the settings leave every offload alone
+func (s *Settings) IsEmpty() bool {
+	return s == nil || (s.GSO == nil && s.TSO == nil && s.GRO == nil)
+}
+
+// Features returns the ethtool features the settings set and their state
+func (s *Settings) Features() map[string]bool {
+	result := make(map[string]bool)
+	if s == nil {
+		return result
+	}
+	for name, value := range map[string]*bool{"gso": s.GSO, "tso": s.TSO, "gro": s.GRO} {
+		if value == nil {
+			continue
+		}
+		for _, feature := range features[name] {
+			result[feature] = *value
+		}
+	}
+	return result
+}
+
+// String describes the settings, e.g. "gro off, gso on"
+func (s *Settings) String() string {
+	var parts []string
+	if s != nil {
+		for name, value := range map[string]*bool{"gso": s.GSO, "tso": s.TSO, "gro": s.GRO} {
+			if value == nil {
+				continue
+			}
+			state := "off"
+			if *value {
+				state = "on"
+			}
+			parts = append(parts, name+" "+state)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// Apply sets the offloads of the device in the current network namespace
+func Apply(device string, s *Settings) error {
+	if s.IsEmpty() {
+		return nil
+	}
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return fmt.Errorf("failed to open ethtool: %v", err)
+	}
+	defer e.Close()
+	if err := e.Change(device, s.Features()); err != nil {
+		return fmt.Errorf("failed to set offloads of %s: %v", device, err)
+	}
+	return nil
+}
+
+// Check returns the offloads of the device in the current network namespace
+// that differ from the settings, as "<feature> on|off" of the wanted state
+func Check(device string, s *Settings) ([]string, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ethtool: %v", err)
+	}
+	defer e.Close()
+	current, err := e.Features(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get offloads of %s: %v", device, err)
+	}
+	return diff(current, s.Features()), nil
+}
+
+// diff returns the wanted features whose current state differs, sorted
+func diff(current, want map[string]bool) []string {
+	var differing []string
+	for feature, on := range want {
+		if current[feature] == on {
+			continue
+		}
+		state := "off"
+		if on {
+			state = "on"
+		}
+		differing = append(differing, feature+" "+state)
+	}
+	sort.Strings(differing)
+	return differing
+}
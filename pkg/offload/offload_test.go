@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package offload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	off, on := false, true
+	s := &Settings{TSO: &on, GRO: &off}
+	want := map[string]bool{"tx-tcp-segmentation": true, "tx-tcp6-segmentation": true, "rx-gro": false}
+	if got := s.Features(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected features %v, got %v", want, got)
+	}
+	if s.String() != "gro off, tso on" {
+		t.Fatalf("Unexpected description %q", s.String())
+	}
+	if !(&Settings{}).IsEmpty() || s.IsEmpty() {
+		t.Fatalf("Unexpected emptiness")
+	}
+
+	// Only the wanted features are compared
+	current := map[string]bool{"tx-tcp-segmentation": true, "tx-tcp6-segmentation": false, "rx-gro": false, "rx-checksum": true}
+	if got := diff(current, want); !reflect.DeepEqual(got, []string{"tx-tcp6-segmentation on"}) {
+		t.Fatalf("Unexpected differing features %v", got)
+	}
+}
@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package ovs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DatapathNetdev is the userspace (DPDK) datapath needed for vhost-user
+	DatapathNetdev = "netdev"
+
+	// attachmentID is the external ID marking ports owned by xvm-cni
+	attachmentID = "xvm-cni-attachment"
+)
+
+// Runner runs ovs-vsctl with the given arguments and returns its output
+type Runner func(args ...string) (string, error)
+
+// VSCtl runs the ovs-vsctl binary
+func VSCtl(args ...string) (string, error) {
+	cmd := exec.Command("ovs-vsctl", append([]string{"--timeout=10"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ovs-vsctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Client manages OVS bridges and ports
+type Client struct {
+	run Runner
+}
+
+// New returns a client using the given runner, or ovs-vsctl if nil
+func New(run Runner) *Client {
+	if run == nil {
+		run = VSCtl
+	}
+	return &Client{run: run}
+}
+
+// BridgeName returns the name of the OVS bridge for a VXLAN ID
+func BridgeName(vxlanID int) string {
+	return fmt.Sprintf("xvmovs%d", vxlanID)
+}
+
+// VxlanPortName returns the name of the VXLAN tunnel port to a remote VTEP
+func VxlanPortName(vxlanID int, remote net.IP) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", vxlanID, remote)))
+	return "xvmvx" + hex.EncodeToString(hash[:])[:8]
+}
+
+// SetupBridge creates the bridge if it doesn't exist yet. An empty datapath
+// type keeps the OVS default.
+func (c *Client) SetupBridge(name, datapathType string) error {
+	args := []string{"--may-exist", "add-br", name}
+	if datapathType != "" {
+		args = append(args, "--", "set", "bridge", name, "datapath_type="+datapathType)
+	}
+	if _, err := c.run(args...); err != nil {
+		return fmt.Errorf("failed to create OVS bridge %s: %v", name, err)
+	}
+	return nil
+}
+
+// DelBridge removes the bridge along with all of its ports
+func (c *Client) DelBridge(name string) error {
+	if _, err := c.run("--if-exists", "del-br", name); err != nil {
+		return fmt.Errorf("failed to delete OVS bridge %s: %v", name, err)
+	}
+	return nil
+}
+
+// AddVxlanPort adds a VXLAN tunnel port to the remote VTEP
+func (c *Client) AddVxlanPort(bridge string, vxlanID, dstPort int, local, remote net.IP) error {
+	name := VxlanPortName(vxlanID, remote)
+	_, err := c.run("--may-exist", "add-port", bridge, name,
+		"--", "set", "interface", name, "type=vxlan",
+		"options:key="+strconv.Itoa(vxlanID),
+		"options:dst_port="+strconv.Itoa(dstPort),
+		"options:local_ip="+local.String(),
+		"options:remote_ip="+remote.String())
+	if err != nil {
+		return fmt.Errorf("failed to add VXLAN port to %s: %v", remote, err)
+	}
+	return nil
+}
+
+// AddPort adds an existing interface to the bridge as the given attachment's
+// port
+func (c *Client) AddPort(bridge, name, attachment string) error {
+	_, err := c.run("--may-exist", "add-port", bridge, name,
+		"--", "set", "interface", name, externalID(attachment))
+	if err != nil {
+		return fmt.Errorf("failed to add port %s to OVS bridge %s: %v", name, bridge, err)
+	}
+	return nil
+}
+
+// AddVhostUserPort adds a vhost-user client port connecting to the socket a
+// VM creates at socketPath
+func (c *Client) AddVhostUserPort(bridge, name, socketPath, attachment string) error {
+	_, err := c.run("--may-exist", "add-port", bridge, name,
+		"--", "set", "interface", name, "type=dpdkvhostuserclient",
+		"options:vhost-server-path="+socketPath, externalID(attachment))
+	if err != nil {
+		return fmt.Errorf("failed to add vhost-user port %s to OVS bridge %s: %v", name, bridge, err)
+	}
+	return nil
+}
+
+// DelPort removes the port from the bridge
+func (c *Client) DelPort(bridge, name string) error {
+	if _, err := c.run("--if-exists", "del-port", bridge, name); err != nil {
+		return fmt.Errorf("failed to delete port %s from OVS bridge %s: %v", name, bridge, err)
+	}
+	return nil
+}
+
+// BridgeExists reports whether the bridge exists
+func (c *Client) BridgeExists(name string) (bool, error) {
+	out, err := c.run("--if-exists", "list-br")
+	if err != nil {
+		return false, fmt.Errorf("failed to list OVS bridges: %v", err)
+	}
+	for _, br := range strings.Fields(out) {
+		if br == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Attachments returns the ports on the bridge owned by xvm-cni, mapped to
+// the attachment they belong to
+func (c *Client) Attachments(bridge string) (map[string]string, error) {
+	out, err := c.run("list-ports", bridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports of OVS bridge %s: %v", bridge, err)
+	}
+
+	ports := make(map[string]string)
+	for _, port := range strings.Fields(out) {
+		value, err := c.run("--if-exists", "get", "interface", port, "external_ids:"+attachmentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get attachment of port %s: %v", port, err)
+		}
+		if attachment := strings.Trim(value, `"`); attachment != "" {
+			ports[port] = attachment
+		}
+	}
+	return ports, nil
+}
+
+// FindPort returns the port of the attachment on the bridge, or an empty
+// name if there is none
+func (c *Client) FindPort(bridge, attachment string) (string, error) {
+	ports, err := c.Attachments(bridge)
+	if err != nil {
+		return "", err
+	}
+	for port, owner := range ports {
+		if owner == attachment {
+			return port, nil
+		}
+	}
+	return "", nil
+}
+
+// externalID returns the column setting marking a port as the attachment's
+func externalID(attachment string) string {
+	return fmt.Sprintf("external_ids:%s=%q", attachmentID, attachment)
+}
@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package ovs
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeVSCtl records ovs-vsctl invocations and answers queries from a fixed
+// set of ports
+type fakeVSCtl struct {
+	calls []string
+	ports map[string]string
+}
+
+func (f *fakeVSCtl) run(args ...string) (string, error) {
+	call := strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+	switch {
+	case args[0] == "list-ports":
+		var names []string
+		for name := range f.ports {
+			names = append(names, name)
+		}
+		return strings.Join(names, "\n"), nil
+	case len(args) > 3 && args[1] == "get":
+		if attachment := f.ports[args[3]]; attachment != "" {
+			return `"` + attachment + `"`, nil
+		}
+	}
+	return "", nil
+}
+
+func TestVxlanPortName(t *testing.T) {
+	remote := net.ParseIP("192.168.1.20")
+	name := VxlanPortName(10, remote)
+
+	// Port names must be stable and fit the 15 character interface limit
+	if name != VxlanPortName(10, remote) {
+		t.Fatalf("Port name is not deterministic")
+	}
+	if len(name) > 15 {
+		t.Fatalf("Port name %s is longer than 15 characters", name)
+	}
+	if name == VxlanPortName(10, net.ParseIP("192.168.1.21")) || name == VxlanPortName(20, remote) {
+		t.Fatalf("Different tunnels share port name %s", name)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeVSCtl{}
+	client := New(fake.run)
+
+	// Bridges and ports are created idempotently
+	if err := client.SetupBridge("xvmovs10", DatapathNetdev); err != nil {
+		t.Fatalf("Failed to setup bridge: %v", err)
+	}
+	if err := client.AddVxlanPort("xvmovs10", 10, 4789, net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.20")); err != nil {
+		t.Fatalf("Failed to add VXLAN port: %v", err)
+	}
+	if err := client.AddVhostUserPort("xvmovs10", "vhu1", "/run/vhu1.sock", "c1/eth0"); err != nil {
+		t.Fatalf("Failed to add vhost-user port: %v", err)
+	}
+	for i, want := range []string{
+		"--may-exist add-br xvmovs10 -- set bridge xvmovs10 datapath_type=netdev",
+		"options:key=10 options:dst_port=4789 options:local_ip=192.168.1.10 options:remote_ip=192.168.1.20",
+		`type=dpdkvhostuserclient options:vhost-server-path=/run/vhu1.sock external_ids:xvm-cni-attachment="c1/eth0"`,
+	} {
+		if !strings.Contains(fake.calls[i], want) {
+			t.Fatalf("Expected call %d to contain %q, got %q", i, want, fake.calls[i])
+		}
+	}
+
+	// Only ports owned by xvm-cni are reported
+	fake.ports = map[string]string{"veth1": "c1/eth0", "xvmvx12345678": ""}
+	ports, err := client.Attachments("xvmovs10")
+	if err != nil {
+		t.Fatalf("Failed to list attachments: %v", err)
+	}
+	if len(ports) != 1 || ports["veth1"] != "c1/eth0" {
+		t.Fatalf("Unexpected attachments: %v", ports)
+	}
+	port, err := client.FindPort("xvmovs10", "c1/eth0")
+	if err != nil || port != "veth1" {
+		t.Fatalf("Expected port veth1, got %q: %v", port, err)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// family is the nftables family of the clamping chain. Its egress hook
+	// sees the frames the VXLAN device encapsulates, whether bridged or
+	// routed to it.
+	family = "netdev"
+	// chain is the name of the clamping chain
+	chain = "clamp"
+
+	// tcpIPv4Overhead and tcpIPv6Overhead are what the IP and TCP headers
+	// take off the MTU for the maximum segment size
+	tcpIPv4Overhead = 20 + 20
+	tcpIPv6Overhead = 40 + 20
+)
+
+// Clamp limits the TCP connections tunneled to a peer to segments that fit
+// the MTU its underlay path carries encapsulated
+type Clamp struct {
+	// MACs are the addresses the VXLAN device tunnels to the peer
+	MACs []net.HardwareAddr
+	// MTU is the largest inner packet the path carries
+	MTU int
+}
+
+// TableName returns the nftables table holding the clamping chain of a
+// network
+func TableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-pmtu-vni%d", vni)
+}
+
+// ClampRuleset returns the nft script SetupClamping applies. It creates the
+// chain on the device's egress hook, or flushes it if it exists, and fills
+// it with a rule lowering the MSS of SYNs to each peer's MACs.
+func ClampRuleset(table, device string, clamps []Clamp) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", family, table)
+	fmt.Fprintf(&b, "add chain %s %s %s { type filter hook egress device \"%s\" priority 0; policy accept; }\n", family, table, chain, device)
+	fmt.Fprintf(&b, "flush chain %s %s %s\n", family, table, chain)
+	for _, c := range clamps {
+		if len(c.MACs) == 0 {
+			continue
+		}
+		macs := make([]string, len(c.MACs))
+		for i, mac := range c.MACs {
+			macs[i] = mac.String()
+		}
+		set := strings.Join(macs, ", ")
+		for _, v := range []struct {
+			etherType string
+			mss       int
+		}{{"ip", c.MTU - tcpIPv4Overhead}, {"ip6", c.MTU - tcpIPv6Overhead}} {
+			fmt.Fprintf(&b, "add rule %s %s %s ether daddr { %s } ether type %s tcp flags & syn == syn tcp option maxseg size > %d tcp option maxseg size set %d\n",
+				family, table, chain, set, v.etherType, v.mss, v.mss)
+		}
+	}
+	return b.String()
+}
+
+// SetupClamping installs the clamping of the connections tunneled through
+// the VXLAN device, replacing what it had before
+func SetupClamping(table, device string, clamps []Clamp) error {
+	for _, c := range clamps {
+		if c.MTU <= tcpIPv6Overhead {
+			return fmt.Errorf("MTU %d too small to clamp to", c.MTU)
+		}
+	}
+	if err := nft.Apply(ClampRuleset(table, device, clamps)); err != nil {
+		return fmt.Errorf("failed to install MSS clamping on %s: %v", device, err)
+	}
+	return nil
+}
+
+// RemoveClamping removes the network's clamping table. It is idempotent.
+func RemoveClamping(table string) error {
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClampRuleset(t *testing.T) {
+	mac1, _ := net.ParseMAC("02:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("02:00:00:00:00:02")
+	table := TableName(42)
+	ruleset := ClampRuleset(table, "xvx-net", []Clamp{
+		{MACs: []net.HardwareAddr{mac1, mac2}, MTU: 1400},
+		{MTU: 1300},
+	})
+
+	for _, want := range []string{
+		"add chain netdev xvm-cni-pmtu-vni42 clamp { type filter hook egress device \"xvx-net\" priority 0; policy accept; }",
+		"flush chain netdev xvm-cni-pmtu-vni42 clamp",
+		"add rule netdev xvm-cni-pmtu-vni42 clamp ether daddr { 02:00:00:00:00:01, 02:00:00:00:00:02 } ether type ip tcp flags & syn == syn tcp option maxseg size > 1360 tcp option maxseg size set 1360",
+		"add rule netdev xvm-cni-pmtu-vni42 clamp ether daddr { 02:00:00:00:00:01, 02:00:00:00:00:02 } ether type ip6 tcp flags & syn == syn tcp option maxseg size > 1340 tcp option maxseg size set 1340",
+	} {
+		if !strings.Contains(ruleset, want+"\n") {
+			t.Errorf("Ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+	// Peers without MACs have nothing tunneled to them to clamp
+	if strings.Count(ruleset, "add rule") != 2 {
+		t.Errorf("Expected 2 rules, got:\n%s", ruleset)
+	}
+
+	if err := SetupClamping(table, "xvx-net", []Clamp{{MACs: []net.HardwareAddr{mac1}, MTU: 60}}); err == nil {
+		t.Errorf("Expected too small MTU to be rejected")
+	}
+}
@@ -0,0 +1,306 @@
+//go:build linux
+// +build linux
+
+// Package pmtu probes whether the underlay path to a peer carries packets of
+// a size unfragmented, so an overlay whose encapsulated frames exceed the
+// path MTU is caught before it silently drops large packets
+package pmtu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultTimeout is how long a probe waits for the peer's reply
+	DefaultTimeout = time.Second
+
+	// ipv4HeaderLen is the size of an IPv4 header without options
+	ipv4HeaderLen = 20
+	// smallSize is the size of the probe checking that the peer answers
+	smallSize = 64
+
+	icmpEchoReply   = 0
+	icmpUnreachable = 3
+	icmpEcho        = 8
+	// icmpFragNeeded is the unreachable code of routers dropping packets
+	// with DF set that exceed the next hop's MTU
+	icmpFragNeeded = 4
+)
+
+// ErrNoReply is returned when the peer doesn't answer even small probes, so
+// the path can't be checked
+var ErrNoReply = errors.New("no reply to ICMP echo")
+
+// Error reports a path that doesn't carry packets of Size bytes
+type Error struct {
+	Peer net.IP
+	Size int
+	// MTU is the path MTU the kernel or a router reported, 0 if the large
+	// probes were dropped without notice
+	MTU int
+}
+
+func (e *Error) Error() string {
+	if e.MTU != 0 {
+		return fmt.Sprintf("path to %s carries at most %d byte packets, not %d", e.Peer, e.MTU, e.Size)
+	}
+	return fmt.Sprintf("%d byte packets to %s are dropped while smaller ones are answered", e.Size, e.Peer)
+}
+
+// Probe checks that packets of size bytes, IPv4 header included, sent with
+// DF set through dev reach the peer. It returns ErrNoReply if the peer
+// doesn't answer a small probe, and an *Error if it answers that one only.
+func Probe(dev string, peer net.IP, size int, timeout time.Duration) error {
+	dst := peer.To4()
+	if dst == nil {
+		return fmt.Errorf("peer %s is not an IPv4 address", peer)
+	}
+	if size < smallSize {
+		return fmt.Errorf("probe size %d below %d", size, smallSize)
+	}
+	p, err := newProber(dev, dst, timeout)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	if err := p.echo(smallSize); err != nil {
+		return err
+	}
+	if err := p.echo(size); errors.Is(err, ErrNoReply) {
+		return &Error{Peer: peer, Size: size}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Discover returns the size of the largest packets, at most size, that
+// reach the peer, bisecting with probes. Paths whose MTU is reported are
+// cut short to it. It returns ErrNoReply if the peer doesn't answer a small
+// probe.
+func Discover(dev string, peer net.IP, size int, timeout time.Duration) (int, error) {
+	dst := peer.To4()
+	if dst == nil {
+		return 0, fmt.Errorf("peer %s is not an IPv4 address", peer)
+	}
+	p, err := newProber(dev, dst, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer p.close()
+
+	if err := p.echo(smallSize); err != nil {
+		return 0, err
+	}
+	lo, hi := smallSize, size
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		err := p.echo(mid)
+		var perr *Error
+		switch {
+		case err == nil:
+			lo = mid
+		case errors.As(err, &perr) && perr.MTU >= lo && perr.MTU < mid:
+			hi = perr.MTU
+		case errors.Is(err, ErrNoReply) || errors.As(err, &perr):
+			hi = mid - 1
+		default:
+			return 0, err
+		}
+	}
+	return lo, nil
+}
+
+// ProbePeers probes the peers concurrently and returns the first error
+// other than ErrNoReply. Peers that don't answer at all are skipped, as they
+// may be down rather than behind a path of a smaller MTU.
+func ProbePeers(dev string, peers []net.IP, size int, timeout time.Duration) error {
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = Probe(dev, peer, size, timeout)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, ErrNoReply) {
+			return err
+		}
+	}
+	return nil
+}
+
+// prober sends the echo requests of a probe and waits for their replies
+type prober struct {
+	fd      int
+	peer    net.IP
+	id      uint16
+	seq     uint16
+	timeout time.Duration
+}
+
+// newProber opens a raw ICMP socket sending to the IPv4 peer through dev
+// with DF set
+func newProber(dev string, peer net.IP, timeout time.Duration) (*prober, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	p := &prober{fd: fd, peer: peer, id: uint16(os.Getpid()), timeout: timeout}
+	if dev != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, dev); err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to bind ICMP socket to %s: %v", dev, err)
+		}
+	}
+	// Set DF without being held to the path MTU the kernel cached, which
+	// may predate a fix of the path
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE); err != nil {
+		p.close()
+		return nil, fmt.Errorf("failed to set DF on ICMP socket: %v", err)
+	}
+	tv := unix.NsecToTimeval((timeout / 10).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		p.close()
+		return nil, fmt.Errorf("failed to set ICMP socket timeout: %v", err)
+	}
+	return p, nil
+}
+
+func (p *prober) close() {
+	unix.Close(p.fd)
+}
+
+// echo sends an echo request of size bytes and waits for the reply, or a
+// router reporting the packet too big
+func (p *prober) echo(size int) error {
+	p.seq++
+	seq := p.seq
+	req := make([]byte, size-ipv4HeaderLen)
+	req[0] = icmpEcho
+	binary.BigEndian.PutUint16(req[4:], p.id)
+	binary.BigEndian.PutUint16(req[6:], seq)
+	binary.BigEndian.PutUint16(req[2:], checksum(req))
+
+	sa := &unix.SockaddrInet4{}
+	copy(sa.Addr[:], p.peer)
+	if err := unix.Sendto(p.fd, req, 0, sa); errors.Is(err, unix.EMSGSIZE) {
+		// The packet doesn't fit the route's MTU on this node already
+		return &Error{Peer: p.peer, Size: size, MTU: routeMTU(p.peer)}
+	} else if err != nil {
+		return fmt.Errorf("failed to send ICMP echo to %s: %v", p.peer, err)
+	}
+
+	// The raw socket sees every ICMP packet of the node, pick ours
+	buf := make([]byte, 1<<16)
+	deadline := time.Now().Add(p.timeout)
+	for time.Now().Before(deadline) {
+		n, _, err := unix.Recvfrom(p.fd, buf, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive ICMP: %v", err)
+		}
+		if mtu, ok := p.match(buf[:n], seq); ok {
+			if mtu != 0 {
+				return &Error{Peer: p.peer, Size: size, MTU: mtu}
+			}
+			return nil
+		}
+	}
+	return ErrNoReply
+}
+
+// match reports whether the IPv4 packet answers the echo request of the
+// sequence number, with the MTU a router reported if it's fragmentation
+// needed
+func (p *prober) match(pkt []byte, seq uint16) (int, bool) {
+	icmp, src, ok := parseIPv4(pkt)
+	if !ok || len(icmp) < 8 {
+		return 0, false
+	}
+	switch icmp[0] {
+	case icmpEchoReply:
+		return 0, src.Equal(p.peer) && p.ours(icmp, seq)
+	case icmpUnreachable:
+		if icmp[1] != icmpFragNeeded {
+			return 0, false
+		}
+		// The error quotes our request's IPv4 header and first 8 bytes
+		quoted := icmp[8:]
+		orig, _, ok := parseIPv4(quoted)
+		if !ok || len(orig) < 8 || orig[0] != icmpEcho || !net.IP(quoted[16:20]).Equal(p.peer) || !p.ours(orig, seq) {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(icmp[6:])), true
+	}
+	return 0, false
+}
+
+// ours reports whether the ICMP echo header carries the probe's identifier
+// and the sequence number
+func (p *prober) ours(icmp []byte, seq uint16) bool {
+	return binary.BigEndian.Uint16(icmp[4:]) == p.id && binary.BigEndian.Uint16(icmp[6:]) == seq
+}
+
+// parseIPv4 returns the payload and source address of an IPv4 packet
+func parseIPv4(pkt []byte) ([]byte, net.IP, bool) {
+	if len(pkt) < ipv4HeaderLen || pkt[0]>>4 != 4 {
+		return nil, nil, false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < ipv4HeaderLen || len(pkt) < ihl {
+		return nil, nil, false
+	}
+	return pkt[ihl:], net.IP(pkt[12:16]), true
+}
+
+// routeMTU returns the MTU of the node's route to the peer, 0 if unknown
+func routeMTU(peer net.IP) int {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0
+	}
+	defer unix.Close(fd)
+	sa := &unix.SockaddrInet4{Port: 9}
+	copy(sa.Addr[:], peer)
+	if err := unix.Connect(fd, sa); err != nil {
+		return 0
+	}
+	mtu, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU)
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
+
+// checksum returns the internet checksum of the ICMP message
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
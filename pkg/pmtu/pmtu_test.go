@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+// ipv4 returns an IPv4 packet of the payload from src to dst
+func ipv4(src, dst net.IP, payload []byte) []byte {
+	pkt := make([]byte, 20, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(20+len(payload)))
+	pkt[9] = 1
+	copy(pkt[12:], src.To4())
+	copy(pkt[16:], dst.To4())
+	return append(pkt, payload...)
+}
+
+// echo returns an ICMP echo header of the type, identifier and sequence
+func echo(typ byte, id, seq uint16) []byte {
+	icmp := make([]byte, 8)
+	icmp[0] = typ
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[6:], seq)
+	return icmp
+}
+
+func TestChecksum(t *testing.T) {
+	msg := echo(icmpEcho, 0x1234, 1)
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	if checksum(msg) != 0 {
+		t.Fatalf("Expected a message with its checksum to sum to 0, got %#x", checksum(msg))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	self := net.ParseIP("192.168.1.1").To4()
+	peer := net.ParseIP("192.168.1.2").To4()
+	router := net.ParseIP("10.0.0.1").To4()
+	p := &prober{peer: peer, id: 7}
+
+	// The peer's reply to the request
+	if mtu, ok := p.match(ipv4(peer, self, echo(icmpEchoReply, 7, 2)), 2); !ok || mtu != 0 {
+		t.Fatalf("Expected reply to match, got %d, %v", mtu, ok)
+	}
+	for name, pkt := range map[string][]byte{
+		"other sequence": ipv4(peer, self, echo(icmpEchoReply, 7, 1)),
+		"other prober":   ipv4(peer, self, echo(icmpEchoReply, 8, 2)),
+		"other host":     ipv4(router, self, echo(icmpEchoReply, 7, 2)),
+		"own request":    ipv4(self, peer, echo(icmpEcho, 7, 2)),
+		"truncated":      ipv4(peer, self, nil)[:12],
+	} {
+		if _, ok := p.match(pkt, 2); ok {
+			t.Errorf("Expected %s not to match", name)
+		}
+	}
+
+	// A router on the way reporting the request too big
+	fragNeeded := echo(icmpUnreachable, 0, 1400)
+	fragNeeded[1] = icmpFragNeeded
+	fragNeeded = append(fragNeeded, ipv4(self, peer, echo(icmpEcho, 7, 2))...)
+	if mtu, ok := p.match(ipv4(router, self, fragNeeded), 2); !ok || mtu != 1400 {
+		t.Fatalf("Expected fragmentation needed with MTU 1400, got %d, %v", mtu, ok)
+	}
+	if _, ok := p.match(ipv4(router, self, fragNeeded), 3); ok {
+		t.Fatalf("Expected fragmentation needed for another request not to match")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	loopback := net.ParseIP("127.0.0.1")
+	if err := Probe("lo", loopback, 9000, 0); err != nil {
+		t.Fatalf("Expected loopback to carry jumbo frames, got: %v", err)
+	}
+	var perr *Error
+	if err := Probe("lo", loopback, 1<<17, 0); !errors.As(err, &perr) || perr.MTU == 0 {
+		t.Fatalf("Expected a probe beyond the loopback MTU to fail with it, got: %v", err)
+	}
+
+	// Discovery stops at the size asked for on a path carrying more
+	if size, err := Discover("lo", loopback, 9000, 0); err != nil || size != 9000 {
+		t.Fatalf("Expected to discover 9000 bytes, got %d: %v", size, err)
+	}
+}
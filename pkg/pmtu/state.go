@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stateFile is the file in a network's data directory the agent records the
+// network's blackholes in
+const stateFile = "pmtu.json"
+
+// Blackhole is a peer whose underlay path drops the network's encapsulated
+// frames without reporting its MTU
+type Blackhole struct {
+	Peer string `json:"peer"`
+	// MTU is the largest packet the path carries
+	MTU int `json:"mtu"`
+}
+
+// SaveBlackholes records the blackholes of the network whose data directory
+// is dir, for the plugin to report on STATUS. The record is removed once
+// there are none.
+func SaveBlackholes(dir string, blackholes []Blackhole) error {
+	path := filepath.Join(dir, stateFile)
+	if len(blackholes) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove PMTU state: %v", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(blackholes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write PMTU state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write PMTU state: %v", err)
+	}
+	return nil
+}
+
+// LoadBlackholes returns the blackholes recorded for the network whose data
+// directory is dir, none if there's no record
+func LoadBlackholes(dir string) ([]Blackhole, error) {
+	path := filepath.Join(dir, stateFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PMTU state: %v", err)
+	}
+	var blackholes []Blackhole
+	if err := json.Unmarshal(data, &blackholes); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return blackholes, nil
+}
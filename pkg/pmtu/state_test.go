@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlackholes(t *testing.T) {
+	dir := t.TempDir()
+	if got, err := LoadBlackholes(dir); err != nil || got != nil {
+		t.Fatalf("Expected no blackholes without a record, got %v, %v", got, err)
+	}
+
+	want := []Blackhole{{Peer: "192.168.1.12", MTU: 1400}}
+	if err := SaveBlackholes(dir, want); err != nil {
+		t.Fatalf("Failed to save blackholes: %v", err)
+	}
+	if got, err := LoadBlackholes(dir); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v, %v", want, got, err)
+	}
+
+	// Recovered paths remove the record
+	if err := SaveBlackholes(dir, nil); err != nil {
+		t.Fatalf("Failed to save blackholes: %v", err)
+	}
+	if got, err := LoadBlackholes(dir); err != nil || got != nil {
+		t.Fatalf("Expected no blackholes once recovered, got %v, %v", got, err)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// egressFamily is the nftables family of the egress rules. Its forward
+	// hook sees the traffic the node routes out of the network.
+	egressFamily = "inet"
+	// EgressChain is the chain holding a network's egress rules
+	EgressChain = "egress"
+)
+
+// EgressTableName returns the nftables table holding the egress rules of a
+// network
+func EgressTableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-egress-vni%d", vni)
+}
+
+// ValidateRules returns the problems with the rules, naming them after field
+func ValidateRules(field string, rules []Rule) []string {
+	var problems []string
+	for i, rule := range rules {
+		problems = append(problems, rule.validate(fmt.Sprintf("%s[%d]", field, i))...)
+	}
+	return problems
+}
+
+// EgressRuleset returns the nft script SetupEgress applies. It replaces the
+// network's table with one filtering the traffic routed from the device,
+// the network's bridge or shim, to anywhere but back into it. Rules are
+// evaluated in order and the first matching one decides; unmatched traffic
+// passes.
+func EgressRuleset(table, device string, rules []Rule) string {
+	var b strings.Builder
+	// Adding the table first makes deleting it succeed if it's missing
+	fmt.Fprintf(&b, "add table %s %s\n", egressFamily, table)
+	fmt.Fprintf(&b, "delete table %s %s\n", egressFamily, table)
+	fmt.Fprintf(&b, "add table %s %s\n", egressFamily, table)
+	fmt.Fprintf(&b, "add chain %s %s forward { type filter hook forward priority 0; policy accept; }\n", egressFamily, table)
+	fmt.Fprintf(&b, "add chain %s %s %s\n", egressFamily, table, EgressChain)
+	fmt.Fprintf(&b, "add rule %s %s forward iifname \"%s\" oifname != \"%s\" jump %s\n", egressFamily, table, device, device, EgressChain)
+	rule := func(expr string) {
+		fmt.Fprintf(&b, "add rule %s %s %s %s\n", egressFamily, table, EgressChain, expr)
+	}
+	// Replies to allowed traffic always pass
+	rule("ct state established,related return")
+	for _, r := range rules {
+		for _, expr := range r.exprs("daddr") {
+			rule(expr)
+		}
+	}
+	return b.String()
+}
+
+// SetupEgress installs the network's egress rules on the device, replacing
+// those it had before
+func SetupEgress(table, device string, rules []Rule) error {
+	if err := nft.Apply(EgressRuleset(table, device, rules)); err != nil {
+		return fmt.Errorf("failed to install egress rules on %s: %v", device, err)
+	}
+	return nil
+}
+
+// HasEgress reports whether the network's egress rules are installed
+func HasEgress(table string) (bool, error) {
+	objects, err := nft.ListTable(egressFamily, table)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object.Chain != nil && object.Chain.Name == EgressChain {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteEgressTable removes the network's egress rules. It is idempotent.
+func DeleteEgressTable(table string) error {
+	if found, err := nft.HasTable(egressFamily, table); err != nil || !found {
+		return err
+	}
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", egressFamily, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
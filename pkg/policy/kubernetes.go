@@ -0,0 +1,179 @@
+//go:build linux
+// +build linux
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NetworkPolicy holds the parts of a Kubernetes NetworkPolicy
+// (networking.k8s.io/v1) the plugin enforces
+type NetworkPolicy struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		PodSelector *LabelSelector `json:"podSelector"`
+		PolicyTypes []string       `json:"policyTypes,omitempty"`
+		Ingress     []struct {
+			From  []NetworkPolicyPeer `json:"from,omitempty"`
+			Ports []NetworkPolicyPort `json:"ports,omitempty"`
+		} `json:"ingress,omitempty"`
+		Egress []struct {
+			To    []NetworkPolicyPeer `json:"to,omitempty"`
+			Ports []NetworkPolicyPort `json:"ports,omitempty"`
+		} `json:"egress,omitempty"`
+	} `json:"spec"`
+}
+
+// LabelSelector is a Kubernetes label selector
+type LabelSelector struct {
+	MatchLabels      map[string]string `json:"matchLabels,omitempty"`
+	MatchExpressions []json.RawMessage `json:"matchExpressions,omitempty"`
+}
+
+// NetworkPolicyPeer is a source or destination of a NetworkPolicy rule
+type NetworkPolicyPeer struct {
+	IPBlock *struct {
+		CIDR   string   `json:"cidr"`
+		Except []string `json:"except,omitempty"`
+	} `json:"ipBlock,omitempty"`
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// NetworkPolicyPort is a port of a NetworkPolicy rule
+type NetworkPolicyPort struct {
+	Protocol string          `json:"protocol,omitempty"`
+	Port     json.RawMessage `json:"port,omitempty"`
+	EndPort  int             `json:"endPort,omitempty"`
+}
+
+// isEmpty reports whether the selector selects everything
+func (s *LabelSelector) isEmpty() bool {
+	return s != nil && len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0
+}
+
+// LoadNetworkPolicies reads the NetworkPolicies of a namespace from the JSON
+// manifests in dir, e.g. as synced from the API server with
+// "kubectl get networkpolicy -A -o json". A manifest holds a NetworkPolicy
+// or a List of them.
+func LoadNetworkPolicies(dir, namespace string) ([]NetworkPolicy, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var policies []NetworkPolicy
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var manifest struct {
+			NetworkPolicy
+			Items []NetworkPolicy `json:"items"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		items := manifest.Items
+		if manifest.Kind == "NetworkPolicy" {
+			items = []NetworkPolicy{manifest.NetworkPolicy}
+		}
+		for _, item := range items {
+			if item.Metadata.Namespace == namespace {
+				policies = append(policies, item)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// FromNetworkPolicies adds the rules of Kubernetes NetworkPolicies to the
+// policy. As in Kubernetes, traffic in a direction a NetworkPolicy covers is
+// denied unless one of them allows it.
+//
+// The plugin doesn't know pod labels, so only NetworkPolicies selecting all
+// pods of their namespace apply, and only ipBlock peers match traffic. Named
+// ports match nothing.
+func FromNetworkPolicies(base Policy, policies []NetworkPolicy) Policy {
+	p := base
+	p.Ingress = append([]Rule{}, base.Ingress...)
+	p.Egress = append([]Rule{}, base.Egress...)
+	for _, np := range policies {
+		if !np.Spec.PodSelector.isEmpty() {
+			continue
+		}
+		ingress, egress := len(np.Spec.PolicyTypes) == 0, len(np.Spec.Egress) > 0 && len(np.Spec.PolicyTypes) == 0
+		for _, policyType := range np.Spec.PolicyTypes {
+			ingress = ingress || policyType == "Ingress"
+			egress = egress || policyType == "Egress"
+		}
+		if ingress {
+			p.DefaultIngress = ActionDeny
+			for _, rule := range np.Spec.Ingress {
+				p.Ingress = append(p.Ingress, allowRules(rule.From, rule.Ports)...)
+			}
+		}
+		if egress {
+			p.DefaultEgress = ActionDeny
+			for _, rule := range np.Spec.Egress {
+				p.Egress = append(p.Egress, allowRules(rule.To, rule.Ports)...)
+			}
+		}
+	}
+	return p
+}
+
+// allowRules converts a NetworkPolicy rule to policy rules. No peers match
+// all addresses, no ports all ports.
+func allowRules(peers []NetworkPolicyPeer, ports []NetworkPolicyPort) []Rule {
+	var addresses []Rule
+	if len(peers) == 0 {
+		addresses = []Rule{{Action: ActionAllow}}
+	}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			addresses = append(addresses, Rule{Action: ActionAllow, CIDRs: []string{peer.IPBlock.CIDR}, Except: peer.IPBlock.Except})
+		}
+	}
+	if len(ports) == 0 {
+		return addresses
+	}
+
+	var rules []Rule
+	for _, port := range ports {
+		protocol := strings.ToLower(port.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		var portRange []string
+		if len(port.Port) > 0 {
+			number, err := strconv.Atoi(string(port.Port))
+			if err != nil {
+				continue
+			}
+			portRange = []string{strconv.Itoa(number)}
+			if port.EndPort > number {
+				portRange = []string{fmt.Sprintf("%d-%d", number, port.EndPort)}
+			}
+		}
+		for _, rule := range addresses {
+			rule.Protocol = protocol
+			rule.Ports = portRange
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
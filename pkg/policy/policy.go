@@ -0,0 +1,353 @@
+//go:build linux
+// +build linux
+
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// family is the nftables family of the policy chains. Its hooks see the
+	// frames the overlay bridge forwards between containers as well as those
+	// to and from the host.
+	family = "bridge"
+	// ingressPrefix is the prefix of the chains filtering traffic to a port
+	ingressPrefix = "to-"
+	// egressPrefix is the prefix of the chains filtering traffic from a port
+	egressPrefix = "from-"
+
+	// ActionAllow lets matching traffic through
+	ActionAllow = "allow"
+	// ActionDeny drops matching traffic
+	ActionDeny = "deny"
+)
+
+// protocols maps the supported rule protocols to their nft names
+var protocols = map[string]string{
+	"tcp":    "tcp",
+	"udp":    "udp",
+	"sctp":   "sctp",
+	"icmp":   "icmp",
+	"icmpv6": "ipv6-icmp",
+}
+
+// baseChains lists the hooks the policy chains are jumped to from, with the
+// directions they filter: forward for traffic between containers, input and
+// output for traffic to and from the host
+var baseChains = []struct {
+	hook    string
+	ingress bool
+	egress  bool
+}{
+	{hook: "forward", ingress: true, egress: true},
+	{hook: "input", egress: true},
+	{hook: "output", ingress: true},
+}
+
+// Policy holds the allow and deny rules of a network. Rules are evaluated in
+// order and the first matching one decides; traffic no rule matches gets
+// the default action.
+type Policy struct {
+	// Ingress rules filter traffic to the containers by its source
+	Ingress []Rule `json:"ingress,omitempty"`
+	// Egress rules filter traffic from the containers by its destination
+	Egress []Rule `json:"egress,omitempty"`
+	// DefaultIngress is the action for unmatched traffic to the containers
+	// (default: allow)
+	DefaultIngress string `json:"defaultIngress,omitempty"`
+	// DefaultEgress is the action for unmatched traffic from the containers
+	// (default: allow)
+	DefaultEgress string `json:"defaultEgress,omitempty"`
+}
+
+// Rule matches traffic by peer address, protocol and port
+type Rule struct {
+	// Action is either "allow" or "deny"
+	Action string `json:"action"`
+	// CIDRs are the peer addresses matched, any if empty
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Except are addresses within CIDRs that don't match
+	Except []string `json:"except,omitempty"`
+	// Protocol is one of "tcp", "udp", "sctp", "icmp" or "icmpv6", any if
+	// empty
+	Protocol string `json:"protocol,omitempty"`
+	// Ports are the destination ports or port ranges ("8000-8080") matched,
+	// any if empty. They require a protocol of "tcp", "udp" or "sctp".
+	Ports []string `json:"ports,omitempty"`
+}
+
+// Port describes the host-side port of an attachment the policy applies to
+type Port struct {
+	// Attachment is the "<container ID>/<interface name>" key of the port,
+	// stored as the comment of its chains and jumps
+	Attachment string
+	// Device is the host-side interface on the overlay bridge
+	Device string
+}
+
+// IsEmpty reports whether the policy lets all traffic through
+func (p *Policy) IsEmpty() bool {
+	return p == nil || (len(p.Ingress) == 0 && len(p.Egress) == 0 && p.DefaultIngress != ActionDeny && p.DefaultEgress != ActionDeny)
+}
+
+// Validate returns the problems with the policy
+func (p *Policy) Validate() []string {
+	var problems []string
+	for field, action := range map[string]string{"defaultIngress": p.DefaultIngress, "defaultEgress": p.DefaultEgress} {
+		if action != "" && action != ActionAllow && action != ActionDeny {
+			problems = append(problems, fmt.Sprintf("policy.%s must be %q or %q", field, ActionAllow, ActionDeny))
+		}
+	}
+	for i, rule := range p.Ingress {
+		problems = append(problems, rule.validate(fmt.Sprintf("policy.ingress[%d]", i))...)
+	}
+	for i, rule := range p.Egress {
+		problems = append(problems, rule.validate(fmt.Sprintf("policy.egress[%d]", i))...)
+	}
+	return problems
+}
+
+// validate returns the problems with the rule
+func (r *Rule) validate(field string) []string {
+	var problems []string
+	if r.Action != ActionAllow && r.Action != ActionDeny {
+		problems = append(problems, fmt.Sprintf("%s.action must be %q or %q", field, ActionAllow, ActionDeny))
+	}
+	for _, cidr := range append(append([]string{}, r.CIDRs...), r.Except...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid CIDR %q", field, cidr))
+		}
+	}
+	if len(r.Except) > 0 && len(r.CIDRs) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.except requires cidrs", field))
+	}
+	if r.Protocol != "" && protocols[r.Protocol] == "" {
+		problems = append(problems, fmt.Sprintf("%s: unsupported protocol %q", field, r.Protocol))
+	}
+	if len(r.Ports) > 0 && r.Protocol != "tcp" && r.Protocol != "udp" && r.Protocol != "sctp" {
+		problems = append(problems, fmt.Sprintf("%s.ports require protocol tcp, udp or sctp", field))
+	}
+	for _, port := range r.Ports {
+		if !validPort(port) {
+			problems = append(problems, fmt.Sprintf("%s: invalid port %q", field, port))
+		}
+	}
+	return problems
+}
+
+// validPort reports whether s is a port or an ascending port range
+func validPort(s string) bool {
+	first, last, isRange := strings.Cut(s, "-")
+	low, err := strconv.Atoi(first)
+	if err != nil || low < 1 || low > 65535 {
+		return false
+	}
+	if !isRange {
+		return true
+	}
+	high, err := strconv.Atoi(last)
+	return err == nil && high >= low && high <= 65535
+}
+
+// TableName returns the nftables table holding the policy of a network
+func TableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-vni%d", vni)
+}
+
+// ChainNames returns the names of the chains filtering the traffic to and
+// from an attachment's port
+func ChainNames(attachment string) (string, string) {
+	hash := sha256.Sum256([]byte(attachment))
+	suffix := hex.EncodeToString(hash[:])[:16]
+	return ingressPrefix + suffix, egressPrefix + suffix
+}
+
+// Ruleset returns the nft script installing the policy on the port. It
+// creates the port's chains, or flushes them if they exist, and jumps to
+// them from the base chains.
+func Ruleset(table string, policy *Policy, port *Port) string {
+	ingress, egress := ChainNames(port.Attachment)
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", family, table)
+	for _, base := range baseChains {
+		fmt.Fprintf(&b, "add chain %s %s %s { type filter hook %s priority 0; policy accept; }\n", family, table, base.hook, base.hook)
+	}
+
+	// Allowed traffic returns rather than being accepted, so the chain of
+	// the receiving container still gets its say
+	for _, chain := range []struct {
+		name     string
+		peer     string
+		rules    []Rule
+		fallback string
+	}{
+		{name: ingress, peer: "saddr", rules: policy.Ingress, fallback: policy.DefaultIngress},
+		{name: egress, peer: "daddr", rules: policy.Egress, fallback: policy.DefaultEgress},
+	} {
+		fmt.Fprintf(&b, "add chain %s %s %s { comment \"%s\"; }\n", family, table, chain.name, port.Attachment)
+		fmt.Fprintf(&b, "flush chain %s %s %s\n", family, table, chain.name)
+		rule := func(expr string) {
+			fmt.Fprintf(&b, "add rule %s %s %s %s\n", family, table, chain.name, expr)
+		}
+		// Replies to allowed traffic and neighbor discovery always pass
+		rule("ct state established,related return")
+		rule("ct state invalid drop")
+		rule("ether type arp return")
+		rule("icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit, nd-router-advert } return")
+		for _, r := range chain.rules {
+			for _, expr := range r.exprs(chain.peer) {
+				rule(expr)
+			}
+		}
+		rule(verdict(chain.fallback))
+	}
+
+	for _, base := range baseChains {
+		if base.egress {
+			fmt.Fprintf(&b, "add rule %s %s %s iifname \"%s\" jump %s comment \"%s\"\n", family, table, base.hook, port.Device, egress, port.Attachment)
+		}
+		if base.ingress {
+			fmt.Fprintf(&b, "add rule %s %s %s oifname \"%s\" jump %s comment \"%s\"\n", family, table, base.hook, port.Device, ingress, port.Attachment)
+		}
+	}
+	return b.String()
+}
+
+// exprs renders the rule as nft rule expressions matching the peer in the
+// given direction ("saddr" or "daddr"), one per address family it covers
+func (r *Rule) exprs(peer string) []string {
+	l4 := ""
+	if r.Protocol != "" {
+		l4 = " meta l4proto " + protocols[r.Protocol]
+		if len(r.Ports) > 0 {
+			l4 += fmt.Sprintf(" %s dport { %s }", r.Protocol, strings.Join(r.Ports, ", "))
+		}
+	}
+	action := verdict(r.Action)
+	if len(r.CIDRs) == 0 {
+		return []string{strings.TrimSpace(l4 + " " + action)}
+	}
+
+	var exprs []string
+	for _, ipFamily := range []string{"ip", "ip6"} {
+		cidrs := filterFamily(r.CIDRs, ipFamily == "ip6")
+		if len(cidrs) == 0 {
+			continue
+		}
+		expr := fmt.Sprintf("%s %s { %s }", ipFamily, peer, strings.Join(cidrs, ", "))
+		if except := filterFamily(r.Except, ipFamily == "ip6"); len(except) > 0 {
+			expr += fmt.Sprintf(" %s %s != { %s }", ipFamily, peer, strings.Join(except, ", "))
+		}
+		exprs = append(exprs, expr+l4+" "+action)
+	}
+	return exprs
+}
+
+// filterFamily returns the CIDRs of one address family
+func filterFamily(cidrs []string, ipv6 bool) []string {
+	var filtered []string
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && (ipNet.IP.To4() == nil) == ipv6 {
+			filtered = append(filtered, ipNet.String())
+		}
+	}
+	return filtered
+}
+
+// verdict returns the nft verdict of an action
+func verdict(action string) string {
+	if action == ActionDeny {
+		return "drop"
+	}
+	return "return"
+}
+
+// Setup installs the policy on the port, replacing what it had before
+func Setup(table string, policy *Policy, port *Port) error {
+	remove, err := removeJumps(table, port.Attachment)
+	if err != nil {
+		return err
+	}
+	if err := nft.Apply(remove + Ruleset(table, policy, port)); err != nil {
+		return fmt.Errorf("failed to install policy on %s: %v", port.Device, err)
+	}
+	return nil
+}
+
+// Teardown removes the policy of an attachment's port. It is idempotent.
+func Teardown(table, attachment string) error {
+	// Without the table, there is nothing to remove, and adding it would
+	// leave it behind
+	if found, err := nft.HasTable(family, table); err != nil || !found {
+		return err
+	}
+	script, err := removeJumps(table, attachment)
+	if err != nil {
+		return err
+	}
+	// Adding the chains first makes deleting them succeed if they're gone
+	// already
+	ingress, egress := ChainNames(attachment)
+	script += fmt.Sprintf("add table %s %s\n", family, table)
+	for _, chain := range []string{ingress, egress} {
+		script += fmt.Sprintf("add chain %[1]s %[2]s %[3]s\ndelete chain %[1]s %[2]s %[3]s\n", family, table, chain)
+	}
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove policy of %s: %v", attachment, err)
+	}
+	return nil
+}
+
+// DeleteTable removes the network's table with the policy of any ports
+// left. It is idempotent.
+func DeleteTable(table string) error {
+	if found, err := nft.HasTable(family, table); err != nil || !found {
+		return err
+	}
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// Attachments returns the attachments with a policy in the table, by the
+// name of their ingress chain
+func Attachments(table string) (map[string]string, error) {
+	objects, err := nft.ListTable(family, table)
+	if err != nil {
+		return nil, err
+	}
+	attachments := make(map[string]string)
+	for _, object := range objects {
+		if object.Chain != nil && strings.HasPrefix(object.Chain.Name, ingressPrefix) {
+			attachments[object.Chain.Name] = object.Chain.Comment
+		}
+	}
+	return attachments, nil
+}
+
+// removeJumps returns the nft commands deleting the jumps to an
+// attachment's chains from the base chains
+func removeJumps(table, attachment string) (string, error) {
+	objects, err := nft.ListTable(family, table)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, object := range objects {
+		if object.Rule != nil && object.Rule.Comment == attachment {
+			fmt.Fprintf(&b, "delete rule %s %s %s handle %d\n", family, table, object.Rule.Chain, object.Rule.Handle)
+		}
+	}
+	return b.String(), nil
+}
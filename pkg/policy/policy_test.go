@@ -0,0 +1,256 @@
+//go:build linux
+// +build linux
+
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleset(t *testing.T) {
+	policy := &Policy{
+		Ingress: []Rule{
+			{Action: ActionDeny, CIDRs: []string{"10.0.0.0/8"}, Except: []string{"10.1.0.0/16"}},
+			{Action: ActionAllow, CIDRs: []string{"192.168.0.0/16", "fd00::/8"}, Protocol: "tcp", Ports: []string{"22", "8000-8080"}},
+		},
+		Egress:         []Rule{{Action: ActionDeny, Protocol: "udp", Ports: []string{"53"}}},
+		DefaultIngress: ActionDeny,
+	}
+	port := &Port{Attachment: "c1/eth0", Device: "veth1234"}
+	ingress, egress := ChainNames(port.Attachment)
+	ruleset := Ruleset(TableName(42), policy, port)
+
+	for _, want := range []string{
+		"add chain bridge xvm-cni-vni42 forward { type filter hook forward priority 0; policy accept; }",
+		"add chain bridge xvm-cni-vni42 " + ingress + " { comment \"c1/eth0\"; }",
+		"flush chain bridge xvm-cni-vni42 " + ingress,
+		"add rule bridge xvm-cni-vni42 " + ingress + " ct state established,related return",
+		"add rule bridge xvm-cni-vni42 " + ingress + " ip saddr { 10.0.0.0/8 } ip saddr != { 10.1.0.0/16 } drop",
+		"add rule bridge xvm-cni-vni42 " + ingress + " ip saddr { 192.168.0.0/16 } meta l4proto tcp tcp dport { 22, 8000-8080 } return",
+		"add rule bridge xvm-cni-vni42 " + ingress + " ip6 saddr { fd00::/8 } meta l4proto tcp tcp dport { 22, 8000-8080 } return",
+		"add rule bridge xvm-cni-vni42 " + ingress + " drop",
+		"add rule bridge xvm-cni-vni42 " + egress + " meta l4proto udp udp dport { 53 } drop",
+		"add rule bridge xvm-cni-vni42 " + egress + " return",
+		"add rule bridge xvm-cni-vni42 forward iifname \"veth1234\" jump " + egress + " comment \"c1/eth0\"",
+		"add rule bridge xvm-cni-vni42 forward oifname \"veth1234\" jump " + ingress + " comment \"c1/eth0\"",
+		"add rule bridge xvm-cni-vni42 input iifname \"veth1234\" jump " + egress + " comment \"c1/eth0\"",
+		"add rule bridge xvm-cni-vni42 output oifname \"veth1234\" jump " + ingress + " comment \"c1/eth0\"",
+	} {
+		if !strings.Contains(ruleset, want+"\n") {
+			t.Errorf("Ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+
+	// Chain names are stable and differ between attachments
+	if other, _ := ChainNames("c1/eth1"); other == ingress || ingress == egress {
+		t.Errorf("Chain names are not unique per attachment")
+	}
+}
+
+func TestEgressRuleset(t *testing.T) {
+	rules := []Rule{
+		{Action: ActionAllow, CIDRs: []string{"10.0.0.0/8"}},
+		{Action: ActionDeny, Protocol: "tcp", Ports: []string{"25"}},
+	}
+	ruleset := EgressRuleset(EgressTableName(42), "xbr-net", rules)
+
+	want := []string{
+		"add table inet xvm-cni-egress-vni42",
+		"delete table inet xvm-cni-egress-vni42",
+		"add table inet xvm-cni-egress-vni42",
+		"add chain inet xvm-cni-egress-vni42 forward { type filter hook forward priority 0; policy accept; }",
+		"add chain inet xvm-cni-egress-vni42 egress",
+		"add rule inet xvm-cni-egress-vni42 forward iifname \"xbr-net\" oifname != \"xbr-net\" jump egress",
+		"add rule inet xvm-cni-egress-vni42 egress ct state established,related return",
+		"add rule inet xvm-cni-egress-vni42 egress ip daddr { 10.0.0.0/8 } return",
+		"add rule inet xvm-cni-egress-vni42 egress meta l4proto tcp tcp dport { 25 } drop",
+	}
+	if got := strings.Split(strings.TrimSpace(ruleset), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected ruleset:\n%s\ngot:\n%s", strings.Join(want, "\n"), ruleset)
+	}
+
+	if problems := ValidateRules("egressRules", []Rule{{Action: "reject"}}); len(problems) != 1 || !strings.HasPrefix(problems[0], "egressRules[0]") {
+		t.Errorf("Expected a problem with egressRules[0], got %v", problems)
+	}
+}
+
+func TestAllowPorts(t *testing.T) {
+	want := &Policy{
+		Ingress: []Rule{
+			{Action: ActionAllow, Protocol: "tcp", Ports: []string{"443", "8000-8080"}},
+			{Action: ActionAllow, Protocol: "udp", Ports: []string{"53"}},
+		},
+		DefaultIngress: ActionDeny,
+	}
+	if got := AllowPorts([]string{"53/udp", "443", "8000-8080/tcp"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if problems := ValidatePorts("ports", []string{"443", "53/udp", "0", "22/icmp", "80-70"}); len(problems) != 3 {
+		t.Errorf("Expected 3 problems, got %v", problems)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		problems int
+	}{
+		{
+			name: "valid",
+			policy: Policy{
+				Ingress:        []Rule{{Action: ActionAllow, CIDRs: []string{"10.0.0.0/8"}, Protocol: "tcp", Ports: []string{"80", "8000-8080"}}},
+				Egress:         []Rule{{Action: ActionDeny, Protocol: "icmp"}},
+				DefaultIngress: ActionDeny,
+			},
+		},
+		{
+			name:     "invalid actions",
+			policy:   Policy{Ingress: []Rule{{Action: "reject"}}, DefaultEgress: "block"},
+			problems: 2,
+		},
+		{
+			name:     "invalid CIDR",
+			policy:   Policy{Ingress: []Rule{{Action: ActionAllow, CIDRs: []string{"10.0.0.0"}}}},
+			problems: 1,
+		},
+		{
+			name:     "except without cidrs",
+			policy:   Policy{Egress: []Rule{{Action: ActionAllow, Except: []string{"10.0.0.0/8"}}}},
+			problems: 1,
+		},
+		{
+			name:     "ports without protocol",
+			policy:   Policy{Egress: []Rule{{Action: ActionAllow, Ports: []string{"80"}}}},
+			problems: 1,
+		},
+		{
+			name:     "invalid ports",
+			policy:   Policy{Egress: []Rule{{Action: ActionAllow, Protocol: "udp", Ports: []string{"0", "90-80", "http"}}}},
+			problems: 3,
+		},
+		{
+			name:     "unsupported protocol",
+			policy:   Policy{Egress: []Rule{{Action: ActionAllow, Protocol: "gre"}}},
+			problems: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problems := tt.policy.Validate(); len(problems) != tt.problems {
+				t.Errorf("Expected %d problems, got %v", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestFromNetworkPolicies(t *testing.T) {
+	dir := t.TempDir()
+	manifests := map[string]string{
+		"web.json": `{
+			"kind": "NetworkPolicy",
+			"metadata": {"name": "web", "namespace": "prod"},
+			"spec": {
+				"podSelector": {},
+				"ingress": [{
+					"from": [{"ipBlock": {"cidr": "10.0.0.0/8", "except": ["10.1.0.0/16"]}}, {"podSelector": {}}],
+					"ports": [{"port": 80}, {"protocol": "UDP", "port": 5000, "endPort": 5010}, {"port": "http"}]
+				}]
+			}
+		}`,
+		"list.json": `{
+			"kind": "NetworkPolicyList",
+			"items": [
+				{"metadata": {"name": "egress", "namespace": "prod"}, "spec": {"podSelector": {}, "policyTypes": ["Egress"]}},
+				{"metadata": {"name": "labelled", "namespace": "prod"}, "spec": {"podSelector": {"matchLabels": {"app": "db"}}}},
+				{"metadata": {"name": "other", "namespace": "dev"}, "spec": {"podSelector": {}}}
+			]
+		}`,
+	}
+	for name, manifest := range manifests {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policies, err := LoadNetworkPolicies(dir, "prod")
+	if err != nil {
+		t.Fatalf("Failed to load NetworkPolicies: %v", err)
+	}
+	if len(policies) != 3 {
+		t.Fatalf("Expected 3 NetworkPolicies of the namespace, got %d", len(policies))
+	}
+
+	base := Policy{Ingress: []Rule{{Action: ActionDeny, CIDRs: []string{"10.2.0.0/16"}}}}
+	got := FromNetworkPolicies(base, policies)
+	want := Policy{
+		Ingress: []Rule{
+			{Action: ActionDeny, CIDRs: []string{"10.2.0.0/16"}},
+			{Action: ActionAllow, CIDRs: []string{"10.0.0.0/8"}, Except: []string{"10.1.0.0/16"}, Protocol: "tcp", Ports: []string{"80"}},
+			{Action: ActionAllow, CIDRs: []string{"10.0.0.0/8"}, Except: []string{"10.1.0.0/16"}, Protocol: "udp", Ports: []string{"5000-5010"}},
+		},
+		Egress:         []Rule{},
+		DefaultIngress: ActionDeny,
+		DefaultEgress:  ActionDeny,
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("Expected %s, got %s", wantJSON, gotJSON)
+	}
+	if problems := got.Validate(); len(problems) != 0 {
+		t.Errorf("Converted policy is invalid: %v", problems)
+	}
+	if len(base.Ingress) != 1 || base.DefaultIngress != "" {
+		t.Errorf("Base policy was modified: %+v", base)
+	}
+}
+
+func TestSetupTeardown(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not available")
+	}
+
+	policy := &Policy{Ingress: []Rule{{Action: ActionAllow, Protocol: "tcp", Ports: []string{"22"}}}, DefaultIngress: ActionDeny}
+	port := &Port{Attachment: "policy-test/eth0", Device: "policy-test0"}
+	table := TableName(16777215)
+	defer DeleteTable(table)
+
+	// Setup twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := Setup(table, policy, port); err != nil {
+			t.Fatalf("Failed to setup policy: %v", err)
+		}
+	}
+	attachments, err := Attachments(table)
+	if err != nil {
+		t.Fatalf("Failed to list attachments: %v", err)
+	}
+	if ingress, _ := ChainNames(port.Attachment); attachments[ingress] != port.Attachment {
+		t.Fatalf("Expected chains of %s, got %v", port.Attachment, attachments)
+	}
+	if jumps, err := removeJumps(table, port.Attachment); err != nil || strings.Count(jumps, "\n") != 4 {
+		t.Fatalf("Expected 4 jumps to the chains, got %q (%v)", jumps, err)
+	}
+
+	// Teardown twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := Teardown(table, port.Attachment); err != nil {
+			t.Fatalf("Failed to remove policy: %v", err)
+		}
+	}
+	if attachments, err := Attachments(table); err != nil || len(attachments) != 0 {
+		t.Fatalf("Expected no attachments left, got %v (%v)", attachments, err)
+	}
+}
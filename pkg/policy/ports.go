@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultPortProtocol is the protocol of allowlist entries naming none
+const defaultPortProtocol = "tcp"
+
+// PortsTableName returns the nftables table holding the ingress port
+// allowlists of a network's containers. It is apart from the policy's, so
+// traffic must pass both.
+func PortsTableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-ports-vni%d", vni)
+}
+
+// splitPort splits an allowlist entry such as "443", "53/udp" or
+// "8000-8080/tcp" into its port or range and protocol
+func splitPort(entry string) (string, string) {
+	port, protocol, ok := strings.Cut(entry, "/")
+	if !ok {
+		protocol = defaultPortProtocol
+	}
+	return port, protocol
+}
+
+// ValidatePorts returns the problems with an ingress port allowlist, naming
+// them after field
+func ValidatePorts(field string, entries []string) []string {
+	var problems []string
+	for _, entry := range entries {
+		port, protocol := splitPort(entry)
+		if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+			problems = append(problems, fmt.Sprintf("%s: unsupported protocol in %q", field, entry))
+		}
+		if !validPort(port) {
+			problems = append(problems, fmt.Sprintf("%s: invalid port %q", field, entry))
+		}
+	}
+	return problems
+}
+
+// AllowPorts returns the policy letting connections to a container through
+// only on the ports of the allowlist. Its egress is left open.
+func AllowPorts(entries []string) *Policy {
+	byProtocol := make(map[string][]string)
+	for _, entry := range entries {
+		port, protocol := splitPort(entry)
+		byProtocol[protocol] = append(byProtocol[protocol], port)
+	}
+	protocols := make([]string, 0, len(byProtocol))
+	for protocol := range byProtocol {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	p := &Policy{DefaultIngress: ActionDeny}
+	for _, protocol := range protocols {
+		p.Ingress = append(p.Ingress, Rule{Action: ActionAllow, Protocol: protocol, Ports: byProtocol[protocol]})
+	}
+	return p
+}
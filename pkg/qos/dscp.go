@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package qos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/nohns/xvm-cni/pkg/nft"
+)
+
+const (
+	// family is the nftables family of the marking chains. Its ingress hook
+	// sees the container's traffic as it enters the host.
+	family = "netdev"
+	// chainPrefix is the prefix of the per-port chains
+	chainPrefix = "dscp-"
+	// priority runs the marking after the anti-spoofing filters
+	priority = 0
+
+	// MaxDSCP is the largest Differentiated Services Code Point (6 bits)
+	MaxDSCP = 63
+)
+
+// Port describes the host-side port of an attachment and the DSCP its
+// traffic is marked with
+type Port struct {
+	// Attachment is the "<container ID>/<interface name>" key of the port,
+	// stored as the chain's comment
+	Attachment string
+	// Device is the host-side interface, e.g. the host veth
+	Device string
+	// DSCP is the code point set on the port's IPv4 and IPv6 packets
+	DSCP int
+}
+
+// TableName returns the nftables table holding the marking chains of a
+// network
+func TableName(vni int) string {
+	return fmt.Sprintf("xvm-cni-qos-vni%d", vni)
+}
+
+// ChainName returns the name of the chain marking an attachment's traffic
+func ChainName(attachment string) string {
+	hash := sha256.Sum256([]byte(attachment))
+	return chainPrefix + hex.EncodeToString(hash[:])[:16]
+}
+
+// Ruleset returns the nft script SetupDSCP applies for the port. It creates
+// the port's chain, or flushes it if it exists, and fills it.
+func Ruleset(table string, port *Port) string {
+	chain := ChainName(port.Attachment)
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", family, table)
+	fmt.Fprintf(&b, "add chain %s %s %s { type filter hook ingress device \"%s\" priority %d; policy accept; comment \"%s\"; }\n",
+		family, table, chain, port.Device, priority, port.Attachment)
+	fmt.Fprintf(&b, "flush chain %s %s %s\n", family, table, chain)
+	fmt.Fprintf(&b, "add rule %s %s %s ip dscp set %d\n", family, table, chain, port.DSCP)
+	fmt.Fprintf(&b, "add rule %s %s %s ip6 dscp set %d\n", family, table, chain, port.DSCP)
+	return b.String()
+}
+
+// SetupDSCP installs the marking of the port, replacing any it had before
+func SetupDSCP(table string, port *Port) error {
+	if port.DSCP < 0 || port.DSCP > MaxDSCP {
+		return fmt.Errorf("DSCP %d out of range (0-%d)", port.DSCP, MaxDSCP)
+	}
+	if err := nft.Apply(Ruleset(table, port)); err != nil {
+		return fmt.Errorf("failed to install DSCP marking on %s: %v", port.Device, err)
+	}
+	return nil
+}
+
+// TeardownDSCP removes the marking of an attachment's port. It is
+// idempotent.
+func TeardownDSCP(table, attachment string) error {
+	// Without the table, there is nothing to remove, and adding it would
+	// leave it behind
+	if found, err := nft.HasTable(family, table); err != nil || !found {
+		return err
+	}
+	chain := ChainName(attachment)
+	// Adding the chain first makes deleting it succeed if it's gone already
+	script := fmt.Sprintf("add table %[1]s %[2]s\nadd chain %[1]s %[2]s %[3]s\ndelete chain %[1]s %[2]s %[3]s\n", family, table, chain)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove chain %s: %v", chain, err)
+	}
+	return nil
+}
+
+// DeleteTable removes the network's table with the marking of any ports
+// left. It is idempotent.
+func DeleteTable(table string) error {
+	if found, err := nft.HasTable(family, table); err != nil || !found {
+		return err
+	}
+	script := fmt.Sprintf("add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, table)
+	if err := nft.Apply(script); err != nil {
+		return fmt.Errorf("failed to remove table %s: %v", table, err)
+	}
+	return nil
+}
+
+// Attachments returns the attachments marked in the table, by chain name
+func Attachments(table string) (map[string]string, error) {
+	objects, err := nft.ListTable(family, table)
+	if err != nil {
+		return nil, err
+	}
+	attachments := make(map[string]string)
+	for _, object := range objects {
+		if object.Chain != nil && strings.HasPrefix(object.Chain.Name, chainPrefix) {
+			attachments[object.Chain.Name] = object.Chain.Comment
+		}
+	}
+	return attachments, nil
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package qos
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRuleset(t *testing.T) {
+	port := &Port{
+		Attachment: "c1/eth0",
+		Device:     "veth1234",
+		DSCP:       46,
+	}
+	table := TableName(42)
+	chain := ChainName(port.Attachment)
+	ruleset := Ruleset(table, port)
+
+	for _, want := range []string{
+		"add chain netdev xvm-cni-qos-vni42 " + chain + " { type filter hook ingress device \"veth1234\" priority 0; policy accept; comment \"c1/eth0\"; }",
+		"flush chain netdev xvm-cni-qos-vni42 " + chain,
+		"add rule netdev xvm-cni-qos-vni42 " + chain + " ip dscp set 46",
+		"add rule netdev xvm-cni-qos-vni42 " + chain + " ip6 dscp set 46",
+	} {
+		if !strings.Contains(ruleset, want+"\n") {
+			t.Errorf("Ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+
+	if err := SetupDSCP(table, &Port{Attachment: "c1/eth0", Device: "veth1234", DSCP: 64}); err == nil {
+		t.Errorf("Expected out of range DSCP to be rejected")
+	}
+}
+
+func TestSetupTeardownDSCP(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not available")
+	}
+
+	port := &Port{
+		Attachment: "qos-test/eth0",
+		Device:     "lo",
+		DSCP:       10,
+	}
+	table := TableName(16777215)
+	defer DeleteTable(table)
+
+	// Setup twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := SetupDSCP(table, port); err != nil {
+			t.Fatalf("Failed to setup marking: %v", err)
+		}
+	}
+	attachments, err := Attachments(table)
+	if err != nil {
+		t.Fatalf("Failed to list attachments: %v", err)
+	}
+	if attachments[ChainName(port.Attachment)] != port.Attachment {
+		t.Fatalf("Expected chain of %s, got %v", port.Attachment, attachments)
+	}
+
+	// Teardown twice to verify idempotency
+	for i := 0; i < 2; i++ {
+		if err := TeardownDSCP(table, port.Attachment); err != nil {
+			t.Fatalf("Failed to teardown marking: %v", err)
+		}
+	}
+	attachments, err = Attachments(table)
+	if err != nil {
+		t.Fatalf("Failed to list attachments: %v", err)
+	}
+	if len(attachments) != 0 {
+		t.Fatalf("Expected no attachments, got %v", attachments)
+	}
+}
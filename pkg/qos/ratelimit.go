@@ -0,0 +1,179 @@
+//go:build linux
+// +build linux
+
+package qos
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+const (
+	// latencyMillis is the longest a packet may wait in the token bucket
+	// before it is dropped, as the bandwidth plugin uses
+	latencyMillis = 25
+	// minBurstBits is the smallest burst, so a bucket holds full-size
+	// GSO packets even at low rates
+	minBurstBits = 64 * 1024 * 8
+
+	// RedirectPriority is the tc filter priority of the redirect to the
+	// IFB device. The IFB device re-injects the packets past the link's tc
+	// filters, so those that must see all traffic run at lower values.
+	RedirectPriority = 10
+)
+
+// DefaultBurst returns the burst used for a rate when none is given: the
+// traffic of 10ms, but at least minBurstBits
+func DefaultBurst(rate uint64) uint64 {
+	if burst := rate / 100; burst > minBurstBits {
+		return burst
+	}
+	return minBurstBits
+}
+
+// Shape installs a token bucket filter as the root qdisc of the link,
+// limiting the traffic it transmits to rate bits per second with bursts of
+// burst bits. A child qdisc of kind child, if set, queues the traffic the
+// bucket lets through.
+func Shape(link netlink.Link, rate, burst uint64, child string) error {
+	rateBytes := rate / 8
+	burstBytes := burst / 8
+	buffer := time2Tick(uint32(float64(burstBytes) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rateBytes)))
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * latencyMillis / 1000
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateBytes,
+		Limit:  uint32(float64(rateBytes)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + uint32(burstBytes),
+		Buffer: buffer,
+	}
+	// A root qdisc of another kind set before can't be changed in place
+	existing, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs on %s: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range existing {
+		attrs := qdisc.Attrs()
+		if attrs.Parent == netlink.HANDLE_ROOT && attrs.Handle == tbf.Handle && qdisc.Type() != "tbf" {
+			if err := netlink.QdiscDel(qdisc); err != nil {
+				return fmt.Errorf("failed to delete qdisc %s on %s: %v", qdisc.Type(), link.Attrs().Name, err)
+			}
+		}
+	}
+	if err := netlink.QdiscReplace(tbf); err != nil {
+		return fmt.Errorf("failed to set rate limit on %s: %v", link.Attrs().Name, err)
+	}
+
+	if child != "" {
+		qdisc := &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(10, 0),
+				Parent:    netlink.MakeHandle(1, 1),
+			},
+			QdiscType: child,
+		}
+		if err := netlink.QdiscReplace(qdisc); err != nil {
+			return fmt.Errorf("failed to set qdisc %s on %s: %v", child, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Shaped returns the rate in bits per second the link's root token bucket
+// filter limits it to, or 0 if it has none
+func Shaped(link netlink.Link) (uint64, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list qdiscs on %s: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+			return tbf.Rate * 8, nil
+		}
+	}
+	return 0, nil
+}
+
+// SetupIFB creates the IFB device that traffic received on a link is
+// redirected to for shaping, or returns the existing one
+func SetupIFB(name string, mtu int) (netlink.Link, error) {
+	ifb := &netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   name,
+			MTU:    mtu,
+			TxQLen: -1,
+		},
+	}
+	err := retry.Do(func() error { return netlink.LinkAdd(ifb) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create IFB %s: %v", name, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IFB %s: %v", name, err)
+	}
+	if link.Type() != "ifb" {
+		return nil, fmt.Errorf("interface %s already exists but is not an IFB", name)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set IFB %s up: %v", name, err)
+	}
+	return link, nil
+}
+
+// Redirect sends all traffic the link receives through the IFB device, so
+// a qdisc on the IFB shapes the link's ingress
+func Redirect(link, ifb netlink.Link) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	// An ingress qdisc can't be replaced in place. The one there already,
+	// e.g. holding the fast path's filters, takes the redirect as well.
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs on %s: %v", link.Attrs().Name, err)
+	}
+	exists := false
+	for _, qdisc := range qdiscs {
+		exists = exists || qdisc.Type() == "ingress"
+	}
+	if !exists {
+		if err := netlink.QdiscAdd(ingress); err != nil {
+			return fmt.Errorf("failed to add ingress qdisc on %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	// Match every packet and redirect it to the IFB
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  RedirectPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		ClassId: netlink.MakeHandle(1, 1),
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("failed to redirect %s to %s: %v", link.Attrs().Name, ifb.Attrs().Name, err)
+	}
+	return nil
+}
+
+// time2Tick converts microseconds to the kernel's packet scheduler ticks
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * float64(netlink.TickInUsec()))
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+// Package resultcache keeps a record of each attachment as ADD set it up:
+// the CNI result it returned and the runtime's parameters. DEL, CHECK and
+// GC fall back to it where the runtime doesn't pass the same parameters
+// again, or has lost them, e.g. an empty netns on DEL.
+package resultcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// resultsDir is the directory in the network's data directory holding the
+// records
+const resultsDir = "results"
+
+// Record is an attachment as ADD set it up
+type Record struct {
+	Network     string `json:"network"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	// Netns is the container's network namespace, "" for VM ports
+	Netns string `json:"netns,omitempty"`
+	// NetnsInode identifies the namespace, as paths like /proc/<pid>/ns/net
+	// name another one once the process is gone and its PID reused
+	NetnsInode uint64 `json:"netnsInode,omitempty"`
+	// MAC is the container interface's or the VM port's
+	MAC string `json:"mac,omitempty"`
+	// HostInterfaces are the attachment's own devices on the host, such as
+	// its host veth or tap device
+	HostInterfaces []string `json:"hostInterfaces,omitempty"`
+	// IPs are the addresses allocated to the attachment, in CIDR notation
+	IPs []string `json:"ips,omitempty"`
+	// NDPProxies are the IPv6 addresses the host interface answers
+	// neighbor solicitations for on behalf of the attachment
+	NDPProxies []string `json:"ndpProxies,omitempty"`
+	// PodQoS is the QoS the pod's annotations set for the attachment
+	PodQoS json.RawMessage `json:"podQoS,omitempty"`
+	// Result is the CNI result ADD returned
+	Result json.RawMessage `json:"result"`
+}
+
+// recordFile returns the file holding an attachment's record
+func recordFile(dir, network, containerID, ifName string) string {
+	hash := sha256.Sum256([]byte(network + "/" + containerID + "/" + ifName))
+	return filepath.Join(dir, resultsDir, hex.EncodeToString(hash[:])[:16]+".json")
+}
+
+// Save stores the record in the network's data directory
+func Save(dir string, r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	path := recordFile(dir, r.Network, r.ContainerID, r.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create results directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write result: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write result: %v", err)
+	}
+	return nil
+}
+
+// Load returns the record of an attachment, or nil if it has none, as for
+// attachments added by earlier versions
+func Load(dir, network, containerID, ifName string) (*Record, error) {
+	return read(recordFile(dir, network, containerID, ifName))
+}
+
+// LoadAll returns the records of the network's attachments, sorted by
+// container ID and interface
+func LoadAll(dir, network string) ([]*Record, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, resultsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, path := range paths {
+		r, err := read(path)
+		if err != nil {
+			return nil, err
+		}
+		// Networks without a name share the data directory
+		if r != nil && r.Network == network {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ContainerID != records[j].ContainerID {
+			return records[i].ContainerID < records[j].ContainerID
+		}
+		return records[i].IfName < records[j].IfName
+	})
+	return records, nil
+}
+
+// Remove removes an attachment's record. It is idempotent.
+func Remove(dir, network, containerID, ifName string) error {
+	if err := os.Remove(recordFile(dir, network, containerID, ifName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove result: %v", err)
+	}
+	return nil
+}
+
+// read reads a record file, returning nil if it doesn't exist
+func read(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %v", err)
+	}
+	r := &Record{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package resultcache
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	if r, err := Load(dir, "xvm-network", "ctr-a", "eth0"); err != nil || r != nil {
+		t.Fatalf("Expected no record, got %+v, err %v", r, err)
+	}
+
+	records := []*Record{
+		{Network: "xvm-network", ContainerID: "ctr-b", IfName: "eth0", Netns: "/var/run/netns/cni-b", MAC: "0a:58:0a:f4:00:03", Result: json.RawMessage(`{"cniVersion":"1.0.0"}`)},
+		{Network: "xvm-network", ContainerID: "ctr-a", IfName: "eth1", HostInterfaces: []string{"tapa1b2c3d4"}, IPs: []string{"10.244.0.2/16"}, Result: json.RawMessage(`{}`)},
+		{Network: "other-network", ContainerID: "ctr-a", IfName: "eth0", Result: json.RawMessage(`{}`)},
+	}
+	for _, r := range records {
+		if err := Save(dir, r); err != nil {
+			t.Fatalf("Failed to save record: %v", err)
+		}
+	}
+
+	r, err := Load(dir, "xvm-network", "ctr-b", "eth0")
+	if err != nil || !reflect.DeepEqual(r, records[0]) {
+		t.Fatalf("Expected %+v, got %+v, err %v", records[0], r, err)
+	}
+
+	// Only the network's records are listed, in order
+	all, err := LoadAll(dir, "xvm-network")
+	if err != nil {
+		t.Fatalf("Failed to load records: %v", err)
+	}
+	if len(all) != 2 || all[0].ContainerID != "ctr-a" || all[1].ContainerID != "ctr-b" {
+		t.Fatalf("Unexpected records %+v", all)
+	}
+
+	if err := Remove(dir, "xvm-network", "ctr-b", "eth0"); err != nil {
+		t.Fatalf("Failed to remove record: %v", err)
+	}
+	if err := Remove(dir, "xvm-network", "ctr-b", "eth0"); err != nil {
+		t.Fatalf("Failed to remove removed record: %v", err)
+	}
+	if r, err := Load(dir, "xvm-network", "ctr-b", "eth0"); err != nil || r != nil {
+		t.Fatalf("Expected record removed, got %+v, err %v", r, err)
+	}
+}
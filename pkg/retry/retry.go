@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package retry
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Backoff describes how often and how long to wait between attempts
+type Backoff struct {
+	// Steps is the maximum number of attempts
+	Steps int
+	// Initial is the wait after the first failed attempt
+	Initial time.Duration
+	// Factor multiplies the wait after every further failed attempt
+	Factor float64
+	// Max caps the wait between attempts
+	Max time.Duration
+}
+
+// DefaultBackoff retries for up to about a second, which covers the netlink
+// races seen while many containers are created or deleted at once
+var DefaultBackoff = Backoff{
+	Steps:   6,
+	Initial: 10 * time.Millisecond,
+	Factor:  2,
+	Max:     400 * time.Millisecond,
+}
+
+// transient holds the errors a netlink request may fail with while the
+// kernel is busy with a concurrent change of the same objects. EEXIST is not
+// among them, as repeating the same request can't succeed; callers creating
+// shared devices reuse the device another invocation created instead.
+var transient = map[syscall.Errno]bool{
+	syscall.EBUSY:   true,
+	syscall.EAGAIN:  true,
+	syscall.EINTR:   true,
+	syscall.ENOBUFS: true,
+	syscall.ENODEV:  true,
+}
+
+// sleep waits between attempts, replaced in tests
+var sleep = time.Sleep
+
+// deadline ends retrying, see SetDeadline
+var deadline time.Time
+
+// SetDeadline stops retrying transient failures past t, the deadline of the
+// command, so a netlink request that timed out with it isn't repeated
+func SetDeadline(t time.Time) {
+	deadline = t
+}
+
+// IsTransient reports whether the error is worth retrying
+func IsTransient(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && transient[errno]
+}
+
+// Do runs op with the default backoff
+func Do(op func() error) error {
+	return DefaultBackoff.Do(op)
+}
+
+// Do runs op until it succeeds, fails with an error that isn't transient, or
+// runs out of attempts or time, and returns the last error
+func (b Backoff) Do(op func() error) error {
+	wait := b.Initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil || !IsTransient(err) || attempt >= b.Steps {
+			return err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return err
+		}
+		sleep(wait)
+		wait = time.Duration(float64(wait) * b.Factor)
+		if b.Max > 0 && wait > b.Max {
+			wait = b.Max
+		}
+	}
+}
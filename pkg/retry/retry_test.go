@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { sleep = time.Sleep }()
+
+	backoff := Backoff{Steps: 4, Initial: 10 * time.Millisecond, Factor: 2, Max: 25 * time.Millisecond}
+
+	// Transient failures are retried until the operation succeeds
+	attempts := 0
+	err := backoff.Do(func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("failed to add link: %w", syscall.EBUSY)
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("Expected success after 3 attempts, got %d attempts and error: %v", attempts, err)
+	}
+	if len(waits) != 2 || waits[0] != 10*time.Millisecond || waits[1] != 20*time.Millisecond {
+		t.Fatalf("Unexpected waits %v", waits)
+	}
+
+	// Persistent transient failures give up after the last step, with the
+	// wait capped
+	waits, attempts = nil, 0
+	err = backoff.Do(func() error {
+		attempts++
+		return syscall.ENODEV
+	})
+	if !errors.Is(err, syscall.ENODEV) || attempts != 4 {
+		t.Fatalf("Expected ENODEV after 4 attempts, got %d attempts and error: %v", attempts, err)
+	}
+	if waits[len(waits)-1] != 25*time.Millisecond {
+		t.Fatalf("Expected wait capped at 25ms, got %v", waits)
+	}
+
+	// Other failures are returned right away
+	attempts = 0
+	err = backoff.Do(func() error {
+		attempts++
+		return syscall.EEXIST
+	})
+	if !errors.Is(err, syscall.EEXIST) || attempts != 1 {
+		t.Fatalf("Expected EEXIST after 1 attempt, got %d attempts and error: %v", attempts, err)
+	}
+
+	// Past the deadline transient failures aren't retried either
+	SetDeadline(time.Now().Add(-time.Second))
+	defer SetDeadline(time.Time{})
+	attempts = 0
+	err = backoff.Do(func() error {
+		attempts++
+		return syscall.EAGAIN
+	})
+	if !errors.Is(err, syscall.EAGAIN) || attempts != 1 {
+		t.Fatalf("Expected EAGAIN after 1 attempt, got %d attempts and error: %v", attempts, err)
+	}
+}
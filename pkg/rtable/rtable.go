@@ -0,0 +1,275 @@
+//go:build linux
+// +build linux
+
+// Package rtable selects a dedicated routing table for the overlay's routes
+// with policy routing rules, keeping them out of the host's main table so
+// they coexist with the routes of other networking agents
+package rtable
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// DefaultPriority orders the rules before the main table's, at 32766
+const DefaultPriority = 1000
+
+// Selector describes the packets the routing table is looked up for
+type Selector struct {
+	Table    int
+	Priority int
+	// Mark and Mask match the packets' fwmark, unless Mark is 0
+	Mark, Mask uint32
+	// Sources match the packets' source prefixes, one rule each
+	Sources []*net.IPNet
+	// Destinations match the packets' destination prefixes, one rule each
+	Destinations []*net.IPNet
+	// IPv6 selects the table for IPv6 packets with the mark as well
+	IPv6 bool
+}
+
+// ParseMark parses a fwmark such as "0x100", or "0x100/0xff00" with a mask
+func ParseMark(s string) (mark, mask uint32, err error) {
+	value, maskValue, masked := strings.Cut(s, "/")
+	m, err := strconv.ParseUint(value, 0, 32)
+	if err != nil || m == 0 {
+		return 0, 0, fmt.Errorf("invalid fwmark %q", s)
+	}
+	mask = 0xffffffff
+	if masked {
+		k, err := strconv.ParseUint(maskValue, 0, 32)
+		if err != nil || k == 0 {
+			return 0, 0, fmt.Errorf("invalid fwmark mask %q", s)
+		}
+		mask = uint32(k)
+	}
+	return uint32(m), mask, nil
+}
+
+// Rules returns the rules selecting the table
+func (s *Selector) Rules() []*netlink.Rule {
+	var rules []*netlink.Rule
+	rule := func(family int) *netlink.Rule {
+		r := netlink.NewRule()
+		r.Family = family
+		r.Table = s.Table
+		r.Priority = s.Priority
+		return r
+	}
+	if s.Mark != 0 {
+		families := []int{netlink.FAMILY_V4}
+		if s.IPv6 {
+			families = append(families, netlink.FAMILY_V6)
+		}
+		for _, family := range families {
+			r := rule(family)
+			r.Mark = s.Mark
+			mask := s.Mask
+			r.Mask = &mask
+			rules = append(rules, r)
+		}
+	}
+	for _, src := range s.Sources {
+		family := netlink.FAMILY_V4
+		if src.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		r := rule(family)
+		r.Src = src
+		rules = append(rules, r)
+	}
+	for _, dst := range s.Destinations {
+		family := netlink.FAMILY_V4
+		if dst.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		r := rule(family)
+		r.Dst = dst
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Refs records the owners using each rule in a directory, so rules that
+// several owners select the same table with stay until the last of them
+// cleans up
+type Refs struct {
+	// Dir holds a directory per rule, with a file per owner
+	Dir   string
+	Owner string
+}
+
+// lock takes the lock of the directory, serializing the owners' changes. It
+// returns the function releasing the lock.
+func (refs *Refs) lock() (func(), error) {
+	if err := os.MkdirAll(refs.Dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(refs.Dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
+
+// ruleDir returns the directory holding the owners of the rule
+func (refs *Refs) ruleDir(r *netlink.Rule) string {
+	key := fmt.Sprintf("%d %d %s", r.Family, r.Priority, Describe(r))
+	return filepath.Join(refs.Dir, strings.NewReplacer(" ", "_", "/", "_").Replace(key))
+}
+
+// add records the owner as using the rule
+func (refs *Refs) add(r *netlink.Rule) error {
+	dir := refs.ruleDir(r)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, refs.Owner), nil, 0644)
+}
+
+// release forgets the owner's use of the rule, and reports whether no other
+// owner uses it
+func (refs *Refs) release(r *netlink.Rule) (bool, error) {
+	dir := refs.ruleDir(r)
+	if err := os.Remove(filepath.Join(dir, refs.Owner)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if len(entries) > 0 {
+		return false, nil
+	}
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// Setup adds the rules selecting the table that are missing. With refs, the
+// owner is recorded as using each of the rules.
+func Setup(s *Selector, refs *Refs) error {
+	if refs != nil {
+		unlock, err := refs.lock()
+		if err != nil {
+			return fmt.Errorf("failed to lock rule owners: %v", err)
+		}
+		defer unlock()
+		for _, r := range s.Rules() {
+			if err := refs.add(r); err != nil {
+				return fmt.Errorf("failed to record owner of rule %s: %v", Describe(r), err)
+			}
+		}
+	}
+	missing, err := Missing(s)
+	if err != nil {
+		return err
+	}
+	for _, r := range missing {
+		// Another invocation may have added it concurrently
+		err := retry.Do(func() error { return netlink.RuleAdd(r) })
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add rule %s: %v", Describe(r), err)
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the rules selecting the table. Those already gone are
+// skipped. With refs, only the rules no other owner uses are removed.
+func Cleanup(s *Selector, refs *Refs) error {
+	if refs != nil {
+		unlock, err := refs.lock()
+		if err != nil {
+			return fmt.Errorf("failed to lock rule owners: %v", err)
+		}
+		defer unlock()
+	}
+	for _, r := range s.Rules() {
+		if refs != nil {
+			unused, err := refs.release(r)
+			if err != nil {
+				return fmt.Errorf("failed to release rule %s: %v", Describe(r), err)
+			}
+			if !unused {
+				continue
+			}
+		}
+		if err := netlink.RuleDel(r); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("failed to delete rule %s: %v", Describe(r), err)
+		}
+	}
+	return nil
+}
+
+// Missing returns the rules selecting the table that aren't installed
+func Missing(s *Selector) ([]*netlink.Rule, error) {
+	installed := make(map[int][]netlink.Rule)
+	var missing []*netlink.Rule
+	for _, r := range s.Rules() {
+		if _, ok := installed[r.Family]; !ok {
+			rules, err := netlink.RuleList(r.Family)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list rules: %v", err)
+			}
+			installed[r.Family] = rules
+		}
+		if !contains(installed[r.Family], r) {
+			missing = append(missing, r)
+		}
+	}
+	return missing, nil
+}
+
+// contains reports whether the rules include one matching r
+func contains(rules []netlink.Rule, r *netlink.Rule) bool {
+	for _, have := range rules {
+		if have.Table != r.Table || have.Priority != r.Priority || have.Mark != r.Mark {
+			continue
+		}
+		if r.Mask != nil && (have.Mask == nil || *have.Mask != *r.Mask) {
+			continue
+		}
+		if r.Src.String() != have.Src.String() || r.Dst.String() != have.Dst.String() {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Describe formats a rule like ip rule does, e.g. "from 10.244.0.0/16
+// lookup 100"
+func Describe(r *netlink.Rule) string {
+	var parts []string
+	if r.Src != nil {
+		parts = append(parts, "from "+r.Src.String())
+	}
+	if r.Dst != nil {
+		parts = append(parts, "to "+r.Dst.String())
+	}
+	if r.Mark != 0 {
+		mark := fmt.Sprintf("fwmark %#x", r.Mark)
+		if r.Mask != nil && *r.Mask != 0xffffffff {
+			mark += fmt.Sprintf("/%#x", *r.Mask)
+		}
+		parts = append(parts, mark)
+	}
+	parts = append(parts, fmt.Sprintf("lookup %d", r.Table))
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package rtable
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseMark(t *testing.T) {
+	mark, mask, err := ParseMark("0x100/0xff00")
+	if err != nil || mark != 0x100 || mask != 0xff00 {
+		t.Fatalf("Unexpected mark %#x/%#x, err %v", mark, mask, err)
+	}
+	if mark, mask, err := ParseMark("256"); err != nil || mark != 256 || mask != 0xffffffff {
+		t.Fatalf("Unexpected mark %#x/%#x, err %v", mark, mask, err)
+	}
+	for _, bad := range []string{"", "0", "mark", "0x100/", "0x100/0", "0x1ffffffff"} {
+		if _, _, err := ParseMark(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.244.0.0/16")
+	_, v6, _ := net.ParseCIDR("fd00:244::/64")
+	s := &Selector{Table: 100, Priority: DefaultPriority, Mark: 0x100, Mask: 0xff00, Sources: []*net.IPNet{v4, v6}, Destinations: []*net.IPNet{v4}, IPv6: true}
+	var got []string
+	for _, r := range s.Rules() {
+		got = append(got, Describe(r))
+	}
+	want := []string{"fwmark 0x100/0xff00 lookup 100", "fwmark 0x100/0xff00 lookup 100", "from 10.244.0.0/16 lookup 100", "from fd00:244::/64 lookup 100", "to 10.244.0.0/16 lookup 100"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected rules %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected rules %v, got %v", want, got)
+		}
+	}
+}
+
+func TestSetupCleanup(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	_, src, _ := net.ParseCIDR("10.199.0.0/16")
+	s := &Selector{Table: 1099, Priority: 1099, Mark: 0x1099, Mask: 0xffffffff, Sources: []*net.IPNet{src}}
+	if err := Setup(s, nil); err != nil {
+		t.Skipf("Policy routing not supported: %v", err)
+	}
+	defer Cleanup(s, nil)
+
+	// Setup twice to verify the rules aren't duplicated
+	if err := Setup(s, nil); err != nil {
+		t.Fatalf("Failed to setup rules again: %v", err)
+	}
+	if missing, err := Missing(s); err != nil || len(missing) != 0 {
+		t.Fatalf("Expected no missing rules, got %v, err %v", missing, err)
+	}
+
+	if err := Cleanup(s, nil); err != nil {
+		t.Fatalf("Failed to cleanup rules: %v", err)
+	}
+	if missing, err := Missing(s); err != nil || len(missing) != 2 {
+		t.Fatalf("Expected both rules missing, got %v, err %v", missing, err)
+	}
+	if err := Cleanup(s, nil); err != nil {
+		t.Fatalf("Failed to cleanup removed rules: %v", err)
+	}
+}
+
+func TestRefs(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	dir := t.TempDir()
+	a, b := &Refs{Dir: dir, Owner: "net-a"}, &Refs{Dir: dir, Owner: "net-b"}
+	s := &Selector{Table: 1098, Priority: 1098, Mark: 0x1098, Mask: 0xffffffff}
+	if err := Setup(s, a); err != nil {
+		t.Skipf("Policy routing not supported: %v", err)
+	}
+	defer Cleanup(s, nil)
+	if err := Setup(s, b); err != nil {
+		t.Fatalf("Failed to setup shared rules: %v", err)
+	}
+
+	// The rule stays until the last network using it cleans up
+	if err := Cleanup(s, a); err != nil {
+		t.Fatalf("Failed to cleanup rules: %v", err)
+	}
+	if missing, err := Missing(s); err != nil || len(missing) != 0 {
+		t.Fatalf("Expected the rule kept for the other owner, got missing %v, err %v", missing, err)
+	}
+	if err := Cleanup(s, b); err != nil {
+		t.Fatalf("Failed to cleanup rules: %v", err)
+	}
+	if missing, err := Missing(s); err != nil || len(missing) != 1 {
+		t.Fatalf("Expected the rule removed, got missing %v, err %v", missing, err)
+	}
+}
@@ -0,0 +1,272 @@
+//go:build linux
+// +build linux
+
+package sriov
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// sysfsRoot is where sysfs is mounted, replaced in tests
+var sysfsRoot = "/sys"
+
+// representorPattern matches the port names of VF representors, e.g. pf0vf3
+// or vf3
+var representorPattern = regexp.MustCompile(`^(?:c\d+)?(?:pf(\d+))?vf(\d+)$`)
+
+// VF describes an SR-IOV virtual function
+type VF struct {
+	// PCIAddr is the PCI address of the VF, e.g. 0000:3b:02.1
+	PCIAddr string
+	// PF is the network interface of the physical function
+	PF string
+	// PFPCIAddr is the PCI address of the physical function
+	PFPCIAddr string
+	// Index is the number of the VF on its physical function
+	Index int
+	// Name is the network interface of the VF on the host
+	Name string
+}
+
+// LookupVF resolves the VF with the given PCI address, as handed out by an
+// SR-IOV device plugin
+func LookupVF(pciAddr string) (*VF, error) {
+	devices := filepath.Join(sysfsRoot, "bus", "pci", "devices")
+	dev := filepath.Join(devices, pciAddr)
+	physfn, err := os.Readlink(filepath.Join(dev, "physfn"))
+	if err != nil {
+		return nil, fmt.Errorf("device %s is not an SR-IOV VF: %v", pciAddr, err)
+	}
+
+	vf := &VF{PCIAddr: pciAddr, PFPCIAddr: filepath.Base(physfn), Index: -1}
+	pfDev := filepath.Join(devices, vf.PFPCIAddr)
+	if vf.PF, err = netdevName(pfDev); err != nil {
+		return nil, err
+	}
+	if vf.PF == "" {
+		return nil, fmt.Errorf("physical function %s has no network interface", vf.PFPCIAddr)
+	}
+
+	// Find the VF's number among the virtfn links of its PF
+	virtfns, err := filepath.Glob(filepath.Join(pfDev, "virtfn*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, virtfn := range virtfns {
+		target, err := os.Readlink(virtfn)
+		if err != nil || filepath.Base(target) != pciAddr {
+			continue
+		}
+		if vf.Index, err = strconv.Atoi(strings.TrimPrefix(filepath.Base(virtfn), "virtfn")); err != nil {
+			return nil, fmt.Errorf("invalid VF link %s", virtfn)
+		}
+		break
+	}
+	if vf.Index < 0 {
+		return nil, fmt.Errorf("device %s is not listed by its physical function %s", pciAddr, vf.PF)
+	}
+
+	if vf.Name, err = netdevName(dev); err != nil {
+		return nil, err
+	}
+	if vf.Name == "" {
+		return nil, fmt.Errorf("VF %s has no network interface, is it bound to a network driver?", pciAddr)
+	}
+
+	return vf, nil
+}
+
+// Representor returns the switchdev representor of the VF, the host-side
+// port that carries its traffic through the embedded switch
+func Representor(vf *VF) (string, error) {
+	netDir := filepath.Join(sysfsRoot, "class", "net")
+	switchID := readAttr(filepath.Join(netDir, vf.PF, "phys_switch_id"))
+	if switchID == "" {
+		return "", fmt.Errorf("physical function %s has no switch ID", vf.PF)
+	}
+	pfPort := strings.TrimPrefix(readAttr(filepath.Join(netDir, vf.PF, "phys_port_name")), "p")
+
+	entries, err := os.ReadDir(netDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == vf.PF || readAttr(filepath.Join(netDir, name, "phys_switch_id")) != switchID {
+			continue
+		}
+		match := representorPattern.FindStringSubmatch(readAttr(filepath.Join(netDir, name, "phys_port_name")))
+		if match == nil || match[2] != strconv.Itoa(vf.Index) {
+			continue
+		}
+		// Physical functions sharing a switch number their VFs separately
+		if match[1] != "" && pfPort != "" && match[1] != pfPort {
+			continue
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("no representor found for VF %d of %s", vf.Index, vf.PF)
+}
+
+// IsSwitchdev reports whether the embedded switch of the VF's physical
+// function is in switchdev mode, so its traffic can be steered from the host
+func IsSwitchdev(vf *VF) (bool, error) {
+	dev, err := netlink.DevLinkGetDeviceByName("pci", vf.PFPCIAddr)
+	if err != nil {
+		return false, fmt.Errorf("failed to get devlink device %s: %v", vf.PFPCIAddr, err)
+	}
+	return dev.Attrs.Eswitch.Mode == "switchdev", nil
+}
+
+// Attach moves the VF into the network namespace under the given name. Its
+// host name is kept in the interface alias, so Release can restore it.
+func Attach(vf *VF, name string, mtu int, hwAddr net.HardwareAddr, netns ns.NetNS) (net.Interface, error) {
+	// Program the MAC through the PF so it survives driver resets of the VF
+	if hwAddr != nil {
+		pf, err := netlink.LinkByName(vf.PF)
+		if err != nil {
+			return net.Interface{}, fmt.Errorf("failed to get physical function %s: %v", vf.PF, err)
+		}
+		if err := netlink.LinkSetVfHardwareAddr(pf, vf.Index, hwAddr); err != nil {
+			return net.Interface{}, fmt.Errorf("failed to set MAC of VF %d: %v", vf.Index, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(vf.Name)
+	if err != nil {
+		return net.Interface{}, fmt.Errorf("failed to get VF %s: %v", vf.Name, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return net.Interface{}, fmt.Errorf("failed to set VF %s down: %v", vf.Name, err)
+	}
+	if err := netlink.LinkSetAlias(link, vf.Name); err != nil {
+		return net.Interface{}, fmt.Errorf("failed to set VF %s alias: %v", vf.Name, err)
+	}
+
+	// Move the VF under a temporary name, so it can't clash with an
+	// interface in the container
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return net.Interface{}, err
+	}
+	if err := netlink.LinkSetName(link, tmpName); err != nil {
+		return net.Interface{}, fmt.Errorf("failed to rename VF %s: %v", vf.Name, err)
+	}
+	if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+		_ = netlink.LinkSetName(link, vf.Name)
+		return net.Interface{}, fmt.Errorf("failed to move VF %s to container: %v", vf.Name, err)
+	}
+
+	var iface net.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, name); err != nil {
+			return fmt.Errorf("failed to rename VF to %s: %v", name, err)
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to get VF %s: %v", name, err)
+		}
+		if mtu > 0 {
+			if err := netlink.LinkSetMTU(link, mtu); err != nil {
+				return fmt.Errorf("failed to set VF MTU: %v", err)
+			}
+		}
+		if hwAddr != nil {
+			if err := netlink.LinkSetHardwareAddr(link, hwAddr); err != nil {
+				return fmt.Errorf("failed to set VF MAC: %v", err)
+			}
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to get VF %s: %v", name, err)
+		}
+		iface = net.Interface{
+			Index:        link.Attrs().Index,
+			MTU:          link.Attrs().MTU,
+			Name:         link.Attrs().Name,
+			HardwareAddr: link.Attrs().HardwareAddr,
+			Flags:        link.Attrs().Flags,
+		}
+		return nil
+	})
+	if err != nil {
+		return net.Interface{}, err
+	}
+
+	return iface, nil
+}
+
+// Release moves the VF with the given name out of the network namespace,
+// back to the host under its original name. A VF that is already gone is
+// not an error.
+func Release(name string, netns ns.NetNS) error {
+	return netns.Do(func(hostNS ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil // Already released
+		}
+		hostName := link.Attrs().Alias
+
+		tmpName, err := ip.RandomVethName()
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set VF %s down: %v", name, err)
+		}
+		if err := netlink.LinkSetName(link, tmpName); err != nil {
+			return fmt.Errorf("failed to rename VF %s: %v", name, err)
+		}
+		if err := netlink.LinkSetAlias(link, ""); err != nil {
+			return fmt.Errorf("failed to clear VF alias: %v", err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(hostNS.Fd())); err != nil {
+			return fmt.Errorf("failed to move VF %s to host: %v", name, err)
+		}
+
+		if hostName == "" {
+			return nil
+		}
+		return hostNS.Do(func(_ ns.NetNS) error {
+			if err := ip.RenameLink(tmpName, hostName); err != nil {
+				return fmt.Errorf("failed to rename VF to %s: %v", hostName, err)
+			}
+			return nil
+		})
+	})
+}
+
+// netdevName returns the network interface of a PCI device, or an empty
+// name if it has none
+func netdevName(dev string) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(dev, "net"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	return entries[0].Name(), nil
+}
+
+// readAttr returns the trimmed content of a sysfs attribute, or an empty
+// string if it can't be read
+func readAttr(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
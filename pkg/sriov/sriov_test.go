@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package sriov
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree with a PF in switchdev mode, two VFs and
+// their representors
+func fakeSysfs(t *testing.T) string {
+	root := t.TempDir()
+	mkdir := func(parts ...string) string {
+		dir := filepath.Join(append([]string{root}, parts...)...)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+		return dir
+	}
+	symlink := func(target string, parts ...string) {
+		if err := os.Symlink(target, filepath.Join(append([]string{root}, parts...)...)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	attr := func(value string, parts ...string) {
+		dir := mkdir(parts[:len(parts)-1]...)
+		if err := os.WriteFile(filepath.Join(dir, parts[len(parts)-1]), []byte(value+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write attribute: %v", err)
+		}
+	}
+
+	devices := []string{"bus", "pci", "devices"}
+	mkdir(append(devices, "0000:3b:00.0", "net", "ens1f0")...)
+	mkdir(append(devices, "0000:3b:00.2", "net", "ens1f0v0")...)
+	mkdir(append(devices, "0000:3b:00.3", "net", "ens1f0v1")...)
+	mkdir(append(devices, "0000:3b:00.4")...) // Bound to vfio-pci
+	symlink("../0000:3b:00.2", append(devices, "0000:3b:00.0", "virtfn0")...)
+	symlink("../0000:3b:00.3", append(devices, "0000:3b:00.0", "virtfn1")...)
+	symlink("../0000:3b:00.4", append(devices, "0000:3b:00.0", "virtfn2")...)
+	for _, vf := range []string{"0000:3b:00.2", "0000:3b:00.3", "0000:3b:00.4"} {
+		symlink("../0000:3b:00.0", append(devices, vf, "physfn")...)
+	}
+
+	attr("abcdef", "class", "net", "ens1f0", "phys_switch_id")
+	attr("p0", "class", "net", "ens1f0", "phys_port_name")
+	attr("abcdef", "class", "net", "eth1", "phys_switch_id")
+	attr("pf0vf0", "class", "net", "eth1", "phys_port_name")
+	attr("abcdef", "class", "net", "eth2", "phys_switch_id")
+	attr("pf1vf1", "class", "net", "eth2", "phys_port_name")
+	attr("abcdef", "class", "net", "eth3", "phys_switch_id")
+	attr("pf0vf1", "class", "net", "eth3", "phys_port_name")
+	return root
+}
+
+func TestLookupVF(t *testing.T) {
+	sysfsRoot = fakeSysfs(t)
+	defer func() { sysfsRoot = "/sys" }()
+
+	vf, err := LookupVF("0000:3b:00.3")
+	if err != nil {
+		t.Fatalf("Failed to look up VF: %v", err)
+	}
+	if vf.PF != "ens1f0" || vf.PFPCIAddr != "0000:3b:00.0" || vf.Index != 1 || vf.Name != "ens1f0v1" {
+		t.Fatalf("Unexpected VF: %+v", vf)
+	}
+
+	// The representor of the VF on the other PF of the switch is skipped
+	rep, err := Representor(vf)
+	if err != nil {
+		t.Fatalf("Failed to find representor: %v", err)
+	}
+	if rep != "eth3" {
+		t.Fatalf("Expected representor eth3, got %s", rep)
+	}
+
+	// Physical functions and VFs without a network driver are rejected
+	if _, err := LookupVF("0000:3b:00.0"); err == nil {
+		t.Fatalf("Expected PF to be rejected")
+	}
+	if _, err := LookupVF("0000:3b:00.4"); err == nil {
+		t.Fatalf("Expected VF without network interface to be rejected")
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package sublink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+const (
+	// ModeMacvlan attaches containers as macvlan children in bridge mode
+	ModeMacvlan = "macvlan"
+	// ModeIPvlan attaches containers as ipvlan children in L2 mode
+	ModeIPvlan = "ipvlan"
+)
+
+// LinkConfig holds the configuration for a child link of the VXLAN device
+type LinkConfig struct {
+	Mode         string
+	Parent       netlink.Link
+	Name         string
+	MTU          int
+	HardwareAddr net.HardwareAddr
+}
+
+// ShimName returns the name of the host shim interface of a network, or of
+// a VXLAN ID for networks without a name as earlier versions named it
+func ShimName(network string, vxlanID int) string {
+	if network == "" {
+		return fmt.Sprintf("xvmgw%d", vxlanID)
+	}
+	return devname.For("xgw-", network)
+}
+
+// newLink returns an unsaved child link for the configured mode
+func newLink(config *LinkConfig, attrs netlink.LinkAttrs) (netlink.Link, error) {
+	// Children can't exceed the MTU the kernel settled on for the parent
+	parent, err := netlink.LinkByIndex(config.Parent.Attrs().Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent interface %s: %v", config.Parent.Attrs().Name, err)
+	}
+	attrs.ParentIndex = parent.Attrs().Index
+	attrs.MTU = config.MTU
+	if attrs.MTU > parent.Attrs().MTU {
+		attrs.MTU = parent.Attrs().MTU
+	}
+	switch config.Mode {
+	case ModeMacvlan:
+		attrs.HardwareAddr = config.HardwareAddr
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}, nil
+	case ModeIPvlan:
+		// ipvlan children share the parent's MAC address
+		if config.HardwareAddr != nil {
+			return nil, fmt.Errorf("ipvlan interfaces can't have their own MAC address")
+		}
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}, nil
+	}
+	return nil, fmt.Errorf("unknown mode %q", config.Mode)
+}
+
+// SetupShim creates the host shim if it doesn't exist yet and sets it up.
+// The host can't reach the children through the parent itself, so the shim
+// carries the gateway addresses instead.
+func SetupShim(config *LinkConfig) (netlink.Link, error) {
+	// Reuse the shim if it already exists
+	existing, err := netlink.LinkByName(config.Name)
+	if err == nil {
+		if existing.Type() != config.Mode || existing.Attrs().ParentIndex != config.Parent.Attrs().Index {
+			return nil, fmt.Errorf("interface %s already exists but is not a %s child of %s", config.Name, config.Mode, config.Parent.Attrs().Name)
+		}
+		if err := netlink.LinkSetUp(existing); err != nil {
+			return nil, fmt.Errorf("failed to set shim %s up: %v", config.Name, err)
+		}
+		return existing, nil
+	}
+
+	// Create the shim
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = config.Name
+	shim, err := newLink(config, attrs)
+	if err != nil {
+		return nil, err
+	}
+	// Another invocation may have created it concurrently, use theirs then
+	err = retry.Do(func() error { return netlink.LinkAdd(shim) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create shim %s: %v", config.Name, err)
+	}
+
+	// Set the shim up
+	if err := netlink.LinkSetUp(shim); err != nil {
+		return nil, fmt.Errorf("failed to set shim %s up: %v", config.Name, err)
+	}
+
+	// Re-read the shim to pick up kernel-assigned attributes
+	link, err := netlink.LinkByName(config.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shim %s: %v", config.Name, err)
+	}
+
+	return link, nil
+}
+
+// ConfigureGateway assigns the gateway address to the shim so it routes for
+// the containers attached next to it
+func ConfigureGateway(shim netlink.Link, gateway *net.IPNet) error {
+	addr := &netlink.Addr{IPNet: gateway}
+	if err := retry.Do(func() error { return netlink.AddrReplace(shim, addr) }); err != nil {
+		return fmt.Errorf("failed to add gateway %s to shim %s: %v", gateway, shim.Attrs().Name, err)
+	}
+	return nil
+}
+
+// CleanupShim removes the shim
+func CleanupShim(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// If the shim doesn't exist, that's fine
+		return nil
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete shim %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// Create creates a child link in the given network namespace. It is created
+// under a temporary name and renamed inside the namespace, so it can't clash
+// with an interface on the host.
+func Create(config *LinkConfig, netns ns.NetNS) (net.Interface, error) {
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return net.Interface{}, err
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = tmpName
+	attrs.Namespace = netlink.NsFd(int(netns.Fd()))
+	link, err := newLink(config, attrs)
+	if err != nil {
+		return net.Interface{}, err
+	}
+	if err := retry.Do(func() error { return netlink.LinkAdd(link) }); err != nil {
+		return net.Interface{}, fmt.Errorf("failed to create %s interface: %v", config.Mode, err)
+	}
+
+	// Rename the link inside the container
+	var iface net.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, config.Name); err != nil {
+			_ = ip.DelLinkByName(tmpName)
+			return fmt.Errorf("failed to rename %s interface to %s: %v", config.Mode, config.Name, err)
+		}
+		renamed, err := netlink.LinkByName(config.Name)
+		if err != nil {
+			return fmt.Errorf("failed to get %s interface %s: %v", config.Mode, config.Name, err)
+		}
+		iface = net.Interface{
+			Index:        renamed.Attrs().Index,
+			MTU:          renamed.Attrs().MTU,
+			Name:         renamed.Attrs().Name,
+			HardwareAddr: renamed.Attrs().HardwareAddr,
+			Flags:        renamed.Attrs().Flags,
+		}
+		return nil
+	})
+	if err != nil {
+		return net.Interface{}, err
+	}
+
+	return iface, nil
+}
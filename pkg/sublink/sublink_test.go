@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package sublink
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetupShim(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	// Use a VXLAN interface as parent
+	parent := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "xvmtest99", MTU: 1400},
+		VxlanId:   99,
+		Port:      4789,
+	}
+	if err := netlink.LinkAdd(parent); err != nil {
+		t.Fatalf("Failed to create parent interface: %v", err)
+	}
+	defer netlink.LinkDel(parent)
+
+	config := &LinkConfig{
+		Mode:   ModeMacvlan,
+		Parent: parent,
+		Name:   ShimName("", 99), // Use a high ID to avoid conflicts
+		MTU:    1500,
+	}
+
+	// Setup twice to verify the shim is reused
+	shim, err := SetupShim(config)
+	if err != nil {
+		t.Fatalf("Failed to setup shim: %v", err)
+	}
+	defer CleanupShim(config.Name)
+	again, err := SetupShim(config)
+	if err != nil {
+		t.Fatalf("Failed to setup existing shim: %v", err)
+	}
+	if again.Attrs().Index != shim.Attrs().Index {
+		t.Fatalf("Existing shim was recreated")
+	}
+
+	// The MTU is capped at the parent's
+	if shim.Attrs().MTU != 1400 {
+		t.Fatalf("Expected shim MTU 1400, got %d", shim.Attrs().MTU)
+	}
+
+	// Configure gateway twice to verify idempotency
+	gateway := &net.IPNet{IP: net.ParseIP("10.99.0.1"), Mask: net.CIDRMask(24, 32)}
+	for i := 0; i < 2; i++ {
+		if err := ConfigureGateway(shim, gateway); err != nil {
+			t.Fatalf("Failed to configure gateway: %v", err)
+		}
+	}
+	addrs, err := netlink.AddrList(shim, unix.AF_INET)
+	if err != nil {
+		t.Fatalf("Failed to list shim addresses: %v", err)
+	}
+	if len(addrs) != 1 || !addrs[0].IP.Equal(gateway.IP) {
+		t.Fatalf("Expected gateway %s on shim, got %v", gateway.IP, addrs)
+	}
+
+	// Clean up
+	if err := CleanupShim(config.Name); err != nil {
+		t.Fatalf("Failed to cleanup shim: %v", err)
+	}
+	if _, err := netlink.LinkByName(config.Name); err == nil {
+		t.Fatalf("Shim still exists after cleanup")
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+// Package vlan sets up the VLAN sub-interface VTEP traffic leaves the node
+// on, where it must ride a tagged segment of the underlay
+package vlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/netops"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// MaxID is the largest VLAN ID
+const MaxID = 4094
+
+// Ops makes the package's netlink requests; tests replace it
+var Ops netops.Ops = netops.Kernel{}
+
+// Config holds the VLAN sub-interface to set up
+type Config struct {
+	Name   string
+	Parent string
+	ID     int
+	// MTU defaults to the parent's
+	MTU int
+	// Address is assigned to a sub-interface created by Setup
+	Address *net.IPNet
+}
+
+// ParseName splits a sub-interface name of the "<parent>.<id>" form, as
+// iproute2 and most distributions name them
+func ParseName(name string) (string, int, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(name[i+1:])
+	if err != nil || id < 1 || id > MaxID {
+		return "", 0, false
+	}
+	return name[:i], id, true
+}
+
+// Setup creates the sub-interface with its address if it doesn't exist yet
+// and sets it up. An existing interface is reused as long as it's the VLAN
+// of the parent; its addresses are left to whoever created it.
+func Setup(config *Config) (*netlink.Vlan, error) {
+	parent, err := Ops.LinkByName(config.Parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent interface %s: %v", config.Parent, err)
+	}
+	if existing, err := Ops.LinkByName(config.Name); err == nil {
+		v, err := check(existing, config, parent)
+		if err != nil {
+			return nil, err
+		}
+		if err := Ops.LinkSetUp(v); err != nil {
+			return nil, fmt.Errorf("failed to set %s up: %v", config.Name, err)
+		}
+		return v, nil
+	}
+
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = parent.Attrs().MTU
+	}
+	v := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        config.Name,
+			ParentIndex: parent.Attrs().Index,
+			MTU:         mtu,
+		},
+		VlanId: config.ID,
+	}
+
+	// Another invocation may have created it concurrently, use theirs then
+	err = retry.Do(func() error { return Ops.LinkAdd(v) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create VLAN interface %s: %v", config.Name, err)
+	}
+	link, err := Ops.LinkByName(config.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VLAN interface %s: %v", config.Name, err)
+	}
+	if v, err = check(link, config, parent); err != nil {
+		return nil, err
+	}
+	if config.Address != nil {
+		addr := &netlink.Addr{IPNet: config.Address}
+		if err := Ops.AddrAdd(v, addr); err != nil && !errors.Is(err, unix.EEXIST) {
+			return nil, fmt.Errorf("failed to assign %s to %s: %v", config.Address, config.Name, err)
+		}
+	}
+	if err := Ops.LinkSetUp(v); err != nil {
+		return nil, fmt.Errorf("failed to set %s up: %v", config.Name, err)
+	}
+	return v, nil
+}
+
+// check returns the link as VLAN, failing if it isn't the configured one
+func check(link netlink.Link, config *Config, parent netlink.Link) (*netlink.Vlan, error) {
+	v, ok := link.(*netlink.Vlan)
+	if !ok {
+		return nil, fmt.Errorf("interface %s already exists but is not a VLAN", config.Name)
+	}
+	if v.VlanId != config.ID || v.ParentIndex != parent.Attrs().Index {
+		return nil, fmt.Errorf("interface %s is VLAN %d of interface index %d, not VLAN %d of %s", config.Name, v.VlanId, v.ParentIndex, config.ID, config.Parent)
+	}
+	return v, nil
+}
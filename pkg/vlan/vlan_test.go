@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package vlan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/netops"
+)
+
+func TestParseName(t *testing.T) {
+	for name, want := range map[string]struct {
+		parent string
+		id     int
+		ok     bool
+	}{
+		"eth0.100":      {"eth0", 100, true},
+		"bond0.10.4094": {"bond0.10", 4094, true},
+		"eth0":          {"", 0, false},
+		"eth0.4095":     {"", 0, false},
+		".100":          {"", 0, false},
+		"eth0.x":        {"", 0, false},
+	} {
+		parent, id, ok := ParseName(name)
+		if parent != want.parent || id != want.id || ok != want.ok {
+			t.Errorf("ParseName(%q) = %q, %d, %v; expected %q, %d, %v", name, parent, id, ok, want.parent, want.id, want.ok)
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	fake := netops.NewFake()
+	Ops = fake
+	defer func() { Ops = netops.Kernel{} }()
+
+	parent := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 9000}}
+	if err := fake.LinkAdd(parent); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseIPNet("192.168.100.10/24")
+	config := &Config{Name: "eth0.100", Parent: "eth0", ID: 100, Address: addr}
+
+	// A missing sub-interface is created with the parent's MTU and the address
+	v, err := Setup(config)
+	if err != nil {
+		t.Fatalf("Failed to set up VLAN: %v", err)
+	}
+	if v.VlanId != 100 || v.ParentIndex != parent.Index || v.MTU != 9000 || v.Flags&net.FlagUp == 0 {
+		t.Fatalf("Unexpected VLAN interface %+v", v)
+	}
+	addrs, _ := fake.AddrList(v, netlink.FAMILY_V4)
+	if len(addrs) != 1 || !addrs[0].IP.Equal(addr.IP) {
+		t.Fatalf("Expected address %s, got %v", addr, addrs)
+	}
+
+	// Setting it up again reuses it
+	if _, err := Setup(config); err != nil {
+		t.Fatalf("Failed to set up existing VLAN: %v", err)
+	}
+
+	// Another VLAN or another kind of interface of the name is rejected
+	if _, err := Setup(&Config{Name: "eth0.100", Parent: "eth0", ID: 200}); err == nil {
+		t.Fatalf("Expected VLAN of another ID to be rejected")
+	}
+	if err := fake.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0.300"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Setup(&Config{Name: "eth0.300", Parent: "eth0", ID: 300}); err == nil {
+		t.Fatalf("Expected non-VLAN interface to be rejected")
+	}
+
+	// The parent must exist
+	if _, err := Setup(&Config{Name: "eth1.100", Parent: "eth1", ID: 100}); err == nil {
+		t.Fatalf("Expected missing parent to be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package vrf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// ownerAlias marks the VRF devices created by xvm-cni, which are removed
+// again once no network uses them. VRFs set up by the operator are left alone.
+const ownerAlias = "xvm-cni vrf"
+
+// ReservedTable reports whether the routing table is one of the kernel's
+// own, which a VRF can't use
+func ReservedTable(table uint32) bool {
+	return table == unix.RT_TABLE_UNSPEC || table == unix.RT_TABLE_DEFAULT ||
+		table == unix.RT_TABLE_MAIN || table == unix.RT_TABLE_LOCAL
+}
+
+// Setup creates the VRF routing through the table if it doesn't exist yet
+// and sets it up. An existing VRF is reused as long as it uses the table; a
+// table of 0 accepts any.
+func Setup(name string, table uint32) (*netlink.Vrf, error) {
+	if existing, err := netlink.LinkByName(name); err == nil {
+		v, ok := existing.(*netlink.Vrf)
+		if !ok {
+			return nil, fmt.Errorf("interface %s already exists but is not a VRF", name)
+		}
+		if table != 0 && v.Table != table {
+			return nil, fmt.Errorf("VRF %s uses table %d, not %d", name, v.Table, table)
+		}
+		if err := netlink.LinkSetUp(v); err != nil {
+			return nil, fmt.Errorf("failed to set VRF %s up: %v", name, err)
+		}
+		return v, nil
+	}
+	if table == 0 {
+		return nil, fmt.Errorf("VRF %s doesn't exist and no table is given to create it", name)
+	}
+
+	// Another invocation may have created it concurrently, use theirs then
+	v := &netlink.Vrf{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Table:     table,
+	}
+	err := retry.Do(func() error { return netlink.LinkAdd(v) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create VRF %s: %v", name, err)
+	}
+	created := err == nil
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VRF %s: %v", name, err)
+	}
+	v, ok := link.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("interface %s is not a VRF", name)
+	}
+	if created {
+		if err := netlink.LinkSetAlias(link, ownerAlias); err != nil {
+			return nil, fmt.Errorf("failed to mark VRF %s: %v", name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(v); err != nil {
+		return nil, fmt.Errorf("failed to set VRF %s up: %v", name, err)
+	}
+	return v, nil
+}
+
+// Join enslaves the link to the VRF, so the routes of its addresses move to
+// the VRF's table. It reports whether the link had to be moved; the kernel
+// cycles the link then, which drops its IPv6 addresses.
+func Join(v *netlink.Vrf, link netlink.Link) (bool, error) {
+	if link.Attrs().MasterIndex == v.Attrs().Index {
+		return false, nil // Already a member
+	}
+	if err := retry.Do(func() error { return netlink.LinkSetMasterByIndex(link, v.Attrs().Index) }); err != nil {
+		return false, fmt.Errorf("failed to add %s to VRF %s: %v", link.Attrs().Name, v.Attrs().Name, err)
+	}
+	return true, nil
+}
+
+// Member reports whether the link is enslaved to the VRF of that name
+func Member(name string, link netlink.Link) (bool, error) {
+	v, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, fmt.Errorf("VRF %s not found: %v", name, err)
+	}
+	return link.Attrs().MasterIndex == v.Attrs().Index, nil
+}
+
+// Cleanup removes the VRF if xvm-cni created it and no interface is left in
+// it
+func Cleanup(name string) error {
+	v, err := netlink.LinkByName(name)
+	if err != nil || v.Attrs().Alias != ownerAlias {
+		return nil // Gone already, or not ours
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex == v.Attrs().Index {
+			return nil // Still in use by another network
+		}
+	}
+	if err := netlink.LinkDel(v); err != nil {
+		return fmt.Errorf("failed to delete VRF %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package vrf
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestReservedTable(t *testing.T) {
+	for _, table := range []uint32{0, 253, 254, 255} {
+		if !ReservedTable(table) {
+			t.Errorf("Expected table %d to be reserved", table)
+		}
+	}
+	if ReservedTable(100) {
+		t.Errorf("Expected table 100 to be usable")
+	}
+}
+
+func TestSetupCleanup(t *testing.T) {
+	// Skip test if not running as root
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	const name = "xvmvrftest"
+	v, err := Setup(name, 1099)
+	if err != nil {
+		t.Skipf("VRFs not supported: %v", err)
+	}
+	defer netlink.LinkDel(v)
+
+	// Setup twice to verify the VRF is reused, and refused for another table
+	again, err := Setup(name, 0)
+	if err != nil {
+		t.Fatalf("Failed to setup existing VRF: %v", err)
+	}
+	if again.Attrs().Index != v.Attrs().Index {
+		t.Fatalf("Existing VRF was recreated")
+	}
+	if _, err := Setup(name, 1100); err == nil {
+		t.Fatalf("Expected an error for a VRF with another table")
+	}
+
+	// Join a bridge, which keeps the VRF in use
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "xvmvrftestbr"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatalf("Failed to create bridge: %v", err)
+	}
+	defer netlink.LinkDel(br)
+	if moved, err := Join(v, br); err != nil || !moved {
+		t.Fatalf("Failed to join VRF: moved %v, %v", moved, err)
+	}
+	link, _ := netlink.LinkByName(br.Name)
+	if member, err := Member(name, link); err != nil || !member {
+		t.Fatalf("Expected bridge to be a member of the VRF: %v", err)
+	}
+	if moved, err := Join(v, link); err != nil || moved {
+		t.Fatalf("Expected joining again to be a no-op: moved %v, %v", moved, err)
+	}
+	if err := Cleanup(name); err != nil {
+		t.Fatalf("Failed to clean up VRF: %v", err)
+	}
+	if _, err := netlink.LinkByName(name); err != nil {
+		t.Fatalf("VRF in use was removed")
+	}
+
+	netlink.LinkDel(link)
+	if err := Cleanup(name); err != nil {
+		t.Fatalf("Failed to clean up VRF: %v", err)
+	}
+	if _, err := netlink.LinkByName(name); err == nil {
+		t.Fatalf("Unused VRF was left behind")
+	}
+}
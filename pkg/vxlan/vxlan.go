@@ -4,11 +4,17 @@
 package vxlan
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/devname"
+	"github.com/nohns/xvm-cni/pkg/netops"
+	"github.com/nohns/xvm-cni/pkg/retry"
 )
 
 const (
@@ -18,97 +24,353 @@ const (
 	DefaultVxlanVNI = 10
 	// DefaultMTU is the default MTU for VXLAN interfaces
 	DefaultMTU = 1500
+	// DefaultTxQLen is the default transmit queue length for VXLAN interfaces
+	DefaultTxQLen = 1000
+	// MaxVxlanVNI is the largest VXLAN Network Identifier (24 bits)
+	MaxVxlanVNI = 1<<24 - 1
+	// Overhead is what encapsulation over IPv4 adds to every packet; the
+	// kernel caps the device's MTU at the underlay's MTU less this
+	Overhead = 50
+	// SafeMTU is the largest MTU whose encapsulated frames a standard 1500
+	// byte underlay carries
+	SafeMTU = 1500 - Overhead
+	// MulticastGroup is the group VTEPs flood broadcast, unknown unicast
+	// and multicast traffic to, and learn each other from
+	MulticastGroup = "239.1.1.1"
+
+	// tosInherit is the TOS value telling the kernel to copy the inner TOS,
+	// "tos inherit" in iproute2
+	tosInherit = 1
+)
+
+// Flooding modes, how the device sends broadcast, unknown unicast and
+// multicast traffic, and finds the VTEPs behind remote MACs
+const (
+	// FloodMulticast floods to MulticastGroup, learning the remote MACs
+	// from what arrives. The underlay must route multicast.
+	FloodMulticast = "multicast"
+	// FloodHeadEnd replicates the traffic to each peer with a flood entry,
+	// learning the remote MACs like FloodMulticast
+	FloodHeadEnd = "headEnd"
+	// FloodNone neither floods nor learns, leaving every remote MAC to
+	// forwarding entries a controller programs
+	FloodNone = "none"
 )
 
+// Ops makes the package's netlink requests; tests and other datapaths
+// replace it
+var Ops netops.Ops = netops.Kernel{}
+
+// DeviceName returns the name of the VXLAN interface of a network, or of a
+// VXLAN ID for networks without a name as earlier versions named it
+func DeviceName(network string, vxlanID int) string {
+	if network == "" {
+		return fmt.Sprintf("vxlan%d", vxlanID)
+	}
+	return devname.For("xvx-", network)
+}
+
 // VxlanConfig holds the configuration for a VXLAN network
 type VxlanConfig struct {
+	// Name is the name of the interface
+	Name          string
 	HostInterface string
 	VxlanID       int
 	MTU           int
+	Port          int
+	TxQLen        int
+	// InheritTOS copies the TOS of the inner packet to the outer header
+	InheritTOS bool
+	// Flooding is the flooding mode (default: FloodMulticast)
+	Flooding string
+}
+
+// LocalIP returns the IPv4 address of the host interface, used as the
+// local VXLAN tunnel endpoint
+func LocalIP(hostInterface string) (net.IP, error) {
+	hostIface, err := Ops.LinkByName(hostInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host interface %s: %v", hostInterface, err)
+	}
+	addrs, err := Ops.AddrList(hostIface, unix.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses for interface %s: %v", hostInterface, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no IPv4 address found on interface %s", hostInterface)
+	}
+	return addrs[0].IP, nil
 }
 
 // SetupVxlan creates a VXLAN interface and configures it
 func SetupVxlan(config *VxlanConfig) (*netlink.Vxlan, error) {
 	// Get the host interface
-	hostIface, err := netlink.LinkByName(config.HostInterface)
+	hostIface, err := Ops.LinkByName(config.HostInterface)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get host interface %s: %v", config.HostInterface, err)
 	}
 
 	// Get the IP address of the host interface
-	addrs, err := netlink.AddrList(hostIface, unix.AF_INET)
+	hostIP, err := LocalIP(config.HostInterface)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get addresses for interface %s: %v", config.HostInterface, err)
-	}
-	if len(addrs) == 0 {
-		return nil, fmt.Errorf("no IPv4 address found on interface %s", config.HostInterface)
+		return nil, err
 	}
-	hostIP := addrs[0].IP
 
 	// Create VXLAN interface
-	vxlanName := fmt.Sprintf("vxlan%d", config.VxlanID)
+	port := config.Port
+	if port == 0 {
+		port = DefaultVxlanPort
+	}
+	txQLen := config.TxQLen
+	if txQLen == 0 {
+		txQLen = DefaultTxQLen
+	}
+	vxlanName := config.Name
 	vxlan := &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
 			Name:   vxlanName,
 			MTU:    config.MTU,
-			TxQLen: 1000,
+			TxQLen: txQLen,
 		},
 		VxlanId:      config.VxlanID,
 		VtepDevIndex: hostIface.Attrs().Index,
 		SrcAddr:      hostIP,
-		Port:         DefaultVxlanPort,
-		Learning:     true,
+		Port:         port,
+		Learning:     config.Flooding != FloodNone,
 		GBP:          false,
-		// Enable multicast for discovery
-		Group: net.ParseIP("239.1.1.1"), // Multicast group IP
+	}
+	// Enable multicast for discovery
+	if config.Flooding == "" || config.Flooding == FloodMulticast {
+		vxlan.Group = net.ParseIP(MulticastGroup)
+	}
+	if config.InheritTOS {
+		vxlan.TOS = tosInherit
 	}
 
-	// Check if the VXLAN interface already exists
-	existing, err := netlink.LinkByName(vxlanName)
+	// Reuse the VXLAN interface if it already exists as configured, which
+	// keeps its forwarding entries and spares each ADD recreating it. One set
+	// up differently, e.g. before the underlay address changed, is replaced.
+	existing, err := Ops.LinkByName(vxlanName)
 	if err == nil {
-		// If it exists, delete it first
-		if err := netlink.LinkDel(existing); err != nil {
+		if current, ok := existing.(*netlink.Vxlan); ok && sameVxlan(current, vxlan, hostIface.Attrs().MTU) {
+			if current.Attrs().Flags&net.FlagUp == 0 {
+				if err := Ops.LinkSetUp(current); err != nil {
+					return nil, fmt.Errorf("failed to set VXLAN interface up: %v", err)
+				}
+			}
+			return current, nil
+		}
+		if err := Ops.LinkDel(existing); err != nil {
 			return nil, fmt.Errorf("failed to delete existing VXLAN interface: %v", err)
 		}
 	}
 
-	// Add the VXLAN interface
-	if err := netlink.LinkAdd(vxlan); err != nil {
+	// Add the VXLAN interface. Another invocation may have created it
+	// concurrently, use theirs then.
+	err = retry.Do(func() error { return Ops.LinkAdd(vxlan) })
+	if err != nil && !errors.Is(err, unix.EEXIST) {
 		return nil, fmt.Errorf("failed to create VXLAN interface: %v", err)
 	}
 
 	// Set the VXLAN interface up
-	if err := netlink.LinkSetUp(vxlan); err != nil {
+	if err := Ops.LinkSetUp(vxlan); err != nil {
 		return nil, fmt.Errorf("failed to set VXLAN interface up: %v", err)
 	}
 
 	return vxlan, nil
 }
 
+// sameVxlan reports whether the existing VXLAN interface is set up as want,
+// with the MTU the kernel caps at what the underlay carries
+func sameVxlan(existing, want *netlink.Vxlan, underlayMTU int) bool {
+	mtu := want.MTU
+	if max := underlayMTU - Overhead; underlayMTU > 0 && mtu > max {
+		mtu = max
+	}
+	return existing.VxlanId == want.VxlanId &&
+		existing.VtepDevIndex == want.VtepDevIndex &&
+		existing.SrcAddr.Equal(want.SrcAddr) &&
+		existing.Group.Equal(want.Group) &&
+		existing.Port == want.Port &&
+		existing.TOS == want.TOS &&
+		existing.Learning == want.Learning &&
+		(mtu == 0 || existing.MTU == mtu)
+}
+
 // CleanupVxlan removes the VXLAN interface
-func CleanupVxlan(vxlanID int) error {
-	vxlanName := fmt.Sprintf("vxlan%d", vxlanID)
-	link, err := netlink.LinkByName(vxlanName)
+func CleanupVxlan(vxlanName string) error {
+	link, err := Ops.LinkByName(vxlanName)
 	if err != nil {
 		// If the interface doesn't exist, that's fine
 		return nil
 	}
 
-	if err := netlink.LinkDel(link); err != nil {
+	if err := Ops.LinkDel(link); err != nil {
 		return fmt.Errorf("failed to delete VXLAN interface: %v", err)
 	}
 
 	return nil
 }
 
-// ConfigureVxlanNetwork sets up the network configuration for the VXLAN
-func ConfigureVxlanNetwork(vxlan *netlink.Vxlan, subnet *net.IPNet) error {
-	// Add an IP address to the VXLAN interface
-	addr := &netlink.Addr{
-		IPNet: subnet,
+// HasFloodEntry reports whether the device has the all-zeros forwarding
+// entry sending traffic without a learned destination to the multicast
+// group. The kernel adds it with the device, but it can be deleted like any
+// other entry.
+func HasFloodEntry(link netlink.Link) (bool, error) {
+	fdb, err := Ops.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return false, fmt.Errorf("failed to list FDB entries on %s: %v", link.Attrs().Name, err)
+	}
+	group := net.ParseIP(MulticastGroup)
+	zero := make(net.HardwareAddr, 6)
+	for _, entry := range fdb {
+		if bytes.Equal(entry.HardwareAddr, zero) && entry.IP.Equal(group) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddFloodEntry adds the all-zeros forwarding entry to the multicast group
+// as the kernel does for a new device, leaving through the underlay device
+func AddFloodEntry(link *netlink.Vxlan) error {
+	return appendFloodEntry(link, net.ParseIP(MulticastGroup), link.VtepDevIndex)
+}
+
+// FloodMode returns the flooding mode the device was created in
+func FloodMode(link *netlink.Vxlan) string {
+	switch {
+	case link.Group != nil && !link.Group.IsUnspecified():
+		return FloodMulticast
+	case link.Learning:
+		return FloodHeadEnd
+	}
+	return FloodNone
+}
+
+// FloodPeers returns the peers the device replicates traffic without a
+// learned destination to, other than the multicast group
+func FloodPeers(link netlink.Link) ([]net.IP, error) {
+	fdb, err := Ops.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list FDB entries on %s: %v", link.Attrs().Name, err)
+	}
+	zero := make(net.HardwareAddr, 6)
+	var peers []net.IP
+	for _, entry := range fdb {
+		if bytes.Equal(entry.HardwareAddr, zero) && entry.IP != nil && !entry.IP.IsMulticast() {
+			peers = append(peers, entry.IP)
+		}
+	}
+	return peers, nil
+}
+
+// AddFloodPeers adds an all-zeros forwarding entry to each peer the device
+// doesn't replicate to yet, for FloodHeadEnd
+func AddFloodPeers(link *netlink.Vxlan, peers []net.IP) error {
+	have, err := FloodPeers(link)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if !containsIP(have, peer) {
+			if err := appendFloodEntry(link, peer, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DelFloodPeers removes the all-zeros forwarding entries to the peers, if
+// any
+func DelFloodPeers(link netlink.Link, peers []net.IP) error {
+	have, err := FloodPeers(link)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if !containsIP(have, peer) {
+			continue
+		}
+		entry := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			IP:           peer,
+			HardwareAddr: make(net.HardwareAddr, 6),
+		}
+		if err := Ops.NeighDel(entry); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("failed to delete flood entry to %s on %s: %v", peer, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// appendFloodEntry adds an all-zeros forwarding entry to the destination,
+// next to any others
+func appendFloodEntry(link *netlink.Vxlan, dst net.IP, vtepDevIndex int) error {
+	entry := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       unix.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           dst,
+		HardwareAddr: make(net.HardwareAddr, 6),
+	}
+	if err := Ops.NeighAppendVia(entry, vtepDevIndex); err != nil {
+		return fmt.Errorf("failed to add flood entry to %s on %s: %v", dst, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// containsIP reports whether the address is among the addresses
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
 	}
-	if err := netlink.AddrAdd(vxlan, addr); err != nil {
-		return fmt.Errorf("failed to add IP address to VXLAN interface: %v", err)
+	return false
+}
+
+// PruneNeighbors removes FDB and neighbor entries on the given link that
+// reference any of the given MAC or IP addresses
+func PruneNeighbors(link netlink.Link, macs []net.HardwareAddr, ips []net.IP) error {
+	index := link.Attrs().Index
+
+	// Remove FDB entries for the given MACs
+	fdb, err := Ops.NeighList(index, unix.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list FDB entries on %s: %v", link.Attrs().Name, err)
+	}
+	for _, entry := range fdb {
+		for _, mac := range macs {
+			if bytes.Equal(entry.HardwareAddr, mac) {
+				if err := Ops.NeighDel(&entry); err != nil {
+					return fmt.Errorf("failed to delete FDB entry %s: %v", mac, err)
+				}
+				break
+			}
+		}
+	}
+
+	// Remove ARP and NDP entries for the given IPs
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		neighs, err := Ops.NeighList(index, family)
+		if err != nil {
+			return fmt.Errorf("failed to list neighbors on %s: %v", link.Attrs().Name, err)
+		}
+		for _, entry := range neighs {
+			for _, ip := range ips {
+				if entry.IP.Equal(ip) {
+					if err := Ops.NeighDel(&entry); err != nil {
+						return fmt.Errorf("failed to delete neighbor %s: %v", ip, err)
+					}
+					break
+				}
+			}
+		}
 	}
 
 	return nil
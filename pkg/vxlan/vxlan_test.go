@@ -4,11 +4,15 @@
 package vxlan
 
 import (
+	"bytes"
 	"net"
 	"os"
 	"testing"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/netops"
 )
 
 // findTestInterface finds a suitable network interface for testing
@@ -54,6 +58,7 @@ func TestSetupVxlan(t *testing.T) {
 
 	// Test VXLAN setup
 	config := &VxlanConfig{
+		Name:          DeviceName("", 99),
 		HostInterface: testInterface,
 		VxlanID:       99, // Use a high ID to avoid conflicts
 		MTU:           1500,
@@ -86,7 +91,7 @@ func TestSetupVxlan(t *testing.T) {
 	}
 
 	// Clean up
-	if err := CleanupVxlan(config.VxlanID); err != nil {
+	if err := CleanupVxlan(config.Name); err != nil {
 		t.Fatalf("Failed to cleanup VXLAN: %v", err)
 	}
 
@@ -95,3 +100,124 @@ func TestSetupVxlan(t *testing.T) {
 		t.Fatalf("VXLAN interface still exists after cleanup")
 	}
 }
+
+func TestVxlanFake(t *testing.T) {
+	fake := netops.NewFake()
+	Ops = fake
+	defer func() { Ops = netops.Kernel{} }()
+
+	underlay := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	if err := fake.LinkAdd(underlay); err != nil {
+		t.Fatal(err)
+	}
+	local := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(24, 32)}}
+	if err := fake.AddrAdd(underlay, local); err != nil {
+		t.Fatal(err)
+	}
+
+	vx, err := SetupVxlan(&VxlanConfig{Name: DeviceName("xvm-net", 42), HostInterface: "eth0", VxlanID: 42, MTU: 1450})
+	if err != nil {
+		t.Fatalf("Failed to set up VXLAN: %v", err)
+	}
+	if vx.VtepDevIndex != underlay.Index || !vx.SrcAddr.Equal(local.IP) || vx.Port != DefaultVxlanPort {
+		t.Fatalf("Unexpected VXLAN device %+v", vx)
+	}
+	if vx.Flags&net.FlagUp == 0 {
+		t.Fatalf("Expected VXLAN device to be up")
+	}
+
+	// The flood entry is restored like the kernel adds it
+	if ok, err := HasFloodEntry(vx); err != nil || ok {
+		t.Fatalf("Expected no flood entry, got %v, %v", ok, err)
+	}
+	if err := AddFloodEntry(vx); err != nil {
+		t.Fatalf("Failed to add flood entry: %v", err)
+	}
+	if ok, err := HasFloodEntry(vx); err != nil || !ok {
+		t.Fatalf("Expected flood entry, got %v, %v", ok, err)
+	}
+
+	// Only the entries of the given MACs and addresses are pruned
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+	for _, m := range []net.HardwareAddr{mac, other} {
+		fdb := &netlink.Neigh{LinkIndex: vx.Index, Family: unix.AF_BRIDGE, HardwareAddr: m, IP: net.ParseIP("192.168.1.11")}
+		if err := fake.NeighSet(fdb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arp := &netlink.Neigh{LinkIndex: vx.Index, IP: net.ParseIP("10.244.0.5"), HardwareAddr: mac}
+	if err := fake.NeighSet(arp); err != nil {
+		t.Fatal(err)
+	}
+	if err := PruneNeighbors(vx, []net.HardwareAddr{mac}, []net.IP{arp.IP}); err != nil {
+		t.Fatalf("Failed to prune neighbors: %v", err)
+	}
+	left := fake.Neighs()
+	if len(left) != 2 || !bytes.Equal(left[0].HardwareAddr, make(net.HardwareAddr, 6)) || !bytes.Equal(left[1].HardwareAddr, other) {
+		t.Fatalf("Unexpected entries left: %+v", left)
+	}
+
+	// Setting it up again reuses the device along with its entries, unless
+	// it is set up differently
+	again, err := SetupVxlan(&VxlanConfig{Name: DeviceName("xvm-net", 42), HostInterface: "eth0", VxlanID: 42, MTU: 1450})
+	if err != nil {
+		t.Fatalf("Failed to set up VXLAN again: %v", err)
+	}
+	if again.Index != vx.Index {
+		t.Fatalf("Expected VXLAN device %d to be reused, got %d", vx.Index, again.Index)
+	}
+	if ok, err := HasFloodEntry(again); err != nil || !ok {
+		t.Fatalf("Expected flood entry to be kept, got %v, %v", ok, err)
+	}
+	changed, err := SetupVxlan(&VxlanConfig{Name: DeviceName("xvm-net", 42), HostInterface: "eth0", VxlanID: 42, MTU: 1450, Port: 4790})
+	if err != nil {
+		t.Fatalf("Failed to set up changed VXLAN: %v", err)
+	}
+	if changed.Index == vx.Index || changed.Port != 4790 {
+		t.Fatalf("Expected VXLAN device to be recreated, got %+v", changed)
+	}
+
+	if FloodMode(changed) != FloodMulticast {
+		t.Fatalf("Expected multicast flooding by default, got %s", FloodMode(changed))
+	}
+
+	// Head-end replication floods to the peers instead of a group, and
+	// another mode recreates the device
+	headEnd, err := SetupVxlan(&VxlanConfig{Name: DeviceName("xvm-net", 42), HostInterface: "eth0", VxlanID: 42, MTU: 1450, Port: 4790, Flooding: FloodHeadEnd})
+	if err != nil {
+		t.Fatalf("Failed to set up head-end VXLAN: %v", err)
+	}
+	if headEnd.Index == changed.Index || headEnd.Group != nil || FloodMode(headEnd) != FloodHeadEnd {
+		t.Fatalf("Expected VXLAN device recreated for head-end replication, got %+v", headEnd)
+	}
+	peers := []net.IP{net.ParseIP("192.168.1.11"), net.ParseIP("192.168.1.12")}
+	for i := 0; i < 2; i++ {
+		if err := AddFloodPeers(headEnd, peers); err != nil {
+			t.Fatalf("Failed to add flood peers: %v", err)
+		}
+	}
+	if got, err := FloodPeers(headEnd); err != nil || len(got) != 2 || !got[0].Equal(peers[0]) || !got[1].Equal(peers[1]) {
+		t.Fatalf("Expected flood peers %v, got %v (%v)", peers, got, err)
+	}
+	if err := DelFloodPeers(headEnd, []net.IP{peers[0], net.ParseIP("192.168.1.13")}); err != nil {
+		t.Fatalf("Failed to delete flood peers: %v", err)
+	}
+	if got, err := FloodPeers(headEnd); err != nil || len(got) != 1 || !got[0].Equal(peers[1]) {
+		t.Fatalf("Expected flood peer %v left, got %v (%v)", peers[1], got, err)
+	}
+	none, err := SetupVxlan(&VxlanConfig{Name: DeviceName("xvm-net", 42), HostInterface: "eth0", VxlanID: 42, MTU: 1450, Port: 4790, Flooding: FloodNone})
+	if err != nil {
+		t.Fatalf("Failed to set up VXLAN without flooding: %v", err)
+	}
+	if none.Learning || FloodMode(none) != FloodNone {
+		t.Fatalf("Expected VXLAN device without flooding or learning, got %+v", none)
+	}
+
+	if err := CleanupVxlan("xvx-xvm-net"); err != nil {
+		t.Fatalf("Failed to clean up VXLAN: %v", err)
+	}
+	if _, err := fake.LinkByName("xvx-xvm-net"); err == nil {
+		t.Fatalf("Expected VXLAN device to be deleted")
+	}
+}
@@ -0,0 +1,223 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/k8s"
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+)
+
+// podIPAnnotation pins the addresses of a pod on its cluster network, at
+// most one per address family, e.g. "10.244.0.50,fd00:10:244::50"
+const podIPAnnotation = "xvm-cni.dev/ip"
+
+// lookupPod returns the attachment's pod from the API server, or nil if the
+// network doesn't read pod annotations, the runtime didn't identify the pod
+// in CNI_ARGS, or the API server can't be reached. The pod is then added
+// without its annotations rather than not at all, as pods keep being
+// scheduled to the node while the control plane is down.
+func lookupPod(ctx context.Context, conf *PluginConf, envArgs *EnvArgs) (*k8s.Pod, error) {
+	owner := envArgs.owner()
+	if !conf.PodAnnotations || owner.PodNamespace == "" || owner.PodName == "" {
+		return nil, nil
+	}
+	config, err := conf.Kubernetes.Config()
+	if err != nil {
+		return nil, configError("failed to configure the Kubernetes client", err)
+	}
+	client, err := k8s.NewClient(config)
+	if err != nil {
+		return nil, configError("failed to configure the Kubernetes client", err)
+	}
+	pod, err := client.GetPod(ctx, owner.PodNamespace, owner.PodName)
+	if err != nil && !k8s.IsStatus(err) {
+		if ctx.Err() != nil {
+			return nil, deadlineError(ctx, "reading the pod's annotations")
+		}
+		warn(fmt.Errorf("adding pod %s/%s without its annotations: %v", owner.PodNamespace, owner.PodName, err))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError(types.ErrTryAgainLater, "failed to read pod annotations", err)
+	}
+	// A pod recreated under the same name has to wait for its own sandbox
+	if owner.PodUID != "" && pod.Metadata.UID != owner.PodUID {
+		return nil, newError(types.ErrTryAgainLater, fmt.Sprintf("pod %s/%s has UID %s, not %s", owner.PodNamespace, owner.PodName, pod.Metadata.UID, owner.PodUID), nil)
+	}
+	return pod, nil
+}
+
+// pinnedIPs returns the addresses the pod's annotation pins for the
+// attachment. Only the pod's cluster network on eth0 is pinned, so the
+// annotation doesn't apply to the subnets of its secondary attachments.
+func pinnedIPs(pod *k8s.Pod, ifName string) ([]string, error) {
+	if pod == nil || ifName != primaryIfName {
+		return nil, nil
+	}
+	value := strings.TrimSpace(pod.Metadata.Annotations[podIPAnnotation])
+	if value == "" {
+		return nil, nil
+	}
+	var ips []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if parseRequestedIP(s) == nil {
+			return nil, configError(fmt.Sprintf("invalid %s annotation %q of pod %s/%s", podIPAnnotation, value, pod.Metadata.Namespace, pod.Metadata.Name), nil)
+		}
+		ips = append(ips, s)
+	}
+	return ips, nil
+}
+
+// The QoS annotations override the network's rate limits and DSCP for a
+// pod. Rates are in bits per second, with an optional k, M or G suffix,
+// and bursts in bits.
+const (
+	podIngressRateAnnotation  = "xvm-cni.dev/ingress-rate"
+	podIngressBurstAnnotation = "xvm-cni.dev/ingress-burst"
+	podEgressRateAnnotation   = "xvm-cni.dev/egress-rate"
+	podEgressBurstAnnotation  = "xvm-cni.dev/egress-burst"
+	podDSCPAnnotation         = "xvm-cni.dev/dscp"
+)
+
+// podQoS is the QoS a pod's annotations set, recorded with the attachment
+// so DEL, CHECK and GC see it without the pod
+type podQoS struct {
+	DSCP *int `json:"dscp,omitempty"`
+	RateLimits
+}
+
+// annotatedQoS returns the QoS the pod's annotations set, or nil if none
+func annotatedQoS(pod *k8s.Pod) (*podQoS, error) {
+	if pod == nil {
+		return nil, nil
+	}
+	q := &podQoS{}
+	set := false
+	for annotation, value := range map[string]*uint64{
+		podIngressRateAnnotation:  &q.IngressRate,
+		podIngressBurstAnnotation: &q.IngressBurst,
+		podEgressRateAnnotation:   &q.EgressRate,
+		podEgressBurstAnnotation:  &q.EgressBurst,
+	} {
+		s, ok := pod.Metadata.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		n, err := parseBits(s)
+		if err != nil {
+			return nil, configError(fmt.Sprintf("invalid %s annotation %q of pod %s/%s", annotation, s, pod.Metadata.Namespace, pod.Metadata.Name), err)
+		}
+		*value = n
+		set = true
+	}
+	if s, ok := pod.Metadata.Annotations[podDSCPAnnotation]; ok {
+		dscp, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, configError(fmt.Sprintf("invalid %s annotation %q of pod %s/%s", podDSCPAnnotation, s, pod.Metadata.Namespace, pod.Metadata.Name), err)
+		}
+		q.DSCP = &dscp
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// parseBits parses a number of bits, or bits per second, with an optional
+// decimal k, M or G suffix
+func parseBits(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1000 * 1000
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("%s overflows", s)
+	}
+	return n * multiplier, nil
+}
+
+// apply overrides the network's QoS with the pod's. A direction the pod
+// sets only the burst of keeps the network's rate. The per-attachment
+// settings of args.cni still take precedence.
+func (q *podQoS) apply(conf *PluginConf) {
+	if q == nil {
+		return
+	}
+	if q.DSCP != nil {
+		conf.DSCP = q.DSCP
+	}
+	if q.IngressRate != 0 {
+		conf.IngressRate, conf.IngressBurst = q.IngressRate, q.IngressBurst
+	} else if q.IngressBurst != 0 {
+		conf.IngressBurst = q.IngressBurst
+	}
+	if q.EgressRate != 0 {
+		conf.EgressRate, conf.EgressBurst = q.EgressRate, q.EgressBurst
+	} else if q.EgressBurst != 0 {
+		conf.EgressBurst = q.EgressBurst
+	}
+}
+
+// recordedQoS returns the pod QoS of the attachment's record, or nil
+func recordedQoS(r *resultcache.Record) (*podQoS, error) {
+	if r == nil || len(r.PodQoS) == 0 {
+		return nil, nil
+	}
+	q := &podQoS{}
+	if err := json.Unmarshal(r.PodQoS, q); err != nil {
+		return nil, newError(types.ErrInternal, "failed to decode recorded pod QoS", err)
+	}
+	return q, nil
+}
+
+// gcAnnotatedDSCP removes the DSCP marking the annotations of pods set on
+// attachments no longer valid, on networks not marking every port, whose
+// marking gcDSCP removes. The caller holds the network lock.
+func gcAnnotatedDSCP(conf *PluginConf, validAttachments map[string]bool) error {
+	records, err := resultcache.LoadAll(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load results", err)
+	}
+	for _, r := range records {
+		if validAttachments[attachmentKey(r.ContainerID, r.IfName)] {
+			continue
+		}
+		q, err := recordedQoS(r)
+		if err != nil {
+			return err
+		}
+		if q == nil || q.DSCP == nil {
+			continue
+		}
+		if err := teardownDSCP(conf, r.ContainerID, r.IfName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/k8s"
+)
+
+func TestLookupPod(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/web-0" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "message": "not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"metadata": {"name": "web-0", "namespace": "default", "uid": "4d2c", "annotations": {"xvm-cni.dev/ip": "10.244.0.50, fd00:10:244::50"}}}`)
+	}))
+	defer srv.Close()
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	data := fmt.Sprintf("current-context: test\nclusters:\n- name: test\n  cluster: {server: %q}\ncontexts:\n- name: test\n  context: {cluster: test, user: test}\nusers:\n- name: test\n  user: {token: secret}\n", srv.URL)
+	if err := os.WriteFile(kubeconfig, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &PluginConf{Kubernetes: &k8s.Settings{Kubeconfig: kubeconfig}}
+	envArgs := &EnvArgs{K8S_POD_NAMESPACE: "default", K8S_POD_NAME: "web-0", K8S_POD_UID: "4d2c"}
+
+	// Pods are only looked up with podAnnotations
+	if pod, err := lookupPod(context.Background(), conf, envArgs); pod != nil || err != nil {
+		t.Fatalf("Expected no lookup without podAnnotations, got %v, %v", pod, err)
+	}
+	conf.PodAnnotations = true
+	pod, err := lookupPod(context.Background(), conf, envArgs)
+	if err != nil {
+		t.Fatalf("Failed to look up pod: %v", err)
+	}
+	ips, err := pinnedIPs(pod, "eth0")
+	if err != nil {
+		t.Fatalf("Failed to read pinned IPs: %v", err)
+	}
+	if len(ips) != 2 || ips[0] != "10.244.0.50" || ips[1] != "fd00:10:244::50" {
+		t.Fatalf("Unexpected pinned IPs %v", ips)
+	}
+	// Secondary attachments aren't pinned
+	if ips, err := pinnedIPs(pod, "net1"); ips != nil || err != nil {
+		t.Fatalf("Expected no pinned IPs for net1, got %v, %v", ips, err)
+	}
+
+	pod.Metadata.Annotations[podIPAnnotation] = "10.244.0.50,web"
+	if _, err := pinnedIPs(pod, "eth0"); err == nil || err.(*types.Error).Code != types.ErrInvalidNetworkConfig {
+		t.Fatalf("Expected invalid annotation to be rejected, got %v", err)
+	}
+
+	// A pod recreated under the same name, or not found, is retried
+	for _, args := range []*EnvArgs{
+		{K8S_POD_NAMESPACE: "default", K8S_POD_NAME: "web-0", K8S_POD_UID: "9f1a"},
+		{K8S_POD_NAMESPACE: "default", K8S_POD_NAME: "web-1"},
+	} {
+		if _, err := lookupPod(context.Background(), conf, args); err == nil || err.(*types.Error).Code != types.ErrTryAgainLater {
+			t.Errorf("Expected %s/%s to be retried, got %v", args.K8S_POD_NAMESPACE, args.K8S_POD_NAME, err)
+		}
+	}
+
+	// Without an API server the pod is added without its annotations
+	srv.Close()
+	if pod, err := lookupPod(context.Background(), conf, envArgs); pod != nil || err != nil {
+		t.Fatalf("Expected no pod while the API server is unreachable, got %v, %v", pod, err)
+	}
+}
+
+func TestAnnotatedQoS(t *testing.T) {
+	pod := &k8s.Pod{}
+	pod.Metadata.Name, pod.Metadata.Namespace = "web-0", "default"
+	if q, err := annotatedQoS(pod); q != nil || err != nil {
+		t.Fatalf("Expected no QoS without annotations, got %v, %v", q, err)
+	}
+
+	pod.Metadata.Annotations = map[string]string{
+		"xvm-cni.dev/ingress-rate": "100M",
+		"xvm-cni.dev/egress-burst": "512k",
+		"xvm-cni.dev/dscp":         "46",
+	}
+	q, err := annotatedQoS(pod)
+	if err != nil {
+		t.Fatalf("Failed to read QoS annotations: %v", err)
+	}
+	if q.IngressRate != 100000000 || q.EgressBurst != 512000 || q.DSCP == nil || *q.DSCP != 46 {
+		t.Fatalf("Unexpected QoS %+v", q)
+	}
+
+	// The pod's rate replaces the network's limit in that direction, its
+	// burst alone keeps the network's rate
+	ten := 10
+	conf := &PluginConf{DSCP: &ten, RateLimits: RateLimits{IngressRate: 1000000, IngressBurst: 80000, EgressRate: 2000000}}
+	q.apply(conf)
+	if *conf.dscp() != 46 {
+		t.Errorf("Expected DSCP 46, got %d", *conf.dscp())
+	}
+	if limits := conf.rateLimits(); limits != (RateLimits{IngressRate: 100000000, EgressRate: 2000000, EgressBurst: 512000}) {
+		t.Errorf("Unexpected rate limits %+v", limits)
+	}
+	// args.cni still takes precedence
+	eight := 8
+	conf.Args = &ArgsConf{}
+	conf.Args.CNI.DSCP = &eight
+	if *conf.dscp() != 8 {
+		t.Errorf("Expected the per-attachment DSCP, got %d", *conf.dscp())
+	}
+
+	for _, annotations := range []map[string]string{
+		{"xvm-cni.dev/ingress-rate": "fast"},
+		{"xvm-cni.dev/egress-rate": "-1M"},
+		{"xvm-cni.dev/egress-rate": "99999999999G"},
+		{"xvm-cni.dev/dscp": "ef"},
+	} {
+		pod.Metadata.Annotations = annotations
+		if _, err := annotatedQoS(pod); err == nil || err.(*types.Error).Code != types.ErrInvalidNetworkConfig {
+			t.Errorf("Expected %v to be rejected, got %v", annotations, err)
+		}
+	}
+}
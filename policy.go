@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/policy"
+)
+
+// attachmentPolicy returns the policy of the attachment: the rules of the
+// network configuration followed by those of the Kubernetes NetworkPolicies
+// of the pod's namespace, with the node let through first if host routes
+// are enabled
+func attachmentPolicy(conf *PluginConf, envArgs *EnvArgs) (*policy.Policy, error) {
+	p := conf.Policy.Policy
+	if conf.Policy.NetworkPolicyDir != "" && envArgs.K8S_POD_NAMESPACE != "" {
+		networkPolicies, err := policy.LoadNetworkPolicies(conf.Policy.NetworkPolicyDir, string(envArgs.K8S_POD_NAMESPACE))
+		if err != nil {
+			return nil, configError("failed to load NetworkPolicies", err)
+		}
+		p = policy.FromNetworkPolicies(p, networkPolicies)
+	}
+
+	// Host routes are for the node to reach the container, so its traffic
+	// passes whatever the rules say
+	if conf.HostRoutes {
+		addrs, err := hostAddresses(conf)
+		if err != nil {
+			return nil, netlinkError("failed to get host addresses", err)
+		}
+		if len(addrs) > 0 {
+			permit := policy.Rule{Action: policy.ActionAllow}
+			for _, addr := range addrs {
+				permit.CIDRs = append(permit.CIDRs, hostRouteDst(addr).String())
+			}
+			p.Ingress = append([]policy.Rule{permit}, p.Ingress...)
+		}
+	}
+	return &p, nil
+}
+
+// setupPolicy installs the policy chains of the attachment's host-side port
+func setupPolicy(conf *PluginConf, args *skel.CmdArgs, envArgs *EnvArgs, hostPort, containerIface net.Interface, undo *rollback) error {
+	p, err := attachmentPolicy(conf, envArgs)
+	if err != nil {
+		return err
+	}
+	port := &policy.Port{
+		Attachment: attachmentKey(args.ContainerID, args.IfName),
+		Device:     hostPort.Name,
+	}
+	// A tap is the VM's port on the bridge itself
+	if conf.Mode == modeTap {
+		port.Device = containerIface.Name
+	}
+
+	if err := policy.Setup(policy.TableName(conf.VxlanID), p, port); err != nil {
+		return newError(types.ErrInternal, "failed to install network policy", err)
+	}
+	undo.add(func() error { return teardownPolicy(conf, args.ContainerID, args.IfName) })
+	return nil
+}
+
+// teardownPolicy removes the policy chains of the attachment's port
+func teardownPolicy(conf *PluginConf, containerID, ifName string) error {
+	if err := policy.Teardown(policy.TableName(conf.VxlanID), attachmentKey(containerID, ifName)); err != nil {
+		return newError(types.ErrInternal, "failed to remove network policy", err)
+	}
+	return nil
+}
+
+// checkPolicy verifies that the policy chains of the attachment's port are
+// installed
+func checkPolicy(conf *PluginConf, args *skel.CmdArgs) error {
+	key := attachmentKey(args.ContainerID, args.IfName)
+	attachments, err := policy.Attachments(policy.TableName(conf.VxlanID))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list network policy chains", err)
+	}
+	if ingress, _ := policy.ChainNames(key); attachments[ingress] != key {
+		return newError(types.ErrInternal, fmt.Sprintf("no network policy for %s", args.IfName), nil)
+	}
+	return nil
+}
+
+// gcPolicy removes the policy chains of attachments the runtime no longer
+// knows about
+func gcPolicy(conf *PluginConf, validAttachments map[string]bool) error {
+	table := policy.TableName(conf.VxlanID)
+	attachments, err := policy.Attachments(table)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list network policy chains", err)
+	}
+	for _, key := range attachments {
+		if validAttachments[key] {
+			continue
+		}
+		if err := policy.Teardown(table, key); err != nil {
+			return newError(types.ErrInternal, "failed to remove orphaned network policy", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/nohns/xvm-cni/pkg/fw"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// portMappings binds the ports the runtime maps with the portMappings
+// capability to the container's addresses
+func portMappings(conf *PluginConf, containerIPs []*current.IPConfig) []fw.PortMapping {
+	ips := make([]net.IPNet, 0, len(containerIPs))
+	for _, ipc := range containerIPs {
+		ips = append(ips, ipc.Address)
+	}
+	return fw.ExpandPortMappings(conf.RuntimeConfig.PortMappings, ips)
+}
+
+// setupPortMappings forwards the node's ports the runtime maps to the
+// container, hairpinning the connections of the containers of its subnet
+// and of the node itself. The rules are stored in the network's data
+// directory, for the agent to restore them if something resets the host's
+// firewall.
+func setupPortMappings(conf *PluginConf, args *skel.CmdArgs, containerIPs []*current.IPConfig, undo *rollback) error {
+	backend, err := firewall(conf)
+	if err != nil {
+		return err
+	}
+	stored := &fw.StoredPortMappings{
+		Network:    conf.Name,
+		Attachment: attachmentKey(args.ContainerID, args.IfName),
+		Backend:    backend.Name(),
+		Mappings:   portMappings(conf, containerIPs),
+	}
+	undo.add(func() error { return teardownPortMappings(conf, args.ContainerID, args.IfName) })
+	if err := backend.SetupPortMappings(conf.Name, stored.Attachment, stored.Mappings); err != nil {
+		return newError(types.ErrInternal, "failed to setup port mappings", err)
+	}
+	// The node's connections to 127.0.0.1 are hairpinned through the
+	// bridge or shim, guarded against the containers sending to the node's
+	// loopback addresses themselves
+	if fw.NeedsLoopbackRouting(stored.Mappings) {
+		if err := backend.SetupLoopbackGuard(conf.Name, l2Name(conf)); err != nil {
+			return newError(types.ErrInternal, "failed to setup loopback guard", err)
+		}
+		if err := fw.EnableLoopbackRouting(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name, l2Name(conf)); err != nil {
+			return newError(types.ErrInternal, "failed to setup port mappings", err)
+		}
+	}
+	if err := fw.SavePortMappings(ipam.NetworkDir(conf.DataDir, conf.Name), stored); err != nil {
+		return newError(types.ErrInternal, "failed to store port mappings", err)
+	}
+	return nil
+}
+
+// teardownPortMappings removes the port forwarding rules of the attachment,
+// if it has any, with every backend on the host, and then their stored copy
+func teardownPortMappings(conf *PluginConf, containerID, ifName string) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	key := attachmentKey(containerID, ifName)
+	stored, err := fw.LoadAttachmentPortMappings(dir, conf.Name, key)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load port mappings", err)
+	}
+	// Runtimes pass the mappings on DEL too, but may have lost them
+	if stored == nil && len(conf.RuntimeConfig.PortMappings) == 0 {
+		return nil
+	}
+	for _, backend := range fw.Available() {
+		if err := backend.TeardownPortMappings(conf.Name, key); err != nil {
+			return newError(types.ErrInternal, "failed to teardown port mappings", err)
+		}
+	}
+	if err := fw.RemovePortMappings(dir, conf.Name, key); err != nil {
+		return newError(types.ErrInternal, "failed to remove stored port mappings", err)
+	}
+	return releaseLoopbackRouting(conf)
+}
+
+// releaseLoopbackRouting restores the bridge's or shim's route_localnet and
+// then removes the loopback guard, with every backend on the host, once no
+// attachment's mappings forward the node's loopback connections
+func releaseLoopbackRouting(conf *PluginConf) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	stored, err := fw.LoadPortMappings(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load port mappings", err)
+	}
+	for _, s := range stored {
+		if fw.NeedsLoopbackRouting(s.Mappings) {
+			return nil
+		}
+	}
+	if err := fw.RestoreLoopbackRouting(dir, conf.Name, l2Name(conf)); err != nil {
+		return newError(types.ErrInternal, "failed to restore loopback routing", err)
+	}
+	for _, backend := range fw.Available() {
+		if err := backend.TeardownLoopbackGuard(conf.Name); err != nil {
+			return newError(types.ErrInternal, "failed to teardown loopback guard", err)
+		}
+	}
+	return nil
+}
+
+// checkPortMappings verifies that the port forwarding rules of the
+// attachment are installed
+func checkPortMappings(conf *PluginConf, args *skel.CmdArgs) error {
+	key := attachmentKey(args.ContainerID, args.IfName)
+	stored, err := fw.LoadAttachmentPortMappings(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name, key)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load port mappings", err)
+	}
+	if stored == nil {
+		return newError(types.ErrInternal, fmt.Sprintf("no port mappings stored for %s", args.IfName), nil)
+	}
+	backend, err := fw.New(stored.Backend)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to select firewall backend", err)
+	}
+	ok, err := backend.HasPortMappings(conf.Name, key, stored.Mappings)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check port mappings", err)
+	}
+	if !ok {
+		return newError(types.ErrInternal, fmt.Sprintf("port mapping rules of %s are missing", args.IfName), nil)
+	}
+	return nil
+}
+
+// gcPortMappings removes the port forwarding rules of attachments the
+// runtime no longer knows about
+func gcPortMappings(conf *PluginConf, validAttachments map[string]bool) error {
+	stored, err := fw.LoadPortMappings(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load port mappings", err)
+	}
+	for _, s := range stored {
+		if validAttachments[s.Attachment] {
+			continue
+		}
+		for _, backend := range fw.Available() {
+			if err := backend.TeardownPortMappings(conf.Name, s.Attachment); err != nil {
+				return newError(types.ErrInternal, "failed to teardown orphaned port mappings", err)
+			}
+		}
+		if err := fw.RemovePortMappings(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name, s.Attachment); err != nil {
+			return newError(types.ErrInternal, "failed to remove stored port mappings", err)
+		}
+	}
+	return releaseLoopbackRouting(conf)
+}
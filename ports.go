@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/policy"
+)
+
+// allowedIngressPorts returns the ports connections to the attachment are
+// let through on, args.cni.allowedIngressPorts taking precedence over the
+// network's. Nil leaves ingress open; an empty list from args lifts the
+// network's allowlist for the attachment.
+func (c *PluginConf) allowedIngressPorts() []string {
+	if c.Args != nil && c.Args.CNI.AllowedIngressPorts != nil {
+		return c.Args.CNI.AllowedIngressPorts
+	}
+	return c.AllowedIngressPorts
+}
+
+// filtersIngressPorts reports whether the network's containers may have an
+// ingress port allowlist, and so a table of them to maintain
+func (c *PluginConf) filtersIngressPorts() bool {
+	return len(c.AllowedIngressPorts) > 0 || len(c.allowedIngressPorts()) > 0
+}
+
+// setupPortAllowlist installs the chains on the attachment's host-side port
+// dropping connections to the container on ports outside its allowlist
+func setupPortAllowlist(conf *PluginConf, args *skel.CmdArgs, hostPort, containerIface net.Interface, undo *rollback) error {
+	port := &policy.Port{
+		Attachment: attachmentKey(args.ContainerID, args.IfName),
+		Device:     hostPort.Name,
+	}
+	// A tap is the VM's port on the bridge itself
+	if conf.Mode == modeTap {
+		port.Device = containerIface.Name
+	}
+
+	if err := policy.Setup(policy.PortsTableName(conf.VxlanID), policy.AllowPorts(conf.allowedIngressPorts()), port); err != nil {
+		return newError(types.ErrInternal, "failed to install ingress port allowlist", err)
+	}
+	undo.add(func() error { return teardownPortAllowlist(conf, args.ContainerID, args.IfName) })
+	return nil
+}
+
+// teardownPortAllowlist removes the chains of the attachment's port
+func teardownPortAllowlist(conf *PluginConf, containerID, ifName string) error {
+	if err := policy.Teardown(policy.PortsTableName(conf.VxlanID), attachmentKey(containerID, ifName)); err != nil {
+		return newError(types.ErrInternal, "failed to remove ingress port allowlist", err)
+	}
+	return nil
+}
+
+// checkPortAllowlist verifies that the chains of the attachment's port are
+// installed
+func checkPortAllowlist(conf *PluginConf, args *skel.CmdArgs) error {
+	key := attachmentKey(args.ContainerID, args.IfName)
+	attachments, err := policy.Attachments(policy.PortsTableName(conf.VxlanID))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list ingress port allowlist chains", err)
+	}
+	if ingress, _ := policy.ChainNames(key); attachments[ingress] != key {
+		return newError(types.ErrInternal, fmt.Sprintf("no ingress port allowlist for %s", args.IfName), nil)
+	}
+	return nil
+}
+
+// gcPortAllowlist removes the chains of attachments the runtime no longer
+// knows about
+func gcPortAllowlist(conf *PluginConf, validAttachments map[string]bool) error {
+	table := policy.PortsTableName(conf.VxlanID)
+	attachments, err := policy.Attachments(table)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list ingress port allowlist chains", err)
+	}
+	for _, key := range attachments {
+		if validAttachments[key] {
+			continue
+		}
+		if err := policy.Teardown(table, key); err != nil {
+			return newError(types.ErrInternal, "failed to remove orphaned ingress port allowlist", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/hoststate"
+	"github.com/nohns/xvm-cni/pkg/ipam"
+)
+
+// ProxyARPConf holds the ARP proxying of the network's devices, for
+// topologies where the node answers ARP on behalf of the containers
+type ProxyARPConf struct {
+	// Bridge applies to the bridge or shim holding the gateway addresses
+	Bridge *ProxyARPSettings `json:"bridge,omitempty"`
+	// Vxlan applies to the network's VXLAN interface
+	Vxlan *ProxyARPSettings `json:"vxlan,omitempty"`
+}
+
+// ProxyARPSettings holds a device's proxy_arp and proxy_delay sysctls
+type ProxyARPSettings struct {
+	// Enabled has the node answer ARP requests for addresses it routes
+	// elsewhere
+	Enabled bool `json:"enabled"`
+	// Delay is the most, in hundredths of a second, proxied answers are
+	// randomly delayed by (default: the kernel's, 80)
+	Delay *int `json:"delay,omitempty"`
+}
+
+// validate returns the problems with the proxy ARP settings
+func (p *ProxyARPConf) validate() []string {
+	var problems []string
+	for name, s := range map[string]*ProxyARPSettings{"bridge": p.Bridge, "vxlan": p.Vxlan} {
+		if s != nil && s.Delay != nil && *s.Delay < 0 {
+			problems = append(problems, fmt.Sprintf("proxyARP.%s.delay %d out of range", name, *s.Delay))
+		}
+	}
+	return problems
+}
+
+// bridgeProxyARP returns the proxy ARP settings of the bridge or shim, nil
+// if unset
+func (c *PluginConf) bridgeProxyARP() *ProxyARPSettings {
+	if c.ProxyARP == nil {
+		return nil
+	}
+	return c.ProxyARP.Bridge
+}
+
+// vxlanProxyARP returns the proxy ARP settings of the VXLAN interface, nil if
+// unset
+func (c *PluginConf) vxlanProxyARP() *ProxyARPSettings {
+	if c.ProxyARP == nil {
+		return nil
+	}
+	return c.ProxyARP.Vxlan
+}
+
+// proxyARPSysctl is a per-device sysctl, in its table relative to
+// /proc/sys/net, e.g. "ipv4/conf"
+type proxyARPSysctl struct {
+	table, name, value string
+}
+
+// sysctls returns the device sysctls the settings set
+func (s *ProxyARPSettings) sysctls() []proxyARPSysctl {
+	enabled := "0"
+	if s.Enabled {
+		enabled = "1"
+	}
+	sysctls := []proxyARPSysctl{{"ipv4/conf", "proxy_arp", enabled}}
+	if s.Delay != nil {
+		sysctls = append(sysctls, proxyARPSysctl{"ipv4/neigh", "proxy_delay", strconv.Itoa(*s.Delay)})
+	}
+	return sysctls
+}
+
+// key returns the key of the device's sysctl in the host state
+func (s proxyARPSysctl) key(device string) string {
+	return device + "/" + s.table + "/" + s.name
+}
+
+// parseProxyARPKey returns the device and sysctl of a host state key
+func parseProxyARPKey(key string) (string, proxyARPSysctl, bool) {
+	first, last := strings.Index(key, "/"), strings.LastIndex(key, "/")
+	if first < 0 || first == last {
+		return "", proxyARPSysctl{}, false
+	}
+	return key[:first], proxyARPSysctl{table: key[first+1 : last], name: key[last+1:]}, true
+}
+
+// setProxyARP sets the device's proxy ARP sysctls. The values they had are
+// recorded in the network's host state first, and restored for those the
+// settings no longer set, so turning proxyARP off doesn't leave the device
+// proxying. The caller holds the network lock.
+func setProxyARP(conf *PluginConf, device string, s *ProxyARPSettings) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	var sysctls []proxyARPSysctl
+	if s != nil {
+		sysctls = s.sysctls()
+	}
+	wanted := make(map[string]bool, len(sysctls))
+	changed := false
+	for _, sysctl := range sysctls {
+		key := sysctl.key(device)
+		wanted[key] = true
+		if _, ok := state.ProxyARP[key]; ok {
+			continue
+		}
+		value, err := deviceSysctl(sysctl.table, device, sysctl.name)
+		if err != nil {
+			return newError(types.ErrInternal, "failed to configure proxy ARP", err)
+		}
+		if state.ProxyARP == nil {
+			state.ProxyARP = make(map[string]string)
+		}
+		state.ProxyARP[key] = value
+		changed = true
+	}
+	for key := range state.ProxyARP {
+		if dev, _, ok := parseProxyARPKey(key); ok && dev == device && !wanted[key] {
+			if err := restoreProxyARP(state, key); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	if changed {
+		if err := state.Save(dir); err != nil {
+			return newError(types.ErrInternal, "failed to save host state", err)
+		}
+	}
+
+	for _, sysctl := range sysctls {
+		if err := setDeviceSysctl(sysctl.table, device, sysctl.name, sysctl.value); err != nil {
+			return newError(types.ErrInternal, "failed to configure proxy ARP", err)
+		}
+	}
+	return nil
+}
+
+// teardownProxyARP restores the proxy ARP sysctls of the network's devices
+// to the values recorded before the plugin set them. The caller holds the
+// network lock.
+func teardownProxyARP(conf *PluginConf) error {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	state, err := hoststate.Load(dir, conf.Name)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to load host state", err)
+	}
+	if len(state.ProxyARP) == 0 {
+		return nil
+	}
+	for key := range state.ProxyARP {
+		if err := restoreProxyARP(state, key); err != nil {
+			return err
+		}
+	}
+	if err := state.Save(dir); err != nil {
+		return newError(types.ErrInternal, "failed to save host state", err)
+	}
+	return nil
+}
+
+// restoreProxyARP sets a recorded sysctl back to its value and forgets it.
+// Devices that are gone took the sysctl with them.
+func restoreProxyARP(state *hoststate.State, key string) error {
+	device, sysctl, ok := parseProxyARPKey(key)
+	if ok && linkExists(device) {
+		if err := setDeviceSysctl(sysctl.table, device, sysctl.name, state.ProxyARP[key]); err != nil {
+			return newError(types.ErrInternal, "failed to restore proxy ARP", err)
+		}
+	}
+	delete(state.ProxyARP, key)
+	return nil
+}
+
+// checkProxyARP verifies the device's proxy ARP sysctls
+func checkProxyARP(device string, s *ProxyARPSettings) error {
+	if s == nil {
+		return nil
+	}
+	for _, sysctl := range s.sysctls() {
+		value, err := deviceSysctl(sysctl.table, device, sysctl.name)
+		if err != nil {
+			return newError(types.ErrInternal, "failed to check proxy ARP", err)
+		}
+		if value != sysctl.value {
+			return newError(types.ErrInternal, fmt.Sprintf("%s of %s is %s, expected %s", sysctl.name, device, value, sysctl.value), nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/qos"
+)
+
+// dscp returns the DSCP the attachment's traffic is marked with, the
+// per-attachment value taking precedence, or nil if it is left alone
+func (c *PluginConf) dscp() *int {
+	if c.Args != nil && c.Args.CNI.DSCP != nil {
+		return c.Args.CNI.DSCP
+	}
+	return c.DSCP
+}
+
+// setupDSCP installs the chain on the attachment's host-side port marking
+// the container's traffic with its DSCP
+func setupDSCP(conf *PluginConf, args *skel.CmdArgs, hostPort, containerIface net.Interface, undo *rollback) error {
+	port := &qos.Port{
+		Attachment: attachmentKey(args.ContainerID, args.IfName),
+		Device:     hostPort.Name,
+		DSCP:       *conf.dscp(),
+	}
+	// A tap is the VM's port itself
+	if conf.Mode == modeTap {
+		port.Device = containerIface.Name
+	}
+
+	if err := qos.SetupDSCP(qos.TableName(conf.VxlanID), port); err != nil {
+		return newError(types.ErrInternal, "failed to install DSCP marking", err)
+	}
+	undo.add(func() error { return teardownDSCP(conf, args.ContainerID, args.IfName) })
+	return nil
+}
+
+// teardownDSCP removes the marking of the attachment's port
+func teardownDSCP(conf *PluginConf, containerID, ifName string) error {
+	if err := qos.TeardownDSCP(qos.TableName(conf.VxlanID), attachmentKey(containerID, ifName)); err != nil {
+		return newError(types.ErrInternal, "failed to remove DSCP marking", err)
+	}
+	return nil
+}
+
+// checkDSCP verifies that the marking of the attachment's port is installed
+func checkDSCP(conf *PluginConf, args *skel.CmdArgs) error {
+	key := attachmentKey(args.ContainerID, args.IfName)
+	attachments, err := qos.Attachments(qos.TableName(conf.VxlanID))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list DSCP marking", err)
+	}
+	if attachments[qos.ChainName(key)] != key {
+		return newError(types.ErrInternal, fmt.Sprintf("no DSCP marking for %s", args.IfName), nil)
+	}
+	return nil
+}
+
+// gcDSCP removes the marking of attachments the runtime no longer knows
+// about
+func gcDSCP(conf *PluginConf, validAttachments map[string]bool) error {
+	table := qos.TableName(conf.VxlanID)
+	attachments, err := qos.Attachments(table)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to list DSCP marking", err)
+	}
+	for _, key := range attachments {
+		if validAttachments[key] {
+			continue
+		}
+		if err := qos.TeardownDSCP(table, key); err != nil {
+			return newError(types.ErrInternal, "failed to remove orphaned DSCP marking", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/announce"
+)
+
+const (
+	// defaultRouterLifetime keeps the advertised default route for the
+	// longest time the kernel accepts, as advertisements are only sent on
+	// ADD and CHECK
+	defaultRouterLifetime = 65535
+	// slaacPrefixLen is the only prefix length SLAAC configures addresses in
+	slaacPrefixLen = 64
+)
+
+// RAConf has the containers learn their IPv6 default route, and optionally
+// their addresses, from router advertisements
+type RAConf struct {
+	// RouterLifetime is how long, in seconds, containers keep the default
+	// route after an advertisement (default: 65535)
+	RouterLifetime int `json:"routerLifetime,omitempty"`
+	// SLAAC lets containers configure addresses in ipv6Subnet themselves,
+	// in addition to the allocated one
+	SLAAC bool `json:"slaac,omitempty"`
+	// External leaves sending advertisements to a responder such as radvd
+	// on the bridge; the plugin only has the containers accept them
+	External bool `json:"external,omitempty"`
+}
+
+// validate returns the problems with the router advertisement settings
+func (r *RAConf) validate(c *PluginConf) []string {
+	var problems []string
+	if c.IPv6Subnet == "" {
+		problems = append(problems, "routerAdvertisements requires ipv6Subnet")
+	}
+	if r.RouterLifetime < 0 || r.RouterLifetime > 65535 {
+		problems = append(problems, fmt.Sprintf("routerAdvertisements.routerLifetime %d out of range (0-65535)", r.RouterLifetime))
+	}
+	// vhost-user ports have neither a host-side device nor a MAC the
+	// plugin knows to send to
+	if !r.External && c.Mode == modeOVS && c.OVS.VhostUser {
+		problems = append(problems, "routerAdvertisements requires external with ovs.vhostUser")
+	}
+	if r.SLAAC {
+		if _, subnet, err := net.ParseCIDR(c.IPv6Subnet); err == nil {
+			if ones, _ := subnet.Mask.Size(); ones != slaacPrefixLen {
+				problems = append(problems, fmt.Sprintf("routerAdvertisements.slaac requires a /%d ipv6Subnet", slaacPrefixLen))
+			}
+		}
+		// Self-configured addresses aren't allocated, so the filters
+		// would drop their traffic
+		if c.AntiSpoofing {
+			problems = append(problems, "routerAdvertisements.slaac can't be combined with antiSpoofing")
+		}
+	}
+	return problems
+}
+
+// router returns what the advertisements tell the containers
+func (r *RAConf) router(conf *PluginConf) announce.Router {
+	router := announce.Router{
+		Lifetime:   defaultRouterLifetime,
+		MTU:        uint32(conf.MTU),
+		Autonomous: r.SLAAC,
+	}
+	if r.RouterLifetime != 0 {
+		router.Lifetime = uint16(r.RouterLifetime)
+	}
+	// The configuration was validated
+	_, router.Prefix, _ = net.ParseCIDR(conf.IPv6Subnet)
+	return router
+}
+
+// raSysctls returns the sysctls having the container interface accept router
+// advertisements, even if the container forwards
+func raSysctls(conf *PluginConf, ifName string) map[string]string {
+	autoconf := "0"
+	if conf.RouterAdvertisements.SLAAC {
+		autoconf = "1"
+	}
+	return map[string]string{
+		fmt.Sprintf("net.ipv6.conf.%s.accept_ra", ifName): "2",
+		fmt.Sprintf("net.ipv6.conf.%s.autoconf", ifName):  autoconf,
+	}
+}
+
+// advertiseRouter sends a router advertisement from the bridge or shim to
+// the attachment, refreshing its default route. Sent to all nodes on the
+// bridge or shim, it would flood over VXLAN to the containers of the other
+// nodes, which route through their own node. It goes down the attachment's
+// host-side port instead, or to its MAC and IPv6 address where it has none.
+func advertiseRouter(conf *PluginConf, l2 netlink.Link, hostIfaces []string, mac net.HardwareAddr, ips []net.IP) error {
+	out := l2.Attrs()
+	var dst announce.Destination
+	switch {
+	case len(hostIfaces) > 0:
+		port, err := ops.LinkByName(hostIfaces[0])
+		if err != nil {
+			return netlinkError(fmt.Sprintf("failed to find host interface %s", hostIfaces[0]), err)
+		}
+		out = port.Attrs()
+	case mac != nil && ipv6Address(ips) != nil:
+		dst = announce.Destination{MAC: mac, IP: ipv6Address(ips)}
+	default:
+		// Nothing addresses the attachment alone
+		return nil
+	}
+	src, err := linkLocalAddress(l2)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to list addresses of %s", l2.Attrs().Name), err)
+	}
+	if src == nil {
+		return newError(types.ErrInternal, fmt.Sprintf("%s has no IPv6 link-local address to advertise", l2.Attrs().Name), nil)
+	}
+	iface := &net.Interface{Index: out.Index, Name: out.Name}
+	if err := announce.Advertise(iface, l2.Attrs().HardwareAddr, src, dst, conf.RouterAdvertisements.router(conf)); err != nil {
+		return newError(types.ErrInternal, "failed to send router advertisement", err)
+	}
+	return nil
+}
+
+// ipv6Address returns the first IPv6 address of ips, or nil
+func ipv6Address(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// linkLocalAddress returns the IPv6 link-local address of the link, or nil
+// if it has none
+func linkLocalAddress(link netlink.Link) (net.IP, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			return addr.IP, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,234 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/qos"
+)
+
+// ifbNameTemplate names the IFB device shaping an attachment's egress
+const ifbNameTemplate = "ifb{{.Hash}}"
+
+// RateLimits caps the bandwidth of a container, in bits per second. Bursts
+// are in bits as well and default to qos.DefaultBurst.
+type RateLimits struct {
+	// IngressRate limits the traffic to the container
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	// EgressRate limits the traffic from the container
+	EgressRate  uint64 `json:"egressRate,omitempty"`
+	EgressBurst uint64 `json:"egressBurst,omitempty"`
+}
+
+// isEmpty reports whether no limit is set
+func (r RateLimits) isEmpty() bool {
+	return r.IngressRate == 0 && r.EgressRate == 0
+}
+
+// validate returns the problems with the rate limits
+func (r RateLimits) validate() []string {
+	var problems []string
+	if r.IngressBurst != 0 && r.IngressRate == 0 {
+		problems = append(problems, "ingressBurst requires ingressRate")
+	}
+	if r.EgressBurst != 0 && r.EgressRate == 0 {
+		problems = append(problems, "egressBurst requires egressRate")
+	}
+	// The token bucket works in bytes
+	if r.IngressRate != 0 && r.IngressRate < 8 {
+		problems = append(problems, fmt.Sprintf("ingressRate %d is below 8 bits per second", r.IngressRate))
+	}
+	if r.EgressRate != 0 && r.EgressRate < 8 {
+		problems = append(problems, fmt.Sprintf("egressRate %d is below 8 bits per second", r.EgressRate))
+	}
+	return problems
+}
+
+// burst returns the burst of a rate, the default one if unset
+func burst(rate, burst uint64) uint64 {
+	if burst == 0 {
+		return qos.DefaultBurst(rate)
+	}
+	return burst
+}
+
+// rateLimits returns the attachment's rate limits: the network's, with each
+// direction the per-attachment overrides set replaced
+func (c *PluginConf) rateLimits() RateLimits {
+	limits := c.RateLimits
+	if c.Args == nil {
+		return limits
+	}
+	if override := c.Args.CNI.RateLimits; override.IngressRate != 0 {
+		limits.IngressRate, limits.IngressBurst = override.IngressRate, override.IngressBurst
+	}
+	if override := c.Args.CNI.RateLimits; override.EgressRate != 0 {
+		limits.EgressRate, limits.EgressBurst = override.EgressRate, override.EgressBurst
+	}
+	return limits
+}
+
+// setupRateLimits shapes the traffic of the attachment's host-side port:
+// traffic to the container with a token bucket on the port, traffic from it
+// with one on an IFB device the port's ingress is redirected to
+func setupRateLimits(conf *PluginConf, args *skel.CmdArgs, hostPort, containerIface net.Interface, undo *rollback) error {
+	limits := conf.rateLimits()
+	device := hostPort.Name
+	// A tap is the VM's port itself
+	if conf.Mode == modeTap {
+		device = containerIface.Name
+	}
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to get interface %s", device), err)
+	}
+
+	if limits.IngressRate != 0 {
+		if err := qos.Shape(link, limits.IngressRate, burst(limits.IngressRate, limits.IngressBurst), conf.Qdisc); err != nil {
+			return netlinkError("failed to limit ingress rate", err)
+		}
+	}
+
+	if limits.EgressRate != 0 {
+		name, err := renderVethName(ifbNameTemplate, args.ContainerID, args.IfName)
+		if err != nil {
+			return newError(types.ErrInternal, "failed to name IFB device", err)
+		}
+		ifb, err := qos.SetupIFB(name, conf.linkMTU())
+		if err != nil {
+			return netlinkError("failed to setup IFB device", err)
+		}
+		undo.add(func() error { return deleteLink(name) })
+		// Tag the IFB so DEL and GC remove it along with the attachment
+		if err := tagHostLink(ifb, conf, args, false); err != nil {
+			return netlinkError("failed to set IFB alias", err)
+		}
+		if err := qos.Shape(ifb, limits.EgressRate, burst(limits.EgressRate, limits.EgressBurst), ""); err != nil {
+			return netlinkError("failed to limit egress rate", err)
+		}
+		if err := qos.Redirect(link, ifb); err != nil {
+			return netlinkError("failed to limit egress rate", err)
+		}
+	}
+	return nil
+}
+
+// checkRateLimits verifies that the attachment's traffic is shaped at the
+// configured rates
+func checkRateLimits(conf *PluginConf, args *skel.CmdArgs) error {
+	limits := conf.rateLimits()
+	device, err := hostPortName(conf, args)
+	if err != nil {
+		return err
+	}
+	check := func(name string, rate uint64) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return newError(types.ErrInternal, fmt.Sprintf("interface %s not found", name), err)
+		}
+		shaped, err := qos.Shaped(link)
+		if err != nil {
+			return netlinkError("failed to list qdiscs", err)
+		}
+		if shaped != rate/8*8 {
+			return newError(types.ErrInternal, fmt.Sprintf("%s is limited to %d bits per second, not %d", name, shaped, rate), nil)
+		}
+		return nil
+	}
+
+	if limits.IngressRate != 0 {
+		if err := check(device, limits.IngressRate); err != nil {
+			return err
+		}
+	}
+	if limits.EgressRate != 0 {
+		name, err := renderVethName(ifbNameTemplate, args.ContainerID, args.IfName)
+		if err != nil {
+			return newError(types.ErrInternal, "failed to name IFB device", err)
+		}
+		if err := check(name, limits.EgressRate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostPortName returns the name of the attachment's host-side port, the tap
+// or the host veth found by its alias
+func hostPortName(conf *PluginConf, args *skel.CmdArgs) (string, error) {
+	if conf.Mode == modeTap {
+		name, err := vmPortName(conf, args.ContainerID, args.IfName)
+		if err != nil {
+			return "", configError("failed to name tap device", err)
+		}
+		return name, nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", netlinkError("failed to list links", err)
+	}
+	for _, link := range links {
+		if ownedBy(link.Attrs().Alias, args.ContainerID, args.IfName) && link.Type() == "veth" {
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", newError(types.ErrInternal, fmt.Sprintf("no host veth for %s", args.IfName), nil)
+}
+
+// gcIFBs deletes the network's IFB devices of attachments the runtime no
+// longer knows about, which aren't ports of the bridge. Those of other
+// networks, or not naming theirs, are left alone.
+func gcIFBs(conf *PluginConf, validAttachments map[string]bool) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return netlinkError("failed to list links", err)
+	}
+	for _, link := range links {
+		if link.Type() != "ifb" {
+			continue
+		}
+		key, owned := parseAttachmentAlias(link.Attrs().Alias)
+		if !owned || validAttachments[key] {
+			continue
+		}
+		if network, ok := aliasNetwork(link.Attrs().Alias); !ok || network != conf.Name {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return netlinkError(fmt.Sprintf("failed to delete orphaned interface %s", link.Attrs().Name), err)
+		}
+	}
+	return nil
+}
+
+// planRateLimits adds shaping the traffic of the attachment's host-side port
+func planRateLimits(p *plan, conf *PluginConf, args *skel.CmdArgs, dev string) {
+	limits := conf.rateLimits()
+	if limits.IngressRate != 0 {
+		p.add("set-qdisc", dev, map[string]string{
+			"qdisc": "tbf",
+			"rate":  strconv.FormatUint(limits.IngressRate, 10),
+			"burst": strconv.FormatUint(burst(limits.IngressRate, limits.IngressBurst), 10),
+		})
+	}
+	if limits.EgressRate != 0 {
+		// The template is fixed and always renders
+		name, _ := renderVethName(ifbNameTemplate, args.ContainerID, args.IfName)
+		p.add("create-link", name, map[string]string{"kind": "ifb", "mtu": strconv.Itoa(conf.linkMTU())})
+		p.add("set-qdisc", name, map[string]string{
+			"qdisc": "tbf",
+			"rate":  strconv.FormatUint(limits.EgressRate, 10),
+			"burst": strconv.FormatUint(burst(limits.EgressRate, limits.EgressBurst), 10),
+		})
+		p.add("redirect-ingress", dev, map[string]string{"to": name})
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// repairHostIface sets a recorded host interface of the attachment up and,
+// on networks with a bridge, adds it to the bridge again in its VLAN. An
+// interface that is gone can't be restored and is left for the check to
+// report.
+func repairHostIface(conf *PluginConf, name string, l2 netlink.Link) error {
+	link, err := ops.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	if br, ok := l2.(*netlink.Bridge); ok && conf.usesBridge() && link.Attrs().MasterIndex != br.Attrs().Index {
+		if err := retry.Do(func() error { return ops.LinkSetMaster(link, br) }); err != nil {
+			return netlinkError(fmt.Sprintf("failed to restore bridge port %s", name), err)
+		}
+		if err := ops.LinkSetHairpin(link, conf.HairpinMode); err != nil {
+			return netlinkError(fmt.Sprintf("failed to set hairpin mode on %s", name), err)
+		}
+		if err := setPortVLAN(conf, br, link); err != nil {
+			return err
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := ops.LinkSetUp(link); err != nil {
+			return netlinkError(fmt.Sprintf("failed to set %s up", name), err)
+		}
+	}
+	return nil
+}
+
+// repairContainerIface restores the container interface in the current
+// network namespace from the attachment's record: sets it up and adds the
+// recorded addresses and the network's routes it lacks. Attachments without
+// a record, or whose interface is gone, are left for the check to report.
+func repairContainerIface(conf *PluginConf, args *skel.CmdArgs, r *resultcache.Record) error {
+	if r == nil {
+		return nil
+	}
+	link, err := ops.LinkByName(args.IfName)
+	if err != nil {
+		return nil
+	}
+
+	// Addresses first, the gateways are only reachable through them
+	addrs, err := ops.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get addresses for container interface", err)
+	}
+	for _, cidr := range r.IPs {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if err != nil || hasAddr(addrs, ip) {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask}}
+		if err := ops.AddrAdd(link, addr); err != nil && !errors.Is(err, unix.EEXIST) {
+			return netlinkError(fmt.Sprintf("failed to restore address %s", cidr), err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := ops.LinkSetUp(link); err != nil {
+			return netlinkError("failed to set container interface up", err)
+		}
+	}
+
+	// Default routes, skipped like on ADD if another attachment or plugin
+	// owns them
+	allRoutes, err := ops.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get routes", err)
+	}
+	gateway := net.ParseIP(conf.Gateway)
+	var missing []*netlink.Route
+	if dr := conf.defaultRoute(); !dr.Disabled {
+		route := dr.netlinkRoute(link.Attrs().Index, gateway)
+		if !hasDefaultRouteVia(allRoutes, route) {
+			installed, err := defaultRouteInstalled(netlink.FAMILY_V4)
+			if err != nil {
+				return netlinkError("failed to list routes", err)
+			}
+			if dr.Metric != 0 || !installed {
+				missing = append(missing, route)
+			}
+		}
+	}
+	if route := conf.ipv6DefaultRoute(link.Attrs().Index); route != nil && !hasDefaultRouteVia(allRoutes, route) {
+		installed, err := defaultRouteInstalled(netlink.FAMILY_V6)
+		if err != nil {
+			return netlinkError("failed to list routes", err)
+		}
+		if route.Priority != 0 || !installed {
+			missing = append(missing, route)
+		}
+	}
+
+	// Static routes
+	routes, err := ops.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get routes for container interface", err)
+	}
+	for _, route := range conf.containerRoutes() {
+		if r := route.netlinkRoute(link.Attrs().Index, gateway); !hasRoute(routes, r) {
+			missing = append(missing, r)
+		}
+	}
+
+	for _, route := range missing {
+		if err := ops.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+			dst := "default"
+			if route.Dst != nil {
+				dst = route.Dst.String()
+			}
+			return netlinkError(fmt.Sprintf("failed to restore route to %s", dst), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/resultcache"
+)
+
+// saveResult records the result of ADD, as returned, and the attachment's runtime
+// parameters and pod QoS, for DEL, CHECK and GC to fall back on
+func saveResult(conf *PluginConf, args *skel.CmdArgs, result types.Result, hostVeth, containerIface net.Interface, containerIPs []*current.IPConfig, annotated *podQoS) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return newError(types.ErrInternal, "failed to encode result", err)
+	}
+	r := &resultcache.Record{
+		Network:     conf.Name,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		MAC:         containerIface.HardwareAddr.String(),
+		Result:      data,
+	}
+	if conf.hasSandbox() {
+		r.Netns = args.Netns
+		r.NetnsInode = netnsInode(args.Netns)
+	}
+	r.HostInterfaces = hostIfaces(conf, hostVeth, containerIface)
+	for _, ipc := range containerIPs {
+		r.IPs = append(r.IPs, ipc.Address.String())
+		if conf.NDPProxy && ipc.Address.IP.To4() == nil {
+			r.NDPProxies = append(r.NDPProxies, ipc.Address.IP.String())
+		}
+	}
+	if annotated != nil {
+		if r.PodQoS, err = json.Marshal(annotated); err != nil {
+			return newError(types.ErrInternal, "failed to encode pod QoS", err)
+		}
+	}
+	if err := resultcache.Save(ipam.NetworkDir(conf.DataDir, conf.Name), r); err != nil {
+		return newError(types.ErrInternal, "failed to save result", err)
+	}
+	return nil
+}
+
+// hostIfaces returns the attachment's own devices on the host. Unlike tap
+// devices, vhost-user ports are no host interfaces.
+func hostIfaces(conf *PluginConf, hostVeth, containerIface net.Interface) []string {
+	var names []string
+	if conf.Mode == modeTap {
+		names = append(names, containerIface.Name)
+	}
+	if hostVeth.Name != "" {
+		names = append(names, hostVeth.Name)
+	}
+	return names
+}
+
+// recordedIPs returns the addresses of the attachment as recorded
+func recordedIPs(r *resultcache.Record) []net.IP {
+	if r == nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range r.IPs {
+		if ip, _, err := net.ParseCIDR(addr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// recordedNDPProxies returns the addresses the attachment's record has NDP
+// proxy entries for
+func recordedNDPProxies(r *resultcache.Record) []net.IP {
+	if r == nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range r.NDPProxies {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// loadResult returns the attachment's record, or nil for attachments added
+// before results were recorded
+func loadResult(conf *PluginConf, args *skel.CmdArgs) (*resultcache.Record, error) {
+	r, err := resultcache.Load(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, newError(types.ErrInternal, "failed to load result", err)
+	}
+	return r, nil
+}
+
+// removeResult removes the attachment's record
+func removeResult(conf *PluginConf, args *skel.CmdArgs) error {
+	if err := resultcache.Remove(ipam.NetworkDir(conf.DataDir, conf.Name), conf.Name, args.ContainerID, args.IfName); err != nil {
+		return newError(types.ErrInternal, "failed to remove result", err)
+	}
+	return nil
+}
+
+// attachmentNetns returns the attachment's network namespace, taken from
+// its record when the runtime doesn't pass it anymore. A recorded path that
+// names another namespace by now is taken as gone.
+func attachmentNetns(args *skel.CmdArgs, r *resultcache.Record) string {
+	if args.Netns == "" && r != nil {
+		if r.NetnsInode != 0 && netnsInode(r.Netns) != r.NetnsInode {
+			return ""
+		}
+		return r.Netns
+	}
+	return args.Netns
+}
+
+// netnsInode returns the inode of the network namespace at the path, 0 if
+// there's none
+func netnsInode(path string) uint64 {
+	var st unix.Stat_t
+	if path == "" || unix.Stat(path, &st) != nil {
+		return 0
+	}
+	return st.Ino
+}
+
+// tapName returns the name of the attachment's tap device, as recorded if
+// the configured name template changed since
+func tapName(conf *PluginConf, args *skel.CmdArgs, r *resultcache.Record) (string, error) {
+	if r != nil && len(r.HostInterfaces) > 0 {
+		return r.HostInterfaces[0], nil
+	}
+	return vmPortName(conf, args.ContainerID, args.IfName)
+}
+
+// recordedMAC returns the MAC of the attachment as recorded, or nil
+func recordedMAC(r *resultcache.Record) net.HardwareAddr {
+	if r == nil {
+		return nil
+	}
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return nil
+	}
+	return mac
+}
+
+// checkRecordedHostIfaces verifies the host interfaces of the attachment's
+// record exist and, on networks with a bridge, are ports of it
+func checkRecordedHostIfaces(conf *PluginConf, r *resultcache.Record, l2 netlink.Link) error {
+	if r == nil {
+		return nil
+	}
+	for _, name := range r.HostInterfaces {
+		if conf.CheckRepairs {
+			if err := repairHostIface(conf, name, l2); err != nil {
+				return err
+			}
+		}
+		link, err := ops.LinkByName(name)
+		if err != nil {
+			return newError(types.ErrInternal, fmt.Sprintf("host interface %s of the attachment not found", name), err)
+		}
+		if conf.usesBridge() && link.Attrs().MasterIndex != l2.Attrs().Index {
+			return newError(types.ErrInternal, fmt.Sprintf("host interface %s is not a port of %s", name, l2.Attrs().Name), nil)
+		}
+	}
+	return nil
+}
+
+// checkRecordedIface verifies the container interface in the current
+// network namespace still has the MAC and addresses of the attachment's
+// record
+func checkRecordedIface(args *skel.CmdArgs, r *resultcache.Record) error {
+	if r == nil {
+		return nil
+	}
+	link, err := ops.LinkByName(args.IfName)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s not found", args.IfName), err)
+	}
+	if mac := recordedMAC(r); mac != nil && link.Attrs().HardwareAddr.String() != mac.String() {
+		return newError(types.ErrInternal, fmt.Sprintf("container interface %s has MAC %s, not %s", args.IfName, link.Attrs().HardwareAddr, mac), nil)
+	}
+	addrs, err := ops.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return netlinkError("failed to get addresses for container interface", err)
+	}
+	for _, cidr := range r.IPs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if !hasAddr(addrs, ip) {
+			return newError(types.ErrInternal, fmt.Sprintf("container interface %s lacks address %s", args.IfName, cidr), nil)
+		}
+	}
+	return nil
+}
+
+// hasAddr reports whether the addresses include ip
+func hasAddr(addrs []netlink.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// gcResults removes the records of the attachments no longer valid and
+// returns their MACs. The caller holds the network lock.
+func gcResults(conf *PluginConf, validAttachments map[string]bool) ([]net.HardwareAddr, error) {
+	dir := ipam.NetworkDir(conf.DataDir, conf.Name)
+	records, err := resultcache.LoadAll(dir, conf.Name)
+	if err != nil {
+		return nil, newError(types.ErrInternal, "failed to load results", err)
+	}
+	var macs []net.HardwareAddr
+	for _, r := range records {
+		if validAttachments[attachmentKey(r.ContainerID, r.IfName)] {
+			continue
+		}
+		if mac := recordedMAC(r); mac != nil {
+			macs = append(macs, mac)
+		}
+		if err := resultcache.Remove(dir, conf.Name, r.ContainerID, r.IfName); err != nil {
+			return nil, newError(types.ErrInternal, "failed to remove result", err)
+		}
+	}
+	return macs, nil
+}
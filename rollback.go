@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// rollback collects how to undo the changes ADD made so far, so a failed ADD
+// leaves neither half-configured interfaces nor allocated addresses behind
+type rollback struct {
+	undo []func() error
+}
+
+// add records how to undo a change that was just made
+func (r *rollback) add(undo func() error) {
+	r.undo = append(r.undo, undo)
+}
+
+// run undoes the recorded changes in reverse order. A failing step doesn't
+// stop the remaining ones; their errors are returned together.
+func (r *rollback) run() error {
+	var errs []error
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	r.undo = nil
+	return errors.Join(errs...)
+}
+
+// runOnError undoes the recorded changes if ADD failed, adding rollback
+// failures to the details of the error returned to the runtime
+func (r *rollback) runOnError(err error) {
+	if err == nil {
+		return
+	}
+	rollbackErr := r.run()
+	if rollbackErr == nil {
+		return
+	}
+	var cniErr *types.Error
+	if errors.As(err, &cniErr) {
+		if cniErr.Details != "" {
+			cniErr.Details += "; "
+		}
+		cniErr.Details += "rollback failed: " + strings.ReplaceAll(rollbackErr.Error(), "\n", "; ")
+	}
+}
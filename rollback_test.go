@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestRollback(t *testing.T) {
+	// Changes are undone in reverse order, past failing steps
+	var order []int
+	undo := &rollback{}
+	for i := 1; i <= 3; i++ {
+		i := i
+		undo.add(func() error {
+			order = append(order, i)
+			if i == 2 {
+				return errors.New("device busy")
+			}
+			return nil
+		})
+	}
+	err := newError(types.ErrInternal, "failed to add route", errors.New("file exists"))
+	undo.runOnError(err)
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Fatalf("Expected undo order [3 2 1], got %v", order)
+	}
+	if !strings.Contains(err.Details, "file exists") || !strings.Contains(err.Details, "rollback failed: device busy") {
+		t.Fatalf("Expected rollback failure in error details, got %q", err.Details)
+	}
+
+	// Nothing is undone after a successful ADD
+	order = nil
+	undo.add(func() error {
+		order = append(order, 1)
+		return nil
+	})
+	undo.runOnError(nil)
+	if len(order) != 0 {
+		t.Fatalf("Expected no undo without error, got %v", order)
+	}
+}
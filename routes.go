@@ -0,0 +1,382 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gatewayProbeTimeout bounds how long CHECK waits for a gateway's
+	// neighbor entry to resolve, about as long as the kernel's three
+	// solicitations take
+	gatewayProbeTimeout  = 3 * time.Second
+	gatewayProbeInterval = 50 * time.Millisecond
+
+	// resolvedNeighStates are the neighbor states with a known link-layer
+	// address. Stale entries were reachable and are probed again on use.
+	resolvedNeighStates = netlink.NUD_REACHABLE | netlink.NUD_STALE | netlink.NUD_DELAY |
+		netlink.NUD_PROBE | netlink.NUD_PERMANENT | netlink.NUD_NOARP
+)
+
+// RouteConf describes a static route installed in the container
+type RouteConf struct {
+	Dst    string `json:"dst"`
+	GW     string `json:"gw,omitempty"`
+	MTU    int    `json:"mtu,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+// containerRoutes returns the static routes of the attachment: the
+// network's, with the per-attachment routes replacing those to the same
+// destination and added after them
+func (c *PluginConf) containerRoutes() []RouteConf {
+	if c.Args == nil || len(c.Args.CNI.Routes) == 0 {
+		return c.Routes
+	}
+	overridden := make(map[string]bool, len(c.Args.CNI.Routes))
+	for _, route := range c.Args.CNI.Routes {
+		overridden[route.Dst] = true
+	}
+	routes := make([]RouteConf, 0, len(c.Routes)+len(c.Args.CNI.Routes))
+	for _, route := range c.Routes {
+		if !overridden[route.Dst] {
+			routes = append(routes, route)
+		}
+	}
+	return append(routes, c.Args.CNI.Routes...)
+}
+
+// validate returns the problems with the route configuration
+func (r *RouteConf) validate() []string {
+	var problems []string
+	if _, _, err := net.ParseCIDR(r.Dst); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid route destination %q", r.Dst))
+	}
+	if r.GW != "" && net.ParseIP(r.GW) == nil {
+		problems = append(problems, fmt.Sprintf("invalid gateway %q for route to %s", r.GW, r.Dst))
+	}
+	if r.MTU != 0 && (r.MTU < minMTU || r.MTU > maxMTU) {
+		problems = append(problems, fmt.Sprintf("mtu %d for route to %s out of range (%d-%d)", r.MTU, r.Dst, minMTU, maxMTU))
+	}
+	if r.Metric < 0 {
+		problems = append(problems, fmt.Sprintf("negative metric for route to %s", r.Dst))
+	}
+	return problems
+}
+
+// gateway returns the route's next hop, falling back to the network gateway
+func (r *RouteConf) gateway(defaultGW net.IP) net.IP {
+	if r.GW != "" {
+		return net.ParseIP(r.GW)
+	}
+	return defaultGW
+}
+
+// netlinkRoute returns the route to install via the given link
+func (r *RouteConf) netlinkRoute(linkIndex int, defaultGW net.IP) *netlink.Route {
+	_, dst, _ := net.ParseCIDR(r.Dst)
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       dst,
+		Gw:        r.gateway(defaultGW),
+		MTU:       r.MTU,
+		Priority:  r.Metric,
+	}
+}
+
+// cniRoute returns the route as reported in the CNI result
+func (r *RouteConf) cniRoute(defaultGW net.IP) *types.Route {
+	_, dst, _ := net.ParseCIDR(r.Dst)
+	return &types.Route{
+		Dst:      *dst,
+		GW:       r.gateway(defaultGW),
+		MTU:      r.MTU,
+		Priority: r.Metric,
+	}
+}
+
+// DefaultRouteConf controls the default route installed in the container
+type DefaultRouteConf struct {
+	// Disabled skips the default route, e.g. for a secondary attachment
+	Disabled bool `json:"disabled,omitempty"`
+	// GW is the next hop, the network gateway if unset
+	GW string `json:"gw,omitempty"`
+	// Gateways are the next hops of an ECMP default route, for overlays with
+	// redundant gateway nodes. Mutually exclusive with GW.
+	Gateways []string `json:"gateways,omitempty"`
+	// Metric is the priority of the route. A default route with a metric is
+	// installed even if the container already has one.
+	Metric int `json:"metric,omitempty"`
+}
+
+// validate returns the problems with the default route configuration
+func (d *DefaultRouteConf) validate(subnet string) []string {
+	var problems []string
+	if d.GW != "" && len(d.Gateways) > 0 {
+		problems = append(problems, "defaultRoute.gw and defaultRoute.gateways are mutually exclusive")
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	for _, s := range append(d.Gateways, d.GW) {
+		if s == "" {
+			continue
+		}
+		if gw := net.ParseIP(s); gw == nil || gw.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid default route gateway %q", s))
+		} else if err == nil && !ipNet.Contains(gw) {
+			problems = append(problems, fmt.Sprintf("default route gateway %s is outside subnet %s", s, subnet))
+		}
+	}
+	if d.Metric < 0 {
+		problems = append(problems, "negative metric for default route")
+	}
+	return problems
+}
+
+// gateway returns the default route's next hop, falling back to the network
+// gateway
+func (d *DefaultRouteConf) gateway(defaultGW net.IP) net.IP {
+	if d.GW != "" {
+		return net.ParseIP(d.GW)
+	}
+	return defaultGW
+}
+
+// netlinkRoute returns the default route to install via the given link,
+// with a next hop per gateway if there are several
+func (d *DefaultRouteConf) netlinkRoute(linkIndex int, defaultGW net.IP) *netlink.Route {
+	if len(d.Gateways) > 0 {
+		// Without a gateway of its own the route needs an explicit
+		// destination
+		route := &netlink.Route{
+			Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Priority: d.Metric,
+		}
+		for _, gw := range d.Gateways {
+			route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{LinkIndex: linkIndex, Gw: net.ParseIP(gw)})
+		}
+		return route
+	}
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Gw:        d.gateway(defaultGW),
+		Priority:  d.Metric,
+	}
+}
+
+// defaultRoute returns the default route configuration of the attachment.
+// One set in args replaces the network's.
+func (c *PluginConf) defaultRoute() DefaultRouteConf {
+	if c.Args != nil && c.Args.CNI.DefaultRoute != nil {
+		return *c.Args.CNI.DefaultRoute
+	}
+	if c.DefaultRoute != nil {
+		return *c.DefaultRoute
+	}
+	return DefaultRouteConf{}
+}
+
+// primaryIfName is the interface of a pod's cluster network. Multus names
+// those of further attachments net1, net2 and so on.
+const primaryIfName = "eth0"
+
+// skipSecondaryDefaultRoute disables the default routes of a secondary
+// network's attachments that don't configure them, so the network doesn't
+// take the pod's traffic from its cluster network
+func (c *PluginConf) skipSecondaryDefaultRoute() {
+	if !c.Secondary || c.DefaultRoute != nil || (c.Args != nil && c.Args.CNI.DefaultRoute != nil) {
+		return
+	}
+	c.DefaultRoute = &DefaultRouteConf{Disabled: true}
+}
+
+// ipv6DefaultRoute returns the IPv6 default route to install via the given
+// link, through ipv6Gateway with the default route's metric, or nil if there
+// is none: without an IPv6 subnet, with the default route disabled, or when
+// router advertisements provide it
+func (c *PluginConf) ipv6DefaultRoute(linkIndex int) *netlink.Route {
+	dr := c.defaultRoute()
+	if c.IPv6Gateway == "" || dr.Disabled || c.RouterAdvertisements != nil {
+		return nil
+	}
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Gw:        net.ParseIP(c.IPv6Gateway),
+		Priority:  dr.Metric,
+	}
+}
+
+// hasDefaultRouteVia reports whether routes contains a default route
+// matching want. xvm-agent withdraws the next hops of failed gateways from
+// ECMP routes, so one through some of the gateways matches as well.
+func hasDefaultRouteVia(routes []netlink.Route, want *netlink.Route) bool {
+	for _, route := range routes {
+		if !isDefaultRoute(route) || (want.Priority != 0 && route.Priority != want.Priority) {
+			continue
+		}
+		if len(want.MultiPath) > 0 {
+			if withinNexthops(route, want.MultiPath) {
+				return true
+			}
+			continue
+		}
+		if route.LinkIndex == want.LinkIndex && route.Gw.Equal(want.Gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinNexthops reports whether the route goes through some of the next
+// hops, as a multipath route or, with one left, through a single gateway
+func withinNexthops(route netlink.Route, nexthops []*netlink.NexthopInfo) bool {
+	via := route.MultiPath
+	if len(via) == 0 {
+		if route.Gw == nil {
+			return false
+		}
+		via = []*netlink.NexthopInfo{{LinkIndex: route.LinkIndex, Gw: route.Gw}}
+	}
+	for _, nh := range via {
+		found := false
+		for _, want := range nexthops {
+			if nh.LinkIndex == want.LinkIndex && nh.Gw.Equal(want.Gw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRoute reports whether routes contains a route matching want
+func hasRoute(routes []netlink.Route, want *netlink.Route) bool {
+	for _, route := range routes {
+		if route.Dst == nil || route.Dst.String() != want.Dst.String() {
+			continue
+		}
+		if route.Gw.Equal(want.Gw) && (want.Priority == 0 || route.Priority == want.Priority) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRouteInstalled reports whether the current network namespace
+// already has a default route of the family, e.g. from another attachment
+func defaultRouteInstalled(family int) (bool, error) {
+	routes, err := ops.RouteList(nil, family)
+	if err != nil {
+		return false, err
+	}
+	for _, route := range routes {
+		if isDefaultRoute(route) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isDefaultRoute reports whether the route has a zero-length destination.
+// Depending on the kernel the destination is either unset or 0.0.0.0/0.
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// hasGlobalAddress reports whether one of the addresses is a global unicast
+// address rather than a link-local one
+func hasGlobalAddress(addrs []netlink.Addr) bool {
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// nexthops returns the gateways of a route
+func nexthops(route *netlink.Route) []net.IP {
+	if len(route.MultiPath) == 0 {
+		return []net.IP{route.Gw}
+	}
+	gateways := make([]net.IP, 0, len(route.MultiPath))
+	for _, nh := range route.MultiPath {
+		gateways = append(gateways, nh.Gw)
+	}
+	return gateways
+}
+
+// checkGateways verifies that at least one of the gateways of a route
+// resolves to a neighbor on the link
+func checkGateways(link netlink.Link, gateways []net.IP) error {
+	for _, gw := range gateways {
+		reachable, err := gatewayReachable(link, gw)
+		if err != nil {
+			return netlinkError(fmt.Sprintf("failed to resolve gateway %s", gw), err)
+		}
+		if reachable {
+			return nil
+		}
+	}
+	return newError(types.ErrInternal, fmt.Sprintf("gateway %s is unreachable from %s", gateways[0], link.Attrs().Name), nil)
+}
+
+// gatewayReachable reports whether the gateway's neighbor entry on the link
+// resolves. Links without ARP, such as ipvlan in l3 mode, always do.
+func gatewayReachable(link netlink.Link, gw net.IP) (bool, error) {
+	if link.Attrs().RawFlags&unix.IFF_NOARP != 0 {
+		return true, nil
+	}
+	family := netlink.FAMILY_V4
+	if gw.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	deadline := time.Now().Add(gatewayProbeTimeout)
+	probed := false
+	for {
+		neighs, err := ops.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return false, err
+		}
+		state := 0
+		for _, neigh := range neighs {
+			if neigh.IP.Equal(gw) {
+				state = neigh.State
+			}
+		}
+		if state&resolvedNeighStates != 0 {
+			return true, nil
+		}
+		if probed && state&netlink.NUD_FAILED != 0 {
+			return false, nil
+		}
+		if !probed {
+			// Mark the entry used, as sending to the gateway would, which
+			// doesn't need a usable source address yet
+			probe := &netlink.Neigh{LinkIndex: link.Attrs().Index, Family: family, IP: gw, Flags: netlink.NTF_USE}
+			if err := ops.NeighSet(probe); err != nil {
+				return false, err
+			}
+			probed = true
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(gatewayProbeInterval)
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/rtable"
+	"github.com/nohns/xvm-cni/pkg/vrf"
+)
+
+// RouteTableConf holds the dedicated routing table of the overlay's routes
+// and the rules selecting it
+type RouteTableConf struct {
+	// ID is the routing table, other than the kernel's own
+	ID uint32 `json:"id"`
+	// FwMark selects the table for packets with the mark, e.g. "0x100" or
+	// "0x100/0xff00"
+	FwMark string `json:"fwmark,omitempty"`
+	// From selects the table for packets from the prefixes, e.g. the
+	// network's subnets
+	From []string `json:"from,omitempty"`
+	// Priority orders the rules among the node's (default: 1000)
+	Priority int `json:"priority,omitempty"`
+}
+
+// validate returns the problems with the routing table settings
+func (r *RouteTableConf) validate(c *PluginConf) []string {
+	var problems []string
+	if vrf.ReservedTable(r.ID) {
+		problems = append(problems, fmt.Sprintf("routeTable.id %d is reserved", r.ID))
+	}
+	if r.FwMark == "" && len(r.From) == 0 {
+		problems = append(problems, "routeTable requires fwmark or from")
+	}
+	if r.FwMark != "" {
+		if _, _, err := rtable.ParseMark(r.FwMark); err != nil {
+			problems = append(problems, fmt.Sprintf("routeTable.fwmark: %v", err))
+		}
+	}
+	for _, from := range r.From {
+		if _, _, err := net.ParseCIDR(from); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid routeTable.from %q", from))
+		}
+	}
+	if r.Priority < 0 || r.Priority > 32765 {
+		problems = append(problems, fmt.Sprintf("routeTable.priority %d out of range (1-32765)", r.Priority))
+	}
+	if c.VRF != nil {
+		problems = append(problems, "routeTable can't be combined with vrf")
+	}
+	return problems
+}
+
+// routeTable returns the routing table the host routes go to, the main
+// table unless routeTable is set
+func (c *PluginConf) routeTable() int {
+	if c.RouteTable == nil {
+		return unix.RT_TABLE_MAIN
+	}
+	return int(c.RouteTable.ID)
+}
+
+// routeSelector returns the rules selecting the network's routing table. The
+// settings are validated.
+func routeSelector(conf *PluginConf) *rtable.Selector {
+	r := conf.RouteTable
+	s := &rtable.Selector{
+		Table:    int(r.ID),
+		Priority: r.Priority,
+		IPv6:     conf.IPv6Subnet != "",
+	}
+	if s.Priority == 0 {
+		s.Priority = rtable.DefaultPriority
+	}
+	if r.FwMark != "" {
+		s.Mark, s.Mask, _ = rtable.ParseMark(r.FwMark)
+	}
+	for _, from := range r.From {
+		_, src, _ := net.ParseCIDR(from)
+		s.Sources = append(s.Sources, src)
+	}
+	// The node's own traffic to the containers is neither marked nor from
+	// the network, so it only takes the host routes through rules for the
+	// subnets
+	if conf.HostRoutes {
+		s.Destinations = networkSubnets(conf)
+	}
+	return s
+}
+
+// routeRefs returns the records of the networks using the rules, which
+// networks sharing a table and selectors share
+func routeRefs(conf *PluginConf) *rtable.Refs {
+	owner := conf.Name
+	if owner == "" {
+		owner = fmt.Sprintf("vni%d", conf.VxlanID)
+	}
+	return &rtable.Refs{Dir: filepath.Join(conf.DataDir, ".rules"), Owner: owner}
+}
+
+// setupRouteTable adds the rules selecting the network's routing table
+func setupRouteTable(conf *PluginConf) error {
+	if err := rtable.Setup(routeSelector(conf), routeRefs(conf)); err != nil {
+		return netlinkError("failed to setup routing table", err)
+	}
+	return nil
+}
+
+// checkRouteTable verifies that the rules selecting the network's routing
+// table are installed
+func checkRouteTable(conf *PluginConf) error {
+	missing, err := rtable.Missing(routeSelector(conf))
+	if err != nil {
+		return netlinkError("failed to check routing table", err)
+	}
+	if len(missing) > 0 {
+		var rules []string
+		for _, r := range missing {
+			rules = append(rules, rtable.Describe(r))
+		}
+		return newError(types.ErrInternal, fmt.Sprintf("missing rules: %s", strings.Join(rules, ", ")), nil)
+	}
+	return nil
+}
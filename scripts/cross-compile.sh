@@ -18,12 +18,14 @@ export CGO_ENABLED=0
 # Ensure bin directory exists
 mkdir -p bin
 
-# Build the binary
-go build -o bin/${OUTPUT_NAME} main.go
-
-# Verify the binary
-echo "Verifying binary..."
-file bin/${OUTPUT_NAME}
+# Build the plugin, the admin CLI and the node agent
+go build -o bin/${OUTPUT_NAME} .
+go build -o bin/xvmctl ./cmd/xvmctl
+go build -o bin/xvm-agent ./cmd/xvm-agent
+
+# Verify the binaries
+echo "Verifying binaries..."
+file bin/${OUTPUT_NAME} bin/xvmctl bin/xvm-agent
 
 echo "Cross-compilation complete: bin/${OUTPUT_NAME}"
 echo "Target: ${TARGET_OS}/${TARGET_ARCH}"
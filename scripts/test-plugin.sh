@@ -50,7 +50,7 @@ CNI_CONF="$TEMP_DIR/xvm-test.conf"
 cat > "$CNI_CONF" << EOF
 {
   "cniVersion": "1.0.0",
-  "name": "xvm-test-network",
+  "name": "xvm-test",
   "type": "xvm-cni",
   "hostInterface": "$DEFAULT_IFACE",
   "vxlanID": 42,
@@ -88,11 +88,18 @@ echo "$NETCONF" | CNI_COMMAND=ADD CNI_CONTAINERID="$CONTAINER_ID" CNI_NETNS="$NE
 echo "Verifying network setup..."
 
 # Check if VXLAN interface exists
-if ! ip link show vxlan42 &>/dev/null; then
-    echo "ERROR: VXLAN interface vxlan42 not found"
+if ! ip link show xvx-xvm-test &>/dev/null; then
+    echo "ERROR: VXLAN interface xvx-xvm-test not found"
     exit 1
 fi
-echo "VXLAN interface vxlan42 exists"
+echo "VXLAN interface xvx-xvm-test exists"
+
+# Check if overlay bridge exists
+if ! ip link show xbr-xvm-test &>/dev/null; then
+    echo "ERROR: Bridge xbr-xvm-test not found"
+    exit 1
+fi
+echo "Bridge xbr-xvm-test exists"
 
 # Check if container interface exists and has IP
 echo "Checking container interface..."
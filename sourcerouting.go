@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+	"github.com/nohns/xvm-cni/pkg/rtable"
+	"github.com/nohns/xvm-cni/pkg/vrf"
+	"github.com/nohns/xvm-cni/pkg/vxlan"
+)
+
+// SourceRoutingConf holds the routing table VXLAN traffic is routed by, so
+// it leaves through hostInterface on nodes with several uplinks
+type SourceRoutingConf struct {
+	// Table holds the routes out of hostInterface, selected for packets from
+	// the VTEP address
+	Table uint32 `json:"table"`
+	// Gateway is the next hop of the table's default route, defaulting to
+	// the one of the main table's default route through hostInterface
+	Gateway string `json:"gateway,omitempty"`
+	// Priority orders the rule among the node's (default: 1000)
+	Priority int `json:"priority,omitempty"`
+}
+
+// validate returns the problems with the source routing settings
+func (s *SourceRoutingConf) validate(c *PluginConf) []string {
+	var problems []string
+	if vrf.ReservedTable(s.Table) {
+		problems = append(problems, fmt.Sprintf("sourceRouting.table %d is reserved", s.Table))
+	}
+	if s.Gateway != "" {
+		if ip := net.ParseIP(s.Gateway); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("invalid sourceRouting.gateway %q", s.Gateway))
+		}
+	}
+	if s.Priority < 0 || s.Priority > 32765 {
+		problems = append(problems, fmt.Sprintf("sourceRouting.priority %d out of range (1-32765)", s.Priority))
+	}
+	if c.RouteTable != nil && c.RouteTable.ID == s.Table {
+		problems = append(problems, "sourceRouting.table and routeTable.id must differ")
+	}
+	return problems
+}
+
+// sourceSelector returns the rule selecting the source routing table for
+// packets from the VTEP address
+func sourceSelector(conf *PluginConf, vtep net.IP) *rtable.Selector {
+	s := &rtable.Selector{
+		Table:    int(conf.SourceRouting.Table),
+		Priority: conf.SourceRouting.Priority,
+		Sources:  []*net.IPNet{{IP: vtep.To4(), Mask: net.CIDRMask(32, 32)}},
+	}
+	if s.Priority == 0 {
+		s.Priority = rtable.DefaultPriority
+	}
+	return s
+}
+
+// sourceRoutes returns the routes of the source routing table: the prefixes
+// of hostInterface's addresses, and the default route through its gateway
+func sourceRoutes(conf *PluginConf, link netlink.Link) ([]*netlink.Route, error) {
+	table := int(conf.SourceRouting.Table)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*netlink.Route
+	for _, addr := range addrs {
+		if !addr.IP.IsGlobalUnicast() {
+			continue
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask},
+			Src:       addr.IP,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		})
+	}
+
+	gateway := net.ParseIP(conf.SourceRouting.Gateway)
+	if gateway == nil {
+		if gateway, err = defaultGateway(link); err != nil {
+			return nil, err
+		}
+	}
+	routes = append(routes, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        gateway,
+		Table:     table,
+	})
+	return routes, nil
+}
+
+// defaultGateway returns the gateway of the main table's default route
+// through the link
+func defaultGateway(link netlink.Link) (net.IP, error) {
+	filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_MAIN}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Gw == nil {
+			continue
+		}
+		if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
+			return route.Gw, nil
+		}
+	}
+	return nil, fmt.Errorf("no default route through %s to take the gateway from, set sourceRouting.gateway", link.Attrs().Name)
+}
+
+// setupSourceRouting routes the VXLAN traffic, sourced from the VTEP address,
+// by a table sending it out of hostInterface, so it leaves through the uplink
+// owning the address rather than the main table's. The rule and routes are
+// left in place when the network is torn down, as other networks may share
+// the underlay.
+func setupSourceRouting(conf *PluginConf) error {
+	link, err := netlink.LinkByName(conf.HostInterface)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to get interface %s", conf.HostInterface), err)
+	}
+	vtep, err := vxlan.LocalIP(conf.HostInterface)
+	if err != nil {
+		return netlinkError("failed to get VTEP address", err)
+	}
+	routes, err := sourceRoutes(conf, link)
+	if err != nil {
+		return netlinkError("failed to get source routes", err)
+	}
+	for _, route := range routes {
+		if err := retry.Do(func() error { return netlink.RouteReplace(route) }); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add route to table %d", route.Table), err)
+		}
+	}
+	if err := rtable.Setup(sourceSelector(conf, vtep), nil); err != nil {
+		return netlinkError("failed to setup source routing", err)
+	}
+	return nil
+}
+
+// checkSourceRouting verifies that the source routing rule and the default
+// route of its table are installed
+func checkSourceRouting(conf *PluginConf) error {
+	vtep, err := vxlan.LocalIP(conf.HostInterface)
+	if err != nil {
+		return netlinkError("failed to get VTEP address", err)
+	}
+	missing, err := rtable.Missing(sourceSelector(conf, vtep))
+	if err != nil {
+		return netlinkError("failed to check source routing", err)
+	}
+	if len(missing) > 0 {
+		return newError(types.ErrInternal, fmt.Sprintf("missing rule: %s", rtable.Describe(missing[0])), nil)
+	}
+	filter := &netlink.Route{Table: int(conf.SourceRouting.Table)}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return netlinkError("failed to list source routes", err)
+	}
+	for _, route := range routes {
+		if route.Gw != nil {
+			return nil
+		}
+	}
+	return newError(types.ErrInternal, fmt.Sprintf("no default route in table %d", conf.SourceRouting.Table), nil)
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/pmtu"
+)
+
+// errLimitedConnectivity is the STATUS error of a plugin whose existing
+// containers may have limited connectivity, which the CNI spec defines but
+// the library doesn't name
+const errLimitedConnectivity uint = 51
+
+// cmdStatus reports the network's connectivity as limited while xvm-agent
+// finds underlay paths to peers that drop the network's encapsulated frames
+// without reporting their MTU
+func cmdStatus(_ context.Context, args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	blackholes, err := pmtu.LoadBlackholes(ipam.NetworkDir(conf.DataDir, conf.Name))
+	if err != nil {
+		return newError(types.ErrInternal, "failed to read PMTU blackholes", err)
+	}
+	if len(blackholes) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(blackholes))
+	for _, b := range blackholes {
+		paths = append(paths, fmt.Sprintf("%s carries %d bytes", b.Peer, b.MTU))
+	}
+	return newError(errLimitedConnectivity, "underlay paths to peers drop large packets without reporting their MTU", fmt.Errorf("%s", strings.Join(paths, ", ")))
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/ipam"
+	"github.com/nohns/xvm-cni/pkg/pmtu"
+)
+
+func TestStatus(t *testing.T) {
+	dataDir := t.TempDir()
+	args := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(`{
+		"cniVersion": "1.1.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"dataDir": %q
+	}`, dataDir))}
+	if err := cmdStatus(context.Background(), args); err != nil {
+		t.Fatalf("Expected network without blackholes to be available, got: %v", err)
+	}
+
+	// The blackholes the agent records limit the connectivity
+	dir := ipam.NetworkDir(dataDir, "xvm-network")
+	if err := pmtu.SaveBlackholes(dir, []pmtu.Blackhole{{Peer: "192.168.1.12", MTU: 1400}}); err != nil {
+		t.Fatalf("Failed to save blackholes: %v", err)
+	}
+	err := cmdStatus(context.Background(), args)
+	if err == nil || err.(*types.Error).Code != errLimitedConnectivity {
+		t.Fatalf("Expected limited connectivity, got: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// containerSysctls returns the sysctls to apply inside the container, with
+// per-attachment args taking precedence over the network configuration
+func (c *PluginConf) containerSysctls() map[string]string {
+	sysctls := make(map[string]string, len(c.Sysctls))
+	for name, value := range c.Sysctls {
+		sysctls[name] = value
+	}
+	if c.Args != nil {
+		for name, value := range c.Args.CNI.Sysctls {
+			sysctls[name] = value
+		}
+	}
+	return sysctls
+}
+
+// validateSysctl checks that the sysctl is scoped to the network namespace,
+// since anything else would change the host
+func validateSysctl(name string) error {
+	parts := sysctlParts(name)
+	if parts[0] != "net" {
+		return fmt.Errorf("sysctl %q is not a network namespace sysctl", name)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid sysctl name %q", name)
+		}
+	}
+	return nil
+}
+
+// sysctlParts splits a sysctl name into the components of its path under
+// /proc/sys. Names are separated by dots, or by slashes as in sysctl(8),
+// for sysctls of devices whose names contain dots, such as
+// "net/ipv4/conf/eth0.100/rp_filter".
+func sysctlParts(name string) []string {
+	if strings.Contains(name, "/") {
+		return strings.Split(name, "/")
+	}
+	return strings.Split(name, ".")
+}
+
+// applySysctls writes the sysctls in the current network namespace, in name
+// order so the result doesn't depend on map iteration
+func applySysctls(sysctls map[string]string) error {
+	names := make([]string, 0, len(sysctls))
+	for name := range sysctls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(append([]string{"/proc/sys"}, sysctlParts(name)...)...)
+		if err := os.WriteFile(path, []byte(sysctls[name]), 0644); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setDeviceSysctl writes a per-device sysctl in the current network
+// namespace, e.g. ("ipv6/conf", "eth0.100", "proxy_ndp"). It goes by path
+// since device names such as VLAN sub-interfaces may contain dots, which
+// sysctl names use as separators.
+func setDeviceSysctl(table, device, name, value string) error {
+	path := filepath.Join("/proc/sys/net", table, device, name)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl %s of %s: %v", name, device, err)
+	}
+	return nil
+}
+
+// deviceSysctl reads a per-device sysctl in the current network namespace,
+// like setDeviceSysctl writes it
+func deviceSysctl(table, device, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys/net", table, device, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read sysctl %s of %s: %v", name, device, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// disableIPv6 turns off IPv6 in the current network namespace, including on
+// the given interface, so it never gets a link-local address. It is a no-op
+// on kernels without IPv6.
+func disableIPv6(ifName string) error {
+	if _, err := os.Stat("/proc/sys/net/ipv6"); os.IsNotExist(err) {
+		return nil
+	}
+	return applySysctls(map[string]string{
+		"net/ipv6/conf/all/disable_ipv6":            "1",
+		"net/ipv6/conf/default/disable_ipv6":        "1",
+		"net/ipv6/conf/" + ifName + "/disable_ipv6": "1",
+	})
+}
@@ -0,0 +1,201 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+	"github.com/nohns/xvm-cni/pkg/neigh"
+)
+
+// maxExpectedPeers keeps the derived thresholds within the sysctls' range
+const maxExpectedPeers = 100000000
+
+// TablesConf sizes the node's neighbor tables and the bridge's forwarding
+// database for the cluster. The kernel's defaults hold about a thousand
+// neighbors, and past them connectivity to random peers drops.
+type TablesConf struct {
+	// ExpectedPeers is the number of containers and nodes the node expects
+	// to reach, which the tables are raised to hold
+	ExpectedPeers int `json:"expectedPeers,omitempty"`
+	// GCThresh1, GCThresh2 and GCThresh3 set the neighbor tables'
+	// thresholds instead of those derived from expectedPeers. Thresholds
+	// already higher are kept.
+	GCThresh1 int `json:"gcThresh1,omitempty"`
+	GCThresh2 int `json:"gcThresh2,omitempty"`
+	GCThresh3 int `json:"gcThresh3,omitempty"`
+	// FDBMaxLearned limits the MACs the bridge learns (default: no limit,
+	// or twice expectedPeers if a lower limit was set)
+	FDBMaxLearned int `json:"fdbMaxLearned,omitempty"`
+}
+
+// validate returns the problems with the tables' settings
+func (t *TablesConf) validate(c *PluginConf) []string {
+	var problems []string
+	if t.ExpectedPeers < 0 || t.ExpectedPeers > maxExpectedPeers {
+		problems = append(problems, fmt.Sprintf("tables.expectedPeers %d out of range (0-%d)", t.ExpectedPeers, maxExpectedPeers))
+	}
+	for i, v := range []int{t.GCThresh1, t.GCThresh2, t.GCThresh3} {
+		if v < 0 || v > 4*maxExpectedPeers {
+			problems = append(problems, fmt.Sprintf("tables.gcThresh%d %d out of range (0-%d)", i+1, v, 4*maxExpectedPeers))
+		}
+	}
+	if len(problems) == 0 {
+		// Unset thresholds are left to the node
+		want, last := t.gcThresh(), 0
+		for _, v := range []int{want.Thresh1, want.Thresh2, want.Thresh3} {
+			if v != 0 && v < last {
+				problems = append(problems, fmt.Sprintf("tables thresholds %d, %d and %d must not decrease", want.Thresh1, want.Thresh2, want.Thresh3))
+				break
+			}
+			last = max(last, v)
+		}
+	}
+	if t.FDBMaxLearned < 0 {
+		problems = append(problems, fmt.Sprintf("tables.fdbMaxLearned %d must not be negative", t.FDBMaxLearned))
+	}
+	if t.FDBMaxLearned > 0 {
+		if !c.usesBridge() {
+			problems = append(problems, fmt.Sprintf("tables.fdbMaxLearned isn't supported in mode %q", c.Mode))
+		}
+		if t.FDBMaxLearned < t.ExpectedPeers {
+			problems = append(problems, fmt.Sprintf("tables.fdbMaxLearned %d is below expectedPeers %d", t.FDBMaxLearned, t.ExpectedPeers))
+		}
+	}
+	return problems
+}
+
+// gcThresh returns the neighbor tables' thresholds to raise to
+func (t *TablesConf) gcThresh() neigh.GCThresh {
+	want := neigh.ForPeers(t.ExpectedPeers)
+	for _, v := range []struct{ set, want *int }{
+		{&t.GCThresh1, &want.Thresh1},
+		{&t.GCThresh2, &want.Thresh2},
+		{&t.GCThresh3, &want.Thresh3},
+	} {
+		if *v.set != 0 {
+			*v.want = *v.set
+		}
+	}
+	return want
+}
+
+// fdbMaxLearned returns the limit to set on the bridge given its current
+// one, which is kept unless configured or too low for the expected peers
+func (t *TablesConf) fdbMaxLearned(cur int) int {
+	if t.FDBMaxLearned != 0 {
+		return t.FDBMaxLearned
+	}
+	if cur != 0 && cur < 2*t.ExpectedPeers {
+		return 2 * t.ExpectedPeers
+	}
+	return cur
+}
+
+// setupTables raises the node's neighbor tables and limits the bridge's
+// forwarding database as configured. The tables are shared by every network
+// namespace, and can only be sized from the initial one, so the plugin
+// running elsewhere leaves them to the node.
+func setupTables(conf *PluginConf, br *netlink.Bridge) error {
+	want := conf.Tables.gcThresh()
+	for _, family := range neigh.Families {
+		if !neigh.Sizable(family) {
+			continue
+		}
+		if _, err := neigh.Raise(family, want); err != nil {
+			return newError(types.ErrInternal, "failed to raise neighbor table thresholds", err)
+		}
+	}
+
+	if br == nil {
+		return nil
+	}
+	limit, err := bridge.FDBLimitOf(br)
+	if errors.Is(err, bridge.ErrNoFDBLimit) && conf.Tables.FDBMaxLearned == 0 {
+		return nil
+	}
+	if err != nil {
+		return netlinkError("failed to get forwarding database limit", err)
+	}
+	if want := conf.Tables.fdbMaxLearned(limit.MaxLearned); want != limit.MaxLearned {
+		if err := bridge.SetFDBMaxLearned(br, want); err != nil {
+			return netlinkError("failed to limit forwarding database", err)
+		}
+	}
+	return nil
+}
+
+// checkTables verifies that the neighbor tables hold the expected peers and
+// that the bridge's forwarding database is limited as configured
+func checkTables(conf *PluginConf, l2 netlink.Link) error {
+	want := conf.Tables.gcThresh()
+	for _, family := range neigh.Families {
+		if !neigh.Sizable(family) {
+			continue
+		}
+		cur, err := neigh.Thresholds(family)
+		if err != nil {
+			return newError(types.ErrInternal, "failed to check neighbor table thresholds", err)
+		}
+		if !cur.Covers(want) {
+			return newError(types.ErrInternal, fmt.Sprintf("%s neighbor table thresholds %d, %d and %d below %d, %d and %d",
+				family, cur.Thresh1, cur.Thresh2, cur.Thresh3, want.Thresh1, want.Thresh2, want.Thresh3), nil)
+		}
+	}
+
+	if !conf.usesBridge() {
+		return nil
+	}
+	limit, err := bridge.FDBLimitOf(l2)
+	if errors.Is(err, bridge.ErrNoFDBLimit) && conf.Tables.FDBMaxLearned == 0 {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "failed to check forwarding database limit", err)
+	}
+	if want := conf.Tables.fdbMaxLearned(limit.MaxLearned); want != limit.MaxLearned {
+		return newError(types.ErrInternal, fmt.Sprintf("bridge %s learns up to %d MACs, expected %d", l2Name(conf), limit.MaxLearned, want), nil)
+	}
+	return nil
+}
+
+// planTables adds the raises of the neighbor tables' thresholds and the
+// bridge's forwarding database limit to the plan
+func planTables(p *plan, conf *PluginConf) {
+	want := conf.Tables.gcThresh()
+	for _, family := range neigh.Families {
+		if !neigh.Sizable(family) {
+			continue
+		}
+		cur, err := neigh.Thresholds(family)
+		if err != nil {
+			continue
+		}
+		next := cur.Max(want)
+		for i, v := range []struct{ cur, next int }{{cur.Thresh3, next.Thresh3}, {cur.Thresh2, next.Thresh2}, {cur.Thresh1, next.Thresh1}} {
+			if v.next != v.cur {
+				p.add("set-sysctl", fmt.Sprintf("net.%s.neigh.default.gc_thresh%d", family, 3-i), map[string]string{"value": strconv.Itoa(v.next)})
+			}
+		}
+	}
+
+	if !conf.usesBridge() {
+		return
+	}
+	cur := 0
+	if link, err := netlink.LinkByName(l2Name(conf)); err == nil {
+		if limit, err := bridge.FDBLimitOf(link); err == nil {
+			cur = limit.MaxLearned
+		}
+	}
+	if want := conf.Tables.fdbMaxLearned(cur); want != cur {
+		p.add("set-fdb-limit", l2Name(conf), map[string]string{"maxLearned": strconv.Itoa(want)})
+	}
+}
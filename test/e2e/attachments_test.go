@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDualHomedAttachment(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	n, _ := newNodes(t)
+	ctrA, ctrB := newNS(t), newNS(t)
+
+	// The network's front-end interface is eth0, the back-end one eth1
+	conf := []byte(fmt.Sprintf(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-e2e",
+		"type": "xvm-cni",
+		"hostInterface": %q,
+		"vxlanID": %d,
+		"subnet": "10.242.0.0/24",
+		"gateway": "10.242.0.1",
+		"mtu": 1450,
+		"dataDir": %q,
+		"attachments": [{
+			"name": "back",
+			"ifName": "eth1",
+			"vxlanID": %d,
+			"subnet": "10.245.0.0/24",
+			"gateway": "10.245.0.1",
+			"routes": [{"dst": "10.246.0.0/16"}]
+		}]
+	}`, underlayName, vxlanID, n.dataDir, vxlanID+2))
+	argsOf := func(command string, ctr ns.NetNS, ip string) *invoke.Args {
+		return &invoke.Args{
+			Command:     command,
+			ContainerID: filepath.Base(ctr.Path()),
+			NetNS:       ctr.Path(),
+			IfName:      "eth0",
+			Path:        pluginDir,
+			PluginArgs:  [][2]string{{"IgnoreUnknown", "1"}, {"IP", ip}},
+		}
+	}
+
+	result, err := n.execConf("ADD", conf, argsOf("ADD", ctrA, "10.242.0.10"))
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	if _, err := n.execConf("ADD", conf, argsOf("ADD", ctrB, "10.242.0.20")); err != nil {
+		t.Fatalf("ADD of the second container failed: %v", err)
+	}
+
+	// The result reports both interfaces, each with the address of its
+	// subnet, and the routes of both
+	addrs := make(map[string]string)
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil {
+			t.Fatalf("Expected the interface of %s in the result", ipc.Address.String())
+		}
+		iface := result.Interfaces[*ipc.Interface]
+		if iface.Sandbox != ctrA.Path() {
+			t.Fatalf("Expected %s in the container, got %v", iface.Name, iface)
+		}
+		addrs[iface.Name] = ipc.Address.String()
+	}
+	if len(addrs) != 2 || addrs["eth0"] != "10.242.0.10/24" || addrs["eth1"] != "10.245.0.2/24" {
+		t.Fatalf("Unexpected addresses %v", addrs)
+	}
+	routed := false
+	for _, route := range result.Routes {
+		routed = routed || route.Dst.String() == "10.246.0.0/16"
+	}
+	if !routed {
+		t.Fatalf("Expected the back-end route in the result, got %v", result.Routes)
+	}
+
+	// The default route stays with eth0, the back-end route goes via eth1
+	err = ctrA.Do(func(ns.NetNS) error {
+		eth1, err := netlink.LinkByName("eth1")
+		if err != nil {
+			return err
+		}
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			isDefault := route.Dst == nil || route.Dst.String() == "0.0.0.0/0"
+			if isDefault && route.LinkIndex == eth1.Attrs().Index {
+				return fmt.Errorf("default route via eth1")
+			}
+			if route.Dst != nil && route.Dst.String() == "10.246.0.0/16" && route.LinkIndex != eth1.Attrs().Index {
+				return fmt.Errorf("back-end route not via eth1")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected container routes: %v", err)
+	}
+
+	// The containers reach each other on the back-end segment
+	var l net.Listener
+	err = ctrB.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", "10.245.0.3:0")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen on the back-end address of the second container: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := dial(ctrA, l.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("Container can't reach the other on the back-end segment: %v", err)
+	}
+	conn.Close()
+
+	if _, err := n.execConf("CHECK", conf, argsOf("CHECK", ctrA, "10.242.0.10")); err != nil {
+		t.Fatalf("CHECK failed: %v", err)
+	}
+
+	// DEL removes both interfaces
+	for _, ctr := range []ns.NetNS{ctrA, ctrB} {
+		if _, err := n.execConf("DEL", conf, argsOf("DEL", ctr, "")); err != nil {
+			t.Fatalf("DEL failed: %v", err)
+		}
+	}
+	err = ctrA.Do(func(ns.NetNS) error {
+		for _, name := range []string{"eth0", "eth1"} {
+			if _, err := netlink.LinkByName(name); err == nil {
+				return fmt.Errorf("%s still exists", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DEL left the container interfaces: %v", err)
+	}
+}
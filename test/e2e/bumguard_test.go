@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// underlayXDP reports whether an XDP program is attached to the node's
+// underlay interface
+func underlayXDP(t *testing.T, n *node) bool {
+	t.Helper()
+	var attached bool
+	err := n.netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(underlayName)
+		if err != nil {
+			return err
+		}
+		attached = link.Attrs().Xdp != nil && link.Attrs().Xdp.Attached
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to find underlay: %v", err)
+	}
+	return attached
+}
+
+func TestBUMGuard(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	nodeA, nodeB := newNodes(t)
+	ctrA, ctrB := newNS(t), newNS(t)
+
+	// Each node pins its guard to a BPF file system of its own
+	fsDirs := make(map[*node]string)
+	for _, n := range []*node{nodeA, nodeB} {
+		dir := t.TempDir()
+		t.Cleanup(func() { unix.Unmount(dir, unix.MNT_DETACH) })
+		fsDirs[n] = dir
+	}
+	confOf := func(n *node) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "xvm-e2e",
+			"type": "xvm-cni",
+			"hostInterface": %q,
+			"vxlanID": %d,
+			"subnet": "10.242.0.0/24",
+			"gateway": "10.242.0.1",
+			"mtu": 1450,
+			"dataDir": %q,
+			"ebpf": {"bumGuard": {"rate": 10, "burst": 20}, "fsDir": %q}
+		}`, underlayName, vxlanID, n.dataDir, fsDirs[n]))
+	}
+	exec := func(n *node, command string, ctr ns.NetNS, ip string) error {
+		args := &invoke.Args{
+			Command:     command,
+			ContainerID: filepath.Base(ctr.Path()),
+			NetNS:       ctr.Path(),
+			IfName:      "eth0",
+			Path:        pluginDir,
+		}
+		if ip != "" {
+			args.PluginArgs = [][2]string{{"IgnoreUnknown", "1"}, {"IP", ip}}
+		}
+		_, err := n.execConf(command, confOf(n), args)
+		return err
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+		ip  string
+	}{{nodeA, ctrA, "10.242.0.10"}, {nodeB, ctrB, "10.242.0.20"}} {
+		if err := exec(a.n, "ADD", a.ctr, a.ip); err != nil {
+			t.Fatalf("ADD of %s failed: %v", a.ip, err)
+		}
+		if err := exec(a.n, "CHECK", a.ctr, ""); err != nil {
+			t.Fatalf("CHECK of %s failed: %v", a.ip, err)
+		}
+	}
+	if !underlayXDP(t, nodeA) {
+		t.Fatalf("Expected guard on node A's underlay")
+	}
+
+	// The neighbor discovery after ADD counts as well, so let the bucket
+	// fill up first
+	time.Sleep(1500 * time.Millisecond)
+
+	// Count the broadcasts reaching the container on node A
+	var l net.PacketConn
+	err := ctrA.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.ListenPacket("udp4", ":9999")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	received := make(chan int)
+	go func() {
+		n := 0
+		buf := make([]byte, 64)
+		for {
+			l.SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err := l.ReadFrom(buf); err != nil {
+				received <- n
+				return
+			}
+			n++
+		}
+	}()
+
+	// A storm from the container on node B is cut down to the burst and
+	// the rate
+	const storm = 200
+	err = ctrB.Do(func(ns.NetNS) error {
+		conn, err := net.ListenPacket("udp4", "10.242.0.20:0")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		raw, err := conn.(*net.UDPConn).SyscallConn()
+		if err != nil {
+			return err
+		}
+		var serr error
+		if err := raw.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return serr
+		}
+		for i := 0; i < storm; i++ {
+			if _, err := conn.WriteTo([]byte("storm"), &net.UDPAddr{IP: net.IPv4bcast, Port: 9999}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to send broadcasts: %v", err)
+	}
+	if n := <-received; n == 0 || n > 60 {
+		t.Fatalf("Expected the guard to let a few of %d broadcasts through, got %d", storm, n)
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+	}{{nodeA, ctrA}, {nodeB, ctrB}} {
+		if err := exec(a.n, "DEL", a.ctr, ""); err != nil {
+			t.Fatalf("DEL failed: %v", err)
+		}
+	}
+
+	// The guard goes with the last network on the interface
+	gcConf := bytes.Replace(confOf(nodeA), []byte(`"1.0.0"`), []byte(`"1.1.0"`), 1)
+	if _, err := nodeA.execConf("GC", gcConf, &invoke.Args{Command: "GC", Path: pluginDir}); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if underlayXDP(t, nodeA) {
+		t.Fatalf("Expected no guard on node A's underlay after GC")
+	}
+}
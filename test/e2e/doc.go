@@ -0,0 +1,9 @@
+//go:build linux
+// +build linux
+
+// Package e2e tests the plugin end to end: it runs the built plugin through
+// its CNI entry points in network namespaces standing in for two nodes
+// joined by a veth underlay, and checks containers on both nodes reach each
+// other over the VXLAN overlay. The tests need root, but no VMs; they skip
+// without it.
+package e2e
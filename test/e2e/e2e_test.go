@@ -0,0 +1,292 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// underlayName is the node's interface to the other node
+	underlayName = "underlay0"
+	// vxlanID is the test network's VNI, unlikely to be in use on the host
+	vxlanID = 4242
+)
+
+// pluginDir holds the plugin built for the tests, empty without root
+var pluginDir string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if os.Geteuid() == 0 {
+		dir, err := os.MkdirTemp("", "xvm-cni-e2e")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create plugin directory: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		build := exec.Command("go", "build", "-o", filepath.Join(dir, "xvm-cni"), "github.com/nohns/xvm-cni")
+		build.Stdout, build.Stderr = os.Stdout, os.Stderr
+		if err := build.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to build plugin: %v\n", err)
+			return 1
+		}
+		pluginDir = dir
+	}
+	return m.Run()
+}
+
+// node is a network namespace standing in for a node, with its own
+// allocations
+type node struct {
+	netns   ns.NetNS
+	dataDir string
+}
+
+// newNodes returns two nodes whose underlay interfaces are the ends of a
+// veth pair, addressed 192.168.242.1 and .2
+func newNodes(t *testing.T) (*node, *node) {
+	t.Helper()
+	a, b := newNode(t), newNode(t)
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("xvme2e%d", os.Getpid()%10000)},
+		PeerName:  fmt.Sprintf("xvme2p%d", os.Getpid()%10000),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatalf("Failed to create underlay: %v", err)
+	}
+	for i, n := range []*node{a, b} {
+		name := veth.Name
+		if i == 1 {
+			name = veth.PeerName
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("Failed to find underlay end %s: %v", name, err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(n.netns.Fd())); err != nil {
+			t.Fatalf("Failed to move underlay end %s: %v", name, err)
+		}
+		addr := fmt.Sprintf("192.168.242.%d/24", i+1)
+		err = n.netns.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetName(link, underlayName); err != nil {
+				return err
+			}
+			ipnet, err := netlink.ParseAddr(addr)
+			if err != nil {
+				return err
+			}
+			if err := netlink.AddrAdd(link, ipnet); err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(link)
+		})
+		if err != nil {
+			t.Fatalf("Failed to configure underlay %s: %v", addr, err)
+		}
+	}
+	return a, b
+}
+
+func newNode(t *testing.T) *node {
+	t.Helper()
+	return &node{netns: newNS(t), dataDir: t.TempDir()}
+}
+
+// newNS returns a network namespace removed at the end of the test
+func newNS(t *testing.T) ns.NetNS {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create network namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		testutils.UnmountNS(netns)
+	})
+	return netns
+}
+
+// conf returns the node's network configuration
+func (n *node) conf() []byte {
+	return []byte(fmt.Sprintf(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-e2e",
+		"type": "xvm-cni",
+		"hostInterface": %q,
+		"vxlanID": %d,
+		"subnet": "10.242.0.0/24",
+		"gateway": "10.242.0.1",
+		"mtu": 1450,
+		"dataDir": %q
+	}`, underlayName, vxlanID, n.dataDir))
+}
+
+// exec runs the plugin in the node's namespace, as the runtime would on
+// the node
+func (n *node) exec(command string, container ns.NetNS, ip string) (*current.Result, error) {
+	args := &invoke.Args{
+		Command:     command,
+		ContainerID: filepath.Base(container.Path()),
+		NetNS:       container.Path(),
+		IfName:      "eth0",
+		Path:        pluginDir,
+	}
+	if ip != "" {
+		args.PluginArgs = [][2]string{{"IgnoreUnknown", "1"}, {"IP", ip}}
+	}
+	return n.execConf(command, n.conf(), args)
+}
+
+// execConf runs the plugin with the configuration in the node's namespace
+func (n *node) execConf(command string, conf []byte, args *invoke.Args) (*current.Result, error) {
+	plugin := filepath.Join(pluginDir, "xvm-cni")
+
+	var result *current.Result
+	err := n.netns.Do(func(ns.NetNS) error {
+		if command != "ADD" {
+			return invoke.ExecPluginWithoutResult(context.Background(), plugin, conf, args, nil)
+		}
+		r, err := invoke.ExecPluginWithResult(context.Background(), plugin, conf, args, nil)
+		if err != nil {
+			return err
+		}
+		result, err = current.NewResultFromResult(r)
+		return err
+	})
+	return result, err
+}
+
+// dial connects from the container to the address until it succeeds or
+// the timeout passes, as the overlay learns the remote MAC on the way
+func dial(container ns.NetNS, addr string, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	err := container.Do(func(ns.NetNS) error {
+		deadline := time.Now().Add(timeout)
+		for {
+			var err error
+			conn, err = net.DialTimeout("tcp", addr, time.Second)
+			if err == nil || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	return conn, err
+}
+
+func TestCrossNodeConnectivity(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	nodeA, nodeB := newNodes(t)
+	ctrA, ctrB := newNS(t), newNS(t)
+
+	resultA, err := nodeA.exec("ADD", ctrA, "10.242.0.10")
+	if err != nil {
+		t.Fatalf("ADD on node A failed: %v", err)
+	}
+	resultB, err := nodeB.exec("ADD", ctrB, "10.242.0.20")
+	if err != nil {
+		t.Fatalf("ADD on node B failed: %v", err)
+	}
+	if len(resultA.IPs) != 1 || resultA.IPs[0].Address.IP.String() != "10.242.0.10" {
+		t.Fatalf("Unexpected result on node A: %v", resultA)
+	}
+	if len(resultB.IPs) != 1 || resultB.IPs[0].Address.IP.String() != "10.242.0.20" {
+		t.Fatalf("Unexpected result on node B: %v", resultB)
+	}
+	for name, n := range map[string]*node{"A": nodeA, "B": nodeB} {
+		ctr := ctrA
+		if n == nodeB {
+			ctr = ctrB
+		}
+		if _, err := n.exec("CHECK", ctr, ""); err != nil {
+			t.Fatalf("CHECK on node %s failed: %v", name, err)
+		}
+	}
+
+	// The container on node A reaches the one on node B through the
+	// overlay, with no route between the nodes other than the underlay
+	var l net.Listener
+	err = ctrB.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", "10.242.0.20:0")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen in container B: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	conn, err := dial(ctrA, l.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("Container A can't reach container B: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to send to container B: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected echo from container B, got %q: %v", reply, err)
+	}
+	conn.Close()
+
+	// Once container B is deleted, it is unreachable, and DEL is idempotent
+	if _, err := nodeB.exec("DEL", ctrB, ""); err != nil {
+		t.Fatalf("DEL on node B failed: %v", err)
+	}
+	err = ctrB.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName("eth0"); err == nil {
+			return fmt.Errorf("eth0 still exists")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DEL on node B left the container interface: %v", err)
+	}
+	if conn, err := dial(ctrA, l.Addr().String(), 0); err == nil {
+		conn.Close()
+		t.Fatalf("Expected container B to be unreachable after DEL")
+	}
+	if _, err := nodeB.exec("DEL", ctrB, ""); err != nil {
+		t.Fatalf("Repeated DEL on node B failed: %v", err)
+	}
+	if _, err := nodeA.exec("DEL", ctrA, ""); err != nil {
+		t.Fatalf("DEL on node A failed: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bpf"
+	"github.com/nohns/xvm-cni/pkg/fastpath"
+)
+
+// echo serves connections in the container on the address, echoing what
+// they send
+func echo(t *testing.T, ctr ns.NetNS, addr string) net.Listener {
+	t.Helper()
+	var l net.Listener
+	err := ctr.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// roundTrip sends a message from the container to the address and expects
+// it echoed
+func roundTrip(ctr ns.NetNS, addr string) error {
+	conn, err := dial(ctr, addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if string(reply) != "ping" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func TestFastPath(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	nodeA, nodeB := newNodes(t)
+	ctrA1, ctrA2, ctrB := newNS(t), newNS(t), newNS(t)
+
+	// Each node pins its maps to a BPF file system of its own
+	fsDirs := make(map[*node]string)
+	for _, n := range []*node{nodeA, nodeB} {
+		dir := t.TempDir()
+		t.Cleanup(func() { unix.Unmount(dir, unix.MNT_DETACH) })
+		fsDirs[n] = dir
+	}
+	confOf := func(n *node) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "xvm-e2e",
+			"type": "xvm-cni",
+			"hostInterface": %q,
+			"vxlanID": %d,
+			"subnet": "10.242.0.0/24",
+			"gateway": "10.242.0.1",
+			"mtu": 1450,
+			"dataDir": %q,
+			"antiSpoofing": true,
+			"ebpf": {"fastPath": true, "antiSpoofing": true, "fsDir": %q}
+		}`, underlayName, vxlanID, n.dataDir, fsDirs[n]))
+	}
+	exec := func(n *node, command string, ctr ns.NetNS, ip string) error {
+		args := &invoke.Args{
+			Command:     command,
+			ContainerID: filepath.Base(ctr.Path()),
+			NetNS:       ctr.Path(),
+			IfName:      "eth0",
+			Path:        pluginDir,
+		}
+		if ip != "" {
+			args.PluginArgs = [][2]string{{"IgnoreUnknown", "1"}, {"IP", ip}}
+		}
+		_, err := n.execConf(command, confOf(n), args)
+		return err
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+		ip  string
+	}{{nodeA, ctrA1, "10.242.0.10"}, {nodeA, ctrA2, "10.242.0.11"}, {nodeB, ctrB, "10.242.0.20"}} {
+		if err := exec(a.n, "ADD", a.ctr, a.ip); err != nil {
+			t.Fatalf("ADD of %s failed: %v", a.ip, err)
+		}
+		if err := exec(a.n, "CHECK", a.ctr, ""); err != nil {
+			t.Fatalf("CHECK of %s failed: %v", a.ip, err)
+		}
+	}
+
+	// Node A redirects the traffic to its two containers
+	maps, err := fastpath.OpenExisting(filepath.Join(fsDirs[nodeA], bpf.PinDir("xvm-e2e")))
+	if err != nil {
+		t.Fatalf("Failed to open node A's maps: %v", err)
+	}
+	defer maps.Close()
+	ports, err := maps.Ports()
+	if err != nil {
+		t.Fatalf("Failed to list ports: %v", err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Expected 2 ports on node A, got %v", ports)
+	}
+
+	// The containers reach each other on the node and across the overlay,
+	// repeatedly once the MACs are known
+	local := echo(t, ctrA2, "10.242.0.11:0")
+	remote := echo(t, ctrB, "10.242.0.20:0")
+	for i := 0; i < 3; i++ {
+		if err := roundTrip(ctrA1, local.Addr().String()); err != nil {
+			t.Fatalf("Container can't reach the other on the node: %v", err)
+		}
+		if err := roundTrip(ctrA1, remote.Addr().String()); err != nil {
+			t.Fatalf("Container can't reach the one on node B: %v", err)
+		}
+	}
+
+	// Traffic from an address the container wasn't allocated is dropped
+	// ahead of the fast path
+	err = ctrA1.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("10.242.0.99/24")
+		addr.Flags = unix.IFA_F_NODAD
+		return netlink.AddrAdd(link, addr)
+	})
+	if err != nil {
+		t.Fatalf("Failed to add spoofed address: %v", err)
+	}
+	err = ctrA1.Do(func(ns.NetNS) error {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("10.242.0.99")}, Timeout: 2 * time.Second}
+		conn, err := dialer.Dial("tcp", local.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err == nil {
+		t.Fatalf("Container reached the other from a spoofed address")
+	}
+
+	// DEL leaves the traffic to the deleted container to the bridge
+	if err := exec(nodeA, "DEL", ctrA2, ""); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	ports, err = maps.Ports()
+	if err != nil {
+		t.Fatalf("Failed to list ports: %v", err)
+	}
+	if len(ports) != 1 {
+		t.Fatalf("Expected 1 port on node A after DEL, got %v", ports)
+	}
+	if err := roundTrip(ctrA1, remote.Addr().String()); err != nil {
+		t.Fatalf("Container can't reach the one on node B after DEL: %v", err)
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+	}{{nodeA, ctrA1}, {nodeB, ctrB}} {
+		if err := exec(a.n, "DEL", a.ctr, ""); err != nil {
+			t.Fatalf("DEL failed: %v", err)
+		}
+	}
+}
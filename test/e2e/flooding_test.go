@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestHeadEndReplication(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	nodeA, nodeB := newNodes(t)
+	ctrA, ctrB := newNS(t), newNS(t)
+
+	// Each node replicates to the other rather than a multicast group
+	peers := map[*node]string{nodeA: "192.168.242.2", nodeB: "192.168.242.1"}
+	confOf := func(n *node) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "xvm-e2e",
+			"type": "xvm-cni",
+			"hostInterface": %q,
+			"vxlanID": %d,
+			"subnet": "10.242.0.0/24",
+			"gateway": "10.242.0.1",
+			"mtu": 1450,
+			"dataDir": %q,
+			"flooding": {"mode": "headEnd", "peers": [%q]}
+		}`, underlayName, vxlanID, n.dataDir, peers[n]))
+	}
+	exec := func(n *node, command string, ctr ns.NetNS, ip string) error {
+		args := &invoke.Args{
+			Command:     command,
+			ContainerID: filepath.Base(ctr.Path()),
+			NetNS:       ctr.Path(),
+			IfName:      "eth0",
+			Path:        pluginDir,
+		}
+		if ip != "" {
+			args.PluginArgs = [][2]string{{"IgnoreUnknown", "1"}, {"IP", ip}}
+		}
+		_, err := n.execConf(command, confOf(n), args)
+		return err
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+		ip  string
+	}{{nodeA, ctrA, "10.242.0.10"}, {nodeB, ctrB, "10.242.0.20"}} {
+		if err := exec(a.n, "ADD", a.ctr, a.ip); err != nil {
+			t.Fatalf("ADD of %s failed: %v", a.ip, err)
+		}
+		if err := exec(a.n, "CHECK", a.ctr, ""); err != nil {
+			t.Fatalf("CHECK of %s failed: %v", a.ip, err)
+		}
+	}
+
+	// The container on node A finds the one on node B by ARP replicated to
+	// node B, with no multicast group on the VXLAN device
+	var l net.Listener
+	err := ctrB.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", "10.242.0.20:0")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen in container B: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := dial(ctrA, l.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("Container A can't reach container B: %v", err)
+	}
+	conn.Close()
+
+	// CHECK notices the flood entry to the peer is gone
+	err = nodeA.netns.Do(func(ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			vx, ok := link.(*netlink.Vxlan)
+			if !ok {
+				continue
+			}
+			if vx.Group != nil {
+				return fmt.Errorf("expected no multicast group, got %s", vx.Group)
+			}
+			entries, err := netlink.NeighList(vx.Index, unix.AF_BRIDGE)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if bytes.Equal(e.HardwareAddr, make(net.HardwareAddr, 6)) {
+					if err := netlink.NeighDel(&e); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("no VXLAN device")
+	})
+	if err != nil {
+		t.Fatalf("Failed to remove flood entry: %v", err)
+	}
+	if err := exec(nodeA, "CHECK", ctrA, ""); err == nil {
+		t.Fatalf("Expected CHECK to fail without the flood entry")
+	}
+
+	for _, a := range []struct {
+		n   *node
+		ctr ns.NetNS
+	}{{nodeA, ctrA}, {nodeB, ctrB}} {
+		if err := exec(a.n, "DEL", a.ctr, ""); err != nil {
+			t.Fatalf("DEL failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// networkSelection is the part of a pod's k8s.v1.cni.cncf.io/networks
+// element Multus passes on to the delegate
+type networkSelection struct {
+	Name      string
+	Interface string
+	IPs       []string
+	MAC       string
+	CNIArgs   map[string]interface{}
+}
+
+// delegateConf returns the configuration Multus delegates to the plugin for
+// a NetworkAttachmentDefinition's spec.config: named after the definition
+// unless it names itself, with the element's ips and mac as the capabilities
+// the configuration declares and its cni-args under args.cni
+func delegateConf(t *testing.T, nadConfig string, sel networkSelection) []byte {
+	t.Helper()
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(nadConfig), &conf); err != nil {
+		t.Fatalf("Invalid NetworkAttachmentDefinition config: %v", err)
+	}
+	if _, ok := conf["name"]; !ok {
+		conf["name"] = sel.Name
+	}
+	caps, _ := conf["capabilities"].(map[string]interface{})
+	runtimeConfig := map[string]interface{}{}
+	if caps["ips"] == true && len(sel.IPs) > 0 {
+		runtimeConfig["ips"] = sel.IPs
+	}
+	if caps["mac"] == true && sel.MAC != "" {
+		runtimeConfig["mac"] = sel.MAC
+	}
+	if len(runtimeConfig) > 0 {
+		conf["runtimeConfig"] = runtimeConfig
+	}
+	if sel.CNIArgs != nil {
+		conf["args"] = map[string]interface{}{"cni": sel.CNIArgs}
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMultusSecondaryAttachment(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	n, _ := newNodes(t)
+	ctr := newNS(t)
+
+	// The cluster network takes eth0 and the default route
+	if _, err := n.exec("ADD", ctr, "10.242.0.10"); err != nil {
+		t.Fatalf("ADD of the cluster network failed: %v", err)
+	}
+
+	// Multus delegates the pod's storage-net element to the plugin with
+	// the definition's config, sharing the cluster network's dataDir
+	nad := fmt.Sprintf(`{
+		"cniVersion": "1.0.0",
+		"type": "xvm-cni",
+		"hostInterface": %q,
+		"vxlanID": %d,
+		"subnet": "10.243.0.0/24",
+		"gateway": "10.243.0.1",
+		"mtu": 1450,
+		"dataDir": %q,
+		"capabilities": {"ips": true, "mac": true},
+		"secondary": true
+	}`, underlayName, vxlanID+1, n.dataDir)
+	sel := networkSelection{
+		Name:      "storage-net",
+		Interface: "net1",
+		IPs:       []string{"10.243.0.7/24"},
+		MAC:       "0a:58:0a:f3:00:07",
+		CNIArgs:   map[string]interface{}{"mtu": 1400},
+	}
+	conf := delegateConf(t, nad, sel)
+	args := &invoke.Args{
+		ContainerID: filepath.Base(ctr.Path()),
+		NetNS:       ctr.Path(),
+		IfName:      sel.Interface,
+		Path:        pluginDir,
+		PluginArgs: [][2]string{
+			{"IgnoreUnknown", "true"},
+			{"K8S_POD_NAMESPACE", "default"},
+			{"K8S_POD_NAME", "web"},
+			{"K8S_POD_INFRA_CONTAINER_ID", filepath.Base(ctr.Path())},
+			{"K8S_POD_UID", "2f1e9a44-3c1b-4d59-9f2e-6f0b8f6c1a7e"},
+		},
+	}
+	withCommand := func(command string) *invoke.Args {
+		a := *args
+		a.Command = command
+		return &a
+	}
+
+	result, err := n.execConf("ADD", conf, withCommand("ADD"))
+	if err != nil {
+		t.Fatalf("ADD of the secondary network failed: %v", err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.243.0.7/24" {
+		t.Fatalf("Expected the requested address, got %v", result.IPs)
+	}
+	if i := result.IPs[0].Interface; i == nil || result.Interfaces[*i].Name != "net1" || result.Interfaces[*i].Sandbox != ctr.Path() {
+		t.Fatalf("Expected the address on net1 in the pod, got %v", result)
+	}
+
+	// net1 is set up as the element asks, and the default route stays
+	// with eth0
+	err = ctr.Do(func(ns.NetNS) error {
+		net1, err := netlink.LinkByName("net1")
+		if err != nil {
+			return err
+		}
+		if mac := net1.Attrs().HardwareAddr.String(); mac != "0a:58:0a:f3:00:07" {
+			return fmt.Errorf("net1 has MAC %s", mac)
+		}
+		if mtu := net1.Attrs().MTU; mtu != 1400 {
+			return fmt.Errorf("net1 has MTU %d", mtu)
+		}
+		eth0, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		var defaults []netlink.Route
+		for _, route := range routes {
+			if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
+				defaults = append(defaults, route)
+			}
+		}
+		if len(defaults) != 1 || defaults[0].LinkIndex != eth0.Attrs().Index {
+			return fmt.Errorf("expected a single default route through eth0, got %v", defaults)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected pod networking: %v", err)
+	}
+
+	// Each network keeps its state apart
+	for _, name := range []string{"xvm-e2e", "storage-net"} {
+		if _, err := os.Stat(filepath.Join(n.dataDir, name)); err != nil {
+			t.Fatalf("Expected state of network %s: %v", name, err)
+		}
+	}
+
+	if _, err := n.execConf("CHECK", conf, withCommand("CHECK")); err != nil {
+		t.Fatalf("CHECK of the secondary network failed: %v", err)
+	}
+	if _, err := n.exec("CHECK", ctr, ""); err != nil {
+		t.Fatalf("CHECK of the cluster network failed: %v", err)
+	}
+
+	// Deleting the secondary attachment leaves the cluster network alone
+	if _, err := n.execConf("DEL", conf, withCommand("DEL")); err != nil {
+		t.Fatalf("DEL of the secondary network failed: %v", err)
+	}
+	err = ctr.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName("net1"); err == nil {
+			return fmt.Errorf("net1 still exists")
+		}
+		_, err := netlink.LinkByName("eth0")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected pod networking after DEL: %v", err)
+	}
+	if _, err := n.exec("CHECK", ctr, ""); err != nil {
+		t.Fatalf("CHECK of the cluster network after DEL failed: %v", err)
+	}
+	if _, err := n.exec("DEL", ctr, ""); err != nil {
+		t.Fatalf("DEL of the cluster network failed: %v", err)
+	}
+}
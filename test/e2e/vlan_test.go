@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// vlanSupported reports whether the kernel filters VLANs on bridges and
+// has VLAN interfaces
+func vlanSupported(t *testing.T, n *node) bool {
+	t.Helper()
+	err := n.netns.Do(func(ns.NetNS) error {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "xvmvlprobe"}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return err
+		}
+		defer netlink.LinkDel(br)
+		if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+			return err
+		}
+		return netlink.LinkAdd(&netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "xvmvlprobe.2", ParentIndex: br.Index},
+			VlanId:    2,
+		})
+	})
+	return err == nil
+}
+
+func TestVLANGateway(t *testing.T) {
+	if pluginDir == "" {
+		t.Skip("Test requires root privileges")
+	}
+	nodeA, _ := newNodes(t)
+	if !vlanSupported(t, nodeA) {
+		t.Skip("Bridge VLAN filtering or VLAN interfaces not supported by the kernel")
+	}
+	ctrs := map[int]ns.NetNS{100: newNS(t), 200: newNS(t)}
+	ips := map[int]string{100: "10.242.0.10", 200: "10.242.0.20"}
+
+	exec := func(command string, vid int) error {
+		conf := []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "xvm-e2e",
+			"type": "xvm-cni",
+			"hostInterface": %q,
+			"vxlanID": %d,
+			"subnet": "10.242.0.0/24",
+			"gateway": "10.242.0.1",
+			"mtu": 1450,
+			"dataDir": %q,
+			"vlanFiltering": true,
+			"vlan": %d
+		}`, underlayName, vxlanID, nodeA.dataDir, vid))
+		args := &invoke.Args{
+			Command:     command,
+			ContainerID: filepath.Base(ctrs[vid].Path()),
+			NetNS:       ctrs[vid].Path(),
+			IfName:      "eth0",
+			Path:        pluginDir,
+		}
+		if command == "ADD" {
+			args.PluginArgs = [][2]string{{"IgnoreUnknown", "1"}, {"IP", ips[vid]}}
+		}
+		_, err := nodeA.execConf(command, conf, args)
+		return err
+	}
+	for _, vid := range []int{100, 200} {
+		if err := exec("ADD", vid); err != nil {
+			t.Fatalf("ADD in VLAN %d failed: %v", vid, err)
+		}
+		if err := exec("CHECK", vid); err != nil {
+			t.Fatalf("CHECK in VLAN %d failed: %v", vid, err)
+		}
+	}
+
+	// The containers of both VLANs reach the gateway on the node, but not
+	// each other
+	gateway := echo(t, nodeA.netns, "10.242.0.1:0")
+	for vid, ctr := range ctrs {
+		if err := roundTrip(ctr, gateway.Addr().String()); err != nil {
+			t.Fatalf("Container in VLAN %d can't reach the gateway: %v", vid, err)
+		}
+	}
+	other := echo(t, ctrs[200], ips[200]+":0")
+	if conn, err := dial(ctrs[100], other.Addr().String(), 0); err == nil {
+		conn.Close()
+		t.Fatalf("Expected the container in VLAN 100 not to reach the one in VLAN 200")
+	}
+
+	for _, vid := range []int{100, 200} {
+		if err := exec("DEL", vid); err != nil {
+			t.Fatalf("DEL in VLAN %d failed: %v", vid, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// defaultCommandTimeout bounds commands without a timeout of their own,
+// short of the two minutes kubelet waits for the runtime
+const defaultCommandTimeout = 90 * time.Second
+
+// TimeoutsConf bounds how long, in seconds, each command may take before it
+// fails with ErrTryAgainLater, so a hung netlink request or an unreachable
+// firewall, OVS or hook backend doesn't hang the runtime
+type TimeoutsConf struct {
+	Add   int `json:"add,omitempty"`
+	Del   int `json:"del,omitempty"`
+	Check int `json:"check,omitempty"`
+	GC    int `json:"gc,omitempty"`
+}
+
+// validate returns the problems with the timeouts
+func (t *TimeoutsConf) validate() []string {
+	var problems []string
+	for _, timeout := range []struct {
+		name    string
+		seconds int
+	}{
+		{"add", t.Add},
+		{"del", t.Del},
+		{"check", t.Check},
+		{"gc", t.GC},
+	} {
+		if timeout.seconds < 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s %d must not be negative", timeout.name, timeout.seconds))
+		}
+	}
+	return problems
+}
+
+// commandTimeout returns how long the command may take
+func (c *PluginConf) commandTimeout(command string) time.Duration {
+	seconds := 0
+	if t := c.Timeouts; t != nil {
+		switch command {
+		case "ADD":
+			seconds = t.Add
+		case "DEL":
+			seconds = t.Del
+		case "CHECK":
+			seconds = t.Check
+		case "GC":
+			seconds = t.GC
+		}
+	}
+	if seconds == 0 {
+		return defaultCommandTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// bounded wraps a command to run with the network's deadline for it. Waits
+// the command makes, for the network lock and hooks, end with the context,
+// and the command checks the deadline between its steps, so an ADD that
+// runs out of time rolls back what it set up before failing. Netlink
+// requests time out with the command, rather than being retried, so a hung
+// one fails the command too.
+func bounded(command string, cmd func(context.Context, *skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		conf, err := parseConfig(args.StdinData)
+		if err != nil {
+			return err
+		}
+		timeout := conf.commandTimeout(command)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := netlink.SetSocketTimeout(timeout); err != nil {
+			return newError(types.ErrInternal, "failed to set netlink timeout", err)
+		}
+		deadline, _ := ctx.Deadline()
+		retry.SetDeadline(deadline)
+
+		err = cmd(ctx, args)
+		// Whatever failed once the deadline passed, e.g. a netlink request
+		// timing out, is worth trying again later
+		var e *types.Error
+		if ctx.Err() != nil && errors.As(err, &e) && e.Code != types.ErrTryAgainLater {
+			return newError(types.ErrTryAgainLater, e.Msg, fmt.Errorf("%s: %v", e.Details, ctx.Err()))
+		}
+		return err
+	}
+}
+
+// deadlineError returns the error of a wait ended by the command's deadline
+func deadlineError(ctx context.Context, what string) error {
+	return newError(types.ErrTryAgainLater, fmt.Sprintf("command deadline passed %s", what), ctx.Err())
+}
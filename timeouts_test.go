@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+func TestBounded(t *testing.T) {
+	args := &skel.CmdArgs{StdinData: []byte(`{
+		"cniVersion": "1.0.0",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"timeouts": {"check": 1}
+	}`)}
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if got := conf.commandTimeout("ADD"); got != defaultCommandTimeout {
+		t.Fatalf("Expected default ADD timeout, got %s", got)
+	}
+
+	defer netlink.SetSocketTimeout(netlink.GetSocketTimeout())
+	defer retry.SetDeadline(time.Time{})
+
+	// A command waiting past its deadline ends with it, through its own
+	// rollback rather than abandoned
+	rolledBack := false
+	start := time.Now()
+	err = bounded("CHECK", func(ctx context.Context, _ *skel.CmdArgs) error {
+		<-ctx.Done()
+		rolledBack = true
+		return deadlineError(ctx, "checking")
+	})(args)
+	if err == nil || err.(*types.Error).Code != types.ErrTryAgainLater {
+		t.Fatalf("Expected try again later, got: %v", err)
+	}
+	if !rolledBack {
+		t.Fatalf("Expected the command to finish before CHECK returned")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Fatalf("Expected CHECK to end after its 1s timeout, took %s", elapsed)
+	}
+
+	// Failures once the deadline passed, such as a netlink request that
+	// timed out with it, are retryable
+	err = bounded("CHECK", func(ctx context.Context, _ *skel.CmdArgs) error {
+		if got := netlink.GetSocketTimeout(); got != time.Second {
+			t.Errorf("Expected netlink requests to time out after 1s, got %s", got)
+		}
+		<-ctx.Done()
+		return netlinkError("failed to get link", unix.ETIMEDOUT)
+	})(args)
+	if err == nil || err.(*types.Error).Code != types.ErrTryAgainLater || err.(*types.Error).Msg != "failed to get link" {
+		t.Fatalf("Expected try again later, got: %v", err)
+	}
+
+	// Commands finishing in time return their own result
+	err = bounded("CHECK", func(ctx context.Context, _ *skel.CmdArgs) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("Expected command context with deadline")
+		}
+		return nil
+	})(args)
+	if err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+}
+
+func TestLockNetworkDeadline(t *testing.T) {
+	conf := &PluginConf{DataDir: t.TempDir(), VxlanID: 10}
+	conf.Name = "xvm-network"
+	unlock, err := lockNetwork(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("Failed to take lock: %v", err)
+	}
+	defer unlock()
+
+	// Waiting for the busy lock ends with the command's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = lockNetwork(ctx, conf)
+	if err == nil || err.(*types.Error).Code != types.ErrTryAgainLater {
+		t.Fatalf("Expected try again later, got: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/nohns/xvm-cni/pkg/netmgr"
+)
+
+// unmanagedPatterns returns the name patterns of the network's devices on
+// the host: the bridge or shim, the VXLAN interface, and the containers'
+// host-side devices as far as their names tell them apart
+func unmanagedPatterns(conf *PluginConf) []string {
+	patterns := []string{l2Name(conf)}
+	if conf.usesVxlan() {
+		patterns = append(patterns, vxlanName(conf))
+	}
+	if pattern := hostPortPattern(conf); pattern != "" {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// hostPortPattern returns the name pattern of the containers' host-side
+// devices, the constant prefix of their name template, or "" if they have
+// none on the host or their names don't start with one
+func hostPortPattern(conf *PluginConf) string {
+	tmpl := conf.VethNameTemplate
+	if tmpl == "" {
+		switch conf.Mode {
+		case modeBridge:
+			return "veth*" // Named by the kernel
+		case modeTap:
+			tmpl = defaultTapNameTemplate
+		default:
+			return ""
+		}
+	}
+	prefix, _, _ := strings.Cut(tmpl, "{{")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "*"
+}
+
+// setupUnmanaged has NetworkManager and systemd-networkd leave the
+// network's devices alone. It must run before the devices are created.
+func setupUnmanaged(conf *PluginConf) error {
+	if err := netmgr.Setup(conf.Name, unmanagedPatterns(conf)); err != nil {
+		return newError(types.ErrInternal, "failed to mark devices unmanaged", err)
+	}
+	return nil
+}
+
+// teardownUnmanaged removes the configuration marking the network's devices
+// unmanaged, if there is any
+func teardownUnmanaged(conf *PluginConf) error {
+	if err := netmgr.Cleanup(conf.Name); err != nil {
+		return newError(types.ErrInternal, "failed to remove unmanaged devices configuration", err)
+	}
+	return nil
+}
+
+// checkUnmanaged verifies that the configuration marking the network's
+// devices unmanaged is in place
+func checkUnmanaged(conf *PluginConf) error {
+	if stale := netmgr.Stale(conf.Name, unmanagedPatterns(conf)); len(stale) > 0 {
+		return newError(types.ErrInternal, fmt.Sprintf("unmanaged devices configuration %s is missing or outdated", stale[0]), nil)
+	}
+	return nil
+}
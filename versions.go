@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types020 "github.com/containernetworking/cni/pkg/types/020"
+	types040 "github.com/containernetworking/cni/pkg/types/040"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// validateVersions returns the problems with the network's CNI versions
+func (c *PluginConf) validateVersions() []string {
+	var problems []string
+	for _, v := range c.CNIVersions {
+		if !supportsVersion(version.All.SupportedVersions(), v) {
+			problems = append(problems, fmt.Sprintf("cniVersions entry %q isn't a supported CNI version", v))
+		}
+	}
+	return problems
+}
+
+// checkVersion refuses configurations of a CNI version the network doesn't
+// accept, as runtimes do for versions a plugin doesn't advertise
+func checkVersion(conf *PluginConf) error {
+	if len(conf.CNIVersions) == 0 || supportsVersion(conf.CNIVersions, conf.CNIVersion) {
+		return nil
+	}
+	return newError(types.ErrIncompatibleCNIVersion, "incompatible CNI versions", fmt.Errorf("config is %q, network accepts %s", conf.CNIVersion, strings.Join(conf.CNIVersions, ", ")))
+}
+
+// pluginVersions returns the CNI versions the plugin advertises on VERSION
+// and accepts configurations of, for the network configuration on stdin: the
+// supported ones of its cniVersions, or all supported versions. Per the
+// spec, runtimes only send VERSION the cniVersion, which advertises all.
+func pluginVersions(stdin []byte) version.PluginInfo {
+	var conf struct {
+		CNIVersions []string `json:"cniVersions"`
+	}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return version.All
+	}
+	var versions []string
+	for _, v := range conf.CNIVersions {
+		if supportsVersion(version.All.SupportedVersions(), v) {
+			versions = append(versions, v)
+		}
+	}
+	// Configurations without a supported one are left to validation to
+	// report
+	if len(versions) == 0 {
+		return version.All
+	}
+	return version.PluginSupports(versions...)
+}
+
+// supportsVersion reports whether the versions include v
+func supportsVersion(versions []string, v string) bool {
+	for _, supported := range versions {
+		if supported == v {
+			return true
+		}
+	}
+	return false
+}
+
+// versionedResult converts the result to the CNI version the runtime
+// configured. The conversions of the CNI library keep the fields added in
+// 1.1.0, the interfaces' MTU, socket path and PCI ID and the routes' MTU,
+// MSS, priority, table and scope, which runtimes of earlier versions may
+// refuse, so they are left out.
+func versionedResult(result *current.Result, cniVersion string) (types.Result, error) {
+	versioned, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return nil, newError(types.ErrIncompatibleCNIVersion, fmt.Sprintf("failed to convert result to version %s", cniVersion), err)
+	}
+	switch r := versioned.(type) {
+	case *current.Result:
+		if r.CNIVersion != "1.0.0" {
+			break
+		}
+		// The conversion shares the interfaces and routes with the result
+		interfaces := make([]*current.Interface, 0, len(r.Interfaces))
+		for _, iface := range r.Interfaces {
+			interfaces = append(interfaces, &current.Interface{Name: iface.Name, Mac: iface.Mac, Sandbox: iface.Sandbox})
+		}
+		r.Interfaces = interfaces
+		r.Routes = basicRoutes(r.Routes)
+	case *types040.Result:
+		r.Routes = basicRoutes(r.Routes)
+	case *types020.Result:
+		for _, ipc := range []*types020.IPConfig{r.IP4, r.IP6} {
+			if ipc == nil {
+				continue
+			}
+			routes := make([]types.Route, 0, len(ipc.Routes))
+			for _, route := range ipc.Routes {
+				routes = append(routes, types.Route{Dst: route.Dst, GW: route.GW})
+			}
+			ipc.Routes = routes
+		}
+	}
+	return versioned, nil
+}
+
+// basicRoutes returns copies of the routes with only their destination and
+// gateway
+func basicRoutes(routes []*types.Route) []*types.Route {
+	if routes == nil {
+		return nil
+	}
+	basic := make([]*types.Route, 0, len(routes))
+	for _, route := range routes {
+		basic = append(basic, &types.Route{Dst: route.Dst, GW: route.GW})
+	}
+	return basic
+}
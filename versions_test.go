@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+func TestVersionedResult(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.96.0.0/12")
+	newResult := func() *current.Result {
+		return &current.Result{
+			CNIVersion: current.ImplementedSpecVersion,
+			Interfaces: []*current.Interface{
+				{Name: "eth0", Mac: "02:00:0a:f4:00:05", Mtu: 1450, Sandbox: "/var/run/netns/cni-a"},
+				{Name: "tapa1b2c3d4", Mac: "02:00:0a:f4:00:06", SocketPath: "/run/xvm-cni/vhost.sock"},
+			},
+			IPs: []*current.IPConfig{{
+				Interface: current.Int(0),
+				Address:   net.IPNet{IP: net.ParseIP("10.244.0.5"), Mask: net.CIDRMask(24, 32)},
+				Gateway:   net.ParseIP("10.244.0.1"),
+			}},
+			Routes: []*types.Route{{Dst: *dst, GW: net.ParseIP("10.244.0.1"), MTU: 1400, Priority: 100}},
+		}
+	}
+
+	for _, tc := range []struct {
+		version string
+		// want and dontWant are JSON fragments the result has and lacks
+		want     []string
+		dontWant []string
+	}{
+		{"1.1.0", []string{`"mtu":1450`, `"socketPath"`, `"priority":100`}, nil},
+		{"1.0.0", []string{`"interface":0`, `"dst":"10.96.0.0/12"`}, []string{`"mtu"`, `"socketPath"`, `"priority"`, `"version"`}},
+		{"0.4.0", []string{`"version":"4"`, `"interface":0`, `"gw":"10.244.0.1"`}, []string{`"mtu"`, `"socketPath"`, `"priority"`}},
+		{"0.3.1", []string{`"version":"4"`, `"sandbox":"/var/run/netns/cni-a"`}, []string{`"mtu"`, `"priority"`}},
+		{"0.3.0", []string{`"version":"4"`}, []string{`"mtu"`, `"priority"`}},
+		{"0.2.0", []string{`"ip4"`, `"dst":"10.96.0.0/12"`}, []string{`"mtu"`, `"priority"`, `"interfaces"`}},
+	} {
+		result := newResult()
+		versioned, err := versionedResult(result, tc.version)
+		if err != nil {
+			t.Fatalf("%s: failed to convert result: %v", tc.version, err)
+		}
+		data, err := json.Marshal(versioned)
+		if err != nil {
+			t.Fatalf("%s: failed to encode result: %v", tc.version, err)
+		}
+		got := string(data)
+		if !strings.Contains(got, `"cniVersion":"`+tc.version+`"`) {
+			t.Errorf("%s: unexpected version in %s", tc.version, got)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: expected %s in %s", tc.version, want, got)
+			}
+		}
+		for _, dontWant := range tc.dontWant {
+			if strings.Contains(got, dontWant) {
+				t.Errorf("%s: expected no %s in %s", tc.version, dontWant, got)
+			}
+		}
+		// The result ADD keeps working with is left intact
+		if result.Interfaces[0].Mtu != 1450 || result.Routes[0].Priority != 100 {
+			t.Errorf("%s: conversion changed the result", tc.version)
+		}
+	}
+}
+
+func TestCNIVersions(t *testing.T) {
+	netconf := `{
+		"cniVersion": "%s",
+		"name": "xvm-network",
+		"type": "xvm-cni",
+		"hostInterface": "eth0",
+		"subnet": "10.244.0.0/16",
+		"gateway": "10.244.0.1",
+		"cniVersions": ["0.4.0", "1.0.0"%s]
+	}`
+	conf, err := parseConfig([]byte(fmt.Sprintf(netconf, "0.4.0", "")))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got: %v", err)
+	}
+
+	// Versions the network doesn't accept are incompatible
+	_, err = parseConfig([]byte(fmt.Sprintf(netconf, "1.1.0", "")))
+	if err == nil || err.(*types.Error).Code != types.ErrIncompatibleCNIVersion {
+		t.Fatalf("Expected incompatible version, got: %v", err)
+	}
+
+	conf, err = parseConfig([]byte(fmt.Sprintf(netconf, "1.0.0", `, "2.0.0"`)))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	err = conf.Validate()
+	if err == nil || !strings.Contains(err.(*types.Error).Details, `cniVersions entry "2.0.0"`) {
+		t.Fatalf("Expected unknown version to be reported, got: %v", err)
+	}
+}
+
+func TestPluginVersions(t *testing.T) {
+	// VERSION is only given the cniVersion, and advertises all versions
+	if got := pluginVersions([]byte(`{"cniVersion": "1.0.0"}`)).SupportedVersions(); len(got) != len(version.All.SupportedVersions()) {
+		t.Fatalf("Expected all versions, got %v", got)
+	}
+	got := pluginVersions([]byte(`{"cniVersion": "1.0.0", "cniVersions": ["0.4.0", "1.0.0", "2.0.0"]}`)).SupportedVersions()
+	if strings.Join(got, ",") != "0.4.0,1.0.0" {
+		t.Fatalf("Expected the network's supported versions, got %v", got)
+	}
+	if got := pluginVersions([]byte(`not json`)).SupportedVersions(); len(got) != len(version.All.SupportedVersions()) {
+		t.Fatalf("Expected all versions, got %v", got)
+	}
+}
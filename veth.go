@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/retry"
+)
+
+// maxQueues is the largest number of queues the kernel allows on a device
+const maxQueues = 4096
+
+// vethQueues returns the number of queues of the attachment's veth pair or
+// tap, the per-attachment value taking precedence, 0 for the kernel default
+func (c *PluginConf) vethQueues() int {
+	if c.Args != nil && c.Args.CNI.VethQueues != 0 {
+		return c.Args.CNI.VethQueues
+	}
+	return c.VethQueues
+}
+
+// supportedQdiscs lists the queue disciplines that can be set without
+// further parameters
+var supportedQdiscs = map[string]bool{
+	"pfifo_fast": true,
+	"pfifo":      true,
+	"fq":         true,
+	"fq_codel":   true,
+	"sfq":        true,
+	"noqueue":    true,
+}
+
+// setupVeth creates a veth pair from the host namespace, with the container
+// end created right in the container's, whose netlink handle is contHandle.
+// It works like ip.SetupVethWithName but also applies the link attributes
+// from the configuration. An empty hostName picks a random one. It returns
+// the host end and the container end.
+func setupVeth(conf *PluginConf, contName, hostName, mac string, netns ns.NetNS, contHandle *netlink.Handle) (netlink.Link, net.Interface, error) {
+	attrs := netlink.NewLinkAttrs()
+	attrs.MTU = conf.linkMTU()
+	peerTxQLen := -1 // Kernel default
+	if conf.TxQueueLen > 0 {
+		attrs.TxQLen = conf.TxQueueLen
+		peerTxQLen = conf.TxQueueLen
+	}
+	if queues := conf.vethQueues(); queues > 0 {
+		attrs.NumTxQueues = queues
+		attrs.NumRxQueues = queues
+	}
+	var hwAddr net.HardwareAddr
+	if mac != "" {
+		var err error
+		hwAddr, err = net.ParseMAC(mac)
+		if err != nil {
+			return nil, net.Interface{}, fmt.Errorf("invalid MAC address %q: %v", mac, err)
+		}
+	}
+
+	// Retry random names on collision
+	random := hostName == ""
+	var hostVeth netlink.Link
+	for i := 0; i < 10; i++ {
+		if random {
+			name, err := ip.RandomVethName()
+			if err != nil {
+				return nil, net.Interface{}, err
+			}
+			hostName = name
+		}
+
+		veth := &netlink.Veth{
+			LinkAttrs:        attrs,
+			PeerName:         contName,
+			PeerHardwareAddr: hwAddr,
+			PeerNamespace:    netlink.NsFd(int(netns.Fd())),
+			PeerMTU:          uint32(conf.linkMTU()),
+			PeerTxQLen:       peerTxQLen,
+			PeerNumTxQueues:  uint32(conf.vethQueues()),
+			PeerNumRxQueues:  uint32(conf.vethQueues()),
+		}
+		veth.Name = hostName
+		err := retry.Do(func() error { return netlink.LinkAdd(veth) })
+		if err == nil {
+			hostVeth = veth
+			break
+		}
+		if !random || !errors.Is(err, unix.EEXIST) {
+			return nil, net.Interface{}, fmt.Errorf("failed to create veth pair %s/%s: %v", contName, hostName, err)
+		}
+	}
+	if hostVeth == nil {
+		return nil, net.Interface{}, fmt.Errorf("failed to find a free host veth name")
+	}
+
+	// Re-read both ends to pick up kernel-assigned attributes
+	hostLink, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return nil, net.Interface{}, fmt.Errorf("failed to get host veth %s: %v", hostName, err)
+	}
+	contLink, err := contHandle.LinkByName(contName)
+	if err != nil {
+		return nil, net.Interface{}, fmt.Errorf("failed to get container veth %s: %v", contName, err)
+	}
+
+	return hostLink, linkInterface(contLink), nil
+}
+
+// linkInterface converts a netlink link to a net.Interface
+func linkInterface(link netlink.Link) net.Interface {
+	return net.Interface{
+		Index:        link.Attrs().Index,
+		MTU:          link.Attrs().MTU,
+		Name:         link.Attrs().Name,
+		HardwareAddr: link.Attrs().HardwareAddr,
+		Flags:        link.Attrs().Flags,
+	}
+}
+
+// setQdisc replaces the root queue discipline of the link
+func setQdisc(link netlink.Link, kind string) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		QdiscType: kind,
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return fmt.Errorf("failed to set qdisc %s on %s: %v", kind, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// clearQdisc removes the root queue discipline set by setQdisc, so the kernel
+// default takes over again
+func clearQdisc(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs on %s: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent != netlink.HANDLE_ROOT || attrs.Handle != netlink.MakeHandle(1, 0) {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("failed to delete qdisc %s on %s: %v", qdisc.Type(), link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// deleteLink deletes the link with the given name, if it still exists
+func deleteLink(name string) error {
+	if err := ip.DelLinkByName(name); err != nil && err != ip.ErrLinkNotFound {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/nohns/xvm-cni/pkg/bridge"
+)
+
+// vlan returns the VLAN of the attachment's bridge port, args.cni.vlan
+// taking precedence over the network's, 0 for the bridge's default VLAN
+func (c *PluginConf) vlan() int {
+	if c.Args != nil && c.Args.CNI.VLAN != 0 {
+		return c.Args.CNI.VLAN
+	}
+	return c.VLAN
+}
+
+// gatewayVLAN returns the VLAN of the attachment's bridge port if it's one
+// the node's addresses aren't in, 0 otherwise
+func (c *PluginConf) gatewayVLAN() int {
+	if vid := c.vlan(); vid != bridge.DefaultVLAN {
+		return vid
+	}
+	return 0
+}
+
+// gatewayVLANName returns the name of the interface carrying the gateway
+// into the VLAN
+func gatewayVLANName(conf *PluginConf, vid int) string {
+	return bridge.GatewayVLANName(conf.Name, vid)
+}
+
+// setupGatewayVLAN gives the containers of the attachment's VLAN their
+// gateway through a VLAN interface on the bridge holding the gateway
+// addresses. The host routes to the containers go through it.
+func setupGatewayVLAN(conf *PluginConf, br *netlink.Bridge) error {
+	vid := conf.gatewayVLAN()
+	if vid == 0 {
+		return nil
+	}
+	link, err := bridge.SetupGatewayVLAN(br, gatewayVLANName(conf, vid), vid)
+	if err != nil {
+		return netlinkError("failed to setup gateway VLAN", err)
+	}
+	// The addresses are the bridge's, so they take no prefix route from it
+	// and skip duplicate address detection
+	for _, gateway := range gatewayAddrs(conf) {
+		addr := &netlink.Addr{IPNet: hostRouteDst(gateway.IP), Flags: unix.IFA_F_NODAD}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return netlinkError("failed to configure gateway VLAN", err)
+		}
+	}
+	return nil
+}
+
+// enableVLANFiltering has the bridge separate the VLANs, with the VXLAN
+// interface carrying them all to the other nodes
+func enableVLANFiltering(br *netlink.Bridge, vxlanIface netlink.Link) error {
+	if err := bridge.EnableVLANFiltering(br, vxlanIface); err != nil {
+		return netlinkError("failed to enable VLAN filtering", err)
+	}
+	return nil
+}
+
+// setPortVLAN places the attachment's bridge port in its VLAN, along with
+// the gateway
+func setPortVLAN(conf *PluginConf, br *netlink.Bridge, port netlink.Link) error {
+	vid := conf.vlan()
+	if vid == 0 {
+		return nil
+	}
+	if err := bridge.SetPortVLAN(port, vid); err != nil {
+		return netlinkError("failed to set port VLAN", err)
+	}
+	return setupGatewayVLAN(conf, br)
+}
+
+// checkPortVLAN checks that the attachment's bridge port is in its VLAN
+func checkPortVLAN(conf *PluginConf, args *skel.CmdArgs) error {
+	name, err := hostPortName(conf, args)
+	if err != nil {
+		return err
+	}
+	port, err := netlink.LinkByName(name)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to get %s", name), err)
+	}
+	vid, err := bridge.PortVLAN(port)
+	if err != nil {
+		return netlinkError("failed to list VLANs", err)
+	}
+	if vid != conf.vlan() {
+		return newError(types.ErrInternal, fmt.Sprintf("%s is in VLAN %d, not %d", name, vid, conf.vlan()), nil)
+	}
+	return nil
+}